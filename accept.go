@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Ways of checking the Accept header of requests
+const (
+	acceptCheckOff     = "off"
+	acceptCheckLenient = "lenient"
+	acceptCheckStrict  = "strict"
+)
+
+// acceptCheck is how requests that can't take JSON are refused: not at all,
+// only when their Accept header clearly rules JSON out, or also when it can't
+// be parsed
+var acceptCheck = acceptCheckLenient
+
+var errNotAcceptable = errors.New("responses are only available as application/json")
+
+func isValidAcceptCheck(mode string) bool {
+	return mode == acceptCheckOff || mode == acceptCheckLenient || mode == acceptCheckStrict
+}
+
+// acceptsJSON reports whether an Accept header takes JSON responses. The most
+// specific media range matching JSON decides, so application/json;q=0 rules
+// it out even alongside */*. Headers that can't be parsed take anything,
+// unless strict.
+func acceptsJSON(accept string, strict bool) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+
+	specificity, q := -1, 0.0
+	for _, accepted := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			if !strict {
+				return true
+			}
+			continue
+		}
+
+		var matched int
+		switch mediaType {
+		case "application/json", problemContentType:
+			matched = 2
+		case "application/*":
+			matched = 1
+		case "*/*":
+			matched = 0
+		default:
+			continue
+		}
+		if matched < specificity {
+			continue
+		}
+
+		value := 1.0
+		if raw, ok := params["q"]; ok {
+			if value, err = strconv.ParseFloat(raw, 64); err != nil {
+				value = 1.0
+			}
+		}
+		if matched > specificity || value > q {
+			specificity, q = matched, value
+		}
+	}
+	return q > 0
+}
+
+// acceptMiddleware refuses requests that can't take JSON with a 406 before
+// running any handler, since JSON is all we respond with
+func acceptMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptCheck != acceptCheckOff && !acceptsJSON(r.Header.Get("Accept"), acceptCheck == acceptCheckStrict) {
+			respondWithError("unable to serve request", errNotAcceptable, w, http.StatusNotAcceptable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		strict bool
+		want   bool
+	}{
+		{"", false, true},
+		{"application/json", false, true},
+		{"*/*", false, true},
+		{"application/*", false, true},
+		{"application/problem+json", false, true},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", false, true},
+		{"text/html", false, false},
+		{"text/html, text/plain", false, false},
+		{"application/json;q=0", false, false},
+		{"*/*, application/json;q=0", false, false},
+		{"text/html;q=0.9, application/*;q=0", false, false},
+		{"not a/media type;;", false, true},
+		{"not a/media type;;", true, false},
+		{"not a/media type;;, application/json", true, true},
+	}
+
+	for _, test := range tests {
+		if got := acceptsJSON(test.accept, test.strict); got != test.want {
+			t.Errorf("Expected %q (strict %v) to accept JSON %v but got: %v", test.accept, test.strict, test.want, got)
+		}
+	}
+}
+
+func TestAcceptMiddleware(t *testing.T) {
+	defer func(mode string) { acceptCheck = mode }(acceptCheck)
+
+	handled := false
+	handler := acceptMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+	}))
+	request := func(accept string) int {
+		handled = false
+		req := httptest.NewRequest("GET", "/users", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	acceptCheck = acceptCheckLenient
+	if status := request("text/html"); status != http.StatusNotAcceptable || handled {
+		t.Errorf("Expected a 406 status code response before the handler but got: %d", status)
+	}
+	if status := request("application/json"); status != http.StatusOK || !handled {
+		t.Errorf("Expected JSON requests to be handled but got: %d", status)
+	}
+
+	acceptCheck = acceptCheckOff
+	if status := request("text/html"); status != http.StatusOK || !handled {
+		t.Errorf("Expected the check to be off but got: %d", status)
+	}
+}
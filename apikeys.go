@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// apiKeyScheme is the Authorization scheme of API keys, which callers use
+// instead of Bearer
+const apiKeyScheme = "apikey"
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognize
+const apiKeyPrefix = "bzk_"
+
+// API keys are apiKeyPrefix, the hex encoded id and the hex encoded secret,
+// separated by an underscore
+const (
+	apiKeyIDBytes     = 8
+	apiKeySecretBytes = 32
+)
+
+var (
+	errInvalidAPIKey     = errors.New("invalid or expired API key")
+	errAPIKeyNotFound    = errors.New("API key not found")
+	errScopeNotGranted   = errors.New("the user's role doesn't grant every scope of the API key")
+	errAPIKeyNotAllowed  = errors.New("API keys can't manage API keys, log in instead")
+	errAPIKeyScopeDenied = errors.New("the API key doesn't have the scope for this request")
+	errTooManyAPIKeys    = errors.New("too many API keys, revoke an old one before creating another")
+)
+
+// maxAPIKeysPerUser is how many active API keys a user can have at once, no
+// limit when it's 0
+var maxAPIKeysPerUser = 20
+
+// findAPIKey looks up the API key with id and the user it belongs to
+var findAPIKey = findStoredAPIKey
+
+// newAPIKey returns a random API key along with its id
+func newAPIKey() (string, string, error) {
+	b := make([]byte, apiKeyIDBytes+apiKeySecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	id := hex.EncodeToString(b[:apiKeyIDBytes])
+	return id, apiKeyPrefix + id + "_" + hex.EncodeToString(b[apiKeyIDBytes:]), nil
+}
+
+// parseAPIKey returns the id of key, refusing keys that don't look like one
+// we minted without looking them up
+func parseAPIKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if len(parts) != 2 || len(parts[0]) != hex.EncodedLen(apiKeyIDBytes) || len(parts[1]) != hex.EncodedLen(apiKeySecretBytes) {
+		return "", false
+	}
+	for _, part := range parts {
+		if _, err := hex.DecodeString(part); err != nil {
+			return "", false
+		}
+	}
+	return parts[0], true
+}
+
+// apiKeyDisplayPrefix is what listings show of an API key, enough to tell
+// keys apart but not to use them
+func apiKeyDisplayPrefix(id string) string {
+	return apiKeyPrefix + id
+}
+
+// apiKeyCollection returns the collection of API keys, making sure the
+// database drops expired ones. Keys without an expiry are kept until revoked.
+func apiKeyCollection(session *mgo.Session) (*mgo.Collection, error) {
+	collection := session.DB("buzz-test-user").C("api_keys")
+
+	index := mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second,
+	}
+	if err := collection.EnsureIndex(index); err != nil {
+		return nil, err
+	}
+	if err := collection.EnsureIndexKey("user_id"); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+func findStoredAPIKey(ctx context.Context, id string) (*model.APIKey, *model.User, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of API keys
+	collection, err := apiKeyCollection(session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key model.APIKey
+	if err := collection.FindId(id).One(&key); err == mgo.ErrNotFound {
+		return nil, nil, errInvalidAPIKey
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := userService{}.GetByID(ctx, key.UserID)
+	if err == errUserNotFound {
+		return nil, nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &key, user, nil
+}
+
+// authenticateAPIKey checks key, returning claims for the user it belongs to
+// like the ones of their tokens. The claims carry the scopes of the key, which
+// limit what it can do. Errors other than errInvalidAPIKey mean the key
+// couldn't be checked at all.
+func authenticateAPIKey(ctx context.Context, key string) (map[string]interface{}, error) {
+	id, ok := parseAPIKey(key)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+
+	stored, user, err := findAPIKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashRefreshToken(key))) != 1 {
+		return nil, errInvalidAPIKey
+	}
+
+	// The database only drops expired keys once in a while
+	if stored.ExpiresAt != nil && !time.Now().Before(*stored.ExpiresAt) {
+		return nil, errInvalidAPIKey
+	}
+	if !canLogIn(user.Status) {
+		return nil, errInvalidAPIKey
+	}
+
+	scopes := make([]interface{}, len(stored.Scopes))
+	for i, scope := range stored.Scopes {
+		scopes[i] = scope
+	}
+	return map[string]interface{}{
+		"sub":      user.ID,
+		"username": user.Username,
+		"role":     user.Role,
+		"api_key":  stored.ID,
+		"scopes":   scopes,
+	}, nil
+}
+
+// apiKeyScopes returns the scopes of the API key claims were made for, and
+// whether they were made for one at all
+func apiKeyScopes(claims map[string]interface{}) ([]string, bool) {
+	if _, ok := claims["api_key"]; !ok {
+		return nil, false
+	}
+	return claimScopes(claims), true
+}
+
+// claimScopes returns the scopes claims carry
+func claimScopes(claims map[string]interface{}) []string {
+	granted, _ := claims["scopes"].([]interface{})
+	scopes := make([]string, 0, len(granted))
+	for _, scope := range granted {
+		if s, ok := scope.(string); ok {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// apiKeyAllows reports whether an API key with scopes can make a request with
+// method. Reading needs users:read and anything else users:write.
+func apiKeyAllows(scopes []string, method string) bool {
+	needed := scopeUsersWrite
+	if method == "GET" || method == "HEAD" {
+		needed = scopeUsersRead
+	}
+	return len(missingScopes([]string{needed}, scopes)) == 0
+}
+
+// requireTokenLogin refuses callers authenticated with an API key, for the
+// routes managing API keys. A leaked key can't be used to mint more keys.
+func requireTokenLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := apiKeyScopes(claimsFromContext(r)); ok {
+			respondWithError("Access not allowed", errAPIKeyNotAllowed, w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// countActiveAPIKeys counts the API keys of userID that haven't expired. The
+// database drops expired keys, but not right away.
+func countActiveAPIKeys(collection *mgo.Collection, userID string, now time.Time) (int, error) {
+	return collection.Find(bson.M{
+		"user_id": userID,
+		"$or":     []bson.M{{"expires_at": nil}, {"expires_at": bson.M{"$gt": now}}},
+	}).Count()
+}
+
+// apiKeysOf returns the API keys of userID, newest first
+func apiKeysOf(collection *mgo.Collection, userID string) ([]model.APIKey, error) {
+	keys := []model.APIKey{}
+	err := collection.Find(bson.M{"user_id": userID}).Sort("-created_at").All(&keys)
+	return keys, err
+}
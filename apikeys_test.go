@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// useAPIKey makes key with scopes, belonging to a user with role, the only
+// one findAPIKey finds until the returned func is called
+func useAPIKey(t *testing.T, role string, scopes []string, expiresAt *time.Time) (string, func()) {
+	id, key, err := newAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := &model.APIKey{ID: id, UserID: "keyOwnerID", Prefix: apiKeyDisplayPrefix(id), Hash: hashRefreshToken(key), Scopes: scopes, ExpiresAt: expiresAt}
+	user := &model.User{ID: "keyOwnerID", Username: "owner", Role: role, Status: statusActive}
+
+	previous := findAPIKey
+	findAPIKey = func(ctx context.Context, lookup string) (*model.APIKey, *model.User, error) {
+		if lookup != id {
+			return nil, nil, errInvalidAPIKey
+		}
+		return stored, user, nil
+	}
+	return key, func() { findAPIKey = previous }
+}
+
+func TestParseAPIKey(t *testing.T) {
+	id, key, err := newAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, apiKeyDisplayPrefix(id)+"_") {
+		t.Errorf("Expected the key to start with its prefix but got: %s", key)
+	}
+	if parsed, ok := parseAPIKey(key); !ok || parsed != id {
+		t.Errorf("Expected the key to parse to %s but got: %s", id, parsed)
+	}
+
+	for _, malformed := range []string{"", id, "bzk_" + id, "bzk_" + id + "_short", strings.Replace(key, "bzk_", "xyz_", 1), key + "_extra"} {
+		if _, ok := parseAPIKey(malformed); ok {
+			t.Errorf("Expected %q to be refused", malformed)
+		}
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sub, _ := claimsFromContext(r)["sub"].(string); sub != "keyOwnerID" {
+			t.Errorf("Expected the key owner to be calling but got: %q", sub)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	call := func(method, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/users/keyOwnerID", nil)
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	key, restore := useAPIKey(t, "student", []string{scopeUsersRead}, nil)
+	if rec := call("GET", "ApiKey "+key); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected the key to be let in but got: %d", rec.Code)
+	}
+	if rec := call("PATCH", "ApiKey "+key); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a read only key to be refused writing but got: %d", rec.Code)
+	}
+	if rec := call("GET", "ApiKey "+key[:len(key)-1]+"0"); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != `ApiKey error="invalid_token"` {
+		t.Errorf("Expected a wrong secret to get an ApiKey challenge but got: %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+	if rec := call("GET", "Bearer "+key); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a key sent as a bearer token to be refused but got: %d", rec.Code)
+	}
+	restore()
+
+	key, restore = useAPIKey(t, "student", []string{scopeUsersRead}, &past)
+	defer restore()
+	if rec := call("GET", "ApiKey "+key); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired key to be refused but got: %d", rec.Code)
+	}
+}
+
+func TestAPIKeyRoles(t *testing.T) {
+	handler := adminMiddleware(requireTokenLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	call := func(key string) int {
+		req := httptest.NewRequest("GET", "/users", nil)
+		req.Header.Set("Authorization", "ApiKey "+key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// An admin's key acts as an admin only with every scope of the role
+	key, restore := useAPIKey(t, "admin", []string{scopeUsersRead}, nil)
+	if code := call(key); code != http.StatusForbidden {
+		t.Errorf("Expected a partial admin key not to act as an admin but got: %d", code)
+	}
+	restore()
+
+	key, restore = useAPIKey(t, "admin", scopesFor("admin"), nil)
+	defer restore()
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "ApiKey "+key)
+	if !isAdminRequest(req) {
+		t.Error("Expected a full admin key to act as an admin")
+	}
+	if code := call(key); code != http.StatusForbidden {
+		t.Errorf("Expected keys to be refused where logging in is required but got: %d", code)
+	}
+}
+
+func TestValidateCreateAPIKey(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	for _, payload := range []struct {
+		name      string
+		scopes    []string
+		expiresAt *time.Time
+	}{
+		{" ", []string{scopeUsersRead}, nil},
+		{"ci", nil, nil},
+		{"ci", []string{"users:delete"}, nil},
+		{"ci", []string{scopeUsersRead}, &past},
+	} {
+		if err := validateCreateAPIKey(&reqres.CreateAPIKeyRequest{Name: payload.name, Scopes: payload.scopes, ExpiresAt: payload.expiresAt}, now); err == nil {
+			t.Errorf("Expected %+v to be refused", payload)
+		}
+	}
+	if err := validateCreateAPIKey(&reqres.CreateAPIKeyRequest{Name: "ci", Scopes: []string{scopeUsersRead}}, now); err != nil {
+		t.Errorf("Expected a valid key to be accepted but got: %v", err)
+	}
+}
+
+func TestAPIKeyLimit(t *testing.T) {
+	defer func(limit int) { maxAPIKeysPerUser = limit }(maxAPIKeysPerUser)
+	maxAPIKeysPerUser = 2
+
+	svc := userService{}
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "keylimit@test.com", FirstName: "key", LastName: "limit", Password: password, Role: "student", Username: "keyLimitUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	// Expired keys don't count
+	past := time.Now().Add(-time.Minute)
+	expired, _, err := svc.CreateAPIKey(context.Background(), user.ID, "expired", nil, &past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.RevokeAPIKey(context.Background(), user.ID, expired.ID)
+
+	for i := 0; i < maxAPIKeysPerUser; i++ {
+		apiKey, _, err := svc.CreateAPIKey(context.Background(), user.ID, "key", nil, nil)
+		if err != nil {
+			t.Fatalf("Expected key %d to be created but got: %v", i+1, err)
+		}
+		defer svc.RevokeAPIKey(context.Background(), user.ID, apiKey.ID)
+	}
+
+	if _, _, err := svc.CreateAPIKey(context.Background(), user.ID, "one too many", nil, nil); err != errTooManyAPIKeys {
+		t.Fatalf("Expected the key over the limit to be refused but got: %v", err)
+	}
+	if keys, err := svc.ListAPIKeys(context.Background(), user.ID); err != nil || len(keys) != maxAPIKeysPerUser+1 {
+		t.Errorf("Expected the refused key not to be kept but got: %d %v", len(keys), err)
+	}
+}
+
+// tooManyKeysService refuses every API key
+type tooManyKeysService struct {
+	UserService
+}
+
+func (tooManyKeysService) CreateAPIKey(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (*model.APIKey, string, error) {
+	return nil, "", errTooManyAPIKeys
+}
+
+func TestCreateAPIKeyOverLimit(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleCreateAPIKey(tooManyKeysService{}).ServeHTTP(rec, httptest.NewRequest("POST", "/users/keyOwnerID/apikeys", strings.NewReader(`{"name":"ci","scopes":["`+scopeUsersRead+`"]}`)))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("Expected a 409 but got: %d", rec.Code)
+	}
+	var payload reqres.ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil || payload.Code != tooManyAPIKeysCode {
+		t.Errorf("Expected the too many API keys code but got: %+v %v", payload, err)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+)
+
+// auditPayloadLimit is how much of a request body the audit trail summarizes
+const auditPayloadLimit = 64 << 10
+
+// auditSensitiveFields are request fields whose values never reach the audit
+// trail
+var auditSensitiveFields = map[string]bool{
+	"password":         true,
+	"current_password": true,
+	"new_password":     true,
+	"token":            true,
+	"refresh_token":    true,
+	"proof_token":      true,
+	"code":             true,
+	"date_of_birth":    true,
+}
+
+// auditStore keeps the audit trail of mutating requests. Nothing is audited
+// when it's nil.
+var auditStore AuditStore
+
+// auditMu keeps this instance from chaining two entries to the same one. The
+// store refusing a taken sequence number covers other instances.
+var auditMu sync.Mutex
+
+var (
+	errAuditSeqTaken = errors.New("audit entry sequence number is taken")
+	errAuditChain    = errors.New("audit trail has been tampered with")
+)
+
+// AuditStore is an interface for keeping the audit trail in order
+type AuditStore interface {
+	// Last returns the latest entry, nil when there is none
+	Last() (*model.AuditEntry, error)
+
+	// Append stores entry, failing with errAuditSeqTaken when its sequence
+	// number is already used
+	Append(entry *model.AuditEntry) error
+
+	// Entries returns every entry in sequence
+	Entries() ([]model.AuditEntry, error)
+}
+
+// auditEntryHash returns the hash an entry is chained with, made from its
+// fields and the hash of the entry before it
+func auditEntryHash(entry *model.AuditEntry) string {
+	h := sha256.New()
+	for _, field := range []string{
+		strconv.FormatInt(entry.Seq, 10),
+		entry.PrevHash,
+		entry.Actor,
+		entry.Method,
+		entry.Path,
+		entry.Payload,
+		strconv.Itoa(entry.Status),
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+	} {
+		// Length prefixes keep fields from bleeding into each other
+		fmt.Fprintf(h, "%d:%s;", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordAudit chains entry to the latest one and stores it
+func recordAudit(store AuditStore, entry *model.AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	for {
+		last, err := store.Last()
+		if err != nil {
+			return err
+		}
+		entry.Seq, entry.PrevHash = 1, ""
+		if last != nil {
+			entry.Seq, entry.PrevHash = last.Seq+1, last.Hash
+		}
+		entry.Hash = auditEntryHash(entry)
+
+		// Another instance got there first, chain to its entry instead
+		if err := store.Append(entry); err != errAuditSeqTaken {
+			return err
+		}
+	}
+}
+
+// verifyAuditChain checks that every entry is intact and chained to the one
+// before it. It returns how many entries were checked and, when the chain is
+// broken, the sequence number of the first entry that doesn't check out.
+func verifyAuditChain(entries []model.AuditEntry) (int, int64, error) {
+	prevHash := ""
+	for i, entry := range entries {
+		if entry.Seq != int64(i+1) || entry.PrevHash != prevHash || entry.Hash != auditEntryHash(&entry) {
+			return i, int64(i + 1), errAuditChain
+		}
+		prevHash = entry.Hash
+	}
+	return len(entries), 0, nil
+}
+
+// auditMiddleware records an entry in the audit trail for every mutating
+// request, with who made it, a summary of its payload without secrets and the
+// status it got. Failing to record an entry doesn't fail the request.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auditStore == nil || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Hand the handler the body we read, followed by the rest of it
+		head, _ := ioutil.ReadAll(io.LimitReader(r.Body, auditPayloadLimit))
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(head), r.Body))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		entry := &model.AuditEntry{
+			Actor:     auditActor(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Payload:   auditPayload(head),
+			Status:    rec.status,
+			CreatedAt: time.Now(),
+		}
+		if err := recordAudit(auditStore, entry); err != nil {
+			log.Println("unable to record audit entry:", err)
+		}
+	})
+}
+
+// statusRecorder remembers the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush sends what was written so far, so streamed responses aren't held back
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// auditActor returns who made a request, going by its token. Requests made
+// with an API key are told apart by the key, which isn't looked up. Requests
+// without a valid token are anonymous.
+func auditActor(r *http.Request) string {
+	if key, ok := apiKeyCredential(r); ok {
+		if id, ok := parseAPIKey(key); ok {
+			return "apikey:" + id
+		}
+		return ""
+	}
+
+	jwtToken, err := bearerToken(r)
+	if err != nil {
+		return ""
+	}
+	token, err := parseToken(jwtToken)
+	if err != nil {
+		return ""
+	}
+	// Impersonation tokens name both the admin and the user acted as
+	sub, _ := token.Claims["sub"].(string)
+	if admin := impersonatorOf(token.Claims); admin != "" {
+		return admin + " as " + sub
+	}
+	return sub
+}
+
+// auditPayload summarizes a JSON request body, with the values of sensitive
+// fields and nested values left out. Other bodies are only described by size.
+func auditPayload(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Sprintf("[%d bytes]", len(body))
+	}
+	for key, value := range fields {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			fields[key] = "[omitted]"
+		}
+		if auditSensitiveFields[key] {
+			fields[key] = "[redacted]"
+		}
+	}
+
+	summary, err := json.Marshal(fields)
+	if err != nil {
+		return ""
+	}
+	return string(summary)
+}
+
+// memoryAuditStore keeps the audit trail in memory, for tests only
+type memoryAuditStore struct {
+	mu      sync.Mutex
+	entries []model.AuditEntry
+}
+
+func (s *memoryAuditStore) Last() (*model.AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) == 0 {
+		return nil, nil
+	}
+	last := s.entries[len(s.entries)-1]
+	return &last, nil
+}
+
+func (s *memoryAuditStore) Append(entry *model.AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.Seq != int64(len(s.entries)+1) {
+		return errAuditSeqTaken
+	}
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+func (s *memoryAuditStore) Entries() ([]model.AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]model.AuditEntry{}, s.entries...), nil
+}
+
+// mongoAuditStore keeps the audit trail in the database, shared by every
+// instance
+type mongoAuditStore struct{}
+
+// auditCollection returns the collection of audit entries, making sure no two
+// share a sequence number
+func auditCollection(session *mgo.Session) (*mgo.Collection, error) {
+	collection := session.DB("buzz-test-user").C("audit_trail")
+	if err := collection.EnsureIndex(mgo.Index{Key: []string{"seq"}, Unique: true}); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+func (mongoAuditStore) Last() (*model.AuditEntry, error) {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	collection, err := auditCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var last model.AuditEntry
+	err = collection.Find(nil).Sort("-seq").One(&last)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &last, nil
+}
+
+func (mongoAuditStore) Append(entry *model.AuditEntry) error {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	collection, err := auditCollection(session)
+	if err != nil {
+		return err
+	}
+
+	entry.ID = strconv.FormatInt(entry.Seq, 10)
+	err = collection.Insert(entry)
+	if mgo.IsDup(err) {
+		return errAuditSeqTaken
+	}
+	return err
+}
+
+func (mongoAuditStore) Entries() ([]model.AuditEntry, error) {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	collection, err := auditCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []model.AuditEntry{}
+	if err := collection.Find(nil).Sort("seq").All(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
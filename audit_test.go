@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+func TestVerifyAuditChain(t *testing.T) {
+	store := &memoryAuditStore{}
+	for _, path := range []string{"/users", "/users/1", "/auth/authenticate"} {
+		entry := &model.AuditEntry{Actor: "admin", Method: "POST", Path: path, Status: http.StatusOK, CreatedAt: time.Now()}
+		if err := recordAudit(store, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, _ := store.Entries()
+	if checked, _, err := verifyAuditChain(entries); err != nil || checked != 3 {
+		t.Fatalf("Expected an intact chain of 3 entries but got: %d, %v", checked, err)
+	}
+
+	// Changing a past entry breaks the chain at that entry
+	store.entries[1].Status = http.StatusForbidden
+	entries, _ = store.Entries()
+	if _, brokenAt, err := verifyAuditChain(entries); err != errAuditChain || brokenAt != 2 {
+		t.Errorf("Expected the chain to break at entry 2 but got: %d, %v", brokenAt, err)
+	}
+
+	// So does rehashing it, since the next entry is chained to the old hash
+	store.entries[1].Hash = auditEntryHash(&store.entries[1])
+	entries, _ = store.Entries()
+	if _, brokenAt, err := verifyAuditChain(entries); err != errAuditChain || brokenAt != 3 {
+		t.Errorf("Expected the chain to break at entry 3 but got: %d, %v", brokenAt, err)
+	}
+
+	// And removing an entry
+	entries = append(entries[:1], entries[2:]...)
+	if _, _, err := verifyAuditChain(entries); err != errAuditChain {
+		t.Errorf("Expected a removed entry to break the chain but got: %v", err)
+	}
+}
+
+func TestAuditPayload(t *testing.T) {
+	payload := auditPayload([]byte(`{"username":"jdoe","password":"secret","roles":["admin"]}`))
+	if strings.Contains(payload, "secret") || !strings.Contains(payload, `"password":"[redacted]"`) {
+		t.Errorf("Expected the password to be redacted but got: %s", payload)
+	}
+	if !strings.Contains(payload, `"username":"jdoe"`) || !strings.Contains(payload, `"roles":"[omitted]"`) {
+		t.Errorf("Expected a summary of the other fields but got: %s", payload)
+	}
+
+	if payload := auditPayload([]byte("not json")); payload != "[8 bytes]" {
+		t.Errorf("Expected other bodies to be described by size but got: %s", payload)
+	}
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	store := &memoryAuditStore{}
+	auditStore = store
+	defer func() { auditStore = nil }()
+
+	handler := auditMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == "POST" && string(body) != `{"password":"secret"}` {
+			t.Errorf("Expected the handler to get the whole body but got: %s", body)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users", strings.NewReader(`{"password":"secret"}`)))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	entries, _ := store.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("Expected only the mutating request to be audited but got: %d entries", len(entries))
+	}
+	if entries[0].Method != "POST" || entries[0].Path != "/users" || entries[0].Status != http.StatusCreated {
+		t.Errorf("Expected the request and its result to be recorded but got: %+v", entries[0])
+	}
+	if strings.Contains(entries[0].Payload, "secret") {
+		t.Errorf("Expected the payload to be redacted but got: %s", entries[0].Payload)
+	}
+}
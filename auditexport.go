@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Formats the audit log can be exported in
+const (
+	auditExportJSON = "json"
+	auditExportCEF  = "cef"
+)
+
+var (
+	// cefVendor and cefProduct name the device of CEF audit exports
+	cefVendor  = "Buzz"
+	cefProduct = "users"
+)
+
+// AuditLogExporter is implemented by sinks the audit log can be streamed from
+type AuditLogExporter interface {
+	// Export calls fn with every event since, oldest first, stopping at the
+	// first error
+	Export(since time.Time, fn func(event *model.AuditEvent) error) error
+}
+
+func isValidAuditExportFormat(format string) bool {
+	return format == auditExportJSON || format == auditExportCEF
+}
+
+// writeAuditExport writes event to w in format, a line per event
+func writeAuditExport(w io.Writer, format string, event *model.AuditEvent) error {
+	if format == auditExportCEF {
+		_, err := io.WriteString(w, cefLine(event)+"\n")
+		return err
+	}
+	return json.NewEncoder(w).Encode(reqres.AuditExportEvent{
+		Actor:     event.Actor,
+		Target:    event.UserID,
+		Event:     event.Action,
+		Outcome:   event.Outcome,
+		IP:        event.IP,
+		Timestamp: event.CreatedAt,
+	})
+}
+
+// cefLine returns event as a line of ArcSight's Common Event Format. Failed
+// actions are of a higher severity than the ones that worked.
+func cefLine(event *model.AuditEvent) string {
+	severity := "3"
+	if event.Outcome == auditOutcomeFailure {
+		severity = "7"
+	}
+	header := []string{
+		"CEF:0",
+		cefHeaderEscaper.Replace(cefVendor),
+		cefHeaderEscaper.Replace(cefProduct),
+		cefHeaderEscaper.Replace(Version),
+		cefHeaderEscaper.Replace(event.Action),
+		cefHeaderEscaper.Replace("user " + event.Action),
+		severity,
+	}
+	extension := []string{
+		"rt=" + strconv.FormatInt(event.CreatedAt.UnixNano()/int64(time.Millisecond), 10),
+		"suser=" + cefExtensionEscaper.Replace(event.Actor),
+		"duser=" + cefExtensionEscaper.Replace(event.UserID),
+		"src=" + cefExtensionEscaper.Replace(event.IP),
+		"outcome=" + cefExtensionEscaper.Replace(event.Outcome),
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(extension, " ")
+}
+
+// CEF escapes backslashes and pipes in the header, and backslashes, equals
+// signs and line breaks in the extension
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, "|", `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func (l *memoryAuditLog) Export(since time.Time, fn func(event *model.AuditEvent) error) error {
+	l.mu.Lock()
+	events := append([]model.AuditEvent{}, l.events...)
+	l.mu.Unlock()
+
+	for i := range events {
+		if events[i].CreatedAt.Before(since) {
+			continue
+		}
+		if err := fn(&events[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mongoAuditLog) Export(since time.Time, fn func(event *model.AuditEvent) error) error {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	collection, err := auditLogCollection(session)
+	if err != nil {
+		return err
+	}
+
+	// Events are read a batch at a time, however many there are
+	iter := collection.Find(bson.M{"created_at": bson.M{"$gte": since}}).Sort("created_at").Iter()
+	var event model.AuditEvent
+	for iter.Next(&event) {
+		if err := fn(&event); err != nil {
+			iter.Close()
+			return err
+		}
+		event = model.AuditEvent{}
+	}
+	return iter.Close()
+}
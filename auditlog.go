@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Where the audit log of user events can be kept
+const (
+	auditLogOff    = "off"
+	auditLogDB     = "db"
+	auditLogStdout = "stdout"
+)
+
+// Actions recorded in the audit log
+const (
+	auditActionCreate         = "create"
+	auditActionLogin          = "login"
+	auditActionPasswordChange = "password_change"
+	auditActionRoleChange     = "role_change"
+	auditActionTokenRefresh   = "token_refresh"
+	auditActionDelete         = "delete"
+	auditActionExport         = "export"
+	auditActionErase          = "erase"
+	auditActionGroupChange    = "group_change"
+	auditActionUnlock         = "unlock"
+	auditActionDeactivate     = "deactivate"
+	auditActionSessionsRevoke = "sessions_revoke"
+	auditActionAPIKeyCreate   = "api_key_create"
+	auditActionAPIKeyRevoke   = "api_key_revoke"
+	auditActionConcurrent     = "concurrent_login"
+	auditActionReissue        = "id_reissue"
+	auditActionResetsRevoke   = "reset_tokens_invalidate"
+	auditActionImpersonate    = "impersonate"
+)
+
+// Outcomes of recorded actions
+const (
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+)
+
+// auditLog records security-relevant user events. Nothing is recorded when
+// it's nil.
+//
+// It's kept apart from the audit trail of auditStore, which answers a
+// different question. The trail is a tamper-evident record of the mutating
+// requests made, as they were made; it can't tell whose account a request
+// changed, or record what happens outside of requests, like a directory
+// changing a role at login. The audit log is of what happened to each user,
+// whatever caused it, and can go to a platform collecting it instead.
+var auditLog AuditLogSink
+
+var errUnknownAuditLog = errors.New("the audit log must be off, db or stdout")
+
+// AuditLogSink is an interface for where the audit log of user events goes.
+// Events are only ever added.
+type AuditLogSink interface {
+	Record(event *model.AuditEvent) error
+}
+
+// AuditLogReader is implemented by sinks the audit log can be read back from
+type AuditLogReader interface {
+	// Events returns a page of the events of userID, or of every user when
+	// it's empty, newest first, along with how many there are
+	Events(userID string, opts model.ListOptions) ([]model.AuditEvent, int, error)
+}
+
+func isValidAuditLog(kind string) bool {
+	return kind == auditLogOff || kind == auditLogDB || kind == auditLogStdout
+}
+
+// newAuditLog returns the sink of the given kind, nil when it's off
+func newAuditLog(kind string) (AuditLogSink, error) {
+	switch kind {
+	case auditLogOff:
+		return nil, nil
+	case auditLogDB:
+		return mongoAuditLog{}, nil
+	case auditLogStdout:
+		return &jsonAuditLog{out: os.Stdout}, nil
+	}
+	return nil, errUnknownAuditLog
+}
+
+// recordAuditEvent records action on userID, made by r, in the audit log. err
+// is what the action failed with. Failing to record it doesn't fail the
+// request.
+func recordAuditEvent(r *http.Request, userID, action string, err error) {
+	recordAuditDetail(r, userID, action, "", err)
+}
+
+// recordAuditDetail records action on userID like recordAuditEvent, along
+// with detail about it
+func recordAuditDetail(r *http.Request, userID, action, detail string, err error) {
+	recordAuditEventBy(auditActor(r), clientInfo{ip: clientIP(r), userAgent: r.UserAgent()}, userID, action, detail, err)
+}
+
+// recordServiceAuditEvent records action on userID, made by actor while
+// serving the request of ctx, in the audit log. It's for the events handlers
+// don't see, such as a provider signing a user up at login.
+func recordServiceAuditEvent(ctx context.Context, actor, userID, action, detail string, err error) {
+	recordAuditEventBy(actor, clientFrom(ctx), userID, action, detail, err)
+}
+
+// recordAuditEventBy records action on userID, made by actor from client, in
+// the audit log
+func recordAuditEventBy(actor string, client clientInfo, userID, action, detail string, err error) {
+	if auditLog == nil {
+		return
+	}
+
+	event := &model.AuditEvent{
+		ID:        bson.NewObjectId().Hex(),
+		Actor:     actor,
+		UserID:    userID,
+		Action:    action,
+		Detail:    detail,
+		IP:        client.ip,
+		UserAgent: client.userAgent,
+		Outcome:   auditOutcomeSuccess,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err != nil {
+		event.Outcome = auditOutcomeFailure
+	}
+	if err := auditLog.Record(event); err != nil {
+		log.Println("unable to record audit event:", err)
+	}
+}
+
+// userIDOf returns the id of user, empty when there is none
+func userIDOf(user *model.User) string {
+	if user == nil {
+		return ""
+	}
+	return user.ID
+}
+
+// loginResultUserID returns the id of the user result is for, empty when
+// there is none
+func loginResultUserID(result *model.LoginResult) string {
+	if result == nil {
+		return ""
+	}
+	return result.UserID
+}
+
+// lookupUsername returns the user with username, nil when there is none
+func lookupUsername(ctx context.Context, svc UserService, username string) *model.User {
+	if auditLog == nil {
+		return nil
+	}
+	user, err := svc.GetByUsername(ctx, username)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// jsonAuditLog writes every event as a line of JSON, for the platform to
+// collect. It can't be read back.
+type jsonAuditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (l *jsonAuditLog) Record(event *model.AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return json.NewEncoder(l.out).Encode(event)
+}
+
+// memoryAuditLog keeps the audit log in memory, for tests only
+type memoryAuditLog struct {
+	mu     sync.Mutex
+	events []model.AuditEvent
+}
+
+func (l *memoryAuditLog) Record(event *model.AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, *event)
+	return nil
+}
+
+func (l *memoryAuditLog) Events(userID string, opts model.ListOptions) ([]model.AuditEvent, int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	matching := []model.AuditEvent{}
+	for _, event := range l.events {
+		if userID == "" || event.UserID == userID {
+			matching = append(matching, event)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].CreatedAt.After(matching[j].CreatedAt)
+	})
+
+	total := len(matching)
+	if opts.Offset > total {
+		opts.Offset = total
+	}
+	end := total
+	if opts.Limit > 0 && opts.Offset+opts.Limit < total {
+		end = opts.Offset + opts.Limit
+	}
+	return matching[opts.Offset:end], total, nil
+}
+
+// mongoAuditLog keeps the audit log in the database, shared by every
+// instance
+type mongoAuditLog struct{}
+
+// auditLogCollection returns the collection of audit events, indexed for
+// listing them by user by migration 0002
+func auditLogCollection(session *mgo.Session) (*mgo.Collection, error) {
+	return session.DB("buzz-test-user").C("audit_log"), nil
+}
+
+func (mongoAuditLog) Record(event *model.AuditEvent) error {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	collection, err := auditLogCollection(session)
+	if err != nil {
+		return err
+	}
+
+	return collection.Insert(event)
+}
+
+func (mongoAuditLog) Events(userID string, opts model.ListOptions) ([]model.AuditEvent, int, error) {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer session.Close()
+
+	collection, err := auditLogCollection(session)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filter := bson.M{}
+	if userID != "" {
+		filter["user_id"] = userID
+	}
+	query := collection.Find(filter)
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events := []model.AuditEvent{}
+	if err := query.Sort("-created_at").Skip(opts.Offset).Limit(opts.Limit).All(&events); err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
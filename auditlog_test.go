@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// auditedLoginService lets in the user with the password "right", and knows
+// every username
+type auditedLoginService struct {
+	UserService
+}
+
+func (auditedLoginService) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	if password != "right" {
+		return nil, errInvalidCredentials
+	}
+	return &model.LoginResult{UserID: username + "ID", Token: "accessToken", RefreshToken: "refreshToken"}, nil
+}
+
+func (auditedLoginService) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	return &model.User{ID: username + "ID", Username: username}, nil
+}
+
+func TestRecordAuditEvent(t *testing.T) {
+	events := &memoryAuditLog{}
+	auditLog = events
+	defer func() { auditLog = nil }()
+
+	login := handleLoginUser(auditedLoginService{})
+	for _, password := range []string{"wrong", "right"} {
+		req := httptest.NewRequest("POST", "/users/login", strings.NewReader(`{"username":"alex","password":"`+password+`"}`))
+		req.Header.Set("User-Agent", "audit-test/1.0")
+		login.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(events.events) != 2 {
+		t.Fatalf("Expected both logins to be recorded but got: %+v", events.events)
+	}
+	for i, outcome := range []string{auditOutcomeFailure, auditOutcomeSuccess} {
+		event := events.events[i]
+		if event.Action != auditActionLogin || event.Outcome != outcome || event.UserID != "alexID" {
+			t.Errorf("Expected a %s login of alexID but got: %+v", outcome, event)
+		}
+		if event.IP != "192.0.2.1" || event.UserAgent != "audit-test/1.0" || event.ID == "" || event.CreatedAt.IsZero() {
+			t.Errorf("Expected where the login came from to be recorded but got: %+v", event)
+		}
+	}
+}
+
+func TestRecordServiceAuditEvent(t *testing.T) {
+	events := &memoryAuditLog{}
+	auditLog = events
+	defer func() { auditLog = nil }()
+
+	req := httptest.NewRequest("GET", "/login/github/callback", nil)
+	req.Header.Set("User-Agent", "testAgent")
+	recordServiceAuditEvent(withClient(req), "github", "signedUpID", auditActionCreate, "signed up with github", nil)
+
+	if len(events.events) != 1 {
+		t.Fatalf("Expected the event to be recorded but got: %+v", events.events)
+	}
+	event := events.events[0]
+	if event.Actor != "github" || event.UserID != "signedUpID" || event.Detail != "signed up with github" || event.Outcome != auditOutcomeSuccess {
+		t.Errorf("Expected the signup made by github but got: %+v", event)
+	}
+	if event.IP != clientIP(req) || event.UserAgent != "testAgent" {
+		t.Errorf("Expected where the login came from to be recorded but got: %+v", event)
+	}
+}
+
+func TestGetAuditEvents(t *testing.T) {
+	events := &memoryAuditLog{}
+	now := time.Now()
+	for i, userID := range []string{"firstID", "secondID", "firstID"} {
+		events.Record(&model.AuditEvent{ID: string(rune('a' + i)), UserID: userID, Action: auditActionLogin, CreatedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	router := mux.NewRouter()
+	router.Handle(AuditLogPath, handleGetAuditEvents(events)).Methods("GET")
+	router.Handle(UserAuditLogPath, handleGetAuditEvents(events)).Methods("GET")
+	list := func(path string) reqres.AuditEventsResponse {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected a 200 for %s but got: %d", path, rec.Code)
+		}
+		var payload reqres.AuditEventsResponse
+		if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload
+	}
+
+	if payload := list("/users/firstID/audit"); payload.Total != 2 || len(payload.Events) != 2 || payload.Events[0].ID != "c" {
+		t.Errorf("Expected the events of firstID newest first but got: %+v", payload)
+	}
+	if payload := list("/audit?offset=1&limit=1"); payload.Total != 3 || len(payload.Events) != 1 || payload.Events[0].ID != "b" {
+		t.Errorf("Expected the second page of every event but got: %+v", payload)
+	}
+}
+
+func TestJSONAuditLog(t *testing.T) {
+	var out bytes.Buffer
+	sink := &jsonAuditLog{out: &out}
+	sink.Record(&model.AuditEvent{ID: "a", UserID: "userID", Action: auditActionDelete, Outcome: auditOutcomeSuccess})
+	sink.Record(&model.AuditEvent{ID: "b", UserID: "userID", Action: auditActionRoleChange, Outcome: auditOutcomeFailure})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a line per event but got: %q", out.String())
+	}
+	var event model.AuditEvent
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.Action != auditActionRoleChange || event.Outcome != auditOutcomeFailure {
+		t.Errorf("Expected the role change to be written as JSON but got: %s", lines[1])
+	}
+}
+
+func TestCEFLine(t *testing.T) {
+	defer func(vendor, product string) { cefVendor, cefProduct = vendor, product }(cefVendor, cefProduct)
+	cefVendor, cefProduct = "Buzz|Corp", "users"
+
+	event := &model.AuditEvent{
+		Actor:     `admin\ID`,
+		UserID:    "user=ID",
+		Action:    auditActionRoleChange,
+		IP:        "192.0.2.1",
+		Outcome:   auditOutcomeFailure,
+		CreatedAt: time.Unix(1500000000, 123000000),
+	}
+	expected := `CEF:0|Buzz\|Corp|users|` + Version + `|role_change|user role_change|7|rt=1500000000123 suser=admin\\ID duser=user\=ID src=192.0.2.1 outcome=failure`
+	if line := cefLine(event); line != expected {
+		t.Errorf("Expected the CEF line %s but got: %s", expected, line)
+	}
+}
+
+func TestExportAuditEvents(t *testing.T) {
+	events := &memoryAuditLog{}
+	now := time.Now().UTC()
+	for i, action := range []string{auditActionLogin, auditActionDelete, auditActionUnlock} {
+		events.Record(&model.AuditEvent{ID: string(rune('a' + i)), Actor: "adminID", UserID: "userID", Action: action, IP: "192.0.2.1", Outcome: auditOutcomeSuccess, CreatedAt: now.Add(time.Duration(i) * time.Hour)})
+	}
+	export := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleExportAuditEvents(events).ServeHTTP(rec, httptest.NewRequest("GET", AuditExportPath+query, nil))
+		return rec
+	}
+
+	rec := export("?since=" + now.Add(time.Minute).Format(time.RFC3339))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != http.StatusOK || len(lines) != 2 {
+		t.Fatalf("Expected the 2 events since as JSON lines but got: %d %q", rec.Code, rec.Body.String())
+	}
+	var event reqres.AuditExportEvent
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil || event.Event != auditActionDelete || event.Actor != "adminID" || event.Target != "userID" || event.IP != "192.0.2.1" || event.Timestamp.IsZero() {
+		t.Errorf("Expected the deletion first but got: %s", lines[0])
+	}
+
+	rec = export("?format=cef")
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "CEF:0|") {
+		t.Errorf("Expected every event as CEF but got: %q", rec.Body.String())
+	}
+	if rec := export("?format=xml"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response for an unknown format but got: %d", rec.Code)
+	}
+}
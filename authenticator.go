@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+
+	"github.com/buzzapp/user/model"
+)
+
+// authenticator checks the passwords of users logging in, against our own
+// password hashes unless a directory is configured
+var authenticator Authenticator = localAuthenticator{}
+
+// Authenticator is an interface for checking the username and password of
+// users logging in
+type Authenticator interface {
+	// Authenticate returns the user these credentials are of, or else
+	// errInvalidCredentials. Whether the user may log in is up to the caller.
+	Authenticate(ctx context.Context, username, password string) (*model.User, error)
+}
+
+// localAuthenticator checks passwords against the hashes we store
+type localAuthenticator struct{}
+
+func (localAuthenticator) Authenticate(ctx context.Context, username, password string) (*model.User, error) {
+	svc := userService{}
+
+	// try to retrive the user by the username, or else by the email
+	user, err := svc.GetByUsername(ctx, username)
+	if err == errUserNotFound && isValidEmail(emailKey(username)) {
+		user, err = svc.GetByEmail(ctx, username)
+	}
+	if err != nil {
+		if err == errUserNotFound {
+			recordLoginAttempt("", false, loginReasonUnknownUser)
+		}
+
+		// take as long as checking a password would, so response times
+		// don't reveal which usernames exist
+		hashPassword(password)
+		return nil, errInvalidCredentials
+	}
+
+	// compare the passwords
+	ok, rehash, err := verifyPassword(user.Password, password)
+	if err != nil || !ok {
+		recordLoginAttempt(user.ID, false, loginReasonBadPassword)
+		return nil, errInvalidCredentials
+	}
+
+	// move the hash to the configured algorithm now that we know the password
+	if rehash {
+		rehashPassword(user.ID, password)
+	}
+
+	return user, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// bannedPasswords are passwords too common to be allowed, by their lowercase
+// form, e.g. the 10,000 most common ones. None are banned when it's empty.
+var bannedPasswords = map[string]bool{}
+
+// loadBannedPasswords reads the passwords to ban from the file at path, one
+// per line. Blank lines and lines starting with # are skipped.
+func loadBannedPasswords(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	banned := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		banned[strings.ToLower(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return banned, nil
+}
+
+// isBannedPassword reports whether password is one of the banned passwords,
+// ignoring case, so a capital letter doesn't make a common password pass
+func isBannedPassword(password string) bool {
+	return bannedPasswords[strings.ToLower(password)]
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// maxBulkUpdateRows is how many users a single bulk update can change
+const maxBulkUpdateRows = 1000
+
+// Outcomes of the rows of a bulk update
+const (
+	bulkRowUpdated     = "updated"
+	bulkRowWouldUpdate = "would_update"
+	bulkRowFailed      = "failed"
+)
+
+// bulkUpdateColumns are the columns bulk update CSVs can have. Users are found
+// by id or email, whichever of the two the CSV has.
+var bulkUpdateColumns = map[string]bool{
+	"id":       true,
+	"email":    true,
+	"role":     true,
+	"active":   true,
+	"verified": true,
+}
+
+// bulkUpdateRow is a row of a bulk update CSV, which either updates the user
+// with key or failed validation
+type bulkUpdateRow struct {
+	line   int
+	key    string
+	update model.AttributeUpdate
+	err    error
+}
+
+// parseBulkUpdateCSV reads a bulk update CSV, returning its rows and the
+// column users are found by. Rows are validated one by one, so a bad row
+// doesn't stop the others; only a bad header or unreadable CSV refuses the
+// whole update.
+func parseBulkUpdateCSV(r io.Reader) ([]bulkUpdateRow, string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, "", errors.New("Please provide a CSV with a header row")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !bulkUpdateColumns[name] {
+			return nil, "", fmt.Errorf("Unknown column %q, columns can be id or email, role, active and verified", name)
+		}
+		if _, ok := columns[name]; ok {
+			return nil, "", fmt.Errorf("Column %q is repeated", name)
+		}
+		columns[name] = i
+	}
+
+	_, byID := columns["id"]
+	_, byEmail := columns["email"]
+	if byID == byEmail {
+		return nil, "", errors.New("Please provide either an id or an email column")
+	}
+	keyColumn := "id"
+	if byEmail {
+		keyColumn = "email"
+	}
+	if len(columns) == 1 {
+		return nil, "", errors.New("Please provide a role, active or verified column to update")
+	}
+
+	rows := []bulkUpdateRow{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rows) == maxBulkUpdateRows {
+			return nil, "", fmt.Errorf("Please provide at most %d rows", maxBulkUpdateRows)
+		}
+		if len(record) != len(header) {
+			rows = append(rows, bulkUpdateRow{line: line, err: fieldError("", fmt.Sprintf("Expected %d fields but got %d", len(header), len(record)))})
+			continue
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := bulkUpdateRow{line: line, key: field(keyColumn)}
+		row.err = parseBulkUpdateRow(keyColumn, row.key, field("role"), field("active"), field("verified"), &row.update)
+		rows = append(rows, row)
+	}
+
+	return rows, keyColumn, nil
+}
+
+// parseBulkUpdateRow validates the fields of a row into update. Empty fields
+// are left as they are.
+func parseBulkUpdateRow(keyColumn, key, role, active, verified string, update *model.AttributeUpdate) error {
+	if key == "" {
+		return fieldError(keyColumn, "Please provide the "+keyColumn+" of the user")
+	}
+	if keyColumn == "email" && !isValidEmail(strings.ToLower(key)) {
+		return fieldError("email", "Please provide a valid email")
+	}
+
+	if role != "" {
+		if !isValidRole(role) {
+			return fieldError("role", "Unknown role: "+role)
+		}
+		update.Role = &role
+	}
+
+	if active != "" {
+		value, err := strconv.ParseBool(active)
+		if err != nil {
+			return fieldError("active", "Please provide true or false")
+		}
+		update.Active = &value
+	}
+
+	if verified != "" {
+		value, err := strconv.ParseBool(verified)
+		if err != nil {
+			return fieldError("verified", "Please provide true or false")
+		}
+		if !value {
+			return fieldError("verified", "Users can't be marked unverified")
+		}
+		update.Verify = true
+	}
+
+	if update.Role == nil && update.Active == nil && !update.Verify {
+		return fieldError("", "Nothing to update")
+	}
+	return nil
+}
+
+// applyBulkUpdate updates the user of each valid row, returning the outcome of
+// every row. Each row changes its user in a single write, so it is applied
+// entirely or not at all. A dry run only finds the users, writing nothing.
+func applyBulkUpdate(ctx context.Context, svc UserService, keyColumn string, rows []bulkUpdateRow, dryRun bool) reqres.BulkUpdateResponse {
+	resp := reqres.BulkUpdateResponse{Results: make([]reqres.BulkUpdateResult, 0, len(rows)), DryRun: dryRun}
+	for _, row := range rows {
+		result := reqres.BulkUpdateResult{Line: row.line, Key: row.key, Result: bulkRowUpdated}
+		if dryRun {
+			result.Result = bulkRowWouldUpdate
+		}
+
+		err := row.err
+		if err == nil {
+			var user *model.User
+			if keyColumn == "email" {
+				user, err = svc.GetByEmail(ctx, row.key)
+			} else {
+				user, err = svc.GetByID(ctx, row.key)
+			}
+			if err == nil {
+				result.UserID = user.ID
+				if !dryRun {
+					_, err = svc.UpdateAttributes(ctx, user.ID, &row.update)
+				}
+			}
+		}
+
+		if err != nil {
+			result.Result, result.Error = bulkRowFailed, bulkRowError(err)
+			resp.Failed++
+		} else {
+			resp.Updated++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp
+}
+
+// Outcomes of the users of a bulk verify, besides failing
+const (
+	bulkVerified        = "verified"
+	bulkAlreadyVerified = "already_verified"
+)
+
+// applyBulkVerify marks the user of each key, an ID or an email, verified,
+// returning the outcome of every key. Users already verified are skipped, so
+// verifying them again is harmless. Each user is verified in a single write.
+func applyBulkVerify(ctx context.Context, svc UserService, keys []string) reqres.BulkVerifyResponse {
+	resp := reqres.BulkVerifyResponse{Results: make([]reqres.BulkVerifyResult, 0, len(keys))}
+	for _, key := range keys {
+		result := reqres.BulkVerifyResult{Key: key, Result: bulkVerified}
+
+		var user *model.User
+		var err error
+		switch key = strings.TrimSpace(key); {
+		case key == "":
+			err = fieldError("users", "Please provide the id or email of the user")
+		case strings.Contains(key, "@"):
+			user, err = svc.GetByEmail(ctx, key)
+		default:
+			user, err = svc.GetByID(ctx, key)
+		}
+		if err == nil {
+			result.UserID = user.ID
+			if isVerified(user) {
+				result.Result = bulkAlreadyVerified
+			} else {
+				_, err = svc.UpdateAttributes(ctx, user.ID, &model.AttributeUpdate{Verify: true})
+			}
+		}
+
+		switch {
+		case err != nil:
+			result.Result, result.Error = bulkRowFailed, bulkRowError(err)
+			resp.Failed++
+		case result.Result == bulkAlreadyVerified:
+			resp.Skipped++
+		default:
+			resp.Verified++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp
+}
+
+// bulkRowError describes why a row failed. Errors of the service itself are
+// logged rather than handed out.
+func bulkRowError(err error) string {
+	switch err.(type) {
+	case codedError, validationErrors, statusTransitionError:
+		return err.Error()
+	}
+	if err == errUserNotFound {
+		return err.Error()
+	}
+	log.Println("unable to bulk update user:", err)
+	return "unable to update user"
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// bulkUpdateUserService keeps users in memory and records their updates
+type bulkUpdateUserService struct {
+	UserService
+	users   map[string]*model.User
+	updates map[string]model.AttributeUpdate
+}
+
+func (svc bulkUpdateUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	if user, ok := svc.users[id]; ok {
+		return user, nil
+	}
+	return nil, errUserNotFound
+}
+
+func (svc bulkUpdateUserService) GetByEmail(ctx context.Context, email string) (*model.User, error) {
+	for _, user := range svc.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+func (svc bulkUpdateUserService) UpdateAttributes(ctx context.Context, id string, update *model.AttributeUpdate) (*model.User, error) {
+	user := svc.users[id]
+	if update.Active != nil && !*update.Active && accountStatus(user.Status) == statusPending {
+		return nil, statusTransitionError{from: statusPending, to: statusDeactivated}
+	}
+	svc.updates[id] = *update
+	return user, nil
+}
+
+func TestBulkUpdateHTTPEndpoint(t *testing.T) {
+	svc := bulkUpdateUserService{
+		users: map[string]*model.User{
+			"1": {ID: "1", Email: "one@test.com", Status: statusActive},
+			"2": {ID: "2", Email: "two@test.com", Status: statusPending},
+			"3": {ID: "3", Email: "three@test.com", Status: statusActive},
+		},
+		updates: make(map[string]model.AttributeUpdate),
+	}
+	server := httptest.NewServer(handleBulkUpdateUsers(svc))
+	defer server.Close()
+
+	bulkUpdate := func(csv string) (int, *reqres.BulkUpdateResponse) {
+		resp, err := http.Post(server.URL, "text/csv", strings.NewReader(csv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload = &reqres.BulkUpdateResponse{}
+		json.NewDecoder(resp.Body).Decode(&payload)
+		return resp.StatusCode, payload
+	}
+
+	status, payload := bulkUpdate(`id,role,active,verified
+1,admin,,
+2,,,true
+3,teacher,,
+4,student,,
+2,,false,
+,student,,
+1,student
+3,,maybe,
+`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", status)
+	}
+	if payload.Updated != 2 || payload.Failed != 6 || len(payload.Results) != 8 {
+		t.Fatalf("Expected 2 rows updated and 6 failed but got: %+v", payload)
+	}
+
+	// Each row has its outcome, by line
+	want := []struct {
+		line   int
+		result string
+		error  string
+	}{
+		{2, bulkRowUpdated, ""},
+		{3, bulkRowUpdated, ""},
+		{4, bulkRowFailed, "Unknown role: teacher"},
+		{5, bulkRowFailed, errUserNotFound.Error()},
+		{6, bulkRowFailed, "an account can't go from pending to deactivated"},
+		{7, bulkRowFailed, "Please provide the id of the user"},
+		{8, bulkRowFailed, "Expected 4 fields but got 2"},
+		{9, bulkRowFailed, "Please provide true or false"},
+	}
+	for i, w := range want {
+		got := payload.Results[i]
+		if got.Line != w.line || got.Result != w.result || got.Error != w.error {
+			t.Errorf("Expected line %d to be %s %q but got: %+v", w.line, w.result, w.error, got)
+		}
+	}
+
+	// Only the valid rows changed their users
+	if len(svc.updates) != 2 || *svc.updates["1"].Role != "admin" || !svc.updates["2"].Verify {
+		t.Errorf("Expected only the valid rows to be applied but got: %+v", svc.updates)
+	}
+
+	// Users can be found by email too
+	if _, payload := bulkUpdate("email,active\nthree@test.com,false\n"); payload.Updated != 1 || payload.Results[0].UserID != "3" {
+		t.Errorf("Expected the user to be found by email but got: %+v", payload)
+	}
+
+	// A bad header refuses the whole CSV
+	for _, csv := range []string{"", "id,email,role\n1,a@test.com,admin\n", "username,role\njdoe,admin\n", "id\n1\n"} {
+		if status, _ := bulkUpdate(csv); status != http.StatusBadRequest {
+			t.Errorf("Expected a 400 status code response for %q but got: %d", csv, status)
+		}
+	}
+}
+
+func TestBulkUpdateAuditsRoleChanges(t *testing.T) {
+	events := &memoryAuditLog{}
+	auditLog = events
+	defer func() { auditLog = nil }()
+
+	svc := bulkUpdateUserService{
+		users:   map[string]*model.User{"1": {ID: "1", Status: statusActive}},
+		updates: make(map[string]model.AttributeUpdate),
+	}
+	req := httptest.NewRequest("POST", "/admin/users/bulk", strings.NewReader("id,role,verified\n1,admin,\n4,student,\n1,,true\n"))
+	handleBulkUpdateUsers(svc).ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(events.events) != 2 {
+		t.Fatalf("Expected the rows changing roles to be recorded but got: %+v", events.events)
+	}
+	for i, outcome := range []string{auditOutcomeSuccess, auditOutcomeFailure} {
+		if event := events.events[i]; event.Action != auditActionRoleChange || event.Outcome != outcome {
+			t.Errorf("Expected a %s role change at %d but got: %+v", outcome, i, event)
+		}
+	}
+	if events.events[0].UserID != "1" {
+		t.Errorf("Expected the role change of user 1 but got: %+v", events.events[0])
+	}
+}
+
+func TestBulkUpdateDryRun(t *testing.T) {
+	events := &memoryAuditLog{}
+	auditLog = events
+	defer func() { auditLog = nil }()
+
+	svc := bulkUpdateUserService{
+		users:   map[string]*model.User{"1": {ID: "1", Status: statusActive}},
+		updates: make(map[string]model.AttributeUpdate),
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/admin/users/bulk?dry_run=true", strings.NewReader("id,role\n1,admin\n4,student\n"))
+	handleBulkUpdateUsers(svc).ServeHTTP(rec, req)
+
+	var payload reqres.BulkUpdateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if !payload.DryRun || payload.Updated != 1 || payload.Failed != 1 {
+		t.Fatalf("Expected a dry run updating 1 user but got: %+v", payload)
+	}
+	if result := payload.Results[0]; result.Result != bulkRowWouldUpdate || result.UserID != "1" {
+		t.Errorf("Expected user 1 to be reported as would be updated but got: %+v", result)
+	}
+
+	// Nothing is written or audited
+	if len(svc.updates) != 0 {
+		t.Errorf("Expected a dry run not to update any user but got: %+v", svc.updates)
+	}
+	if len(events.events) != 0 {
+		t.Errorf("Expected a dry run not to be audited but got: %+v", events.events)
+	}
+}
+
+func TestBulkVerifyHTTPEndpoint(t *testing.T) {
+	svc := bulkUpdateUserService{
+		users: map[string]*model.User{
+			"1": {ID: "1", Email: "one@test.com", Status: statusPending},
+			"2": {ID: "2", Email: "two@test.com", Status: statusPending},
+			"3": {ID: "3", Email: "three@test.com", Status: statusActive},
+		},
+		updates: make(map[string]model.AttributeUpdate),
+	}
+	server := httptest.NewServer(handleBulkVerifyUsers(svc))
+	defer server.Close()
+
+	bulkVerify := func(body string) (int, *reqres.BulkVerifyResponse) {
+		resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload = &reqres.BulkVerifyResponse{}
+		json.NewDecoder(resp.Body).Decode(&payload)
+		return resp.StatusCode, payload
+	}
+
+	// IDs and emails can be mixed, and verified users are skipped
+	status, payload := bulkVerify(`{"users": ["1", "two@test.com", "3", "4", "nobody@test.com", ""]}`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", status)
+	}
+	if payload.Verified != 2 || payload.Skipped != 1 || payload.Failed != 3 || len(payload.Results) != 6 {
+		t.Fatalf("Expected 2 users verified, 1 skipped and 3 failed but got: %+v", payload)
+	}
+
+	want := []struct {
+		userID string
+		result string
+		error  string
+	}{
+		{"1", bulkVerified, ""},
+		{"2", bulkVerified, ""},
+		{"3", bulkAlreadyVerified, ""},
+		{"", bulkRowFailed, errUserNotFound.Error()},
+		{"", bulkRowFailed, errUserNotFound.Error()},
+		{"", bulkRowFailed, "Please provide the id or email of the user"},
+	}
+	for i, w := range want {
+		got := payload.Results[i]
+		if got.UserID != w.userID || got.Result != w.result || got.Error != w.error {
+			t.Errorf("Expected user %d to be %s %q but got: %+v", i+1, w.result, w.error, got)
+		}
+	}
+
+	// Only the unverified users were written
+	if len(svc.updates) != 2 || !svc.updates["1"].Verify || !svc.updates["2"].Verify {
+		t.Errorf("Expected only the unverified users to be verified but got: %+v", svc.updates)
+	}
+
+	for _, body := range []string{`{"users": []}`, `{}`, `not json`} {
+		if status, _ := bulkVerify(body); status != http.StatusBadRequest {
+			t.Errorf("Expected a 400 status code response for %q but got: %d", body, status)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/buzzapp/user/model"
+)
+
+// User cache modes
+const (
+	userCacheOff    = "off"
+	userCacheMemory = "memory"
+	userCacheRedis  = "redis"
+)
+
+var (
+	// userCacheTTL is how long a cached user is served before being read
+	// again, whether or not a write invalidated it
+	userCacheTTL = 30 * time.Second
+
+	// userCacheSize is how many users the in-process user cache holds
+	userCacheSize = 10000
+
+	// revocationCacheSize is how many tokens found not revoked are remembered
+	revocationCacheSize = 10000
+)
+
+// CacheStore is an interface for values cached by key until they expire.
+// Stores backed by a shared database let every instance see the same values,
+// and the same invalidations.
+type CacheStore interface {
+	// Get returns the value cached for key, if there is one
+	Get(key string) ([]byte, bool, error)
+
+	// Set caches value for key during ttl
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Delete forgets the values of keys
+	Delete(keys ...string) error
+
+	// Flush forgets every value
+	Flush() error
+}
+
+// memoryCacheStore keeps up to capacity values in memory, forgetting the
+// least recently used first. Invalidations only reach the instance they
+// happen on.
+type memoryCacheStore struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // most recently used first
+	now      func() time.Time
+}
+
+type cacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func newMemoryCacheStore(capacity int) *memoryCacheStore {
+	return &memoryCacheStore{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+func (s *memoryCacheStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !s.now().Before(entry.expiresAt) {
+		s.remove(element)
+		return nil, false, nil
+	}
+
+	s.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (s *memoryCacheStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiresAt := s.now().Add(ttl)
+	if element, ok := s.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.value, entry.expiresAt = value, expiresAt
+		s.order.MoveToFront(element)
+		return nil
+	}
+
+	s.entries[key] = s.order.PushFront(&cacheEntry{key: key, value: value, expiresAt: expiresAt})
+	for s.order.Len() > s.capacity {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+func (s *memoryCacheStore) Delete(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := s.entries[key]; ok {
+			s.remove(element)
+		}
+	}
+	return nil
+}
+
+func (s *memoryCacheStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = make(map[string]*list.Element)
+	s.order.Init()
+	return nil
+}
+
+// remove drops element. The lock must be held.
+func (s *memoryCacheStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*cacheEntry).key)
+}
+
+// redisCacheStore keeps the values in Redis, which expires them by itself,
+// so every instance shares the cache and its invalidations
+type redisCacheStore struct {
+	pool *redis.Pool
+}
+
+func (s redisCacheStore) Get(key string) ([]byte, bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", "cache:"+key))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s redisCacheStore) Set(key string, value []byte, ttl time.Duration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", "cache:"+key, value, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (s redisCacheStore) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = "cache:" + key
+	}
+	_, err := conn.Do("DEL", args...)
+	return err
+}
+
+func (s redisCacheStore) Flush() error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	// Walk the keys a batch at a time rather than blocking Redis with KEYS
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "cache:*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		if cursor, err = redis.Int(values[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Values(values[1], nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if _, err := conn.Do("DEL", keys...); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// userCacheKey is the key of the user with id
+func userCacheKey(id string) string {
+	return "user:" + id
+}
+
+// usernameCacheKey is the key of the id of the user named username
+func usernameCacheKey(username string) string {
+	return "username:" + usernameKey(username)
+}
+
+// userServiceCacheMiddleware serves users got by ID or username from a cache,
+// reading them through on a miss. Users are invalidated whenever a write to
+// them is marked in recentWrites, and expire after ttl regardless. Errors,
+// users not found included, aren't cached.
+//
+// Usernames only point at the ID of their user, so a user renamed or deleted
+// can't be served under a name that's no longer theirs.
+type userServiceCacheMiddleware struct {
+	UserService
+	store   CacheStore
+	ttl     time.Duration
+	metrics *metrics
+}
+
+func newUserServiceCacheMiddleware(svc UserService, store CacheStore, ttl time.Duration, m *metrics) userServiceCacheMiddleware {
+	mw := userServiceCacheMiddleware{UserService: svc, store: store, ttl: ttl, metrics: m}
+	recentWrites.OnMark(mw.invalidate)
+	return mw
+}
+
+func (mw userServiceCacheMiddleware) GetByID(ctx context.Context, id string) (*model.User, error) {
+	if user := mw.cached(id); user != nil {
+		mw.metrics.countCacheLookup("user", true)
+		return user, nil
+	}
+	mw.metrics.countCacheLookup("user", false)
+
+	user, err := mw.UserService.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	mw.put(user)
+	return user, nil
+}
+
+func (mw userServiceCacheMiddleware) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	id, ok, err := mw.store.Get(usernameCacheKey(username))
+	if err != nil {
+		log.Println("unable to read user cache:", err)
+	}
+	if ok {
+		if user := mw.cached(string(id)); user != nil && usernameKey(user.Username) == usernameKey(username) {
+			mw.metrics.countCacheLookup("user", true)
+			return user, nil
+		}
+	}
+	mw.metrics.countCacheLookup("user", false)
+
+	user, err := mw.UserService.GetByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	mw.put(user)
+	return user, nil
+}
+
+// cached returns the user with id from the cache, nil when it isn't there.
+// Users are cached encrypted like they're stored, so a shared cache holds
+// nothing the database doesn't protect.
+func (mw userServiceCacheMiddleware) cached(id string) *model.User {
+	data, ok, err := mw.store.Get(userCacheKey(id))
+	if err != nil {
+		log.Println("unable to read user cache:", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	var user model.User
+	if err := bson.Unmarshal(data, &user); err != nil {
+		log.Println("unable to read user cache:", err)
+		return nil
+	}
+	if err := decryptUsers(&user); err != nil {
+		log.Println("unable to read user cache:", err)
+		return nil
+	}
+	return &user
+}
+
+// put caches user under its ID and username
+func (mw userServiceCacheMiddleware) put(user *model.User) {
+	stored, err := encryptUser(user)
+	if err != nil {
+		log.Println("unable to write user cache:", err)
+		return
+	}
+	data, err := bson.Marshal(stored)
+	if err != nil {
+		log.Println("unable to write user cache:", err)
+		return
+	}
+
+	if err := mw.store.Set(userCacheKey(user.ID), data, mw.ttl); err != nil {
+		log.Println("unable to write user cache:", err)
+		return
+	}
+	if err := mw.store.Set(usernameCacheKey(user.Username), []byte(user.ID), mw.ttl); err != nil {
+		log.Println("unable to write user cache:", err)
+	}
+}
+
+// invalidate forgets the users written, marked by ID or username
+func (mw userServiceCacheMiddleware) invalidate(keys ...string) {
+	cacheKeys := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		cacheKeys = append(cacheKeys, userCacheKey(key), usernameCacheKey(key))
+	}
+	if err := mw.store.Delete(cacheKeys...); err != nil {
+		log.Println("unable to invalidate user cache:", err)
+	}
+}
+
+// cachingRevocationStore remembers, for ttl, the tokens found not revoked so
+// most requests don't ask the revocation store. The lookups are per instance:
+// a token revoked on another instance is only refused here once its entry
+// expires, hence short TTLs.
+type cachingRevocationStore struct {
+	TokenRevocationStore
+	notRevoked *memoryCacheStore
+	ttl        time.Duration
+	metrics    *metrics
+}
+
+func newCachingRevocationStore(store TokenRevocationStore, ttl time.Duration, m *metrics) cachingRevocationStore {
+	return cachingRevocationStore{TokenRevocationStore: store, notRevoked: newMemoryCacheStore(revocationCacheSize), ttl: ttl, metrics: m}
+}
+
+func (s cachingRevocationStore) Revoke(tokenID string, expiry time.Time) error {
+	err := s.TokenRevocationStore.Revoke(tokenID, expiry)
+	s.notRevoked.Delete(tokenID)
+	return err
+}
+
+func (s cachingRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	if _, ok, _ := s.notRevoked.Get(tokenID); ok {
+		s.metrics.countCacheLookup("revocation", true)
+		return false, nil
+	}
+	s.metrics.countCacheLookup("revocation", false)
+
+	revoked, err := s.TokenRevocationStore.IsRevoked(tokenID)
+	if err == nil && !revoked {
+		s.notRevoked.Set(tokenID, nil, s.ttl)
+	}
+	return revoked, err
+}
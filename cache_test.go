@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// lookupUserService knows the users of byID and counts the lookups that
+// reach it
+type lookupUserService struct {
+	UserService
+	byID    map[string]*model.User
+	lookups int
+}
+
+func (s *lookupUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	s.lookups++
+	user, ok := s.byID[id]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *lookupUserService) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	s.lookups++
+	for _, user := range s.byID {
+		if usernameKey(user.Username) == usernameKey(username) {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryCacheStore(2)
+	store.now = func() time.Time { return now }
+
+	testCacheStore(t, store)
+
+	// Values expire
+	store.Set("a", []byte("1"), time.Second)
+	now = now.Add(time.Second)
+	if _, ok, _ := store.Get("a"); ok {
+		t.Error("Expected an expired value to be forgotten")
+	}
+
+	// The least recently used values go first
+	store.Set("a", []byte("1"), time.Minute)
+	store.Set("b", []byte("2"), time.Minute)
+	store.Get("a")
+	store.Set("c", []byte("3"), time.Minute)
+	if _, ok, _ := store.Get("b"); ok {
+		t.Error("Expected the least recently used value to be evicted")
+	}
+	if _, ok, _ := store.Get("a"); !ok {
+		t.Error("Expected a recently used value to be kept")
+	}
+}
+
+func TestRedisCacheStore(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL not set")
+	}
+
+	testCacheStore(t, redisCacheStore{newRedisPool(url)})
+}
+
+func TestUserServiceCacheMiddleware(t *testing.T) {
+	svc := &lookupUserService{byID: map[string]*model.User{
+		"userID": {ID: "userID", Username: "testUser", FirstName: "Test"},
+	}}
+	m := newMetrics()
+	cached := newUserServiceCacheMiddleware(svc, newMemoryCacheStore(10), time.Minute, m)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		user, err := cached.GetByID(ctx, "userID")
+		if err != nil || user.FirstName != "Test" {
+			t.Fatalf("Expected the user but got: %v %v", user, err)
+		}
+	}
+	if user, err := cached.GetByUsername(ctx, "testUser"); err != nil || user.ID != "userID" {
+		t.Fatalf("Expected the user by username but got: %v %v", user, err)
+	}
+	if svc.lookups != 1 {
+		t.Errorf("Expected a single lookup to reach the service but got: %d", svc.lookups)
+	}
+	user, _ := cached.GetByID(ctx, "userID")
+	user.FirstName = "Changed"
+	if user, _ := cached.GetByID(ctx, "userID"); user.FirstName != "Test" {
+		t.Error("Expected every caller to get its own copy")
+	}
+
+	// Writes invalidate the user, by ID or username
+	svc.byID["userID"].FirstName = "Updated"
+	recentWrites.Mark("userID")
+	if user, _ := cached.GetByID(ctx, "userID"); user.FirstName != "Updated" {
+		t.Errorf("Expected a write to invalidate the cached user but got: %s", user.FirstName)
+	}
+
+	// A renamed user isn't served under their old name
+	svc.byID["userID"].Username = "renamedUser"
+	recentWrites.Mark("userID")
+	cached.GetByID(ctx, "userID")
+	if _, err := cached.GetByUsername(ctx, "testUser"); err != errUserNotFound {
+		t.Errorf("Expected the old username to be free but got: %v", err)
+	}
+
+	// Users not found aren't cached
+	lookups := svc.lookups
+	cached.GetByID(ctx, "missingID")
+	cached.GetByID(ctx, "missingID")
+	if svc.lookups != lookups+2 {
+		t.Errorf("Expected missing users to be looked up every time but got: %d", svc.lookups-lookups)
+	}
+
+	var text bytes.Buffer
+	m.writeText(&text)
+	if !strings.Contains(text.String(), `user_cache_lookups_total{cache="user",result="hit"} 4`) {
+		t.Errorf("Expected the cache hits to be counted but got:\n%s", text.String())
+	}
+}
+
+func TestCachingRevocationStore(t *testing.T) {
+	inner := newMemoryRevocationStore()
+	m := newMetrics()
+	store := newCachingRevocationStore(inner, time.Minute, m)
+	expiry := time.Now().Add(time.Hour)
+
+	if revoked, err := store.IsRevoked("tokenID"); err != nil || revoked {
+		t.Fatalf("Expected the token not to be revoked but got: %v %v", revoked, err)
+	}
+	store.IsRevoked("tokenID")
+	if m.caches[cacheSeries{"revocation", "hit"}] != 1 || m.caches[cacheSeries{"revocation", "miss"}] != 1 {
+		t.Errorf("Expected the second lookup to hit the cache but got: %v", m.caches)
+	}
+
+	// Revoking through the cache is seen at once
+	store.Revoke("tokenID", expiry)
+	if revoked, _ := store.IsRevoked("tokenID"); !revoked {
+		t.Error("Expected a token revoked here to be refused at once")
+	}
+
+	// Revoking elsewhere is only seen once the entry expires
+	store.IsRevoked("otherID")
+	inner.Revoke("otherID", expiry)
+	if revoked, _ := store.IsRevoked("otherID"); revoked {
+		t.Error("Expected the cached lookup to be trusted until it expires")
+	}
+	store.notRevoked.now = func() time.Time { return time.Now().Add(time.Minute) }
+	if revoked, _ := store.IsRevoked("otherID"); !revoked {
+		t.Error("Expected the revocation to be seen once the entry expired")
+	}
+}
+
+// testCacheStore checks the behaviour every CacheStore must share
+func testCacheStore(t *testing.T, store CacheStore) {
+	prefix := "test-" + strconv.FormatInt(time.Now().UnixNano(), 10) + ":"
+
+	if _, ok, err := store.Get(prefix + "a"); err != nil || ok {
+		t.Fatalf("Expected nothing cached yet but got: %v %v", ok, err)
+	}
+	if err := store.Set(prefix+"a", []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := store.Get(prefix + "a"); err != nil || !ok || string(value) != "1" {
+		t.Fatalf("Expected the value set but got: %q %v %v", value, ok, err)
+	}
+
+	if err := store.Delete(prefix+"a", prefix+"missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get(prefix + "a"); ok {
+		t.Error("Expected a deleted value to be forgotten")
+	}
+
+	store.Set(prefix+"b", []byte("2"), time.Minute)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get(prefix + "b"); ok {
+		t.Error("Expected flushing to forget every value")
+	}
+}
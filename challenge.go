@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/buzzapp/user/model"
+)
+
+// proofTokenType is the typ claim of ownership proof tokens, which prove a
+// user confirmed a challenge but can't be used to authenticate
+const proofTokenType = "ownership_proof"
+
+var (
+	// challengeTTL is how long a one-time code can be confirmed for
+	challengeTTL = 5 * time.Minute
+
+	// challengeMaxAttempts is how many wrong codes void a challenge
+	challengeMaxAttempts = 5
+
+	// proofTokenTTL is how long the proof of a confirmed challenge is valid
+	proofTokenTTL = 5 * time.Minute
+
+	// challengeSender delivers one-time codes to users. Challenges can't be
+	// sent when it's nil.
+	challengeSender ChallengeSender
+)
+
+var (
+	errNoChallengeSender = errors.New("no way of delivering one-time codes is configured")
+	errChallengeExpired  = errors.New("no pending challenge, or it has expired")
+	errTooManyAttempts   = errors.New("too many wrong codes, send a new challenge")
+	errInvalidCode       = errors.New("invalid code")
+)
+
+// ChallengeSender is an interface for delivering one-time codes to users,
+// e.g. by email or text message
+type ChallengeSender interface {
+	SendChallenge(user *model.User, code string) error
+}
+
+// logChallengeSender writes codes to the service log, for development only
+type logChallengeSender struct{}
+
+func (logChallengeSender) SendChallenge(user *model.User, code string) error {
+	log.Printf("one-time code for user %s: %s", user.ID, code)
+	return nil
+}
+
+// newChallengeCode returns a random six digit code
+func newChallengeCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashChallengeCode keys the hash of a code to the user, so stored hashes of
+// six digit codes can't simply be looked up
+func hashChallengeCode(userID, code string) string {
+	mac := hmac.New(sha256.New, []byte(SecretKey))
+	io.WriteString(mac, userID+":"+code)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// generateProofToken mints a short-lived token proving userID confirmed a
+// challenge
+func generateProofToken(userID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(proofTokenTTL)
+
+	token := jwt.New(signingMethod)
+	token.Claims["sub"] = userID
+	token.Claims["typ"] = proofTokenType
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = expiresAt.Unix()
+	token.Claims["nbf"] = now.Unix()
+	token.Claims["jti"] = makeJTI(userID, now.Unix())
+	tokenString, err := signToken(token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return tokenString, expiresAt, nil
+}
+
+// verifyProofToken checks that proofToken proves userID recently confirmed a
+// challenge
+func verifyProofToken(proofToken, userID string) error {
+	token, err := parseToken(proofToken)
+	if err != nil {
+		return err
+	}
+	if token.Claims["typ"] != proofTokenType || token.Claims["sub"] != userID {
+		return errors.New("not an ownership proof for this user")
+	}
+	return nil
+}
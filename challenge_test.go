@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestNewChallengeCode(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		code, err := newChallengeCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(`^[0-9]{6}$`).MatchString(code) {
+			t.Errorf("Expected a six digit code but got: %q", code)
+		}
+	}
+}
+
+func TestProofTokenOnlyProvesOwnership(t *testing.T) {
+	proofToken, _, err := generateProofToken("userID")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyProofToken(proofToken, "userID"); err != nil {
+		t.Errorf("Expected the proof to be valid but got: %v", err)
+	}
+	if err := verifyProofToken(proofToken, "otherID"); err == nil {
+		t.Error("Expected the proof not to be valid for another user")
+	}
+
+	// Regular tokens aren't proofs
+	token, err := generateToken("userID", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyProofToken(token, "userID"); err == nil {
+		t.Error("Expected a regular token not to be a proof")
+	}
+
+	// And proofs can't be used to authenticate
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", "/users/userID", nil)
+	req.Header.Set("Authorization", "Bearer "+proofToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 status code response but got: %d", rec.Code)
+	}
+}
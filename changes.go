@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// Page sizes of the changes feed
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// userChange describes how a user changed since a time. Deleted users become
+// tombstones.
+func userChange(user *model.User, since time.Time) model.UserChange {
+	change := model.UserChange{ID: user.ID, ChangedAt: user.UpdatedAt}
+
+	switch {
+	case user.Status == statusDeleted:
+		change.Change = model.ChangeDeleted
+	case user.Timestamp > since.Unix():
+		change.Change = model.ChangeCreated
+		change.User = user
+	default:
+		change.Change = model.ChangeUpdated
+		change.User = user
+	}
+
+	return change
+}
+
+// encodeChangesCursor makes an opaque cursor for the changes after a user's
+func encodeChangesCursor(updatedAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(updatedAt.UnixNano(), 10) + ":" + id))
+}
+
+func decodeChangesCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errors.New("invalid cursor")
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", errors.New("invalid cursor")
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", errors.New("invalid cursor")
+	}
+
+	return time.Unix(0, nanos), parts[1], nil
+}
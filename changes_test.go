@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+func TestUserChangeKinds(t *testing.T) {
+	since := time.Now().Add(-time.Hour)
+
+	created := userChange(&model.User{ID: "new", Timestamp: time.Now().Unix(), Status: statusActive}, since)
+	if created.Change != model.ChangeCreated || created.User == nil {
+		t.Errorf("Expected a user created after since to be a creation but got: %+v", created)
+	}
+
+	updated := userChange(&model.User{ID: "old", Timestamp: since.Add(-time.Hour).Unix(), Status: statusLocked}, since)
+	if updated.Change != model.ChangeUpdated || updated.User == nil {
+		t.Errorf("Expected a user created before since to be an update but got: %+v", updated)
+	}
+
+	deleted := userChange(&model.User{ID: "gone", Timestamp: time.Now().Unix(), Status: statusDeleted}, since)
+	if deleted.Change != model.ChangeDeleted || deleted.User != nil || deleted.ID != "gone" {
+		t.Errorf("Expected a deleted user to be a tombstone but got: %+v", deleted)
+	}
+}
+
+func TestChangesCursor(t *testing.T) {
+	updatedAt := time.Unix(1500000000, 123000000)
+	after, id, err := decodeChangesCursor(encodeChangesCursor(updatedAt, "someID"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Equal(updatedAt) || id != "someID" {
+		t.Errorf("Expected the cursor to round trip but got: %v, %s", after, id)
+	}
+
+	if _, _, err := decodeChangesCursor("not a cursor"); err == nil {
+		t.Error("Expected an invalid cursor to be refused")
+	}
+}
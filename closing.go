@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	// accountCloseGrace is how long a closed account stays deactivated, and
+	// can still be reopened, before it is purged
+	accountCloseGrace = 14 * 24 * time.Hour
+
+	// accountPurgeInterval is how often closed accounts past their grace
+	// period are purged. Purging is disabled when it's 0.
+	accountPurgeInterval = time.Hour
+)
+
+var errNoPendingClose = errors.New("account isn't scheduled to be closed")
+
+// runAccountPurges purges the closed accounts past their grace period every
+// accountPurgeInterval, until ctx is done
+func runAccountPurges(ctx context.Context, svc UserService) {
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if _, err := svc.PurgeClosedAccounts(ctx, now); err != nil {
+				log.Println("unable to purge closed accounts:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/buzzapp/user/model"
+)
+
+// coalescedTimeout bounds a shared GetByID, which no one caller can cancel
+var coalescedTimeout = 10 * time.Second
+
+// userServiceCoalescingMiddleware shares the result of a GetByID among the
+// concurrent calls for the same ID, so a hot user costs a single query at a
+// time. Only in-flight calls are shared, nothing is cached, errors included.
+type userServiceCoalescingMiddleware struct {
+	UserService
+	group *singleflight.Group
+}
+
+func newUserServiceCoalescingMiddleware(svc UserService) userServiceCoalescingMiddleware {
+	return userServiceCoalescingMiddleware{UserService: svc, group: &singleflight.Group{}}
+}
+
+func (mw userServiceCoalescingMiddleware) GetByID(ctx context.Context, id string) (*model.User, error) {
+	// The shared query outlives any one caller giving up on it, but not a
+	// hung database
+	results := mw.group.DoChan(id, func() (interface{}, error) {
+		shared, cancel := context.WithTimeout(context.Background(), coalescedTimeout)
+		defer cancel()
+		return mw.UserService.GetByID(shared, id)
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		return nil, contextError(ctx.Err())
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	// Every caller gets its own copy to change as it likes
+	user := *result.Val.(*model.User)
+	return &user, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// countingUserService counts the GetByID calls that reach it
+type countingUserService struct {
+	UserService
+	calls int32
+	delay time.Duration
+	err   error
+}
+
+func (s *countingUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(s.delay)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &model.User{ID: id, Username: "hotUser"}, nil
+}
+
+func TestCoalescedGetByID(t *testing.T) {
+	store := &countingUserService{delay: 50 * time.Millisecond}
+	svc := newUserServiceCoalescingMiddleware(store)
+
+	var wg sync.WaitGroup
+	users := make([]*model.User, 50)
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := svc.GetByID(context.Background(), "hotID")
+			if err != nil {
+				t.Error(err)
+			}
+			users[i] = user
+		}(i)
+	}
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&store.calls); calls != 1 {
+		t.Errorf("Expected a single store call but got: %d", calls)
+	}
+	if users[0] == users[1] || users[0].ID != "hotID" {
+		t.Error("Expected every caller to get its own copy of the user")
+	}
+
+	// Other IDs aren't shared
+	svc.GetByID(context.Background(), "otherID")
+	if calls := atomic.LoadInt32(&store.calls); calls != 2 {
+		t.Errorf("Expected another ID to make its own store call but got: %d", calls)
+	}
+}
+
+func TestCoalescedGetByIDDoesNotCacheErrors(t *testing.T) {
+	store := &countingUserService{err: errors.New("database unavailable")}
+	svc := newUserServiceCoalescingMiddleware(store)
+
+	if _, err := svc.GetByID(context.Background(), "id"); err == nil {
+		t.Fatal("Expected the store error")
+	}
+
+	store.err = nil
+	if _, err := svc.GetByID(context.Background(), "id"); err != nil {
+		t.Errorf("Expected the next call to reach the store again but got: %v", err)
+	}
+	if calls := atomic.LoadInt32(&store.calls); calls != 2 {
+		t.Errorf("Expected 2 store calls but got: %d", calls)
+	}
+}
+
+// contextState is the state of the context of a call while it's made
+type contextState struct {
+	err     error
+	bounded bool
+}
+
+// contextUserService reports the context of every GetByID to states, once
+// release is closed
+type contextUserService struct {
+	UserService
+	states  chan contextState
+	release chan struct{}
+}
+
+func (s contextUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	<-s.release
+	_, bounded := ctx.Deadline()
+	s.states <- contextState{err: ctx.Err(), bounded: bounded}
+	return &model.User{ID: id}, nil
+}
+
+func TestCoalescedGetByIDContext(t *testing.T) {
+	store := contextUserService{states: make(chan contextState, 1), release: make(chan struct{})}
+	svc := newUserServiceCoalescingMiddleware(store)
+
+	// The caller giving up doesn't cancel the shared query
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := svc.GetByID(ctx, "hotID"); err != context.Canceled {
+		t.Errorf("Expected the caller to give up but got: %v", err)
+	}
+	close(store.release)
+
+	state := <-store.states
+	if state.err != nil {
+		t.Errorf("Expected the shared query to carry on but got: %v", state.err)
+	}
+	if !state.bounded {
+		t.Error("Expected the shared query to be bounded")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encodings responses can be compressed with
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+)
+
+var (
+	// compressionLevel is the gzip level responses are compressed with, from
+	// 1 for fastest to 9 for smallest, or -1 for gzip's default. Responses
+	// aren't compressed when it's 0.
+	compressionLevel = gzip.DefaultCompression
+
+	// brotliLevel is the brotli level responses are compressed with, from 0
+	// for fastest to 11 for smallest
+	brotliLevel = brotli.DefaultCompression
+
+	// compressionMinSize is how many bytes a response needs before it's
+	// worth compressing
+	compressionMinSize = 1024
+)
+
+func isValidCompressionLevel(level int) bool {
+	return level == gzip.DefaultCompression || (level >= gzip.NoCompression && level <= gzip.BestCompression)
+}
+
+func isValidBrotliLevel(level int) bool {
+	return level >= brotli.BestSpeed && level <= brotli.BestCompression
+}
+
+// responseEncoding returns the encoding to compress the response to a request
+// with an Accept-Encoding header in, brotli whenever it's taken as it's the
+// smaller of the two, and "" for none
+func responseEncoding(acceptEncoding string) string {
+	switch {
+	case acceptsEncoding(acceptEncoding, encodingBrotli):
+		return encodingBrotli
+	case acceptsEncoding(acceptEncoding, encodingGzip):
+		return encodingGzip
+	}
+	return ""
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header takes encoding.
+// An explicit coding decides over the * wildcard, so gzip;q=0 rules gzip out.
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	codingQ, anyQ := -1.0, -1.0
+	for _, accepted := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(accepted, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+
+		if coding == "x-gzip" {
+			coding = encodingGzip
+		}
+		switch coding {
+		case encoding:
+			codingQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+
+	if codingQ >= 0 {
+		return codingQ > 0
+	}
+	return anyQ > 0
+}
+
+// compressMiddleware compresses the responses of clients that accept brotli
+// or gzip, once they are at least compressionMinSize bytes
+func compressMiddleware(next http.Handler) http.Handler {
+	if compressionLevel == gzip.NoCompression {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := responseEncoding(r.Header.Get("Accept-Encoding"))
+		if r.Method == "HEAD" || encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter is what gzip and brotli compress responses with
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newCompressWriter returns a writer compressing to w with encoding
+func newCompressWriter(w io.Writer, encoding string) (compressWriter, error) {
+	if encoding == encodingBrotli {
+		return brotli.NewWriterLevel(w, brotliLevel), nil
+	}
+	return gzip.NewWriterLevel(w, compressionLevel)
+}
+
+// compressResponseWriter holds back the response until it knows whether it's
+// big enough to compress, then sends it compressed with encoding or as is.
+// Flushing sends what was written so far, so streamed responses are
+// compressed as they go.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	started  bool
+	cw       compressWriter
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.started {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.started {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < compressionMinSize {
+			return len(p), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	if w.cw != nil {
+		return w.cw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what was written so far. Responses that are flushed are being
+// streamed, so they are compressed whatever their size.
+func (w *compressResponseWriter) Flush() {
+	if !w.started {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		if err := w.start(true); err != nil {
+			return
+		}
+	}
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close sends whatever is held back and finishes the compressed stream
+func (w *compressResponseWriter) Close() error {
+	if !w.started {
+		if w.status == 0 {
+			return nil
+		}
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.cw != nil {
+		return w.cw.Close()
+	}
+	return nil
+}
+
+// start sends the response headers, compressing the response when asked and
+// it has a body no one else encoded yet, followed by what was held back
+func (w *compressResponseWriter) start(compress bool) error {
+	w.started = true
+
+	header := w.Header()
+	if compress && header.Get("Content-Encoding") == "" && w.status != http.StatusNoContent && w.status != http.StatusNotModified {
+		cw, err := newCompressWriter(w.ResponseWriter, w.encoding)
+		if err == nil {
+			w.cw = cw
+			header.Set("Content-Encoding", w.encoding)
+			header.Del("Content-Length")
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.cw != nil {
+		_, err := w.cw.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestResponseEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", encodingGzip},
+		{"deflate, gzip;q=0.5", encodingGzip},
+		{"x-gzip", encodingGzip},
+		{"br", encodingBrotli},
+		{"gzip, br", encodingBrotli},
+		{"gzip;q=1, br;q=0.1", encodingBrotli},
+		{"br;q=0, gzip", encodingGzip},
+		{"*", encodingBrotli},
+		{"br;q=0, *", encodingGzip},
+		{"gzip;q=0, br;q=0, *", ""},
+		{"GZIP", encodingGzip},
+		{"deflate", ""},
+	}
+	for _, test := range tests {
+		if got := responseEncoding(test.acceptEncoding); got != test.want {
+			t.Errorf("responseEncoding(%q) = %q, want %q", test.acceptEncoding, got, test.want)
+		}
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	defer func(level, size int) { compressionLevel, compressionMinSize = level, size }(compressionLevel, compressionMinSize)
+	compressionLevel, compressionMinSize = gzip.BestSpeed, 100
+
+	big := strings.Repeat(`{"username":"someone"}`, 50)
+	handler := compressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	serve := func(body, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/users", nil)
+		req.URL.RawQuery = "body=" + body
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(big, "gzip")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a large response to be gzipped but got: %q", rec.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := ioutil.ReadAll(gz); string(decoded) != big {
+		t.Errorf("Expected the gzipped response to decode to the body but got: %q", decoded)
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected responses to vary on Accept-Encoding but got: %q", rec.Header().Get("Vary"))
+	}
+
+	rec = serve("{}", "gzip")
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "{}" {
+		t.Errorf("Expected a small response to be sent as is but got: %q", rec.Body.String())
+	}
+
+	// Brotli is preferred when the client takes it
+	rec = serve(big, "gzip, br")
+	if rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("Expected a large response to be compressed with brotli but got: %q", rec.Header().Get("Content-Encoding"))
+	}
+	if decoded, _ := ioutil.ReadAll(brotli.NewReader(rec.Body)); string(decoded) != big {
+		t.Errorf("Expected the brotli response to decode to the body but got: %q", decoded)
+	}
+
+	rec = serve(big, "deflate")
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != big {
+		t.Error("Expected clients that take neither gzip nor brotli to get the response as is")
+	}
+}
+
+func TestCompressMiddlewareStreams(t *testing.T) {
+	defer func(level, size int) { compressionLevel, compressionMinSize = level, size }(compressionLevel, compressionMinSize)
+	compressionLevel, compressionMinSize = gzip.DefaultCompression, 1024
+
+	flushed := 0
+	rec := httptest.NewRecorder()
+	handler := compressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"line":1}`))
+		w.(http.Flusher).Flush()
+		flushed = rec.Body.Len()
+		w.Write([]byte(`{"line":2}`))
+	}))
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, req)
+
+	if flushed == 0 {
+		t.Error("Expected flushing to send what was written so far")
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := ioutil.ReadAll(gz); string(decoded) != `{"line":1}{"line":2}` {
+		t.Errorf("Expected the streamed response to decode to every line but got: %q", decoded)
+	}
+}
+
+func TestCompressMiddlewareStreamsBrotli(t *testing.T) {
+	flushed := 0
+	rec := httptest.NewRecorder()
+	handler := compressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"line":1}`))
+		w.(http.Flusher).Flush()
+		flushed = rec.Body.Len()
+		w.Write([]byte(`{"line":2}`))
+	}))
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	handler.ServeHTTP(rec, req)
+
+	if flushed == 0 || rec.Header().Get("Content-Encoding") != "br" {
+		t.Errorf("Expected flushing to send what was compressed so far but got %d bytes as %q", flushed, rec.Header().Get("Content-Encoding"))
+	}
+	if decoded, _ := ioutil.ReadAll(brotli.NewReader(rec.Body)); string(decoded) != `{"line":1}{"line":2}` {
+		t.Errorf("Expected the streamed response to decode to every line but got: %q", decoded)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Ways of handling a login from another IP soon after the last one
+const (
+	concurrentLoginIgnore    = "ignore"
+	concurrentLoginFlag      = "flag"
+	concurrentLoginChallenge = "challenge"
+)
+
+var (
+	// concurrentLoginMode is what happens to a login from another IP than
+	// the user's last login within concurrentLoginWindow: nothing, a note in
+	// the audit log, or a one-time code to confirm before getting tokens
+	concurrentLoginMode = concurrentLoginIgnore
+
+	// concurrentLoginWindow is how soon after a login another one from a
+	// different IP is suspicious
+	concurrentLoginWindow = time.Minute
+
+	// recentLogins remembers the last login of each user. It is kept by each
+	// instance, so logins landing on different instances aren't compared.
+	recentLogins = newLoginTracker(concurrentLoginWindow)
+)
+
+func isValidConcurrentLoginMode(mode string) bool {
+	return mode == concurrentLoginIgnore || mode == concurrentLoginFlag || mode == concurrentLoginChallenge
+}
+
+// loginTracker remembers where users last logged in from within a time window
+type loginTracker struct {
+	mu     sync.Mutex
+	window time.Duration
+	logins map[string]recentLogin
+	now    func() time.Time
+}
+
+type recentLogin struct {
+	ip string
+	at time.Time
+}
+
+func newLoginTracker(window time.Duration) *loginTracker {
+	return &loginTracker{window: window, logins: make(map[string]recentLogin), now: time.Now}
+}
+
+// Record remembers a login of userID from ip
+func (t *loginTracker) Record(userID, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	// Forget logins that are outside the window
+	for id, login := range t.logins {
+		if now.Sub(login.at) >= t.window {
+			delete(t.logins, id)
+		}
+	}
+
+	t.logins[userID] = recentLogin{ip: ip, at: now}
+}
+
+// Concurrent returns the IP userID last logged in from when it was another IP
+// than ip within the window
+func (t *loginTracker) Concurrent(userID, ip string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	login, ok := t.logins[userID]
+	if !ok || login.ip == ip || t.now().Sub(login.at) >= t.window {
+		return "", false
+	}
+	return login.ip, true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// stepUpUserService logs anyone in, and confirms challenges with code
+type stepUpUserService struct {
+	UserService
+	code       string
+	challenges int
+}
+
+func (s *stepUpUserService) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	return &model.LoginResult{UserID: "stepUpID", Token: "token", RefreshToken: "refresh"}, nil
+}
+
+func (s *stepUpUserService) CreateChallenge(ctx context.Context, userID string) (time.Time, error) {
+	s.challenges++
+	return time.Now().Add(challengeTTL), nil
+}
+
+func (s *stepUpUserService) VerifyChallenge(ctx context.Context, userID, code string) (string, time.Time, error) {
+	if code != s.code {
+		return "", time.Time{}, errInvalidCode
+	}
+	return "proof", time.Now().Add(proofTokenTTL), nil
+}
+
+func TestLoginTracker(t *testing.T) {
+	now := time.Now()
+	tracker := newLoginTracker(time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	tracker.Record("userID", "10.0.0.1")
+	if _, concurrent := tracker.Concurrent("userID", "10.0.0.1"); concurrent {
+		t.Error("Expected logins from the same IP not to be concurrent")
+	}
+	if lastIP, concurrent := tracker.Concurrent("userID", "10.0.0.2"); !concurrent || lastIP != "10.0.0.1" {
+		t.Errorf("Expected a login from another IP to be concurrent but got: %q %v", lastIP, concurrent)
+	}
+	if _, concurrent := tracker.Concurrent("otherID", "10.0.0.2"); concurrent {
+		t.Error("Expected logins of other users not to be concurrent")
+	}
+
+	now = now.Add(time.Minute)
+	if _, concurrent := tracker.Concurrent("userID", "10.0.0.2"); concurrent {
+		t.Error("Expected logins outside the window not to be concurrent")
+	}
+}
+
+func TestConcurrentLogins(t *testing.T) {
+	defer func(mode string, tracker *loginTracker) { concurrentLoginMode, recentLogins = mode, tracker }(concurrentLoginMode, recentLogins)
+
+	login := func(svc UserService, ip, code string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(reqres.LoginRequest{Username: "stepUpUser", Password: password, Code: code})
+		req := httptest.NewRequest("POST", "/login", bytes.NewReader(body))
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		handleLoginUser(svc).ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, mode := range []string{concurrentLoginIgnore, concurrentLoginFlag} {
+		concurrentLoginMode = mode
+		recentLogins = newLoginTracker(time.Minute)
+		svc := &stepUpUserService{}
+		if rec := login(svc, "10.0.0.1", ""); rec.Code != http.StatusOK {
+			t.Fatalf("Expected the first login to succeed in %s mode but got: %d", mode, rec.Code)
+		}
+		if rec := login(svc, "10.0.0.2", ""); rec.Code != http.StatusOK || svc.challenges != 0 {
+			t.Errorf("Expected the second login to succeed unchallenged in %s mode but got: %d", mode, rec.Code)
+		}
+	}
+
+	concurrentLoginMode = concurrentLoginChallenge
+	recentLogins = newLoginTracker(time.Minute)
+	svc := &stepUpUserService{code: "123456"}
+	if rec := login(svc, "10.0.0.1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the first login to succeed but got: %d", rec.Code)
+	}
+
+	// A rapid login from another IP needs a one-time code
+	rec := login(svc, "10.0.0.2", "")
+	if rec.Code != http.StatusUnauthorized || svc.challenges != 1 {
+		t.Errorf("Expected the second login to be challenged but got: %d", rec.Code)
+	}
+	var payload = &reqres.ErrorResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Code != stepUpRequiredCode {
+		t.Errorf("Expected the %s code but got: %s", stepUpRequiredCode, payload.Code)
+	}
+
+	if rec := login(svc, "10.0.0.2", "000000"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a wrong code to be refused but got: %d", rec.Code)
+	}
+	if rec := login(svc, "10.0.0.2", "123456"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the confirmed login to succeed but got: %d", rec.Code)
+	}
+}
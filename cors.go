@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// corsAllowedOrigins are the origins browsers may call us from. "*" allows any
+// origin, without letting browsers send credentials along.
+var corsAllowedOrigins = []string{"*"}
+
+// corsMethods are the methods the router serves
+var corsMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// corsHeaders are the request headers browsers may send us
+var corsHeaders = []string{"Origin", "Accept", "Content-Type", "Authorization", validationModeHeader, schemaVersionHeader, requestIDHeader}
+
+// corsMaxAge is how many seconds browsers may cache a preflight response
+const corsMaxAge = "600"
+
+// defaultCORSOrigins is the comma separated origins set by the
+// CORS_ALLOWED_ORIGINS environment variable
+func defaultCORSOrigins() string {
+	if origins := os.Getenv("CORS_ALLOWED_ORIGINS"); origins != "" {
+		return origins
+	}
+	return "*"
+}
+
+// corsMiddleware lets browsers call us from corsAllowedOrigins, answering
+// preflight requests itself
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Responses differ by origin, so caches mustn't share them
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+		allowed, wildcard := corsOriginAllowed(origin)
+		if allowed {
+			if wildcard {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				// Browsers only send credentials to an origin named exactly
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if !preflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// corsOriginAllowed reports whether origin is allowed, and whether only
+// because any origin is
+func corsOriginAllowed(origin string) (bool, bool) {
+	wildcard := false
+	for _, allowed := range corsAllowedOrigins {
+		if strings.EqualFold(originOf(allowed), originOf(origin)) {
+			return true, false
+		}
+		wildcard = wildcard || allowed == "*"
+	}
+	return wildcard, wildcard
+}
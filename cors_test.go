@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	defer func(origins []string) { corsAllowedOrigins = origins }(corsAllowedOrigins)
+	corsAllowedOrigins = []string{"https://app.buzz.com"}
+
+	reached := false
+	handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/users", nil)
+		req.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", "Authorization, Content-Type")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Preflights are answered without reaching the router
+	rec := request("OPTIONS", "https://app.buzz.com")
+	if rec.Code != http.StatusNoContent || reached {
+		t.Errorf("Expected the preflight to be answered with a 204 but got: %d", rec.Code)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://app.buzz.com" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Expected the allowed origin to be echoed but got: %v", rec.Header())
+	}
+	if rec.Header().Get("Access-Control-Allow-Methods") == "" || rec.Header().Get("Access-Control-Allow-Headers") == "" {
+		t.Errorf("Expected the allowed methods and headers but got: %v", rec.Header())
+	}
+
+	rec = request("GET", "https://app.buzz.com")
+	if !reached || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.buzz.com" {
+		t.Errorf("Expected the request to go through with the origin allowed but got: %v", rec.Header())
+	}
+
+	// Other origins get nothing to go on
+	rec = request("OPTIONS", "https://evil.example.com")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected another origin not to be allowed but got: %v", rec.Header())
+	}
+
+	// Any origin is allowed without credentials
+	corsAllowedOrigins = []string{"*"}
+	rec = request("OPTIONS", "https://evil.example.com")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("Expected a wildcard without credentials but got: %v", rec.Header())
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+)
+
+// webhookDeadLetters keeps the webhook deliveries given up on. They're only
+// logged when it's nil.
+var webhookDeadLetters DeadLetterStore
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetterStore is an interface for keeping webhook deliveries given up on
+type DeadLetterStore interface {
+	Add(letter *model.WebhookDeadLetter) error
+
+	// Get returns the dead letter id, failing with errDeadLetterNotFound
+	Get(id string) (*model.WebhookDeadLetter, error)
+
+	// List returns every dead letter, oldest first
+	List() ([]model.WebhookDeadLetter, error)
+
+	// Remove drops the dead letter id, once it's been replayed
+	Remove(id string) error
+}
+
+// memoryDeadLetterStore keeps dead letters in memory, for tests only
+type memoryDeadLetterStore struct {
+	mu      sync.Mutex
+	letters map[string]model.WebhookDeadLetter
+}
+
+func (s *memoryDeadLetterStore) Add(letter *model.WebhookDeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.letters == nil {
+		s.letters = map[string]model.WebhookDeadLetter{}
+	}
+	s.letters[letter.ID] = *letter
+	return nil
+}
+
+func (s *memoryDeadLetterStore) Get(id string) (*model.WebhookDeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, ok := s.letters[id]
+	if !ok {
+		return nil, errDeadLetterNotFound
+	}
+	return &letter, nil
+}
+
+func (s *memoryDeadLetterStore) List() ([]model.WebhookDeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := []model.WebhookDeadLetter{}
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.Before(letters[j].FailedAt) })
+	return letters, nil
+}
+
+func (s *memoryDeadLetterStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.letters[id]; !ok {
+		return errDeadLetterNotFound
+	}
+	delete(s.letters, id)
+	return nil
+}
+
+// mongoDeadLetterStore keeps dead letters in the database, shared by every
+// instance
+type mongoDeadLetterStore struct{}
+
+// deadLetterCollection returns the collection of webhook dead letters
+func deadLetterCollection(session *mgo.Session) *mgo.Collection {
+	return session.DB("buzz-test-user").C("webhook_dead_letters")
+}
+
+func (mongoDeadLetterStore) Add(letter *model.WebhookDeadLetter) error {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return deadLetterCollection(session).Insert(letter)
+}
+
+func (mongoDeadLetterStore) Get(id string) (*model.WebhookDeadLetter, error) {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var letter model.WebhookDeadLetter
+	err = deadLetterCollection(session).FindId(id).One(&letter)
+	if err == mgo.ErrNotFound {
+		return nil, errDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+func (mongoDeadLetterStore) List() ([]model.WebhookDeadLetter, error) {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	letters := []model.WebhookDeadLetter{}
+	if err := deadLetterCollection(session).Find(nil).Sort("failed_at").All(&letters); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+func (mongoDeadLetterStore) Remove(id string) error {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	err = deadLetterCollection(session).RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return errDeadLetterNotFound
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// drainGrace is how long a draining instance keeps serving the requests it
+// still gets before shutting down
+var drainGrace = 30 * time.Second
+
+// shutdownTimeout is how long in-flight requests have to finish once the
+// instance shuts down, before their connections are closed
+var shutdownTimeout = 30 * time.Second
+
+// readinessTimeout is how long readiness checks wait for the dependencies
+// before reporting the ones that didn't answer unavailable
+var readinessTimeout = 2 * time.Second
+
+// drainer tracks whether the instance is draining for a rolling deploy. While
+// draining it reports not ready, so load balancers stop sending new traffic,
+// and it is done once the grace period is over.
+type drainer struct {
+	mu       sync.Mutex
+	grace    time.Duration
+	draining bool
+	endsAt   time.Time
+	done     chan struct{}
+}
+
+func newDrainer(grace time.Duration) *drainer {
+	return &drainer{grace: grace, done: make(chan struct{})}
+}
+
+// Drain starts draining, returning when the grace period will be over. Only
+// the first call starts the grace period.
+func (d *drainer) Drain() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.draining {
+		d.draining = true
+		d.endsAt = time.Now().Add(d.grace)
+		time.AfterFunc(d.grace, func() { close(d.done) })
+	}
+	return d.endsAt
+}
+
+// Draining reports whether the instance is draining
+func (d *drainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.draining
+}
+
+// Done is closed once the grace period of a drain is over
+func (d *drainer) Done() <-chan struct{} {
+	return d.done
+}
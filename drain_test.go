@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/reqres"
+)
+
+// pingingService reaches the database unless err is set
+type pingingService struct {
+	UserService
+	err error
+}
+
+func (s *pingingService) Ping(ctx context.Context) error {
+	return s.err
+}
+
+func TestDrain(t *testing.T) {
+	d := newDrainer(20 * time.Millisecond)
+	svc := &pingingService{}
+
+	check := func(handler http.Handler, path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	if code := check(handleReadyz(svc, d), "/readyz"); code != http.StatusOK {
+		t.Errorf("Expected a ready instance to respond 200 but got: %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	handleDrain(d).ServeHTTP(rec, httptest.NewRequest("POST", "/admin/drain", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("Expected a 202 status code response but got: %d", rec.Code)
+	}
+
+	// Load balancers stop sending traffic, orchestrators don't restart us
+	if code := check(handleReadyz(svc, d), "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a draining instance not to be ready but got: %d", code)
+	}
+	if code := check(handleHealthz(), "/healthz"); code != http.StatusOK {
+		t.Errorf("Expected a draining instance to stay healthy but got: %d", code)
+	}
+
+	select {
+	case <-d.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected the drain to be done after the grace period")
+	}
+}
+
+func TestReadyzChecksDatabase(t *testing.T) {
+	svc := &pingingService{err: errors.New("no reachable servers")}
+	handler := handleReadyz(svc, newDrainer(time.Minute))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected an instance without a database not to be ready but got: %d", rec.Code)
+	}
+
+	// Liveness doesn't depend on the database, so we aren't restarted for it
+	rec = httptest.NewRecorder()
+	handleHealthz().ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the instance to stay healthy but got: %d", rec.Code)
+	}
+
+	svc.err = nil
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected a 200 status code response once the database is back but got: %d", rec.Code)
+	}
+}
+
+func TestReadyzReportsDependencies(t *testing.T) {
+	defer func(checks []dependencyCheck, timeout time.Duration) {
+		dependencyChecks, readinessTimeout = checks, timeout
+	}(dependencyChecks, readinessTimeout)
+	readinessTimeout = 50 * time.Millisecond
+
+	var redisErr, natsErr error
+	dependencyChecks = []dependencyCheck{
+		{name: "redis", required: true, check: func(ctx context.Context) error { return redisErr }},
+		{name: "nats", check: func(ctx context.Context) error { return natsErr }},
+	}
+	check := func() (int, reqres.HealthResponse) {
+		rec := httptest.NewRecorder()
+		handleReadyz(&pingingService{}, newDrainer(time.Minute)).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		var payload reqres.HealthResponse
+		if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, payload
+	}
+
+	code, payload := check()
+	if code != http.StatusOK || payload.Status != "ok" || len(payload.Dependencies) != 3 {
+		t.Fatalf("Expected every dependency reported ok but got: %d %+v", code, payload)
+	}
+	if mongo := payload.Dependencies[0]; mongo.Name != "mongo" || !mongo.Required || mongo.Status != dependencyOK {
+		t.Errorf("Expected MongoDB to be required and ok but got: %+v", mongo)
+	}
+
+	// An optional dependency down only degrades the instance
+	natsErr = errNATSDisconnected
+	if code, payload := check(); code != http.StatusOK || payload.Status != "degraded" || payload.Dependencies[2].Status != dependencyUnavailable || payload.Dependencies[2].Error == "" {
+		t.Errorf("Expected a degraded but ready instance but got: %d %+v", code, payload)
+	}
+
+	// A required one that doesn't answer in time makes it unready
+	dependencyChecks[0].check = func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}
+	if code, payload := check(); code != http.StatusServiceUnavailable || payload.Dependencies[1].Status != dependencyUnavailable {
+		t.Errorf("Expected an instance whose Redis times out not to be ready but got: %d %+v", code, payload)
+	}
+}
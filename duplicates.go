@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/buzzapp/user/model"
+)
+
+// What potential duplicate accounts can be matched on
+const (
+	duplicateByEmail = "email"
+	duplicateByName  = "name"
+)
+
+// Page sizes of the duplicates report
+const (
+	defaultDuplicatesLimit = 50
+	maxDuplicatesLimit     = 500
+)
+
+// duplicateCriteria is what the duplicates report matches accounts on when a
+// request doesn't choose
+var duplicateCriteria = []string{duplicateByEmail, duplicateByName}
+
+func isValidDuplicateCriterion(criterion string) bool {
+	return criterion == duplicateByEmail || criterion == duplicateByName
+}
+
+// parseDuplicateCriteria parses comma separated criteria, refusing unknown or
+// repeated ones
+func parseDuplicateCriteria(spec string) ([]string, error) {
+	criteria := []string{}
+	for _, criterion := range strings.Split(spec, ",") {
+		criterion = strings.TrimSpace(criterion)
+		if !isValidDuplicateCriterion(criterion) {
+			return nil, errors.New("Please provide criteria out of email and name")
+		}
+		for _, c := range criteria {
+			if c == criterion {
+				return nil, errors.New("Please provide each criterion once")
+			}
+		}
+		criteria = append(criteria, criterion)
+	}
+	return criteria, nil
+}
+
+// normalizeEmail reduces an email to the mailbox it delivers to, ignoring case
+// and "+tag" subaddresses
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	return local + domain
+}
+
+// normalizeName reduces a full name so spellings differing only in case,
+// accents or spacing match
+func normalizeName(firstName, lastName string) string {
+	decomposed := norm.NFKD.String(strings.ToLower(firstName + " " + lastName))
+
+	name := make([]rune, 0, len(decomposed))
+	for _, r := range decomposed {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		name = append(name, r)
+	}
+	return strings.Join(strings.Fields(string(name)), " ")
+}
+
+// duplicateKey returns what user is matched on for criterion, or "" when the
+// user can't be matched on it
+func duplicateKey(user *model.User, criterion string) string {
+	switch criterion {
+	case duplicateByEmail:
+		return normalizeEmail(user.Email)
+	case duplicateByName:
+		// A single name is too common to mean anything
+		if strings.TrimSpace(user.FirstName) == "" || strings.TrimSpace(user.LastName) == "" {
+			return ""
+		}
+		return normalizeName(user.FirstName, user.LastName)
+	}
+	return ""
+}
+
+// findDuplicates groups the users sharing a key for any of criteria. Groups
+// come out in criteria order, then by key, with the oldest account first, so
+// pages stay stable between requests.
+func findDuplicates(users []model.User, criteria []string) []model.DuplicateGroup {
+	groups := []model.DuplicateGroup{}
+
+	for _, criterion := range criteria {
+		byKey := map[string][]model.User{}
+		for i := range users {
+			if key := duplicateKey(&users[i], criterion); key != "" {
+				byKey[key] = append(byKey[key], users[i])
+			}
+		}
+
+		keys := make([]string, 0, len(byKey))
+		for key, matched := range byKey {
+			if len(matched) > 1 {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			matched := byKey[key]
+			sort.Sort(usersByAge(matched))
+			groups = append(groups, model.DuplicateGroup{Criterion: criterion, Key: key, Users: matched})
+		}
+	}
+
+	return groups
+}
+
+// usersByAge sorts users oldest account first
+type usersByAge []model.User
+
+func (u usersByAge) Len() int      { return len(u) }
+func (u usersByAge) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u usersByAge) Less(i, j int) bool {
+	if u[i].Timestamp != u[j].Timestamp {
+		return u[i].Timestamp < u[j].Timestamp
+	}
+	return u[i].ID < u[j].ID
+}
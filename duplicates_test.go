@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/buzzapp/user/model"
+)
+
+func TestFindDuplicatesGroupsNormalizedEmails(t *testing.T) {
+	users := []model.User{
+		{ID: "newer", Email: "Jane.Doe+work@Example.com", FirstName: "Jane", LastName: "Doe", Timestamp: 200},
+		{ID: "older", Email: "jane.doe@example.com", FirstName: "Jane", LastName: "Smith", Timestamp: 100},
+		{ID: "other", Email: "john@example.com", FirstName: "John", LastName: "Doe", Timestamp: 300},
+	}
+
+	groups := findDuplicates(users, []string{duplicateByEmail})
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 group but got: %+v", groups)
+	}
+	group := groups[0]
+	if group.Criterion != duplicateByEmail || group.Key != "jane.doe@example.com" {
+		t.Errorf("Expected the group to be keyed by the normalized email but got: %s %s", group.Criterion, group.Key)
+	}
+	if len(group.Users) != 2 || group.Users[0].ID != "older" || group.Users[1].ID != "newer" {
+		t.Errorf("Expected both accounts, oldest first, but got: %+v", group.Users)
+	}
+}
+
+func TestFindDuplicatesGroupsSimilarNames(t *testing.T) {
+	users := []model.User{
+		{ID: "a", Email: "a@example.com", FirstName: "José", LastName: "García"},
+		{ID: "b", Email: "b@example.com", FirstName: " jose ", LastName: "GARCIA"},
+		{ID: "c", Email: "c@example.com", FirstName: "Jose"},
+		{ID: "d", Email: "d@example.com", FirstName: "Jose"},
+	}
+
+	groups := findDuplicates(users, []string{duplicateByName})
+	if len(groups) != 1 || groups[0].Key != "jose garcia" || len(groups[0].Users) != 2 {
+		t.Errorf("Expected only the full names to be grouped but got: %+v", groups)
+	}
+
+	// Criteria that aren't asked for aren't matched
+	if groups := findDuplicates(users, []string{duplicateByEmail}); len(groups) != 0 {
+		t.Errorf("Expected no groups but got: %+v", groups)
+	}
+}
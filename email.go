@@ -0,0 +1,15 @@
+package main
+
+import "strings"
+
+// preserveEmailCase stores emails as users typed them, for display and
+// delivery, instead of only accepting them in lower case. Either way emails
+// differing only in case are the same email, both for uniqueness and for
+// logging in.
+var preserveEmailCase = false
+
+// emailKey is what emails are compared by. Emails are stored with it, or with
+// its blind index when they are encrypted.
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
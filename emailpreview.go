@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"text/template"
+	"time"
+)
+
+var errUnknownEmailTemplate = errors.New("unknown email template")
+
+// emailPreviews are the emails users can be sent, by name, each returning
+// the template it is rendered with in a locale and sample data to render it
+// with. Only welcome emails are localized so far.
+var emailPreviews = map[string]func(locale string) (*template.Template, interface{}){
+	"welcome": func(locale string) (*template.Template, interface{}) {
+		return localizedTemplate(welcomeEmailTemplates, locale), welcomeEmail{Username: "ada", FirstName: "Ada", LastName: "Lovelace"}
+	},
+	"lockout": func(string) (*template.Template, interface{}) {
+		return lockoutNoticeTemplate, lockoutNotice{Username: "ada", FirstName: "Ada", LastName: "Lovelace", LockedUntil: time.Now().Add(15 * time.Minute)}
+	},
+	"password-changed": func(string) (*template.Template, interface{}) {
+		return passwordChangedNoticeTemplate, passwordChangedNotice{Username: "ada", FirstName: "Ada", LastName: "Lovelace", ChangedAt: time.Now(), IP: "192.0.2.1"}
+	},
+}
+
+// emailPreview returns the template of the email named name in locale, and
+// the sample data to render it with, failing with errUnknownEmailTemplate
+// when there is no such email
+func emailPreview(name, locale string) (*template.Template, interface{}, error) {
+	preview, ok := emailPreviews[name]
+	if !ok {
+		return nil, nil, errUnknownEmailTemplate
+	}
+	tmpl, data := preview(locale)
+	return tmpl, data, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestEmailPreviewHTTPEndpoint(t *testing.T) {
+	defer func(templates map[string]*template.Template) { welcomeEmailTemplates = templates }(welcomeEmailTemplates)
+	dir, err := ioutil.TempDir("", "welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "pt.tmpl"), []byte("Olá {{.FirstName}}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if welcomeEmailTemplates, err = parseWelcomeEmailTemplates(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	preview := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleEmailPreview().ServeHTTP(rec, httptest.NewRequest("GET", EmailPreviewPath+query, nil))
+		return rec
+	}
+
+	rec := preview("?template=welcome&locale=pt-BR")
+	if rec.Code != http.StatusOK || rec.Body.String() != "Olá Ada" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected the Portuguese welcome email with sample data but got: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := preview("?template=lockout"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Your account ada was locked") {
+		t.Errorf("Expected the lockout notice with sample data but got: %d %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := preview("?template=verification"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response for an unknown template but got: %d", rec.Code)
+	}
+	if rec := preview("?locale=en"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response without a template but got: %d", rec.Code)
+	}
+	if rec := preview("?template=welcome&locale=not_a_locale"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response for a bad locale but got: %d", rec.Code)
+	}
+}
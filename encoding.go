@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Supported casings for the keys of JSON responses
+const (
+	snakeCase = "snake"
+	camelCase = "camel"
+)
+
+// jsonFieldCase is the casing applied to the keys of every JSON response
+var jsonFieldCase = snakeCase
+
+// marshalJSON marshals v using its struct tags (which are snake_case) and,
+// when the service is configured for camelCase, rewrites every object key
+func marshalJSON(v interface{}) ([]byte, error) {
+	js, err := json.Marshal(v)
+	if err != nil || jsonFieldCase != camelCase {
+		return js, err
+	}
+
+	// Decode into generic values, keeping numbers untouched
+	var decoded interface{}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	if err := dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(camelizeKeys(decoded))
+}
+
+// camelizeKeys walks a decoded JSON value and converts all object keys
+func camelizeKeys(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		camelized := make(map[string]interface{}, len(value))
+		for key, val := range value {
+			camelized[toCamelCase(key)] = camelizeKeys(val)
+		}
+		return camelized
+	case []interface{}:
+		for i, val := range value {
+			value[i] = camelizeKeys(val)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+// toCamelCase converts a snake_case key, e.g. first_name becomes firstName
+func toCamelCase(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func isValidJSONFieldCase(fieldCase string) bool {
+	return fieldCase == snakeCase || fieldCase == camelCase
+}
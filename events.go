@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/nats-io/nats.go"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Types of the events published when users change
+const (
+	userEventCreated  = "user.created"
+	userEventUpdated  = "user.updated"
+	userEventDeleted  = "user.deleted"
+	userEventLogin    = "user.login"
+	userEventReissued = "user.reissued"
+
+	// userEventTest is only ever sent by POST /admin/webhooks/test
+	userEventTest = "webhook.test"
+)
+
+// Headers of webhook deliveries. The signature is the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with WebhookSecret.
+const (
+	webhookEventHeader     = "X-Buzz-Event"
+	webhookTimestampHeader = "X-Buzz-Timestamp"
+	webhookSignatureHeader = "X-Buzz-Signature"
+)
+
+var (
+	// WebhookSecret signs webhook deliveries, set by the WEBHOOK_SECRET
+	// secret
+	WebhookSecret = ""
+
+	// webhookMaxAttempts is how many times a webhook delivery is tried
+	webhookMaxAttempts = 5
+
+	// webhookBackoff is how long the first retry of a webhook delivery waits,
+	// doubling with every retry
+	webhookBackoff = time.Second
+
+	// webhook is the publisher posting events to -webhook-url, nil when
+	// there's none
+	webhook *webhookPublisher
+)
+
+// EventPublisher is an interface for telling downstream services about user
+// events. Publishing doesn't wait for the event to be delivered.
+type EventPublisher interface {
+	Publish(event *model.UserEvent) error
+
+	// Close waits for the events published to be delivered, or given up on,
+	// until ctx is done. Nothing is published after.
+	Close(ctx context.Context) error
+}
+
+// newUserEvent returns an event of type about userID
+func newUserEvent(eventType, userID string, user *model.User) *model.UserEvent {
+	return &model.UserEvent{ID: bson.NewObjectId().Hex(), Type: eventType, UserID: userID, User: user, CreatedAt: time.Now().UTC()}
+}
+
+// multiPublisher publishes every event with each of its publishers
+type multiPublisher []EventPublisher
+
+func (m multiPublisher) Publish(event *model.UserEvent) error {
+	var failed error
+	for _, publisher := range m {
+		if err := publisher.Publish(event); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+func (m multiPublisher) Close(ctx context.Context) error {
+	var failed error
+	for _, publisher := range m {
+		if err := publisher.Close(ctx); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// webhookPublisher posts events to a URL, signed with a secret. Deliveries
+// failing with a network error, a 429 or a 5xx are retried with exponential
+// backoff, in the background.
+type webhookPublisher struct {
+	url         string
+	secret      string
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+
+	// deliveries tracks the deliveries in flight, so Close can wait for them
+	mu         sync.Mutex
+	closed     bool
+	deliveries sync.WaitGroup
+}
+
+func newWebhookPublisher(url, secret string, maxAttempts int, backoff time.Duration) *webhookPublisher {
+	return &webhookPublisher{url: url, secret: secret, client: &http.Client{Timeout: 10 * time.Second}, maxAttempts: maxAttempts, backoff: backoff}
+}
+
+// signWebhook returns the signature of a delivery of body at timestamp
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *webhookPublisher) Publish(event *model.UserEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errPublisherClosed
+	}
+	p.deliveries.Add(1)
+	go func() {
+		defer p.deliveries.Done()
+		p.deliver(event.Type, body)
+	}()
+	return nil
+}
+
+// Close waits for the deliveries in flight, retries included
+func (p *webhookPublisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.deliveries.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver posts body until it's accepted, refused for good or out of attempts
+func (p *webhookPublisher) deliver(eventType string, body []byte) {
+	wait := p.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := p.post(eventType, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= p.maxAttempts {
+			log.Printf("unable to deliver %s webhook after %d attempts: %v", eventType, attempt, err)
+			p.deadLetter(eventType, body, attempt, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// deadLetter keeps a delivery given up on in webhookDeadLetters, so it can be
+// replayed
+func (p *webhookPublisher) deadLetter(eventType string, body []byte, attempts int, failure error) {
+	if webhookDeadLetters == nil {
+		return
+	}
+	letter := &model.WebhookDeadLetter{
+		ID:        bson.NewObjectId().Hex(),
+		EventType: eventType,
+		URL:       p.url,
+		Body:      string(body),
+		Attempts:  attempts,
+		Error:     failure.Error(),
+		FailedAt:  time.Now().UTC(),
+	}
+	if err := webhookDeadLetters.Add(letter); err != nil {
+		log.Printf("unable to keep dead letter of %s webhook: %v", eventType, err)
+	}
+}
+
+// replay posts a dead letter again, once, returning the status it's answered
+// with and how long that took
+func (p *webhookPublisher) replay(letter *model.WebhookDeadLetter) (int, time.Duration, error) {
+	start := time.Now()
+	status, err := p.postTo(letter.URL, letter.EventType, []byte(letter.Body))
+	return status, time.Since(start), err
+}
+
+// post makes one delivery, reporting whether a failure is worth retrying
+func (p *webhookPublisher) post(eventType string, body []byte) (bool, error) {
+	status, err := p.postTo(p.url, eventType, body)
+	if err != nil && status == 0 {
+		return true, err
+	}
+	retry := status == http.StatusTooManyRequests || status >= 500
+	return retry, err
+}
+
+// postTo posts body to url once, signed, returning the status it's answered
+// with. That's 0 when there's no answer.
+func (p *webhookPublisher) postTo(url, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhook(p.secret, timestamp, body))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+}
+
+// test posts a sample event to url once, without retries, returning the
+// status it's answered with and how long that took
+func (p *webhookPublisher) test(url string) (int, time.Duration, error) {
+	body, err := json.Marshal(newUserEvent(userEventTest, "", nil))
+	if err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	status, err := p.postTo(url, userEventTest, body)
+	return status, time.Since(start), err
+}
+
+// natsTimeout bounds dialing a NATS server
+var natsTimeout = 5 * time.Second
+
+// natsQueueSize is how many events wait to be published to NATS at most,
+// events published while it's full are dropped
+var natsQueueSize = 1024
+
+var (
+	errNATSQueueFull   = errors.New("the NATS queue is full, dropping the event")
+	errPublisherClosed = errors.New("the publisher is closed")
+	errNoWebhook       = errors.New("no webhook is configured")
+)
+
+// natsPublisher publishes events to a NATS server, on the subject of the
+// prefix and the event type, e.g. users.user.created. Events are queued and
+// published by a worker in the background, so requests never wait for the
+// server, and the client reconnects when the connection drops. Credentials
+// are taken from the URL, user and password or a token, and the connection
+// is encrypted for tls:// URLs and servers requiring it. Errors the server
+// reports, such as a permissions violation, are logged.
+type natsPublisher struct {
+	prefix string
+	conn   *nats.Conn
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan *model.UserEvent
+	done   chan struct{}
+}
+
+// newNATSPublisher connects to the NATS server at rawURL, retrying in the
+// background when it can't be reached yet
+func newNATSPublisher(rawURL, prefix string, options ...nats.Option) (*natsPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+		return nil, fmt.Errorf("the NATS URL must look like nats://host:4222 or tls://host:4222")
+	}
+
+	options = append([]nats.Option{
+		nats.Name("buzz-user"),
+		nats.Timeout(natsTimeout),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Printf("NATS server error: %v", err)
+		}),
+	}, options...)
+	conn, err := nats.Connect(rawURL, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &natsPublisher{prefix: prefix, conn: conn, queue: make(chan *model.UserEvent, natsQueueSize), done: make(chan struct{})}
+	go p.run()
+	return p, nil
+}
+
+// Publish queues event, failing when the queue is full
+func (p *natsPublisher) Publish(event *model.UserEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errPublisherClosed
+	}
+	select {
+	case p.queue <- event:
+		return nil
+	default:
+		return errNATSQueueFull
+	}
+}
+
+// run publishes the events queued until the queue is closed
+func (p *natsPublisher) run() {
+	defer close(p.done)
+	for event := range p.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("unable to publish %s event to NATS: %v", event.Type, err)
+			continue
+		}
+		if err := p.conn.Publish(p.prefix+"."+event.Type, body); err != nil {
+			log.Printf("unable to publish %s event to NATS: %v", event.Type, err)
+		}
+	}
+}
+
+// Close publishes the events still queued, waiting for the server to get
+// them until ctx is done, and closes the connection
+func (p *natsPublisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	defer p.conn.Close()
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.conn.FlushWithContext(ctx)
+}
+
+// userUpdateHooks are told about users changed outside of the calls of
+// UserService, such as a role the directory changed at login
+var userUpdateHooks []func(user *model.User)
+
+// notifyUserUpdated tells userUpdateHooks that user changed
+func notifyUserUpdated(user *model.User) {
+	for _, f := range userUpdateHooks {
+		f(user)
+	}
+}
+
+// userServiceEventsMiddleware publishes an event after every successful
+// change of a user and every login. Failing to publish doesn't fail the call.
+type userServiceEventsMiddleware struct {
+	UserService
+	publisher EventPublisher
+}
+
+func newUserServiceEventsMiddleware(svc UserService, publisher EventPublisher) userServiceEventsMiddleware {
+	mw := userServiceEventsMiddleware{UserService: svc, publisher: publisher}
+	userUpdateHooks = append(userUpdateHooks, func(user *model.User) {
+		mw.publish(userEventUpdated, user.ID, user)
+	})
+	return mw
+}
+
+func (mw userServiceEventsMiddleware) publish(eventType, userID string, user *model.User) {
+	if err := mw.publisher.Publish(newUserEvent(eventType, userID, user)); err != nil {
+		log.Printf("unable to publish %s event: %v", eventType, err)
+	}
+}
+
+func (mw userServiceEventsMiddleware) Create(ctx context.Context, newUser *model.CreateUser) (*model.User, error) {
+	user, err := mw.UserService.Create(ctx, newUser)
+	if err == nil {
+		mw.publish(userEventCreated, user.ID, user)
+	}
+	return user, err
+}
+
+func (mw userServiceEventsMiddleware) Update(ctx context.Context, id string, updatedUser *model.UpdateUser) (*model.User, error) {
+	user, err := mw.UserService.Update(ctx, id, updatedUser)
+	if err == nil {
+		mw.publish(userEventUpdated, user.ID, user)
+	}
+	return user, err
+}
+
+func (mw userServiceEventsMiddleware) UpdateAttributes(ctx context.Context, id string, update *model.AttributeUpdate) (*model.User, error) {
+	user, err := mw.UserService.UpdateAttributes(ctx, id, update)
+	if err == nil {
+		mw.publish(userEventUpdated, user.ID, user)
+	}
+	return user, err
+}
+
+func (mw userServiceEventsMiddleware) SetStatus(ctx context.Context, id, status string) (*model.User, error) {
+	user, err := mw.UserService.SetStatus(ctx, id, status)
+	if err == nil {
+		mw.publish(userEventUpdated, user.ID, user)
+	}
+	return user, err
+}
+
+func (mw userServiceEventsMiddleware) Delete(ctx context.Context, id string) error {
+	err := mw.UserService.Delete(ctx, id)
+	if err == nil {
+		mw.publish(userEventDeleted, id, nil)
+	}
+	return err
+}
+
+func (mw userServiceEventsMiddleware) Remove(ctx context.Context, id string) error {
+	err := mw.UserService.Remove(ctx, id)
+	if err == nil {
+		mw.publish(userEventDeleted, id, nil)
+	}
+	return err
+}
+
+// EraseUser publishes a deletion, downstream services have to forget the
+// user just the same
+func (mw userServiceEventsMiddleware) EraseUser(ctx context.Context, id string) error {
+	err := mw.UserService.EraseUser(ctx, id)
+	if err == nil {
+		mw.publish(userEventDeleted, id, nil)
+	}
+	return err
+}
+
+func (mw userServiceEventsMiddleware) InviteUser(ctx context.Context, invitee *model.CreateUser, invitedBy string) (*model.Invitation, error) {
+	invitation, err := mw.UserService.InviteUser(ctx, invitee, invitedBy)
+	if err == nil {
+		mw.publish(userEventCreated, invitation.UserID, nil)
+	}
+	return invitation, err
+}
+
+func (mw userServiceEventsMiddleware) AcceptInvitation(ctx context.Context, token, password string) (*model.User, error) {
+	user, err := mw.UserService.AcceptInvitation(ctx, token, password)
+	if err == nil {
+		mw.publish(userEventUpdated, user.ID, user)
+	}
+	return user, err
+}
+
+func (mw userServiceEventsMiddleware) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	result, err := mw.UserService.Login(ctx, username, password, referer)
+	if err == nil {
+		mw.publish(userEventLogin, result.UserID, nil)
+	}
+	return result, err
+}
+
+func (mw userServiceEventsMiddleware) LoginWithProvider(ctx context.Context, profile *model.ExternalProfile, referer string) (*model.LoginResult, error) {
+	result, err := mw.UserService.LoginWithProvider(ctx, profile, referer)
+	if err == nil {
+		mw.publish(userEventLogin, result.UserID, nil)
+	}
+	return result, err
+}
+
+// updated publishes an update of user when the call changing it succeeded
+func (mw userServiceEventsMiddleware) updated(user *model.User, err error) (*model.User, error) {
+	if err == nil {
+		mw.publish(userEventUpdated, user.ID, user)
+	}
+	return user, err
+}
+
+func (mw userServiceEventsMiddleware) ChangePassword(ctx context.Context, id, currentPassword, newPassword string) error {
+	err := mw.UserService.ChangePassword(ctx, id, currentPassword, newPassword)
+	if err == nil {
+		mw.publish(userEventUpdated, id, nil)
+	}
+	return err
+}
+
+func (mw userServiceEventsMiddleware) CloseAccount(ctx context.Context, id string) (*model.User, error) {
+	return mw.updated(mw.UserService.CloseAccount(ctx, id))
+}
+
+func (mw userServiceEventsMiddleware) CancelClose(ctx context.Context, username, password string) (*model.User, error) {
+	return mw.updated(mw.UserService.CancelClose(ctx, username, password))
+}
+
+func (mw userServiceEventsMiddleware) Reactivate(ctx context.Context, id string) (*model.User, error) {
+	return mw.updated(mw.UserService.Reactivate(ctx, id))
+}
+
+func (mw userServiceEventsMiddleware) ResetPassword(ctx context.Context, token, newPassword string) (*model.User, error) {
+	return mw.updated(mw.UserService.ResetPassword(ctx, token, newPassword))
+}
+
+func (mw userServiceEventsMiddleware) VerifyEmail(ctx context.Context, token string) (*model.User, error) {
+	return mw.updated(mw.UserService.VerifyEmail(ctx, token))
+}
+
+func (mw userServiceEventsMiddleware) LinkIdentity(ctx context.Context, userID string, profile *model.ExternalProfile) (*model.User, error) {
+	return mw.updated(mw.UserService.LinkIdentity(ctx, userID, profile))
+}
+
+func (mw userServiceEventsMiddleware) UnlinkIdentity(ctx context.Context, userID, provider string) (*model.User, error) {
+	return mw.updated(mw.UserService.UnlinkIdentity(ctx, userID, provider))
+}
+
+// DeactivateInactive publishes an update of every user deactivated, none on
+// a dry run
+func (mw userServiceEventsMiddleware) DeactivateInactive(ctx context.Context, cutoff time.Time, dryRun bool) ([]string, error) {
+	ids, err := mw.UserService.DeactivateInactive(ctx, cutoff, dryRun)
+	if !dryRun {
+		// A batch failing doesn't undo the ones before it
+		for _, id := range ids {
+			mw.publish(userEventUpdated, id, nil)
+		}
+	}
+	return ids, err
+}
+
+func (mw userServiceEventsMiddleware) PurgeClosedAccounts(ctx context.Context, now time.Time) ([]string, error) {
+	purged, err := mw.UserService.PurgeClosedAccounts(ctx, now)
+	for _, id := range purged {
+		mw.publish(userEventDeleted, id, nil)
+	}
+	return purged, err
+}
+
+// ReissueID publishes the user under its new id, along with the one
+// downstream services know it by
+func (mw userServiceEventsMiddleware) ReissueID(ctx context.Context, id string) (*model.User, error) {
+	user, err := mw.UserService.ReissueID(ctx, id)
+	if err == nil {
+		event := newUserEvent(userEventReissued, user.ID, user)
+		event.PreviousUserID = id
+		if err := mw.publisher.Publish(event); err != nil {
+			log.Printf("unable to publish %s event: %v", userEventReissued, err)
+		}
+	}
+	return user, err
+}
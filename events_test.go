@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+)
+
+// recordingPublisher remembers the events published with it
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []*model.UserEvent
+}
+
+func (p *recordingPublisher) Publish(event *model.UserEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *recordingPublisher) Close(ctx context.Context) error {
+	return nil
+}
+
+// deletingService deletes every user but missingID
+type deletingService struct {
+	auditedLoginService
+}
+
+func (deletingService) Delete(ctx context.Context, id string) error {
+	if id == "missingID" {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func TestUserServiceEventsMiddleware(t *testing.T) {
+	publisher := &recordingPublisher{}
+	svc := newUserServiceEventsMiddleware(deletingService{}, publisher)
+
+	svc.Login(context.Background(), "alex", "right", "")
+	svc.Login(context.Background(), "alex", "wrong", "")
+	svc.Delete(context.Background(), "deletedID")
+	svc.Delete(context.Background(), "missingID")
+
+	if len(publisher.events) != 2 {
+		t.Fatalf("Expected only the successful calls to publish events but got: %d", len(publisher.events))
+	}
+	if event := publisher.events[0]; event.Type != userEventLogin || event.UserID != "alexID" || event.ID == "" {
+		t.Errorf("Expected a login event of alexID but got: %+v", event)
+	}
+	if event := publisher.events[1]; event.Type != userEventDeleted || event.UserID != "deletedID" || event.User != nil {
+		t.Errorf("Expected a deletion event of deletedID but got: %+v", event)
+	}
+}
+
+func TestUserServiceEventsMiddlewareHook(t *testing.T) {
+	defer func(hooks []func(*model.User)) { userUpdateHooks = hooks }(userUpdateHooks)
+	userUpdateHooks = nil
+
+	publisher := &recordingPublisher{}
+	newUserServiceEventsMiddleware(deletingService{}, publisher)
+
+	// Like the directory changing a role at login
+	notifyUserUpdated(&model.User{ID: "promotedID", Role: "admin"})
+
+	if len(publisher.events) != 1 {
+		t.Fatalf("Expected the change to be published but got: %d", len(publisher.events))
+	}
+	if event := publisher.events[0]; event.Type != userEventUpdated || event.UserID != "promotedID" || event.User.Role != "admin" {
+		t.Errorf("Expected an update of promotedID but got: %+v", event)
+	}
+}
+
+// purgingService purges firstID and secondID, and reissues every id as
+// reissuedID
+type purgingService struct {
+	UserService
+}
+
+func (purgingService) PurgeClosedAccounts(ctx context.Context, now time.Time) ([]string, error) {
+	return []string{"firstID", "secondID"}, nil
+}
+
+func (purgingService) DeactivateInactive(ctx context.Context, cutoff time.Time, dryRun bool) ([]string, error) {
+	return []string{"inactiveID"}, nil
+}
+
+func (purgingService) ReissueID(ctx context.Context, id string) (*model.User, error) {
+	return &model.User{ID: "reissuedID"}, nil
+}
+
+func TestUserServiceEventsMiddlewareBatches(t *testing.T) {
+	publisher := &recordingPublisher{}
+	svc := newUserServiceEventsMiddleware(purgingService{}, publisher)
+
+	svc.PurgeClosedAccounts(context.Background(), time.Now())
+	svc.DeactivateInactive(context.Background(), time.Now(), true)
+	svc.DeactivateInactive(context.Background(), time.Now(), false)
+	svc.ReissueID(context.Background(), "oldID")
+
+	expected := []model.UserEvent{
+		{Type: userEventDeleted, UserID: "firstID"},
+		{Type: userEventDeleted, UserID: "secondID"},
+		{Type: userEventUpdated, UserID: "inactiveID"},
+		{Type: userEventReissued, UserID: "reissuedID", PreviousUserID: "oldID"},
+	}
+	if len(publisher.events) != len(expected) {
+		t.Fatalf("Expected an event for every user changed, none on a dry run, but got: %d", len(publisher.events))
+	}
+	for i, event := range publisher.events {
+		if event.Type != expected[i].Type || event.UserID != expected[i].UserID || event.PreviousUserID != expected[i].PreviousUserID {
+			t.Errorf("Expected %+v at %d but got: %+v", expected[i], i, event)
+		}
+	}
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	delivered := make(chan *http.Request, 1)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if got := signWebhook("webhookSecret", r.Header.Get(webhookTimestampHeader), body); got != r.Header.Get(webhookSignatureHeader) {
+			t.Errorf("Expected the delivery to be signed with %s but got: %s", got, r.Header.Get(webhookSignatureHeader))
+		}
+		var event model.UserEvent
+		if err := json.Unmarshal(body, &event); err != nil || event.UserID != "createdID" {
+			t.Errorf("Expected the event as JSON but got: %s", body)
+		}
+		delivered <- r
+	}))
+	defer server.Close()
+
+	publisher := newWebhookPublisher(server.URL, "webhookSecret", 3, time.Millisecond)
+	if err := publisher.Publish(newUserEvent(userEventCreated, "createdID", &model.User{ID: "createdID"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing waits for the delivery, retries included
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := publisher.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-delivered:
+		if r.Header.Get(webhookEventHeader) != userEventCreated {
+			t.Errorf("Expected the event type in the headers but got: %q", r.Header.Get(webhookEventHeader))
+		}
+	default:
+		t.Fatal("Expected the delivery to be retried until it's accepted before closing")
+	}
+	if err := publisher.Publish(newUserEvent(userEventCreated, "createdID", nil)); err != errPublisherClosed {
+		t.Errorf("Expected nothing to be published once closed but got: %v", err)
+	}
+
+	// Refused deliveries aren't worth retrying
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer refusing.Close()
+	if retry, err := newWebhookPublisher(refusing.URL, "webhookSecret", 3, time.Millisecond).post(userEventCreated, []byte(`{}`)); err == nil || retry {
+		t.Errorf("Expected a 400 to fail without a retry but got: %v, %v", retry, err)
+	}
+}
+
+func TestTestWebhookHTTPEndpoint(t *testing.T) {
+	defer func(publisher *webhookPublisher, secret string) { webhook, WebhookSecret = publisher, secret }(webhook, WebhookSecret)
+	webhook, WebhookSecret = nil, "webhookSecret"
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := ioutil.ReadAll(r.Body)
+		if got := signWebhook("webhookSecret", r.Header.Get(webhookTimestampHeader), body); got != r.Header.Get(webhookSignatureHeader) {
+			t.Errorf("Expected the sample to be signed with %s but got: %s", got, r.Header.Get(webhookSignatureHeader))
+		}
+		if r.Header.Get(webhookEventHeader) != userEventTest {
+			t.Errorf("Expected a %s event but got: %q", userEventTest, r.Header.Get(webhookEventHeader))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	test := func(body string) (*httptest.ResponseRecorder, reqres.TestWebhookResponse) {
+		rec := httptest.NewRecorder()
+		handleTestWebhook().ServeHTTP(rec, httptest.NewRequest("POST", WebhookTestPath, strings.NewReader(body)))
+		var payload reqres.TestWebhookResponse
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec, payload
+	}
+
+	// Without a webhook there's nowhere to send to
+	if rec, _ := test(""); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected a 501 status code response without a webhook but got: %d", rec.Code)
+	}
+	if rec, _ := test(`{"url":"ftp://example.com"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response for a non http URL but got: %d", rec.Code)
+	}
+
+	// A supplied URL is sent to, once, with the status it answered
+	rec, payload := test(`{"url":"` + server.URL + `"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", rec.Code)
+	}
+	if payload.URL != server.URL || payload.Status != http.StatusServiceUnavailable || payload.Error == "" || attempts != 1 {
+		t.Errorf("Expected one failed attempt reported but got: %+v after %d attempts", payload, attempts)
+	}
+
+	// Otherwise the configured webhook is
+	webhook = newWebhookPublisher(server.URL, "webhookSecret", 3, time.Millisecond)
+	if _, payload := test(""); payload.URL != server.URL || payload.Status != http.StatusServiceUnavailable || attempts != 2 {
+		t.Errorf("Expected the configured webhook to be tried once but got: %+v after %d attempts", payload, attempts)
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	defer func(publisher *webhookPublisher, store DeadLetterStore) {
+		webhook, webhookDeadLetters = publisher, store
+	}(webhook, webhookDeadLetters)
+	webhookDeadLetters = &memoryDeadLetterStore{}
+
+	var mu sync.Mutex
+	accepting := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !accepting {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	// A delivery out of attempts is kept
+	webhook = newWebhookPublisher(server.URL, "webhookSecret", 2, time.Millisecond)
+	webhook.deliver(userEventCreated, []byte(`{"user_id":"createdID"}`))
+
+	router := mux.NewRouter()
+	router.Handle(DeadLettersPath, handleListDeadLetters())
+	router.Handle(ReplayLetterPath, handleReplayDeadLetter())
+	list := func() []model.WebhookDeadLetter {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", DeadLettersPath, nil))
+		var payload reqres.ListDeadLettersResponse
+		if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload.DeadLetters
+	}
+	replay := func(id string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", DeadLettersPath+"/"+id+"/replay", nil))
+		return rec.Code
+	}
+
+	letters := list()
+	if len(letters) != 1 || letters[0].EventType != userEventCreated || letters[0].Attempts != 2 || letters[0].URL != server.URL || letters[0].Body != `{"user_id":"createdID"}` {
+		t.Fatalf("Expected the delivery given up on to be kept but got: %+v", letters)
+	}
+
+	// Replaying it keeps it until it's accepted
+	if code := replay("unknown"); code != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response for an unknown dead letter but got: %d", code)
+	}
+	if code := replay(letters[0].ID); code != http.StatusBadGateway || len(list()) != 1 {
+		t.Errorf("Expected a refused replay to be kept with a 502 but got: %d", code)
+	}
+	mu.Lock()
+	accepting = true
+	mu.Unlock()
+	if code := replay(letters[0].ID); code != http.StatusOK {
+		t.Errorf("Expected a 200 status code response but got: %d", code)
+	}
+	if letters := list(); len(letters) != 0 {
+		t.Errorf("Expected the replayed delivery to be dropped but got: %+v", letters)
+	}
+}
+
+// fakeNATSServer accepts one connection on listener, greeting it with info
+// and upgrading it with tlsConfig when there is one. It answers pings with a
+// pong, and sends every other line it reads to received.
+func fakeNATSServer(listener net.Listener, info string, tlsConfig *tls.Config, received chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("INFO " + info + "\r\n"))
+	if tlsConfig != nil {
+		conn = tls.Server(conn, tlsConfig)
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			close(received)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "PING" {
+			conn.Write([]byte("PONG\r\n"))
+			continue
+		}
+		received <- line
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 8)
+	go fakeNATSServer(listener, `{"server_id":"test","max_payload":1048576}`, nil, received)
+
+	publisher, err := newNATSPublisher("nats://alex:secret@"+listener.Addr().String(), "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(newUserEvent(userEventLogin, "loggedID", nil)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := publisher.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for len(lines) < 3 {
+		lines = append(lines, <-received)
+	}
+	if !strings.HasPrefix(lines[0], "CONNECT ") || !strings.Contains(lines[0], `"user":"alex","pass":"secret"`) {
+		t.Errorf("Expected to connect with the credentials of the URL but got: %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "PUB users.user.login ") || !strings.Contains(lines[2], `"user_id":"loggedID"`) {
+		t.Errorf("Expected the event to be published on users.user.login but got: %q", lines[1:])
+	}
+	if err := publisher.Publish(newUserEvent(userEventLogin, "loggedID", nil)); err != errPublisherClosed {
+		t.Errorf("Expected nothing to be published once closed but got: %v", err)
+	}
+
+	if _, err := newNATSPublisher("http://localhost:4222", "users"); err == nil {
+		t.Error("Expected a URL of another scheme to be refused")
+	}
+}
+
+func TestNATSPublisherQueueFull(t *testing.T) {
+	// Without a worker, nothing leaves the queue
+	publisher := &natsPublisher{prefix: "users", queue: make(chan *model.UserEvent, 1)}
+	if err := publisher.Publish(newUserEvent(userEventLogin, "firstID", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(newUserEvent(userEventLogin, "secondID", nil)); err != errNATSQueueFull {
+		t.Errorf("Expected an event to be dropped while the queue is full but got: %v", err)
+	}
+}
+
+func TestNATSPublisherTLS(t *testing.T) {
+	// The test server's certificate is for 127.0.0.1
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 8)
+	go fakeNATSServer(listener, `{"server_id":"test","max_payload":1048576,"tls_required":true}`, server.TLS, received)
+
+	rootCAs := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	publisher, err := newNATSPublisher("nats://"+listener.Addr().String(), "users", nats.Secure(&tls.Config{RootCAs: rootCAs}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close(context.Background())
+	if line := <-received; !strings.Contains(line, `"tls_required":true`) {
+		t.Errorf("Expected to connect over TLS but got: %q", line)
+	}
+}
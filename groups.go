@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxGroupNameLength caps how long a group name can be
+const maxGroupNameLength = 64
+
+var (
+	errGroupNotFound  = errors.New("group not found")
+	errDuplicateGroup = errors.New("a group with that name already exists")
+	errNotGroupMember = errors.New("the user isn't a member of the group")
+)
+
+// groupCollection returns the collection of groups. Their names are unique
+// whatever their case by an index of migration 0001.
+func groupCollection(session *mgo.Session) (*mgo.Collection, error) {
+	return session.DB("buzz-test-user").C("groups"), nil
+}
+
+// groupMemberCollection returns the collection of group memberships, which
+// are named after their group and user so each user joins a group once
+func groupMemberCollection(session *mgo.Session) (*mgo.Collection, error) {
+	return session.DB("buzz-test-user").C("group_members"), nil
+}
+
+// groupNameKey is what group names are compared by
+func groupNameKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// groupMembershipID names the membership of userID in groupID
+func groupMembershipID(groupID, userID string) string {
+	return groupID + ":" + userID
+}
+
+// newGroup returns a group named name, to be stored
+func newGroup(name, description string) *model.Group {
+	now := time.Now()
+	return &model.Group{
+		ID:          bson.NewObjectId().Hex(),
+		Name:        strings.TrimSpace(name),
+		NameKey:     groupNameKey(name),
+		Description: description,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+}
+
+// groupIDsOf returns the ids of the groups userID belongs to, for the groups
+// claim of their tokens. Tokens carry the groups of when they were issued, so
+// changes show once they're refreshed.
+func groupIDsOf(session *mgo.Session, userID string) ([]string, error) {
+	members, err := groupMemberCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if err := members.Find(bson.M{"user_id": userID}).Distinct("group_id", &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// groupsOf returns the groups userID belongs to, by name
+func groupsOf(session *mgo.Session, userID string) ([]model.Group, error) {
+	ids, err := groupIDsOf(session, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	collection, err := groupCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []model.Group{}
+	if len(ids) == 0 {
+		return groups, nil
+	}
+	if err := collection.Find(bson.M{"_id": bson.M{"$in": ids}}).Sort("name_key").All(&groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
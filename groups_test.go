@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buzzapp/user/model"
+	"github.com/gorilla/mux"
+)
+
+// groupingService knows the group "groupID", named "Staff", and the user
+// "userID", who isn't a member of it yet
+type groupingService struct {
+	UserService
+	members map[string]bool
+}
+
+func (s *groupingService) CreateGroup(ctx context.Context, name, description string) (*model.Group, error) {
+	if groupNameKey(name) == "staff" {
+		return nil, errDuplicateGroup
+	}
+	return newGroup(name, description), nil
+}
+
+func (s *groupingService) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	if groupID != "groupID" {
+		return errGroupNotFound
+	}
+	if userID != "userID" {
+		return errUserNotFound
+	}
+	s.members[userID] = true
+	return nil
+}
+
+func (s *groupingService) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	if groupID != "groupID" {
+		return errGroupNotFound
+	}
+	if !s.members[userID] {
+		return errNotGroupMember
+	}
+	delete(s.members, userID)
+	return nil
+}
+
+func TestCreateGroup(t *testing.T) {
+	svc := &groupingService{}
+	create := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleCreateGroup(svc).ServeHTTP(rec, httptest.NewRequest("POST", GroupsPath, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := create(`{"name":" Teachers ","description":"Everyone teaching"}`); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"name":"Teachers"`) {
+		t.Errorf("Expected the group to be created with its name trimmed but got: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := create(`{"name":"STAFF"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected a name taken in another case to be a conflict but got: %d", rec.Code)
+	}
+	if rec := create(`{"name":"  "}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a blank name to be refused but got: %d", rec.Code)
+	}
+	if rec := create(`{"name":"` + strings.Repeat("a", maxGroupNameLength+1) + `"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a name that's too long to be refused but got: %d", rec.Code)
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	svc := &groupingService{members: map[string]bool{}}
+	router := mux.NewRouter()
+	router.Handle(GroupMemberPath, handleAddGroupMember(svc)).Methods("POST")
+	router.Handle(GroupMemberPath, handleRemoveGroupMember(svc)).Methods("DELETE")
+
+	do := func(method, groupID, userID string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, "/groups/"+groupID+"/members/"+userID, nil))
+		return rec.Code
+	}
+
+	for _, test := range []struct {
+		method, groupID, userID string
+		code                    int
+	}{
+		{"DELETE", "groupID", "userID", http.StatusNotFound},
+		{"POST", "groupID", "userID", http.StatusNoContent},
+		{"POST", "groupID", "userID", http.StatusNoContent},
+		{"POST", "otherID", "userID", http.StatusNotFound},
+		{"POST", "groupID", "otherID", http.StatusNotFound},
+		{"DELETE", "otherID", "userID", http.StatusNotFound},
+		{"DELETE", "groupID", "userID", http.StatusNoContent},
+	} {
+		if code := do(test.method, test.groupID, test.userID); code != test.code {
+			t.Errorf("Expected %s of %s in %s to be a %d but got: %d", test.method, test.userID, test.groupID, test.code, code)
+		}
+	}
+}
+
+func TestGroupsClaim(t *testing.T) {
+	token, err := generateSessionToken("userID", "testUser", "student", "", "sessionID", []string{"groupID", "otherID"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, _ := parsed.Claims["groups"].([]interface{})
+	if len(groups) != 2 || groups[0] != "groupID" || groups[1] != "otherID" {
+		t.Errorf("Expected the token to claim both groups but got: %v", parsed.Claims["groups"])
+	}
+
+	// Users in no group get no claim at all
+	token, err = generateSessionToken("userID", "testUser", "student", "", "sessionID", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err = parseToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsed.Claims["groups"]; ok {
+		t.Errorf("Expected no groups claim but got: %v", parsed.Claims["groups"])
+	}
+}
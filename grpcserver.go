@@ -0,0 +1,342 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative userpb/users.proto
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+	"github.com/buzzapp/user/userpb"
+	"gitlab.fg/go/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcPublicMethods can be called without credentials, like the routes they
+// match. Credentials that are sent must still be valid.
+var grpcPublicMethods = map[string]bool{
+	userpb.UsersCreateMethod:        true,
+	userpb.UsersLoginMethod:         true,
+	userpb.UsersRefreshTokenMethod:  true,
+	userpb.UsersValidateTokenMethod: true,
+}
+
+// grpcHTTPMethods are the HTTP methods of the routes matching gRPC methods,
+// which API key scopes are checked against. Others are POSTs.
+var grpcHTTPMethods = map[string]string{
+	userpb.UsersGetByIDMethod: http.MethodGet,
+}
+
+// newGRPCServer returns a gRPC server serving svc, the same UserService the
+// HTTP routes use, with the logging and auth interceptors
+func newGRPCServer(l *logger.ServiceLogger, svc UserService) *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcLoggingInterceptor(l), grpcAuthInterceptor))
+	userpb.RegisterUsersServer(server, grpcUserServer{svc})
+	return server
+}
+
+// grpcRequest returns the gRPC call of ctx to method as an http.Request, so
+// it is authenticated, throttled and audited the way HTTP requests are.
+// Metadata becomes headers, e.g. authorization and user-agent.
+func grpcRequest(ctx context.Context, method string) *http.Request {
+	r := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: method}, Proto: "HTTP/2.0", Header: http.Header{}}
+	if httpMethod, ok := grpcHTTPMethods[method]; ok {
+		r.Method = httpMethod
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r.WithContext(ctx)
+}
+
+// grpcClaims returns the token claims grpcAuthInterceptor put in ctx
+func grpcClaims(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(claimsContextKey).(map[string]interface{})
+	return claims
+}
+
+// grpcAuthInterceptor checks the credentials of calls like authMiddleware,
+// putting their claims in the context for grpcClaims. Calls to methods that
+// aren't public need credentials, refused ones get Unauthenticated and API
+// keys without the scope for the method PermissionDenied.
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	r := grpcRequest(ctx, info.FullMethod)
+	if r.Header.Get("Authorization") == "" && grpcPublicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	claims, challenge, err := authenticate(r)
+	if err != nil && challenge == "" {
+		log.Println("unable to check credentials:", err)
+		return nil, status.Error(codes.Internal, "unable to check credentials")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Authentication required: "+err.Error())
+	}
+	if scopes, ok := apiKeyScopes(claims); ok && !apiKeyAllows(scopes, r.Method) {
+		return nil, status.Error(codes.PermissionDenied, "Access not allowed: "+errAPIKeyScopeDenied.Error())
+	}
+	if scopes, ok := unverifiedTokenScopes(claims); ok && !apiKeyAllows(scopes, r.Method) {
+		return nil, status.Error(codes.PermissionDenied, "Access not allowed: "+errUnverifiedScopeDenied.Error())
+	}
+
+	if sessionID := sessionOf(claims); sessionID != "" {
+		touchSession(sessionID)
+	}
+
+	// Let the methods know who is calling
+	return handler(context.WithValue(ctx, claimsContextKey, claims), req)
+}
+
+// grpcLoggingInterceptor logs every call with its method, status code and
+// latency, like the request log does for HTTP
+func grpcLoggingInterceptor(l *logger.ServiceLogger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		l.Info("gRPC Request", "gRPC", "method", info.FullMethod, "code", status.Code(err).String(), "latency", time.Since(start).String())
+		return resp, err
+	}
+}
+
+// grpcError turns an error of the service into a gRPC status with the code
+// matching the HTTP status its routes respond with. The details of internal
+// errors are only logged.
+func grpcError(msg string, err error) error {
+	var code codes.Code
+	switch {
+	case isValidationError(err):
+		code = codes.InvalidArgument
+	case err == errDuplicateEmail, err == errDuplicateUsername, err == errDirectoryEmailTaken:
+		code = codes.AlreadyExists
+	case err == errUserNotFound:
+		code = codes.NotFound
+	case err == errInvalidCredentials, err == errInvalidRefreshToken, err == errRefreshTokenReused, err == errReauthRequired, err == errAccountInactive:
+		code = codes.Unauthenticated
+	case err == errOriginMismatch, err == errNoDirectoryEmail:
+		code = codes.PermissionDenied
+	case err == errIdentityNotLinked, err == errStepUpRequired:
+		code = codes.FailedPrecondition
+	case err == errServiceTimeout, err == errDirectoryUnavailable:
+		code = codes.Unavailable
+	case err == context.Canceled:
+		code = codes.Canceled
+	default:
+		log.Println(msg+":", err)
+		return status.Error(codes.Internal, msg)
+	}
+	return status.Error(code, msg+": "+err.Error())
+}
+
+// grpcUserServer serves the Users gRPC service with the same UserService,
+// validation and policies as the HTTP routes
+type grpcUserServer struct {
+	svc UserService
+}
+
+func (s grpcUserServer) Create(ctx context.Context, in *userpb.CreateRequest) (*userpb.User, error) {
+	// Do some validation
+	payload := &reqres.CreateUserRequest{
+		Email:              in.GetEmail(),
+		FirstName:          in.GetFirstName(),
+		LastName:           in.GetLastName(),
+		Password:           in.GetPassword(),
+		Role:               in.GetRole(),
+		Username:           in.GetUsername(),
+		DateOfBirth:        in.GetDateOfBirth(),
+		AcceptedTOSVersion: in.GetAcceptedTosVersion(),
+	}
+	if err := validateCreateUser(payload, &validation{mode: validationMode}); err != nil {
+		return nil, grpcError("Validation error", err)
+	}
+
+	// Create our new user struct
+	newUser := &model.CreateUser{
+		Email:              payload.Email,
+		FirstName:          payload.FirstName,
+		LastName:           payload.LastName,
+		Password:           payload.Password,
+		Role:               payload.Role,
+		Username:           payload.Username,
+		DateOfBirth:        payload.DateOfBirth,
+		AcceptedTOSVersion: payload.AcceptedTOSVersion,
+	}
+
+	// Only admins can create accounts with another role than the default
+	creator := creatorSignup
+	if hasRole(grpcClaims(ctx), "admin") {
+		creator = creatorAdmin
+	}
+
+	user, err := s.svc.Create(withCreator(ctx, creator), newUser)
+	recordAuditEvent(grpcRequest(ctx, userpb.UsersCreateMethod), userIDOf(user), auditActionCreate, err)
+	if err != nil {
+		return nil, grpcError("unable to add user", err)
+	}
+	return userToProto(user), nil
+}
+
+func (s grpcUserServer) GetByID(ctx context.Context, in *userpb.GetByIDRequest) (*userpb.User, error) {
+	// Do some validation
+	if err := validateGetUserByID(in.GetId()); err != nil {
+		return nil, grpcError("Validation error", err)
+	}
+
+	// Users can only get themselves, unless they are admins. Admins see
+	// soft-deleted users too.
+	claims := grpcClaims(ctx)
+	admin := hasRole(claims, "admin")
+	if sub, _ := claims["sub"].(string); !admin && (sub == "" || sub != in.GetId()) {
+		return nil, status.Error(codes.PermissionDenied, "Access not allowed: "+roleError(claims, []string{"admin"}).Error())
+	}
+
+	var user *model.User
+	var err error
+	if admin {
+		user, err = s.svc.GetByIDIncludingDeleted(ctx, in.GetId())
+	} else {
+		user, err = s.svc.GetByID(ctx, in.GetId())
+	}
+	if err != nil {
+		return nil, grpcError("unable to get user", err)
+	}
+	return userToProto(user), nil
+}
+
+func (s grpcUserServer) Login(ctx context.Context, in *userpb.LoginRequest) (*userpb.LoginResponse, error) {
+	// Do some validation
+	payload := &reqres.LoginRequest{Username: in.GetUsername(), Password: in.GetPassword()}
+	if err := validateLoginUser(payload); err != nil {
+		return nil, grpcError("Validation error", err)
+	}
+
+	// Slow down bursts of failed logins before checking the password
+	r := grpcRequest(ctx, userpb.UsersLoginMethod)
+	if loginThrottle != nil && !loginThrottle.IsExempt(payload.Username, userRole(ctx, s.svc)) {
+		throttled, _, err := loginThrottle.Throttled(clientIP(r), payload.Username)
+		if err != nil {
+			// Don't turn a rate limit store outage into a login outage
+			log.Println("unable to check login throttle:", err)
+		}
+		if throttled {
+			return nil, status.Error(codes.ResourceExhausted, "Too many requests: too many failed logins, try again later")
+		}
+	}
+
+	result, err := s.svc.Login(withClient(r), payload.Username, payload.Password, r.Referer())
+	if err == errInvalidCredentials {
+		recordFailedLogin(r, s.svc, payload.Username)
+		recordAuditEvent(r, userIDOf(lookupUsername(ctx, s.svc, payload.Username)), auditActionLogin, err)
+	}
+	if err != nil {
+		return nil, grpcError("unable to log in user", err)
+	}
+	if err := checkGRPCConcurrentLogin(r, result.UserID); err != nil {
+		return nil, grpcError("unable to log in user", err)
+	}
+	recordSuccessfulLogin(payload.Username)
+	recordAuditEvent(r, result.UserID, auditActionLogin, nil)
+
+	return loginResultToProto(result), nil
+}
+
+// checkGRPCConcurrentLogin is checkConcurrentLogin for logins over gRPC, which
+// can't send the one-time code a login needing it has to be confirmed with.
+// They are refused, so the login is made over HTTP.
+func checkGRPCConcurrentLogin(r *http.Request, userID string) error {
+	if concurrentLoginMode == concurrentLoginIgnore {
+		return nil
+	}
+
+	ip := clientIP(r)
+	lastIP, concurrent := recentLogins.Concurrent(userID, ip)
+	if concurrent {
+		recordAuditDetail(r, userID, auditActionConcurrent, fmt.Sprintf("from %s and %s within %s", lastIP, ip, concurrentLoginWindow), nil)
+	}
+	if concurrent && concurrentLoginMode == concurrentLoginChallenge {
+		return errStepUpRequired
+	}
+
+	recentLogins.Record(userID, ip)
+	return nil
+}
+
+func (s grpcUserServer) RefreshToken(ctx context.Context, in *userpb.RefreshTokenRequest) (*userpb.LoginResponse, error) {
+	// Do some validation
+	if err := validateRefreshToken(&reqres.RefreshTokenRequest{RefreshToken: in.GetRefreshToken()}); err != nil {
+		return nil, grpcError("Validation error", err)
+	}
+
+	// Swap the refresh token for a new pair
+	r := grpcRequest(ctx, userpb.UsersRefreshTokenMethod)
+	result, err := s.svc.RefreshToken(withClient(r), in.GetRefreshToken(), requestOrigin(r))
+	recordAuditEvent(r, loginResultUserID(result), auditActionTokenRefresh, err)
+	if err == errUserNotFound {
+		return nil, status.Error(codes.Unauthenticated, "Access not allowed: "+err.Error())
+	}
+	if err != nil {
+		return nil, grpcError("unable to refresh token", err)
+	}
+	return loginResultToProto(result), nil
+}
+
+func (s grpcUserServer) ValidateToken(ctx context.Context, in *userpb.ValidateTokenRequest) (*userpb.ValidateTokenResponse, error) {
+	// The token is checked exactly like the ones of HTTP requests
+	r := grpcRequest(ctx, userpb.UsersValidateTokenMethod)
+	r.Header.Set("Authorization", "Bearer "+in.GetToken())
+	claims, challenge, err := authenticate(r)
+	if err != nil && challenge == "" {
+		log.Println("unable to check credentials:", err)
+		return nil, status.Error(codes.Internal, "unable to check credentials")
+	}
+	if err != nil {
+		return &userpb.ValidateTokenResponse{Error: err.Error()}, nil
+	}
+
+	sub, username, role, _ := identityClaims(claims)
+	exp, _ := claims["exp"].(float64)
+	return &userpb.ValidateTokenResponse{Valid: true, UserId: sub, Username: username, Role: role, ExpiresAt: int64(exp)}, nil
+}
+
+func userToProto(user *model.User) *userpb.User {
+	return &userpb.User{
+		Id:          user.ID,
+		Email:       user.Email,
+		FirstName:   user.FirstName,
+		LastName:    user.LastName,
+		Role:        user.Role,
+		Username:    user.Username,
+		Status:      user.Status,
+		Timestamp:   user.Timestamp,
+		DisplayName: user.DisplayName,
+		Locale:      user.Locale,
+	}
+}
+
+func loginResultToProto(result *model.LoginResult) *userpb.LoginResponse {
+	return &userpb.LoginResponse{
+		UserId:                result.UserID,
+		Token:                 string(result.Token),
+		RefreshToken:          result.RefreshToken,
+		TosAcceptanceRequired: result.TOSAcceptanceRequired,
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/userpb"
+)
+
+// grpcTestService has the user "userID", who logs in with the password
+// "right"
+type grpcTestService struct {
+	UserService
+}
+
+func (grpcTestService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	if id != "userID" {
+		return nil, errUserNotFound
+	}
+	return &model.User{ID: id, Username: "testUser", Role: "student", Timestamp: 42}, nil
+}
+
+func (s grpcTestService) GetByIDIncludingDeleted(ctx context.Context, id string) (*model.User, error) {
+	return s.GetByID(ctx, id)
+}
+
+func (grpcTestService) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	if password != "right" {
+		return nil, errInvalidCredentials
+	}
+	return &model.LoginResult{UserID: "userID", Token: "accessToken", RefreshToken: "refreshToken"}, nil
+}
+
+// dialTestGRPCServer serves svc over an in-memory connection, returning a
+// client of it and the function stopping it, which returns what it logged
+func dialTestGRPCServer(t *testing.T, svc UserService) (userpb.UsersClient, func() string) {
+	dir, err := ioutil.TempDir("", "grpcserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "service.log")
+	sink, err := newLogSink(logSinkFile, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(getLogger(sink), svc)
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := func() string {
+		conn.Close()
+		server.Stop()
+		sink.Close()
+		log.SetOutput(os.Stderr)
+		defer os.RemoveAll(dir)
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+	return userpb.NewUsersClient(conn), stop
+}
+
+func TestGRPCGetByID(t *testing.T) {
+	client, stop := dialTestGRPCServer(t, grpcTestService{})
+
+	studentToken, err := generateToken("userID", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := generateToken("otherID", "otherUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminToken, err := generateToken("adminID", "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		id    string
+		code  codes.Code
+	}{
+		{"self", studentToken, "userID", codes.OK},
+		{"admin", adminToken, "userID", codes.OK},
+		{"unknown", adminToken, "nobody", codes.NotFound},
+		{"someone else", otherToken, "userID", codes.PermissionDenied},
+		{"without token", "", "userID", codes.Unauthenticated},
+		{"invalid token", "not-a-token", "userID", codes.Unauthenticated},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+test.token)
+		}
+		user, err := client.GetByID(ctx, &userpb.GetByIDRequest{Id: test.id})
+		if status.Code(err) != test.code {
+			t.Errorf("%s: expected %s but got: %v", test.name, test.code, err)
+			continue
+		}
+		if err == nil && (user.Id != "userID" || user.Username != "testUser" || user.Timestamp != 42) {
+			t.Errorf("%s: expected userID but got: %v", test.name, user)
+		}
+	}
+
+	// Every call is logged with its outcome
+	contents := stop()
+	for _, code := range []string{"OK", "NotFound", "PermissionDenied", "Unauthenticated"} {
+		if !strings.Contains(contents, code) {
+			t.Errorf("Expected a call logged with %s but got: %s", code, contents)
+		}
+	}
+}
+
+func TestGRPCLogin(t *testing.T) {
+	client, stop := dialTestGRPCServer(t, grpcTestService{})
+	defer stop()
+
+	resp, err := client.Login(context.Background(), &userpb.LoginRequest{Username: "testUser", Password: "right"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.UserId != "userID" || resp.Token != "accessToken" || resp.RefreshToken != "refreshToken" {
+		t.Errorf("Expected the tokens of userID but got: %v", resp)
+	}
+
+	_, err = client.Login(context.Background(), &userpb.LoginRequest{Username: "testUser", Password: "wrong"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated for a wrong password but got: %v", err)
+	}
+
+	_, err = client.Login(context.Background(), &userpb.LoginRequest{Username: "testUser"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without a password but got: %v", err)
+	}
+}
+
+func TestGRPCValidateToken(t *testing.T) {
+	client, stop := dialTestGRPCServer(t, grpcTestService{})
+	defer stop()
+
+	token, err := generateToken("userID", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.ValidateToken(context.Background(), &userpb.ValidateTokenRequest{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Valid || resp.UserId != "userID" || resp.Username != "testUser" || resp.Role != "student" || resp.ExpiresAt == 0 {
+		t.Errorf("Expected a valid token of userID but got: %v", resp)
+	}
+
+	resp, err = client.ValidateToken(context.Background(), &userpb.ValidateTokenRequest{Token: "not-a-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Valid || resp.Error == "" {
+		t.Errorf("Expected an invalid token with its error but got: %v", resp)
+	}
+}
@@ -1,82 +1,211 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 
 	"github.com/buzzapp/user/model"
 	"github.com/buzzapp/user/reqres"
 )
 
-func handleCreateUser(svc UserService) http.Handler {
+// Error codes returned alongside error messages
+const (
+	userGoneCode       = "USER_GONE"
+	accountExistsCode  = "ACCOUNT_EXISTS"
+	emailExistsCode    = "EMAIL_EXISTS"
+	usernameTakenCode  = "USERNAME_TAKEN"
+	originMismatchCode = "ORIGIN_MISMATCH"
+
+	usernameChangeCooldownCode = "USERNAME_CHANGE_COOLDOWN"
+
+	invalidStatusTransitionCode = "INVALID_STATUS_TRANSITION"
+	accountInactiveCode         = "ACCOUNT_INACTIVE"
+	noPendingCloseCode          = "NO_PENDING_CLOSE"
+
+	challengeExpiredCode = "CHALLENGE_EXPIRED"
+	invalidCodeCode      = "INVALID_CODE"
+	tooManyAttemptsCode  = "TOO_MANY_ATTEMPTS"
+
+	invalidCredentialsCode = "INVALID_CREDENTIALS"
+	stepUpRequiredCode     = "STEP_UP_REQUIRED"
+	invalidResetTokenCode  = "INVALID_RESET_TOKEN"
+	reauthRequiredCode     = "REAUTH_REQUIRED"
+
+	invalidVerificationTokenCode = "INVALID_VERIFICATION_TOKEN"
+	invalidInviteTokenCode       = "INVALID_INVITE_TOKEN"
+	inviteExpiredCode            = "INVITE_EXPIRED"
+
+	invalidOAuthStateCode = "INVALID_OAUTH_STATE"
+	identityNotLinkedCode = "IDENTITY_NOT_LINKED"
+	identityTakenCode     = "IDENTITY_TAKEN"
+	providerLinkedCode    = "PROVIDER_LINKED"
+	lastAuthMethodCode    = "LAST_AUTH_METHOD"
+
+	scopeNotGrantedCode = "SCOPE_NOT_GRANTED"
+	tooManyAPIKeysCode  = "TOO_MANY_API_KEYS"
+)
+
+// Error codes of responses without a more specific code, by status
+const (
+	validationErrorCode    = "VALIDATION_ERROR"
+	unauthorizedCode       = "UNAUTHORIZED"
+	forbiddenCode          = "FORBIDDEN"
+	notFoundCode           = "NOT_FOUND"
+	conflictCode           = "CONFLICT"
+	goneCode               = "GONE"
+	notAcceptableCode      = "NOT_ACCEPTABLE"
+	tooManyRequestsCode    = "TOO_MANY_REQUESTS"
+	badRequestCode         = "BAD_REQUEST"
+	notImplementedCode     = "NOT_IMPLEMENTED"
+	serviceUnavailableCode = "SERVICE_UNAVAILABLE"
+	internalErrorCode      = "INTERNAL_ERROR"
+)
+
+// signupConflictHints makes signup conflicts say which field clashed and
+// suggest logging in or resetting the password instead. It is off by default
+// since it reveals which emails have accounts.
+var signupConflictHints = false
+
+func handleGetMe(svc UserService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Read the body into a string for json decoding
-		var payload = &reqres.CreateUserRequest{}
+		// Get the caller's ID from their token
+		id, _ := claimsFromContext(r)["sub"].(string)
+		markPhase(r, phaseValidation)
+
+		// get the user from our database
+		user, err := svc.GetByID(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err == errUserNotFound {
+			respondWithError("unable to find user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to find user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleUpdateMe(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the caller's ID from their token
+		id, _ := claimsFromContext(r)["sub"].(string)
+
+		// Read the body into a string for json decoding. The request has no
+		// role, so callers can't change their own.
+		var payload = &reqres.UpdateMeRequest{}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			respondWithError("unable to decode json request", err, w, http.StatusInternalServerError)
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
 			return
 		}
 
 		// Do some validation
-		if err := validateCreateUser(payload); err != nil {
+		if err := validateUpdateMe(id, payload); err != nil {
 			respondWithError("Validation error", err, w, http.StatusBadRequest)
 			return
 		}
+		markPhase(r, phaseValidation)
 
-		// Create our new user struct
-		newUser := &model.CreateUser{
+		// Create our updated user struct
+		updatedUser := &model.UpdateUser{
 			Email:     payload.Email,
 			FirstName: payload.FirstName,
 			LastName:  payload.LastName,
-			Password:  payload.Password,
-			Role:      payload.Role,
 			Username:  payload.Username,
+
+			DisplayName: payload.DisplayName,
+			AvatarURL:   payload.AvatarURL,
+			Timezone:    payload.Timezone,
+			Locale:      payload.Locale,
+			Phone:       payload.Phone,
 		}
 
-		// save the app to our database
-		user, err := svc.Create(newUser)
+		// save the changes to our database
+		user, err := svc.Update(r.Context(), id, updatedUser)
+		markPhase(r, phaseDB)
+		if err == errUserNotFound {
+			respondWithError("unable to update user", err, w, http.StatusNotFound)
+			return
+		}
+		if err == errDuplicateEmail {
+			respondWithErrorCode("unable to update user", emailExistsCode, err, w, http.StatusConflict)
+			return
+		}
+		if err == errDuplicateUsername {
+			respondWithErrorCode("unable to update user", usernameTakenCode, err, w, http.StatusConflict)
+			return
+		}
+		if cooldown, ok := err.(usernameCooldownError); ok {
+			respondWithUsernameCooldown(cooldown, w)
+			return
+		}
 		if err != nil {
-			respondWithError("unable to add user", err, w, http.StatusInternalServerError)
+			respondWithError("unable to update user", err, w, http.StatusInternalServerError)
 			return
 		}
 
 		// Generate our response
-		resp := reqres.CreateUserResponse{User: user}
+		resp := reqres.UpdateUserResponse{User: user}
 
 		// Marshal up the json response
-		js, err := json.Marshal(resp)
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
 		if err != nil {
 			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
 			return
 		}
 
 		// Return the response
-		w.WriteHeader(http.StatusCreated)
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		w.Write(js)
 	})
 }
 
-func handleGetUserByID(svc UserService) http.Handler {
+func handleCloseAccount(svc UserService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the user ID from the url
-		id := mux.Vars(r)["id"]
-
-		// Do some validation
-		if err := validateGetUserByID(id); err != nil {
-			respondWithError("Validation error", err, w, http.StatusBadRequest)
+		// schedule the caller's account to be purged
+		userID, _ := claimsFromContext(r)["sub"].(string)
+		user, err := svc.CloseAccount(r.Context(), userID)
+		markPhase(r, phaseDB)
+		if err == errUserNotFound {
+			respondWithError("unable to close account", err, w, http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(statusTransitionError); ok {
+			respondWithErrorCode("unable to close account", invalidStatusTransitionCode, err, w, http.StatusConflict)
 			return
 		}
-
-		// get the user from our database
-		user, err := svc.GetByID(id)
 		if err != nil {
-			respondWithError("unable to get user", err, w, http.StatusInternalServerError)
+			respondWithError("unable to close account", err, w, http.StatusInternalServerError)
 			return
 		}
 
@@ -84,25 +213,26 @@ func handleGetUserByID(svc UserService) http.Handler {
 		resp := reqres.GetUserResponse{User: user}
 
 		// Marshal up the json response
-		js, err := json.Marshal(resp)
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
 		if err != nil {
 			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
 			return
 		}
 
 		// Return the response
-		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		w.Write(js)
 	})
 }
 
-func handleLoginUser(svc UserService) http.Handler {
+func handleCancelClose(svc UserService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Read the body into a string for json decoding
 		var payload = &reqres.LoginRequest{}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			respondWithError("unable to decode json request", err, w, http.StatusInternalServerError)
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
 			return
 		}
 
@@ -111,98 +241,4079 @@ func handleLoginUser(svc UserService) http.Handler {
 			respondWithError("Validation error", err, w, http.StatusBadRequest)
 			return
 		}
+		markPhase(r, phaseValidation)
 
-		// save the app to our database
-		token, err := svc.Login(payload.Username, payload.Password, r.Referer())
+		// Closed accounts can't log in, so this checks the password itself
+		if throttleLogin(w, r, svc, payload.Username) {
+			return
+		}
+
+		// reopen the account in our database
+		user, err := svc.CancelClose(r.Context(), payload.Username, payload.Password)
+		markPhase(r, phaseDB)
+		if err == errInvalidCredentials {
+			recordFailedLogin(r, svc, payload.Username)
+			respondWithErrorCode("unable to cancel account close", invalidCredentialsCode, err, w, http.StatusBadRequest)
+			return
+		}
+		if err == errNoPendingClose {
+			respondWithErrorCode("unable to cancel account close", noPendingCloseCode, err, w, http.StatusConflict)
+			return
+		}
 		if err != nil {
-			respondWithError("unable to log in user", err, w, http.StatusBadRequest)
+			respondWithError("unable to cancel account close", err, w, http.StatusInternalServerError)
 			return
 		}
+		recordSuccessfulLogin(payload.Username)
 
 		// Generate our response
-		resp := reqres.LoginResponse{Token: token}
+		resp := reqres.GetUserResponse{User: user}
 
 		// Marshal up the json response
-		js, err := json.Marshal(resp)
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
 		if err != nil {
 			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
 			return
 		}
 
 		// Return the response
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleAcceptTOS(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.AcceptTOSRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateAcceptTOS(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// record the acceptance for the caller
+		userID, _ := claimsFromContext(r)["sub"].(string)
+		if err := svc.AcceptTOS(r.Context(), userID, payload.Version); err != nil {
+			respondWithError("unable to accept terms of service", err, w, http.StatusInternalServerError)
+			return
+		}
+		markPhase(r, phaseDB)
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.MessageResponse{Message: "Terms of service accepted"})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		w.Write(js)
 	})
 }
 
-func handleRefreshToken(svc UserService) http.Handler {
+func handleChangePassword(svc UserService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
 		// Read the body into a string for json decoding
-		var payload = &reqres.RefreshTokenRequest{}
+		var payload = &reqres.ChangePasswordRequest{}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			respondWithError("unable to decode json request", err, w, http.StatusInternalServerError)
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
 			return
 		}
 
-		if err := validateRefreshToken(payload); err != nil {
+		// The new password may not contain the user's details
+		user, err := svc.GetByID(r.Context(), id)
+		if err == errUserNotFound {
+			respondWithError("unable to change password", err, w, http.StatusNotFound)
+			return
+		}
+		if respondWithServiceError("unable to change password", err, w) {
+			return
+		}
+		if err != nil {
+			respondWithError("unable to change password", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Do some validation
+		if err := validateChangePassword(payload, user); err != nil {
 			respondWithError("Validation error", err, w, http.StatusBadRequest)
 			return
 		}
+		markPhase(r, phaseValidation)
 
-		// Decode jwt token
-		token, err := jwt.Parse(payload.Token, func(token *jwt.Token) (interface{}, error) {
-			// Valid alg is what we expect
-			if token.Method != jwt.SigningMethodHS256 {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(SecretKey), nil
-		})
+		// Slow down guessing the current password with a stolen token
+		if throttleLogin(w, r, svc, user.Username) {
+			return
+		}
+
+		// change the password in our database
+		err = svc.ChangePassword(r.Context(), id, payload.CurrentPassword, payload.NewPassword)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, id, auditActionPasswordChange, err)
+		if err == errInvalidCredentials {
+			recordFailedLogin(r, svc, user.Username)
+			respondWithErrorCode("unable to change password", invalidCredentialsCode, err, w, http.StatusBadRequest)
+			return
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to change password", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to change password", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.MessageResponse{Message: "Password changed"})
+		markPhase(r, phaseSerialization)
 		if err != nil {
-			respondWithError("Access not allowed", err, w, http.StatusForbidden)
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleReserveUsername holds a username for a signup in progress, so it
+// can't be taken before the signup is submitted
+func handleReserveUsername(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.ReserveUsernameRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
 			return
 		}
 
-		if !token.Valid {
-			respondWithError("Access not allowed", errors.New("Invalid jwt token"), w, http.StatusForbidden)
+		// Do some validation
+		if err := validateReserveUsername(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
 			return
 		}
+		markPhase(r, phaseValidation)
 
-		jwtToken, err := svc.RefreshToken(token.Claims["sub"].(string), token.Claims["username"].(string), token.Claims["role"].(string), r.Referer())
+		// hold the username for this signup
+		token, expiresAt, err := svc.ReserveUsername(r.Context(), payload.Username)
+		markPhase(r, phaseDB)
+		if err == errDuplicateUsername {
+			respondWithErrorCode("unable to reserve username", usernameTakenCode, err, w, http.StatusConflict)
+			return
+		}
 		if err != nil {
-			respondWithError("unable to refresh token", err, w, http.StatusInternalServerError)
+			respondWithError("unable to reserve username", err, w, http.StatusInternalServerError)
 			return
 		}
 
 		// Generate our response
-		resp := reqres.LoginResponse{Token: jwtToken}
+		resp := reqres.ReserveUsernameResponse{Username: normalizeUsername(payload.Username), ReservationToken: token, ExpiresAt: expiresAt}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(js)
+	})
+}
+
+// handleValidateEmail checks an email the way signing up would, without
+// looking it up, so forms can check emails as they are typed
+func handleValidateEmail() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.ValidateEmailRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// An invalid email is the answer, not a bad request
+		resp := reqres.ValidateEmailResponse{Email: payload.Email, Normalized: emailKey(payload.Email), Valid: true}
+		if err := validateSignupEmail(payload.Email); err != nil {
+			resp.Valid, resp.Message = false, err.Error()
+		}
+		markPhase(r, phaseValidation)
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleReleaseUsername(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.ReleaseUsernameRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateReleaseUsername(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// let go of the username, if the token still holds it
+		err := svc.ReleaseUsername(r.Context(), payload.Username, payload.ReservationToken)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to release username", err, w, http.StatusInternalServerError)
+			return
+		}
 
 		// Marshal up the json response
-		js, err := json.Marshal(resp)
+		js, err := marshalJSON(reqres.MessageResponse{Message: "Username released"})
+		markPhase(r, phaseSerialization)
 		if err != nil {
 			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
 			return
 		}
 
 		// Return the response
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleRequestPasswordReset sends a password reset token to the user with
+// the email. It responds the same whether or not there is such a user, so it
+// can't be used to find out who has an account.
+func handleRequestPasswordReset(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.RequestPasswordResetRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateRequestPasswordReset(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// send the user a password reset token
+		err := svc.CreatePasswordReset(r.Context(), payload.Email)
+		markPhase(r, phaseDB)
+		if err == errNoPasswordResetSender {
+			respondWithError("unable to reset password", err, w, http.StatusNotImplemented)
+			return
+		}
+		if err != nil && err != errUserNotFound {
+			// Failing only for existing users would give them away
+			log.Println("unable to reset password:", err)
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.MessageResponse{Message: "If an account with this email exists, a password reset has been sent to it"})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		w.Write(js)
 	})
 }
 
-// Helper function to return a json error message
-func respondWithError(msg string, err error, w http.ResponseWriter, status int) {
-	errMsg := reqres.ErrorResponse{Message: msg + ": " + err.Error()}
+func handleConfirmPasswordReset(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.ConfirmPasswordResetRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
 
-	js, err := json.Marshal(errMsg)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(status)
-		return
-	}
+		// Do some validation
+		if err := validateConfirmPasswordReset(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
 
-	w.Header().Set("Content-Type", "application/json")
+		// reset the password in our database
+		user, err := svc.ResetPassword(r.Context(), payload.Token, payload.NewPassword)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, userIDOf(user), auditActionPasswordChange, err)
+		if err == errInvalidResetToken {
+			respondWithErrorCode("unable to reset password", invalidResetTokenCode, err, w, http.StatusBadRequest)
+			return
+		}
+		if isValidationError(err) {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to reset password", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Let the user know, in case it wasn't them
+		go notifyPasswordChanged(user, clientIP(r), time.Now())
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.MessageResponse{Message: "Password reset"})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleVerifyEmail(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			respondWithError("Validation error", fieldError("token", "Please provide the email verification token"), w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// activate the account in our database
+		_, err := svc.VerifyEmail(r.Context(), token)
+		markPhase(r, phaseDB)
+		if err == errInvalidVerificationToken {
+			respondWithErrorCode("unable to verify email", invalidVerificationTokenCode, err, w, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to verify email", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.MessageResponse{Message: "Email verified"})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleResendVerification(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.ResendVerificationRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateResendVerification(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// send the user a new verification token
+		err := svc.ResendVerification(r.Context(), payload.Email)
+		markPhase(r, phaseDB)
+		if err == errNoVerificationSender {
+			respondWithError("unable to resend verification", err, w, http.StatusNotImplemented)
+			return
+		}
+		if err != nil && err != errUserNotFound {
+			// Failing only for pending accounts would give them away
+			log.Println("unable to resend verification:", err)
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.MessageResponse{Message: "If an unverified account with this email exists, a verification has been sent to it"})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleResendVerifications(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if verificationSender == nil {
+			respondWithError("unable to resend verifications", errNoVerificationSender, w, http.StatusNotImplemented)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// find the users with an email left to verify
+		users, err := pendingVerificationUsers(r.Context())
+		markPhase(r, phaseDB)
+		if respondWithServiceError("unable to resend verifications", err, w) {
+			return
+		}
+		if err != nil {
+			respondWithError("unable to resend verifications", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// and send them their verifications in the background
+		if err := verificationResends.start(svc, users); err != nil {
+			respondWithError("unable to resend verifications", err, w, http.StatusConflict)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.ResendVerificationsResponse{Queued: len(users)})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(js)
+	})
+}
+
+func handleTestWebhook() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The URL is optional, testing without one sends to the webhook
+		var payload = &reqres.TestWebhookRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && err != io.EOF {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateTestWebhook(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		publisher := webhook
+		if publisher == nil {
+			if payload.URL == "" || WebhookSecret == "" {
+				respondWithError("unable to test webhook", errNoWebhook, w, http.StatusNotImplemented)
+				return
+			}
+			publisher = newWebhookPublisher(payload.URL, WebhookSecret, 1, webhookBackoff)
+		}
+		if payload.URL == "" {
+			payload.URL = publisher.url
+		}
+		markPhase(r, phaseValidation)
+
+		// send the sample event, once
+		status, latency, err := publisher.test(payload.URL)
+		resp := reqres.TestWebhookResponse{URL: payload.URL, Status: status, LatencyMS: int64(latency / time.Millisecond)}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleListDeadLetters() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if webhookDeadLetters == nil {
+			respondWithError("unable to list dead letters", errNoWebhook, w, http.StatusNotImplemented)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		letters, err := webhookDeadLetters.List()
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to list dead letters", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.ListDeadLettersResponse{DeadLetters: letters})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleReplayDeadLetter() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if webhook == nil || webhookDeadLetters == nil {
+			respondWithError("unable to replay dead letter", errNoWebhook, w, http.StatusNotImplemented)
+			return
+		}
+
+		// Get the dead letter ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		letter, err := webhookDeadLetters.Get(id)
+		if err == errDeadLetterNotFound {
+			respondWithError("unable to replay dead letter", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to replay dead letter", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// post it again, once, keeping it when it's refused
+		status, latency, err := webhook.replay(letter)
+		if err != nil {
+			respondWithError("unable to replay dead letter", err, w, http.StatusBadGateway)
+			return
+		}
+		err = webhookDeadLetters.Remove(id)
+		markPhase(r, phaseDB)
+		if err != nil && err != errDeadLetterNotFound {
+			respondWithError("unable to drop replayed dead letter", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.ReplayDeadLetterResponse{ID: id, Status: status, LatencyMS: int64(latency / time.Millisecond)})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleCreateUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding, in the schema version asked for
+		payload, err := decodeCreateUserRequest(r)
+		if err == errUnknownSchemaVersion {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		v := &validation{mode: validationModeOf(r)}
+		if err := validateCreateUser(payload, v); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// Create our new user struct
+		newUser := &model.CreateUser{
+			Email:              payload.Email,
+			FirstName:          payload.FirstName,
+			LastName:           payload.LastName,
+			Password:           payload.Password,
+			Role:               payload.Role,
+			Username:           payload.Username,
+			DateOfBirth:        payload.DateOfBirth,
+			AcceptedTOSVersion: payload.AcceptedTOSVersion,
+			ReservationToken:   payload.ReservationToken,
+		}
+
+		// Only admins can create accounts with another role than the default
+		ctx := withCreator(r.Context(), creatorSignup)
+		if isAdminRequest(r) {
+			ctx = withCreator(r.Context(), creatorAdmin)
+		}
+
+		// save the app to our database
+		user, err := svc.Create(ctx, newUser)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, userIDOf(user), auditActionCreate, err)
+		if err == errDuplicateEmail || err == errDuplicateUsername {
+			respondWithSignupConflict(err, w)
+			return
+		}
+		if isValidationError(err) {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		if respondWithServiceError("unable to add user", err, w) {
+			return
+		}
+		if err != nil {
+			respondWithError("unable to add user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.CreateUserResponse{User: user, Warnings: v.warnings}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusCreated)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	})
+}
+
+func handleGetUserByID(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Do some validation
+		if err := validateGetUserByID(id); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the user from our database. Admins see soft-deleted users too.
+		var user *model.User
+		var err error
+		if hasRole(claimsFromContext(r), "admin") {
+			user, err = svc.GetByIDIncludingDeleted(r.Context(), id)
+		} else {
+			user, err = svc.GetByID(r.Context(), id)
+		}
+		markPhase(r, phaseDB)
+		if respondWithServiceError("unable to get user", err, w) {
+			return
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to get user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to get user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	})
+}
+
+// respondWithUsernameCooldown refuses a username change, telling when the next
+// one is allowed
+func respondWithUsernameCooldown(cooldown usernameCooldownError, w http.ResponseWriter) {
+	retryAfter := time.Until(cooldown.next)
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	respondWithErrorCode("unable to update user", usernameChangeCooldownCode, cooldown, w, http.StatusTooManyRequests)
+}
+
+func handleUpdateUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Read the body into a string for json decoding
+		var payload = &reqres.UpdateUserRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateUpdateUser(id, payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Users can only update themselves, and only admins can change roles
+		claims := claimsFromContext(r)
+		isAdmin := hasRole(claims, "admin")
+		if claims["sub"] != id && !isAdmin {
+			respondWithError("Access not allowed", errors.New("you can only update your own account"), w, http.StatusForbidden)
+			return
+		}
+		if payload.Role != nil && !isAdmin {
+			respondWithError("Access not allowed", errors.New("admin role required to change roles"), w, http.StatusForbidden)
+			return
+		}
+
+		// Users change their password with their current one, not just a token
+		if payload.Password != nil && !isAdmin {
+			respondWithError("Access not allowed", errors.New("change your password with POST "+ChangePasswordPath+", which needs your current one"), w, http.StatusForbidden)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// Create our updated user struct
+		updatedUser := &model.UpdateUser{
+			Email:     payload.Email,
+			FirstName: payload.FirstName,
+			LastName:  payload.LastName,
+			Password:  payload.Password,
+			Role:      payload.Role,
+			Username:  payload.Username,
+
+			DisplayName: payload.DisplayName,
+			AvatarURL:   payload.AvatarURL,
+			Timezone:    payload.Timezone,
+			Locale:      payload.Locale,
+			Phone:       payload.Phone,
+		}
+
+		// save the changes to our database
+		user, err := svc.Update(r.Context(), id, updatedUser)
+		markPhase(r, phaseDB)
+		if payload.Role != nil {
+			recordAuditEvent(r, id, auditActionRoleChange, err)
+		}
+		if payload.Password != nil {
+			recordAuditEvent(r, id, auditActionPasswordChange, err)
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to update user", err, w, http.StatusNotFound)
+			return
+		}
+		if err == errDuplicateEmail {
+			respondWithErrorCode("unable to update user", emailExistsCode, err, w, http.StatusConflict)
+			return
+		}
+		if err == errDuplicateUsername {
+			respondWithErrorCode("unable to update user", usernameTakenCode, err, w, http.StatusConflict)
+			return
+		}
+		if cooldown, ok := err.(usernameCooldownError); ok {
+			respondWithUsernameCooldown(cooldown, w)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to update user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.UpdateUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleDeleteUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		dryRun, err := parseDryRun(r.URL.Query().Get("dry_run"))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// A dry run only says who would be deleted
+		if dryRun {
+			respondWithDryRun(w, r, "delete", "unable to delete user", svc.GetByID, id)
+			return
+		}
+
+		// soft delete the user in our database
+		err = svc.Delete(r.Context(), id)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, id, auditActionDelete, err)
+		if err == errUserNotFound {
+			respondWithError("unable to delete user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to delete user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleReactivateUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		// bring the soft-deleted user back in our database
+		user, err := svc.Reactivate(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err == errUserNotFound {
+			respondWithError("unable to reactivate user", err, w, http.StatusNotFound)
+			return
+		}
+		if err == errNotDeleted || err == errUserErased {
+			respondWithErrorCode("unable to reactivate user", invalidStatusTransitionCode, err, w, http.StatusConflict)
+			return
+		}
+		if err == errDuplicateEmail {
+			respondWithErrorCode("unable to reactivate user", emailExistsCode, err, w, http.StatusConflict)
+			return
+		}
+		if err == errDuplicateUsername {
+			respondWithErrorCode("unable to reactivate user", usernameTakenCode, err, w, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to reactivate user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleUnlockLogin(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		// get the user from our database, for the names they log in with
+		user, err := svc.GetByID(r.Context(), id)
+		markPhase(r, phaseDB)
+		if respondWithServiceError("unable to unlock logins", err, w) {
+			return
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to unlock logins", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to unlock logins", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// lift the lockout of both, since logins can go by either
+		if loginThrottle != nil {
+			if err := loginThrottle.Unlock(user.Username, user.Email); err != nil {
+				respondWithError("unable to unlock logins", err, w, http.StatusInternalServerError)
+				return
+			}
+		}
+		recordAuditEvent(r, user.ID, auditActionUnlock, nil)
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleImpersonateUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		adminID, _ := claimsFromContext(r)["sub"].(string)
+		if id == adminID {
+			respondWithError("Validation error", errImpersonateSelf, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the user to act as
+		user, err := svc.GetByID(r.Context(), id)
+		markPhase(r, phaseDB)
+		if respondWithServiceError("unable to impersonate user", err, w) {
+			return
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to impersonate user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to impersonate user", err, w, http.StatusInternalServerError)
+			return
+		}
+		if strings.EqualFold(user.Role, "admin") {
+			recordAuditDetail(r, id, auditActionImpersonate, "impersonated by "+adminID, errImpersonateAdmin)
+			respondWithError("Access not allowed", errImpersonateAdmin, w, http.StatusForbidden)
+			return
+		}
+
+		// and hand the admin a token of theirs naming the admin
+		expiresAt := time.Now().Add(impersonationTTL).UTC()
+		token, err := generateImpersonationToken(user, adminID, r.Referer(), expiresAt)
+		recordAuditDetail(r, id, auditActionImpersonate, "impersonated by "+adminID, err)
+		if err != nil {
+			respondWithError("unable to impersonate user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.ImpersonateResponse{Token: model.JWTToken(token), ExpiresAt: expiresAt})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleInvalidateResetTokens(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		// drop the outstanding reset and verification tokens of the user
+		invalidated, err := svc.InvalidateResetTokens(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err != errUserNotFound {
+			recordAuditEvent(r, id, auditActionResetsRevoke, err)
+		}
+		if respondWithServiceError("unable to invalidate tokens", err, w) {
+			return
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to invalidate tokens", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to invalidate tokens", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.InvalidateResetTokensResponse{Invalidated: invalidated}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleListUsers(svc UserService) http.Handler {
+	lookup := handleLookupUser(svc)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Looking a single user up shares the route
+		if isUserLookup(r.URL.Query()) {
+			lookup.ServeHTTP(w, r)
+			return
+		}
+
+		// Do some validation
+		opts, err := parseListUsersQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the page of users from our database
+		users, total, err := svc.List(r.Context(), opts)
+		markPhase(r, phaseDB)
+		warnings := listWarnings(err)
+		if err != nil && warnings == nil {
+			respondWithError("unable to list users", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.ListUsersResponse{Users: users, Offset: opts.Offset, Limit: opts.Limit, Warnings: warnings}
+		resp.Total, total = listTotal(users, total, opts, err)
+		resp.Next, resp.Prev = pageLinks(r.URL, opts, total)
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// listWarnings returns the warnings of a list that List could only get part
+// of, nil when err is anything else
+func listWarnings(err error) []string {
+	partial, ok := err.(partialListError)
+	if !ok {
+		return nil
+	}
+	log.Printf("listing users in part: %v", partial)
+	return []string{partial.warning}
+}
+
+// listTotal returns the total to report for a page of users and the one to
+// page by. Without a count, it reports the users up to the end of the page,
+// and pages on while pages are full.
+func listTotal(users []model.User, total int, opts model.ListOptions, err error) (int, int) {
+	partial, ok := err.(partialListError)
+	if !ok || partial.warning != warnTotalUnavailable {
+		return total, total
+	}
+	seen := opts.Offset + len(users)
+	if opts.Limit > 0 && len(users) == opts.Limit {
+		return seen, seen + 1
+	}
+	return seen, seen
+}
+
+// pageLinks returns links to the pages after and before the page of opts,
+// empty when there is none. Links page the way the request did, by page and
+// per_page or by offset and limit, and keep its other parameters.
+func pageLinks(u *url.URL, opts model.ListOptions, total int) (string, string) {
+	query := u.Query()
+	byPage := query.Get("page") != "" || query.Get("per_page") != ""
+
+	link := func(offset int) string {
+		if byPage {
+			query.Set("page", strconv.Itoa(offset/opts.Limit+1))
+			query.Set("per_page", strconv.Itoa(opts.Limit))
+		} else {
+			query.Set("offset", strconv.Itoa(offset))
+			query.Set("limit", strconv.Itoa(opts.Limit))
+		}
+		return u.Path + "?" + query.Encode()
+	}
+
+	next, prev := "", ""
+	if opts.Offset+opts.Limit < total {
+		next = link(opts.Offset + opts.Limit)
+	}
+	if opts.Offset > 0 {
+		offset := opts.Offset - opts.Limit
+		if offset < 0 {
+			offset = 0
+		}
+		prev = link(offset)
+	}
+	return next, prev
+}
+
+// handleListUsersByScope lists the users who have a scope through their
+// role, for permission audits
+func handleListUsersByScope(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		opts, err := parsePagingQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		opts.Roles = rolesWithScope(mux.Vars(r)["scope"])
+		if len(opts.Roles) == 0 {
+			respondWithError("unable to list users", errUnknownScope, w, http.StatusNotFound)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the page of users from our database
+		users, total, err := svc.List(r.Context(), opts)
+		markPhase(r, phaseDB)
+		warnings := listWarnings(err)
+		if err != nil && warnings == nil {
+			respondWithError("unable to list users", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.ListUsersResponse{Users: users, Offset: opts.Offset, Limit: opts.Limit, Warnings: warnings}
+		resp.Total, _ = listTotal(users, total, opts, err)
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleSearchUsers finds users whatever their status, soft-deleted ones
+// included, for support to track accounts down
+func handleSearchUsers(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		opts, err := parseSearchUsersQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// search our database
+		users, total, err := svc.Search(r.Context(), opts)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to search users", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.ListUsersResponse{Users: users, Total: total, Offset: opts.Offset, Limit: opts.Limit}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleLookupUser gets the user with the username or email of the query
+func handleLookupUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		field, value, err := parseUserLookupQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the user from our database
+		var user *model.User
+		if field == "email" {
+			user, err = svc.GetByEmail(r.Context(), value)
+		} else {
+			user, err = svc.GetByUsername(r.Context(), value)
+		}
+		markPhase(r, phaseDB)
+		if err == errUserNotFound {
+			respondWithError("unable to get user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to get user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetDuplicates(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		query := r.URL.Query()
+		criteria, offset, limit, err := parseDuplicatesQuery(query.Get("criteria"), query.Get("offset"), query.Get("limit"))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the potential duplicates from our database
+		groups, total, err := svc.GetDuplicates(r.Context(), criteria, offset, limit)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to get duplicate users", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetDuplicatesResponse{Groups: groups, Total: total, Offset: offset, Limit: limit}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleGetStats gets the user and login statistics of the ops dashboard
+func handleGetStats(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// get the statistics from our database
+		stats, err := svc.GetStats(r.Context())
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to get user statistics", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetStatsResponse{Stats: stats}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleDeactivateInactive deactivates users who haven't logged in since a
+// cutoff, or counts them on a dry run
+func handleDeactivateInactive(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		query := r.URL.Query()
+		cutoff, dryRun, err := parseDeactivateInactiveQuery(query.Get("inactive_since"), query.Get("dry_run"))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// deactivate the inactive users in our database
+		ids, err := svc.DeactivateInactive(r.Context(), cutoff, dryRun)
+		markPhase(r, phaseDB)
+		if !dryRun {
+			// A batch failing doesn't undo the ones before it
+			for _, id := range ids {
+				recordAuditDetail(r, id, auditActionDeactivate, "inactive since "+cutoff.Format(time.RFC3339), nil)
+			}
+		}
+		if err != nil {
+			respondWithError("unable to deactivate inactive users", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.DeactivateInactiveResponse{Count: len(ids), DryRun: dryRun}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGCTokens(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		markPhase(r, phaseValidation)
+
+		// garbage collect the expired tokens right away
+		resp, err := collectTokenGarbage(r.Context(), svc, time.Now())
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to garbage collect tokens", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetChanges(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		query := r.URL.Query()
+		since, limit, err := parseChangesQuery(query.Get("since"), query.Get("limit"))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the changes from our database
+		changes, next, err := svc.GetChanges(r.Context(), since, query.Get("cursor"), limit)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to get changes", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetChangesResponse{Changes: changes, NextCursor: next}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetLoginAttempts(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Do some validation
+		if err := validateGetUserByID(id); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the attempts from our database
+		attempts, err := svc.GetLoginAttempts(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to get login attempts", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetLoginAttemptsResponse{LoginAttempts: attempts}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleImportUsers creates the users of a CSV or JSON array, with the outcome
+// of each row. With ?async=true the import runs in the background and its
+// report is polled by job id.
+func handleImportUsers(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the rows of the import, each validated on its own
+		rows, err := parseImport(r)
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		async := r.URL.Query().Get("async") == "true"
+		markPhase(r, phaseValidation)
+
+		// create the users in our database
+		status := http.StatusOK
+		var resp reqres.ImportResponse
+		if async {
+			id := importJobs.start(svc, rows)
+			resp = reqres.ImportResponse{JobID: id, Status: importRunning, Results: []reqres.ImportResult{}}
+			w.Header().Set("Location", strings.Replace(ImportJobPath, "{jobID}", id, 1))
+			status = http.StatusAccepted
+		} else {
+			resp = runImport(r.Context(), svc, rows, nil)
+		}
+		markPhase(r, phaseDB)
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(js)
+	})
+}
+
+func handleGetImportJob() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the job ID from the url
+		id := mux.Vars(r)["jobID"]
+		markPhase(r, phaseValidation)
+
+		// get the report of the job so far
+		resp, err := importJobs.get(id)
+		markPhase(r, phaseDB)
+		if err == errImportJobNotFound {
+			respondWithError("unable to get import job", err, w, http.StatusNotFound)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleBulkUpdateUsers updates the role and status of the users of a CSV,
+// with the outcome of each row
+func handleBulkUpdateUsers(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the rows of the CSV, each validated on its own
+		dryRun, err := parseDryRun(r.URL.Query().Get("dry_run"))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		rows, keyColumn, err := parseBulkUpdateCSV(r.Body)
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// update the users in our database
+		resp := applyBulkUpdate(r.Context(), svc, keyColumn, rows, dryRun)
+		markPhase(r, phaseDB)
+
+		// Every row has its result, in order
+		for i, row := range rows {
+			if dryRun || row.update.Role == nil {
+				continue
+			}
+			var err error
+			if result := resp.Results[i]; result.Result == bulkRowFailed {
+				err = errors.New(result.Error)
+			}
+			recordAuditEvent(r, resp.Results[i].UserID, auditActionRoleChange, err)
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleBulkVerifyUsers(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.BulkVerifyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateBulkVerify(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// verify the users in our database, each on its own
+		resp := applyBulkVerify(r.Context(), svc, payload.Users)
+		markPhase(r, phaseDB)
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetSecurityEvents(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		opts, err := parsePagingQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the caller's own events from our database, never anyone else's
+		userID, _ := claimsFromContext(r)["sub"].(string)
+		events, total, err := svc.GetSecurityEvents(r.Context(), userID, opts)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to get security events", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.SecurityEventsResponse{Events: events, Total: total, Offset: opts.Offset, Limit: opts.Limit}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetSecurityReport(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Do some validation
+		if err := validateGetUserByID(id); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+
+		from, to, err := parseTimeRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// put the report together from our database
+		report, err := svc.GetSecurityReport(r.Context(), id, from, to)
+		markPhase(r, phaseDB)
+		if err == errUserNotFound {
+			respondWithError("unable to get security report", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to get security report", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetSecurityReportResponse{Report: report}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleCreateChallenge(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Do some validation
+		if err := validateGetUserByID(id); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// send the user a one-time code
+		expiresAt, err := svc.CreateChallenge(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err == errUserNotFound {
+			respondWithError("unable to send challenge", err, w, http.StatusNotFound)
+			return
+		}
+		if err == errNoChallengeSender {
+			respondWithError("unable to send challenge", err, w, http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to send challenge", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.CreateChallengeResponse{ExpiresAt: expiresAt}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(js)
+	})
+}
+
+func handleVerifyChallenge(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Read the body into a string for json decoding
+		var payload = &reqres.VerifyChallengeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateVerifyChallenge(id, payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// confirm the code in our database
+		proofToken, expiresAt, err := svc.VerifyChallenge(r.Context(), id, payload.Code)
+		markPhase(r, phaseDB)
+		if err == errInvalidCode {
+			respondWithErrorCode("unable to verify challenge", invalidCodeCode, err, w, http.StatusBadRequest)
+			return
+		}
+		if err == errChallengeExpired {
+			respondWithErrorCode("unable to verify challenge", challengeExpiredCode, err, w, http.StatusGone)
+			return
+		}
+		if err == errTooManyAttempts {
+			respondWithErrorCode("unable to verify challenge", tooManyAttemptsCode, err, w, http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to verify challenge", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.VerifyChallengeResponse{ProofToken: proofToken, ExpiresAt: expiresAt}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleSetStatus(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Read the body into a string for json decoding
+		var payload = &reqres.SetStatusRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateSetStatus(id, payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// change the status in our database
+		user, err := svc.SetStatus(r.Context(), id, payload.Status)
+		markPhase(r, phaseDB)
+		if err == errUserNotFound {
+			respondWithError("unable to change status", err, w, http.StatusNotFound)
+			return
+		}
+		if _, ok := err.(statusTransitionError); ok {
+			respondWithErrorCode("unable to change status", invalidStatusTransitionCode, err, w, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to change status", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleReissueID(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Do some validation
+		if err := validateGetUserByID(id); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// move the user to a new id in our database
+		user, err := svc.ReissueID(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err != nil {
+			recordAuditEvent(r, id, auditActionReissue, err)
+		} else {
+			// Events before the reissue stay under the old id
+			recordAuditDetail(r, user.ID, auditActionReissue, "reissued from "+id, nil)
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to reissue id", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to reissue id", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleResolveUsers(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.ResolveUsersRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateResolveUsers(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// look the usernames up in our database
+		users, err := svc.ResolveUsernames(r.Context(), payload.Usernames)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to resolve usernames", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.ResolveUsersResponse{Users: users}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// throttleLogin responds with a 429 and reports true when logins for username
+// from the client have failed too often lately
+func throttleLogin(w http.ResponseWriter, r *http.Request, svc UserService, username string) bool {
+	if loginThrottle == nil || loginThrottle.IsExempt(username, userRole(r.Context(), svc)) {
+		return false
+	}
+
+	throttled, retryAfter, err := loginThrottle.Throttled(clientIP(r), username)
+	if err != nil {
+		// Don't turn a rate limit store outage into a login outage
+		log.Println("unable to check login throttle:", err)
+	}
+	if throttled {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+		respondWithError("Too many requests", errors.New("too many failed logins, try again later"), w, http.StatusTooManyRequests)
+	}
+	return throttled
+}
+
+// recordFailedLogin counts a failed login for username from the client
+// against the login throttle
+func recordFailedLogin(r *http.Request, svc UserService, username string) {
+	if loginThrottle == nil {
+		return
+	}
+	if loginThrottle.IsExempt(username, userRole(r.Context(), svc)) {
+		log.Printf("failed login for throttle exempt user %q from %s", username, clientIP(r))
+		return
+	}
+	lockout, err := loginThrottle.Failed(clientIP(r), username)
+	if err != nil {
+		log.Println("unable to record failed login:", err)
+		return
+	}
+	if lockout > 0 {
+		go notifyLockout(svc, username, time.Now().Add(lockout))
+	}
+}
+
+// recordSuccessfulLogin starts counting failed logins for username over
+func recordSuccessfulLogin(username string) {
+	if loginThrottle == nil {
+		return
+	}
+	if err := loginThrottle.Succeeded(username); err != nil {
+		log.Println("unable to reset failed logins:", err)
+	}
+}
+
+// errStepUpRequired is returned for logins needing the one-time code sent to
+// the user
+var errStepUpRequired = errors.New("logging in from somewhere else this soon needs the one-time code sent to you")
+
+// checkConcurrentLogin handles a login of userID from another IP than its last
+// login within the window, reporting whether it responded. Only logins that go
+// through are remembered. The tokens of a login waiting for its code are never
+// handed out, so they can't be used.
+func checkConcurrentLogin(w http.ResponseWriter, r *http.Request, svc UserService, userID, code string) bool {
+	if concurrentLoginMode == concurrentLoginIgnore {
+		return false
+	}
+
+	ip := clientIP(r)
+	lastIP, concurrent := recentLogins.Concurrent(userID, ip)
+	if concurrent {
+		recordAuditDetail(r, userID, auditActionConcurrent, fmt.Sprintf("from %s and %s within %s", lastIP, ip, concurrentLoginWindow), nil)
+	}
+
+	if concurrent && concurrentLoginMode == concurrentLoginChallenge {
+		if code == "" {
+			if _, err := svc.CreateChallenge(r.Context(), userID); err != nil {
+				respondWithError("unable to send one-time code", err, w, http.StatusInternalServerError)
+				return true
+			}
+			respondWithErrorCode("unable to log in user", stepUpRequiredCode, errStepUpRequired, w, http.StatusUnauthorized)
+			return true
+		}
+
+		_, _, err := svc.VerifyChallenge(r.Context(), userID, code)
+		switch err {
+		case nil:
+		case errInvalidCode:
+			respondWithErrorCode("unable to log in user", invalidCodeCode, err, w, http.StatusBadRequest)
+			return true
+		case errChallengeExpired:
+			respondWithErrorCode("unable to log in user", challengeExpiredCode, err, w, http.StatusGone)
+			return true
+		case errTooManyAttempts:
+			respondWithErrorCode("unable to log in user", tooManyAttemptsCode, err, w, http.StatusTooManyRequests)
+			return true
+		default:
+			respondWithError("unable to log in user", err, w, http.StatusInternalServerError)
+			return true
+		}
+	}
+
+	recentLogins.Record(userID, ip)
+	return false
+}
+
+// userRole returns a function looking up the role of a username, which is
+// empty for unknown usernames
+func userRole(ctx context.Context, svc UserService) func(username string) string {
+	return func(username string) string {
+		user, err := svc.GetByUsername(ctx, username)
+		if err != nil {
+			return ""
+		}
+		return user.Role
+	}
+}
+
+func handleLoginUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.LoginRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateLoginUser(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// Slow down bursts of failed logins before checking the password
+		if throttleLogin(w, r, svc, payload.Username) {
+			return
+		}
+
+		// save the app to our database
+		ctx := withRememberMe(withClient(r), payload.RememberMe)
+		result, err := svc.Login(ctx, payload.Username, payload.Password, r.Referer())
+		markPhase(r, phaseDB)
+		if err == errInvalidCredentials {
+			recordFailedLogin(r, svc, payload.Username)
+			recordAuditEvent(r, userIDOf(lookupUsername(r.Context(), svc, payload.Username)), auditActionLogin, err)
+			respondWithErrorCode("unable to log in user", invalidCredentialsCode, err, w, http.StatusBadRequest)
+			return
+		}
+		if respondWithServiceError("unable to log in user", err, w) {
+			return
+		}
+		switch err {
+		case nil:
+		case errDirectoryUnavailable:
+			respondWithError("unable to log in user", err, w, http.StatusServiceUnavailable)
+			return
+		case errIdentityNotLinked:
+			respondWithErrorCode("unable to log in user", identityNotLinkedCode, err, w, http.StatusConflict)
+			return
+		case errDirectoryEmailTaken:
+			respondWithErrorCode("unable to log in user", emailExistsCode, err, w, http.StatusConflict)
+			return
+		case errNoDirectoryEmail:
+			respondWithError("unable to log in user", err, w, http.StatusForbidden)
+			return
+		default:
+			respondWithError("unable to log in user", err, w, http.StatusInternalServerError)
+			return
+		}
+		if checkConcurrentLogin(w, r, svc, result.UserID, payload.Code) {
+			return
+		}
+		recordSuccessfulLogin(payload.Username)
+		recordAuditEvent(r, result.UserID, auditActionLogin, nil)
+
+		// Generate our response
+		resp := reqres.LoginResponse{Token: result.Token, RefreshToken: result.RefreshToken, TOSAcceptanceRequired: result.TOSAcceptanceRequired, EvictedSessions: result.EvictedSessions}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	})
+}
+
+func handleLogout(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The refresh token is optional, logging out without one only ends
+		// the access token
+		var payload = &reqres.LogoutRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && err != io.EOF {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateLogout(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		claims := claimsFromContext(r)
+		tokenID, _ := claims["jti"].(string)
+		exp, ok := claims["exp"].(float64)
+		if tokenID == "" || !ok {
+			respondWithError("Validation error", errors.New("token has no jti or exp claim to revoke it by"), w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// revoke the caller's token until it expires
+		if err := svc.Revoke(r.Context(), tokenID, time.Unix(int64(exp), 0)); err != nil {
+			respondWithError("unable to log out", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// and the refresh tokens of the same login, so it can't be refreshed
+		if payload.RefreshToken != "" {
+			sub, _ := claims["sub"].(string)
+			if err := svc.EndSession(r.Context(), sub, payload.RefreshToken); err != nil {
+				respondWithError("unable to log out", err, w, http.StatusInternalServerError)
+				return
+			}
+		}
+		markPhase(r, phaseDB)
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// handleTokenRevoked tells services caching tokens whether the token with a
+// jti was revoked, e.g. by logging out
+func handleTokenRevoked() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.TokenRevokedRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateTokenRevoked(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// look the token up in the revocation store
+		revoked, err := revokedTokens.IsRevoked(payload.JTI)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to check token", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.TokenRevokedResponse{Revoked: revoked}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleRevokeSessions(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		// revoke every refresh token of the user in our database
+		err := svc.RevokeSessions(r.Context(), id)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, id, auditActionSessionsRevoke, err)
+		if err != nil {
+			respondWithError("unable to revoke sessions", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleListSessions(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Do some validation
+		if err := validateGetUserByID(id); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the sessions from our database
+		sessions, err := svc.ListSessions(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to get sessions", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Point out the session the caller is using
+		current := sessionOf(claimsFromContext(r))
+		for i := range sessions {
+			sessions[i].Current = current != "" && sessions[i].ID == current
+		}
+
+		// Generate our response
+		resp := reqres.ListSessionsResponse{Sessions: sessions}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleRevokeSession(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user and session IDs from the url
+		vars := mux.Vars(r)
+		markPhase(r, phaseValidation)
+
+		// log the user out of the session in our database
+		err := svc.RevokeSession(r.Context(), vars["id"], vars["sessionID"])
+		markPhase(r, phaseDB)
+		if err == errSessionNotFound {
+			respondWithError("unable to revoke session", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to revoke session", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleInviteUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.InviteUserRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateInviteUser(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// Create our invitee struct
+		invitee := &model.CreateUser{
+			Email:     payload.Email,
+			FirstName: payload.FirstName,
+			LastName:  payload.LastName,
+			Role:      payload.Role,
+			Username:  payload.Username,
+		}
+
+		// create the invited user in our database and send the invite
+		invitedBy, _ := claimsFromContext(r)["sub"].(string)
+		invitation, err := svc.InviteUser(withCreator(r.Context(), creatorAdmin), invitee, invitedBy)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, invitationUserID(invitation), auditActionCreate, err)
+		if err == errNoInvitationSender {
+			respondWithError("unable to invite user", err, w, http.StatusNotImplemented)
+			return
+		}
+		if err == errDuplicateEmail || err == errDuplicateUsername {
+			respondWithSignupConflict(err, w)
+			return
+		}
+		if isValidationError(err) {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to invite user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.InviteUserResponse{Invitation: invitation}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(js)
+	})
+}
+
+func handleAcceptInvitation(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.AcceptInvitationRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateAcceptInvitation(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// set the password and activate the user in our database
+		user, err := svc.AcceptInvitation(r.Context(), payload.Token, payload.Password)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, userIDOf(user), auditActionPasswordChange, err)
+		if err == errInvalidInviteToken {
+			respondWithErrorCode("unable to accept invite", invalidInviteTokenCode, err, w, http.StatusBadRequest)
+			return
+		}
+		if isValidationError(err) {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to accept invite", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleCheckInvitation tells whether an invite token can be accepted, and
+// who it's for, without using it up
+func handleCheckInvitation(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the invite token from the url
+		token := mux.Vars(r)["token"]
+		markPhase(r, phaseValidation)
+
+		// look the invitation up in our database
+		invitation, user, err := svc.CheckInvitation(r.Context(), token)
+		markPhase(r, phaseDB)
+		switch err {
+		case nil:
+		case errInvalidInviteToken:
+			respondWithErrorCode("unable to check invite", invalidInviteTokenCode, err, w, http.StatusNotFound)
+			return
+		case errInvitationExpired:
+			respondWithErrorCode("unable to check invite", inviteExpiredCode, err, w, http.StatusGone)
+			return
+		default:
+			respondWithError("unable to check invite", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.CheckInvitationResponse{Email: user.Email, Role: user.Role, ExpiresAt: invitation.ExpiresAt}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleListInvitations(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		opts, err := parsePagingQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the pending invitations from our database
+		invitations, total, err := svc.ListInvitations(r.Context(), opts)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to list invitations", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.ListInvitationsResponse{Invitations: invitations, Total: total, Offset: opts.Offset, Limit: opts.Limit}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleRevokeInvitation(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the invitation ID from the url
+		id := mux.Vars(r)["inviteID"]
+		markPhase(r, phaseValidation)
+
+		// withdraw the invitation in our database
+		err := svc.RevokeInvitation(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err == errInvitationNotFound {
+			respondWithError("unable to revoke invitation", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to revoke invitation", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleCreateGroup(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.CreateGroupRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateCreateGroup(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// create the group in our database
+		group, err := svc.CreateGroup(r.Context(), payload.Name, payload.Description)
+		markPhase(r, phaseDB)
+		if err == errDuplicateGroup {
+			respondWithError("unable to create group", err, w, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to create group", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GroupResponse{Group: group}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(js)
+	})
+}
+
+func handleListGroups(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		opts, err := parsePagingQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the groups from our database
+		groups, total, err := svc.ListGroups(r.Context(), opts)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to list groups", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.ListGroupsResponse{Groups: groups, Total: total, Offset: opts.Offset, Limit: opts.Limit}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetGroup(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the group ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		// get the group from our database
+		group, err := svc.GetGroup(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err == errGroupNotFound {
+			respondWithError("unable to find group", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to find group", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GroupResponse{Group: group}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleUpdateGroup(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the group ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Read the body into a string for json decoding
+		var payload = &reqres.UpdateGroupRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateUpdateGroup(id, payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// update the group in our database
+		group, err := svc.UpdateGroup(r.Context(), id, &model.UpdateGroup{Name: payload.Name, Description: payload.Description})
+		markPhase(r, phaseDB)
+		if err == errGroupNotFound {
+			respondWithError("unable to update group", err, w, http.StatusNotFound)
+			return
+		}
+		if err == errDuplicateGroup {
+			respondWithError("unable to update group", err, w, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to update group", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GroupResponse{Group: group}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleDeleteGroup(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the group ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		// delete the group and its memberships from our database
+		err := svc.DeleteGroup(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err == errGroupNotFound {
+			respondWithError("unable to delete group", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to delete group", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleAddGroupMember(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the group and user IDs from the url
+		vars := mux.Vars(r)
+		groupID, userID := vars["id"], vars["userID"]
+		markPhase(r, phaseValidation)
+
+		// add the user to the group in our database
+		err := svc.AddGroupMember(r.Context(), groupID, userID)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, userID, auditActionGroupChange, err)
+		if err == errGroupNotFound || err == errUserNotFound {
+			respondWithError("unable to add group member", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to add group member", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleRemoveGroupMember(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the group and user IDs from the url
+		vars := mux.Vars(r)
+		groupID, userID := vars["id"], vars["userID"]
+		markPhase(r, phaseValidation)
+
+		// take the user out of the group in our database
+		err := svc.RemoveGroupMember(r.Context(), groupID, userID)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, userID, auditActionGroupChange, err)
+		if err == errGroupNotFound || err == errNotGroupMember {
+			respondWithError("unable to remove group member", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to remove group member", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handleListUserGroups(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		// get the groups of the user from our database
+		groups, err := svc.ListUserGroups(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to list groups", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.UserGroupsResponse{Groups: groups}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleRefreshToken(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.RefreshTokenRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		if err := validateRefreshToken(payload); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+
+		markPhase(r, phaseValidation)
+
+		// Swap the refresh token for a new pair
+		result, err := svc.RefreshToken(withClient(r), payload.RefreshToken, requestOrigin(r))
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, loginResultUserID(result), auditActionTokenRefresh, err)
+		if respondWithServiceError("unable to refresh token", err, w) {
+			return
+		}
+		switch err {
+		case nil:
+		case errInvalidRefreshToken, errRefreshTokenReused:
+			respondWithError("Access not allowed", err, w, http.StatusUnauthorized)
+			return
+		case errOriginMismatch:
+			respondWithErrorCode("Access not allowed", originMismatchCode, err, w, http.StatusForbidden)
+			return
+		case errReauthRequired:
+			respondWithErrorCode("Access not allowed", reauthRequiredCode, err, w, http.StatusUnauthorized)
+			return
+		case errUserNotFound:
+			respondWithErrorCode("Access not allowed", userGoneCode, err, w, http.StatusUnauthorized)
+			return
+		case errAccountInactive:
+			respondWithErrorCode("Access not allowed", accountInactiveCode, err, w, http.StatusUnauthorized)
+			return
+		default:
+			respondWithError("unable to refresh token", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.LoginResponse{Token: result.Token, RefreshToken: result.RefreshToken, TOSAcceptanceRequired: result.TOSAcceptanceRequired, EvictedSessions: result.EvictedSessions}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	})
+}
+
+func handleOAuthAuthorize(publicURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the provider from the url
+		provider, ok := oauthProviders[mux.Vars(r)["provider"]]
+		if !ok {
+			respondWithError("unable to log in user", errUnknownProvider, w, http.StatusNotFound)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// Send the browser to the provider, bound to the login
+		authorizeURL, err := startOAuth(w, provider, publicURL, "", requestOrigin(r))
+		if err != nil {
+			respondWithError("unable to log in user", err, w, http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, authorizeURL, http.StatusFound)
+	})
+}
+
+func handleOAuthCallback(svc UserService, publicURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the provider from the url
+		provider, ok := oauthProviders[mux.Vars(r)["provider"]]
+		if !ok {
+			respondWithError("unable to log in user", errUnknownProvider, w, http.StatusNotFound)
+			return
+		}
+
+		// Do some validation
+		query := r.URL.Query()
+		if reason := query.Get("error"); reason != "" {
+			respondWithError("unable to log in user", fmt.Errorf("%s refused the login: %s", provider.name, reason), w, http.StatusBadRequest)
+			return
+		}
+		nonce := ""
+		if cookie, err := r.Cookie(oauthStateCookie); err == nil {
+			nonce = cookie.Value
+		}
+		state, err := verifyOAuthState(query.Get("state"), provider.name, nonce)
+		if err != nil {
+			respondWithErrorCode("unable to log in user", invalidOAuthStateCode, err, w, http.StatusBadRequest)
+			return
+		}
+		if query.Get("code") == "" {
+			respondWithError("Validation error", fieldError("code", "Please provide the code the provider sent back"), w, http.StatusBadRequest)
+			return
+		}
+		setOAuthStateCookie(w, publicURL, "", -1)
+		markPhase(r, phaseValidation)
+
+		// Find out from the provider who logged in
+		profile, err := fetchOAuthProfile(r.Context(), provider, query.Get("code"), oauthCallbackURL(publicURL, provider.name))
+		if err != nil {
+			respondWithError("unable to reach login provider", err, w, http.StatusBadGateway)
+			return
+		}
+
+		if state.userID != "" {
+			respondLinkIdentity(w, r, svc, state.userID, profile)
+			return
+		}
+		respondLoginWithProvider(w, r, svc, state.origin, profile)
+	})
+}
+
+// respondLoginWithProvider logs in the user of profile, handing out our
+// tokens like a login with a password does
+func respondLoginWithProvider(w http.ResponseWriter, r *http.Request, svc UserService, origin string, profile *model.ExternalProfile) {
+	// get the linked user from our database, or sign them up
+	result, err := svc.LoginWithProvider(withClient(r), profile, origin)
+	markPhase(r, phaseDB)
+	recordAuditEvent(r, loginResultUserID(result), auditActionLogin, err)
+	if respondWithServiceError("unable to log in user", err, w) {
+		return
+	}
+	switch err {
+	case nil:
+	case errIdentityNotLinked:
+		respondWithErrorCode("unable to log in user", identityNotLinkedCode, err, w, http.StatusConflict)
+		return
+	case errIdentityTaken:
+		respondWithErrorCode("unable to log in user", identityTakenCode, err, w, http.StatusConflict)
+		return
+	case errUnverifiedOAuthEmail:
+		respondWithError("unable to log in user", err, w, http.StatusForbidden)
+		return
+	case errAccountInactive:
+		respondWithErrorCode("unable to log in user", accountInactiveCode, err, w, http.StatusUnauthorized)
+		return
+	default:
+		respondWithError("unable to log in user", err, w, http.StatusInternalServerError)
+		return
+	}
+
+	// Generate our response
+	resp := reqres.LoginResponse{Token: result.Token, RefreshToken: result.RefreshToken, TOSAcceptanceRequired: result.TOSAcceptanceRequired, EvictedSessions: result.EvictedSessions}
+
+	// Marshal up the json response
+	js, err := marshalJSON(resp)
+	markPhase(r, phaseSerialization)
+	if err != nil {
+		respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+		return
+	}
+
+	// Return the response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// respondLinkIdentity links the identity of profile to the user who started
+// linking it
+func respondLinkIdentity(w http.ResponseWriter, r *http.Request, svc UserService, userID string, profile *model.ExternalProfile) {
+	// link the identity to the user in our database
+	user, err := svc.LinkIdentity(r.Context(), userID, profile)
+	markPhase(r, phaseDB)
+	switch err {
+	case nil:
+	case errUserNotFound:
+		respondWithError("unable to link identity", err, w, http.StatusNotFound)
+		return
+	case errIdentityTaken:
+		respondWithErrorCode("unable to link identity", identityTakenCode, err, w, http.StatusConflict)
+		return
+	case errProviderLinked:
+		respondWithErrorCode("unable to link identity", providerLinkedCode, err, w, http.StatusConflict)
+		return
+	default:
+		respondWithError("unable to link identity", err, w, http.StatusInternalServerError)
+		return
+	}
+
+	// Generate our response
+	resp := reqres.GetUserResponse{User: user}
+
+	// Marshal up the json response
+	js, err := marshalJSON(resp)
+	markPhase(r, phaseSerialization)
+	if err != nil {
+		respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+		return
+	}
+
+	// Return the response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+func handleLinkIdentity(publicURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID and provider from the url
+		vars := mux.Vars(r)
+		provider, ok := oauthProviders[vars["provider"]]
+		if !ok {
+			respondWithError("unable to link identity", errUnknownProvider, w, http.StatusNotFound)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// The browser goes to the provider next, and the callback links
+		// whoever logs in there to the user
+		authorizeURL, err := startOAuth(w, provider, publicURL, vars["id"], requestOrigin(r))
+		if err != nil {
+			respondWithError("unable to link identity", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(reqres.LinkIdentityResponse{AuthorizeURL: authorizeURL})
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleUnlinkIdentity(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID and provider from the url, which doesn't need to
+		// be configured anymore to be unlinked
+		vars := mux.Vars(r)
+		markPhase(r, phaseValidation)
+
+		// unlink the identity from the user in our database
+		user, err := svc.UnlinkIdentity(r.Context(), vars["id"], vars["provider"])
+		markPhase(r, phaseDB)
+		switch err {
+		case nil:
+		case errUserNotFound, errProviderNotLinked:
+			respondWithError("unable to unlink identity", err, w, http.StatusNotFound)
+			return
+		case errLastAuthMethod:
+			respondWithErrorCode("unable to unlink identity", lastAuthMethodCode, err, w, http.StatusConflict)
+			return
+		default:
+			respondWithError("unable to unlink identity", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.GetUserResponse{User: user}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleCreateAPIKey(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Read the body into a string for json decoding
+		var payload = &reqres.CreateAPIKeyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Do some validation
+		if err := validateCreateAPIKey(payload, time.Now()); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// mint the key in our database
+		apiKey, key, err := svc.CreateAPIKey(r.Context(), id, payload.Name, payload.Scopes, payload.ExpiresAt)
+		markPhase(r, phaseDB)
+		if apiKey != nil {
+			recordAuditDetail(r, id, auditActionAPIKeyCreate, fmt.Sprintf("key %s with scopes %s", apiKey.ID, strings.Join(apiKey.Scopes, " ")), err)
+		} else {
+			recordAuditEvent(r, id, auditActionAPIKeyCreate, err)
+		}
+		switch err {
+		case nil:
+		case errUserNotFound:
+			respondWithError("unable to create API key", err, w, http.StatusNotFound)
+			return
+		case errScopeNotGranted:
+			respondWithErrorCode("unable to create API key", scopeNotGrantedCode, err, w, http.StatusForbidden)
+			return
+		case errTooManyAPIKeys:
+			respondWithErrorCode("unable to create API key", tooManyAPIKeysCode, err, w, http.StatusConflict)
+			return
+		default:
+			respondWithError("unable to create API key", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.CreateAPIKeyResponse{Key: key, APIKey: apiKey}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response, which is the only time the key is shown
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(js)
+	})
+}
+
+func handleListAPIKeys(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		markPhase(r, phaseValidation)
+
+		// get the keys of the user from our database
+		keys, err := svc.ListAPIKeys(r.Context(), id)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to list API keys", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.ListAPIKeysResponse{APIKeys: keys}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleRevokeAPIKey(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID and key ID from the url
+		vars := mux.Vars(r)
+		markPhase(r, phaseValidation)
+
+		// revoke the key in our database
+		err := svc.RevokeAPIKey(r.Context(), vars["id"], vars["keyID"])
+		markPhase(r, phaseDB)
+		recordAuditDetail(r, vars["id"], auditActionAPIKeyRevoke, "key "+vars["keyID"], err)
+		if err == errAPIKeyNotFound {
+			respondWithError("unable to revoke API key", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to revoke API key", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// handleExportAuditEvents streams the audit log, oldest first, a line per
+// event. Once the first line is written, failing can only cut it short.
+func handleExportAuditEvents(events AuditLogExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		format, since, err := parseAuditExportQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		contentType := "application/x-ndjson"
+		if format == auditExportCEF {
+			contentType = "text/plain; charset=utf-8"
+		}
+		flusher, _ := w.(http.Flusher)
+		written := 0
+		err = events.Export(since, func(event *model.AuditEvent) error {
+			if written == 0 {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Cache-Control", "private, no-cache")
+				w.WriteHeader(http.StatusOK)
+			}
+			if err := writeAuditExport(w, format, event); err != nil {
+				return err
+			}
+			if written++; flusher != nil && written%100 == 0 {
+				flusher.Flush()
+			}
+			return nil
+		})
+		markPhase(r, phaseDB)
+		if err != nil && written == 0 {
+			respondWithError("unable to export audit log", err, w, http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			log.Printf("audit log export cut short after %d events: %v", written, err)
+			return
+		}
+		if written == 0 {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Cache-Control", "private, no-cache")
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// handleGetAuditEvents lists the audit log of the {id} user, or of every user
+// on routes without one
+func handleGetAuditEvents(events AuditLogReader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		opts, err := parsePagingQuery(r.URL.Query())
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the events from the audit log
+		list, total, err := events.Events(mux.Vars(r)["id"], opts)
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to get audit log", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		resp := reqres.AuditEventsResponse{Events: list, Total: total, Offset: opts.Offset, Limit: opts.Limit}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleExportUsers streams every user that isn't deleted in order of id, a
+// JSON line per user, after the user with the id of the after parameter when
+// there is one. Once the first line is written, failing can only cut it
+// short, and the id of the last line is where to pick up from.
+func handleExportUsers(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		after := r.URL.Query().Get("after")
+		markPhase(r, phaseValidation)
+
+		writeHeader := func() {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.WriteHeader(http.StatusOK)
+		}
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		written := 0
+		err := svc.ExportUsers(r.Context(), after, func(user *model.User) error {
+			if written == 0 {
+				writeHeader()
+			}
+			if err := encoder.Encode(user); err != nil {
+				return err
+			}
+			if written++; flusher != nil && written%100 == 0 {
+				flusher.Flush()
+			}
+			return nil
+		})
+		markPhase(r, phaseDB)
+		recordAuditDetail(r, "", auditActionExport, strconv.Itoa(written)+" users", err)
+		if err != nil && written == 0 {
+			respondWithError("unable to export users", err, w, http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			log.Printf("user export cut short after %d users: %v", written, err)
+			return
+		}
+		if written == 0 {
+			writeHeader()
+		}
+	})
+}
+
+func handleExportUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Do some validation
+		if err := validateGetUserByID(id); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// gather everything we hold about the user
+		export, err := svc.ExportUser(r.Context(), id)
+		recordAuditEvent(r, id, auditActionExport, err)
+		if err == errUserNotFound {
+			respondWithError("unable to export user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to export user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// The audit log is only part of the export when it can be read back
+		if events, ok := auditLog.(AuditLogReader); ok {
+			if export.AuditEvents, _, err = events.Events(id, model.ListOptions{}); err != nil {
+				respondWithError("unable to export user", err, w, http.StatusInternalServerError)
+				return
+			}
+		}
+		markPhase(r, phaseDB)
+
+		// Marshal up the json response, the export is the whole body
+		js, err := marshalJSON(export)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="user-`+id+`.json"`)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleEraseUser(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+
+		// Do some validation
+		if err := validateGetUserByID(id); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		dryRun, err := parseDryRun(r.URL.Query().Get("dry_run"))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// A dry run only says who would be erased, deleted users included
+		if dryRun {
+			respondWithDryRun(w, r, "erase", "unable to erase user", svc.GetByIDIncludingDeleted, id)
+			return
+		}
+
+		// anonymize the user and purge their tokens in our database
+		err = svc.EraseUser(r.Context(), id)
+		markPhase(r, phaseDB)
+		recordAuditEvent(r, id, auditActionErase, err)
+		if err == errUserNotFound {
+			respondWithError("unable to erase user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to erase user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// respondWithDryRun responds with the user of id that action would affect,
+// found with get, without changing anything
+func respondWithDryRun(w http.ResponseWriter, r *http.Request, action, message string, get func(context.Context, string) (*model.User, error), id string) {
+	user, err := get(r.Context(), id)
+	markPhase(r, phaseDB)
+	if err == errUserNotFound {
+		respondWithError(message, err, w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWithError(message, err, w, http.StatusInternalServerError)
+		return
+	}
+
+	// Generate our response
+	resp := reqres.DryRunResponse{Action: action, Count: 1, UserIDs: []string{user.ID}, DryRun: true}
+
+	// Marshal up the json response
+	js, err := marshalJSON(resp)
+	markPhase(r, phaseSerialization)
+	if err != nil {
+		respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+		return
+	}
+
+	// Return the response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// handleEmailPreview renders an email users can be sent with sample data, so
+// copy can be reviewed without sending it
+func handleEmailPreview() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Do some validation
+		query := r.URL.Query()
+		name, locale, err := parseEmailPreviewQuery(query.Get("template"), query.Get("locale"))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		tmpl, data, err := emailPreview(name, locale)
+		if err == errUnknownEmailTemplate {
+			respondWithError("unable to preview email", err, w, http.StatusNotFound)
+			return
+		}
+		var email bytes.Buffer
+		if err := tmpl.Execute(&email, data); err != nil {
+			respondWithError("unable to preview email", err, w, http.StatusInternalServerError)
+			return
+		}
+		markPhase(r, phaseSerialization)
+
+		// Return the response
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(email.Bytes())
+	})
+}
+
+func handleDiscovery(publicURL string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		baseURL := strings.TrimRight(publicURL, "/")
+
+		// Generate our response
+		resp := reqres.DiscoveryResponse{
+			Issuer:                    baseURL,
+			TokenEndpoint:             baseURL + LoginUserPath,
+			RefreshEndpoint:           baseURL + RefreshTokenPath,
+			SigningAlgValuesSupported: []string{signingMethod.Alg()},
+			JWKSURI:                   baseURL + JWKSPath,
+			PasswordPolicyEndpoint:    baseURL + PasswordPolicyPath,
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleJWKS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Generate our response
+		resp := reqres.JWKSResponse{Keys: jsonWebKeys(time.Now())}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetPasswordPolicy() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Generate our response
+		resp := reqres.PasswordPolicyResponse{Policy: passwordPolicy}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response, the policy only changes on restart
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleCheckPassword() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body into a string for json decoding
+		var payload = &reqres.CheckPasswordRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respondWithError("unable to decode json request", err, w, http.StatusBadRequest)
+			return
+		}
+
+		// Generate our response, a failing password is still a successful check
+		resp := reqres.CheckPasswordResponse{Valid: true, Warnings: []string{}}
+		if err := validatePassword(payload.Password, payload.Username, payload.Email, payload.FirstName, payload.LastName); err != nil {
+			resp.Valid = false
+			resp.Message = err.Error()
+			resp.Code = validationErrorCodeOf(err)
+		} else {
+			resp.Warnings = passwordWarnings(payload.Password)
+		}
+		markPhase(r, phaseValidation)
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetPermissions() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Go by the caller's token, like the authorization checks do, so a
+		// role change shows once the token is refreshed
+		role, _ := claimsFromContext(r)["role"].(string)
+
+		// Generate our response
+		resp := reqres.PermissionsResponse{Role: role, Scopes: scopesFor(role)}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetAuthMethods(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// get the caller from our database
+		userID, _ := claimsFromContext(r)["sub"].(string)
+		user, err := svc.GetByID(r.Context(), userID)
+		markPhase(r, phaseDB)
+		if respondWithServiceError("unable to get user", err, w) {
+			return
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to get user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to get user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(authMethodsOf(user))
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetPasswordStatus(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// get the caller from our database
+		userID, _ := claimsFromContext(r)["sub"].(string)
+		user, err := svc.GetByID(r.Context(), userID)
+		markPhase(r, phaseDB)
+		if respondWithServiceError("unable to get user", err, w) {
+			return
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to get user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to get user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Marshal up the json response
+		js, err := marshalJSON(passwordStatusOf(user, time.Now()))
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// authMethodsOf summarizes the ways user can authenticate. Passwords and
+// linked providers are the only methods we support so far, so the others are
+// never configured.
+func authMethodsOf(user *model.User) reqres.AuthMethodsResponse {
+	resp := reqres.AuthMethodsResponse{
+		PasswordSet:     user.Password != "",
+		LinkedProviders: []string{},
+	}
+	for _, identity := range user.Identities {
+		resp.LinkedProviders = append(resp.LinkedProviders, identity.Provider)
+	}
+	return resp
+}
+
+// handleGetRoleDiff previews the scopes a user would gain and lose from a role
+// change, before an admin makes it
+func handleGetRoleDiff(svc UserService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Get the user ID from the url
+		id := mux.Vars(r)["id"]
+		to := r.URL.Query().Get("to")
+
+		// Do some validation
+		if err := validateRoleDiff(id, to); err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		markPhase(r, phaseValidation)
+
+		// get the user from our database
+		user, err := svc.GetByID(r.Context(), id)
+		markPhase(r, phaseDB)
+		if respondWithServiceError("unable to get user", err, w) {
+			return
+		}
+		if err == errUserNotFound {
+			respondWithError("unable to get user", err, w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondWithError("unable to get user", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		added, removed := scopeDiff(user.Role, to)
+		resp := reqres.RoleDiffResponse{UserID: user.ID, CurrentRole: user.Role, ProposedRole: to, Added: added, Removed: removed}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleVerifyAudit() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// get the audit trail from our database
+		entries, err := auditStore.Entries()
+		markPhase(r, phaseDB)
+		if err != nil {
+			respondWithError("unable to get audit trail", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Generate our response
+		checked, brokenAt, err := verifyAuditChain(entries)
+		resp := reqres.AuditVerifyResponse{Valid: err == nil, Entries: checked, BrokenAt: brokenAt}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+func handleGetRoles() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Generate our response
+		resp := reqres.RolesResponse{Roles: roles}
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response, the roles only change on restart
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// handleHealthz reports that the instance is alive, even while draining
+func handleHealthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithHealth(reqres.HealthResponse{Status: "ok"}, w, http.StatusOK)
+	})
+}
+
+// handleReadyz reports whether the instance takes new traffic, which it
+// doesn't once draining or while the database can't be reached
+func handleReadyz(svc UserService, d *drainer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.Draining() {
+			respondWithHealth(reqres.HealthResponse{Status: "draining"}, w, http.StatusServiceUnavailable)
+			return
+		}
+
+		// Every dependency is checked at once, MongoDB always being required
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		checks := append([]dependencyCheck{{name: "mongo", required: true, check: svc.Ping}}, dependencyChecks...)
+		dependencies, ready := checkDependencies(ctx, checks)
+		if !ready {
+			respondWithHealth(reqres.HealthResponse{Status: "unavailable", Dependencies: dependencies}, w, http.StatusServiceUnavailable)
+			return
+		}
+
+		// Optional dependencies being down leaves the instance ready, but
+		// degraded
+		status := "ok"
+		for _, dependency := range dependencies {
+			if dependency.Status != dependencyOK {
+				status = "degraded"
+			}
+		}
+		respondWithHealth(reqres.HealthResponse{Status: status, Dependencies: dependencies}, w, http.StatusOK)
+	})
+}
+
+// handleDrain stops the instance from taking new traffic, shutting it down
+// once the grace period is over
+func handleDrain(d *drainer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Generate our response
+		resp := reqres.DrainResponse{ShutdownAt: d.Drain()}
+		log.Println("draining, shutting down at", resp.ShutdownAt)
+
+		// Marshal up the json response
+		js, err := marshalJSON(resp)
+		markPhase(r, phaseSerialization)
+		if err != nil {
+			respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		// Return the response
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(js)
+	})
+}
+
+// Helper function to return a health check response, which is never cached
+func respondWithHealth(resp reqres.HealthResponse, w http.ResponseWriter, status int) {
+	js, err := marshalJSON(resp)
+	if err != nil {
+		respondWithError("unable to marshal json response", err, w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// Helper function to respond to a signup that clashes with an existing user
+func respondWithSignupConflict(err error, w http.ResponseWriter) {
+	if !signupConflictHints {
+		respondWithErrorCode("unable to add user", accountExistsCode, errors.New("an account with this email or username may already exist"), w, http.StatusConflict)
+		return
+	}
+
+	if err == errDuplicateEmail {
+		respondWithErrorCode("unable to add user", emailExistsCode, errors.New("an account with this email address already exists, try logging in or resetting your password"), w, http.StatusConflict)
+		return
+	}
+	respondWithErrorCode("unable to add user", usernameTakenCode, err, w, http.StatusConflict)
+}
+
+// statusErrorCode returns the error code of responses with status that have
+// no more specific code
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return validationErrorCode
+	case http.StatusUnauthorized:
+		return unauthorizedCode
+	case http.StatusForbidden:
+		return forbiddenCode
+	case http.StatusNotFound:
+		return notFoundCode
+	case http.StatusConflict:
+		return conflictCode
+	case http.StatusGone:
+		return goneCode
+	case http.StatusNotAcceptable:
+		return notAcceptableCode
+	case http.StatusTooManyRequests:
+		return tooManyRequestsCode
+	case http.StatusNotImplemented:
+		return notImplementedCode
+	case http.StatusServiceUnavailable:
+		return serviceUnavailableCode
+	}
+	if status >= http.StatusInternalServerError {
+		return internalErrorCode
+	}
+	return badRequestCode
+}
+
+// statusClientClosedRequest is the non-standard status of responses to clients
+// that went away before we were done
+const statusClientClosedRequest = 499
+
+// respondWithServiceError responds to a service call that ran out of time or
+// whose client went away, reporting whether err was either
+func respondWithServiceError(msg string, err error, w http.ResponseWriter) bool {
+	switch err {
+	case errServiceTimeout:
+		respondWithError(msg, err, w, http.StatusServiceUnavailable)
+	case context.Canceled:
+		respondWithError(msg, err, w, statusClientClosedRequest)
+	default:
+		return false
+	}
+	return true
+}
+
+// Helper function to return a json error message
+func respondWithError(msg string, err error, w http.ResponseWriter, status int) {
+	respondWithErrorCode(msg, validationErrorCodeOf(err), err, w, status)
+}
+
+// validationErrorCodeOf returns the code of the first of the validation
+// errors of err that has one
+func validationErrorCodeOf(err error) string {
+	for _, coded := range fieldErrorsOf(err) {
+		if coded.code != "" {
+			return coded.code
+		}
+	}
+	return ""
+}
+
+// Helper function to return a json error message with a machine readable code,
+// which defaults to the one of the status. Validation errors about fields are
+// listed, each one, and the first of each field is also listed under it. The details of server errors are only logged, along with
+// the id of the request the response carries. Clients that accept problem
+// details get the error described as one.
+func respondWithErrorCode(msg, code string, err error, w http.ResponseWriter, status int) {
+	if code == "" {
+		code = statusErrorCode(status)
+	}
+	errMsg := reqres.ErrorResponse{Message: msg + ": " + err.Error(), Code: code, RequestID: w.Header().Get(requestIDHeader)}
+	for _, coded := range fieldErrorsOf(err) {
+		if coded.field == "" {
+			continue
+		}
+		if errMsg.Fields == nil {
+			errMsg.Fields = map[string]string{}
+		}
+		if _, ok := errMsg.Fields[coded.field]; !ok {
+			errMsg.Fields[coded.field] = coded.message
+		}
+		errMsg.Errors = append(errMsg.Errors, reqres.FieldError{Field: coded.field, Message: coded.message})
+	}
+	if status >= http.StatusInternalServerError {
+		if errMsg.RequestID != "" {
+			log.Printf("%s: %v (request %s)", msg, err, errMsg.RequestID)
+		} else {
+			log.Printf("%s: %v", msg, err)
+		}
+		errMsg.Message = msg
+	}
+
+	contentType := "application/json"
+	var resp interface{} = errMsg
+	if pw, ok := w.(*problemResponseWriter); ok {
+		contentType = problemContentType
+		resp = problemFor(errMsg, status, pw.requestID)
+	}
+
+	js, err := marshalJSON(resp)
+	if err != nil {
+		w.Header().Set("Content-Type", contentType+"; charset=UTF-8")
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(status)
 	w.Write(js)
 }
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 
@@ -21,11 +27,16 @@ import (
 var (
 	userID   string
 	username = "testUser"
-	password = "testPassword"
+	password = "Correct-Horse-42"
 	token    model.JWTToken
+
+	refreshToken string
 )
 
 func TestMain(m *testing.M) {
+	SecretKey = "test-secret"
+
+	setUp()
 	result := m.Run()
 
 	tearDown()
@@ -57,7 +68,49 @@ func TestCreateUserHTTPEndpoint(t *testing.T) {
 		t.Errorf("Success expected: %d", res.StatusCode)
 	}
 
-	getUserID(res.Body)
+	getUserID(t, res)
+}
+
+func TestCreateUserDuplicateEmail(t *testing.T) {
+	defer func() { signupConflictHints = false }()
+
+	server := httptest.NewServer(handleCreateUser(userService{}))
+	defer server.Close()
+
+	// Same email as the user created above, different username
+	userJSON := `{"email": "test@test.com", "first_name": "testname", "last_name": "lasttest", "password": "` + password + `", "role": "student", "username": "otherUser"}`
+
+	for _, c := range []struct {
+		hints bool
+		code  string
+	}{
+		{false, accountExistsCode},
+		{true, emailExistsCode},
+	} {
+		signupConflictHints = c.hints
+
+		res, err := http.Post(fmt.Sprintf("%s/users", server.URL), "application/json", strings.NewReader(userJSON))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != 409 {
+			t.Errorf("Expected a 409 status code response but got: %d", res.StatusCode)
+		}
+
+		var payload = &reqres.ErrorResponse{}
+		if err := json.NewDecoder(res.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if payload.Code != c.code {
+			t.Errorf("Expected the %s code with hints %v but got: %q", c.code, c.hints, payload.Code)
+		}
+
+		if !c.hints && strings.Contains(payload.Message, "password") {
+			t.Errorf("Expected a generic message without hints but got: %s", payload.Message)
+		}
+	}
 }
 
 func TestGetUserByIDHTTPEndpoint(t *testing.T) {
@@ -82,6 +135,31 @@ func TestGetUserByIDHTTPEndpoint(t *testing.T) {
 	}
 }
 
+func TestResolveUsersHTTPEndpoint(t *testing.T) {
+	server := httptest.NewServer(handleResolveUsers(userService{}))
+	defer server.Close()
+
+	resolveJSON := `{"usernames": ["` + username + `", " ` + username + ` ", "nobodyByThisName"]}`
+
+	resp, err := http.Post(fmt.Sprintf("%s/users/resolve", server.URL), "application/json", strings.NewReader(resolveJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.ResolveUsersResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payload.Users) != 1 || payload.Users[0].Username != username || payload.Users[0].ID != userID {
+		t.Errorf("Expected only %s to be resolved but got: %+v", username, payload.Users)
+	}
+}
+
 func TestLoginUser(t *testing.T) {
 	server := httptest.NewServer(handleLoginUser(userService{}))
 
@@ -100,15 +178,97 @@ func TestLoginUser(t *testing.T) {
 		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
 	}
 
-	getToken(resp.Body)
+	getToken(t, resp)
 }
 
-func testRefreshToken(t *testing.T) {
+func TestFailedLoginAttemptIsRecorded(t *testing.T) {
 	server := httptest.NewServer(handleLoginUser(userService{}))
+	defer server.Close()
+
+	loginJSON := `{"username": "` + username + `", "password": "wrongPassword"}`
+
+	resp, err := http.Post(fmt.Sprintf("%s/auth/authenticate", server.URL), "application/json", strings.NewReader(loginJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 400 {
+		t.Errorf("Expected a 400 status code response but got: %d", resp.StatusCode)
+	}
+
+	attempts, err := userService{}.GetLoginAttempts(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(attempts) == 0 {
+		t.Fatal("Expected the failed attempt to be recorded")
+	}
+
+	if attempts[0].Success || attempts[0].Reason != loginReasonBadPassword {
+		t.Errorf("Expected a failed attempt with reason %s but got: %+v", loginReasonBadPassword, attempts[0])
+	}
+}
+
+func TestTOSReacceptanceAfterVersionBump(t *testing.T) {
+	defer func() { requireTOSAcceptance, currentTOSVersion = false, "" }()
+	requireTOSAcceptance, currentTOSVersion = true, "1"
+
+	svc := userService{}
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "tos@test.com", FirstName: "tos", LastName: "user", Password: password, Role: "student", Username: "tosUser", AcceptedTOSVersion: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	result, err := svc.Login(context.Background(), "tosUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TOSAcceptanceRequired {
+		t.Error("Expected no acceptance to be required for the accepted version")
+	}
+
+	// Bump the version
+	currentTOSVersion = "2"
+
+	result, err = svc.Login(context.Background(), "tosUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.TOSAcceptanceRequired {
+		t.Error("Expected acceptance to be required after a version bump")
+	}
+
+	server := httptest.NewServer(authMiddleware(handleAcceptTOS(svc)))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/me/accept-tos", server.URL), strings.NewReader(`{"version": "2"}`))
+	req.Header.Set("Authorization", "Bearer "+string(result.Token))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	result, err = svc.Login(context.Background(), "tosUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TOSAcceptanceRequired {
+		t.Error("Expected no acceptance to be required after accepting the new version")
+	}
+}
+
+func testRefreshToken(t *testing.T) {
+	server := httptest.NewServer(handleRefreshToken(userService{}))
 
 	refreshTokenURL := fmt.Sprintf("%s/auth/refresh-token", server.URL)
 
-	refreshTokenJSON := `{"token": "` + string(token) + `"}`
+	refreshTokenJSON := `{"refresh_token": "` + refreshToken + `"}`
 
 	req, _ := http.NewRequest("POST", refreshTokenURL, strings.NewReader(refreshTokenJSON))
 
@@ -122,39 +282,2697 @@ func testRefreshToken(t *testing.T) {
 	}
 }
 
-func tearDown() {
-	//Grab a copy of our session
-	session, err := getSession()
+func TestPermissionsFollowRoleAfterRefresh(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "perms@test.com", FirstName: "perms", LastName: "user", Password: password, Role: "student", Username: "permsUser"})
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	defer session.Close()
+	defer svc.Remove(context.Background(), user.ID)
 
-	//Get our collection of applications
-	db := session.DB("buzz-test-user")
-	collection := db.C("users")
+	session, err := svc.Login(context.Background(), "permsUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	//remove our applications from the collection
-	err = collection.Remove(bson.M{"username": username})
+	server := httptest.NewServer(authMiddleware(handleGetPermissions()))
+	defer server.Close()
+
+	permissions := func(token model.JWTToken) *reqres.PermissionsResponse {
+		req, _ := http.NewRequest("GET", server.URL+"/me/permissions", nil)
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+		}
+		var payload = &reqres.PermissionsResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload
+	}
+
+	if payload := permissions(session.Token); payload.Role != "student" || len(payload.Scopes) != 1 || payload.Scopes[0] != scopeUsersRead {
+		t.Errorf("Expected the student scopes but got: %+v", payload)
+	}
+
+	admin := "admin"
+	if _, err := svc.Update(context.Background(), user.ID, &model.UpdateUser{Role: &admin}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token still carries the old role until it's refreshed
+	if payload := permissions(session.Token); payload.Role != "student" {
+		t.Errorf("Expected the token's role until it's refreshed but got: %+v", payload)
+	}
+
+	refreshed, err := svc.RefreshToken(context.Background(), session.RefreshToken, "")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	if payload := permissions(refreshed.Token); payload.Role != "admin" || len(payload.Scopes) != len(scopesFor("admin")) {
+		t.Errorf("Expected the admin scopes after refreshing but got: %+v", payload)
 	}
 }
 
-func getUserID(respBody io.Reader) {
-	var payload = &reqres.CreateUserResponse{}
-	if err := json.NewDecoder(respBody).Decode(&payload); err != nil {
-		log.Fatal("Error decoding json response")
+func TestErrorResponseShape(t *testing.T) {
+	decode := func(body io.Reader) *reqres.ErrorResponse {
+		var payload = &reqres.ErrorResponse{}
+		if err := json.NewDecoder(body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload
 	}
 
-	userID = payload.User.ID
+	// Validation failures name every offending field
+	server := httptest.NewServer(handleCreateUser(userService{}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/users", "application/json", strings.NewReader(`{"email": "not-an-email", "username": "shapeUser"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", resp.StatusCode)
+	}
+	payload := decode(resp.Body)
+	if payload.Code != validationErrorCode || payload.Fields["email"] == "" || payload.Fields["password"] == "" {
+		t.Errorf("Expected validation errors for the email and password fields but got: %+v", payload)
+	}
+	if len(payload.Errors) != len(payload.Fields) || payload.Errors[0].Field != "email" || payload.Errors[0].Message != payload.Fields["email"] {
+		t.Errorf("Expected the validation errors to be listed in order but got: %+v", payload.Errors)
+	}
+
+	// Malformed bodies are the client's fault too
+	resp, err = http.Post(server.URL+"/users", "application/json", strings.NewReader(`{`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response for a malformed body but got: %d", resp.StatusCode)
+	}
+
+	// Server errors don't reveal their details
+	rec := httptest.NewRecorder()
+	respondWithError("unable to add user", errors.New("dial tcp 10.0.0.1:27017: connection refused"), rec, http.StatusInternalServerError)
+	payload = decode(rec.Body)
+	if payload.Code != internalErrorCode || payload.Message != "unable to add user" || payload.Fields != nil {
+		t.Errorf("Expected a generic internal error but got: %+v", payload)
+	}
+
+	// Other errors get the code of their status unless they have their own
+	rec = httptest.NewRecorder()
+	authMiddleware(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/users/someID", nil))
+	if payload := decode(rec.Body); payload.Code != unauthorizedCode {
+		t.Errorf("Expected the %s code but got: %+v", unauthorizedCode, payload)
+	}
+
+	rec = httptest.NewRecorder()
+	respondWithErrorCode("Access not allowed", userGoneCode, errUserNotFound, rec, http.StatusUnauthorized)
+	if payload := decode(rec.Body); payload.Code != userGoneCode {
+		t.Errorf("Expected the %s code but got: %+v", userGoneCode, payload)
+	}
 }
 
-func getToken(respBody io.Reader) {
-	var payload = &reqres.LoginResponse{}
-	if err := json.NewDecoder(respBody).Decode(&payload); err != nil {
-		log.Fatal("Error decoding json response")
+func TestMarshalJSONFieldCase(t *testing.T) {
+	defer func() { jsonFieldCase = snakeCase }()
+
+	resp := reqres.GetUserResponse{User: &model.User{FirstName: "testname", LastName: "lasttest", Timestamp: 1}}
+
+	jsonFieldCase = snakeCase
+	js, err := marshalJSON(resp)
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(js), `"first_name":"testname"`) || !strings.Contains(string(js), `"last_name":"lasttest"`) {
+		t.Errorf("Expected snake_case keys but got: %s", js)
 	}
 
-	token = payload.Token
+	jsonFieldCase = camelCase
+	js, err = marshalJSON(resp)
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(js), `"firstName":"testname"`) || !strings.Contains(string(js), `"lastName":"lasttest"`) {
+		t.Errorf("Expected camelCase keys but got: %s", js)
+	}
+	if !strings.Contains(string(js), `"timestamp":1`) {
+		t.Errorf("Expected numbers to be preserved but got: %s", js)
+	}
+}
+
+func TestGetPasswordPolicyHTTPEndpoint(t *testing.T) {
+	defaultPolicy := passwordPolicy
+	defer func() { passwordPolicy = defaultPolicy }()
+
+	passwordPolicy = model.PasswordPolicy{MinLength: 12, RequiredClasses: []string{digitClass, symbolClass}}
+
+	server := httptest.NewServer(handleGetPasswordPolicy())
+	defer server.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/password-policy", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	if resp.Header.Get("Cache-Control") == "" {
+		t.Error("Expected the policy to be cacheable")
+	}
+
+	var payload = &reqres.PasswordPolicyResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Policy.MinLength != 12 || len(payload.Policy.RequiredClasses) != 2 || payload.Policy.RequiredClasses[1] != symbolClass {
+		t.Errorf("Expected the configured policy but got: %+v", payload.Policy)
+	}
+}
+
+func TestCheckPasswordHTTPEndpoint(t *testing.T) {
+	defaultPolicy := passwordPolicy
+	defer func() { passwordPolicy = defaultPolicy }()
+
+	passwordPolicy = model.PasswordPolicy{MinLength: 8, RequiredClasses: []string{digitClass}}
+
+	server := httptest.NewServer(handleCheckPassword())
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		body     string
+		valid    bool
+		code     string
+		warnings int
+	}{
+		{"strong", `{"password": "correct-horse-42"}`, true, "", 0},
+		{"weak but valid", `{"password": "abcdefg1"}`, true, "", 1},
+		{"too short", `{"password": "abc1"}`, false, "", 0},
+		{"missing class", `{"password": "abcdefghijkl"}`, false, "", 0},
+		{"personal info", `{"password": "testUser2024!", "username": "testUser"}`, false, passwordPersonalInfoCode, 0},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Post(fmt.Sprintf("%s/password-policy/check", server.URL), "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: expected a 200 status code response but got: %d", test.name, resp.StatusCode)
+		}
+
+		var payload = &reqres.CheckPasswordResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if payload.Valid != test.valid || payload.Code != test.code || len(payload.Warnings) != test.warnings {
+			t.Errorf("%s: unexpected result: %+v", test.name, payload)
+		}
+		if !test.valid && payload.Message == "" {
+			t.Errorf("%s: expected a reason for the failure", test.name)
+		}
+	}
+}
+
+func TestGetRolesHTTPEndpoint(t *testing.T) {
+	defaultRoles := roles
+	defer func() { roles = defaultRoles }()
+
+	roles = []model.Role{
+		{Name: "student", Scopes: []string{scopeUsersRead}},
+		{Name: "teacher", Scopes: []string{scopeUsersRead, scopeUsersWrite}},
+	}
+
+	server := httptest.NewServer(handleGetRoles())
+	defer server.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/roles", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.RolesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payload.Roles) != 2 || payload.Roles[1].Name != "teacher" || len(payload.Roles[1].Scopes) != 2 {
+		t.Errorf("Expected the configured roles but got: %+v", payload.Roles)
+	}
+
+	// Signups are validated against the same roles
+	if !isValidRole("teacher") || isValidRole("admin") {
+		t.Error("Expected role validation to follow the configured roles")
+	}
+}
+
+func TestSetStatusHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "status@test.com", FirstName: "status", LastName: "user", Password: password, Role: "student", Username: "statusUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	router := mux.NewRouter()
+	router.Handle("/users/{id}/status", handleSetStatus(svc))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	setStatus := func(status string) int {
+		resp, err := http.Post(fmt.Sprintf("%s/users/%s/status", server.URL, user.ID), "application/json", strings.NewReader(`{"status": "`+status+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := setStatus(statusLocked); code != 200 {
+		t.Errorf("Expected locking an active account to succeed but got: %d", code)
+	}
+
+	// Locked accounts can't log in
+	if _, err := svc.Login(context.Background(), "statusUser", password, ""); err == nil {
+		t.Error("Expected a locked account not to be able to log in")
+	}
+
+	if code := setStatus(statusDeleted); code != 200 {
+		t.Errorf("Expected deleting a locked account to succeed but got: %d", code)
+	}
+
+	if code := setStatus(statusActive); code != http.StatusConflict {
+		t.Errorf("Expected activating a deleted account to be a conflict but got: %d", code)
+	}
+
+	if code := setStatus("banished"); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown status to be refused but got: %d", code)
+	}
+}
+
+func TestGetSecurityReportHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "report@test.com", FirstName: "report", LastName: "user", Password: password, Role: "student", Username: "reportUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	svc.Login(context.Background(), "reportUser", "wrong password", "")
+	if _, err := svc.SetStatus(context.Background(), user.ID, statusLocked); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/users/{id}/security-report", handleGetSecurityReport(svc))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	from := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	resp, err := http.Get(fmt.Sprintf("%s/users/%s/security-report?from=%s", server.URL, user.ID, from))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.GetSecurityReportResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Report == nil || payload.Report.Status != statusLocked || len(payload.Report.LoginAttempts) == 0 {
+		t.Errorf("Expected every section of the report to be populated but got: %+v", payload.Report)
+	}
+}
+
+func TestCreateUserLookalikeUsername(t *testing.T) {
+	defer func(check bool) { usernameConfusableCheck = check }(usernameConfusableCheck)
+
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "jose@test.com", FirstName: "jose", LastName: "user", Password: password, Role: "student", Username: "jos\u00e9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	// The same username in another normalization form is the same username
+	usernameConfusableCheck = false
+	if _, err := svc.Create(context.Background(), &model.CreateUser{Email: "jose2@test.com", FirstName: "jose", LastName: "user", Password: password, Role: "student", Username: "jose\u0301"}); err != errDuplicateUsername {
+		t.Errorf("Expected an NFD variant to be a duplicate username but got: %v", err)
+	}
+
+	// Homoglyphs are only refused with the confusable check
+	lookalike := &model.CreateUser{Email: "jose3@test.com", FirstName: "jose", LastName: "user", Password: password, Role: "student", Username: "j\u043es\u00e9"}
+	usernameConfusableCheck = true
+	if _, err := svc.Create(context.Background(), lookalike); err != errDuplicateUsername {
+		t.Errorf("Expected a homoglyph username to be refused but got: %v", err)
+	}
+
+	usernameConfusableCheck = false
+	created, err := svc.Create(context.Background(), lookalike)
+	if err != nil {
+		t.Errorf("Expected a homoglyph username to be allowed without the check but got: %v", err)
+	} else {
+		svc.Remove(context.Background(), created.ID)
+	}
+}
+
+func TestLoginMigratesPasswordHash(t *testing.T) {
+	defer func(hasher PasswordHasher) { passwordHasher = hasher }(passwordHasher)
+
+	svc := userService{}
+
+	passwordHasher, _ = newPasswordHasher(hashBcrypt)
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "rehash@test.com", FirstName: "rehash", LastName: "user", Password: password, Role: "student", Username: "rehashUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	passwordHasher, _ = newPasswordHasher(hashArgon2id)
+	if _, err := svc.Login(context.Background(), "rehashUser", password, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := svc.GetByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.Password, "$argon2id$") {
+		t.Errorf("Expected the hash to be moved to argon2id but got: %s", stored.Password)
+	}
+
+	// The migrated hash keeps working
+	if _, err := svc.Login(context.Background(), "rehashUser", password, ""); err != nil {
+		t.Errorf("Expected to log in with the migrated hash but got: %v", err)
+	}
+}
+
+func TestLoginByEmailIgnoresCase(t *testing.T) {
+	defer func(preserve bool) { preserveEmailCase = preserve }(preserveEmailCase)
+	preserveEmailCase = true
+
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "Mixed.Case@Test.com", FirstName: "mixed", LastName: "case", Password: password, Role: "student", Username: "mixedCaseUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	// The email is displayed as it was typed
+	stored, err := svc.GetByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != "Mixed.Case@Test.com" {
+		t.Errorf("Expected the email to keep its case but got: %s", stored.Email)
+	}
+
+	for _, email := range []string{"Mixed.Case@Test.com", "mixed.case@test.com", "MIXED.CASE@TEST.COM"} {
+		if _, err := svc.Login(context.Background(), email, password, ""); err != nil {
+			t.Errorf("Expected to log in with %s but got: %v", email, err)
+		}
+	}
+
+	// The same email in another case is taken
+	_, err = svc.Create(context.Background(), &model.CreateUser{Email: "mixed.case@test.com", FirstName: "mixed", LastName: "case", Password: password, Role: "student", Username: "otherCaseUser"})
+	if err != errDuplicateEmail {
+		t.Errorf("Expected the email in another case to be taken but got: %v", err)
+	}
+}
+
+func TestCreateConsumesUsernameReservation(t *testing.T) {
+	svc := userService{}
+
+	token, _, err := svc.ReserveUsername(context.Background(), "reservedUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.ReleaseUsername(context.Background(), "reservedUser", token)
+
+	if _, _, err := svc.ReserveUsername(context.Background(), "reservedUser"); err != errDuplicateUsername {
+		t.Errorf("Expected a reserved username not to be reserved again but got: %v", err)
+	}
+
+	// Only the signup holding the reservation gets the username
+	newUser := &model.CreateUser{Email: "reserved@test.com", FirstName: "reserved", LastName: "user", Password: password, Role: "student", Username: "reservedUser"}
+	if _, err := svc.Create(context.Background(), newUser); err != errDuplicateUsername {
+		t.Errorf("Expected the username to be held for the reservation but got: %v", err)
+	}
+	newUser.ReservationToken = token
+	user, err := svc.Create(context.Background(), newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	if holder, _ := usernameReservations.Holder(usernameKey("reservedUser")); holder != "" {
+		t.Errorf("Expected the reservation to be consumed but got: %q", holder)
+	}
+}
+
+// storedUserService serves one user by id, without a database
+type storedUserService struct {
+	UserService
+	user *model.User
+}
+
+func (svc storedUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	if id != svc.user.ID {
+		return nil, errUserNotFound
+	}
+	return svc.user, nil
+}
+
+func TestValidateEmailHTTPEndpoint(t *testing.T) {
+	defer func(preserve bool) { preserveEmailCase = preserve }(preserveEmailCase)
+
+	validate := func(email string) *reqres.ValidateEmailResponse {
+		body, _ := json.Marshal(reqres.ValidateEmailRequest{Email: email})
+		rec := httptest.NewRecorder()
+		handleValidateEmail().ServeHTTP(rec, httptest.NewRequest("POST", "/email/validate", bytes.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected a 200 status code response but got: %d", rec.Code)
+		}
+		var payload = &reqres.ValidateEmailResponse{}
+		if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload
+	}
+
+	if payload := validate("jane.doe+news@test.com"); !payload.Valid || payload.Normalized != "jane.doe+news@test.com" || payload.Message != "" {
+		t.Errorf("Expected a valid email but got: %+v", payload)
+	}
+	if payload := validate("not an email"); payload.Valid || payload.Message == "" {
+		t.Errorf("Expected an invalid email to be refused with a reason but got: %+v", payload)
+	}
+
+	// Emails have to be typed in lower case unless their case is preserved
+	preserveEmailCase = false
+	if payload := validate("Jane@Test.com"); payload.Valid {
+		t.Errorf("Expected an email in upper case to be refused but got: %+v", payload)
+	}
+	preserveEmailCase = true
+	if payload := validate("Jane@Test.com"); !payload.Valid || payload.Email != "Jane@Test.com" || payload.Normalized != "jane@test.com" {
+		t.Errorf("Expected the email to be kept as typed and compared in lower case but got: %+v", payload)
+	}
+}
+
+func TestGetAuthMethodsHTTPEndpoint(t *testing.T) {
+	user := &model.User{ID: "methodsID", Username: "methodsUser", Password: "$2a$10$hash", Role: "student"}
+	server := httptest.NewServer(authMiddleware(handleGetAuthMethods(storedUserService{user: user})))
+	defer server.Close()
+
+	authMethods := func() (*reqres.AuthMethodsResponse, string) {
+		token, err := generateToken(user.ID, user.Username, user.Role, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", server.URL+"/me/auth-methods", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		var payload = &reqres.AuthMethodsResponse{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload, string(body)
+	}
+
+	payload, body := authMethods()
+	if !payload.PasswordSet || payload.TOTPEnabled || payload.PhoneVerified || payload.APIKeys != 0 || payload.LinkedProviders == nil || len(payload.LinkedProviders) != 0 {
+		t.Errorf("Expected only a password to be configured but got: %+v", payload)
+	}
+	if strings.Contains(body, "$2a$") {
+		t.Errorf("Expected the password hash to be left out but got: %s", body)
+	}
+
+	// Users without a password have no way of logging in yet
+	user.Password = ""
+	if payload, _ := authMethods(); payload.PasswordSet {
+		t.Errorf("Expected no password to be configured but got: %+v", payload)
+	}
+}
+
+func TestGetSecurityEventsHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	alice, err := svc.Create(context.Background(), &model.CreateUser{Email: "events@test.com", FirstName: "events", LastName: "user", Password: password, Role: "student", Username: "eventsUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), alice.ID)
+	bob, err := svc.Create(context.Background(), &model.CreateUser{Email: "otherevents@test.com", FirstName: "other", LastName: "user", Password: password, Role: "student", Username: "otherEventsUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), bob.ID)
+
+	// Alice logs in once and fails once, bob logs in twice
+	svc.Login(context.Background(), "eventsUser", password, "")
+	svc.Login(context.Background(), "eventsUser", "wrong password", "")
+	svc.Login(context.Background(), "otherEventsUser", password, "")
+	svc.Login(context.Background(), "otherEventsUser", password, "")
+
+	server := httptest.NewServer(authMiddleware(handleGetSecurityEvents(svc)))
+	defer server.Close()
+
+	token, err := generateToken(alice.ID, alice.Username, alice.Role, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/me/security-events?user_id="+bob.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.SecurityEventsResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Total != 2 || len(payload.Events) != 2 {
+		t.Fatalf("Expected only alice's 2 events but got: %+v", payload)
+	}
+	if payload.Events[0].Type != securityEventLoginFailed || payload.Events[1].Type != securityEventLogin {
+		t.Errorf("Expected the failed login then the login but got: %+v", payload.Events)
+	}
+}
+
+func TestUserJSONOmitsPasswordHash(t *testing.T) {
+	js, err := marshalJSON(reqres.GetUserResponse{User: &model.User{ID: "id", Username: "testUser", Password: "$2a$10$hash"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(js), "password") || strings.Contains(string(js), "$2a$") {
+		t.Errorf("Expected the password hash not to be serialized but got: %s", js)
+	}
+}
+
+func TestLoginFailuresAreIndistinguishable(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "creds@test.com", FirstName: "creds", LastName: "user", Password: password, Role: "student", Username: "credsUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	stored, err := svc.GetByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Password == password || !strings.HasPrefix(stored.Password, "$2") {
+		t.Error("Expected only a bcrypt hash of the password to be stored")
+	}
+
+	_, unknownErr := svc.Login(context.Background(), "noSuchUser", password, "")
+	_, mismatchErr := svc.Login(context.Background(), "credsUser", "wrong password", "")
+	if unknownErr != errInvalidCredentials || mismatchErr != errInvalidCredentials {
+		t.Errorf("Expected the same error for an unknown user and a wrong password but got: %v, %v", unknownErr, mismatchErr)
+	}
+}
+
+func TestUpdateUserHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "update@test.com", FirstName: "update", LastName: "user", Password: password, Role: "student", Username: "updateUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	other, err := svc.Create(context.Background(), &model.CreateUser{Email: "taken@test.com", FirstName: "taken", LastName: "user", Password: password, Role: "student", Username: "takenUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), other.ID)
+
+	router := mux.NewRouter()
+	router.Handle("/users/{id}", authMiddleware(handleUpdateUser(svc)))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	update := func(id, asID, role, body string) *http.Response {
+		token, err := generateToken(asID, "updateUser", role, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/users/%s", server.URL, id), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// A partial update leaves the other fields alone
+	resp := update(user.ID, user.ID, "student", `{"first_name": "renamed"}`)
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	var payload = &reqres.UpdateUserResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.User.FirstName != "renamed" || payload.User.LastName != "user" || payload.User.Email != "update@test.com" {
+		t.Errorf("Expected only the first name to change but got: %+v", payload.User)
+	}
+
+	// Emails stay unique
+	if resp := update(user.ID, user.ID, "student", `{"email": "taken@test.com"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a 409 status code response but got: %d", resp.StatusCode)
+	}
+
+	// Nobody else can update the user
+	if resp := update(user.ID, other.ID, "student", `{"last_name": "hijacked"}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 status code response but got: %d", resp.StatusCode)
+	}
+
+	// And the email format is checked like on signup
+	if resp := update(user.ID, user.ID, "student", `{"email": "not an email"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", resp.StatusCode)
+	}
+
+	// Users change their password with their current one, elsewhere
+	if resp := update(user.ID, user.ID, "student", `{"password": "Another-Horse-43"}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 status code response but got: %d", resp.StatusCode)
+	}
+
+	// Admins can still set it, which logs the user out everywhere
+	loggedIn, err := startSession(context.Background(), user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := update(user.ID, "adminID", "admin", `{"password": "Another-Horse-43"}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	if _, err := svc.RefreshToken(context.Background(), loggedIn.RefreshToken, ""); err != errInvalidRefreshToken {
+		t.Errorf("Expected the user's refresh tokens to be revoked but got: %v", err)
+	}
+	if sessions, err := svc.ListSessions(context.Background(), user.ID); err != nil || len(sessions) != 0 {
+		t.Errorf("Expected the user's sessions to be ended but got: %v %v", sessions, err)
+	}
+}
+
+func TestGetChangesHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	updated, err := svc.Create(context.Background(), &model.CreateUser{Email: "updated@test.com", FirstName: "updated", LastName: "user", Password: password, Role: "student", Username: "updatedUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), updated.ID)
+
+	deleted, err := svc.Create(context.Background(), &model.CreateUser{Email: "deleted@test.com", FirstName: "deleted", LastName: "user", Password: password, Role: "student", Username: "deletedUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), deleted.ID)
+
+	// Timestamps are in seconds, so leave a clear gap before the cutoff
+	time.Sleep(1100 * time.Millisecond)
+	since := time.Now()
+
+	created, err := svc.Create(context.Background(), &model.CreateUser{Email: "created@test.com", FirstName: "created", LastName: "user", Password: password, Role: "student", Username: "createdUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), created.ID)
+
+	lastName := "changed"
+	if _, err := svc.Update(context.Background(), updated.ID, &model.UpdateUser{LastName: &lastName}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.SetStatus(context.Background(), deleted.ID, statusDeleted); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handleGetChanges(svc))
+	defer server.Close()
+
+	// Page through the changes one at a time
+	found := map[string]string{}
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		resp, err := http.Get(fmt.Sprintf("%s/users/changes?since=%s&limit=1&cursor=%s", server.URL, since.UTC().Format(time.RFC3339Nano), cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+		}
+
+		var payload = &reqres.GetChangesResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		for _, change := range payload.Changes {
+			found[change.ID] = change.Change
+		}
+		if payload.NextCursor == "" {
+			break
+		}
+		cursor = payload.NextCursor
+	}
+
+	if found[created.ID] != model.ChangeCreated || found[updated.ID] != model.ChangeUpdated || found[deleted.ID] != model.ChangeDeleted {
+		t.Errorf("Expected a creation, an update and a deletion but got: %v", found)
+	}
+}
+
+func TestRefreshTokenDeletedUser(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "gone@test.com", FirstName: "gone", LastName: "user", Password: password, Role: "student", Username: "goneUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := svc.Login(context.Background(), "goneUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.Remove(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handleRefreshToken(svc))
+	defer server.Close()
+
+	refreshTokenJSON := `{"refresh_token": "` + result.RefreshToken + `"}`
+
+	resp, err := http.Post(fmt.Sprintf("%s/auth/refresh-token", server.URL), "application/json", strings.NewReader(refreshTokenJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 401 {
+		t.Errorf("Expected a 401 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.ErrorResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Code != userGoneCode {
+		t.Errorf("Expected the %s error code but got: %q", userGoneCode, payload.Code)
+	}
+}
+
+func TestDiscoveryHTTPEndpoint(t *testing.T) {
+	server := httptest.NewServer(handleDiscovery("https://users.example.com/"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + DiscoveryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.DiscoveryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Issuer != "https://users.example.com" {
+		t.Errorf("Expected the configured issuer but got: %s", payload.Issuer)
+	}
+	if payload.TokenEndpoint != "https://users.example.com/auth/authenticate" {
+		t.Errorf("Expected the token endpoint under the public URL but got: %s", payload.TokenEndpoint)
+	}
+	if payload.RefreshEndpoint != "https://users.example.com/auth/refresh-token" {
+		t.Errorf("Expected the refresh endpoint under the public URL but got: %s", payload.RefreshEndpoint)
+	}
+}
+
+func TestChangePasswordHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "change@test.com", FirstName: "change", LastName: "user", Password: password, Role: "student", Username: "changeUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	session, err := svc.Login(context.Background(), "changeUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle(ChangePasswordPath, authMiddleware(requireSelfOrRoles(handleChangePassword(svc)))).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	changePassword := func(id, body string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/users/%s/password", server.URL, id), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+string(session.Token))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if code := changePassword(user.ID, `{"current_password": "wrongPassword", "new_password": "correct horse battery"}`); code != 400 {
+		t.Errorf("Expected a wrong current password to get a 400 but got: %d", code)
+	}
+	if code := changePassword(user.ID, `{"current_password": "`+password+`", "new_password": "short"}`); code != 400 {
+		t.Errorf("Expected a weak new password to get a 400 but got: %d", code)
+	}
+	if code := changePassword("someOtherID", `{"current_password": "`+password+`", "new_password": "correct horse battery"}`); code != 403 {
+		t.Errorf("Expected changing another user's password to get a 403 but got: %d", code)
+	}
+	if code := changePassword(user.ID, `{"current_password": "`+password+`", "new_password": "correct horse battery"}`); code != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", code)
+	}
+
+	if _, err := svc.Login(context.Background(), "changeUser", password, ""); err != errInvalidCredentials {
+		t.Errorf("Expected the old password to stop working but got: %v", err)
+	}
+	if _, err := svc.Login(context.Background(), "changeUser", "correct horse battery", ""); err != nil {
+		t.Errorf("Expected the new password to work but got: %v", err)
+	}
+
+	// Other sessions are logged out
+	if _, err := svc.RefreshToken(context.Background(), session.RefreshToken, ""); err != errInvalidRefreshToken {
+		t.Errorf("Expected refresh tokens to be revoked but got: %v", err)
+	}
+}
+
+func TestRefreshTokenUnknownToken(t *testing.T) {
+	server := httptest.NewServer(handleRefreshToken(userService{}))
+	defer server.Close()
+
+	// Access tokens aren't refresh tokens
+	accessToken, err := generateToken("someID", username, "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func(token string) int {
+		resp, err := http.Post(fmt.Sprintf("%s/auth/refresh-token", server.URL), "application/json", strings.NewReader(`{"refresh_token": "`+token+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	// Malformed tokens are the client's mistake
+	for _, token := range []string{accessToken, "junk", strings.Repeat("z", 64)} {
+		if status := refresh(token); status != http.StatusBadRequest {
+			t.Errorf("Expected a 400 status code response for %q but got: %d", token, status)
+		}
+	}
+
+	// Well formed tokens we never issued fail to authenticate
+	unknown, err := newRefreshToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := refresh(unknown); status != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 status code response but got: %d", status)
+	}
+}
+
+func TestRefreshTokenOriginMismatch(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "origin@test.com", FirstName: "origin", LastName: "user", Password: password, Role: "student", Username: "originUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	result, err := svc.Login(context.Background(), "originUser", password, "https://app.buzz.com/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handleRefreshToken(svc))
+	defer server.Close()
+
+	refreshTokenJSON := `{"refresh_token": "` + result.RefreshToken + `"}`
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/auth/refresh-token", server.URL), strings.NewReader(refreshTokenJSON))
+	req.Header.Set("Origin", "https://evil.com")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 403 {
+		t.Errorf("Expected a 403 status code response but got: %d", resp.StatusCode)
+	}
+}
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "rotate@test.com", FirstName: "rotate", LastName: "user", Password: password, Role: "student", Username: "rotateUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	result, err := svc.Login(context.Background(), "rotateUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RefreshToken == "" {
+		t.Fatal("Expected the login to hand out a refresh token")
+	}
+
+	server := httptest.NewServer(handleRefreshToken(svc))
+	defer server.Close()
+
+	refresh := func(refreshToken string) *http.Response {
+		resp, err := http.Post(fmt.Sprintf("%s/auth/refresh-token", server.URL), "application/json", strings.NewReader(`{"refresh_token": "`+refreshToken+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := refresh(result.RefreshToken)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.LoginResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Token == "" || payload.RefreshToken == "" || payload.RefreshToken == result.RefreshToken {
+		t.Fatalf("Expected a new access token and a rotated refresh token but got: %+v", payload)
+	}
+
+	// Using the old token again revokes the whole chain
+	if resp := refresh(result.RefreshToken); resp.StatusCode != 401 {
+		t.Errorf("Expected a reused refresh token to get a 401 but got: %d", resp.StatusCode)
+	}
+	if resp := refresh(payload.RefreshToken); resp.StatusCode != 401 {
+		t.Errorf("Expected the rotated refresh token to be revoked after reuse but got: %d", resp.StatusCode)
+	}
+}
+
+func TestRefreshTokenFamilyCap(t *testing.T) {
+	defer func(max int) { maxFamilyRefreshes = max }(maxFamilyRefreshes)
+	maxFamilyRefreshes = 2
+
+	svc := userService{}
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "refreshcap@test.com", FirstName: "refresh", LastName: "cap", Password: password, Role: "student", Username: "refreshCapUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	result, err := svc.Login(context.Background(), "refreshCapUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handleRefreshToken(svc))
+	defer server.Close()
+
+	refresh := func(refreshToken string) (int, reqres.LoginResponse, reqres.ErrorResponse) {
+		resp, err := http.Post(server.URL+"/auth/refresh-token", "application/json", strings.NewReader(`{"refresh_token": "`+refreshToken+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		var payload reqres.LoginResponse
+		var failure reqres.ErrorResponse
+		json.Unmarshal(body, &payload)
+		json.Unmarshal(body, &failure)
+		return resp.StatusCode, payload, failure
+	}
+
+	// The family is refreshed up to the cap, then has to log in again
+	refreshToken := result.RefreshToken
+	for i := 0; i < 2; i++ {
+		code, payload, _ := refresh(refreshToken)
+		if code != http.StatusOK {
+			t.Fatalf("Expected refresh %d to get a 200 but got: %d", i+1, code)
+		}
+		refreshToken = payload.RefreshToken
+	}
+	code, _, failure := refresh(refreshToken)
+	if code != http.StatusUnauthorized || failure.Code != reauthRequiredCode {
+		t.Errorf("Expected a refresh over the cap to get a 401 with %s but got: %d %+v", reauthRequiredCode, code, failure)
+	}
+
+	// A new login starts a new family
+	result, err = svc.Login(context.Background(), "refreshCapUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, _ := refresh(result.RefreshToken); code != http.StatusOK {
+		t.Errorf("Expected a new login to refresh again but got: %d", code)
+	}
+}
+
+func TestRememberMeRefreshTokenTTL(t *testing.T) {
+	defer func(ttl, remembered time.Duration) { refreshTokenTTL, rememberMeTTL = ttl, remembered }(refreshTokenTTL, rememberMeTTL)
+	refreshTokenTTL, rememberMeTTL = time.Hour, 30*24*time.Hour
+
+	svc := userService{}
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "rememberme@test.com", FirstName: "remember", LastName: "me", Password: password, Role: "student", Username: "rememberMeUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	session, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	collection, err := refreshTokenCollection(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func(refreshToken string) model.RefreshToken {
+		var token model.RefreshToken
+		if err := collection.FindId(hashRefreshToken(refreshToken)).One(&token); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expectTTL := func(token model.RefreshToken, ttl time.Duration) {
+		if lifetime := token.ExpiresAt.Sub(token.CreatedAt); lifetime < ttl-time.Second || lifetime > ttl+time.Second {
+			t.Errorf("Expected the refresh token to last %v but got: %v", ttl, lifetime)
+		}
+	}
+
+	result, err := svc.Login(context.Background(), "rememberMeUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := stored(result.RefreshToken); token.RememberMe {
+		t.Error("Expected a login not asking to be remembered to get a short refresh token")
+	} else {
+		expectTTL(token, time.Hour)
+	}
+
+	// Remembered logins last longer, and so do their refreshed tokens
+	result, err = svc.Login(withRememberMe(context.Background(), true), "rememberMeUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := stored(result.RefreshToken); !token.RememberMe {
+		t.Error("Expected the refresh token to be marked remembered")
+	} else {
+		expectTTL(token, 30*24*time.Hour)
+	}
+	refreshed, err := svc.RefreshToken(context.Background(), result.RefreshToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := stored(refreshed.RefreshToken); !token.RememberMe {
+		t.Error("Expected the refreshed token to stay remembered")
+	} else {
+		expectTTL(token, 30*24*time.Hour)
+	}
+}
+
+func TestLogoutRevokesToken(t *testing.T) {
+	defer func(store TokenRevocationStore) { revokedTokens = store }(revokedTokens)
+	revokedTokens = newMemoryRevocationStore()
+
+	token, err := generateToken("someID", username, "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := generateToken("someID", username, "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logout := authMiddleware(handleLogout(userService{}))
+	protected := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(handler http.Handler, token string) int {
+		req := httptest.NewRequest("POST", "/logout", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := request(logout, token); code != http.StatusNoContent {
+		t.Fatalf("Expected a 204 status code response but got: %d", code)
+	}
+	if code := request(protected, token); code != http.StatusUnauthorized {
+		t.Errorf("Expected a logged out token to be refused but got: %d", code)
+	}
+
+	// Other tokens of the same user, even from the same second, still work
+	if code := request(protected, otherToken); code != http.StatusOK {
+		t.Errorf("Expected another token to still work but got: %d", code)
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	defer func(store TokenRevocationStore) { revokedTokens = store }(revokedTokens)
+	revokedTokens = newMemoryRevocationStore()
+
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "logout@test.com", FirstName: "logout", LastName: "user", Password: password, Role: "student", Username: "logoutUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	session, err := svc.Login(context.Background(), "logoutUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSession, err := svc.Login(context.Background(), "logoutUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logout := func(body string) int {
+		req := httptest.NewRequest("POST", "/users/logout", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+string(session.Token))
+		rec := httptest.NewRecorder()
+		authMiddleware(handleLogout(svc)).ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := logout(`{"refresh_token": "not a token"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a malformed refresh token to get a 400 but got: %d", code)
+	}
+	if code := logout(`{"refresh_token": "` + session.RefreshToken + `"}`); code != http.StatusNoContent {
+		t.Fatalf("Expected a 204 status code response but got: %d", code)
+	}
+
+	if _, err := svc.RefreshToken(context.Background(), session.RefreshToken, ""); err != errInvalidRefreshToken {
+		t.Errorf("Expected the refresh token of the logged out session to be revoked but got: %v", err)
+	}
+	if _, err := svc.RefreshToken(context.Background(), otherSession.RefreshToken, ""); err != nil {
+		t.Errorf("Expected the other session to still refresh but got: %v", err)
+	}
+}
+
+func TestRevokeSessionsHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "revokesessions@test.com", FirstName: "revoke", LastName: "sessions", Password: password, Role: "student", Username: "revokeSessionsUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	session, err := svc.Login(context.Background(), "revokeSessionsUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSession, err := svc.Login(context.Background(), "revokeSessionsUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle(RevokeSessionsPath, authMiddleware(requireSelfOrRoles(handleRevokeSessions(svc), "admin"))).Methods("POST")
+
+	revoke := func(id, token string) int {
+		req := httptest.NewRequest("POST", "/users/"+id+"/sessions/revoke", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	otherToken, err := generateToken("someOtherID", "someone", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := revoke(user.ID, otherToken); code != http.StatusForbidden {
+		t.Errorf("Expected another user to get a 403 but got: %d", code)
+	}
+
+	if code := revoke(user.ID, string(session.Token)); code != http.StatusNoContent {
+		t.Fatalf("Expected a 204 status code response but got: %d", code)
+	}
+	for _, refreshToken := range []string{session.RefreshToken, otherSession.RefreshToken} {
+		if _, err := svc.RefreshToken(context.Background(), refreshToken, ""); err != errInvalidRefreshToken {
+			t.Errorf("Expected every session to be revoked but got: %v", err)
+		}
+	}
+}
+
+func TestReissueIDHTTPEndpoint(t *testing.T) {
+	defer func(store TokenRevocationStore) { revokedTokens = store }(revokedTokens)
+	revokedTokens = newMemoryRevocationStore()
+	defer func(sink AuditLogSink) { auditLog = sink }(auditLog)
+	events := &memoryAuditLog{}
+	auditLog = events
+
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "reissue@test.com", FirstName: "reissue", LastName: "user", Password: password, Role: "student", Username: "reissueUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.Login(context.Background(), "reissueUser", "wrongPassword", ""); err != errInvalidCredentials {
+		t.Fatalf("Expected the failed login to be refused but got: %v", err)
+	}
+	session, err := svc.Login(context.Background(), "reissueUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := svc.CreateGroup(context.Background(), "Reissued", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.DeleteGroup(context.Background(), group.ID)
+	if err := svc.AddGroupMember(context.Background(), group.ID, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.CreateAPIKey(context.Background(), user.ID, "reissued", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	mgoSession, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgoSession.Close()
+	if err := issueEmailVerification(mgoSession, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := (mongoAuditLog{}).Record(&model.AuditEvent{ID: bson.NewObjectId().Hex(), UserID: user.ID, Action: auditActionLogin, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	adminToken, err := generateToken("adminID", "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle(ReissueIDPath, adminMiddleware(handleReissueID(svc))).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/users/%s/reissue-id", server.URL, user.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.GetUserResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	newID := payload.User.ID
+	defer svc.Remove(context.Background(), newID)
+	defer func() {
+		for _, name := range []string{"api_keys", "sessions", "email_verifications"} {
+			mgoSession.DB("buzz-test-user").C(name).RemoveAll(bson.M{"user_id": newID})
+		}
+		mgoSession.DB("buzz-test-user").C("audit_log").RemoveAll(bson.M{"user_id": user.ID})
+	}()
+
+	if newID == "" || newID == user.ID || payload.User.Username != "reissueUser" {
+		t.Fatalf("Expected the user under a new id but got: %+v", payload.User)
+	}
+	if _, err := svc.GetByID(context.Background(), user.ID); err != errUserNotFound {
+		t.Errorf("Expected the old id to be gone but got: %v", err)
+	}
+
+	// The login history follows the user
+	attempts, err := svc.GetLoginAttempts(context.Background(), newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Errorf("Expected both login attempts under the new id but got: %d", len(attempts))
+	}
+
+	// So does everything else kept by user id
+	if groups, err := svc.ListUserGroups(context.Background(), newID); err != nil || len(groups) != 1 {
+		t.Errorf("Expected the group membership under the new id but got: %v %v", groups, err)
+	}
+	if keys, err := svc.ListAPIKeys(context.Background(), newID); err != nil || len(keys) != 1 {
+		t.Errorf("Expected the API key under the new id but got: %v %v", keys, err)
+	}
+	if sessions, err := svc.ListSessions(context.Background(), newID); err != nil || len(sessions) != 1 {
+		t.Errorf("Expected the session under the new id but got: %v %v", sessions, err)
+	}
+	for _, name := range []string{"group_members", "api_keys", "sessions", "email_verifications"} {
+		if count, err := mgoSession.DB("buzz-test-user").C(name).Find(bson.M{"user_id": user.ID}).Count(); err != nil || count != 0 {
+			t.Errorf("Expected nothing in %s under the old id but got: %d %v", name, count, err)
+		}
+	}
+	if count, err := mgoSession.DB("buzz-test-user").C("email_verifications").Find(bson.M{"user_id": newID}).Count(); err != nil || count != 1 {
+		t.Errorf("Expected the email verification under the new id but got: %d %v", count, err)
+	}
+
+	// The audit log stays as it happened, with the reissue linking the ids
+	if past, _, err := (mongoAuditLog{}).Events(user.ID, model.ListOptions{}); err != nil || len(past) != 1 {
+		t.Errorf("Expected the audit event to stay under the old id but got: %v %v", past, err)
+	}
+	if len(events.events) != 1 || events.events[0].UserID != newID || events.events[0].Action != auditActionReissue || events.events[0].Detail != "reissued from "+user.ID {
+		t.Errorf("Expected the reissue to be audited under the new id but got: %+v", events.events)
+	}
+
+	// Tokens for the old id stop working
+	protected := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	oldReq := httptest.NewRequest("GET", "/users/"+user.ID, nil)
+	oldReq.Header.Set("Authorization", "Bearer "+string(session.Token))
+	protected.ServeHTTP(rec, oldReq)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a token for the old id to be refused but got: %d", rec.Code)
+	}
+	if _, err := svc.RefreshToken(context.Background(), session.RefreshToken, ""); err != errInvalidRefreshToken {
+		t.Errorf("Expected refresh tokens for the old id to be revoked but got: %v", err)
+	}
+}
+
+// recordingChallengeSender keeps the last code it was asked to send
+type recordingChallengeSender struct {
+	code string
+}
+
+func (s *recordingChallengeSender) SendChallenge(user *model.User, code string) error {
+	s.code = code
+	return nil
+}
+
+func TestChallengeHTTPEndpoints(t *testing.T) {
+	defer func(sender ChallengeSender, ttl time.Duration) {
+		challengeSender, challengeTTL = sender, ttl
+	}(challengeSender, challengeTTL)
+	sender := &recordingChallengeSender{}
+	challengeSender = sender
+
+	svc := userService{}
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "challenge@test.com", FirstName: "challenge", LastName: "user", Password: password, Role: "student", Username: "challengeUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	router := mux.NewRouter()
+	router.Handle("/users/{id}/challenge", handleCreateChallenge(svc))
+	router.Handle("/users/{id}/challenge/verify", handleVerifyChallenge(svc))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	challenge := func() int {
+		resp, err := http.Post(fmt.Sprintf("%s/users/%s/challenge", server.URL, user.ID), "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	verify := func(code string) (*http.Response, *reqres.VerifyChallengeResponse) {
+		resp, err := http.Post(fmt.Sprintf("%s/users/%s/challenge/verify", server.URL, user.ID), "application/json", strings.NewReader(`{"code": "`+code+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload = &reqres.VerifyChallengeResponse{}
+		json.NewDecoder(resp.Body).Decode(&payload)
+		return resp, payload
+	}
+	wrongCode := func() string {
+		if sender.code == "000000" {
+			return "000001"
+		}
+		return "000000"
+	}
+
+	// A wrong code is refused, the right one proves ownership once
+	if code := challenge(); code != http.StatusAccepted {
+		t.Fatalf("Expected a 202 status code response but got: %d", code)
+	}
+	if resp, _ := verify(wrongCode()); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a wrong code to be refused but got: %d", resp.StatusCode)
+	}
+	resp, payload := verify(sender.code)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	if err := verifyProofToken(payload.ProofToken, user.ID); err != nil {
+		t.Errorf("Expected a proof token for the user but got: %v", err)
+	}
+	if resp, _ := verify(sender.code); resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected a used code to be refused but got: %d", resp.StatusCode)
+	}
+
+	// Too many wrong codes void the challenge
+	challenge()
+	for i := 0; i < challengeMaxAttempts; i++ {
+		verify(wrongCode())
+	}
+	if resp, _ := verify(sender.code); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 status code response but got: %d", resp.StatusCode)
+	}
+
+	// Codes expire
+	challengeTTL = -time.Second
+	challenge()
+	if resp, _ := verify(sender.code); resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected an expired code to be refused but got: %d", resp.StatusCode)
+	}
+}
+
+// setUp gives the test database the indexes of the migrations, which the
+// tests needing a database count on
+func setUp() {
+	session, err := getSession()
+	if err != nil {
+		// the tests needing a database report it themselves
+		return
+	}
+	defer session.Close()
+
+	migrations, err := builtinMigrations()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := migrateUp(session.DB("buzz-test-user"), migrations, latestVersion(migrations)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func tearDown() {
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	//remove our applications from the collection
+	err = collection.Remove(bson.M{"username": username})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//remove the login attempts we made
+	_, err = db.C("login_attempts").RemoveAll(bson.M{"user_id": userID})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func getUserID(t *testing.T, res *http.Response) {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		t.Fatalf("Unable to create the test user: %d", res.StatusCode)
+	}
+
+	var payload = &reqres.CreateUserResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&payload); err != nil || payload.User == nil {
+		t.Fatal("Error decoding json response")
+	}
+
+	userID = payload.User.ID
+}
+
+func getToken(t *testing.T, res *http.Response) {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		t.Fatalf("Unable to log in the test user: %d", res.StatusCode)
+	}
+
+	var payload = &reqres.LoginResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&payload); err != nil {
+		t.Fatal("Error decoding json response")
+	}
+
+	token = payload.Token
+	refreshToken = payload.RefreshToken
+}
+
+func TestDeleteUserHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "delete@test.com", FirstName: "delete", LastName: "user", Password: password, Role: "student", Username: "deleteUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	router := mux.NewRouter()
+	router.Handle("/users/{id}", adminMiddleware(handleDeleteUser(svc)))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	remove := func(id, asID, role string) *http.Response {
+		token, err := generateToken(asID, "deleteUser", role, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/users/%s", server.URL, id), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Only admins can delete users, even their own
+	if resp := remove(user.ID, user.ID, "student"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 status code response but got: %d", resp.StatusCode)
+	}
+
+	resp := remove(user.ID, "adminID", "admin")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected a 204 status code response but got: %d", resp.StatusCode)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); len(body) != 0 {
+		t.Errorf("Expected an empty body but got: %s", body)
+	}
+
+	// The user is gone for lookups and logins
+	if _, err := svc.GetByID(context.Background(), user.ID); err != errUserNotFound {
+		t.Errorf("Expected a soft-deleted user not to be found but got: %v", err)
+	}
+	if _, err := svc.Login(context.Background(), "deleteUser", password, ""); err == nil {
+		t.Error("Expected a soft-deleted user not to be able to log in")
+	}
+
+	// Deleting again or deleting an unknown user is a 404
+	if resp := remove(user.ID, user.ID, "admin"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response but got: %d", resp.StatusCode)
+	}
+	if resp := remove("unknownID", "unknownID", "admin"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response but got: %d", resp.StatusCode)
+	}
+}
+
+// dryRunUserService finds users but fails the test on any change to them
+type dryRunUserService struct {
+	UserService
+	t     *testing.T
+	users map[string]*model.User
+}
+
+func (svc dryRunUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	if user, ok := svc.users[id]; ok && user.DeletedAt == nil {
+		return user, nil
+	}
+	return nil, errUserNotFound
+}
+
+func (svc dryRunUserService) GetByIDIncludingDeleted(ctx context.Context, id string) (*model.User, error) {
+	if user, ok := svc.users[id]; ok {
+		return user, nil
+	}
+	return nil, errUserNotFound
+}
+
+func (svc dryRunUserService) Delete(ctx context.Context, id string) error {
+	svc.t.Errorf("Expected a dry run not to delete user %s", id)
+	return nil
+}
+
+func (svc dryRunUserService) EraseUser(ctx context.Context, id string) error {
+	svc.t.Errorf("Expected a dry run not to erase user %s", id)
+	return nil
+}
+
+func TestDeleteAndEraseDryRun(t *testing.T) {
+	events := &memoryAuditLog{}
+	auditLog = events
+	defer func() { auditLog = nil }()
+
+	deletedAt := time.Now()
+	svc := dryRunUserService{t: t, users: map[string]*model.User{
+		"1": {ID: "1"},
+		"2": {ID: "2", DeletedAt: &deletedAt},
+	}}
+	router := mux.NewRouter()
+	router.Handle(DeleteUserPath, handleDeleteUser(svc)).Methods("DELETE")
+	router.Handle(EraseUserPath, handleEraseUser(svc)).Methods("POST")
+
+	dryRun := func(method, path string) (int, *reqres.DryRunResponse) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		var payload = &reqres.DryRunResponse{}
+		json.NewDecoder(rec.Body).Decode(&payload)
+		return rec.Code, payload
+	}
+
+	// The user that would be affected is reported, and nothing is changed
+	status, payload := dryRun("DELETE", "/users/1?dry_run=true")
+	if status != http.StatusOK || !payload.DryRun || payload.Action != "delete" || payload.Count != 1 || len(payload.UserIDs) != 1 || payload.UserIDs[0] != "1" {
+		t.Errorf("Expected a dry run deleting user 1 but got: %d %+v", status, payload)
+	}
+	status, payload = dryRun("POST", "/users/2/erase?dry_run=true")
+	if status != http.StatusOK || payload.Action != "erase" || payload.Count != 1 || payload.UserIDs[0] != "2" {
+		t.Errorf("Expected a dry run erasing deleted user 2 but got: %d %+v", status, payload)
+	}
+	if len(events.events) != 0 {
+		t.Errorf("Expected dry runs not to be audited but got: %+v", events.events)
+	}
+
+	// Users that couldn't be deleted or erased are still a 404
+	if status, _ := dryRun("DELETE", "/users/2?dry_run=true"); status != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response but got: %d", status)
+	}
+	if status, _ := dryRun("POST", "/users/3/erase?dry_run=true"); status != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response but got: %d", status)
+	}
+	if status, _ := dryRun("DELETE", "/users/1?dry_run=maybe"); status != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", status)
+	}
+}
+
+func TestReactivateUserHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "reactivate@test.com", FirstName: "reactivate", LastName: "user", Password: password, Role: "student", Username: "reactivateUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+	if err := svc.Delete(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/users/{id}", authMiddleware(requireSelfOrRoles(handleGetUserByID(svc), "admin"))).Methods("GET")
+	router.Handle("/users/{id}/reactivate", adminMiddleware(handleReactivateUser(svc))).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	do := func(method, path, asID, role string) *http.Response {
+		token, err := generateToken(asID, "reactivateUser", role, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Only admins see the deleted user
+	if resp := do("GET", "/users/"+user.ID, user.ID, "student"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response but got: %d", resp.StatusCode)
+	}
+	resp := do("GET", "/users/"+user.ID, "adminID", "admin")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	var payload = &reqres.GetUserResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.User.Status != statusDeleted {
+		t.Errorf("Expected the user to be deleted but got: %q", payload.User.Status)
+	}
+
+	// Only admins can reactivate users
+	if resp := do("POST", "/users/"+user.ID+"/reactivate", user.ID, "student"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 status code response but got: %d", resp.StatusCode)
+	}
+	if resp := do("POST", "/users/"+user.ID+"/reactivate", "adminID", "admin"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	if _, err := svc.Login(context.Background(), "reactivateUser", password, ""); err != nil {
+		t.Errorf("Expected a reactivated user to be able to log in but got: %v", err)
+	}
+
+	// Users that aren't deleted can't be reactivated
+	if resp := do("POST", "/users/"+user.ID+"/reactivate", "adminID", "admin"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a 409 status code response but got: %d", resp.StatusCode)
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	u, _ := url.Parse("/users?page=2&per_page=10&role=student")
+	next, prev := pageLinks(u, model.ListOptions{Offset: 10, Limit: 10}, 35)
+	if next != "/users?page=3&per_page=10&role=student" || prev != "/users?page=1&per_page=10&role=student" {
+		t.Errorf("Expected links to the pages around page 2 but got: %q %q", next, prev)
+	}
+
+	u, _ = url.Parse("/users?offset=5&limit=10")
+	next, prev = pageLinks(u, model.ListOptions{Offset: 5, Limit: 10}, 15)
+	if next != "" || prev != "/users?limit=10&offset=0" {
+		t.Errorf("Expected only a link to the start but got: %q %q", next, prev)
+	}
+
+	u, _ = url.Parse("/users")
+	if next, prev = pageLinks(u, model.ListOptions{Limit: 10}, 5); next != "" || prev != "" {
+		t.Errorf("Expected no links for a single page but got: %q %q", next, prev)
+	}
+}
+
+func TestListUsersHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	for i := 0; i < 3; i++ {
+		user, err := svc.Create(context.Background(), &model.CreateUser{Email: fmt.Sprintf("list%d@test.com", i), FirstName: "list", LastName: "user", Password: password, Role: "student", Username: fmt.Sprintf("listUser%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer svc.Remove(context.Background(), user.ID)
+	}
+	admin, err := svc.Create(withCreator(context.Background(), creatorAdmin), &model.CreateUser{Email: "listadmin@test.com", FirstName: "list", LastName: "admin", Password: password, Role: "admin", Username: "listAdmin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), admin.ID)
+
+	server := httptest.NewServer(handleListUsers(svc))
+	defer server.Close()
+
+	list := func(query string) (*http.Response, *reqres.ListUsersResponse) {
+		resp, err := http.Get(server.URL + "/users?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload = &reqres.ListUsersResponse{}
+		json.NewDecoder(resp.Body).Decode(&payload)
+		return resp, payload
+	}
+
+	resp, payload := list("role=student&limit=2")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	if len(payload.Users) != 2 || payload.Limit != 2 || payload.Total < 3 {
+		t.Errorf("Expected a page of 2 out of at least 3 students but got: %+v", payload)
+	}
+	for _, user := range payload.Users {
+		if user.Role != "student" {
+			t.Errorf("Expected only students but got: %s", user.Role)
+		}
+	}
+
+	// Pages don't overlap
+	_, next := list("role=student&page=2&per_page=2")
+	for _, user := range next.Users {
+		for _, previous := range payload.Users {
+			if user.ID == previous.ID {
+				t.Errorf("Expected %s not to be on both pages", user.ID)
+			}
+		}
+	}
+
+	if resp, _ := list("limit=-1"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", resp.StatusCode)
+	}
+}
+
+// partialListUserService lists users with err, and the page and total it got
+// regardless
+type partialListUserService struct {
+	UserService
+	users []model.User
+	total int
+	err   error
+}
+
+func (svc partialListUserService) List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	return svc.users, svc.total, svc.err
+}
+
+func TestListUsersWithWarnings(t *testing.T) {
+	list := func(svc UserService) (int, *reqres.ListUsersResponse) {
+		rec := httptest.NewRecorder()
+		handleListUsers(svc).ServeHTTP(rec, httptest.NewRequest("GET", "/users?limit=2", nil))
+		var payload = &reqres.ListUsersResponse{}
+		json.NewDecoder(rec.Body).Decode(&payload)
+		return rec.Code, payload
+	}
+
+	// A count failing still returns the page, paging on while pages are full
+	users := []model.User{{ID: "1"}, {ID: "2"}}
+	status, payload := list(partialListUserService{users: users, err: partialListError{warning: warnTotalUnavailable, err: errors.New("count timed out")}})
+	if status != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", status)
+	}
+	if len(payload.Users) != 2 || payload.Total != 2 || payload.Next == "" {
+		t.Errorf("Expected the page and a link to the next but got: %+v", payload)
+	}
+	if len(payload.Warnings) != 1 || payload.Warnings[0] != warnTotalUnavailable {
+		t.Errorf("Expected a warning the total is unavailable but got: %v", payload.Warnings)
+	}
+
+	// The page failing still returns the total
+	status, payload = list(partialListUserService{users: []model.User{}, total: 5, err: partialListError{warning: warnPageUnavailable, err: errors.New("page timed out")}})
+	if status != http.StatusOK || payload.Total != 5 || len(payload.Users) != 0 || len(payload.Warnings) != 1 || payload.Warnings[0] != warnPageUnavailable {
+		t.Errorf("Expected the total with a warning the page is unavailable but got: %d %+v", status, payload)
+	}
+
+	// Only both failing fails the list
+	if status, _ := list(partialListUserService{err: errors.New("no reachable servers")}); status != http.StatusInternalServerError {
+		t.Errorf("Expected a 500 status code response but got: %d", status)
+	}
+}
+
+// capturingResetSender remembers the last password reset token it was asked
+// to deliver
+type capturingResetSender struct {
+	token string
+}
+
+func (s *capturingResetSender) SendPasswordReset(user *model.User, token string) error {
+	s.token = token
+	return nil
+}
+
+func TestPasswordResetHTTPEndpoints(t *testing.T) {
+	svc := userService{}
+	sender := &capturingResetSender{}
+	passwordResetSender = sender
+	defer func() { passwordResetSender = nil }()
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "reset@test.com", FirstName: "reset", LastName: "user", Password: password, Role: "student", Username: "resetUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	session, err := svc.Login(context.Background(), "resetUser", password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestServer := httptest.NewServer(handleRequestPasswordReset(svc))
+	defer requestServer.Close()
+	confirmServer := httptest.NewServer(handleConfirmPasswordReset(svc))
+	defer confirmServer.Close()
+
+	// Unknown emails get the same response
+	for _, email := range []string{"nobody@test.com", "Reset@Test.com"} {
+		resp, err := http.Post(requestServer.URL, "application/json", strings.NewReader(`{"email": "`+email+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected a 200 status code response for %s but got: %d", email, resp.StatusCode)
+		}
+	}
+	if sender.token == "" {
+		t.Fatal("Expected a reset token to be sent")
+	}
+
+	confirm := func(token, newPassword string) *http.Response {
+		body, _ := json.Marshal(reqres.ConfirmPasswordResetRequest{Token: token, NewPassword: newPassword})
+		resp, err := http.Post(confirmServer.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := confirm("not a token", "correct horse battery"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown token to be refused but got: %d", resp.StatusCode)
+	}
+
+	// A refused password doesn't use the token up
+	if resp := confirm(sender.token, "resetUser123"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a password containing the username to be refused but got: %d", resp.StatusCode)
+	}
+	if resp := confirm(sender.token, "correct horse battery"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	if _, err := svc.Login(context.Background(), "resetUser", "correct horse battery", ""); err != nil {
+		t.Errorf("Expected the new password to work but got: %v", err)
+	}
+	if _, err := svc.RefreshToken(context.Background(), session.RefreshToken, ""); err != errInvalidRefreshToken {
+		t.Errorf("Expected the existing sessions to be revoked but got: %v", err)
+	}
+
+	// Tokens are single use
+	if resp := confirm(sender.token, "another horse battery"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a used token to be refused but got: %d", resp.StatusCode)
+	}
+}
+
+func TestInvalidateResetTokensHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+	sender := &capturingResetSender{}
+	passwordResetSender = sender
+	defer func() { passwordResetSender = nil }()
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "invalidate@test.com", FirstName: "invalidate", LastName: "user", Password: password, Role: "student", Username: "invalidateUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	if err := svc.CreatePasswordReset(context.Background(), "invalidate@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	if sender.token == "" {
+		t.Fatal("Expected a reset token to be sent")
+	}
+
+	events := &memoryAuditLog{}
+	auditLog = events
+	defer func() { auditLog = nil }()
+
+	router := mux.NewRouter()
+	router.Handle(ResetTokensPath, handleInvalidateResetTokens(svc)).Methods("POST")
+	invalidate := func(id string) (int, reqres.InvalidateResetTokensResponse) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/users/"+id+"/invalidate-reset-tokens", nil))
+		var payload reqres.InvalidateResetTokensResponse
+		json.NewDecoder(rec.Body).Decode(&payload)
+		return rec.Code, payload
+	}
+
+	if code, payload := invalidate(user.ID); code != http.StatusOK || payload.Invalidated != 1 {
+		t.Fatalf("Expected the reset token to be invalidated but got: %d %+v", code, payload)
+	}
+	if len(events.events) != 1 || events.events[0].UserID != user.ID || events.events[0].Action != auditActionResetsRevoke {
+		t.Errorf("Expected the invalidation to be audited but got: %+v", events.events)
+	}
+
+	// The token sent before doesn't work anymore
+	if _, err := svc.ResetPassword(context.Background(), sender.token, "correct horse battery"); err != errInvalidResetToken {
+		t.Errorf("Expected the invalidated reset token to be refused but got: %v", err)
+	}
+
+	// Invalidating again is fine, there's just nothing left
+	if code, payload := invalidate(user.ID); code != http.StatusOK || payload.Invalidated != 0 {
+		t.Errorf("Expected invalidating again to succeed with nothing invalidated but got: %d %+v", code, payload)
+	}
+	if code, _ := invalidate("unknownID"); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown user to get a 404 but got: %d", code)
+	}
+}
+
+func TestLookupUserHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "Lookup@Test.com", FirstName: "lookup", LastName: "user", Password: password, Role: "student", Username: "lookupUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	server := httptest.NewServer(handleListUsers(svc))
+	defer server.Close()
+
+	lookup := func(query string) (*http.Response, map[string]interface{}) {
+		resp, err := http.Get(server.URL + "/users?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&payload)
+		return resp, payload
+	}
+
+	for _, query := range []string{"username=lookupUser", "email=lookup@test.com"} {
+		resp, payload := lookup(query)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected a 200 status code response for %q but got: %d", query, resp.StatusCode)
+		}
+		found, _ := payload["user"].(map[string]interface{})
+		if found["id"] != user.ID {
+			t.Errorf("Expected %q to find the user but got: %v", query, payload)
+		}
+		if _, ok := found["password"]; ok {
+			t.Errorf("Expected %q not to return the password hash", query)
+		}
+	}
+
+	if resp, _ := lookup("email=nobody@test.com"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response but got: %d", resp.StatusCode)
+	}
+	if resp, _ := lookup("username="); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", resp.StatusCode)
+	}
+
+	// Deleted users can't be looked up
+	if err := svc.Delete(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := lookup("username=lookupUser"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a deleted user not to be found but got: %d", resp.StatusCode)
+	}
+}
+
+func TestSearchUsersHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "search@test.com", FirstName: "searchable", LastName: "user", Password: password, Role: "student", Username: "searchUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+	if err := svc.Delete(context.Background(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/admin/users/search", handleSearchUsers(svc))
+	router.Handle("/users/{id}", handleGetUserByID(svc))
+	router.Handle("/users", handleListUsers(svc))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// Admins find soft-deleted users, labelled as such
+	resp, err := http.Get(server.URL + "/admin/users/search?q=SEARCHABLE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	var payload = &reqres.ListUsersResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, result := range payload.Users {
+		if result.ID == user.ID {
+			found = true
+			if result.Status != statusDeleted {
+				t.Errorf("Expected the user to be labelled %s but got: %s", statusDeleted, result.Status)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected the search to find the deleted user but got: %v", payload.Users)
+	}
+
+	// The public endpoints don't
+	resp, err = http.Get(server.URL + "/users/" + user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("Expected the deleted user not to be found")
+	}
+
+	resp, err = http.Get(server.URL + "/users?limit=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list = &reqres.ListUsersResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	for _, listed := range list.Users {
+		if listed.ID == user.ID {
+			t.Errorf("Expected the deleted user not to be listed")
+		}
+	}
+
+	resp, err = http.Get(server.URL + "/admin/users/search?q=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", resp.StatusCode)
+	}
+}
+
+func TestDeactivateInactiveHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	create := func(username string) *model.User {
+		user, err := svc.Create(context.Background(), &model.CreateUser{Email: username + "@test.com", FirstName: "inactive", LastName: "user", Password: password, Role: "student", Username: username})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	stale, recent, newcomer := create("staleUser"), create("recentUser"), create("newcomerUser")
+	for _, user := range []*model.User{stale, recent, newcomer} {
+		defer svc.Remove(context.Background(), user.ID)
+	}
+
+	session, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	collection := session.DB("buzz-test-user").C("users")
+	if err := collection.UpdateId(stale.ID, bson.M{"$set": bson.M{"last_login_at": time.Now().AddDate(-2, 0, 0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.UpdateId(recent.ID, bson.M{"$set": bson.M{"last_login_at": time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handleDeactivateInactive(svc))
+	defer server.Close()
+	cutoff := url.QueryEscape(time.Now().AddDate(-1, 0, 0).Format(time.RFC3339))
+
+	deactivate := func(query string) *reqres.DeactivateInactiveResponse {
+		resp, err := http.Post(server.URL+"/admin/users/deactivate-inactive?"+query, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+		}
+		var payload = &reqres.DeactivateInactiveResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload
+	}
+	status := func(user *model.User) string {
+		found, err := userRepository.GetByID(context.Background(), user.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return accountStatus(found.Status)
+	}
+
+	// Dry runs only count
+	if payload := deactivate("inactive_since=" + cutoff + "&dry_run=true"); payload.Count < 1 || !payload.DryRun {
+		t.Errorf("Expected the dry run to count the stale user but got: %+v", payload)
+	}
+	if status(stale) != statusActive {
+		t.Errorf("Expected a dry run to leave users active")
+	}
+
+	if payload := deactivate("inactive_since=" + cutoff); payload.Count < 1 || payload.DryRun {
+		t.Errorf("Expected the stale user to be deactivated but got: %+v", payload)
+	}
+	if status(stale) != statusDeactivated {
+		t.Errorf("Expected the user past the cutoff to be deactivated but got: %s", status(stale))
+	}
+	for _, user := range []*model.User{recent, newcomer} {
+		if status(user) != statusActive {
+			t.Errorf("Expected %s to stay active but got: %s", user.Username, status(user))
+		}
+	}
+}
+
+func TestGetStatsHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+
+	server := httptest.NewServer(handleGetStats(svc))
+	defer server.Close()
+
+	getStats := func() *model.UserStats {
+		resp, err := http.Get(server.URL + "/admin/stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+		}
+		var payload = &reqres.GetStatsResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload.Stats
+	}
+
+	before := getStats()
+
+	active, err := svc.Create(context.Background(), &model.CreateUser{Email: "statsactive@test.com", FirstName: "stats", LastName: "active", Password: password, Role: "student", Username: "statsActiveUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), active.ID)
+	deactivated, err := svc.Create(context.Background(), &model.CreateUser{Email: "statsdeactivated@test.com", FirstName: "stats", LastName: "deactivated", Password: password, Role: "student", Username: "statsDeactivatedUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), deactivated.ID)
+	if _, err := svc.SetStatus(context.Background(), deactivated.ID, statusDeactivated); err != nil {
+		t.Fatal(err)
+	}
+	svc.Login(context.Background(), "statsActiveUser", password, "")
+	svc.Login(context.Background(), "statsActiveUser", "wrongPassword", "")
+
+	after := getStats()
+	deltas := []struct {
+		name  string
+		delta int
+		want  int
+	}{
+		{"total users", after.TotalUsers - before.TotalUsers, 2},
+		{"active users", after.ActiveUsers - before.ActiveUsers, 1},
+		{"deactivated users", after.DeactivatedUsers - before.DeactivatedUsers, 1},
+		{"signups in the last day", after.SignupsLastDay - before.SignupsLastDay, 2},
+		{"signups in the last month", after.SignupsLastMonth - before.SignupsLastMonth, 2},
+		{"login successes", after.LoginSuccesses - before.LoginSuccesses, 1},
+		{"login failures", after.LoginFailures - before.LoginFailures, 1},
+	}
+	for _, d := range deltas {
+		if d.delta != d.want {
+			t.Errorf("Expected %d more %s but got: %d", d.want, d.name, d.delta)
+		}
+	}
+	if after.LoginSuccessRate+after.LoginFailureRate < 0.99 {
+		t.Errorf("Expected the login rates to add up but got: %v %v", after.LoginSuccessRate, after.LoginFailureRate)
+	}
+}
+
+func TestCloseAccountHTTPEndpoints(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "close@test.com", FirstName: "close", LastName: "user", Password: password, Role: "student", Username: "closeUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	token, err := generateToken(user.ID, "closeUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closeServer := httptest.NewServer(authMiddleware(handleCloseAccount(svc)))
+	defer closeServer.Close()
+	cancelServer := httptest.NewServer(handleCancelClose(svc))
+	defer cancelServer.Close()
+
+	closeAccount := func() *http.Response {
+		req, _ := http.NewRequest("POST", closeServer.URL+"/me/close-account", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	cancelClose := func(pw string) *http.Response {
+		resp, err := http.Post(cancelServer.URL+"/me/cancel-close", "application/json", strings.NewReader(`{"username": "closeUser", "password": "`+pw+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Closing deactivates the account until the end of the grace period
+	resp := closeAccount()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	var payload = &reqres.GetUserResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.User.Status != statusDeactivated || payload.User.PurgeAt == nil {
+		t.Fatalf("Expected a deactivated account with a purge date but got: %+v", payload.User)
+	}
+	if payload.User.PurgeAt.Before(time.Now().Add(accountCloseGrace - time.Minute)) {
+		t.Errorf("Expected the purge to wait for the grace period but got: %v", payload.User.PurgeAt)
+	}
+	if _, err := svc.Login(context.Background(), "closeUser", password, ""); err == nil {
+		t.Error("Expected a closed account not to be able to log in")
+	}
+	if resp := closeAccount(); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected closing twice to be a conflict but got: %d", resp.StatusCode)
+	}
+
+	// Cancelling needs the password and reopens the account
+	if resp := cancelClose("wrong password"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", resp.StatusCode)
+	}
+	if resp := cancelClose(password); resp.StatusCode != 200 {
+		t.Errorf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	if _, err := svc.Login(context.Background(), "closeUser", password, ""); err != nil {
+		t.Errorf("Expected a reopened account to be able to log in but got: %v", err)
+	}
+	if resp := cancelClose(password); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected cancelling without a pending close to be a conflict but got: %d", resp.StatusCode)
+	}
+
+	// Purges leave accounts in their grace period alone
+	if resp := closeAccount(); resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+	if _, err := svc.PurgeClosedAccounts(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.GetByID(context.Background(), user.ID); err != nil {
+		t.Errorf("Expected the account to survive its grace period but got: %v", err)
+	}
+
+	// And purge them once it's over
+	purged, err := svc.PurgeClosedAccounts(context.Background(), time.Now().Add(accountCloseGrace+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) < 1 || purged[len(purged)-1] != user.ID {
+		t.Errorf("Expected the account to be purged but got: %v", purged)
+	}
+	if _, err := svc.GetByID(context.Background(), user.ID); err != errUserNotFound {
+		t.Errorf("Expected a purged account not to be found but got: %v", err)
+	}
+	if resp := cancelClose(password); resp.StatusCode == 200 {
+		t.Error("Expected a purged account not to be reopened")
+	}
+}
+
+func TestEncryptedEmails(t *testing.T) {
+	defer func(key string, fields map[string]bool) {
+		PIIEncryptionKey, encryptedFields = key, fields
+	}(PIIEncryptionKey, encryptedFields)
+	PIIEncryptionKey = "test-pii-key"
+	encryptedFields = map[string]bool{piiFieldEmail: true, piiFieldPhone: true}
+
+	svc := userService{}
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "encrypted@test.com", FirstName: "encrypted", LastName: "user", Password: password, Role: "student", Username: "encryptedUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+	if user.Email != "encrypted@test.com" {
+		t.Errorf("Expected the created user to have its plaintext email but got: %s", user.Email)
+	}
+
+	session, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	collection := session.DB("buzz-test-user").C("users")
+
+	// The email is encrypted at rest
+	var stored model.User
+	if err := collection.FindId(user.ID).One(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored.Email, "encrypted@test.com") || stored.EmailIndex == "" {
+		t.Errorf("Expected an encrypted email with a blind index but got: %+v", stored)
+	}
+
+	// And can still be looked up through its blind index
+	var found model.User
+	if err := collection.Find(emailQuery("encrypted@test.com")).One(&found); err != nil || found.ID != user.ID {
+		t.Errorf("Expected to find the user by email but got: %v", err)
+	}
+
+	// Reads decrypt it
+	retrieved, err := svc.GetByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrieved.Email != "encrypted@test.com" {
+		t.Errorf("Expected the decrypted email but got: %s", retrieved.Email)
+	}
+
+	// Phones are encrypted at rest too, and read decrypted
+	phone := "+14155550100"
+	if updated, err := svc.Update(context.Background(), user.ID, &model.UpdateUser{Phone: &phone}); err != nil || updated.Phone != phone {
+		t.Errorf("Expected the phone but got: %+v %v", updated, err)
+	}
+	if err := collection.FindId(user.ID).One(&stored); err != nil || !strings.HasPrefix(stored.Phone, encryptedValuePrefix) {
+		t.Errorf("Expected the phone encrypted but got: %s %v", stored.Phone, err)
+	}
+
+	// Emails stay unique
+	if _, err := svc.Create(context.Background(), &model.CreateUser{Email: "encrypted@test.com", FirstName: "other", LastName: "user", Password: password, Role: "student", Username: "otherEncryptedUser"}); err != errDuplicateEmail {
+		t.Errorf("Expected a duplicate email error but got: %v", err)
+	}
+}
+
+func TestExportAndEraseUserHTTPEndpoint(t *testing.T) {
+	svc := userService{}
+	events := &memoryAuditLog{}
+	auditLog = events
+	defer func() { auditLog = nil }()
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "erase@test.com", FirstName: "erase", LastName: "user", Password: password, Role: "student", Username: "eraseUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+	if _, err := svc.Login(context.Background(), "eraseUser", password, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle(ExportUserPath, handleExportUser(svc)).Methods("GET")
+	router.Handle(EraseUserPath, handleEraseUser(svc)).Methods("POST")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	exportUser := func() *model.UserExport {
+		resp, err := http.Get(fmt.Sprintf("%s/users/%s/export", server.URL, user.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected the export to succeed but got: %d", resp.StatusCode)
+		}
+		var export model.UserExport
+		if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+			t.Fatal(err)
+		}
+		return &export
+	}
+
+	export := exportUser()
+	if export.User.Email != "erase@test.com" || len(export.Sessions) != 1 || len(export.RefreshTokens) != 1 || len(export.LoginAttempts) != 1 {
+		t.Errorf("Expected the profile, session and login of the user but got: %+v", export)
+	}
+	if len(export.AuditEvents) != 1 || export.AuditEvents[0].Action != auditActionExport {
+		t.Errorf("Expected the export to include its own audit event but got: %+v", export.AuditEvents)
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%s/users/%s/erase", server.URL, user.ID), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected erasing the user to succeed but got: %d", resp.StatusCode)
+	}
+
+	// The user stays behind under the same id, without anything personal
+	export = exportUser()
+	if erased := export.User; erased.ID != user.ID || erased.Email != erasedEmail(user.ID) || erased.Username != erasedUsername(user.ID) || erased.FirstName != "" || erased.DeletedAt == nil || erased.ErasedAt == nil {
+		t.Errorf("Expected the user to be anonymized but got: %+v", erased)
+	}
+	if len(export.Sessions) != 0 || len(export.RefreshTokens) != 0 || len(export.LoginAttempts) != 1 {
+		t.Errorf("Expected the sessions to be purged and the logins kept but got: %+v", export)
+	}
+	if _, err := svc.Login(context.Background(), "eraseUser", password, ""); err == nil {
+		t.Error("Expected an erased user not to be able to log in")
+	}
+	if _, err := svc.Reactivate(context.Background(), user.ID); err != errUserErased {
+		t.Errorf("Expected an erased user not to be reactivated but got: %v", err)
+	}
+
+	resp, err = http.Post(fmt.Sprintf("%s/users/unknownID/erase", server.URL), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected erasing an unknown user to be a 404 but got: %d", resp.StatusCode)
+	}
+
+	if len(events.events) != 4 {
+		t.Fatalf("Expected every export and erasure to be recorded but got: %+v", events.events)
+	}
+	for i, action := range []string{auditActionExport, auditActionErase, auditActionExport, auditActionErase} {
+		if events.events[i].Action != action {
+			t.Errorf("Expected %s at %d in the audit log but got: %+v", action, i, events.events[i])
+		}
+	}
+}
+
+// capturingInvitationSender remembers the last invite token it delivered
+type capturingInvitationSender struct {
+	token string
+}
+
+func (s *capturingInvitationSender) SendInvitation(user *model.User, token string) error {
+	s.token = token
+	return nil
+}
+
+func TestInvitationHTTPEndpoints(t *testing.T) {
+	sender := &capturingInvitationSender{}
+	invitationSender = sender
+	defer func() { invitationSender = nil }()
+
+	svc := userService{}
+	ctx := withCreator(context.Background(), creatorAdmin)
+	invitation, err := svc.InviteUser(ctx, &model.CreateUser{Email: "invitee@test.com", FirstName: "invited", LastName: "user", Role: "admin", Username: "inviteeUser"}, "adminID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), invitation.UserID)
+
+	// Invited users can't log in before accepting
+	if _, err := svc.Login(context.Background(), "inviteeUser", password, ""); err == nil {
+		t.Error("Expected an invited user not to be able to log in")
+	}
+
+	// Inviting them again replaces the invite
+	firstToken := sender.token
+	again, err := svc.InviteUser(ctx, &model.CreateUser{Email: "invitee@test.com", Username: "inviteeUser"}, "adminID")
+	if err != nil || again.UserID != invitation.UserID {
+		t.Fatalf("Expected a new invite for the same user but got: %+v, %v", again, err)
+	}
+	if _, err := svc.AcceptInvitation(context.Background(), firstToken, password); err != errInvalidInviteToken {
+		t.Errorf("Expected the replaced invite to be refused but got: %v", err)
+	}
+
+	invitations, total, err := svc.ListInvitations(context.Background(), model.ListOptions{Limit: 10})
+	if err != nil || total != 1 || invitations[0].ID != again.ID {
+		t.Errorf("Expected only the new invite to be pending but got: %+v, %d, %v", invitations, total, err)
+	}
+
+	// Checking the invite doesn't use it up
+	for i := 0; i < 2; i++ {
+		if checked, user, err := svc.CheckInvitation(context.Background(), sender.token); err != nil || checked.ID != again.ID || user.Role != "admin" {
+			t.Errorf("Expected the invite to check out but got: %+v, %+v, %v", checked, user, err)
+		}
+	}
+
+	server := httptest.NewServer(handleAcceptInvitation(svc))
+	defer server.Close()
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"token": "`+sender.token+`", "password": "`+password+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected accepting the invite to succeed but got: %d", resp.StatusCode)
+	}
+
+	result, err := svc.Login(context.Background(), "inviteeUser", password, "")
+	if err != nil {
+		t.Fatalf("Expected the invitee to log in with their password but got: %v", err)
+	}
+	if user, _ := svc.GetByID(context.Background(), result.UserID); user.Role != "admin" {
+		t.Errorf("Expected the invitee to get the role they were invited with but got: %q", user.Role)
+	}
+
+	// Invites are single use
+	if _, err := svc.AcceptInvitation(context.Background(), sender.token, password); err != errInvalidInviteToken {
+		t.Errorf("Expected an accepted invite to be refused but got: %v", err)
+	}
+	if _, _, err := svc.CheckInvitation(context.Background(), sender.token); err != errInvalidInviteToken {
+		t.Errorf("Expected an accepted invite not to check out but got: %v", err)
+	}
+	if _, err := svc.InviteUser(ctx, &model.CreateUser{Email: "invitee@test.com", Username: "inviteeUser"}, "adminID"); err != errDuplicateEmail {
+		t.Errorf("Expected inviting someone who joined to be a duplicate but got: %v", err)
+	}
+}
+
+func TestMeHTTPEndpoints(t *testing.T) {
+	svc := userService{}
+
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "me@test.com", FirstName: "me", LastName: "user", Password: password, Role: "student", Username: "meUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	token, err := generateToken(user.ID, "meUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle(MePath, authMiddleware(handleGetMe(svc))).Methods("GET")
+	router.Handle(MePath, authMiddleware(handleUpdateMe(svc))).Methods("PATCH")
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	me := func(method, body string) *reqres.GetUserResponse {
+		req, _ := http.NewRequest(method, server.URL+MePath, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+		}
+		var payload = &reqres.GetUserResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload
+	}
+
+	// The caller is resolved from their token
+	if payload := me("GET", ""); payload.User.ID != user.ID {
+		t.Errorf("Expected the caller's account but got: %+v", payload.User)
+	}
+
+	// Profile fields are set, and callers can't change their own role
+	payload := me("PATCH", `{"display_name": "Me", "timezone": "America/New_York", "phone": "+14155550100", "role": "admin"}`)
+	if payload.User.DisplayName != "Me" || payload.User.Timezone != "America/New_York" || payload.User.Phone != "+14155550100" || payload.User.FirstName != "me" {
+		t.Errorf("Expected only the profile fields to change but got: %+v", payload.User)
+	}
+	if payload.User.Role != "student" {
+		t.Errorf("Expected the role to be left alone but got: %s", payload.User.Role)
+	}
+
+	// And cleared when empty
+	if payload := me("PATCH", `{"phone": ""}`); payload.User.Phone != "" || payload.User.DisplayName != "Me" {
+		t.Errorf("Expected only the phone to be cleared but got: %+v", payload.User)
+	}
 }
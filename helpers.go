@@ -2,34 +2,36 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
-	lumberjack "gopkg.in/natefinch/lumberjack.v2"
-
 	"gitlab.fg/go/logger"
 )
 
-func getLogger(filepath string) *logger.ServiceLogger {
-	lj := &lumberjack.Logger{
-		Filename:   filepath,
-		MaxSize:    500, // megabytes
-		MaxBackups: 3,
-		MaxAge:     28, //days
-	}
-	mw := io.MultiWriter(os.Stderr, lj)
-	serviceLogger := logger.NewServiceLogger(mw, "app")
+func getLogger(sink LogSink) *logger.ServiceLogger {
+	serviceLogger := logger.NewServiceLogger(sink, "app")
 	log.SetOutput(logger.NewStdlibAdapter(serviceLogger)) // redirect stdlib logging to us
 	log.SetFlags(0)
 	return &serviceLogger
 }
 
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(spec string) []string {
+	list := []string{}
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 // Mechanical stuff
 func interrupt() error {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	return fmt.Errorf("%s", <-c)
 }
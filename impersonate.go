@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// impersonationTTL is how long an admin's token acting as another user is
+// valid for. It can't be refreshed.
+var impersonationTTL = 15 * time.Minute
+
+var (
+	errImpersonateSelf  = errors.New("admins can't impersonate themselves")
+	errImpersonateAdmin = errors.New("admins can't be impersonated")
+)
+
+// generateImpersonationToken returns an access token of user for the admin
+// adminID, who it names in an RFC 8693 act claim. It carries user's role and
+// expires at expiresAt, whatever the role's own lifetime.
+func generateImpersonationToken(user *model.User, adminID, referer string, expiresAt time.Time) (string, error) {
+	token := newSessionToken(user.ID, user.Username, user.Role, referer, "", nil, isVerified(user))
+	token.Claims["exp"] = expiresAt.Unix()
+	token.Claims["act"] = map[string]interface{}{"sub": adminID}
+	return signToken(token)
+}
+
+// impersonatorOf returns who is acting as the subject of claims, empty when
+// they aren't an impersonation token's
+func impersonatorOf(claims map[string]interface{}) string {
+	act, _ := claims["act"].(map[string]interface{})
+	sub, _ := act["sub"].(string)
+	return sub
+}
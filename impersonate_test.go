@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// impersonatedUserService knows the student userID and the admin otherAdminID
+type impersonatedUserService struct {
+	UserService
+}
+
+func (impersonatedUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	switch id {
+	case "userID":
+		return &model.User{ID: id, Username: "student", Role: "student", Status: statusActive}, nil
+	case "otherAdminID":
+		return &model.User{ID: id, Username: "otherAdmin", Role: "admin", Status: statusActive}, nil
+	}
+	return nil, errUserNotFound
+}
+
+func TestImpersonateUser(t *testing.T) {
+	events := &memoryAuditLog{}
+	auditLog = events
+	defer func() { auditLog = nil }()
+
+	adminToken, err := generateToken("adminID", "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.Handle(ImpersonatePath, adminMiddleware(requireTokenLogin(handleImpersonateUser(impersonatedUserService{})))).Methods("POST")
+	impersonate := func(id, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/users/"+id+"/impersonate", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := impersonate("userID", adminToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", rec.Code)
+	}
+	var payload reqres.ImpersonateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(payload.ExpiresAt); until <= 0 || until > impersonationTTL {
+		t.Errorf("Expected the token to expire within %s but got: %s", impersonationTTL, payload.ExpiresAt)
+	}
+
+	// The token acts as the user, naming the admin
+	token, err := parseToken(string(payload.Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Claims["sub"] != "userID" || token.Claims["role"] != "student" || impersonatorOf(token.Claims) != "adminID" {
+		t.Errorf("Expected a student token of userID acted by adminID but got: %v", token.Claims)
+	}
+	if len(events.events) != 1 || events.events[0].Actor != "adminID" || events.events[0].UserID != "userID" || events.events[0].Action != auditActionImpersonate {
+		t.Errorf("Expected the impersonation to be audited but got: %+v", events.events)
+	}
+
+	// and what's done with it is audited under both
+	req := httptest.NewRequest("GET", "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+string(payload.Token))
+	if actor := auditActor(req); actor != "adminID as userID" {
+		t.Errorf("Expected both identities as the actor but got: %q", actor)
+	}
+
+	// Admins can't be impersonated, themselves included, and an impersonation
+	// token carries the user's role rather than the admin's
+	if rec := impersonate("otherAdminID", adminToken); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a 403 impersonating an admin but got: %d", rec.Code)
+	}
+	if rec := impersonate("adminID", adminToken); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 impersonating oneself but got: %d", rec.Code)
+	}
+	if rec := impersonate("missingID", adminToken); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for an unknown user but got: %d", rec.Code)
+	}
+	if rec := impersonate("userID", string(payload.Token)); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a student's impersonation token to be refused but got: %d", rec.Code)
+	}
+}
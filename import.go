@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxImportRows is how many users a single import can create
+const maxImportRows = 10000
+
+// importBatchSize is how many rows of an import are created at once. Jobs
+// report their progress after every batch.
+const importBatchSize = 20
+
+// Outcomes of the rows of an import
+const (
+	importRowCreated = "created"
+	importRowSkipped = "skipped"
+	importRowFailed  = "failed"
+)
+
+// Statuses of imports
+const (
+	importRunning   = "running"
+	importDone      = "done"
+	importCancelled = "cancelled"
+)
+
+// importJobTTL is how long the report of an import run in the background is
+// kept once it's done
+var importJobTTL = time.Hour
+
+var errImportJobNotFound = errors.New("import job not found")
+
+// importColumns are the columns import CSVs can have, named like the fields
+// of a signup
+var importColumns = map[string]bool{
+	"email":                true,
+	"first_name":           true,
+	"last_name":            true,
+	"password":             true,
+	"role":                 true,
+	"username":             true,
+	"date_of_birth":        true,
+	"accepted_tos_version": true,
+}
+
+// importRow is a user to import, which either is created or failed validation
+type importRow struct {
+	row     int
+	payload *reqres.CreateUserRequest
+	err     error
+}
+
+// parseImport reads the users of an import, a CSV when r says so and a JSON
+// array otherwise. Rows are validated like signups, one by one, so a bad row
+// doesn't stop the others.
+func parseImport(r *http.Request) ([]importRow, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		return parseImportCSV(r.Body)
+	}
+	return parseImportJSON(r.Body)
+}
+
+// parseImportCSV reads an import CSV, rows counted by their line
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("Please provide a CSV with a header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !importColumns[name] {
+			return nil, fmt.Errorf("Unknown column %q", name)
+		}
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("Column %q is repeated", name)
+		}
+		columns[name] = i
+	}
+
+	rows := []importRow{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == maxImportRows {
+			return nil, fmt.Errorf("Please provide at most %d rows", maxImportRows)
+		}
+		if len(record) != len(header) {
+			rows = append(rows, importRow{row: line, payload: &reqres.CreateUserRequest{}, err: fieldError("", fmt.Sprintf("Expected %d fields but got %d", len(header), len(record)))})
+			continue
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		payload := &reqres.CreateUserRequest{
+			Email:              field("email"),
+			FirstName:          field("first_name"),
+			LastName:           field("last_name"),
+			Password:           field("password"),
+			Role:               field("role"),
+			Username:           field("username"),
+			DateOfBirth:        field("date_of_birth"),
+			AcceptedTOSVersion: field("accepted_tos_version"),
+		}
+		rows = append(rows, importRow{row: line, payload: payload, err: validateCreateUser(payload, &validation{})})
+	}
+
+	return rows, nil
+}
+
+// parseImportJSON reads a JSON array of signups, rows counted from 1
+func parseImportJSON(r io.Reader) ([]importRow, error) {
+	var payloads []*reqres.CreateUserRequest
+	if err := json.NewDecoder(r).Decode(&payloads); err != nil {
+		return nil, errors.New("Please provide a CSV or a JSON array of users")
+	}
+	if len(payloads) > maxImportRows {
+		return nil, fmt.Errorf("Please provide at most %d rows", maxImportRows)
+	}
+
+	rows := make([]importRow, 0, len(payloads))
+	for i, payload := range payloads {
+		if payload == nil {
+			payload = &reqres.CreateUserRequest{}
+		}
+		rows = append(rows, importRow{row: i + 1, payload: payload, err: validateCreateUser(payload, &validation{})})
+	}
+	return rows, nil
+}
+
+// runImport creates the user of each valid row, batch by batch, passing the
+// report so far to progress after each batch. Accounts get the role of their
+// row, as admins creating them. Rows left when ctx is done fail.
+func runImport(ctx context.Context, svc UserService, rows []importRow, progress func(reqres.ImportResponse)) reqres.ImportResponse {
+	resp := reqres.ImportResponse{Status: importRunning, Results: make([]reqres.ImportResult, 0, len(rows))}
+	ctx = withCreator(ctx, creatorAdmin)
+
+	for start := 0; start < len(rows); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		batch := make([]reqres.ImportResult, end-start)
+		var wg sync.WaitGroup
+		for i := range batch {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				batch[i] = importUser(ctx, svc, rows[start+i])
+			}(i)
+		}
+		wg.Wait()
+
+		for _, result := range batch {
+			switch result.Result {
+			case importRowCreated:
+				resp.Created++
+			case importRowSkipped:
+				resp.Skipped++
+			default:
+				resp.Failed++
+			}
+			resp.Results = append(resp.Results, result)
+		}
+		if progress != nil {
+			progress(resp)
+		}
+	}
+
+	resp.Status = importDone
+	if ctx.Err() != nil {
+		resp.Status = importCancelled
+	}
+	return resp
+}
+
+// importUser creates the user of row. Users whose email or username is taken
+// are skipped, since they are usually imported already.
+func importUser(ctx context.Context, svc UserService, row importRow) reqres.ImportResult {
+	result := reqres.ImportResult{Row: row.row, Email: row.payload.Email, Username: row.payload.Username, Result: importRowFailed}
+	if row.err != nil {
+		result.Error = row.err.Error()
+		return result
+	}
+	if err := ctx.Err(); err != nil {
+		result.Error = "import was cancelled"
+		return result
+	}
+
+	user, err := svc.Create(ctx, &model.CreateUser{
+		Email:              row.payload.Email,
+		FirstName:          row.payload.FirstName,
+		LastName:           row.payload.LastName,
+		Password:           row.payload.Password,
+		Role:               row.payload.Role,
+		Username:           row.payload.Username,
+		DateOfBirth:        row.payload.DateOfBirth,
+		AcceptedTOSVersion: row.payload.AcceptedTOSVersion,
+	})
+	switch err.(type) {
+	case nil:
+		result.UserID, result.Result = user.ID, importRowCreated
+		return result
+	case codedError, validationErrors:
+		result.Error = err.Error()
+		return result
+	}
+	if err == errDuplicateEmail || err == errDuplicateUsername {
+		result.Result, result.Error = importRowSkipped, err.Error()
+		return result
+	}
+	log.Println("unable to import user:", err)
+	result.Error = "unable to add user"
+	return result
+}
+
+// importJob is an import run in the background
+type importJob struct {
+	report     reqres.ImportResponse
+	finishedAt time.Time
+}
+
+// importJobStore keeps the reports of imports run in the background. Jobs are
+// kept by the instance running them, so polling them needs sticky sessions
+// when there are several instances.
+type importJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*importJob
+
+	// ctx is what imports run under, cancelled on shutdown. Until it's set
+	// they run until done.
+	ctx     context.Context
+	running sync.WaitGroup
+}
+
+var importJobs = &importJobStore{jobs: map[string]*importJob{}}
+
+// start runs rows in the background, returning the id of the job
+func (s *importJobStore) start(svc UserService, rows []importRow) string {
+	id := bson.NewObjectId().Hex()
+
+	s.mu.Lock()
+	s.prune(time.Now())
+	s.jobs[id] = &importJob{report: reqres.ImportResponse{JobID: id, Status: importRunning, Results: []reqres.ImportResult{}}}
+	s.mu.Unlock()
+
+	// The import outlives the request that started it, but not the service
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		report := runImport(ctx, svc, rows, func(progress reqres.ImportResponse) {
+			s.update(id, progress, time.Time{})
+		})
+		s.update(id, report, time.Now())
+		if report.Status == importCancelled {
+			log.Printf("import %s cancelled: %d created, %d skipped, %d failed of %d rows", id, report.Created, report.Skipped, report.Failed, len(rows))
+		}
+	}()
+	return id
+}
+
+// wait waits for the imports running to finish, which they do quickly once
+// their context is cancelled
+func (s *importJobStore) wait() {
+	s.running.Wait()
+}
+
+func (s *importJobStore) update(id string, report reqres.ImportResponse, finishedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		report.JobID = id
+		report.Results = append([]reqres.ImportResult{}, report.Results...)
+		job.report, job.finishedAt = report, finishedAt
+	}
+}
+
+// get returns the report of the job with id so far
+func (s *importJobStore) get(id string) (reqres.ImportResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	job, ok := s.jobs[id]
+	if !ok {
+		return reqres.ImportResponse{}, errImportJobNotFound
+	}
+	return job.report, nil
+}
+
+// prune forgets the jobs done for longer than importJobTTL
+func (s *importJobStore) prune(now time.Time) {
+	for id, job := range s.jobs {
+		if !job.finishedAt.IsZero() && now.Sub(job.finishedAt) > importJobTTL {
+			delete(s.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// importingService creates every user but the ones with taken@example.com,
+// remembering the roles they got
+type importingService struct {
+	UserService
+	mu    sync.Mutex
+	roles map[string]string
+}
+
+func (s *importingService) Create(ctx context.Context, newUser *model.CreateUser) (*model.User, error) {
+	if newUser.Email == "taken@example.com" {
+		return nil, errDuplicateEmail
+	}
+	role, err := resolveRole(ctx, newUser.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[newUser.Username] = role
+	return &model.User{ID: newUser.Username + "ID", Username: newUser.Username, Role: role}, nil
+}
+
+func TestImportUsersCSV(t *testing.T) {
+	svc := &importingService{roles: map[string]string{}}
+	csv := "email,username,first_name,last_name,password,role\n" +
+		"teacher@example.com,teacher,Tess,Teach,correct horse battery,admin\n" +
+		"not an email,broken,Bo,Ken,correct horse battery,\n" +
+		"taken@example.com,taken,Tay,Ken,correct horse battery,\n" +
+		"short@example.com\n"
+
+	req := httptest.NewRequest("POST", ImportUsersPath, strings.NewReader(csv))
+	req.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	rec := httptest.NewRecorder()
+	handleImportUsers(svc).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 but got: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var resp reqres.ImportResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != importDone || resp.Created != 1 || resp.Skipped != 1 || resp.Failed != 2 || len(resp.Results) != 4 {
+		t.Fatalf("Expected 1 created, 1 skipped and 2 failed rows but got: %+v", resp)
+	}
+	for i, want := range []struct {
+		row    int
+		result string
+	}{{2, importRowCreated}, {3, importRowFailed}, {4, importRowSkipped}, {5, importRowFailed}} {
+		if got := resp.Results[i]; got.Row != want.row || got.Result != want.result {
+			t.Errorf("Expected line %d to be %s but got: %+v", want.row, want.result, got)
+		}
+	}
+	if svc.roles["teacher"] != "admin" {
+		t.Errorf("Expected imported users to get the role of their row but got: %q", svc.roles["teacher"])
+	}
+
+	req = httptest.NewRequest("POST", ImportUsersPath, strings.NewReader("email,nickname\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	rec = httptest.NewRecorder()
+	handleImportUsers(svc).ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown column to refuse the import but got: %d", rec.Code)
+	}
+}
+
+func TestImportUsersAsync(t *testing.T) {
+	svc := &importingService{roles: map[string]string{}}
+	var users []string
+	for i := 0; i < importBatchSize+5; i++ {
+		name := "user" + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		users = append(users, `{"email":"`+name+`@example.com","username":"`+name+`","first_name":"A","last_name":"B","password":"correct horse battery"}`)
+	}
+
+	router := mux.NewRouter()
+	router.Handle(ImportUsersPath, handleImportUsers(svc)).Methods("POST")
+	router.Handle(ImportJobPath, handleGetImportJob()).Methods("GET")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", ImportUsersPath+"?async=true", strings.NewReader("["+strings.Join(users, ",")+"]")))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected a 202 but got: %d %s", rec.Code, rec.Body.String())
+	}
+	var started reqres.ImportResponse
+	if err := json.NewDecoder(rec.Body).Decode(&started); err != nil || started.JobID == "" {
+		t.Fatalf("Expected a job id but got: %+v", started)
+	}
+	location := rec.Header().Get("Location")
+	if location != "/users/import/"+started.JobID {
+		t.Errorf("Expected the job to be located at its report but got: %q", location)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", location, nil))
+		var report reqres.ImportResponse
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Status == importDone {
+			if report.Created != len(users) || len(report.Results) != len(users) {
+				t.Errorf("Expected every user to be created but got: %+v", report)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the import to finish but got: %+v", report)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/users/import/unknownJob", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for an unknown job but got: %d", rec.Code)
+	}
+}
+
+func TestImportJobsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jobs := &importJobStore{jobs: map[string]*importJob{}, ctx: ctx}
+
+	rows := []importRow{{row: 1, payload: &reqres.CreateUserRequest{Email: "a@example.com", Username: "a"}}}
+	id := jobs.start(&importingService{roles: map[string]string{}}, rows)
+	jobs.wait()
+
+	report, err := jobs.get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != importCancelled || report.Failed != 1 || report.Created != 0 {
+		t.Errorf("Expected the import to be reported cancelled but got: %+v", report)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// invitationTTL is how long an invite can be accepted for
+	invitationTTL = 7 * 24 * time.Hour
+
+	// invitationSender delivers invite tokens to the people invited. Nobody
+	// can be invited when it's nil.
+	invitationSender InvitationSender
+)
+
+var (
+	errNoInvitationSender = errors.New("no way of delivering invite tokens is configured")
+	errInvalidInviteToken = errors.New("invalid, expired or already used invite token")
+	errInvitationExpired  = errors.New("the invite has expired, ask for a new one")
+	errInvitationNotFound = errors.New("invitation not found")
+)
+
+// InvitationSender is an interface for delivering invite tokens to the people
+// invited, e.g. as a link in an email
+type InvitationSender interface {
+	SendInvitation(user *model.User, token string) error
+}
+
+// logInvitationSender writes tokens to the service log, for development only
+type logInvitationSender struct{}
+
+func (logInvitationSender) SendInvitation(user *model.User, token string) error {
+	log.Printf("invite token for user %s: %s", user.ID, token)
+	return nil
+}
+
+// invitationCollection returns the collection of invitations, making sure the
+// database drops expired ones and that each invited user has one at most.
+// Tokens are random like refresh tokens, so they are generated and stored
+// hashed the same way.
+func invitationCollection(session *mgo.Session) (*mgo.Collection, error) {
+	collection := session.DB("buzz-test-user").C("invitations")
+
+	index := mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second,
+	}
+	if err := collection.EnsureIndex(index); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"token_hash", "user_id"} {
+		if err := collection.EnsureIndex(mgo.Index{Key: []string{key}, Unique: true}); err != nil {
+			return nil, err
+		}
+	}
+	return collection, nil
+}
+
+// findInvitation looks up the invitation token is for and the account waiting
+// on it. Accepted invites are gone, like unknown ones. Expired ones are told
+// apart until the database drops them.
+func findInvitation(ctx context.Context, invitations *mgo.Collection, token string) (*model.Invitation, *model.User, error) {
+	var invitation model.Invitation
+	err := invitations.Find(bson.M{"token_hash": hashRefreshToken(token)}).One(&invitation)
+	if err == mgo.ErrNotFound {
+		return nil, nil, errInvalidInviteToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//The database only drops expired invitations every minute or so
+	if !time.Now().Before(invitation.ExpiresAt) {
+		return nil, nil, errInvitationExpired
+	}
+
+	user, err := userRepository.GetByID(ctx, invitation.UserID, false)
+	if err == errUserNotFound {
+		return nil, nil, errInvalidInviteToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &invitation, user, nil
+}
+
+// invitationUserID returns the id of the user invited by invitation, empty
+// when there is none
+func invitationUserID(invitation *model.Invitation) string {
+	if invitation == nil {
+		return ""
+	}
+	return invitation.UserID
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// invitingService invites anyone but taken@example.com and knows the invite
+// token "goodToken", and "expiredToken" too late
+type invitingService struct {
+	UserService
+	invitedBy string
+}
+
+func (s *invitingService) InviteUser(ctx context.Context, invitee *model.CreateUser, invitedBy string) (*model.Invitation, error) {
+	if invitee.Email == "taken@example.com" {
+		return nil, errDuplicateEmail
+	}
+	s.invitedBy = invitedBy
+	return &model.Invitation{ID: "inviteID", UserID: invitee.Username + "ID", Email: invitee.Email, InvitedBy: invitedBy}, nil
+}
+
+func (s *invitingService) AcceptInvitation(ctx context.Context, token, password string) (*model.User, error) {
+	if token != "goodToken" {
+		return nil, errInvalidInviteToken
+	}
+	return &model.User{ID: "inviteeID", Status: statusActive}, nil
+}
+
+func (s *invitingService) CheckInvitation(ctx context.Context, token string) (*model.Invitation, *model.User, error) {
+	switch token {
+	case "goodToken":
+		return &model.Invitation{ID: "inviteID", UserID: "inviteeID", Email: "invitee@example.com"}, &model.User{ID: "inviteeID", Email: "invitee@example.com", Role: "admin", Status: statusInvited}, nil
+	case "expiredToken":
+		return nil, nil, errInvitationExpired
+	}
+	return nil, nil, errInvalidInviteToken
+}
+
+func TestInviteUser(t *testing.T) {
+	svc := &invitingService{}
+	invite := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", InviteUserPath, strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), claimsContextKey, map[string]interface{}{"sub": "adminID", "role": "admin"}))
+		rec := httptest.NewRecorder()
+		handleInviteUser(svc).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := invite(`{"email":"invitee@example.com","username":"invitee","role":"admin"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected a 201 but got: %d %s", rec.Code, rec.Body.String())
+	}
+	var resp reqres.InviteUserResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Invitation.UserID != "inviteeID" || svc.invitedBy != "adminID" {
+		t.Errorf("Expected the invite to come from the admin calling but got: %+v", resp.Invitation)
+	}
+
+	if rec := invite(`{"email":"taken@example.com","username":"taken"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected inviting a taken email to be a conflict but got: %d", rec.Code)
+	}
+	if rec := invite(`{"email":"invitee@example.com"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invite without a username to be refused but got: %d", rec.Code)
+	}
+}
+
+func TestAcceptInvitation(t *testing.T) {
+	accept := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleAcceptInvitation(&invitingService{}).ServeHTTP(rec, httptest.NewRequest("POST", AcceptInvitePath, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := accept(`{"token":"goodToken","password":"correct horse battery"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected accepting a good invite to succeed but got: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := accept(`{"token":"badToken","password":"correct horse battery"}`)
+	var resp reqres.ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || resp.Code != invalidInviteTokenCode {
+		t.Errorf("Expected a bad token to be refused with %s but got: %d %+v", invalidInviteTokenCode, rec.Code, resp)
+	}
+
+	if rec := accept(`{"token":"goodToken"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected accepting without a password to be refused but got: %d", rec.Code)
+	}
+}
+
+func TestCheckInvitation(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle(InviteTokenPath, handleCheckInvitation(&invitingService{})).Methods("GET")
+	check := func(token string) (*httptest.ResponseRecorder, reqres.ErrorResponse) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/users/invite/"+token, nil))
+		var resp reqres.ErrorResponse
+		if rec.Code != http.StatusOK {
+			json.NewDecoder(rec.Body).Decode(&resp)
+		}
+		return rec, resp
+	}
+
+	rec, _ := check("goodToken")
+	var resp reqres.CheckInvitationResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || resp.Email != "invitee@example.com" || resp.Role != "admin" {
+		t.Errorf("Expected the invite to be valid for the invitee but got: %d %+v", rec.Code, resp)
+	}
+
+	if rec, resp := check("expiredToken"); rec.Code != http.StatusGone || resp.Code != inviteExpiredCode {
+		t.Errorf("Expected an expired invite to be gone but got: %d %+v", rec.Code, resp)
+	}
+	if rec, resp := check("acceptedToken"); rec.Code != http.StatusNotFound || resp.Code != invalidInviteTokenCode {
+		t.Errorf("Expected an unknown or accepted invite not to be found but got: %d %+v", rec.Code, resp)
+	}
+}
+
+func TestInvitedAccountsOnlyJoinByAccepting(t *testing.T) {
+	if canLogIn(statusInvited) {
+		t.Error("Expected invited accounts not to be able to log in")
+	}
+	if err := checkStatusTransition(statusInvited, statusActive); err == nil {
+		t.Error("Expected invited accounts not to be activated without a password")
+	}
+	if err := checkStatusTransition(statusInvited, statusDeleted); err != nil {
+		t.Errorf("Expected invited accounts to be deletable but got: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+var (
+	// maxJSONDepth is how deeply objects and arrays of request bodies can
+	// nest, 0 for no limit
+	maxJSONDepth = 32
+
+	// maxJSONKeys is how many object keys request bodies can have in all, 0
+	// for no limit
+	maxJSONKeys = 1000
+)
+
+var (
+	errJSONTooDeep     = errors.New("request body is nested too deeply")
+	errJSONTooManyKeys = errors.New("request body has too many fields")
+)
+
+// jsonFrame is an object or array being read
+type jsonFrame struct {
+	object    bool
+	expectKey bool
+}
+
+// checkJSONComplexity reads the JSON of r token by token, without decoding
+// any values, and fails as soon as it nests deeper than maxDepth or has more
+// than maxKeys keys. Malformed JSON is left for decoding to refuse.
+func checkJSONComplexity(r io.Reader, maxDepth, maxKeys int) error {
+	dec := json.NewDecoder(r)
+	var stack []jsonFrame
+	keys := 0
+
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		if token == json.Delim('}') || token == json.Delim(']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		// Objects alternate keys and values
+		if len(stack) > 0 && stack[len(stack)-1].object {
+			top := &stack[len(stack)-1]
+			if top.expectKey {
+				top.expectKey = false
+				if keys++; maxKeys > 0 && keys > maxKeys {
+					return errJSONTooManyKeys
+				}
+				continue
+			}
+			top.expectKey = true
+		}
+
+		if token == json.Delim('{') || token == json.Delim('[') {
+			stack = append(stack, jsonFrame{object: token == json.Delim('{'), expectKey: true})
+			if maxDepth > 0 && len(stack) > maxDepth {
+				return errJSONTooDeep
+			}
+		}
+	}
+}
+
+// jsonGuardMiddleware refuses request bodies nested too deeply or with too
+// many fields before any handler decodes them, since decoding those costs far
+// more than their size suggests
+func jsonGuardMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (maxJSONDepth <= 0 && maxJSONKeys <= 0) || r.Body == nil || r.Method == "GET" || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Hand the handler what the check read, followed by the rest
+		var read bytes.Buffer
+		err := checkJSONComplexity(io.TeeReader(r.Body, &read), maxJSONDepth, maxJSONKeys)
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(io.MultiReader(&read, r.Body))
+
+		next.ServeHTTP(w, r)
+	})
+}
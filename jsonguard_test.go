@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckJSONComplexity(t *testing.T) {
+	tests := []struct {
+		body string
+		want error
+	}{
+		{`{"username":"jdoe","roles":["a","b"],"profile":{"first_name":"J"}}`, nil},
+		{`[[[1]]]`, nil},
+		{`[[[[1]]]]`, errJSONTooDeep},
+		{`{"a":{"b":{"c":{"d":1}}}}`, errJSONTooDeep},
+		{`{"a":1,"b":2,"c":3,"d":4,"e":5}`, errJSONTooManyKeys},
+		{`{"a":{"b":1,"c":2},"d":3,"e":["f","g","h"]}`, errJSONTooManyKeys},
+
+		// String values aren't keys
+		{`{"a":"b","c":"d","e":["f","g","h","i"]}`, nil},
+
+		// Malformed bodies are left for decoding to refuse
+		{`{"a":`, nil},
+	}
+
+	for _, test := range tests {
+		if err := checkJSONComplexity(strings.NewReader(test.body), 3, 4); err != test.want {
+			t.Errorf("Expected %s to give %v but got: %v", test.body, test.want, err)
+		}
+	}
+}
+
+func TestJSONGuardMiddleware(t *testing.T) {
+	handler := jsonGuardMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+
+	// Deeply nested bodies are refused before the handler decodes them
+	nested := strings.Repeat("[", 10000) + strings.Repeat("]", 10000)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users", strings.NewReader(nested)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", rec.Code)
+	}
+
+	// Others reach the handler whole
+	body := `{"username":"jdoe","password":"correct horse battery"}`
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Errorf("Expected the handler to get the whole body but got: %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/buzzapp/user/reqres"
+)
+
+// Ways of handling tokens signed with the previous secret after it's rotated.
+//
+// With kid, tokens name the key they were signed with, and tokens signed with
+// the previous secret stay valid until they expire. That is the least
+// disruptive, but a leaked previous secret keeps working for as long as it's
+// configured.
+//
+// With grace, the previous secret is tried after the current one for a fixed
+// window after startup. Outstanding tokens get the chance to be refreshed,
+// and the previous secret stops working once the window is over even if it's
+// left configured.
+const (
+	secretRotationKID   = "kid"
+	secretRotationGrace = "grace"
+)
+
+// secretRotation is how tokens signed with PreviousSecretKey are verified
+var secretRotation = secretRotationGrace
+
+// PreviousSecretKey is the JWT secret in use before the current one, set by
+// the JWT_PREVIOUS_SECRET secret. Only the current secret is used when it's
+// empty.
+var PreviousSecretKey = ""
+
+// previousSecretUntil is the end of the grace window for PreviousSecretKey
+var previousSecretUntil time.Time
+
+func isValidSecretRotation(mode string) bool {
+	return mode == secretRotationKID || mode == secretRotationGrace
+}
+
+// keyID identifies a secret in the kid header of tokens without revealing it
+func keyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signingMethod is how tokens are signed: HS256 with SecretKey, or RS256 or
+// ES256 with privateKey once loadSigningKeys is called
+var signingMethod jwt.SigningMethod = jwt.SigningMethodHS256
+
+var (
+	// privateKey signs tokens, an *rsa.PrivateKey or *ecdsa.PrivateKey
+	privateKey crypto.PrivateKey
+
+	// publicKey verifies tokens signed with privateKey
+	publicKey crypto.PublicKey
+
+	// previousPublicKey verifies tokens signed with the key pair in use
+	// before the current one, following secretRotation like secrets do. It's
+	// nil when there is none.
+	previousPublicKey crypto.PublicKey
+)
+
+// loadSigningKeys switches token signing to RS256 or ES256, depending on the
+// PEM encoded RSA or P-256 ECDSA private key at privatePath. Tokens are
+// verified with the public key at publicPath, or with the private key's own
+// when publicPath is empty.
+func loadSigningKeys(privatePath, publicPath string) error {
+	b, err := ioutil.ReadFile(privatePath)
+	if err != nil {
+		return err
+	}
+	key, err := parsePrivateKeyPEM(b)
+	if err != nil {
+		return err
+	}
+
+	var method jwt.SigningMethod
+	var public crypto.PublicKey
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		method, public = jwt.SigningMethodRS256, &k.PublicKey
+	case *ecdsa.PrivateKey:
+		method, public = jwt.SigningMethodES256, &k.PublicKey
+	}
+
+	if publicPath != "" {
+		given, err := readPublicKey(publicPath)
+		if err != nil {
+			return err
+		}
+		if publicKeyID(given) != publicKeyID(public) {
+			return errors.New("The public key doesn't match the private key")
+		}
+		public = given
+	}
+
+	privateKey, publicKey = key, public
+	signingMethod = method
+	return nil
+}
+
+// loadPreviousPublicKey lets tokens signed with the key pair in use before the
+// current one be verified with the PEM encoded public key at path. It must be
+// of the same kind as the current key, since tokens are only accepted with
+// signingMethod.
+func loadPreviousPublicKey(path string) error {
+	key, err := readPublicKey(path)
+	if err != nil {
+		return err
+	}
+
+	_, isRSA := key.(*rsa.PublicKey)
+	if isRSA != (signingMethod == jwt.SigningMethodRS256) {
+		return errors.New("The previous public key must be of the same kind as the current one")
+	}
+
+	previousPublicKey = key
+	return nil
+}
+
+// parsePrivateKeyPEM parses a PEM encoded PKCS1, PKCS8 or SEC1 private key,
+// which must be an RSA or P-256 ECDSA key
+func parsePrivateKeyPEM(b []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("The private key must be PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, errors.New("The private key must be a PKCS1, PKCS8 or SEC1 key")
+			}
+		}
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("ECDSA keys must be on the P-256 curve to sign with ES256")
+		}
+		return k, nil
+	}
+	return nil, errors.New("The private key must be an RSA or ECDSA key")
+}
+
+// readPublicKey reads the PEM encoded RSA or ECDSA public key, or certificate,
+// at path
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("The public key must be PEM encoded")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		cert, certErr := x509.ParseCertificate(block.Bytes)
+		if certErr != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, errors.New("The public key must be an RSA or ECDSA key")
+}
+
+// publicKeyID identifies a public key in the kid header of tokens
+func publicKeyID(key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	return keyID(string(der))
+}
+
+// signToken names the key token is signed with in its kid header, and signs
+// it with signingMethod
+func signToken(token *jwt.Token) (string, error) {
+	if signingMethod != jwt.SigningMethodHS256 {
+		token.Header["kid"] = publicKeyID(publicKey)
+		return token.SignedString(privateKey)
+	}
+
+	token.Header["kid"] = keyID(SecretKey)
+	return token.SignedString([]byte(SecretKey))
+}
+
+// previousKeyAccepted reports whether tokens signed with the previous secret
+// or key pair are still accepted at now
+func previousKeyAccepted(now time.Time) bool {
+	return secretRotation == secretRotationKID || now.Before(previousSecretUntil)
+}
+
+// verificationKeys returns the keys a token may have been signed with, in the
+// order they should be tried
+func verificationKeys(token *jwt.Token, now time.Time) []interface{} {
+	if signingMethod != jwt.SigningMethodHS256 {
+		if previousPublicKey == nil {
+			return []interface{}{publicKey}
+		}
+		return rotationKeys(token, now, publicKey, publicKeyID(publicKey), previousPublicKey, publicKeyID(previousPublicKey))
+	}
+
+	if PreviousSecretKey == "" {
+		return []interface{}{[]byte(SecretKey)}
+	}
+	return rotationKeys(token, now, []byte(SecretKey), keyID(SecretKey), []byte(PreviousSecretKey), keyID(PreviousSecretKey))
+}
+
+// rotationKeys returns which of the current and previous keys, identified by
+// currentID and previousID, a token may have been signed with according to
+// secretRotation
+func rotationKeys(token *jwt.Token, now time.Time, current interface{}, currentID string, previous interface{}, previousID string) []interface{} {
+	if secretRotation == secretRotationKID {
+		kid, _ := token.Header["kid"].(string)
+		switch kid {
+		case currentID:
+			return []interface{}{current}
+		case previousID:
+			return []interface{}{previous}
+		}
+		return nil
+	}
+
+	if previousKeyAccepted(now) {
+		return []interface{}{current, previous}
+	}
+	return []interface{}{current}
+}
+
+// jsonWebKeys returns the public keys tokens are verified with at now, for
+// other services to verify them by themselves. Secrets are never published,
+// so there are none with HS256.
+func jsonWebKeys(now time.Time) []reqres.JSONWebKey {
+	keys := []reqres.JSONWebKey{}
+	if signingMethod == jwt.SigningMethodHS256 {
+		return keys
+	}
+
+	keys = append(keys, jsonWebKey(publicKey))
+	if previousPublicKey != nil && previousKeyAccepted(now) {
+		keys = append(keys, jsonWebKey(previousPublicKey))
+	}
+	return keys
+}
+
+// jsonWebKey describes an RSA or ECDSA public key as a JWK (RFC 7517)
+func jsonWebKey(key crypto.PublicKey) reqres.JSONWebKey {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwk := reqres.JSONWebKey{KeyID: publicKeyID(key), Use: "sig"}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType, jwk.Algorithm = "RSA", jwt.SigningMethodRS256.Alg()
+		jwk.N = encode(k.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// Coordinates are padded to the size of the curve
+		size := (k.Curve.Params().BitSize + 7) / 8
+		x, y := make([]byte, size), make([]byte, size)
+		jwk.KeyType, jwk.Algorithm, jwk.Curve = "EC", jwt.SigningMethodES256.Alg(), k.Curve.Params().Name
+		jwk.X = encode(k.X.FillBytes(x))
+		jwk.Y = encode(k.Y.FillBytes(y))
+	}
+	return jwk
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/buzzapp/user/model"
+)
+
+// providerLDAP is the provider of the identities of users who log in with
+// the directory
+const providerLDAP = "ldap"
+
+var (
+	// LDAPBindPassword is the password of the account we search the
+	// directory as, set by the LDAP_BIND_PASSWORD secret
+	LDAPBindPassword = ""
+
+	// ldapAutoProvision creates an account for users logging in with the
+	// directory for the first time
+	ldapAutoProvision = true
+
+	// ldapTimeout bounds a whole login against the directory
+	ldapTimeout = 10 * time.Second
+
+	// ldapAttributes are the attributes of users read from the directory
+	ldapAttributes = []string{"mail", "givenName", "sn", "memberOf", "entryUUID"}
+)
+
+var (
+	errDirectoryUnavailable = errors.New("the directory is unavailable, please try again later")
+	errNoDirectoryEmail     = errors.New("the directory has no email for this user")
+	errDirectoryEmailTaken  = errors.New("an account not linked to the directory already has this email")
+	errLDAPUserNotFound     = errors.New("no such user in the directory")
+)
+
+// ldapAuthenticator checks passwords by binding to the directory as the user
+// logging in, signing them up the first time. Users the directory doesn't
+// know log in with their local password, so accounts such as those of
+// operators keep working when the directory is configured.
+//
+// When groups are mapped to roles the directory is the authority on roles:
+// users get the role of the first group of theirs that's mapped, the default
+// role if none is, every time they log in.
+type ldapAuthenticator struct {
+	directory  *ldapDirectory
+	groupRoles []ldapGroupRole
+	local      Authenticator
+}
+
+func newLDAPAuthenticator(directory *ldapDirectory, groupRoles []ldapGroupRole) ldapAuthenticator {
+	return ldapAuthenticator{directory: directory, groupRoles: groupRoles, local: localAuthenticator{}}
+}
+
+func (a ldapAuthenticator) Authenticate(ctx context.Context, username, password string) (*model.User, error) {
+	// Directories take binds without a password as anonymous ones, which
+	// succeed whoever the DN is
+	if password == "" {
+		return nil, errInvalidCredentials
+	}
+
+	entry, err := a.directory.authenticate(ctx, username, password)
+	switch err {
+	case nil:
+	case errLDAPUserNotFound:
+		return a.local.Authenticate(ctx, username, password)
+	case errInvalidCredentials:
+		var user *model.User
+		if entry != nil {
+			user, _ = userByIdentity(ctx, providerLDAP, entry.subject())
+		}
+		recordLoginAttempt(userIDOf(user), false, loginReasonBadPassword)
+		return nil, errInvalidCredentials
+	default:
+		log.Println("unable to authenticate against the directory:", err)
+		return nil, errDirectoryUnavailable
+	}
+
+	user, err := userByIdentity(ctx, providerLDAP, entry.subject())
+	if err == errUserNotFound {
+		return a.provision(ctx, username, entry)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if role := a.roleOf(entry); role != "" && role != user.Role {
+		err := setRole(ctx, user.ID, role)
+		recordServiceAuditEvent(ctx, providerLDAP, user.ID, auditActionRoleChange, fmt.Sprintf("from %s to %s, as the directory has it", user.Role, role), err)
+		if err != nil {
+			return nil, err
+		}
+		user.Role = role
+		notifyUserUpdated(user)
+	}
+	return user, nil
+}
+
+// provision signs up the user of entry, who logged in as username
+func (a ldapAuthenticator) provision(ctx context.Context, username string, entry *ldapEntry) (*model.User, error) {
+	if !ldapAutoProvision {
+		return nil, errIdentityNotLinked
+	}
+
+	// The directory vouches for the emails it has
+	profile := &model.ExternalProfile{
+		Provider:      providerLDAP,
+		Subject:       entry.subject(),
+		Email:         entry.first("mail"),
+		EmailVerified: true,
+		Username:      username,
+		FirstName:     entry.first("givenName"),
+		LastName:      entry.first("sn"),
+	}
+	if profile.Email == "" {
+		return nil, errNoDirectoryEmail
+	}
+
+	role := a.roleOf(entry)
+	if role == "" {
+		role = defaultRole
+	}
+	user, err := signUpWithIdentity(ctx, profile, role)
+	if err == errDuplicateEmail {
+		return nil, errDirectoryEmailTaken
+	}
+	return user, err
+}
+
+// roleOf returns the role the groups of entry map to, "" when groups aren't
+// mapped to roles
+func (a ldapAuthenticator) roleOf(entry *ldapEntry) string {
+	if len(a.groupRoles) == 0 {
+		return ""
+	}
+
+	groups := map[string]bool{}
+	for _, group := range entry.attributes[strings.ToLower("memberOf")] {
+		groups[ldapDNKey(group)] = true
+	}
+	for _, mapping := range a.groupRoles {
+		if groups[ldapDNKey(mapping.groupDN)] {
+			return mapping.role
+		}
+	}
+	return defaultRole
+}
+
+// setRole gives the user with userID role
+func setRole(ctx context.Context, userID, role string) error {
+	change := UserChange{Set: map[string]interface{}{"role": role, "updated_at": time.Now()}}
+	return modifyUser(ctx, UserFilter{IDs: []string{userID}}, change, errUserNotFound)
+}
+
+// ldapGroupRole gives the members of a directory group a role
+type ldapGroupRole struct {
+	role    string
+	groupDN string
+}
+
+// parseLDAPGroupRoles parses role=groupDN mappings separated by semicolons,
+// since DNs have commas. The first mapping a user's groups match wins.
+func parseLDAPGroupRoles(s string) ([]ldapGroupRole, error) {
+	var mappings []ldapGroupRole
+	for _, pair := range strings.Split(s, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid LDAP group mapping %q, expected role=groupDN", pair)
+		}
+		role := strings.TrimSpace(parts[0])
+		if !isValidRole(role) {
+			return nil, fmt.Errorf("invalid LDAP group mapping %q: unknown role %s", pair, role)
+		}
+		mappings = append(mappings, ldapGroupRole{role: role, groupDN: strings.TrimSpace(parts[1])})
+	}
+	return mappings, nil
+}
+
+// ldapDNKey is what DNs are compared by. Attribute names and, in practice,
+// values are compared whatever their case, and spaces between RDNs don't
+// count.
+func ldapDNKey(dn string) string {
+	rdns := strings.Split(dn, ",")
+	for i, rdn := range rdns {
+		rdns[i] = strings.TrimSpace(rdn)
+	}
+	return strings.ToLower(strings.Join(rdns, ","))
+}
+
+// ldapDirectory is an LDAPv3 server users authenticate against
+type ldapDirectory struct {
+	url           *url.URL
+	bindDN        string
+	bindPassword  string
+	baseDN        string
+	userAttribute string
+}
+
+// newLDAPDirectory returns the directory at rawURL, an ldap:// or ldaps://
+// URL. Users are searched for under baseDN by their userAttribute, as
+// bindDN when it's set. Without TLS passwords cross the network in the
+// clear.
+func newLDAPDirectory(rawURL, bindDN, bindPassword, baseDN, userAttribute string) (*ldapDirectory, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "389")
+		}
+	case "ldaps":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "636")
+		}
+	default:
+		return nil, fmt.Errorf("invalid LDAP URL %s: the scheme must be ldap or ldaps", rawURL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %s: no host", rawURL)
+	}
+	if userAttribute == "" {
+		return nil, errors.New("the LDAP user attribute can't be empty")
+	}
+
+	return &ldapDirectory{url: u, bindDN: bindDN, bindPassword: bindPassword, baseDN: baseDN, userAttribute: userAttribute}, nil
+}
+
+// ldapEntry is an entry of the directory with the attributes we asked for,
+// by lowercased name
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// first returns the first value of the attribute name, "" when there's none
+func (e *ldapEntry) first(name string) string {
+	if values := e.attributes[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// subject is what identifies the entry for good: its entryUUID, which
+// survives renames, or else its DN
+func (e *ldapEntry) subject() string {
+	if uuid := e.first("entryUUID"); uuid != "" {
+		return uuid
+	}
+	return ldapDNKey(e.dn)
+}
+
+// authenticate finds the entry of username and binds as it with password,
+// proving the password. Wrong passwords are errInvalidCredentials, returned
+// along with the entry, and usernames the directory doesn't have
+// errLDAPUserNotFound.
+func (d *ldapDirectory) authenticate(ctx context.Context, username, password string) (*ldapEntry, error) {
+	conn, err := d.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Directories rarely let anonymous clients search
+	if err := ldapBind(conn, d.bindDN, d.bindPassword); err != nil {
+		return nil, fmt.Errorf("unable to bind as %q: %v", d.bindDN, err)
+	}
+
+	// Two entries are enough to know the username is ambiguous
+	request := ldap.NewSearchRequest(
+		d.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(d.userAttribute), ldap.EscapeFilter(username)),
+		ldapAttributes, nil,
+	)
+	result, err := conn.Search(request)
+	if err != nil && !(ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) && result != nil && len(result.Entries) > 1) {
+		return nil, err
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, errLDAPUserNotFound
+	case 1:
+	default:
+		// Nobody's told apart from the others by this username
+		log.Printf("unable to authenticate against the directory: %d or more entries have %s %s", len(result.Entries), d.userAttribute, username)
+		return nil, errInvalidCredentials
+	}
+
+	entry := newLDAPEntry(result.Entries[0])
+	if err := ldapBind(conn, entry.dn, password); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// dial connects to the directory, for no longer than ldapTimeout
+func (d *ldapDirectory) dial(ctx context.Context) (*ldap.Conn, error) {
+	deadline := time.Now().Add(ldapTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	conn, err := ldap.DialURL(d.url.String(), ldap.DialWithDialer(&net.Dialer{Deadline: deadline}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(time.Until(deadline))
+	return conn, nil
+}
+
+// ldapBind authenticates conn as dn with a simple bind. Invalid credentials
+// are errInvalidCredentials.
+func ldapBind(conn *ldap.Conn, dn, password string) error {
+	err := conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return errInvalidCredentials
+	}
+	return err
+}
+
+// newLDAPEntry returns the entry the directory sent
+func newLDAPEntry(e *ldap.Entry) *ldapEntry {
+	entry := &ldapEntry{dn: e.DN, attributes: map[string][]string{}}
+	for _, attribute := range e.Attributes {
+		name := strings.ToLower(attribute.Name)
+		entry.attributes[name] = append(entry.attributes[name], attribute.Values...)
+	}
+	return entry
+}
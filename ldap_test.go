@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/buzzapp/user/model"
+)
+
+// fakeDirectory serves the directory of dc=example,dc=com over LDAP: the
+// service account cn=service and the users testUser and twin, who two
+// entries have
+func fakeDirectory(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	passwords := map[string]string{
+		"cn=service,dc=example,dc=com":             "servicePassword",
+		"uid=testUser,ou=people,dc=example,dc=com": "secret",
+	}
+	entries := map[string][]*ldap.Entry{
+		"testUser": {ldap.NewEntry("uid=testUser,ou=people,dc=example,dc=com", map[string][]string{
+			"mail":     {"test@example.com"},
+			"memberOf": {"cn=Staff,ou=groups,dc=example,dc=com", "cn=Admins,ou=groups,dc=example,dc=com"},
+		})},
+		"twin": {
+			ldap.NewEntry("uid=twin,ou=a,dc=example,dc=com", nil),
+			ldap.NewEntry("uid=twin,ou=b,dc=example,dc=com", nil),
+		},
+	}
+	result := func(tag ber.Tag, code int) *ber.Packet {
+		op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+		op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+		op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+		op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+		return op
+	}
+	searchEntry := func(entry *ldap.Entry) *ber.Packet {
+		op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, ""))
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		for _, attribute := range entry.Attributes {
+			typeAndValues := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			typeAndValues.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Name, ""))
+			values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, value := range attribute.Values {
+				values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+			}
+			typeAndValues.AppendChild(values)
+			attributes.AppendChild(typeAndValues)
+		}
+		op.AppendChild(attributes)
+		return op
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					message, err := ber.ReadPacket(conn)
+					if err != nil || len(message.Children) < 2 {
+						return
+					}
+					id := message.Children[0].Value.(int64)
+					reply := func(op *ber.Packet) {
+						envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+						envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+						envelope.AppendChild(op)
+						conn.Write(envelope.Bytes())
+					}
+
+					request := message.Children[1]
+					switch request.Tag {
+					case ldap.ApplicationBindRequest:
+						dn, password := request.Children[1].Value.(string), request.Children[2].Data.String()
+						if expected, ok := passwords[dn]; ok && expected == password {
+							reply(result(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess))
+						} else {
+							reply(result(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials))
+						}
+					case ldap.ApplicationSearchRequest:
+						filter := request.Children[6]
+						found := entries[filter.Children[1].Data.String()]
+						for _, entry := range found {
+							reply(searchEntry(entry))
+						}
+						if len(found) > 1 {
+							reply(result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+						} else {
+							reply(result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+						}
+					case ldap.ApplicationUnbindRequest:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func TestLDAPDirectory(t *testing.T) {
+	directory, err := newLDAPDirectory(fakeDirectory(t), "cn=service,dc=example,dc=com", "servicePassword", "dc=example,dc=com", "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	entry, err := directory.authenticate(ctx, "testUser", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.dn != "uid=testUser,ou=people,dc=example,dc=com" || entry.first("mail") != "test@example.com" || len(entry.attributes["memberof"]) != 2 {
+		t.Errorf("Expected the entry of the user but got: %+v", entry)
+	}
+	if entry.subject() != "uid=testuser,ou=people,dc=example,dc=com" {
+		t.Errorf("Expected entries without an entryUUID to be identified by DN but got: %s", entry.subject())
+	}
+
+	for _, test := range []struct {
+		username, password string
+		err                error
+	}{
+		{"testUser", "wrong", errInvalidCredentials},
+		{"twin", "secret", errInvalidCredentials},
+		{"nobody", "secret", errLDAPUserNotFound},
+	} {
+		if _, err := directory.authenticate(ctx, test.username, test.password); err != test.err {
+			t.Errorf("Expected %s to be %v but got: %v", test.username, test.err, err)
+		}
+	}
+
+	// A service account the directory refuses is a configuration error
+	directory.bindPassword = "wrong"
+	if _, err := directory.authenticate(ctx, "testUser", "secret"); err == nil || err == errInvalidCredentials {
+		t.Errorf("Expected the service bind to fail but got: %v", err)
+	}
+}
+
+func TestNewLDAPDirectory(t *testing.T) {
+	for url, host := range map[string]string{
+		"ldap://ldap.example.com":       "ldap.example.com:389",
+		"ldaps://ldap.example.com":      "ldap.example.com:636",
+		"ldaps://ldap.example.com:3269": "ldap.example.com:3269",
+	} {
+		directory, err := newLDAPDirectory(url, "", "", "dc=example,dc=com", "uid")
+		if err != nil || directory.url.Host != host {
+			t.Errorf("Expected %s to be at %s but got: %v %v", url, host, directory, err)
+		}
+	}
+	for _, url := range []string{"http://ldap.example.com", "ldap://", "ldap.example.com"} {
+		if _, err := newLDAPDirectory(url, "", "", "dc=example,dc=com", "uid"); err == nil {
+			t.Errorf("Expected %s to be refused", url)
+		}
+	}
+}
+
+// credentialsAuthenticator authenticates users by a password of theirs
+type credentialsAuthenticator map[string]string
+
+func (a credentialsAuthenticator) Authenticate(ctx context.Context, username, password string) (*model.User, error) {
+	if expected, ok := a[username]; !ok || expected != password {
+		return nil, errInvalidCredentials
+	}
+	return &model.User{ID: username + "ID", Username: username}, nil
+}
+
+func TestLDAPAuthenticatorFallsBack(t *testing.T) {
+	directory, err := newLDAPDirectory(fakeDirectory(t), "cn=service,dc=example,dc=com", "servicePassword", "dc=example,dc=com", "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := ldapAuthenticator{directory: directory, local: credentialsAuthenticator{"operator": "localSecret", "testUser": "localSecret"}}
+	ctx := context.Background()
+
+	if user, err := a.Authenticate(ctx, "operator", "localSecret"); err != nil || user.ID != "operatorID" {
+		t.Errorf("Expected users the directory doesn't have to log in locally but got: %v %v", user, err)
+	}
+	if _, err := a.Authenticate(ctx, "testUser", "localSecret"); err != errInvalidCredentials {
+		t.Errorf("Expected users the directory has to need their directory password but got: %v", err)
+	}
+	if _, err := a.Authenticate(ctx, "testUser", ""); err != errInvalidCredentials {
+		t.Errorf("Expected an empty password to be refused but got: %v", err)
+	}
+
+	// Logins fail rather than fall back when the directory is down
+	directory.url.Host = "127.0.0.1:1"
+	if _, err := a.Authenticate(ctx, "operator", "localSecret"); err != errDirectoryUnavailable {
+		t.Errorf("Expected the directory to be unavailable but got: %v", err)
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	mappings, err := parseLDAPGroupRoles("admin=cn=Admins,ou=groups,dc=example,dc=com; student = CN=Staff, OU=Groups, DC=example, DC=com;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 2 || mappings[0].role != "admin" || mappings[1].groupDN != "CN=Staff, OU=Groups, DC=example, DC=com" {
+		t.Fatalf("Expected both mappings but got: %+v", mappings)
+	}
+	for _, s := range []string{"admin", "admin=", "wizard=cn=Wizards,dc=example,dc=com"} {
+		if _, err := parseLDAPGroupRoles(s); err == nil {
+			t.Errorf("Expected %q to be refused", s)
+		}
+	}
+
+	a := ldapAuthenticator{groupRoles: mappings}
+	member := func(groups ...string) *ldapEntry {
+		return &ldapEntry{attributes: map[string][]string{"memberof": groups}}
+	}
+	for _, test := range []struct {
+		entry *ldapEntry
+		role  string
+	}{
+		{member("cn=staff,ou=groups,dc=example,dc=com"), "student"},
+		{member("cn=Staff,ou=groups,dc=example,dc=com", "cn=Admins,ou=groups,dc=example,dc=com"), "admin"},
+		{member("cn=Others,ou=groups,dc=example,dc=com"), defaultRole},
+		{member(), defaultRole},
+	} {
+		if role := a.roleOf(test.entry); role != test.role {
+			t.Errorf("Expected %v to be a %s but got: %s", test.entry.attributes["memberof"], test.role, role)
+		}
+	}
+
+	// Without mappings roles are left to us
+	if role := (ldapAuthenticator{}).roleOf(member("cn=Admins,ou=groups,dc=example,dc=com")); role != "" {
+		t.Errorf("Expected no role without mappings but got: %s", role)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"text/template"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// defaultLockoutNotice is the notice users get when failed logins lock their
+// account out, unless a template of our own is configured
+const defaultLockoutNotice = `Hi {{.FirstName}},
+
+Your account {{.Username}} was locked until {{.LockedUntil.Format "Jan 2 15:04 MST"}} after too many failed logins.
+
+If this was you, you can log in again once the lock is over. If it wasn't, someone may be guessing your password: reset it to keep your account safe.
+`
+
+var (
+	// lockoutNotices tells users when failed logins lock their account out
+	lockoutNotices = false
+
+	// lockoutNoticeTemplate renders the notice, given a lockoutNotice
+	lockoutNoticeTemplate = template.Must(template.New("lockout").Parse(defaultLockoutNotice))
+
+	// lockoutNoticeSender delivers lockout notices to users. Notices aren't
+	// sent when it's nil.
+	lockoutNoticeSender LockoutNoticeSender
+)
+
+// LockoutNoticeSender is an interface for delivering lockout notices to users,
+// e.g. by email
+type LockoutNoticeSender interface {
+	SendLockoutNotice(user *model.User, notice string) error
+}
+
+// logLockoutNoticeSender writes notices to the service log, for development only
+type logLockoutNoticeSender struct{}
+
+func (logLockoutNoticeSender) SendLockoutNotice(user *model.User, notice string) error {
+	log.Printf("lockout notice for user %s:\n%s", user.ID, notice)
+	return nil
+}
+
+// lockoutNotice is what lockout notice templates are rendered with
+type lockoutNotice struct {
+	Username    string
+	FirstName   string
+	LastName    string
+	LockedUntil time.Time
+}
+
+// parseLockoutNoticeTemplate reads the lockout notice template at path
+func parseLockoutNoticeTemplate(path string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("lockout").Parse(string(text))
+}
+
+// notifyLockout tells the user with username that their account is locked out
+// until lockedUntil. It is best effort, and usernames without a user are
+// ignored since anyone can lock those out.
+func notifyLockout(svc UserService, username string, lockedUntil time.Time) {
+	if !lockoutNotices || lockoutNoticeSender == nil {
+		return
+	}
+
+	// The notice is sent after the request it's for is over
+	user, err := svc.GetByUsername(context.Background(), username)
+	if err != nil {
+		if err != errUserNotFound {
+			log.Println("unable to send lockout notice:", err)
+		}
+		return
+	}
+
+	var notice bytes.Buffer
+	data := lockoutNotice{Username: user.Username, FirstName: user.FirstName, LastName: user.LastName, LockedUntil: lockedUntil}
+	if err := lockoutNoticeTemplate.Execute(&notice, data); err != nil {
+		log.Println("unable to send lockout notice:", err)
+		return
+	}
+	if err := lockoutNoticeSender.SendLockoutNotice(user, notice.String()); err != nil {
+		log.Println("unable to send lockout notice:", err)
+	}
+}
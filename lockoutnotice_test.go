@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// capturingLockoutSender hands the notices it is asked to send over
+type capturingLockoutSender struct {
+	notices chan string
+}
+
+func (s capturingLockoutSender) SendLockoutNotice(user *model.User, notice string) error {
+	s.notices <- user.Username + ": " + notice
+	return nil
+}
+
+func TestLockoutNotice(t *testing.T) {
+	defer func(throttle *loginThrottler, enabled bool, sender LockoutNoticeSender) {
+		loginThrottle, lockoutNotices, lockoutNoticeSender = throttle, enabled, sender
+	}(loginThrottle, lockoutNotices, lockoutNoticeSender)
+
+	sender := capturingLockoutSender{notices: make(chan string, 10)}
+	lockoutNoticeSender = sender
+	loginThrottle = newLoginThrottler(newMemoryRateLimitStore(), 3, time.Minute, 10*time.Minute)
+	svc := fakeRoleService{roles: map[string]string{"alice": "student", "bob": "student"}}
+
+	fail := func(username string, times int) {
+		for i := 0; i < times; i++ {
+			req := httptest.NewRequest("POST", "/auth/authenticate", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			recordFailedLogin(req, svc, username)
+		}
+	}
+	received := func() (string, bool) {
+		select {
+		case notice := <-sender.notices:
+			return notice, true
+		case <-time.After(100 * time.Millisecond):
+			return "", false
+		}
+	}
+
+	// Disabled notices aren't sent
+	lockoutNotices = false
+	fail("bob", 3)
+	if notice, ok := received(); ok {
+		t.Errorf("Expected no notice while disabled but got: %s", notice)
+	}
+
+	lockoutNotices = true
+	fail("alice", 2)
+	if notice, ok := received(); ok {
+		t.Errorf("Expected no notice before the lockout but got: %s", notice)
+	}
+	fail("alice", 1)
+	notice, ok := received()
+	if !ok {
+		t.Fatal("Expected the lockout to send a notice")
+	}
+	if !strings.HasPrefix(notice, "alice: ") || !strings.Contains(notice, "was locked until") {
+		t.Errorf("Expected the notice to tell alice about the lockout but got: %s", notice)
+	}
+
+	// Nobody is told about usernames without a user
+	fail("nobody", 3)
+	if notice, ok := received(); ok {
+		t.Errorf("Expected no notice for an unknown username but got: %s", notice)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"strconv"
+	"time"
+
 	"github.com/buzzapp/user/model"
 	"gitlab.fg/go/logger"
 )
@@ -10,8 +14,8 @@ type userServiceLogginMiddleware struct {
 	UserService
 }
 
-func (mw userServiceLogginMiddleware) Create(newUser *model.CreateUser) (*model.User, error) {
-	user, err := mw.UserService.Create(newUser)
+func (mw userServiceLogginMiddleware) Create(ctx context.Context, newUser *model.CreateUser) (*model.User, error) {
+	user, err := mw.UserService.Create(ctx, newUser)
 	if err != nil {
 		mw.logger.Info("Create", "Service Results", "success", "false", "error", err.Error())
 		return user, err
@@ -20,8 +24,78 @@ func (mw userServiceLogginMiddleware) Create(newUser *model.CreateUser) (*model.
 	return user, err
 }
 
-func (mw userServiceLogginMiddleware) GetAll() ([]model.User, error) {
-	users, err := mw.UserService.GetAll()
+func (mw userServiceLogginMiddleware) AcceptTOS(ctx context.Context, userID, version string) error {
+	err := mw.UserService.AcceptTOS(ctx, userID, version)
+	if err != nil {
+		mw.logger.Info("AcceptTOS", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("AcceptTOS", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) CancelClose(ctx context.Context, username, password string) (*model.User, error) {
+	user, err := mw.UserService.CancelClose(ctx, username, password)
+	if err != nil {
+		mw.logger.Info("CancelClose", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("CancelClose", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) ChangePassword(ctx context.Context, id, currentPassword, newPassword string) error {
+	err := mw.UserService.ChangePassword(ctx, id, currentPassword, newPassword)
+	if err != nil {
+		mw.logger.Info("ChangePassword", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("ChangePassword", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) CloseAccount(ctx context.Context, id string) (*model.User, error) {
+	user, err := mw.UserService.CloseAccount(ctx, id)
+	if err != nil {
+		mw.logger.Info("CloseAccount", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("CloseAccount", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) CreateChallenge(ctx context.Context, userID string) (time.Time, error) {
+	expiresAt, err := mw.UserService.CreateChallenge(ctx, userID)
+	if err != nil {
+		mw.logger.Info("CreateChallenge", "Service Results", "success", "false", "error", err.Error())
+		return expiresAt, err
+	}
+	mw.logger.Info("CreateChallenge", "Service Results", "success", "true")
+	return expiresAt, err
+}
+
+func (mw userServiceLogginMiddleware) CreatePasswordReset(ctx context.Context, email string) error {
+	err := mw.UserService.CreatePasswordReset(ctx, email)
+	if err != nil {
+		mw.logger.Info("CreatePasswordReset", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("CreatePasswordReset", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) Delete(ctx context.Context, id string) error {
+	err := mw.UserService.Delete(ctx, id)
+	if err != nil {
+		mw.logger.Info("Delete", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("Delete", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) GetAll(ctx context.Context) ([]model.User, error) {
+	users, err := mw.UserService.GetAll(ctx)
 	if err != nil {
 		mw.logger.Info("GetAll", "Service Results", "success", "false", "error", err.Error())
 		return users, err
@@ -30,8 +104,8 @@ func (mw userServiceLogginMiddleware) GetAll() ([]model.User, error) {
 	return users, err
 }
 
-func (mw userServiceLogginMiddleware) GetByID(id string) (*model.User, error) {
-	user, err := mw.UserService.GetByID(id)
+func (mw userServiceLogginMiddleware) GetByID(ctx context.Context, id string) (*model.User, error) {
+	user, err := mw.UserService.GetByID(ctx, id)
 	if err != nil {
 		mw.logger.Info("GetByID", "Service Results", "success", "false", "error", err.Error())
 		return user, err
@@ -40,28 +114,118 @@ func (mw userServiceLogginMiddleware) GetByID(id string) (*model.User, error) {
 	return user, err
 }
 
-func (mw userServiceLogginMiddleware) Login(username, password, referer string) (model.JWTToken, error) {
-	token, err := mw.UserService.Login(username, password, referer)
+func (mw userServiceLogginMiddleware) GetByEmail(ctx context.Context, email string) (*model.User, error) {
+	user, err := mw.UserService.GetByEmail(ctx, email)
+	if err != nil {
+		mw.logger.Info("GetByEmail", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("GetByEmail", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	user, err := mw.UserService.GetByUsername(ctx, username)
+	if err != nil {
+		mw.logger.Info("GetByUsername", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("GetByUsername", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) GetChanges(ctx context.Context, since time.Time, cursor string, limit int) ([]model.UserChange, string, error) {
+	changes, next, err := mw.UserService.GetChanges(ctx, since, cursor, limit)
+	if err != nil {
+		mw.logger.Info("GetChanges", "Service Results", "success", "false", "error", err.Error())
+		return changes, next, err
+	}
+	mw.logger.Info("GetChanges", "Service Results", "success", "true")
+	return changes, next, err
+}
+
+func (mw userServiceLogginMiddleware) GetDuplicates(ctx context.Context, criteria []string, offset, limit int) ([]model.DuplicateGroup, int, error) {
+	groups, total, err := mw.UserService.GetDuplicates(ctx, criteria, offset, limit)
+	if err != nil {
+		mw.logger.Info("GetDuplicates", "Service Results", "success", "false", "error", err.Error())
+		return groups, total, err
+	}
+	mw.logger.Info("GetDuplicates", "Service Results", "success", "true")
+	return groups, total, err
+}
+
+func (mw userServiceLogginMiddleware) GetLoginAttempts(ctx context.Context, userID string) ([]model.LoginAttempt, error) {
+	attempts, err := mw.UserService.GetLoginAttempts(ctx, userID)
+	if err != nil {
+		mw.logger.Info("GetLoginAttempts", "Service Results", "success", "false", "error", err.Error())
+		return attempts, err
+	}
+	mw.logger.Info("GetLoginAttempts", "Service Results", "success", "true")
+	return attempts, err
+}
+
+func (mw userServiceLogginMiddleware) GetSecurityEvents(ctx context.Context, userID string, opts model.ListOptions) ([]model.SecurityEvent, int, error) {
+	events, total, err := mw.UserService.GetSecurityEvents(ctx, userID, opts)
+	if err != nil {
+		mw.logger.Info("GetSecurityEvents", "Service Results", "success", "false", "error", err.Error())
+		return events, total, err
+	}
+	mw.logger.Info("GetSecurityEvents", "Service Results", "success", "true")
+	return events, total, err
+}
+
+func (mw userServiceLogginMiddleware) GetSecurityReport(ctx context.Context, userID string, from, to time.Time) (*model.SecurityReport, error) {
+	report, err := mw.UserService.GetSecurityReport(ctx, userID, from, to)
+	if err != nil {
+		mw.logger.Info("GetSecurityReport", "Service Results", "success", "false", "error", err.Error())
+		return report, err
+	}
+	mw.logger.Info("GetSecurityReport", "Service Results", "success", "true")
+	return report, err
+}
+
+func (mw userServiceLogginMiddleware) List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	users, total, err := mw.UserService.List(ctx, opts)
+	if err != nil {
+		mw.logger.Info("List", "Service Results", "success", "false", "error", err.Error())
+		return users, total, err
+	}
+	mw.logger.Info("List", "Service Results", "success", "true")
+	return users, total, err
+}
+
+func (mw userServiceLogginMiddleware) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	result, err := mw.UserService.Login(ctx, username, password, referer)
 	if err != nil {
 		mw.logger.Info("Login", "Service Results", "success", "false", "error", err.Error())
-		return token, err
+		return result, err
 	}
 	mw.logger.Info("Login", "Service Results", "success", "true")
-	return token, err
+	return result, err
 }
 
-func (mw userServiceLogginMiddleware) RefreshToken(userID, username, role, referer string) (model.JWTToken, error) {
-	token, err := mw.UserService.RefreshToken(userID, username, role, referer)
+func (mw userServiceLogginMiddleware) RefreshToken(ctx context.Context, refreshToken, origin string) (*model.LoginResult, error) {
+	result, err := mw.UserService.RefreshToken(ctx, refreshToken, origin)
 	if err != nil {
 		mw.logger.Info("RefreshToken", "Service Results", "success", "false", "error", err.Error())
-		return token, err
+		return result, err
 	}
 	mw.logger.Info("RefreshToken", "Service Results", "success", "true")
-	return token, err
+	return result, err
+}
+
+func (mw userServiceLogginMiddleware) ReissueID(ctx context.Context, id string) (*model.User, error) {
+	user, err := mw.UserService.ReissueID(ctx, id)
+	if err != nil {
+		mw.logger.Info("ReissueID", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("ReissueID", "Service Results", "success", "true")
+	return user, err
 }
 
-func (mw userServiceLogginMiddleware) Remove(id string) error {
-	err := mw.UserService.Remove(id)
+func (mw userServiceLogginMiddleware) Remove(ctx context.Context, id string) error {
+	err := mw.UserService.Remove(ctx, id)
 	if err != nil {
 		mw.logger.Info("Remove", "Service Results", "success", "false", "error", err.Error())
 		return err
@@ -69,8 +233,108 @@ func (mw userServiceLogginMiddleware) Remove(id string) error {
 	return err
 }
 
-func (mw userServiceLogginMiddleware) Update(updatedUser *model.UpdateUser) (*model.User, error) {
-	user, err := mw.UserService.Update(updatedUser)
+func (mw userServiceLogginMiddleware) PurgeClosedAccounts(ctx context.Context, now time.Time) ([]string, error) {
+	purged, err := mw.UserService.PurgeClosedAccounts(ctx, now)
+	if err != nil {
+		mw.logger.Info("PurgeClosedAccounts", "Service Results", "success", "false", "error", err.Error())
+		return purged, err
+	}
+	mw.logger.Info("PurgeClosedAccounts", "Service Results", "success", "true", "purged", strconv.Itoa(len(purged)))
+	return purged, err
+}
+
+func (mw userServiceLogginMiddleware) Revoke(ctx context.Context, tokenID string, expiry time.Time) error {
+	err := mw.UserService.Revoke(ctx, tokenID, expiry)
+	if err != nil {
+		mw.logger.Info("Revoke", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("Revoke", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) ResetPassword(ctx context.Context, token, newPassword string) (*model.User, error) {
+	user, err := mw.UserService.ResetPassword(ctx, token, newPassword)
+	if err != nil {
+		mw.logger.Info("ResetPassword", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("ResetPassword", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) ReleaseUsername(ctx context.Context, username, token string) error {
+	err := mw.UserService.ReleaseUsername(ctx, username, token)
+	if err != nil {
+		mw.logger.Info("ReleaseUsername", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("ReleaseUsername", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) ReserveUsername(ctx context.Context, username string) (string, time.Time, error) {
+	token, expiresAt, err := mw.UserService.ReserveUsername(ctx, username)
+	if err != nil {
+		mw.logger.Info("ReserveUsername", "Service Results", "success", "false", "error", err.Error())
+		return token, expiresAt, err
+	}
+	mw.logger.Info("ReserveUsername", "Service Results", "success", "true")
+	return token, expiresAt, err
+}
+
+func (mw userServiceLogginMiddleware) ResolveUsernames(ctx context.Context, usernames []string) ([]model.ResolvedUser, error) {
+	users, err := mw.UserService.ResolveUsernames(ctx, usernames)
+	if err != nil {
+		mw.logger.Info("ResolveUsernames", "Service Results", "success", "false", "error", err.Error())
+		return users, err
+	}
+	mw.logger.Info("ResolveUsernames", "Service Results", "success", "true")
+	return users, err
+}
+
+func (mw userServiceLogginMiddleware) Search(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	users, total, err := mw.UserService.Search(ctx, opts)
+	if err != nil {
+		mw.logger.Info("Search", "Service Results", "success", "false", "error", err.Error())
+		return users, total, err
+	}
+	mw.logger.Info("Search", "Service Results", "success", "true")
+	return users, total, err
+}
+
+func (mw userServiceLogginMiddleware) DeactivateInactive(ctx context.Context, cutoff time.Time, dryRun bool) ([]string, error) {
+	ids, err := mw.UserService.DeactivateInactive(ctx, cutoff, dryRun)
+	if err != nil {
+		mw.logger.Info("DeactivateInactive", "Service Results", "success", "false", "error", err.Error())
+		return ids, err
+	}
+	mw.logger.Info("DeactivateInactive", "Service Results", "success", "true", "count", strconv.Itoa(len(ids)), "dry_run", strconv.FormatBool(dryRun))
+	return ids, err
+}
+
+func (mw userServiceLogginMiddleware) GetStats(ctx context.Context) (*model.UserStats, error) {
+	stats, err := mw.UserService.GetStats(ctx)
+	if err != nil {
+		mw.logger.Info("GetStats", "Service Results", "success", "false", "error", err.Error())
+		return stats, err
+	}
+	mw.logger.Info("GetStats", "Service Results", "success", "true")
+	return stats, err
+}
+
+func (mw userServiceLogginMiddleware) SetStatus(ctx context.Context, id, status string) (*model.User, error) {
+	user, err := mw.UserService.SetStatus(ctx, id, status)
+	if err != nil {
+		mw.logger.Info("SetStatus", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("SetStatus", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) Update(ctx context.Context, id string, updatedUser *model.UpdateUser) (*model.User, error) {
+	user, err := mw.UserService.Update(ctx, id, updatedUser)
 	if err != nil {
 		mw.logger.Info("Update", "Service Results", "success", "false", "error", err.Error())
 		return user, err
@@ -78,3 +342,342 @@ func (mw userServiceLogginMiddleware) Update(updatedUser *model.UpdateUser) (*mo
 	mw.logger.Info("Update", "Service Results", "success", "true")
 	return user, err
 }
+
+func (mw userServiceLogginMiddleware) VerifyChallenge(ctx context.Context, userID, code string) (string, time.Time, error) {
+	proofToken, expiresAt, err := mw.UserService.VerifyChallenge(ctx, userID, code)
+	if err != nil {
+		mw.logger.Info("VerifyChallenge", "Service Results", "success", "false", "error", err.Error())
+		return proofToken, expiresAt, err
+	}
+	mw.logger.Info("VerifyChallenge", "Service Results", "success", "true")
+	return proofToken, expiresAt, err
+}
+
+func (mw userServiceLogginMiddleware) UpdateAttributes(ctx context.Context, id string, update *model.AttributeUpdate) (*model.User, error) {
+	user, err := mw.UserService.UpdateAttributes(ctx, id, update)
+	if err != nil {
+		mw.logger.Info("UpdateAttributes", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("UpdateAttributes", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) CollectTokenGarbage(ctx context.Context, now time.Time) (*model.TokenGarbage, error) {
+	garbage, err := mw.UserService.CollectTokenGarbage(ctx, now)
+	if err != nil {
+		mw.logger.Info("CollectTokenGarbage", "Service Results", "success", "false", "error", err.Error())
+		return nil, err
+	}
+	mw.logger.Info("CollectTokenGarbage", "Service Results", "success", "true", "refresh_tokens", strconv.Itoa(garbage.RefreshTokens), "token_families", strconv.Itoa(garbage.TokenFamilies))
+	return garbage, nil
+}
+
+func (mw userServiceLogginMiddleware) GetByIDIncludingDeleted(ctx context.Context, id string) (*model.User, error) {
+	user, err := mw.UserService.GetByIDIncludingDeleted(ctx, id)
+	if err != nil {
+		mw.logger.Info("GetByIDIncludingDeleted", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("GetByIDIncludingDeleted", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) Reactivate(ctx context.Context, id string) (*model.User, error) {
+	user, err := mw.UserService.Reactivate(ctx, id)
+	if err != nil {
+		mw.logger.Info("Reactivate", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("Reactivate", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) ResendVerification(ctx context.Context, email string) error {
+	err := mw.UserService.ResendVerification(ctx, email)
+	if err != nil {
+		mw.logger.Info("ResendVerification", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("ResendVerification", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) VerifyEmail(ctx context.Context, token string) (*model.User, error) {
+	user, err := mw.UserService.VerifyEmail(ctx, token)
+	if err != nil {
+		mw.logger.Info("VerifyEmail", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("VerifyEmail", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) EndSession(ctx context.Context, userID, refreshToken string) error {
+	err := mw.UserService.EndSession(ctx, userID, refreshToken)
+	if err != nil {
+		mw.logger.Info("EndSession", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("EndSession", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) InvalidateResetTokens(ctx context.Context, userID string) (int, error) {
+	invalidated, err := mw.UserService.InvalidateResetTokens(ctx, userID)
+	if err != nil {
+		mw.logger.Info("InvalidateResetTokens", "Service Results", "success", "false", "error", err.Error())
+		return invalidated, err
+	}
+	mw.logger.Info("InvalidateResetTokens", "Service Results", "success", "true", "invalidated", strconv.Itoa(invalidated))
+	return invalidated, err
+}
+
+func (mw userServiceLogginMiddleware) RevokeSessions(ctx context.Context, userID string) error {
+	err := mw.UserService.RevokeSessions(ctx, userID)
+	if err != nil {
+		mw.logger.Info("RevokeSessions", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("RevokeSessions", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) LoginWithProvider(ctx context.Context, profile *model.ExternalProfile, referer string) (*model.LoginResult, error) {
+	result, err := mw.UserService.LoginWithProvider(ctx, profile, referer)
+	if err != nil {
+		mw.logger.Info("LoginWithProvider", "Service Results", "success", "false", "error", err.Error())
+		return result, err
+	}
+	mw.logger.Info("LoginWithProvider", "Service Results", "success", "true")
+	return result, err
+}
+
+func (mw userServiceLogginMiddleware) LinkIdentity(ctx context.Context, userID string, profile *model.ExternalProfile) (*model.User, error) {
+	user, err := mw.UserService.LinkIdentity(ctx, userID, profile)
+	if err != nil {
+		mw.logger.Info("LinkIdentity", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("LinkIdentity", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) UnlinkIdentity(ctx context.Context, userID, provider string) (*model.User, error) {
+	user, err := mw.UserService.UnlinkIdentity(ctx, userID, provider)
+	if err != nil {
+		mw.logger.Info("UnlinkIdentity", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("UnlinkIdentity", "Service Results", "success", "true")
+	return user, err
+}
+
+// Ping is called by every readiness check, so only failures are logged
+func (mw userServiceLogginMiddleware) Ping(ctx context.Context) error {
+	err := mw.UserService.Ping(ctx)
+	if err != nil {
+		mw.logger.Info("Ping", "Service Results", "success", "false", "error", err.Error())
+	}
+	return err
+}
+
+func (mw userServiceLogginMiddleware) CreateAPIKey(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (*model.APIKey, string, error) {
+	apiKey, key, err := mw.UserService.CreateAPIKey(ctx, userID, name, scopes, expiresAt)
+	if err != nil {
+		mw.logger.Info("CreateAPIKey", "Service Results", "success", "false", "error", err.Error())
+		return apiKey, key, err
+	}
+	mw.logger.Info("CreateAPIKey", "Service Results", "success", "true")
+	return apiKey, key, err
+}
+
+func (mw userServiceLogginMiddleware) ListAPIKeys(ctx context.Context, userID string) ([]model.APIKey, error) {
+	keys, err := mw.UserService.ListAPIKeys(ctx, userID)
+	if err != nil {
+		mw.logger.Info("ListAPIKeys", "Service Results", "success", "false", "error", err.Error())
+		return keys, err
+	}
+	mw.logger.Info("ListAPIKeys", "Service Results", "success", "true")
+	return keys, err
+}
+
+func (mw userServiceLogginMiddleware) RevokeAPIKey(ctx context.Context, userID, keyID string) error {
+	err := mw.UserService.RevokeAPIKey(ctx, userID, keyID)
+	if err != nil {
+		mw.logger.Info("RevokeAPIKey", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("RevokeAPIKey", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) ExportUser(ctx context.Context, id string) (*model.UserExport, error) {
+	export, err := mw.UserService.ExportUser(ctx, id)
+	if err != nil {
+		mw.logger.Info("ExportUser", "Service Results", "success", "false", "error", err.Error())
+		return export, err
+	}
+	mw.logger.Info("ExportUser", "Service Results", "success", "true")
+	return export, err
+}
+
+func (mw userServiceLogginMiddleware) EraseUser(ctx context.Context, id string) error {
+	err := mw.UserService.EraseUser(ctx, id)
+	if err != nil {
+		mw.logger.Info("EraseUser", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("EraseUser", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) ListSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	sessions, err := mw.UserService.ListSessions(ctx, userID)
+	if err != nil {
+		mw.logger.Info("ListSessions", "Service Results", "success", "false", "error", err.Error())
+		return sessions, err
+	}
+	mw.logger.Info("ListSessions", "Service Results", "success", "true")
+	return sessions, err
+}
+
+func (mw userServiceLogginMiddleware) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	err := mw.UserService.RevokeSession(ctx, userID, sessionID)
+	if err != nil {
+		mw.logger.Info("RevokeSession", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("RevokeSession", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) InviteUser(ctx context.Context, invitee *model.CreateUser, invitedBy string) (*model.Invitation, error) {
+	invitation, err := mw.UserService.InviteUser(ctx, invitee, invitedBy)
+	if err != nil {
+		mw.logger.Info("InviteUser", "Service Results", "success", "false", "error", err.Error())
+		return invitation, err
+	}
+	mw.logger.Info("InviteUser", "Service Results", "success", "true")
+	return invitation, err
+}
+
+func (mw userServiceLogginMiddleware) AcceptInvitation(ctx context.Context, token, password string) (*model.User, error) {
+	user, err := mw.UserService.AcceptInvitation(ctx, token, password)
+	if err != nil {
+		mw.logger.Info("AcceptInvitation", "Service Results", "success", "false", "error", err.Error())
+		return user, err
+	}
+	mw.logger.Info("AcceptInvitation", "Service Results", "success", "true")
+	return user, err
+}
+
+func (mw userServiceLogginMiddleware) CheckInvitation(ctx context.Context, token string) (*model.Invitation, *model.User, error) {
+	invitation, user, err := mw.UserService.CheckInvitation(ctx, token)
+	if err != nil {
+		mw.logger.Info("CheckInvitation", "Service Results", "success", "false", "error", err.Error())
+		return invitation, user, err
+	}
+	mw.logger.Info("CheckInvitation", "Service Results", "success", "true")
+	return invitation, user, err
+}
+
+func (mw userServiceLogginMiddleware) ListInvitations(ctx context.Context, opts model.ListOptions) ([]model.Invitation, int, error) {
+	invitations, total, err := mw.UserService.ListInvitations(ctx, opts)
+	if err != nil {
+		mw.logger.Info("ListInvitations", "Service Results", "success", "false", "error", err.Error())
+		return invitations, total, err
+	}
+	mw.logger.Info("ListInvitations", "Service Results", "success", "true")
+	return invitations, total, err
+}
+
+func (mw userServiceLogginMiddleware) RevokeInvitation(ctx context.Context, id string) error {
+	err := mw.UserService.RevokeInvitation(ctx, id)
+	if err != nil {
+		mw.logger.Info("RevokeInvitation", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("RevokeInvitation", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	err := mw.UserService.AddGroupMember(ctx, groupID, userID)
+	if err != nil {
+		mw.logger.Info("AddGroupMember", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("AddGroupMember", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) CreateGroup(ctx context.Context, name, description string) (*model.Group, error) {
+	group, err := mw.UserService.CreateGroup(ctx, name, description)
+	if err != nil {
+		mw.logger.Info("CreateGroup", "Service Results", "success", "false", "error", err.Error())
+		return group, err
+	}
+	mw.logger.Info("CreateGroup", "Service Results", "success", "true")
+	return group, err
+}
+
+func (mw userServiceLogginMiddleware) GetGroup(ctx context.Context, id string) (*model.Group, error) {
+	group, err := mw.UserService.GetGroup(ctx, id)
+	if err != nil {
+		mw.logger.Info("GetGroup", "Service Results", "success", "false", "error", err.Error())
+		return group, err
+	}
+	mw.logger.Info("GetGroup", "Service Results", "success", "true")
+	return group, err
+}
+
+func (mw userServiceLogginMiddleware) ListGroups(ctx context.Context, opts model.ListOptions) ([]model.Group, int, error) {
+	groups, total, err := mw.UserService.ListGroups(ctx, opts)
+	if err != nil {
+		mw.logger.Info("ListGroups", "Service Results", "success", "false", "error", err.Error())
+		return groups, total, err
+	}
+	mw.logger.Info("ListGroups", "Service Results", "success", "true")
+	return groups, total, err
+}
+
+func (mw userServiceLogginMiddleware) UpdateGroup(ctx context.Context, id string, update *model.UpdateGroup) (*model.Group, error) {
+	group, err := mw.UserService.UpdateGroup(ctx, id, update)
+	if err != nil {
+		mw.logger.Info("UpdateGroup", "Service Results", "success", "false", "error", err.Error())
+		return group, err
+	}
+	mw.logger.Info("UpdateGroup", "Service Results", "success", "true")
+	return group, err
+}
+
+func (mw userServiceLogginMiddleware) DeleteGroup(ctx context.Context, id string) error {
+	err := mw.UserService.DeleteGroup(ctx, id)
+	if err != nil {
+		mw.logger.Info("DeleteGroup", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("DeleteGroup", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	err := mw.UserService.RemoveGroupMember(ctx, groupID, userID)
+	if err != nil {
+		mw.logger.Info("RemoveGroupMember", "Service Results", "success", "false", "error", err.Error())
+		return err
+	}
+	mw.logger.Info("RemoveGroupMember", "Service Results", "success", "true")
+	return err
+}
+
+func (mw userServiceLogginMiddleware) ListUserGroups(ctx context.Context, userID string) ([]model.Group, error) {
+	groups, err := mw.UserService.ListUserGroups(ctx, userID)
+	if err != nil {
+		mw.logger.Info("ListUserGroups", "Service Results", "success", "false", "error", err.Error())
+		return groups, err
+	}
+	mw.logger.Info("ListUserGroups", "Service Results", "success", "true")
+	return groups, err
+}
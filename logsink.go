@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/syslog"
+	"os"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Destinations the service logs can be written to
+const (
+	logSinkStdout = "stdout"
+	logSinkFile   = "file"
+	logSinkSyslog = "syslog"
+)
+
+// LogSink is an interface for where the service logs go. Close flushes
+// anything still buffered and is called on shutdown.
+type LogSink interface {
+	io.Writer
+	Close() error
+}
+
+// defaultLogSink is the sink set by the LOG_SINK environment variable
+func defaultLogSink() string {
+	if sink := os.Getenv("LOG_SINK"); sink != "" {
+		return sink
+	}
+	return logSinkFile
+}
+
+func isValidLogSink(sink string) bool {
+	return sink == logSinkStdout || sink == logSinkFile || sink == logSinkSyslog
+}
+
+// newLogSink opens the sink of the given kind. path is only used by the file
+// sink.
+func newLogSink(kind, path string) (LogSink, error) {
+	switch kind {
+	case logSinkStdout:
+		return stdoutLogSink{}, nil
+	case logSinkFile:
+		lj := &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    500, // megabytes
+			MaxBackups: 3,
+			MaxAge:     28, //days
+		}
+		return fileLogSink{Writer: io.MultiWriter(os.Stderr, lj), file: lj}, nil
+	case logSinkSyslog:
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "buzz-user")
+	}
+	return nil, errors.New("unknown log sink: " + kind)
+}
+
+// stdoutLogSink writes the logs to stdout for the platform to collect
+type stdoutLogSink struct{}
+
+func (stdoutLogSink) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdoutLogSink) Close() error {
+	return os.Stdout.Sync()
+}
+
+// fileLogSink writes the logs to a file rotated by size, and to stderr.
+// Rotation happens while holding the file's lock, so no entry is lost.
+type fileLogSink struct {
+	io.Writer
+	file *lumberjack.Logger
+}
+
+func (s fileLogSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogsRouteToConfiguredSink(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "service.log")
+	sink, err := newLogSink(logSinkFile, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := getLogger(sink)
+	l.Info("Service log entry", "Test")
+	log.Println("stdlib log entry")
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"Service log entry", "stdlib log entry"} {
+		if !strings.Contains(string(contents), entry) {
+			t.Errorf("Expected %q in the log file but got: %s", entry, contents)
+		}
+	}
+
+	if sink, err := newLogSink(logSinkStdout, ""); err != nil {
+		t.Error(err)
+	} else if _, ok := sink.(stdoutLogSink); !ok {
+		t.Errorf("Expected a stdout sink but got: %T", sink)
+	}
+
+	if _, err := newLogSink("carrier-pigeon", ""); err == nil {
+		t.Error("Expected an unknown sink to be refused")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+)
+
+// metricsContentType is the media type of the Prometheus text format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// unmatchedRoute is the route label of requests no route matched, so paths
+// of 404s can't blow up the number of series
+const unmatchedRoute = "unmatched"
+
+// latencyBuckets are the upper bounds in seconds of the request latency
+// histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// serviceMetrics are the metrics of this instance, exposed at /metrics
+var serviceMetrics = newMetrics()
+
+type requestSeries struct {
+	route, method, status string
+}
+
+type latencySeries struct {
+	route, method string
+}
+
+type cacheSeries struct {
+	cache, result string
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics holds the counters and histograms of the instance
+type metrics struct {
+	mu        sync.Mutex
+	requests  map[requestSeries]uint64
+	latencies map[latencySeries]*histogram
+	logins    map[string]uint64
+	tokens    map[string]uint64
+	caches    map[cacheSeries]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  map[requestSeries]uint64{},
+		latencies: map[latencySeries]*histogram{},
+		logins:    map[string]uint64{},
+		tokens:    map[string]uint64{},
+		caches:    map[cacheSeries]uint64{},
+	}
+}
+
+// observeRequest counts a request to route and records how long it took
+func (m *metrics) observeRequest(route, method string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestSeries{route, method, strconv.Itoa(status)}]++
+	series := latencySeries{route, method}
+	h, ok := m.latencies[series]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[series] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// countLogin counts a login, by whether it succeeded
+func (m *metrics) countLogin(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logins[result]++
+}
+
+// countTokens counts the access and refresh tokens handed out with result
+func (m *metrics) countTokens(result *model.LoginResult) {
+	if result == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if result.Token != "" {
+		m.tokens["access"]++
+	}
+	if result.RefreshToken != "" {
+		m.tokens["refresh"]++
+	}
+}
+
+// countCacheLookup counts a lookup of cache, by whether it was a hit
+func (m *metrics) countCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.caches[cacheSeries{cache, result}]++
+}
+
+// writeText writes the metrics in the Prometheus text format, with the series
+// of every metric sorted so scrapes are stable
+func (m *metrics) writeText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP http_requests_total Requests served, by route, method and status.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	requests := make([]requestSeries, 0, len(m.requests))
+	for series := range m.requests {
+		requests = append(requests, series)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, series := range requests {
+		fmt.Fprintf(w, "http_requests_total{route=%s,method=%s,status=%s} %d\n", labelValue(series.route), labelValue(series.method), labelValue(series.status), m.requests[series])
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds Time taken to serve requests, by route and method.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	latencies := make([]latencySeries, 0, len(m.latencies))
+	for series := range m.latencies {
+		latencies = append(latencies, series)
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		a, b := latencies[i], latencies[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.method < b.method
+	})
+	for _, series := range latencies {
+		h := m.latencies[series]
+		labels := fmt.Sprintf("route=%s,method=%s", labelValue(series.route), labelValue(series.method))
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP user_logins_total Logins with a password or a provider, by result.")
+	fmt.Fprintln(w, "# TYPE user_logins_total counter")
+	for _, result := range []string{"success", "failure"} {
+		fmt.Fprintf(w, "user_logins_total{result=%q} %d\n", result, m.logins[result])
+	}
+
+	fmt.Fprintln(w, "# HELP user_tokens_issued_total Tokens handed out by logins and refreshes, by kind.")
+	fmt.Fprintln(w, "# TYPE user_tokens_issued_total counter")
+	for _, kind := range []string{"access", "refresh"} {
+		fmt.Fprintf(w, "user_tokens_issued_total{kind=%q} %d\n", kind, m.tokens[kind])
+	}
+
+	fmt.Fprintln(w, "# HELP user_cache_lookups_total Lookups of the user and token revocation caches, by cache and result.")
+	fmt.Fprintln(w, "# TYPE user_cache_lookups_total counter")
+	for _, cache := range []string{"user", "revocation"} {
+		for _, result := range []string{"hit", "miss"} {
+			fmt.Fprintf(w, "user_cache_lookups_total{cache=%q,result=%q} %d\n", cache, result, m.caches[cacheSeries{cache, result}])
+		}
+	}
+}
+
+// labelValue quotes a label value, escaping what the text format requires
+func labelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return `"` + v + `"`
+}
+
+// metricsMiddleware counts every request and times it, labelled with the
+// template of the route of router it matches rather than its path
+func metricsMiddleware(m *metrics, router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := unmatchedRoute
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		m.observeRequest(route, r.Method, rec.status, time.Since(start))
+	})
+}
+
+// handleMetrics exposes m for Prometheus to scrape
+func handleMetrics(m *metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		m.writeText(w)
+	})
+}
+
+// userServiceMetricsMiddleware counts the logins of users and the tokens they
+// are handed
+type userServiceMetricsMiddleware struct {
+	UserService
+	metrics *metrics
+}
+
+func newUserServiceMetricsMiddleware(svc UserService, m *metrics) userServiceMetricsMiddleware {
+	return userServiceMetricsMiddleware{UserService: svc, metrics: m}
+}
+
+func (mw userServiceMetricsMiddleware) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	result, err := mw.UserService.Login(ctx, username, password, referer)
+	mw.metrics.countLogin(err)
+	mw.metrics.countTokens(result)
+	return result, err
+}
+
+func (mw userServiceMetricsMiddleware) LoginWithProvider(ctx context.Context, profile *model.ExternalProfile, referer string) (*model.LoginResult, error) {
+	result, err := mw.UserService.LoginWithProvider(ctx, profile, referer)
+	mw.metrics.countLogin(err)
+	mw.metrics.countTokens(result)
+	return result, err
+}
+
+func (mw userServiceMetricsMiddleware) RefreshToken(ctx context.Context, refreshToken, origin string) (*model.LoginResult, error) {
+	result, err := mw.UserService.RefreshToken(ctx, refreshToken, origin)
+	mw.metrics.countTokens(result)
+	return result, err
+}
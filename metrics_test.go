@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+)
+
+// loggingInService lets in the user with the password "right"
+type loggingInService struct {
+	UserService
+}
+
+func (loggingInService) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	if password != "right" {
+		return nil, errors.New("invalid credentials")
+	}
+	return &model.LoginResult{UserID: username, Token: "accessToken", RefreshToken: "refreshToken"}, nil
+}
+
+func (loggingInService) RefreshToken(ctx context.Context, refreshToken, origin string) (*model.LoginResult, error) {
+	return &model.LoginResult{Token: "accessToken", RefreshToken: "refreshToken"}, nil
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	m := newMetrics()
+	router := mux.NewRouter()
+	router.Handle(GetUserByIDPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})).Methods("GET")
+	router.Handle(MetricsPath, handleMetrics(m)).Methods("GET")
+	handler := metricsMiddleware(m, router, router)
+
+	for _, path := range []string{"/users/a", "/users/b", "/nowhere/a", "/nowhere/b"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", MetricsPath, nil))
+	if rec.Header().Get("Content-Type") != metricsContentType {
+		t.Errorf("Expected the Prometheus text format but got: %s", rec.Header().Get("Content-Type"))
+	}
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		`http_requests_total{route="/users/{id}",method="GET",status="404"} 2`,
+		`http_requests_total{route="unmatched",method="GET",status="404"} 2`,
+		`http_request_duration_seconds_bucket{route="/users/{id}",method="GET",le="+Inf"} 2`,
+		`http_request_duration_seconds_count{route="/users/{id}",method="GET"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected the metrics to have %s but got:\n%s", line, body)
+		}
+	}
+}
+
+func TestUserServiceMetricsMiddleware(t *testing.T) {
+	m := newMetrics()
+	svc := newUserServiceMetricsMiddleware(loggingInService{}, m)
+
+	svc.Login(context.Background(), "user", "right", "")
+	svc.Login(context.Background(), "user", "wrong", "")
+	svc.Login(context.Background(), "user", "wrong", "")
+	svc.RefreshToken(context.Background(), "refreshToken", "")
+
+	if m.logins["success"] != 1 || m.logins["failure"] != 2 {
+		t.Errorf("Expected 1 successful and 2 failed logins but got: %v", m.logins)
+	}
+	if m.tokens["access"] != 2 || m.tokens["refresh"] != 2 {
+		t.Errorf("Expected 2 access and 2 refresh tokens but got: %v", m.tokens)
+	}
+
+	var out strings.Builder
+	m.writeText(&out)
+	if !strings.Contains(out.String(), `user_logins_total{result="failure"} 2`) {
+		t.Errorf("Expected the failed logins to be exposed but got:\n%s", out.String())
+	}
+}
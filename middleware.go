@@ -1,47 +1,331 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 )
 
+type contextKey string
+
+// claimsContextKey is the request context key of the caller's token claims
+const claimsContextKey contextKey = "claims"
+
+// authMiddleware only lets through requests with a valid bearer token or API
+// key, and puts its claims in the request context for claimsFromContext.
+// Missing, invalid and expired credentials get a 401, API keys without the
+// scope for the request a 403.
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			respondWithError("Access not allowed", errors.New("Invalid jwt token"), w, http.StatusForbidden)
+		claims, challenge, err := authenticate(r)
+		if err != nil && challenge == "" {
+			respondWithError("unable to check credentials", err, w, http.StatusInternalServerError)
 			return
 		}
-
-		// TODO: Make this a bit more robust, parsing-wise
-		authHeaderParts := strings.Split(authHeader, " ")
-		if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" {
-			respondWithError("Access not allowed", errors.New("Authorization header format must be Bearer {token}"), w, http.StatusForbidden)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", challenge)
+			respondWithError("Authentication required", err, w, http.StatusUnauthorized)
+			return
+		}
+		if scopes, ok := apiKeyScopes(claims); ok && !apiKeyAllows(scopes, r.Method) {
+			respondWithError("Access not allowed", errAPIKeyScopeDenied, w, http.StatusForbidden)
+			return
+		}
+		if scopes, ok := unverifiedTokenScopes(claims); ok && !apiKeyAllows(scopes, r.Method) {
+			respondWithError("Access not allowed", errUnverifiedScopeDenied, w, http.StatusForbidden)
 			return
 		}
 
-		jwtToken := authHeaderParts[1]
+		if sessionID := sessionOf(claims); sessionID != "" {
+			touchSession(sessionID)
+		}
 
-		token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-			// Valid alg is what we expect
-			if token.Method != jwt.SigningMethodHS256 {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(SecretKey), nil
-		})
+		// Let the handlers know who is calling
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticate checks the bearer token or API key of r, returning its claims.
+// Refused credentials come with the WWW-Authenticate challenge to answer with,
+// which is empty when they couldn't be checked at all.
+func authenticate(r *http.Request) (map[string]interface{}, string, error) {
+	if key, ok := apiKeyCredential(r); ok {
+		claims, err := authenticateAPIKey(r.Context(), key)
+		if err == errInvalidAPIKey {
+			return nil, `ApiKey error="invalid_token"`, err
+		}
 		if err != nil {
-			respondWithError("Access not allowed", err, w, http.StatusForbidden)
-			return
+			return nil, "", err
 		}
+		return claims, "", nil
+	}
+
+	jwtToken, err := bearerToken(r)
+	if err != nil {
+		return nil, "Bearer", err
+	}
+
+	invalid := `Bearer error="invalid_token"`
+	token, err := parseToken(jwtToken)
+	if err != nil {
+		return nil, invalid, err
+	}
+
+	// Ownership proofs only vouch for a confirmed challenge
+	if _, ok := token.Claims["typ"]; ok {
+		return nil, invalid, errors.New("Token can't be used to authenticate")
+	}
 
-		if !token.Valid {
-			respondWithError("Access not allowed", errors.New("Invalid jwt token"), w, http.StatusForbidden)
+	if _, _, _, err := identityClaims(token.Claims); err != nil {
+		return nil, invalid, err
+	}
+
+	// Refuse tokens that were logged out before they expired
+	revoked, err := isTokenRevoked(token.Claims)
+	if err != nil {
+		return nil, "", err
+	}
+	if revoked {
+		return nil, invalid, errors.New("Token has been revoked")
+	}
+
+	return token.Claims, "", nil
+}
+
+// claimsFromContext returns the token claims authMiddleware put in the request
+func claimsFromContext(r *http.Request) map[string]interface{} {
+	claims, _ := r.Context().Value(claimsContextKey).(map[string]interface{})
+	return claims
+}
+
+// adminMiddleware only lets through requests made with an admin token. Other
+// valid tokens get a 403.
+func adminMiddleware(next http.Handler) http.Handler {
+	return authMiddleware(requireRoles(next, "admin"))
+}
+
+// requireRoles only lets through callers with one of the allowed roles, going
+// by the claims authMiddleware put in the request. Others get a 403.
+func requireRoles(next http.Handler, allowed ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasRole(claimsFromContext(r), allowed...) {
+			respondWithError("Access not allowed", roleError(claimsFromContext(r), allowed), w, http.StatusForbidden)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requireSelfOrRoles is requireRoles, but also lets callers through for their
+// own {id}
+func requireSelfOrRoles(next http.Handler, allowed ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r)
+		if sub, _ := claims["sub"].(string); sub == "" || sub != mux.Vars(r)["id"] {
+			if !hasRole(claims, allowed...) {
+				respondWithError("Access not allowed", roleError(claims, allowed), w, http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasRole reports whether the role claim is one of roles, ignoring case. API
+// keys, and the tokens of unverified users, only act with the role of their
+// user when they have every scope of it.
+func hasRole(claims map[string]interface{}, roles ...string) bool {
+	role, _ := claims["role"].(string)
+	keyScopes, isKey := apiKeyScopes(claims)
+	if !isKey {
+		keyScopes, isKey = unverifiedTokenScopes(claims)
+	}
+	for _, allowed := range roles {
+		if strings.EqualFold(role, allowed) {
+			return !isKey || len(missingScopes(scopesFor(role), keyScopes)) == 0
+		}
+	}
+	return false
+}
+
+func roleError(claims map[string]interface{}, allowed []string) error {
+	role, _ := claims["role"].(string)
+	return fmt.Errorf("role %q is not allowed, requires one of: %s", role, strings.Join(allowed, ", "))
+}
+
+// isAdminRequest reports whether the request carries a valid admin token, for
+// routes open to anyone that treat admins differently. Tokens are checked
+// like authMiddleware does, so logged out tokens don't count.
+func isAdminRequest(r *http.Request) bool {
+	claims, _, err := authenticate(r)
+	return err == nil && hasRole(claims, "admin")
+}
+
+// bearerToken extracts the token from a "Bearer {token}" Authorization header
+func bearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", errors.New("Invalid jwt token")
+	}
+
+	// TODO: Make this a bit more robust, parsing-wise
+	authHeaderParts := strings.Split(authHeader, " ")
+	if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != "bearer" {
+		return "", errors.New("Authorization header format must be Bearer {token}")
+	}
+
+	return authHeaderParts[1], nil
+}
+
+// apiKeyCredential extracts the key from an "ApiKey {key}" Authorization
+// header, reporting whether the header uses that scheme
+func apiKeyCredential(r *http.Request) (string, bool) {
+	authHeaderParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(authHeaderParts) != 2 || strings.ToLower(authHeaderParts[0]) != apiKeyScheme {
+		return "", false
+	}
+	return authHeaderParts[1], true
+}
+
+// Ways of checking that a token is refreshed from the front-end it was issued to
+const (
+	originCheckOff    = "off"
+	originCheckOrigin = "origin"
+	originCheckExact  = "exact"
+)
+
+// refreshOriginCheck is how strictly the origin a token was issued to (its iss
+// claim) must match the origin it is refreshed from
+var refreshOriginCheck = originCheckOrigin
+
+func isValidOriginCheck(check string) bool {
+	return check == originCheckOff || check == originCheckOrigin || check == originCheckExact
+}
+
+// requestOrigin returns where a request comes from, preferring the Origin
+// header browsers send over the Referer
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return origin
+	}
+	return r.Referer()
+}
+
+// matchesBoundOrigin reports whether current matches the origin a token was
+// bound to, according to refreshOriginCheck
+func matchesBoundOrigin(bound, current string) bool {
+	switch refreshOriginCheck {
+	case originCheckOff:
+		return true
+	case originCheckExact:
+		return bound == current
+	default:
+		return originOf(bound) == originOf(current)
+	}
+}
+
+// originOf reduces a URL to its scheme and host
+func originOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// tokenLeeway is the clock skew tolerated when checking the exp, nbf and iat
+// claims, so tokens from services with slightly drifting clocks still work
+var tokenLeeway = 60 * time.Second
+
+// parseToken parses a JWT token string and makes sure it's valid
+func parseToken(jwtToken string) (*jwt.Token, error) {
+	now := time.Now()
+
+	var token *jwt.Token
+	var err error
+	for attempt := 0; ; attempt++ {
+		// Try the next key while the signature doesn't match and keys are left
+		moreKeys := false
+		token, err = jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
+			// Valid alg is what we expect
+			if token.Method != signingMethod {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+
+			keys := verificationKeys(token, now)
+			if attempt >= len(keys) {
+				return nil, errors.New("Unknown signing key")
+			}
+			moreKeys = attempt+1 < len(keys)
+			return keys[attempt], nil
+		})
+
+		vErr, ok := err.(*jwt.ValidationError)
+		if !moreKeys || !ok || vErr.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			break
+		}
+	}
+	if err != nil {
+		// The parser checks exp and nbf without any leeway, so only let
+		// those through to be checked again below
+		vErr, ok := err.(*jwt.ValidationError)
+		if !ok || vErr.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+			return nil, err
+		}
+	}
+
+	if err := validateTokenTimes(token.Claims, now); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// identityClaims returns who a token was issued to, making sure the sub,
+// username and role claims are there and are strings
+func identityClaims(claims map[string]interface{}) (string, string, string, error) {
+	sub, ok := claims["sub"].(string)
+	if !ok || sub == "" {
+		return "", "", "", errors.New("Token has no sub claim")
+	}
+	username, ok := claims["username"].(string)
+	if !ok || username == "" {
+		return "", "", "", errors.New("Token has no username claim")
+	}
+	role, ok := claims["role"].(string)
+	if !ok || role == "" {
+		return "", "", "", errors.New("Token has no role claim")
+	}
+	return sub, username, role, nil
+}
+
+// validateTokenTimes checks the exp, nbf and iat claims against now, allowing
+// for tokenLeeway of clock skew. Tokens without an exp claim never expire, so
+// they are refused.
+func validateTokenTimes(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("Token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(tokenLeeway)) {
+		return errors.New("Token is expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-tokenLeeway)) {
+		return errors.New("Token is not valid yet")
+	}
+
+	if iat, ok := claims["iat"].(float64); ok && now.Before(time.Unix(int64(iat), 0).Add(-tokenLeeway)) {
+		return errors.New("Token was issued in the future")
+	}
+
+	return nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+func signTestToken(t *testing.T, claims map[string]interface{}) string {
+	token := jwt.New(jwt.SigningMethodHS256)
+	for key, value := range claims {
+		token.Claims[key] = value
+	}
+	tokenString, err := token.SignedString([]byte(SecretKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenString
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	var claims map[string]interface{}
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims = claimsFromContext(r)
+	}))
+
+	studentToken, err := generateToken("userID", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken := signTestToken(t, map[string]interface{}{"sub": "userID", "exp": time.Now().Add(-time.Hour).Unix()})
+	neverExpiringToken := signTestToken(t, map[string]interface{}{"sub": "userID", "username": "testUser", "role": "student"})
+	anonymousToken := signTestToken(t, map[string]interface{}{"sub": "userID", "role": 7, "exp": time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name   string
+		header string
+		code   int
+	}{
+		{"valid", "Bearer " + studentToken, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"malformed", studentToken, http.StatusUnauthorized},
+		{"invalid", "Bearer not-a-token", http.StatusUnauthorized},
+		{"expired", "Bearer " + expiredToken, http.StatusUnauthorized},
+		{"without expiry", "Bearer " + neverExpiringToken, http.StatusUnauthorized},
+		{"without identity", "Bearer " + anonymousToken, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		claims = nil
+		req := httptest.NewRequest("GET", "/users/userID", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.code {
+			t.Errorf("%s: expected a %d status code response but got: %d", test.name, test.code, rec.Code)
+		}
+		if test.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate header", test.name)
+		}
+	}
+
+	// The last valid request's claims reached the handler
+	req := httptest.NewRequest("GET", "/users/userID", nil)
+	req.Header.Set("Authorization", "Bearer "+studentToken)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if claims["sub"] != "userID" || claims["username"] != "testUser" || claims["role"] != "student" {
+		t.Errorf("Expected the token claims in the context but got: %v", claims)
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	handler := adminMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(role string) int {
+		req := httptest.NewRequest("GET", "/users", nil)
+		if role != "" {
+			token, err := generateToken("userID", "testUser", role, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := request("admin"); code != http.StatusOK {
+		t.Errorf("Expected admins to be let through but got: %d", code)
+	}
+	if code := request("student"); code != http.StatusForbidden {
+		t.Errorf("Expected a 403 status code response but got: %d", code)
+	}
+	if code := request(""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 status code response but got: %d", code)
+	}
+}
+
+func TestIsAdminRequest(t *testing.T) {
+	defer func(store TokenRevocationStore) { revokedTokens = store }(revokedTokens)
+	revokedTokens = newMemoryRevocationStore()
+
+	request := func(role string) *http.Request {
+		token, err := generateToken("adminID", "testAdmin", role, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/users", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	if !isAdminRequest(request("admin")) {
+		t.Error("Expected an admin token to count")
+	}
+	if isAdminRequest(request("student")) || isAdminRequest(httptest.NewRequest("POST", "/users", nil)) {
+		t.Error("Expected only admin tokens to count")
+	}
+
+	// Logged out admin tokens don't count either
+	revokeSubject("adminID")
+	if isAdminRequest(request("admin")) {
+		t.Error("Expected a revoked admin token not to count")
+	}
+}
+
+func TestRequireRoles(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := mux.NewRouter()
+	router.Handle("/roles-only", authMiddleware(requireRoles(ok, "admin", "teacher")))
+	router.Handle("/users/{id}", authMiddleware(requireSelfOrRoles(ok, "admin")))
+
+	request := func(path, sub, role string) *httptest.ResponseRecorder {
+		token, err := generateToken(sub, "testUser", role, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name string
+		path string
+		sub  string
+		role string
+		code int
+	}{
+		{"allowed role", "/roles-only", "userID", "teacher", http.StatusOK},
+		{"role in another case", "/roles-only", "userID", "Admin", http.StatusOK},
+		{"other role", "/roles-only", "userID", "student", http.StatusForbidden},
+		{"own record", "/users/userID", "userID", "student", http.StatusOK},
+		{"someone else's record", "/users/otherID", "userID", "student", http.StatusForbidden},
+		{"admin on someone else's record", "/users/otherID", "userID", "ADMIN", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		rec := request(test.path, test.sub, test.role)
+		if rec.Code != test.code {
+			t.Errorf("%s: expected a %d status code response but got: %d", test.name, test.code, rec.Code)
+		}
+		if rec.Code == http.StatusForbidden && !strings.Contains(rec.Body.String(), "requires one of") {
+			t.Errorf("%s: expected the error to say which roles are allowed but got: %s", test.name, rec.Body.String())
+		}
+	}
+}
+
+func TestParseTokenLeeway(t *testing.T) {
+	defaultLeeway := tokenLeeway
+	defer func() { tokenLeeway = defaultLeeway }()
+	tokenLeeway = 60 * time.Second
+
+	now := time.Now()
+
+	// Just past expiry but within the leeway
+	justExpired := signTestToken(t, map[string]interface{}{"sub": "id", "exp": now.Add(-30 * time.Second).Unix()})
+	if _, err := parseToken(justExpired); err != nil {
+		t.Errorf("Expected a token expired within the leeway to be accepted but got: %v", err)
+	}
+
+	// Expired beyond the leeway
+	expired := signTestToken(t, map[string]interface{}{"sub": "id", "exp": now.Add(-2 * time.Minute).Unix()})
+	if _, err := parseToken(expired); err == nil {
+		t.Error("Expected a token expired beyond the leeway to be rejected")
+	}
+
+	// Not valid for a few more seconds
+	notYet := signTestToken(t, map[string]interface{}{"sub": "id", "nbf": now.Add(30 * time.Second).Unix(), "exp": now.Add(time.Hour).Unix()})
+	if _, err := parseToken(notYet); err != nil {
+		t.Errorf("Expected a token becoming valid within the leeway to be accepted but got: %v", err)
+	}
+
+	// Issued well in the future
+	future := signTestToken(t, map[string]interface{}{"sub": "id", "iat": now.Add(5 * time.Minute).Unix(), "exp": now.Add(time.Hour).Unix()})
+	if _, err := parseToken(future); err == nil {
+		t.Error("Expected a token issued in the future to be rejected")
+	}
+
+	// The leeway never excuses a bad signature
+	tampered := justExpired[:len(justExpired)-2] + "xx"
+	if _, err := parseToken(tampered); err == nil {
+		t.Error("Expected a tampered token to be rejected")
+	}
+}
+
+func TestMatchesBoundOrigin(t *testing.T) {
+	defer func() { refreshOriginCheck = originCheckOrigin }()
+
+	cases := []struct {
+		check   string
+		bound   string
+		current string
+		matches bool
+	}{
+		{originCheckOrigin, "https://app.buzz.com/login", "https://app.buzz.com/dashboard", true},
+		{originCheckOrigin, "https://app.buzz.com/login", "https://APP.buzz.com", true},
+		{originCheckOrigin, "https://app.buzz.com/login", "https://evil.com/login", false},
+		{originCheckOrigin, "https://app.buzz.com/login", "http://app.buzz.com/login", false},
+		{originCheckOrigin, "https://app.buzz.com/login", "", false},
+		{originCheckOrigin, "", "", true},
+		{originCheckExact, "https://app.buzz.com/login", "https://app.buzz.com/login", true},
+		{originCheckExact, "https://app.buzz.com/login", "https://app.buzz.com/dashboard", false},
+		{originCheckOff, "https://app.buzz.com/login", "https://evil.com", true},
+	}
+
+	for _, c := range cases {
+		refreshOriginCheck = c.check
+		if matches := matchesBoundOrigin(c.bound, c.current); matches != c.matches {
+			t.Errorf("%s check of %q against %q: expected %v but got %v", c.check, c.bound, c.current, c.matches, matches)
+		}
+	}
+}
+
+func TestParseTokenSecretRotation(t *testing.T) {
+	defer func(current, previous, mode string, until time.Time) {
+		SecretKey, PreviousSecretKey, secretRotation, previousSecretUntil = current, previous, mode, until
+	}(SecretKey, PreviousSecretKey, secretRotation, previousSecretUntil)
+
+	oldToken, err := generateToken("id", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate the secret
+	PreviousSecretKey, SecretKey = SecretKey, "new-secret"
+
+	newToken, err := generateToken("id", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Within the grace window both secrets are accepted
+	secretRotation = secretRotationGrace
+	previousSecretUntil = time.Now().Add(time.Minute)
+	if _, err := parseToken(oldToken); err != nil {
+		t.Errorf("Expected a token signed with the previous secret to be accepted during the grace window but got: %v", err)
+	}
+	if _, err := parseToken(newToken); err != nil {
+		t.Errorf("Expected a token signed with the current secret to be accepted but got: %v", err)
+	}
+
+	// After it only the current one is
+	previousSecretUntil = time.Now().Add(-time.Minute)
+	if _, err := parseToken(oldToken); err == nil {
+		t.Error("Expected a token signed with the previous secret to be rejected after the grace window")
+	}
+
+	// By kid, tokens signed with the previous secret are accepted until they expire
+	secretRotation = secretRotationKID
+	if _, err := parseToken(oldToken); err != nil {
+		t.Errorf("Expected a token naming the previous key to be accepted but got: %v", err)
+	}
+	if _, err := parseToken(newToken); err != nil {
+		t.Errorf("Expected a token naming the current key to be accepted but got: %v", err)
+	}
+
+	// But a token claiming a key it wasn't signed with is not
+	forged := jwt.New(jwt.SigningMethodHS256)
+	forged.Header["kid"] = keyID(SecretKey)
+	forged.Claims["sub"] = "id"
+	forgedToken, err := forged.SignedString([]byte("other-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseToken(forgedToken); err == nil {
+		t.Error("Expected a token signed with an unknown secret to be rejected")
+	}
+}
+
+// restoreSigningKeys puts back the signing keys a test replaced
+func restoreSigningKeys(method jwt.SigningMethod, private crypto.PrivateKey, public, previous crypto.PublicKey) {
+	signingMethod, privateKey, publicKey, previousPublicKey = method, private, public, previous
+}
+
+// writeTestPEM writes der as a PEM block of blockType to a temporary file,
+// returning its path
+func writeTestPEM(t *testing.T, blockType string, der []byte) string {
+	f, err := ioutil.TempFile("", "jwt-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestParseTokenRS256(t *testing.T) {
+	defer restoreSigningKeys(signingMethod, privateKey, publicKey, previousPublicKey)
+
+	hsToken, err := generateToken("id", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := ioutil.TempFile("", "jwt-rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyFile.Close()
+
+	if err := loadSigningKeys(keyFile.Name(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rsToken, err := generateToken("id", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := parseToken(rsToken)
+	if err != nil {
+		t.Fatalf("Expected an RS256 token to be accepted but got: %v", err)
+	}
+	if token.Header["alg"] != "RS256" {
+		t.Errorf("Expected the token to be signed with RS256 but got: %v", token.Header["alg"])
+	}
+
+	// HS256 tokens are refused once RS256 is configured, so the public key
+	// can't be used as an HMAC secret either
+	if _, err := parseToken(hsToken); err == nil {
+		t.Error("Expected an HS256 token to be rejected")
+	}
+}
+
+func TestKeyRotationES256(t *testing.T) {
+	defer restoreSigningKeys(signingMethod, privateKey, publicKey, previousPublicKey)
+	defer func(mode string, until time.Time) {
+		secretRotation, previousSecretUntil = mode, until
+	}(secretRotation, previousSecretUntil)
+
+	// HS256 secrets are never published
+	if keys := jsonWebKeys(time.Now()); len(keys) != 0 {
+		t.Errorf("Expected no keys with HS256 but got: %+v", keys)
+	}
+
+	writeKey := func() (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		private, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writeTestPEM(t, "PRIVATE KEY", private), writeTestPEM(t, "PUBLIC KEY", public)
+	}
+	oldPrivate, oldPublic := writeKey()
+	defer os.Remove(oldPrivate)
+	defer os.Remove(oldPublic)
+	newPrivate, newPublic := writeKey()
+	defer os.Remove(newPrivate)
+	defer os.Remove(newPublic)
+
+	if err := loadSigningKeys(oldPrivate, oldPublic); err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := generateToken("id", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err := parseToken(oldToken); err != nil || token.Header["alg"] != "ES256" {
+		t.Fatalf("Expected an ES256 token to be accepted but got: %v", err)
+	}
+
+	// The public key has to be the private key's
+	if err := loadSigningKeys(newPrivate, oldPublic); err == nil {
+		t.Error("Expected a mismatched public key to be refused")
+	}
+
+	// Rotate the key pair
+	if err := loadSigningKeys(newPrivate, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadPreviousPublicKey(oldPublic); err != nil {
+		t.Fatal(err)
+	}
+
+	secretRotation = secretRotationKID
+	if _, err := parseToken(oldToken); err != nil {
+		t.Errorf("Expected a token signed with the previous key to be accepted but got: %v", err)
+	}
+	keys := jsonWebKeys(time.Now())
+	if len(keys) != 2 || keys[0].KeyID != publicKeyID(publicKey) || keys[1].KeyID != publicKeyID(previousPublicKey) {
+		t.Fatalf("Expected the current and previous keys to be published but got: %+v", keys)
+	}
+	if keys[0].KeyType != "EC" || keys[0].Curve != "P-256" || keys[0].Algorithm != "ES256" || len(keys[0].X) != 43 || len(keys[0].Y) != 43 {
+		t.Errorf("Expected a P-256 JWK but got: %+v", keys[0])
+	}
+
+	// Once the grace window is over the previous key is retired
+	secretRotation = secretRotationGrace
+	previousSecretUntil = time.Now().Add(-time.Minute)
+	if _, err := parseToken(oldToken); err == nil {
+		t.Error("Expected a token signed with the previous key to be rejected after the grace window")
+	}
+	if keys := jsonWebKeys(time.Now()); len(keys) != 1 {
+		t.Errorf("Expected only the current key to be published but got: %+v", keys)
+	}
+
+	// Tokens are only accepted with the current algorithm
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicPath := writeTestPEM(t, "PUBLIC KEY", rsaPublic)
+	defer os.Remove(rsaPublicPath)
+	if err := loadPreviousPublicKey(rsaPublicPath); err == nil {
+		t.Error("Expected a previous RSA key to be refused along with an ECDSA key")
+	}
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"gitlab.fg/go/logger"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// migrationFiles are the migrations built into the binary. Each version has
+// an up and a down file, a JSON array of the database commands that apply
+// and revert it, run in order. What commands can't express goes in
+// migrationSteps. A version can also have an up and a down .sql file, run on
+// sqlMigrationDB when users are stored in PostgreSQL.
+//
+//go:embed migrations/*.json migrations/*.sql
+var migrationFiles embed.FS
+
+// sqlMigrationDB is the PostgreSQL database users are stored in, nil unless
+// -user-store picks it. Its migrations are recorded in its own
+// schema_migrations table, so a database can be added to a deployment whose
+// MongoDB is already migrated.
+var sqlMigrationDB *sql.DB
+
+// schemaCheck is whether the server refuses to start on a database schema
+// other than the one this build expects. It's on by default because the
+// migrations are the only place indexes are created, the unique emails,
+// usernames and group names and the expiry of sessions included: serving a
+// schema that's behind would quietly go without them. A deployment runs
+// `users migrate up`, or starts with -migrate-on-start, before serving. With
+// the check off a mismatch is only logged.
+var schemaCheck = true
+
+// migrationLockTimeout is how long migrating waits for another instance
+// migrating at the same time, after which its lock is taken to be of an
+// instance that died migrating
+var migrationLockTimeout = 5 * time.Minute
+
+var (
+	errSchemaBehind    = errors.New("the database schema is behind the one this build expects, run `users migrate up` or start with -migrate-on-start")
+	errSchemaAhead     = errors.New("the database schema is ahead of the one this build expects, deploy a newer build or migrate down with it")
+	errMigrationLocked = errors.New("another instance is migrating the database")
+)
+
+// migrationFilePattern is what migration files are named like, e.g.
+// 0001_group_indexes.up.json or 0005_users_table.down.sql
+var migrationFilePattern = regexp.MustCompile(`^([0-9]+)_([a-z0-9_]+)\.(up|down)\.(json|sql)$`)
+
+// migration is a versioned change to the database schema
+type migration struct {
+	version int
+	name    string
+	up      []bson.D
+	down    []bson.D
+	// sqlUp and sqlDown are the SQL applying and reverting it in
+	// PostgreSQL, empty when it doesn't change it
+	sqlUp   string
+	sqlDown string
+	// step runs after up for what commands can't express, and isn't reverted
+	step func(db *mgo.Database) error
+}
+
+// migrationSteps are the steps of the built-in migrations, by version
+var migrationSteps = map[int]func(db *mgo.Database) error{
+	4: recomputeUsernameSkeletons,
+}
+
+// appliedMigration is how a migration applied is recorded
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// migrationCollection returns the collection of the migrations applied
+func migrationCollection(db *mgo.Database) *mgo.Collection {
+	return db.C("schema_migrations")
+}
+
+// loadMigrations reads the migrations of files, by version
+func loadMigrations(files fs.FS) ([]migration, error) {
+	paths, err := fs.Glob(files, "migrations/*")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, p := range paths {
+		match := migrationFilePattern.FindStringSubmatch(path.Base(p))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", p)
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %s", p)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.name, match[2])
+		}
+
+		data, err := fs.ReadFile(files, p)
+		if err != nil {
+			return nil, err
+		}
+		if match[4] == "sql" {
+			if match[3] == "up" {
+				m.sqlUp = string(data)
+			} else {
+				m.sqlDown = string(data)
+			}
+			continue
+		}
+		commands, err := parseMigrationCommands(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file %s: %v", p, err)
+		}
+		if match[3] == "up" {
+			m.up = commands
+		} else {
+			m.down = commands
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == nil || m.down == nil {
+			return nil, fmt.Errorf("migration %d %s needs both an up and a down file", m.version, m.name)
+		}
+		if (m.sqlUp == "") != (m.sqlDown == "") {
+			return nil, fmt.Errorf("migration %d %s needs both an up and a down SQL file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// builtinMigrations returns the migrations built into the binary
+func builtinMigrations() ([]migration, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	for i := range migrations {
+		migrations[i].step = migrationSteps[migrations[i].version]
+	}
+	return migrations, nil
+}
+
+// latestVersion is the version of the schema once migrations are all
+// applied, 0 when there are none
+func latestVersion(migrations []migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// parseMigrationCommands reads the JSON array of database commands data
+// holds. The fields of commands keep their order, since the name of a
+// command comes first and the keys of an index are in order.
+func parseMigrationCommands(data []byte) ([]bson.D, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	value, err := readOrderedJSON(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the commands")
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("expected an array of commands")
+	}
+	commands := make([]bson.D, len(values))
+	for i, value := range values {
+		command, ok := value.(bson.D)
+		if !ok || len(command) == 0 {
+			return nil, fmt.Errorf("command %d isn't a command", i+1)
+		}
+		commands[i] = command
+	}
+	return commands, nil
+}
+
+// readOrderedJSON reads the next JSON value of decoder, objects as bson.D
+func readOrderedJSON(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token := token.(type) {
+	case json.Delim:
+		switch token {
+		case '{':
+			doc := bson.D{}
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := readOrderedJSON(decoder)
+				if err != nil {
+					return nil, err
+				}
+				doc = append(doc, bson.DocElem{Name: key.(string), Value: value})
+			}
+			_, err := decoder.Token()
+			return doc, err
+		case '[':
+			array := []interface{}{}
+			for decoder.More() {
+				value, err := readOrderedJSON(decoder)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+			_, err := decoder.Token()
+			return array, err
+		}
+		return nil, fmt.Errorf("unexpected %v", token)
+	case json.Number:
+		if n, err := token.Int64(); err == nil {
+			return n, nil
+		}
+		return token.Float64()
+	default:
+		return token, nil
+	}
+}
+
+// appliedMigrations returns the migrations applied to db, by version
+func appliedMigrations(db *mgo.Database) ([]appliedMigration, error) {
+	var applied []appliedMigration
+	if err := migrationCollection(db).Find(nil).Sort("_id").All(&applied); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// schemaVersion returns the version of the schema of db: the latest
+// migration applied, 0 for none
+func schemaVersion(db *mgo.Database) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	if len(applied) == 0 {
+		return 0, nil
+	}
+	return applied[len(applied)-1].Version, nil
+}
+
+// prepareSchema applies the migrations not applied yet to db when
+// migrateOnStart, then checks its schema is the one this build expects. A
+// schema that isn't fails it when schemaCheck is on, and is logged when not.
+func prepareSchema(l *logger.ServiceLogger, db *mgo.Database, migrateOnStart bool) error {
+	migrations, err := builtinMigrations()
+	if err != nil {
+		return err
+	}
+	if migrateOnStart {
+		applied, err := migrateUp(db, migrations, latestVersion(migrations))
+		for _, m := range applied {
+			l.Info("Applied migration", "Main", "version", strconv.Itoa(m.version), "name", m.name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := checkSchemaVersion(db, migrations); err != nil {
+		if schemaCheck {
+			return err
+		}
+		l.Info("Database schema isn't the one expected, serving without the indexes of the migrations not applied", "Main", "error", err.Error())
+	}
+	return nil
+}
+
+// checkSchemaVersion makes sure the schema of db is the one migrations lead
+// to, so a build never serves traffic against a schema it doesn't know
+func checkSchemaVersion(db *mgo.Database, migrations []migration) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	switch expected := latestVersion(migrations); {
+	case version < expected:
+		return fmt.Errorf("%v (version %d, expected %d)", errSchemaBehind, version, expected)
+	case version > expected:
+		return fmt.Errorf("%v (version %d, expected %d)", errSchemaAhead, version, expected)
+	}
+	if sqlMigrationDB == nil {
+		return nil
+	}
+
+	applied, err := appliedSQLMigrations(sqlMigrationDB)
+	if err != nil {
+		return err
+	}
+	version = 0
+	if len(applied) > 0 {
+		version = applied[len(applied)-1].Version
+	}
+	switch expected := latestVersion(migrations); {
+	case version < expected:
+		return fmt.Errorf("%v (PostgreSQL version %d, expected %d)", errSchemaBehind, version, expected)
+	case version > expected:
+		return fmt.Errorf("%v (PostgreSQL version %d, expected %d)", errSchemaAhead, version, expected)
+	}
+	return nil
+}
+
+// migrateUp applies the migrations of db not applied yet, up to version
+// target, returning those it applied
+func migrateUp(db *mgo.Database, migrations []migration, target int) ([]migration, error) {
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	isApplied := map[int]bool{}
+	for _, m := range applied {
+		isApplied[m.Version] = true
+	}
+	isSQLApplied, err := appliedSQLVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []migration
+	for _, m := range migrations {
+		pendingSQL := sqlMigrationDB != nil && !isSQLApplied[m.version]
+		if m.version > target || (isApplied[m.version] && !pendingSQL) {
+			continue
+		}
+		if !isApplied[m.version] {
+			if err := runMigrationCommands(db, m.up); err != nil {
+				return done, fmt.Errorf("unable to apply migration %d %s: %v", m.version, m.name, err)
+			}
+			if m.step != nil {
+				if err := m.step(db); err != nil {
+					return done, fmt.Errorf("unable to apply migration %d %s: %v", m.version, m.name, err)
+				}
+			}
+			if err := migrationCollection(db).Insert(appliedMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}); err != nil {
+				return done, err
+			}
+		}
+		if pendingSQL {
+			if err := runSQLMigration(sqlMigrationDB, m, true); err != nil {
+				return done, fmt.Errorf("unable to apply migration %d %s to PostgreSQL: %v", m.version, m.name, err)
+			}
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// migrateDown reverts the migrations of db applied after version target,
+// latest first, returning those it reverted
+func migrateDown(db *mgo.Database, migrations []migration, target int) ([]migration, error) {
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	isSQLApplied, err := appliedSQLVersions()
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]migration{}
+	for _, m := range migrations {
+		byVersion[m.version] = m
+	}
+
+	// Versions applied to either database are reverted from both, latest
+	// first
+	names := map[int]string{}
+	for _, m := range applied {
+		names[m.Version] = m.Name
+	}
+	isApplied := map[int]bool{}
+	for version := range names {
+		isApplied[version] = true
+	}
+	for version := range isSQLApplied {
+		if _, ok := names[version]; !ok {
+			names[version] = byVersion[version].name
+		}
+	}
+	versions := []int{}
+	for version := range names {
+		if version > target {
+			versions = append(versions, version)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	var done []migration
+	for _, version := range versions {
+		m, ok := byVersion[version]
+		if !ok {
+			return done, fmt.Errorf("unable to revert migration %d %s: this build doesn't have it", version, names[version])
+		}
+		if isSQLApplied[version] {
+			if err := runSQLMigration(sqlMigrationDB, m, false); err != nil {
+				return done, fmt.Errorf("unable to revert migration %d %s from PostgreSQL: %v", m.version, m.name, err)
+			}
+		}
+		if isApplied[version] {
+			if err := runMigrationCommands(db, m.down); err != nil {
+				return done, fmt.Errorf("unable to revert migration %d %s: %v", m.version, m.name, err)
+			}
+			if err := migrationCollection(db).RemoveId(m.version); err != nil {
+				return done, err
+			}
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// runMigrationCommands runs commands on db, in order
+func runMigrationCommands(db *mgo.Database, commands []bson.D) error {
+	for _, command := range commands {
+		var result bson.M
+		if err := db.Run(command, &result); err != nil {
+			return fmt.Errorf("%s: %v", command[0].Name, err)
+		}
+	}
+	return nil
+}
+
+// appliedSQLMigrations returns the migrations applied to the PostgreSQL
+// database db, by version
+func appliedSQLMigrations(db *sql.DB) ([]appliedMigration, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL)")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := []appliedMigration{}
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// appliedSQLVersions returns the versions applied to sqlMigrationDB, none
+// when users aren't stored in PostgreSQL
+func appliedSQLVersions() (map[int]bool, error) {
+	isApplied := map[int]bool{}
+	if sqlMigrationDB == nil {
+		return isApplied, nil
+	}
+	applied, err := appliedSQLMigrations(sqlMigrationDB)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range applied {
+		isApplied[m.Version] = true
+	}
+	return isApplied, nil
+}
+
+// runSQLMigration applies or reverts the SQL of m on db, recording it in the
+// same transaction. Every version is recorded, SQL or not, so the version of
+// the schema reads the same in both databases.
+func runSQLMigration(db *sql.DB, m migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements, record := m.sqlDown, "DELETE FROM schema_migrations WHERE version = $1"
+	args := []interface{}{m.version}
+	if up {
+		statements, record = m.sqlUp, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)"
+		args = append(args, m.name, time.Now())
+	}
+	if statements != "" {
+		if _, err := tx.Exec(statements); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockMigrations keeps other instances from migrating db at the same time,
+// waiting up to migrationLockTimeout for them. The lock returned must be
+// released.
+func lockMigrations(db *mgo.Database) (func(), error) {
+	locks := db.C("schema_migrations_lock")
+	deadline := time.Now().Add(migrationLockTimeout)
+	for {
+		// Locks this old are of instances that died migrating
+		locks.Remove(bson.M{"_id": "lock", "locked_at": bson.M{"$lt": time.Now().Add(-migrationLockTimeout)}})
+
+		err := locks.Insert(bson.M{"_id": "lock", "locked_at": time.Now()})
+		if err == nil {
+			return func() { locks.RemoveId("lock") }, nil
+		}
+		if !mgo.IsDup(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errMigrationLocked
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// runMigrateCommand runs `users migrate` with args:
+//
+//	up [version]    applies the migrations not applied yet, up to version
+//	down [version]  reverts the migrations after version, the latest one by default
+//	status          lists the migrations and whether they're applied
+func runMigrateCommand(db *mgo.Database, migrations []migration, args []string, out io.Writer) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: users migrate up [version] | down [version] | status")
+	}
+
+	target := -1
+	if len(args) == 2 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %s", args[1])
+		}
+		target = version
+	}
+
+	switch args[0] {
+	case "up":
+		if target < 0 {
+			target = latestVersion(migrations)
+		}
+		done, err := migrateUp(db, migrations, target)
+		for _, m := range done {
+			fmt.Fprintf(out, "applied %d %s\n", m.version, m.name)
+		}
+		return err
+	case "down":
+		if target < 0 {
+			applied, err := appliedMigrations(db)
+			if err != nil {
+				return err
+			}
+			if len(applied) < 2 {
+				target = 0
+			} else {
+				target = applied[len(applied)-2].Version
+			}
+		}
+		done, err := migrateDown(db, migrations, target)
+		for _, m := range done {
+			fmt.Fprintf(out, "reverted %d %s\n", m.version, m.name)
+		}
+		return err
+	case "status":
+		if target >= 0 {
+			return errors.New("usage: users migrate status")
+		}
+		return writeMigrationStatus(db, migrations, out)
+	default:
+		return fmt.Errorf("unknown migrate command %s, expected up, down or status", args[0])
+	}
+}
+
+// writeMigrationStatus lists the migrations of this build and of db, with
+// when they were applied
+func writeMigrationStatus(db *mgo.Database, migrations []migration, out io.Writer) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	appliedAt := map[int]time.Time{}
+	for _, m := range applied {
+		appliedAt[m.Version] = m.AppliedAt
+	}
+
+	sqlAppliedAt := map[int]time.Time{}
+	if sqlMigrationDB != nil {
+		sqlApplied, err := appliedSQLMigrations(sqlMigrationDB)
+		if err != nil {
+			return err
+		}
+		for _, m := range sqlApplied {
+			sqlAppliedAt[m.Version] = m.AppliedAt
+		}
+	}
+	status := func(appliedAt map[int]time.Time, version int) string {
+		if at, ok := appliedAt[version]; ok {
+			return at.UTC().Format(time.RFC3339)
+		}
+		return "pending"
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if sqlMigrationDB != nil {
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED\tPOSTGRESQL")
+	} else {
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	}
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.version] = true
+		if sqlMigrationDB != nil {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", m.version, m.name, status(appliedAt, m.version), status(sqlAppliedAt, m.version))
+		} else {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.version, m.name, status(appliedAt, m.version))
+		}
+	}
+	for _, m := range applied {
+		if !known[m.Version] {
+			fmt.Fprintf(w, "%d\t%s\t%s (unknown to this build)\n", m.Version, m.Name, m.AppliedAt.UTC().Format(time.RFC3339))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	version, _ := schemaVersion(db)
+	fmt.Fprintf(out, "\nschema version %d, this build expects %d\n", version, latestVersion(migrations))
+	return nil
+}
@@ -0,0 +1,54 @@
+-- Users stored in PostgreSQL, with -user-store postgres. Empty strings are
+-- stored as NULL, so the unique indexes leave users without a value alone
+-- like the sparse indexes of MongoDB do.
+CREATE TABLE users (
+  id text PRIMARY KEY,
+  email text,
+  email_index text,
+  email_key text,
+  first_name text,
+  last_name text,
+  password text,
+  role text,
+  username text,
+  username_key text,
+  username_skeleton text,
+  date_of_birth text,
+  accepted_tos_version text,
+  status text,
+  "timestamp" bigint NOT NULL DEFAULT 0,
+  updated_at timestamptz,
+  deleted_at timestamptz,
+  purge_at timestamptz,
+  erased_at timestamptz,
+  last_login_at timestamptz,
+  password_changed_at timestamptz,
+  username_changed_at timestamptz,
+  display_name text,
+  avatar_url text,
+  timezone text,
+  locale text,
+  phone text
+);
+
+CREATE UNIQUE INDEX users_email_key ON users (email);
+CREATE UNIQUE INDEX users_username_key ON users (username);
+CREATE UNIQUE INDEX users_email_key_key ON users (email_key);
+CREATE UNIQUE INDEX users_email_index_key ON users (email_index);
+CREATE INDEX users_username_key_idx ON users (username_key);
+CREATE INDEX users_username_skeleton_idx ON users (username_skeleton);
+CREATE INDEX users_first_name_idx ON users (first_name);
+CREATE INDEX users_last_name_idx ON users (last_name);
+CREATE INDEX users_timestamp_id_idx ON users ("timestamp", id);
+CREATE INDEX users_updated_at_id_idx ON users (updated_at, id);
+
+-- Identities of a provider log in to a single account, which has at most
+-- one of each provider
+CREATE TABLE user_identities (
+  provider text NOT NULL,
+  subject text NOT NULL,
+  user_id text NOT NULL REFERENCES users (id) ON UPDATE CASCADE ON DELETE CASCADE,
+  linked_at timestamptz NOT NULL,
+  PRIMARY KEY (provider, subject),
+  UNIQUE (user_id, provider)
+);
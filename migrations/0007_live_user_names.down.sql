@@ -0,0 +1,11 @@
+-- Fails while a deleted user and another share a name, which can only be
+-- once -reserve-deleted-names has been turned off
+DROP INDEX users_email_key;
+DROP INDEX users_username_key;
+DROP INDEX users_email_key_key;
+DROP INDEX users_email_index_key;
+
+CREATE UNIQUE INDEX users_email_key ON users (email);
+CREATE UNIQUE INDEX users_username_key ON users (username);
+CREATE UNIQUE INDEX users_email_key_key ON users (email_key);
+CREATE UNIQUE INDEX users_email_index_key ON users (email_index);
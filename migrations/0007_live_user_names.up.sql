@@ -0,0 +1,11 @@
+-- Only users that aren't deleted need unique names, whether deleted users
+-- keep theirs reserved is up to -reserve-deleted-names
+DROP INDEX users_email_key;
+DROP INDEX users_username_key;
+DROP INDEX users_email_key_key;
+DROP INDEX users_email_index_key;
+
+CREATE UNIQUE INDEX users_email_key ON users (email) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX users_username_key ON users (username) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX users_email_key_key ON users (email_key) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX users_email_index_key ON users (email_index) WHERE deleted_at IS NULL;
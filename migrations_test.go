@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBuiltinMigrations(t *testing.T) {
+	migrations, err := builtinMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Expected migration versions to follow each other but got %d after %d", m.version, i)
+		}
+		for _, command := range append(m.up, m.down...) {
+			if _, ok := command[0].Value.(string); !ok {
+				t.Errorf("Expected every command of %s to name its collection first but got: %v", m.name, command)
+			}
+		}
+	}
+	for version := range migrationSteps {
+		if version < 1 || version > len(migrations) || migrations[version-1].step == nil {
+			t.Errorf("Expected the step of migration %d to belong to a built-in migration", version)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(data string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(data)} }
+	migrations, err := loadMigrations(fstest.MapFS{
+		"migrations/0002_second.up.json":   file(`[{"create": "b"}]`),
+		"migrations/0002_second.down.json": file(`[{"drop": "b"}]`),
+		"migrations/0001_first.up.json":    file(`[{"create": "a"}]`),
+		"migrations/0001_first.down.json":  file(`[]`),
+		"migrations/0002_second.up.sql":    file(`CREATE TABLE b ();`),
+		"migrations/0002_second.down.sql":  file(`DROP TABLE b;`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].name != "first" || migrations[1].version != 2 || len(migrations[0].down) != 0 {
+		t.Errorf("Expected both migrations in order but got: %+v", migrations)
+	}
+	if migrations[0].sqlUp != "" || migrations[1].sqlUp != "CREATE TABLE b ();" || migrations[1].sqlDown != "DROP TABLE b;" {
+		t.Errorf("Expected only the second migration to have SQL but got: %+v", migrations)
+	}
+	if latestVersion(migrations) != 2 {
+		t.Errorf("Expected the latest version to be 2 but got: %d", latestVersion(migrations))
+	}
+
+	for name, files := range map[string]fstest.MapFS{
+		"no down":       {"migrations/0001_first.up.json": file(`[]`)},
+		"bad name":      {"migrations/first.up.json": file(`[]`), "migrations/first.down.json": file(`[]`)},
+		"renamed":       {"migrations/0001_first.up.json": file(`[]`), "migrations/0001_other.down.json": file(`[]`)},
+		"not an array":  {"migrations/0001_first.up.json": file(`{"create": "a"}`), "migrations/0001_first.down.json": file(`[]`)},
+		"not a command": {"migrations/0001_first.up.json": file(`["create"]`), "migrations/0001_first.down.json": file(`[]`)},
+		"trailing data": {"migrations/0001_first.up.json": file(`[] []`), "migrations/0001_first.down.json": file(`[]`)},
+		"version zero":  {"migrations/0000_first.up.json": file(`[]`), "migrations/0000_first.down.json": file(`[]`)},
+		"invalid json":  {"migrations/0001_first.up.json": file(`[{`), "migrations/0001_first.down.json": file(`[]`)},
+		"empty command": {"migrations/0001_first.up.json": file(`[{}]`), "migrations/0001_first.down.json": file(`[]`)},
+		"no down sql":   {"migrations/0001_first.up.json": file(`[]`), "migrations/0001_first.down.json": file(`[]`), "migrations/0001_first.up.sql": file(`SELECT 1;`)},
+		"only sql":      {"migrations/0001_first.up.sql": file(`SELECT 1;`), "migrations/0001_first.down.sql": file(`SELECT 1;`)},
+	} {
+		if _, err := loadMigrations(files); err == nil {
+			t.Errorf("Expected migrations with %s to be refused", name)
+		}
+	}
+}
+
+func TestParseMigrationCommands(t *testing.T) {
+	commands, err := parseMigrationCommands([]byte(`[{"createIndexes": "a", "indexes": [{"key": {"z": 1, "a": -1}, "sparse": true, "weight": 0.5}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{
+		{Name: "createIndexes", Value: "a"},
+		{Name: "indexes", Value: []interface{}{bson.D{
+			{Name: "key", Value: bson.D{{Name: "z", Value: int64(1)}, {Name: "a", Value: int64(-1)}}},
+			{Name: "sparse", Value: true},
+			{Name: "weight", Value: 0.5},
+		}}},
+	}
+	if len(commands) != 1 || !bytes.Equal(mustMarshalBSON(t, commands[0]), mustMarshalBSON(t, expected)) {
+		t.Errorf("Expected the command with its fields in order but got: %v", commands)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	session, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("buzz-test-migrations")
+	defer db.DropDatabase()
+
+	migrations, err := loadMigrations(fstest.MapFS{
+		"migrations/0001_widgets.up.json":   &fstest.MapFile{Data: []byte(`[{"create": "widgets"}]`)},
+		"migrations/0001_widgets.down.json": &fstest.MapFile{Data: []byte(`[{"drop": "widgets"}]`)},
+		"migrations/0002_index.up.json":     &fstest.MapFile{Data: []byte(`[{"createIndexes": "widgets", "indexes": [{"key": {"name": 1}, "name": "name_1"}]}]`)},
+		"migrations/0002_index.down.json":   &fstest.MapFile{Data: []byte(`[{"dropIndexes": "widgets", "index": "name_1"}]`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate := func(args ...string) string {
+		var out bytes.Buffer
+		if err := runMigrateCommand(db, migrations, args, &out); err != nil {
+			t.Fatalf("Expected migrate %v to succeed but got: %v", args, err)
+		}
+		return out.String()
+	}
+
+	if err := checkSchemaVersion(db, migrations); err == nil || !strings.Contains(err.Error(), errSchemaBehind.Error()) {
+		t.Errorf("Expected an empty database to be behind but got: %v", err)
+	}
+	if out := migrate("up", "1"); out != "applied 1 widgets\n" {
+		t.Errorf("Expected only the first migration to be applied but got: %q", out)
+	}
+	if out := migrate("up"); out != "applied 2 index\n" {
+		t.Errorf("Expected the rest to be applied but got: %q", out)
+	}
+	if out := migrate("up"); out != "" {
+		t.Errorf("Expected nothing left to apply but got: %q", out)
+	}
+	if err := checkSchemaVersion(db, migrations); err != nil {
+		t.Errorf("Expected the schema to be up to date but got: %v", err)
+	}
+	if out := migrate("status"); !strings.Contains(out, "schema version 2, this build expects 2") || strings.Contains(out, "pending") {
+		t.Errorf("Expected every migration to be applied but got:\n%s", out)
+	}
+
+	// Builds older than the schema refuse it
+	if err := checkSchemaVersion(db, migrations[:1]); err == nil || !strings.Contains(err.Error(), errSchemaAhead.Error()) {
+		t.Errorf("Expected the schema to be ahead of an older build but got: %v", err)
+	}
+
+	if out := migrate("down"); out != "reverted 2 index\n" {
+		t.Errorf("Expected the latest migration to be reverted but got: %q", out)
+	}
+	if out := migrate("status"); !strings.Contains(out, "pending") {
+		t.Errorf("Expected the reverted migration to be pending but got:\n%s", out)
+	}
+	if out := migrate("down", "0"); out != "reverted 1 widgets\n" {
+		t.Errorf("Expected every migration to be reverted but got: %q", out)
+	}
+}
+
+func TestMigrateCommandUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"sideways"}, {"up", "latest"}, {"down", "-1"}, {"status", "1"}, {"up", "1", "2"}} {
+		if err := runMigrateCommand(nil, nil, args, &bytes.Buffer{}); err == nil {
+			t.Errorf("Expected migrate %v to be refused", args)
+		}
+	}
+}
+
+func mustMarshalBSON(t *testing.T, value interface{}) []byte {
+	data, err := bson.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRecomputeUsernameSkeletons(t *testing.T) {
+	session, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("buzz-test-migrations")
+	defer db.DropDatabase()
+
+	// Skeletons as they were stored before "і" mapped to "l"
+	users := db.C("users")
+	stale := model.User{ID: "staleID", Username: "b\u0456ll", UsernameSkeleton: "bill"}
+	current := model.User{ID: "currentID", Username: "alice", UsernameSkeleton: usernameSkeleton("alice")}
+	for _, user := range []model.User{stale, current} {
+		if err := users.Insert(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := recomputeUsernameSkeletons(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []model.User{stale, current} {
+		var stored model.User
+		if err := users.FindId(user.ID).One(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.UsernameSkeleton != usernameSkeleton(user.Username) {
+			t.Errorf("Expected %q to have skeleton %q but got %q", user.Username, usernameSkeleton(user.Username), stored.UsernameSkeleton)
+		}
+	}
+}
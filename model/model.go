@@ -1,37 +1,406 @@
 package model
 
+import "time"
+
 // User struct describes a user's properties
 type User struct {
-	ID        string `bson:"_id" json:"id"`
-	Email     string `bson:"email" json:"email"`
-	FirstName string `bson:"first_name" json:"first_name"`
-	LastName  string `bson:"last_name" json:"last_name"`
-	Password  string `bson:"password" json:"password"`
-	Role      string `bson:"role" json:"role"`
-	Username  string `bson:"username" json:"username"`
-	Timestamp int64  `bson:"timestamp" json:"timestamp"`
+	ID                 string     `bson:"_id" json:"id"`
+	Email              string     `bson:"email" json:"email"`
+	EmailIndex         string     `bson:"email_index,omitempty" json:"-"`
+	EmailKey           string     `bson:"email_key,omitempty" json:"-"`
+	FirstName          string     `bson:"first_name" json:"first_name"`
+	LastName           string     `bson:"last_name" json:"last_name"`
+	Password           string     `bson:"password" json:"-"`
+	Role               string     `bson:"role" json:"role"`
+	Username           string     `bson:"username" json:"username"`
+	UsernameKey        string     `bson:"username_key,omitempty" json:"-"`
+	UsernameSkeleton   string     `bson:"username_skeleton,omitempty" json:"-"`
+	DateOfBirth        string     `bson:"date_of_birth,omitempty" json:"date_of_birth,omitempty"`
+	AcceptedTOSVersion string     `bson:"accepted_tos_version" json:"accepted_tos_version"`
+	Status             string     `bson:"status,omitempty" json:"status"`
+	Timestamp          int64      `bson:"timestamp" json:"timestamp"`
+	UpdatedAt          time.Time  `bson:"updated_at,omitempty" json:"updated_at"`
+	DeletedAt          *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	PurgeAt            *time.Time `bson:"purge_at,omitempty" json:"purge_at,omitempty"`
+	ErasedAt           *time.Time `bson:"erased_at,omitempty" json:"erased_at,omitempty"`
+	LastLoginAt        *time.Time `bson:"last_login_at,omitempty" json:"last_login_at,omitempty"`
+	PasswordChangedAt  *time.Time `bson:"password_changed_at,omitempty" json:"-"`
+	UsernameChangedAt  *time.Time `bson:"username_changed_at,omitempty" json:"username_changed_at,omitempty"`
+	Identities         []Identity `bson:"identities,omitempty" json:"identities,omitempty"`
+
+	// Profile fields are optional, users stored before they existed simply
+	// don't have them
+	DisplayName string `bson:"display_name,omitempty" json:"display_name,omitempty"`
+	AvatarURL   string `bson:"avatar_url,omitempty" json:"avatar_url,omitempty"`
+	Timezone    string `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Locale      string `bson:"locale,omitempty" json:"locale,omitempty"`
+	Phone       string `bson:"phone,omitempty" json:"phone,omitempty"`
+}
+
+// Identity is an account of a user with an OAuth2 provider, which they can log
+// in with instead of a password
+type Identity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"-"`
+	LinkedAt time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+// ExternalProfile is what an OAuth2 provider tells about the user logging in
+type ExternalProfile struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	FirstName     string
+	LastName      string
+}
+
+// Kinds of change to a user
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// UserChange describes a change to a user for incremental syncs. Deleted users
+// are tombstones without the user.
+type UserChange struct {
+	Change    string    `json:"change"`
+	ID        string    `json:"id"`
+	ChangedAt time.Time `json:"changed_at"`
+	User      *User     `json:"user,omitempty"`
+}
+
+// ResolvedUser pairs a username with the ID of its user
+type ResolvedUser struct {
+	ID       string `bson:"_id" json:"id"`
+	Username string `bson:"username" json:"username"`
 }
 
 // CreateUser is a struct that describes the properties for creating a new user
 type CreateUser struct {
-	Email     string `json:"email"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Password  string `json:"password"`
-	Role      string `json:"role"`
-	Username  string `json:"username"`
+	Email              string `json:"email"`
+	FirstName          string `json:"first_name"`
+	LastName           string `json:"last_name"`
+	Password           string `json:"password"`
+	Role               string `json:"role"`
+	Username           string `json:"username"`
+	DateOfBirth        string `json:"date_of_birth"`
+	AcceptedTOSVersion string `json:"accepted_tos_version"`
+	ReservationToken   string `json:"reservation_token"`
+}
+
+// ListOptions selects a page of users, optionally only those with a role or
+// matching a search query
+type ListOptions struct {
+	Offset int
+	Limit  int
+	Role   string
+	Query  string
+	// Roles, when set, lists the users with any of them, matching role
+	// names ignoring case like authorization does
+	Roles []string
+	// Sort is the fields users are listed in order of, prefixed with - for
+	// descending order. Users are listed oldest first when it's empty.
+	Sort []string
 }
 
-// UpdateUser is a struct that describes the properties for updating a user
+// UpdateUser is a struct that describes the properties for updating a user.
+// Nil fields are left as they are.
 type UpdateUser struct {
-	ID        string `json:"id"`
-	Email     string `json:"email"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Password  string `json:"password"`
-	Role      string `json:"role"`
-	Username  string `json:"username"`
+	Email     *string `json:"email"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Password  *string `json:"password"`
+	Role      *string `json:"role"`
+	Username  *string `json:"username"`
+
+	// Empty profile fields are cleared
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+	Timezone    *string `json:"timezone"`
+	Locale      *string `json:"locale"`
+	Phone       *string `json:"phone"`
+}
+
+// AttributeUpdate changes the role and status of a user at once. Nil fields
+// are left as they are, and Verify activates pending users.
+type AttributeUpdate struct {
+	Role   *string
+	Active *bool
+	Verify bool
 }
 
-//JWTToken represts the JWTToken
+// JWTToken represts the JWTToken
 type JWTToken string
+
+// LoginResult describes the outcome of a successful login
+type LoginResult struct {
+	UserID string
+	Token  JWTToken
+	// RefreshToken can be swapped once for a new access token and refresh
+	// token
+	RefreshToken string
+	// TOSAcceptanceRequired is set when the user hasn't accepted the current
+	// terms of service version
+	TOSAcceptanceRequired bool
+	// EvictedSessions are the ids of the sessions the login ended, being
+	// over the limit of sessions a user can have
+	EvictedSessions []string
+}
+
+// PasswordPolicy describes the requirements a new password must meet
+type PasswordPolicy struct {
+	MinLength       int      `json:"min_length"`
+	RequiredClasses []string `json:"required_classes"`
+	HIBPCheck       bool     `json:"hibp_check"`
+	BannedList      bool     `json:"banned_list"`
+}
+
+// SecurityReport bundles what an investigation of a user needs. Attempts
+// are limited to the requested time range.
+type SecurityReport struct {
+	UserID        string         `json:"user_id"`
+	Status        string         `json:"status"`
+	LoginAttempts []LoginAttempt `json:"login_attempts"`
+}
+
+// UserStats aggregates users and logins for the ops dashboard. Users are
+// counted by status, deleted users aside, and signups count every user created
+// in the window. Logins are over the last day.
+type UserStats struct {
+	TotalUsers       int       `json:"total_users"`
+	ActiveUsers      int       `json:"active_users"`
+	DeactivatedUsers int       `json:"deactivated_users"`
+	LockedUsers      int       `json:"locked_users"`
+	UnverifiedUsers  int       `json:"unverified_users"`
+	SignupsLastDay   int       `json:"signups_last_day"`
+	SignupsLastWeek  int       `json:"signups_last_week"`
+	SignupsLastMonth int       `json:"signups_last_month"`
+	LoginSuccesses   int       `json:"login_successes"`
+	LoginFailures    int       `json:"login_failures"`
+	LoginSuccessRate float64   `json:"login_success_rate"`
+	LoginFailureRate float64   `json:"login_failure_rate"`
+	GeneratedAt      time.Time `json:"generated_at"`
+}
+
+// DuplicateGroup lists accounts that may belong to the same person because
+// they share the key of a criterion, e.g. the same normalized email
+type DuplicateGroup struct {
+	Criterion string `json:"criterion"`
+	Key       string `json:"key"`
+	Users     []User `json:"users"`
+}
+
+// Role describes a role users can be given and what it allows
+type Role struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// Challenge is a pending one-time code sent to a user to confirm they own
+// the account. Only a hash of the code is kept.
+type Challenge struct {
+	UserID    string    `bson:"_id"`
+	CodeHash  string    `bson:"code_hash"`
+	Attempts  int       `bson:"attempts"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// RefreshToken is a long-lived token issued at login. Each one can be used
+// once, handing out its successor in the same family. Only a hash of the
+// token is kept.
+type RefreshToken struct {
+	ID        string     `bson:"_id" json:"-"`
+	UserID    string     `bson:"user_id" json:"user_id"`
+	FamilyID  string     `bson:"family_id" json:"family_id"`
+	Origin    string     `bson:"origin" json:"origin"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	// RememberMe is set on the tokens of logins asking to be remembered,
+	// which last longer
+	RememberMe bool `bson:"remember_me,omitempty" json:"remember_me"`
+}
+
+// APIKey is a long-lived key a user minted for jobs that can't log in. It
+// authenticates as the user, limited to its scopes. Only a hash of the key is
+// kept, the prefix identifies it in listings.
+type APIKey struct {
+	ID        string     `bson:"_id" json:"id"`
+	UserID    string     `bson:"user_id" json:"user_id"`
+	Name      string     `bson:"name" json:"name"`
+	Prefix    string     `bson:"prefix" json:"prefix"`
+	Hash      string     `bson:"hash" json:"-"`
+	Scopes    []string   `bson:"scopes" json:"scopes"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+// Session is a login of a user on a device, lasting as long as its family of
+// refresh tokens. Access tokens name it in their sid claim.
+type Session struct {
+	ID         string    `bson:"_id" json:"id"`
+	UserID     string    `bson:"user_id" json:"user_id"`
+	IP         string    `bson:"ip" json:"ip"`
+	UserAgent  string    `bson:"user_agent" json:"user_agent"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+	LastSeenAt time.Time `bson:"last_seen_at" json:"last_seen_at"`
+	ExpiresAt  time.Time `bson:"expires_at" json:"expires_at"`
+	Refreshes  int       `bson:"refreshes,omitempty" json:"refreshes"`
+	Current    bool      `bson:"-" json:"current"`
+}
+
+// PasswordReset is a pending request to reset a user's password. It can be
+// used once before it expires. Only a hash of the token is kept.
+type PasswordReset struct {
+	ID        string     `bson:"_id"`
+	UserID    string     `bson:"user_id"`
+	CreatedAt time.Time  `bson:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at"`
+	UsedAt    *time.Time `bson:"used_at,omitempty"`
+}
+
+// Invitation is an admin's pending invite for someone to join. Their account
+// waits as invited, without a password, until they accept it by picking
+// one. Only a hash of the token is kept.
+type Invitation struct {
+	ID        string    `bson:"_id" json:"id"`
+	UserID    string    `bson:"user_id" json:"user_id"`
+	Email     string    `bson:"email" json:"email"`
+	InvitedBy string    `bson:"invited_by" json:"invited_by"`
+	TokenHash string    `bson:"token_hash" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// Group is a named set of users, e.g. a team. The groups of a user are
+// claimed in their tokens for other services to authorize on.
+type Group struct {
+	ID          string    `bson:"_id" json:"id"`
+	Name        string    `bson:"name" json:"name"`
+	NameKey     string    `bson:"name_key" json:"-"`
+	Description string    `bson:"description" json:"description"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// UpdateGroup describes the changes to a group. Nil fields are left as they
+// are.
+type UpdateGroup struct {
+	Name        *string
+	Description *string
+}
+
+// GroupMembership is a user belonging to a group
+type GroupMembership struct {
+	ID      string    `bson:"_id"`
+	GroupID string    `bson:"group_id"`
+	UserID  string    `bson:"user_id"`
+	AddedAt time.Time `bson:"added_at"`
+}
+
+// EmailVerification is a pending confirmation of a user's email. It can be
+// used once before it expires. Only a hash of the token is kept.
+type EmailVerification struct {
+	ID        string     `bson:"_id"`
+	UserID    string     `bson:"user_id"`
+	CreatedAt time.Time  `bson:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at"`
+	UsedAt    *time.Time `bson:"used_at,omitempty"`
+}
+
+// TokenGarbage counts what a token garbage collection removed from the
+// database
+type TokenGarbage struct {
+	RefreshTokens  int
+	TokenFamilies  int
+	PasswordResets int
+	Challenges     int
+}
+
+// LoginAttempt records the outcome of a single login attempt
+type LoginAttempt struct {
+	ID        string    `bson:"_id" json:"id"`
+	UserID    string    `bson:"user_id" json:"user_id"`
+	Success   bool      `bson:"success" json:"success"`
+	Reason    string    `bson:"reason" json:"reason"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// AuditEntry records a mutating API call in the audit trail. Each entry
+// carries the hash of the one before it, so changing or removing a past entry
+// breaks the chain.
+type AuditEntry struct {
+	ID        string    `bson:"_id" json:"id"`
+	Seq       int64     `bson:"seq" json:"seq"`
+	Actor     string    `bson:"actor" json:"actor"`
+	Method    string    `bson:"method" json:"method"`
+	Path      string    `bson:"path" json:"path"`
+	Payload   string    `bson:"payload" json:"payload"`
+	Status    int       `bson:"status" json:"status"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	PrevHash  string    `bson:"prev_hash" json:"prev_hash"`
+	Hash      string    `bson:"hash" json:"hash"`
+}
+
+// AuditEvent records a security-relevant event of a user in the audit log:
+// who did what to which user, from where and whether it worked. UserID is
+// empty when the event didn't get as far as a user. Detail says more about
+// some actions, e.g. which API key was created.
+type AuditEvent struct {
+	ID        string    `bson:"_id" json:"id"`
+	Actor     string    `bson:"actor" json:"actor"`
+	UserID    string    `bson:"user_id" json:"user_id"`
+	Action    string    `bson:"action" json:"action"`
+	Detail    string    `bson:"detail,omitempty" json:"detail,omitempty"`
+	IP        string    `bson:"ip" json:"ip"`
+	UserAgent string    `bson:"user_agent" json:"user_agent"`
+	Outcome   string    `bson:"outcome" json:"outcome"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// UserEvent is published to downstream services when a user changes. User is
+// the user after the change, left out of login and deletion events.
+// PreviousUserID is the id a user had before it was reissued.
+type UserEvent struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	UserID         string    `json:"user_id"`
+	PreviousUserID string    `json:"previous_user_id,omitempty"`
+	User           *User     `json:"user,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// WebhookDeadLetter is a webhook delivery given up on, kept so it can be
+// looked into and replayed. Body is the event exactly as it was posted.
+type WebhookDeadLetter struct {
+	ID        string    `bson:"_id" json:"id"`
+	EventType string    `bson:"event_type" json:"event_type"`
+	URL       string    `bson:"url" json:"url"`
+	Body      string    `bson:"body" json:"body"`
+	Attempts  int       `bson:"attempts" json:"attempts"`
+	Error     string    `bson:"error" json:"error"`
+	FailedAt  time.Time `bson:"failed_at" json:"failed_at"`
+}
+
+// UserExport is everything kept about a user, for handing it over to them.
+// Refresh tokens are left without their hashes.
+type UserExport struct {
+	User          *User          `json:"user"`
+	Sessions      []Session      `json:"sessions"`
+	RefreshTokens []RefreshToken `json:"refresh_tokens"`
+	LoginAttempts []LoginAttempt `json:"login_attempts"`
+	APIKeys       []APIKey       `json:"api_keys"`
+	Groups        []Group        `json:"groups"`
+	AuditEvents   []AuditEvent   `json:"audit_events"`
+	ExportedAt    time.Time      `json:"exported_at"`
+}
+
+// SecurityEvent summarizes something that happened to an account, for its
+// owner to check it was them
+type SecurityEvent struct {
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/buzzapp/user/model"
+)
+
+// OAuth2 providers users can log in with
+const (
+	providerGoogle = "google"
+	providerGitHub = "github"
+)
+
+// oauthStateType is the typ claim of OAuth2 state tokens, which carry a login
+// or link to the provider and back
+const oauthStateType = "oauth_state"
+
+// oauthStateCookie binds the state of a login to the browser that started it,
+// so nobody can get a victim logged into the attacker's account by sending
+// them a callback link
+const oauthStateCookie = "oauth_state"
+
+var (
+	// OAuthGoogleClientSecret and OAuthGitHubClientSecret are the client
+	// secrets of our OAuth2 apps, set by the OAUTH_GOOGLE_CLIENT_SECRET and
+	// OAUTH_GITHUB_CLIENT_SECRET secrets
+	OAuthGoogleClientSecret = ""
+	OAuthGitHubClientSecret = ""
+
+	// oauthProviders are the providers users can log in with, by name. Social
+	// login is disabled when there are none.
+	oauthProviders = map[string]*oauthProvider{}
+
+	// oauthAutoProvision creates an account for users logging in with a
+	// provider for the first time, when no account has their email yet
+	oauthAutoProvision = true
+
+	// oauthStateTTL is how long users have to come back from the provider
+	oauthStateTTL = 10 * time.Minute
+
+	// oauthClient talks to the providers
+	oauthClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+var (
+	errUnknownProvider      = errors.New("unknown login provider")
+	errInvalidOAuthState    = errors.New("invalid or expired login state, please start over")
+	errIdentityNotLinked    = errors.New("no account is linked to this identity, log in and link it first")
+	errIdentityTaken        = errors.New("this identity is already linked to another account")
+	errProviderLinked       = errors.New("an identity of this provider is already linked, unlink it first")
+	errProviderNotLinked    = errors.New("no identity of this provider is linked")
+	errLastAuthMethod       = errors.New("the account needs a password or another linked identity to log in with")
+	errUnverifiedOAuthEmail = errors.New("the provider hasn't verified the email of this identity")
+)
+
+// oauthProvider is an OAuth2 provider users can log in with, using the
+// authorization code flow
+type oauthProvider struct {
+	name         string
+	authorizeURL string
+	tokenURL     string
+	profileURL   string
+	scopes       []string
+	clientID     string
+	clientSecret string
+
+	// readProfile reads the profile of the user logging in from the
+	// provider, with the access token they gave us
+	readProfile func(ctx context.Context, p *oauthProvider, accessToken string) (*model.ExternalProfile, error)
+}
+
+func newGoogleProvider(clientID, clientSecret string) *oauthProvider {
+	return &oauthProvider{
+		name:         providerGoogle,
+		authorizeURL: "https://accounts.google.com/o/oauth2/v2/auth",
+		tokenURL:     "https://oauth2.googleapis.com/token",
+		profileURL:   "https://openidconnect.googleapis.com/v1/userinfo",
+		scopes:       []string{"openid", "email", "profile"},
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		readProfile:  readGoogleProfile,
+	}
+}
+
+func newGitHubProvider(clientID, clientSecret string) *oauthProvider {
+	return &oauthProvider{
+		name:         providerGitHub,
+		authorizeURL: "https://github.com/login/oauth/authorize",
+		tokenURL:     "https://github.com/login/oauth/access_token",
+		profileURL:   "https://api.github.com/user",
+		scopes:       []string{"read:user", "user:email"},
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		readProfile:  readGitHubProfile,
+	}
+}
+
+// oauthCallbackURL is where a provider sends users back to, which has to be
+// registered with the provider as is
+func oauthCallbackURL(publicURL, provider string) string {
+	return strings.TrimRight(publicURL, "/") + strings.Replace(OAuthCallbackPath, "{provider}", provider, 1)
+}
+
+// AuthCodeURL returns where to send users to log in with the provider
+func (p *oauthProvider) AuthCodeURL(redirectURI, state string) string {
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {strings.Join(p.scopes, " ")},
+		"state":         {state},
+	}
+	return p.authorizeURL + "?" + query.Encode()
+}
+
+// Exchange swaps the code the provider sent users back with for an access
+// token
+func (p *oauthProvider) Exchange(ctx context.Context, code, redirectURI string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+	}
+	req, err := http.NewRequest("POST", p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := doOAuthRequest(ctx, req, &token); err != nil && token.Error == "" {
+		return "", err
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("%s refused the code: %s %s", p.name, token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("%s handed out no access token", p.name)
+	}
+	return token.AccessToken, nil
+}
+
+// getOAuthJSON decodes the JSON at u, read with accessToken, into v
+func getOAuthJSON(ctx context.Context, u, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return doOAuthRequest(ctx, req, v)
+}
+
+// doOAuthRequest sends req to a provider and decodes its JSON response into v.
+// Error responses are decoded too, since providers describe errors in them.
+func doOAuthRequest(ctx context.Context, req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	decodeErr := json.Unmarshal(body, v)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", req.URL.Host, resp.Status)
+	}
+	return decodeErr
+}
+
+func readGoogleProfile(ctx context.Context, p *oauthProvider, accessToken string) (*model.ExternalProfile, error) {
+	var info struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		GivenName     string `json:"given_name"`
+		FamilyName    string `json:"family_name"`
+	}
+	if err := getOAuthJSON(ctx, p.profileURL, accessToken, &info); err != nil {
+		return nil, err
+	}
+	if info.Subject == "" {
+		return nil, errors.New("google returned a profile without a subject")
+	}
+
+	profile := &model.ExternalProfile{
+		Provider:      p.name,
+		Subject:       info.Subject,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+		FirstName:     info.GivenName,
+		LastName:      info.FamilyName,
+	}
+	if at := strings.LastIndex(info.Email, "@"); at > 0 {
+		profile.Username = info.Email[:at]
+	}
+	return profile, nil
+}
+
+func readGitHubProfile(ctx context.Context, p *oauthProvider, accessToken string) (*model.ExternalProfile, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := getOAuthJSON(ctx, p.profileURL, accessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, errors.New("github returned a profile without an id")
+	}
+
+	// The email of the profile is only the public one, if any, so ask for
+	// the primary one along with whether it's verified
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getOAuthJSON(ctx, p.profileURL+"/emails", accessToken, &emails); err != nil {
+		return nil, err
+	}
+
+	// Logins can be renamed, the id is what stays
+	profile := &model.ExternalProfile{
+		Provider: p.name,
+		Subject:  strconv.FormatInt(user.ID, 10),
+		Username: user.Login,
+	}
+	profile.FirstName, profile.LastName = splitName(user.Name)
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email, profile.EmailVerified = email.Email, email.Verified
+		}
+	}
+	return profile, nil
+}
+
+// splitName splits a full name into first name and the rest
+func splitName(name string) (string, string) {
+	fields := strings.Fields(name)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	return fields[0], strings.Join(fields[1:], " ")
+}
+
+// newOAuthNonce returns a random nonce binding a state to a browser
+func newOAuthNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// generateOAuthState mints the state of a login with provider from origin, or
+// of linking it to userID when set. It is signed like our other tokens, so
+// nothing has to be stored until the user comes back.
+func generateOAuthState(provider, nonce, userID, origin string) (string, error) {
+	now := time.Now()
+
+	token := jwt.New(signingMethod)
+	token.Claims["typ"] = oauthStateType
+	token.Claims["provider"] = provider
+	token.Claims["nonce"] = nonce
+	token.Claims["origin"] = origin
+	if userID != "" {
+		token.Claims["sub"] = userID
+	}
+	token.Claims["iat"] = now.Unix()
+	token.Claims["exp"] = now.Add(oauthStateTTL).Unix()
+	token.Claims["nbf"] = now.Unix()
+	return signToken(token)
+}
+
+// oauthState is a verified state of a login or link
+type oauthState struct {
+	// userID is who the identity is linked to, empty when logging in
+	userID string
+	origin string
+}
+
+// verifyOAuthState checks that state was minted by us for provider, in the
+// browser holding nonce
+func verifyOAuthState(state, provider, nonce string) (*oauthState, error) {
+	token, err := parseToken(state)
+	if err != nil {
+		return nil, errInvalidOAuthState
+	}
+	if token.Claims["typ"] != oauthStateType || token.Claims["provider"] != provider || nonce == "" || token.Claims["nonce"] != nonce {
+		return nil, errInvalidOAuthState
+	}
+
+	verified := &oauthState{}
+	verified.userID, _ = token.Claims["sub"].(string)
+	verified.origin, _ = token.Claims["origin"].(string)
+	return verified, nil
+}
+
+// startOAuth binds a login with provider, or a link of it to userID when set,
+// to the browser, returning where to send it to log in
+func startOAuth(w http.ResponseWriter, provider *oauthProvider, publicURL, userID, origin string) (string, error) {
+	nonce, err := newOAuthNonce()
+	if err != nil {
+		return "", err
+	}
+	state, err := generateOAuthState(provider.name, nonce, userID, origin)
+	if err != nil {
+		return "", err
+	}
+
+	setOAuthStateCookie(w, publicURL, nonce, int(oauthStateTTL/time.Second))
+	return provider.AuthCodeURL(oauthCallbackURL(publicURL, provider.name), state), nil
+}
+
+// fetchOAuthProfile swaps the code the provider sent the user back with for
+// their profile
+func fetchOAuthProfile(ctx context.Context, provider *oauthProvider, code, redirectURI string) (*model.ExternalProfile, error) {
+	accessToken, err := provider.Exchange(ctx, code, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+	return provider.readProfile(ctx, provider, accessToken)
+}
+
+// setOAuthStateCookie hands nonce to the browser for the callback, which is a
+// top-level navigation from the provider and so still gets lax cookies
+func setOAuthStateCookie(w http.ResponseWriter, publicURL, nonce string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    nonce,
+		Path:     "/users/oauth/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(publicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// identityQuery finds the user the identity with subject at provider is
+// linked to
+func identityQuery(provider, subject string) bson.M {
+	return bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+}
+
+// userByIdentity returns the user the identity with subject at provider is
+// linked to, errUserNotFound when there's none
+func userByIdentity(ctx context.Context, provider, subject string) (*model.User, error) {
+	return findUser(ctx, UserFilter{Identity: &model.Identity{Provider: provider, Subject: subject}, NotDeleted: true})
+}
+
+// provisionAttempts is how many usernames are tried for a user signing up
+// with a provider, since the username they have there may be taken here
+const provisionAttempts = 5
+
+// provisionUser signs up the user of profile, logging in with a provider for
+// the first time. They get no password, so they log in with the provider
+// until they reset it. Accounts that already have their email aren't taken
+// over; their user has to log in and link the identity.
+func provisionUser(ctx context.Context, profile *model.ExternalProfile) (*model.User, error) {
+	if !oauthAutoProvision {
+		return nil, errIdentityNotLinked
+	}
+	if profile.Email == "" || !profile.EmailVerified {
+		return nil, errUnverifiedOAuthEmail
+	}
+
+	user, err := signUpWithIdentity(ctx, profile, defaultRole)
+	if err == errDuplicateEmail {
+		return nil, errIdentityNotLinked
+	}
+	return user, err
+}
+
+// signUpWithIdentity signs up the user of profile with role, linked to the
+// identity of profile and with a username as close to theirs there as is
+// free. Emails already taken are errDuplicateEmail.
+func signUpWithIdentity(ctx context.Context, profile *model.ExternalProfile, role string) (*model.User, error) {
+	base := normalizeUsername(profile.Username)
+	if base == "" {
+		base = profile.Provider + "-" + profile.Subject
+	}
+
+	now := time.Now()
+	for attempt := 0; ; attempt++ {
+		username := base
+		if attempt > 0 {
+			suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				return nil, err
+			}
+			username = fmt.Sprintf("%s%04d", base, suffix.Int64())
+		}
+
+		user := &model.User{
+			ID:               bson.NewObjectId().Hex(),
+			Email:            profile.Email,
+			FirstName:        profile.FirstName,
+			LastName:         profile.LastName,
+			Role:             role,
+			Username:         username,
+			UsernameKey:      usernameKey(username),
+			UsernameSkeleton: usernameSkeleton(username),
+			Status:           statusActive,
+			Timestamp:        now.Unix(),
+			UpdatedAt:        now,
+			Identities:       []model.Identity{{Provider: profile.Provider, Subject: profile.Subject, LinkedAt: now}},
+		}
+		err := insertUser(ctx, user, "")
+		switch {
+		case err == nil:
+			recordServiceAuditEvent(ctx, profile.Provider, user.ID, auditActionCreate, "signed up with "+profile.Provider, nil)
+			return user, nil
+		case err == errDuplicateUsername && attempt+1 < provisionAttempts:
+			continue
+		case mgo.IsDup(err):
+			// Someone signed up with the same identity at the same time
+			return nil, errIdentityTaken
+		default:
+			return nil, err
+		}
+	}
+}
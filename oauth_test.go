@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+)
+
+// oauthLoggingInService logs in or links whoever the provider says logged in
+type oauthLoggingInService struct {
+	UserService
+	linked *model.ExternalProfile
+	linkTo string
+}
+
+func (s *oauthLoggingInService) LoginWithProvider(ctx context.Context, profile *model.ExternalProfile, referer string) (*model.LoginResult, error) {
+	if profile.Subject != "42" {
+		return nil, errIdentityNotLinked
+	}
+	return &model.LoginResult{UserID: "octoID", Token: "accessToken", RefreshToken: "refreshToken"}, nil
+}
+
+func (s *oauthLoggingInService) LinkIdentity(ctx context.Context, userID string, profile *model.ExternalProfile) (*model.User, error) {
+	s.linked, s.linkTo = profile, userID
+	return &model.User{ID: userID, Identities: []model.Identity{{Provider: profile.Provider, Subject: profile.Subject}}}, nil
+}
+
+// newFakeGitHub serves the token and profile endpoints of GitHub, handing out
+// the user with id for the code "goodCode"
+func newFakeGitHub(t *testing.T, id string) (*httptest.Server, *oauthProvider) {
+	routes := http.NewServeMux()
+	routes.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_secret") != "clientSecret" {
+			t.Errorf("Expected the client secret to be sent but got: %q", r.Form.Get("client_secret"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("code") != "goodCode" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"bad_verification_code","error_description":"The code is incorrect or expired."}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"providerToken","token_type":"bearer"}`))
+	})
+	routes.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer providerToken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":` + id + `,"login":"octocat","name":"Mona Lisa Octocat"}`))
+	})
+	routes.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"email":"public@test.com","primary":false,"verified":true},{"email":"octo@test.com","primary":true,"verified":true}]`))
+	})
+	server := httptest.NewServer(routes)
+
+	provider := newGitHubProvider("clientID", "clientSecret")
+	provider.authorizeURL = server.URL + "/authorize"
+	provider.tokenURL = server.URL + "/token"
+	provider.profileURL = server.URL + "/user"
+	return server, provider
+}
+
+func TestOAuthGitHubProfile(t *testing.T) {
+	server, provider := newFakeGitHub(t, "42")
+	defer server.Close()
+
+	if _, err := fetchOAuthProfile(context.Background(), provider, "badCode", "http://localhost/callback"); err == nil || !strings.Contains(err.Error(), "bad_verification_code") {
+		t.Errorf("Expected a refused code to fail with the provider's error but got: %v", err)
+	}
+
+	profile, err := fetchOAuthProfile(context.Background(), provider, "goodCode", "http://localhost/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Subject != "42" || profile.Username != "octocat" {
+		t.Errorf("Expected subject 42 and username octocat but got: %s and %s", profile.Subject, profile.Username)
+	}
+	if profile.Email != "octo@test.com" || !profile.EmailVerified {
+		t.Errorf("Expected the verified primary email but got: %s (verified %v)", profile.Email, profile.EmailVerified)
+	}
+	if profile.FirstName != "Mona" || profile.LastName != "Lisa Octocat" {
+		t.Errorf("Expected the name to be split but got: %q %q", profile.FirstName, profile.LastName)
+	}
+}
+
+func TestOAuthState(t *testing.T) {
+	state, err := generateOAuthState(providerGitHub, "nonce", "userID", "https://app.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := verifyOAuthState(state, providerGitHub, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.userID != "userID" || verified.origin != "https://app.test" {
+		t.Errorf("Expected the user and origin to be kept but got: %+v", verified)
+	}
+
+	if _, err := verifyOAuthState(state, providerGitHub, "otherNonce"); err != errInvalidOAuthState {
+		t.Errorf("Expected a state of another browser to be refused but got: %v", err)
+	}
+	if _, err := verifyOAuthState(state, providerGitHub, ""); err != errInvalidOAuthState {
+		t.Errorf("Expected a state without a cookie to be refused but got: %v", err)
+	}
+	if _, err := verifyOAuthState(state, providerGoogle, "nonce"); err != errInvalidOAuthState {
+		t.Errorf("Expected a state of another provider to be refused but got: %v", err)
+	}
+
+	accessToken, err := generateToken("userID", "user", "user", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyOAuthState(string(accessToken), providerGitHub, "nonce"); err != errInvalidOAuthState {
+		t.Errorf("Expected an access token to be refused as a state but got: %v", err)
+	}
+}
+
+func TestOAuthCallbackHTTPEndpoint(t *testing.T) {
+	server, provider := newFakeGitHub(t, "42")
+	defer server.Close()
+	defer func(providers map[string]*oauthProvider) { oauthProviders = providers }(oauthProviders)
+	oauthProviders = map[string]*oauthProvider{providerGitHub: provider}
+
+	svc := &oauthLoggingInService{}
+	router := mux.NewRouter()
+	router.Handle(OAuthAuthorizePath, handleOAuthAuthorize("https://users.test")).Methods("GET")
+	router.Handle(OAuthCallbackPath, handleOAuthCallback(svc, "https://users.test")).Methods("GET")
+	router.Handle(IdentityPath, handleLinkIdentity("https://users.test")).Methods("POST")
+
+	// start sends the browser to the provider, returning the state and
+	// cookie it comes back with
+	start := func(method, path string) (string, *http.Cookie) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		location := rec.Header().Get("Location")
+		if method == "POST" {
+			var resp struct {
+				AuthorizeURL string `json:"authorize_url"`
+			}
+			json.NewDecoder(rec.Body).Decode(&resp)
+			location = resp.AuthorizeURL
+		}
+		redirect, err := url.Parse(location)
+		if err != nil || !strings.HasPrefix(location, server.URL+"/authorize") {
+			t.Fatalf("Expected to be sent to the provider but got: %d %q", rec.Code, location)
+		}
+		if got := redirect.Query().Get("redirect_uri"); got != "https://users.test/users/oauth/github/callback" {
+			t.Errorf("Expected the callback as redirect URI but got: %s", got)
+		}
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure {
+			t.Fatalf("Expected a secure state cookie but got: %v", cookies)
+		}
+		return redirect.Query().Get("state"), cookies[0]
+	}
+	callback := func(query string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/users/oauth/github/callback?"+query, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/users/oauth/myspace/authorize", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown provider to get a 404 but got: %d", rec.Code)
+	}
+
+	state, cookie := start("GET", "/users/oauth/github/authorize")
+	if rec := callback("code=goodCode&state="+url.QueryEscape(state), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a callback without the state cookie to get a 400 but got: %d", rec.Code)
+	}
+	if rec := callback("error=access_denied&state="+url.QueryEscape(state), cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a refused login to get a 400 but got: %d", rec.Code)
+	}
+	if rec := callback("code=badCode&state="+url.QueryEscape(state), cookie); rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected a code the provider refuses to get a 502 but got: %d", rec.Code)
+	}
+
+	rec = callback("code=goodCode&state="+url.QueryEscape(state), cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d %s", rec.Code, rec.Body)
+	}
+	var login struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	json.NewDecoder(rec.Body).Decode(&login)
+	if login.Token != "accessToken" || login.RefreshToken != "refreshToken" {
+		t.Errorf("Expected our tokens to be handed out but got: %+v", login)
+	}
+
+	// Linking comes back to the same callback, for whoever started it
+	state, cookie = start("POST", "/users/userID/identities/github")
+	if rec := callback("code=goodCode&state="+url.QueryEscape(state), cookie); rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d %s", rec.Code, rec.Body)
+	}
+	if svc.linkTo != "userID" || svc.linked == nil || svc.linked.Subject != "42" {
+		t.Errorf("Expected the identity to be linked to userID but got: %s %+v", svc.linkTo, svc.linked)
+	}
+}
+
+func TestOAuthCallbackUnlinkedIdentity(t *testing.T) {
+	server, provider := newFakeGitHub(t, "7")
+	defer server.Close()
+	defer func(providers map[string]*oauthProvider) { oauthProviders = providers }(oauthProviders)
+	oauthProviders = map[string]*oauthProvider{providerGitHub: provider}
+
+	router := mux.NewRouter()
+	router.Handle(OAuthCallbackPath, handleOAuthCallback(&oauthLoggingInService{}, "http://users.test")).Methods("GET")
+
+	state, err := generateOAuthState(providerGitHub, "nonce", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/users/oauth/github/callback?code=goodCode&state="+url.QueryEscape(state), nil)
+	req.AddCookie(&http.Cookie{Name: oauthStateCookie, Value: "nonce"})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected a 409 status code response but got: %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), identityNotLinkedCode) {
+		t.Errorf("Expected the %s code but got: %s", identityNotLinkedCode, rec.Body)
+	}
+}
+
+func TestAuthMethodsListLinkedProviders(t *testing.T) {
+	user := &model.User{Identities: []model.Identity{{Provider: providerGoogle, Subject: "1"}}}
+	methods := authMethodsOf(user)
+	if methods.PasswordSet {
+		t.Error("Expected a user without a password to have none set")
+	}
+	if len(methods.LinkedProviders) != 1 || methods.LinkedProviders[0] != providerGoogle {
+		t.Errorf("Expected google to be linked but got: %v", methods.LinkedProviders)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// Who may call a route, as documented in the OpenAPI document
+const (
+	authPublic  = ""
+	authUser    = "user"
+	authSelf    = "self"
+	authAdmin   = "admin"
+	authService = "service"
+)
+
+// apiOperation documents a route for the OpenAPI document, and says what its
+// requests are validated against
+type apiOperation struct {
+	summary string
+
+	// auth is who may call the route, one of the auth constants
+	auth string
+
+	// request is the JSON body the route takes, nil when it takes none or
+	// takes something other than JSON
+	request interface{}
+
+	// versions are older bodies of request, by the schema version clients
+	// ask for them with
+	versions map[string]interface{}
+
+	// status and response are what the route responds with when it succeeds.
+	// response is nil when there is no JSON body.
+	status   int
+	response interface{}
+
+	// paged routes take the paging query parameters
+	paged bool
+}
+
+// requestBody returns what the body of a request asking for schema version
+// should look like
+func (op apiOperation) requestBody(version string) interface{} {
+	if body, ok := op.versions[strings.TrimSpace(version)]; ok {
+		return body
+	}
+	return op.request
+}
+
+func apiOperationKey(method, path string) string {
+	return method + " " + path
+}
+
+// apiOperations documents the routes we serve, by method and path. Routes
+// that are missing still make it into the OpenAPI document, just without a
+// summary or schemas.
+var apiOperations = map[string]apiOperation{
+	apiOperationKey("POST", CreateUserPath):      {summary: "Sign up a new user", request: reqres.CreateUserRequest{}, versions: map[string]interface{}{"1": reqres.CreateUserRequestV1{}}, status: http.StatusCreated, response: reqres.CreateUserResponse{}},
+	apiOperationKey("POST", ReserveUsernamePath): {summary: "Hold a username during a signup", request: reqres.ReserveUsernameRequest{}, status: http.StatusCreated, response: reqres.ReserveUsernameResponse{}},
+	apiOperationKey("POST", ReleaseUsernamePath): {summary: "Let go of a reserved username", request: reqres.ReleaseUsernameRequest{}, status: http.StatusOK, response: reqres.MessageResponse{}},
+	apiOperationKey("POST", ValidateEmailPath):   {summary: "Check an email ahead of signing up with it", request: reqres.ValidateEmailRequest{}, status: http.StatusOK, response: reqres.ValidateEmailResponse{}},
+	apiOperationKey("POST", ImportUsersPath):     {summary: "Import users from a CSV or JSON array", auth: authAdmin, status: http.StatusOK, response: reqres.ImportResponse{}},
+	apiOperationKey("GET", ImportJobPath):        {summary: "Get the report of an import run in the background", auth: authAdmin, status: http.StatusOK, response: reqres.ImportResponse{}},
+	apiOperationKey("GET", UserSearchPath):       {summary: "Search users by relevance", auth: authAdmin, status: http.StatusOK, response: reqres.ListUsersResponse{}, paged: true},
+	apiOperationKey("POST", InviteUserPath):      {summary: "Invite someone to join", auth: authAdmin, request: reqres.InviteUserRequest{}, status: http.StatusCreated, response: reqres.InviteUserResponse{}},
+	apiOperationKey("POST", AcceptInvitePath):    {summary: "Accept an invite, picking a password", request: reqres.AcceptInvitationRequest{}, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("GET", InviteTokenPath):      {summary: "Check an invite token without using it", status: http.StatusOK, response: reqres.CheckInvitationResponse{}},
+	apiOperationKey("GET", InvitationsPath):      {summary: "List the pending invites", auth: authAdmin, status: http.StatusOK, response: reqres.ListInvitationsResponse{}, paged: true},
+	apiOperationKey("DELETE", InvitationPath):    {summary: "Revoke an invite", auth: authAdmin, status: http.StatusNoContent},
+	apiOperationKey("GET", ListUsersPath):        {summary: "List users", auth: authAdmin, status: http.StatusOK, response: reqres.ListUsersResponse{}, paged: true},
+	apiOperationKey("POST", ResolveUsersPath):    {summary: "Resolve usernames to IDs", auth: authService, request: reqres.ResolveUsersRequest{}, status: http.StatusOK, response: reqres.ResolveUsersResponse{}},
+	apiOperationKey("GET", ChangesPath):          {summary: "List the users changed since a time", auth: authAdmin, status: http.StatusOK, response: reqres.GetChangesResponse{}},
+	apiOperationKey("GET", VerifyEmailPath):      {summary: "Verify an email with its verification token", status: http.StatusOK, response: reqres.MessageResponse{}},
+	apiOperationKey("POST", ResendVerifyPath):    {summary: "Send a new email verification token", request: reqres.ResendVerificationRequest{}, status: http.StatusOK, response: reqres.MessageResponse{}},
+	apiOperationKey("GET", DuplicatesPath):       {summary: "Report likely duplicate accounts", auth: authAdmin, status: http.StatusOK, response: reqres.GetDuplicatesResponse{}, paged: true},
+	apiOperationKey("GET", GetUserByIDPath):      {summary: "Get a user", auth: authSelf, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("PUT", UpdateUserPath):       {summary: "Update a user", auth: authUser, request: reqres.UpdateUserRequest{}, status: http.StatusOK, response: reqres.UpdateUserResponse{}},
+	apiOperationKey("PATCH", UpdateUserPath):     {summary: "Update some fields of a user", auth: authUser, request: reqres.UpdateUserRequest{}, status: http.StatusOK, response: reqres.UpdateUserResponse{}},
+	apiOperationKey("POST", ChangePasswordPath):  {summary: "Change your password", auth: authSelf, request: reqres.ChangePasswordRequest{}, status: http.StatusOK, response: reqres.MessageResponse{}},
+	apiOperationKey("PUT", ChangePasswordPath):   {summary: "Change your password", auth: authSelf, request: reqres.ChangePasswordRequest{}, status: http.StatusOK, response: reqres.MessageResponse{}},
+	apiOperationKey("POST", ReissueIDPath):       {summary: "Give a user a new ID", auth: authAdmin, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("DELETE", DeleteUserPath):    {summary: "Delete a user", auth: authAdmin, status: http.StatusNoContent},
+	apiOperationKey("POST", ReactivateUserPath):  {summary: "Reactivate a deleted user", auth: authAdmin, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("POST", UnlockLoginPath):     {summary: "Lift the login lockout of a user", auth: authAdmin, status: http.StatusNoContent},
+	apiOperationKey("POST", ImpersonatePath):     {summary: "Get a short-lived token acting as a user", auth: authAdmin, status: http.StatusOK, response: reqres.ImpersonateResponse{}},
+	apiOperationKey("POST", ResetTokensPath):     {summary: "Invalidate the outstanding reset and verification tokens of a user", auth: authAdmin, status: http.StatusOK, response: reqres.InvalidateResetTokensResponse{}},
+	apiOperationKey("POST", RevokeSessionsPath):  {summary: "Log a user out everywhere", auth: authSelf, status: http.StatusNoContent},
+	apiOperationKey("GET", SessionsPath):         {summary: "List the sessions of a user", auth: authSelf, status: http.StatusOK, response: reqres.ListSessionsResponse{}},
+	apiOperationKey("DELETE", SessionPath):       {summary: "Log a session out", auth: authSelf, status: http.StatusNoContent},
+	apiOperationKey("GET", UserGroupsPath):       {summary: "List the groups of a user", auth: authSelf, status: http.StatusOK, response: reqres.UserGroupsResponse{}},
+	apiOperationKey("POST", GroupsPath):          {summary: "Create a group", auth: authAdmin, request: reqres.CreateGroupRequest{}, status: http.StatusCreated, response: reqres.GroupResponse{}},
+	apiOperationKey("GET", GroupsPath):           {summary: "List groups", auth: authAdmin, status: http.StatusOK, response: reqres.ListGroupsResponse{}, paged: true},
+	apiOperationKey("GET", GroupPath):            {summary: "Get a group", auth: authAdmin, status: http.StatusOK, response: reqres.GroupResponse{}},
+	apiOperationKey("PUT", GroupPath):            {summary: "Update a group", auth: authAdmin, request: reqres.UpdateGroupRequest{}, status: http.StatusOK, response: reqres.GroupResponse{}},
+	apiOperationKey("PATCH", GroupPath):          {summary: "Update some fields of a group", auth: authAdmin, request: reqres.UpdateGroupRequest{}, status: http.StatusOK, response: reqres.GroupResponse{}},
+	apiOperationKey("DELETE", GroupPath):         {summary: "Delete a group", auth: authAdmin, status: http.StatusNoContent},
+	apiOperationKey("POST", GroupMemberPath):     {summary: "Add a user to a group", auth: authAdmin, status: http.StatusNoContent},
+	apiOperationKey("DELETE", GroupMemberPath):   {summary: "Remove a user from a group", auth: authAdmin, status: http.StatusNoContent},
+	apiOperationKey("GET", GetLoginAttemptsPath): {summary: "List the login attempts of a user", auth: authAdmin, status: http.StatusOK, response: reqres.GetLoginAttemptsResponse{}},
+	apiOperationKey("GET", SecurityReportPath):   {summary: "Get the security report of a user", auth: authAdmin, status: http.StatusOK, response: reqres.GetSecurityReportResponse{}},
+	apiOperationKey("POST", SetStatusPath):       {summary: "Change the status of an account", auth: authAdmin, request: reqres.SetStatusRequest{}, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("GET", RoleDiffPath):         {summary: "Preview the scopes a role change gains and loses", auth: authAdmin, status: http.StatusOK, response: reqres.RoleDiffResponse{}},
+	apiOperationKey("GET", AuditVerifyPath):      {summary: "Verify the audit trail", auth: authAdmin, status: http.StatusOK, response: reqres.AuditVerifyResponse{}},
+	apiOperationKey("GET", AuditExportPath):      {summary: "Stream the audit log as JSON lines or CEF", auth: authAdmin, status: http.StatusOK},
+	apiOperationKey("GET", AuditLogPath):         {summary: "List the audit log", auth: authAdmin, status: http.StatusOK, response: reqres.AuditEventsResponse{}, paged: true},
+	apiOperationKey("GET", UserAuditLogPath):     {summary: "List the audit log of a user", auth: authAdmin, status: http.StatusOK, response: reqres.AuditEventsResponse{}, paged: true},
+	apiOperationKey("GET", ExportUserPath):       {summary: "Export everything kept about a user", auth: authSelf, status: http.StatusOK, response: model.UserExport{}},
+	apiOperationKey("POST", EraseUserPath):       {summary: "Erase the personal data of a user", auth: authSelf, status: http.StatusNoContent},
+	apiOperationKey("POST", ChallengePath):       {summary: "Send a user a one-time code", auth: authAdmin, status: http.StatusAccepted, response: reqres.CreateChallengeResponse{}},
+	apiOperationKey("POST", VerifyChallengePath): {summary: "Confirm a one-time code", auth: authAdmin, request: reqres.VerifyChallengeRequest{}, status: http.StatusOK, response: reqres.VerifyChallengeResponse{}},
+	apiOperationKey("POST", LoginUserPath):       {summary: "Log in", request: reqres.LoginRequest{}, status: http.StatusOK, response: reqres.LoginResponse{}},
+	apiOperationKey("GET", MePath):               {summary: "Get your account", auth: authUser, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("PATCH", MePath):             {summary: "Update your account and profile", auth: authUser, request: reqres.UpdateMeRequest{}, status: http.StatusOK, response: reqres.UpdateUserResponse{}},
+	apiOperationKey("POST", AcceptTOSPath):       {summary: "Accept the terms of service", auth: authUser, request: reqres.AcceptTOSRequest{}, status: http.StatusOK, response: reqres.MessageResponse{}},
+	apiOperationKey("GET", PermissionsPath):      {summary: "Get your permissions", auth: authUser, status: http.StatusOK, response: reqres.PermissionsResponse{}},
+	apiOperationKey("GET", AuthMethodsPath):      {summary: "Get the ways you can authenticate", auth: authUser, status: http.StatusOK, response: reqres.AuthMethodsResponse{}},
+	apiOperationKey("GET", SecurityEventsPath):   {summary: "List your recent security events", auth: authUser, status: http.StatusOK, response: reqres.SecurityEventsResponse{}},
+	apiOperationKey("GET", PasswordStatusPath):   {summary: "Get how old your password is", auth: authUser, status: http.StatusOK, response: reqres.PasswordStatusResponse{}},
+	apiOperationKey("POST", CloseAccountPath):    {summary: "Close your account", auth: authUser, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("POST", CancelClosePath):     {summary: "Cancel closing your account", request: reqres.LoginRequest{}, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("GET", PasswordPolicyPath):   {summary: "Get the password policy", status: http.StatusOK, response: reqres.PasswordPolicyResponse{}},
+	apiOperationKey("POST", CheckPasswordPath):   {summary: "Check a password against the policy", request: reqres.CheckPasswordRequest{}, status: http.StatusOK, response: reqres.CheckPasswordResponse{}},
+	apiOperationKey("POST", RequestResetPath):    {summary: "Request a password reset token", request: reqres.RequestPasswordResetRequest{}, status: http.StatusOK, response: reqres.MessageResponse{}},
+	apiOperationKey("POST", ConfirmResetPath):    {summary: "Reset a password with a reset token", request: reqres.ConfirmPasswordResetRequest{}, status: http.StatusOK, response: reqres.MessageResponse{}},
+	apiOperationKey("GET", RolesPath):            {summary: "List the roles", status: http.StatusOK, response: reqres.RolesResponse{}},
+	apiOperationKey("GET", DiscoveryPath):        {summary: "Get the discovery document", status: http.StatusOK, response: reqres.DiscoveryResponse{}},
+	apiOperationKey("GET", JWKSPath):             {summary: "Get the keys tokens are verified with", status: http.StatusOK, response: reqres.JWKSResponse{}},
+	apiOperationKey("POST", RefreshTokenPath):    {summary: "Swap a refresh token for new tokens", request: reqres.RefreshTokenRequest{}, status: http.StatusOK, response: reqres.LoginResponse{}},
+	apiOperationKey("POST", LogoutPath):          {summary: "Log out", auth: authUser, request: reqres.LogoutRequest{}, status: http.StatusNoContent},
+	apiOperationKey("POST", UsersLogoutPath):     {summary: "Log out", auth: authUser, request: reqres.LogoutRequest{}, status: http.StatusNoContent},
+	apiOperationKey("POST", TokenRevokedPath):    {summary: "Check whether a token was revoked", auth: authService, request: reqres.TokenRevokedRequest{}, status: http.StatusOK, response: reqres.TokenRevokedResponse{}},
+	apiOperationKey("GET", OAuthAuthorizePath):   {summary: "Log in with a provider", status: http.StatusFound},
+	apiOperationKey("GET", OAuthCallbackPath):    {summary: "Finish logging in with a provider", status: http.StatusOK, response: reqres.LoginResponse{}},
+	apiOperationKey("POST", IdentityPath):        {summary: "Start linking an identity from a provider", auth: authSelf, status: http.StatusOK, response: reqres.LinkIdentityResponse{}},
+	apiOperationKey("DELETE", IdentityPath):      {summary: "Unlink an identity", auth: authSelf, status: http.StatusOK, response: reqres.GetUserResponse{}},
+	apiOperationKey("POST", APIKeysPath):         {summary: "Create an API key", auth: authSelf, request: reqres.CreateAPIKeyRequest{}, status: http.StatusCreated, response: reqres.CreateAPIKeyResponse{}},
+	apiOperationKey("GET", APIKeysPath):          {summary: "List the API keys of a user", auth: authSelf, status: http.StatusOK, response: reqres.ListAPIKeysResponse{}},
+	apiOperationKey("DELETE", APIKeyPath):        {summary: "Revoke an API key", auth: authSelf, status: http.StatusNoContent},
+	apiOperationKey("GET", HealthzPath):          {summary: "Check the service is up", status: http.StatusOK, response: reqres.HealthResponse{}},
+	apiOperationKey("GET", ReadyzPath):           {summary: "Check the service can take requests", status: http.StatusOK, response: reqres.HealthResponse{}},
+	apiOperationKey("GET", MetricsPath):          {summary: "Get the service metrics", status: http.StatusOK},
+	apiOperationKey("GET", SearchUsersPath):      {summary: "Search users", auth: authAdmin, status: http.StatusOK, response: reqres.ListUsersResponse{}, paged: true},
+	apiOperationKey("GET", UsersByScopePath):     {summary: "List the users with a scope", auth: authAdmin, status: http.StatusOK, response: reqres.ListUsersResponse{}, paged: true},
+	apiOperationKey("POST", DeactivateUsersPath): {summary: "Deactivate inactive users", auth: authAdmin, status: http.StatusOK, response: reqres.DeactivateInactiveResponse{}},
+	apiOperationKey("POST", BulkUpdatePath):      {summary: "Update users from a CSV", auth: authAdmin, status: http.StatusOK, response: reqres.BulkUpdateResponse{}},
+	apiOperationKey("POST", ResendVerifiesPath):  {summary: "Resend the verifications of every pending user in the background", auth: authAdmin, status: http.StatusAccepted, response: reqres.ResendVerificationsResponse{}},
+	apiOperationKey("GET", ExportUsersPath):      {summary: "Stream every user as JSON lines, after the user with the id of after", auth: authAdmin, status: http.StatusOK},
+	apiOperationKey("GET", EmailPreviewPath):     {summary: "Render an email with sample data", auth: authAdmin, status: http.StatusOK},
+	apiOperationKey("POST", WebhookTestPath):     {summary: "Send a signed sample event to the webhook", auth: authAdmin, request: reqres.TestWebhookRequest{}, status: http.StatusOK, response: reqres.TestWebhookResponse{}},
+	apiOperationKey("GET", DeadLettersPath):      {summary: "List the webhook deliveries given up on", auth: authAdmin, status: http.StatusOK, response: reqres.ListDeadLettersResponse{}},
+	apiOperationKey("POST", ReplayLetterPath):    {summary: "Replay a webhook delivery given up on", auth: authAdmin, status: http.StatusOK, response: reqres.ReplayDeadLetterResponse{}},
+	apiOperationKey("POST", BulkVerifyPath):      {summary: "Mark users verified by ID or email", auth: authAdmin, request: reqres.BulkVerifyRequest{}, status: http.StatusOK, response: reqres.BulkVerifyResponse{}},
+	apiOperationKey("GET", StatsPath):            {summary: "Get user statistics", auth: authAdmin, status: http.StatusOK, response: reqres.GetStatsResponse{}},
+	apiOperationKey("POST", GCTokensPath):        {summary: "Garbage collect expired tokens", auth: authAdmin, status: http.StatusOK, response: reqres.GCTokensResponse{}},
+	apiOperationKey("POST", DrainPath):           {summary: "Drain the instance", auth: authAdmin, status: http.StatusAccepted, response: reqres.DrainResponse{}},
+	apiOperationKey("GET", OpenAPIPath):          {summary: "Get this document", status: http.StatusOK},
+}
+
+// pathParamPattern matches the variables of a route path template, with the
+// pattern they may have
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// newOpenAPIDocument describes the routes of router as an OpenAPI 3.0
+// document. Request schemas are inlined, response schemas are shared as
+// components and follow the casing of JSON responses.
+func newOpenAPIDocument(router *mux.Router, publicURL string) (map[string]interface{}, error) {
+	responses := &schemaGenerator{components: map[string]interface{}{}, camel: jsonFieldCase == camelCase}
+	requests := &schemaGenerator{}
+
+	paths := map[string]map[string]interface{}{}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path := pathParamPattern.ReplaceAllString(template, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		for _, method := range methods {
+			op := apiOperations[apiOperationKey(method, template)]
+			paths[path][strings.ToLower(method)] = op.document(template, requests, responses)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	responses.schemaOf(reflect.TypeOf(reqres.ErrorResponse{}))
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "buzzapp users",
+			"version": Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": responses.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+	if publicURL != "" {
+		doc["servers"] = []interface{}{map[string]interface{}{"url": publicURL}}
+	}
+	return doc, nil
+}
+
+// document describes op, served at the path template, as an OpenAPI operation
+func (op apiOperation) document(template string, requests, responses *schemaGenerator) map[string]interface{} {
+	doc := map[string]interface{}{}
+	if op.summary != "" {
+		doc["summary"] = op.summary
+	}
+
+	switch op.auth {
+	case authAdmin:
+		doc["description"] = "Admins only."
+	case authSelf:
+		doc["description"] = "The user themselves or an admin."
+	case authService:
+		doc["description"] = "Trusted services, by signed request or bearer token."
+	}
+	if op.auth != authPublic {
+		doc["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+	}
+
+	var params []interface{}
+	for _, match := range pathParamPattern.FindAllStringSubmatch(template, -1) {
+		params = append(params, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+	}
+	if op.paged {
+		for _, name := range []string{"limit", "offset", "page", "per_page"} {
+			params = append(params, map[string]interface{}{"name": name, "in": "query", "schema": map[string]interface{}{"type": "integer"}})
+		}
+	}
+	if len(op.versions) > 0 {
+		params = append(params, map[string]interface{}{"name": schemaVersionHeader, "in": "header", "description": "Version of the request body schema, the latest when omitted.", "schema": map[string]interface{}{"type": "string"}})
+	}
+	if len(params) > 0 {
+		doc["parameters"] = params
+	}
+
+	if op.request != nil {
+		doc["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": requests.schemaOf(reflect.TypeOf(op.request))},
+			},
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": responses.schemaOf(reflect.TypeOf(op.response))},
+		}
+	}
+	doc["responses"] = map[string]interface{}{
+		fmt.Sprint(status): success,
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"}},
+			},
+		},
+	}
+	return doc
+}
+
+// schemaGenerator turns Go types into OpenAPI schemas, the way encoding/json
+// would marshal them. Structs are shared as components when there are
+// components to share them in, and are inlined otherwise.
+type schemaGenerator struct {
+	components map[string]interface{}
+	camel      bool
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := g.schemaOf(t.Elem())
+		if _, ok := schema["$ref"]; ok {
+			return schema
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if g.components == nil || t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			// Claimed ahead of generating it, for types that refer to
+			// themselves
+			g.components[t.Name()] = nil
+			g.components[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema describes the JSON object a struct marshals into
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	g.addProperties(properties, t)
+	return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+func (g *schemaGenerator) addProperties(properties map[string]interface{}, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		if field.Anonymous && tag[0] == "" && field.Type.Kind() == reflect.Struct {
+			g.addProperties(properties, field.Type)
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = field.Name
+		}
+		if g.camel {
+			name = toCamelCase(name)
+		}
+		properties[name] = g.schemaOf(field.Type)
+	}
+}
+
+// handleGetOpenAPI serves the OpenAPI document of router. It is built on the
+// first request, once every route is registered.
+func handleGetOpenAPI(router *mux.Router, publicURL string) http.Handler {
+	var (
+		once sync.Once
+		js   []byte
+		err  error
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			var doc map[string]interface{}
+			if doc, err = newOpenAPIDocument(router, publicURL); err == nil {
+				js, err = json.Marshal(doc)
+			}
+		})
+		if err != nil {
+			respondWithError("unable to build the OpenAPI document", err, w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(js)
+	})
+}
+
+// requestValidationMiddleware rejects JSON bodies with fields the route of
+// router they're for doesn't take, or values of the wrong type, before they
+// reach the handlers. Bodies that aren't JSON at all are left for the handlers
+// to refuse.
+func requestValidationMiddleware(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if r.Body == nil || !isJSONRequest(r) || !router.Match(r, &match) || match.Route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := match.Route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body := apiOperations[apiOperationKey(r.Method, template)].requestBody(r.Header.Get(schemaVersionHeader))
+		if body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Hand the handler what the check read, followed by the rest
+		var read bytes.Buffer
+		err = validateJSONBody(io.TeeReader(r.Body, &read), reflect.TypeOf(body))
+		r.Body = ioutil.NopCloser(io.MultiReader(&read, r.Body))
+		if err != nil {
+			respondWithError("Validation error", err, w, http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isJSONRequest reports whether r says its body is JSON, or doesn't say
+func isJSONRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// validateJSONBody checks body holds a t, without unknown fields or values of
+// the wrong type. Empty bodies and malformed JSON are the handlers' to refuse.
+func validateJSONBody(body io.Reader, t reflect.Type) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(reflect.New(t).Interface())
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil, err == io.EOF, err == io.ErrUnexpectedEOF:
+		return nil
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("request body must be %s", jsonTypeName(typeErr.Type))
+		}
+		return fmt.Errorf("%s must be %s", typeErr.Field, jsonTypeName(typeErr.Type))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	default:
+		return nil
+	}
+}
+
+// jsonTypeName names the JSON type t is decoded from, e.g. "a string"
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
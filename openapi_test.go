@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle(CreateUserPath, http.NotFoundHandler()).Methods("POST")
+	router.Handle(SessionPath, http.NotFoundHandler()).Methods("DELETE")
+	router.Handle(OpenAPIPath, handleGetOpenAPI(router, "https://users.example.com")).Methods("GET")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", OpenAPIPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]map[string]struct {
+			Summary    string                     `json:"summary"`
+			Security   []map[string][]string      `json:"security"`
+			Parameters []map[string]interface{}   `json:"parameters"`
+			Request    map[string]interface{}     `json:"requestBody"`
+			Responses  map[string]json.RawMessage `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != "3.0.3" || len(doc.Servers) != 1 || doc.Servers[0].URL != "https://users.example.com" {
+		t.Errorf("Expected an OpenAPI 3.0 document for the public URL but got: %s %v", doc.OpenAPI, doc.Servers)
+	}
+	if len(doc.Paths) != 3 {
+		t.Errorf("Expected every route to be documented but got: %v", doc.Paths)
+	}
+
+	signup := doc.Paths[CreateUserPath]["post"]
+	if signup.Summary == "" || signup.Request == nil || signup.Security != nil {
+		t.Errorf("Expected a public signup with a request body but got: %+v", signup)
+	}
+	if _, ok := signup.Responses["201"]; !ok {
+		t.Errorf("Expected signups to respond with a 201 but got: %v", signup.Responses)
+	}
+	user := doc.Components.Schemas["User"]
+	if user.Properties["first_name"]["type"] != "string" || user.Properties["updated_at"]["format"] != "date-time" {
+		t.Errorf("Expected the user schema to follow its JSON tags but got: %v", user.Properties)
+	}
+	if _, ok := user.Properties["password"]; ok {
+		t.Error("Expected fields that aren't marshalled to be left out")
+	}
+
+	revoke := doc.Paths["/users/{id}/sessions/{sessionID}"]["delete"]
+	if len(revoke.Security) != 1 || len(revoke.Parameters) != 2 {
+		t.Errorf("Expected an authenticated route with two path parameters but got: %+v", revoke)
+	}
+}
+
+func TestRequestValidationMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle(LoginUserPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusTeapot)
+		}
+	})).Methods("POST")
+	router.Handle(CreateUserPath, http.NotFoundHandler()).Methods("POST")
+	handler := requestValidationMiddleware(router, router)
+
+	post := func(path, body, contentType, version string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if version != "" {
+			req.Header.Set(schemaVersionHeader, version)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, test := range []struct {
+		body, contentType string
+		code              int
+		message           string
+	}{
+		{`{"username": "testUser", "password": "secret"}`, "application/json", http.StatusOK, ""},
+		{`{"username": "testUser", "pasword": "secret"}`, "", http.StatusBadRequest, `unknown field \"pasword\"`},
+		{`{"username": 42}`, "application/json; charset=utf-8", http.StatusBadRequest, "username must be a string"},
+		{`["testUser"]`, "", http.StatusBadRequest, "request body must be an object"},
+		{`{"username": 42}`, "text/plain", http.StatusOK, ""},
+		{`{not json`, "", http.StatusTeapot, ""},
+	} {
+		rec := post(LoginUserPath, test.body, test.contentType, "")
+		if rec.Code != test.code {
+			t.Errorf("Expected %s to be a %d but got: %d", test.body, test.code, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), test.message) {
+			t.Errorf("Expected %s to be refused with %q but got: %s", test.body, test.message, rec.Body.String())
+		}
+	}
+
+	// Bodies are checked against the schema version they ask for
+	if rec := post(CreateUserPath, `{"name": "Test User"}`, "", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a version 1 field to be refused by the latest schema but got: %d", rec.Code)
+	}
+	if rec := post(CreateUserPath, `{"name": "Test User"}`, "", "1"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected a version 1 field to be let through for version 1 but got: %d", rec.Code)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+var (
+	// passwordMaxAge is how long a password can be used before it has to be
+	// changed, 0 for as long as the user likes
+	passwordMaxAge time.Duration
+
+	// passwordExpiryWarning is how long before it expires a password is
+	// nearing expiry, so users can be prompted to change it in time
+	passwordExpiryWarning = 14 * 24 * time.Hour
+)
+
+// passwordStatusOf returns how old the password of user is at now and whether
+// it has to be changed. Passwords set before changes were recorded are as old
+// as their account.
+func passwordStatusOf(user *model.User, now time.Time) reqres.PasswordStatusResponse {
+	status := reqres.PasswordStatusResponse{ChangedAt: user.PasswordChangedAt, MaxAge: int64(passwordMaxAge / time.Second)}
+	if passwordMaxAge <= 0 {
+		return status
+	}
+
+	changedAt := time.Unix(user.Timestamp, 0)
+	if user.PasswordChangedAt != nil {
+		changedAt = *user.PasswordChangedAt
+	}
+	expiresAt := changedAt.Add(passwordMaxAge)
+
+	status.ExpiresAt = &expiresAt
+	status.Expired = !now.Before(expiresAt)
+	status.ExpiringSoon = !status.Expired && expiresAt.Sub(now) <= passwordExpiryWarning
+	status.ChangeRequired = status.Expired
+	return status
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+func TestPasswordStatusOf(t *testing.T) {
+	defer func(maxAge, warning time.Duration) {
+		passwordMaxAge, passwordExpiryWarning = maxAge, warning
+	}(passwordMaxAge, passwordExpiryWarning)
+
+	now := time.Now()
+	changedAt := func(age time.Duration) *model.User {
+		at := now.Add(-age)
+		return &model.User{PasswordChangedAt: &at}
+	}
+
+	// Passwords don't expire by default
+	passwordMaxAge = 0
+	if status := passwordStatusOf(changedAt(1000*24*time.Hour), now); status.Expired || status.ExpiresAt != nil {
+		t.Errorf("Expected passwords not to expire without a max age but got: %+v", status)
+	}
+
+	passwordMaxAge, passwordExpiryWarning = 90*24*time.Hour, 14*24*time.Hour
+	tests := []struct {
+		user     *model.User
+		expiring bool
+		expired  bool
+	}{
+		{changedAt(time.Hour), false, false},
+		{changedAt(80 * 24 * time.Hour), true, false},
+		{changedAt(90 * 24 * time.Hour), false, true},
+
+		// Passwords set before changes were recorded are as old as their account
+		{&model.User{Timestamp: now.Add(-100 * 24 * time.Hour).Unix()}, false, true},
+	}
+	for _, test := range tests {
+		status := passwordStatusOf(test.user, now)
+		if status.ExpiringSoon != test.expiring || status.Expired != test.expired || status.ChangeRequired != test.expired {
+			t.Errorf("Expected expiring %v and expired %v but got: %+v", test.expiring, test.expired, status)
+		}
+	}
+}
+
+func TestGetPasswordStatusHTTPEndpoint(t *testing.T) {
+	defer func(maxAge time.Duration) { passwordMaxAge = maxAge }(passwordMaxAge)
+	passwordMaxAge = 90 * 24 * time.Hour
+
+	changedAt := time.Now().Add(-100 * 24 * time.Hour)
+	user := &model.User{ID: "expiredID", Username: "expiredUser", Role: "student", PasswordChangedAt: &changedAt}
+	server := httptest.NewServer(authMiddleware(handleGetPasswordStatus(storedUserService{user: user})))
+	defer server.Close()
+
+	token, err := generateToken(user.ID, user.Username, user.Role, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/me/password-status", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 status code response but got: %d", resp.StatusCode)
+	}
+
+	var payload = &reqres.PasswordStatusResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if !payload.Expired || !payload.ChangeRequired || payload.ChangedAt == nil || payload.ExpiresAt == nil || payload.MaxAge != int64(passwordMaxAge/time.Second) {
+		t.Errorf("Expected the password to have to be changed but got: %+v", payload)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"text/template"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// defaultPasswordChangedNotice is the notice users get when their password is
+// reset, unless a template of our own is configured
+const defaultPasswordChangedNotice = `Hi {{.FirstName}},
+
+The password of your account {{.Username}} was reset on {{.ChangedAt.Format "Jan 2 15:04 MST"}}{{if .IP}} from {{.IP}}{{end}}.
+
+If this was you, there is nothing else to do. If it wasn't, someone else may have access to your email: reset your password again and secure your email account.
+`
+
+var (
+	// passwordChangedNotices tells users when their password is reset
+	passwordChangedNotices = false
+
+	// passwordChangedNoticeTemplate renders the notice, given a
+	// passwordChangedNotice
+	passwordChangedNoticeTemplate = template.Must(template.New("password-changed").Parse(defaultPasswordChangedNotice))
+
+	// passwordChangedNoticeSender delivers password changed notices to users.
+	// Notices aren't sent when it's nil.
+	passwordChangedNoticeSender PasswordChangedNoticeSender
+)
+
+// PasswordChangedNoticeSender is an interface for delivering password changed
+// notices to users, e.g. by email
+type PasswordChangedNoticeSender interface {
+	SendPasswordChangedNotice(user *model.User, notice string) error
+}
+
+// logPasswordChangedNoticeSender writes notices to the service log, for
+// development only
+type logPasswordChangedNoticeSender struct{}
+
+func (logPasswordChangedNoticeSender) SendPasswordChangedNotice(user *model.User, notice string) error {
+	log.Printf("password changed notice for user %s:\n%s", user.ID, notice)
+	return nil
+}
+
+// passwordChangedNotice is what password changed notice templates are
+// rendered with. IP is where the reset was confirmed from.
+type passwordChangedNotice struct {
+	Username  string
+	FirstName string
+	LastName  string
+	ChangedAt time.Time
+	IP        string
+}
+
+// parsePasswordChangedNoticeTemplate reads the password changed notice
+// template at path
+func parsePasswordChangedNoticeTemplate(path string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("password-changed").Parse(string(text))
+}
+
+// notifyPasswordChanged tells user their password was reset from ip at
+// changedAt. It is best effort: the reset is done either way.
+func notifyPasswordChanged(user *model.User, ip string, changedAt time.Time) {
+	if !passwordChangedNotices || passwordChangedNoticeSender == nil {
+		return
+	}
+
+	var notice bytes.Buffer
+	data := passwordChangedNotice{Username: user.Username, FirstName: user.FirstName, LastName: user.LastName, ChangedAt: changedAt, IP: ip}
+	if err := passwordChangedNoticeTemplate.Execute(&notice, data); err != nil {
+		log.Println("unable to send password changed notice:", err)
+		return
+	}
+	if err := passwordChangedNoticeSender.SendPasswordChangedNotice(user, notice.String()); err != nil {
+		log.Println("unable to send password changed notice:", err)
+	}
+}
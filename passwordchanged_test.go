@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// capturingPasswordChangedSender hands the notices it is asked to send over
+type capturingPasswordChangedSender struct {
+	notices chan string
+}
+
+func (s capturingPasswordChangedSender) SendPasswordChangedNotice(user *model.User, notice string) error {
+	s.notices <- user.Username + ": " + notice
+	return nil
+}
+
+// resettingUserService resets passwords with a single valid token, without a
+// database
+type resettingUserService struct {
+	UserService
+}
+
+func (resettingUserService) ResetPassword(ctx context.Context, token, newPassword string) (*model.User, error) {
+	if token != "valid" {
+		return nil, errInvalidResetToken
+	}
+	return &model.User{ID: "resetID", Username: "alice", FirstName: "Alice"}, nil
+}
+
+func TestPasswordChangedNotice(t *testing.T) {
+	defer func(enabled bool, sender PasswordChangedNoticeSender) {
+		passwordChangedNotices, passwordChangedNoticeSender = enabled, sender
+	}(passwordChangedNotices, passwordChangedNoticeSender)
+
+	sender := capturingPasswordChangedSender{notices: make(chan string, 10)}
+	passwordChangedNoticeSender = sender
+	passwordChangedNotices = true
+	handler := handleConfirmPasswordReset(resettingUserService{})
+
+	reset := func(token string) int {
+		req := httptest.NewRequest("POST", "/password/reset/confirm", strings.NewReader(`{"token":"`+token+`","new_password":"correct horse battery"}`))
+		req.RemoteAddr = "10.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	received := func() (string, bool) {
+		select {
+		case notice := <-sender.notices:
+			return notice, true
+		case <-time.After(100 * time.Millisecond):
+			return "", false
+		}
+	}
+
+	// Failed resets change nothing to tell about
+	if status := reset("expired"); status != http.StatusBadRequest {
+		t.Fatalf("Expected a 400 status code response but got: %d", status)
+	}
+	if notice, ok := received(); ok {
+		t.Errorf("Expected no notice for a failed reset but got: %s", notice)
+	}
+
+	if status := reset("valid"); status != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", status)
+	}
+	notice, ok := received()
+	if !ok {
+		t.Fatal("Expected the reset to send a notice")
+	}
+	if !strings.HasPrefix(notice, "alice: ") || !strings.Contains(notice, "was reset on") || !strings.Contains(notice, "from 10.0.0.1") {
+		t.Errorf("Expected the notice to tell alice when and where their password was reset but got: %s", notice)
+	}
+
+	// Disabled notices aren't sent
+	passwordChangedNotices = false
+	reset("valid")
+	if notice, ok := received(); ok {
+		t.Errorf("Expected no notice while disabled but got: %s", notice)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	hashBcrypt   = "bcrypt"
+	hashArgon2id = "argon2id"
+)
+
+// PasswordHasher is an interface for hashing and verifying passwords. Hashes
+// start with an identifier of their algorithm, so any stored hash can be
+// verified whichever algorithm is configured.
+type PasswordHasher interface {
+	// Algorithm names the algorithm of the hasher
+	Algorithm() string
+
+	Hash(password string) (string, error)
+
+	// Verify reports whether password matches hash
+	Verify(hash, password string) (bool, error)
+
+	// NeedsRehash reports whether a hash of this algorithm was made with
+	// weaker parameters than the hasher's
+	NeedsRehash(hash string) bool
+}
+
+// bcryptCost is the cost new bcrypt hashes are made with. Raising it rehashes
+// existing passwords as users log in.
+var bcryptCost = bcrypt.DefaultCost
+
+func isValidBcryptCost(cost int) bool {
+	return cost >= bcrypt.MinCost && cost <= bcrypt.MaxCost
+}
+
+// passwordHasher hashes new passwords. Passwords hashed differently are
+// rehashed with it on login.
+var passwordHasher PasswordHasher = bcryptHasher{cost: bcryptCost}
+
+func newPasswordHasher(algorithm string) (PasswordHasher, error) {
+	switch algorithm {
+	case hashBcrypt:
+		return bcryptHasher{cost: bcryptCost}, nil
+	case hashArgon2id:
+		return argon2idHasher{time: 1, memory: 64 * 1024, threads: 4, keyLength: 32}, nil
+	}
+	return nil, errors.New("unknown password hash: " + algorithm)
+}
+
+// hasherFor returns the hasher that made hash
+func hasherFor(hash string) (PasswordHasher, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		if passwordHasher.Algorithm() == hashArgon2id {
+			return passwordHasher, nil
+		}
+		return newPasswordHasher(hashArgon2id)
+	}
+	if strings.HasPrefix(hash, "$2") {
+		if passwordHasher.Algorithm() == hashBcrypt {
+			return passwordHasher, nil
+		}
+		return newPasswordHasher(hashBcrypt)
+	}
+	return nil, errors.New("unknown password hash format")
+}
+
+// verifyPassword checks password against hash, whatever algorithm and pepper
+// made it, and reports whether the hash should be replaced with one by
+// hashPassword
+func verifyPassword(hash, password string) (bool, bool, error) {
+	pepperID, hash := splitPepperedHash(hash)
+	if pepperID != "" {
+		pepper, ok := pepperByID(pepperID)
+		if !ok {
+			return false, false, errUnknownPepper
+		}
+		password = pepperPassword(password, pepper)
+	}
+
+	hasher, err := hasherFor(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	ok, err := hasher.Verify(hash, password)
+	if err != nil || !ok {
+		return false, false, err
+	}
+
+	rehash := hasher.Algorithm() != passwordHasher.Algorithm() || hasher.NeedsRehash(hash) || pepperID != currentPepperID()
+	return true, rehash, nil
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (bcryptHasher) Algorithm() string {
+	return hashBcrypt
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hash), err
+}
+
+func (bcryptHasher) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h bcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.cost
+}
+
+// argon2idHasher stores hashes in the PHC string format,
+// $argon2id$v=19$m={memory},t={time},p={threads}${salt}${key}
+type argon2idHasher struct {
+	time      uint32
+	memory    uint32
+	threads   uint8
+	keyLength uint32
+}
+
+func (argon2idHasher) Algorithm() string {
+	return hashArgon2id
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (argon2idHasher) Verify(hash, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(candidate, key) == 1, nil
+}
+
+func (h argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := decodeArgon2idHash(hash)
+	return err != nil || params.time < h.time || params.memory < h.memory
+}
+
+func decodeArgon2idHash(hash string) (argon2idHasher, []byte, []byte, error) {
+	var params argon2idHasher
+	var version int
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errors.New("invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.keyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	for _, algorithm := range []string{hashBcrypt, hashArgon2id} {
+		hasher, err := newPasswordHasher(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := hasher.Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := hasher.Verify(hash, "correct horse"); err != nil || !ok {
+			t.Errorf("%s: expected the password to match its hash but got: %v, %v", algorithm, ok, err)
+		}
+		if ok, _ := hasher.Verify(hash, "battery staple"); ok {
+			t.Errorf("%s: expected another password not to match", algorithm)
+		}
+		if hasher.NeedsRehash(hash) {
+			t.Errorf("%s: expected a fresh hash not to need rehashing", algorithm)
+		}
+	}
+}
+
+func TestVerifyPasswordAcrossAlgorithms(t *testing.T) {
+	defer func(hasher PasswordHasher) { passwordHasher = hasher }(passwordHasher)
+
+	bcryptHash, _ := bcryptHasher{cost: bcrypt.MinCost}.Hash("correct horse")
+	argon2Hasher, _ := newPasswordHasher(hashArgon2id)
+	argon2Hash, _ := argon2Hasher.Hash("correct horse")
+
+	if !strings.HasPrefix(argon2Hash, "$argon2id$v=19$") {
+		t.Errorf("Expected the hash to identify its algorithm but got: %s", argon2Hash)
+	}
+
+	// With argon2id configured, bcrypt hashes still verify but need moving
+	passwordHasher = argon2Hasher
+	if ok, rehash, err := verifyPassword(bcryptHash, "correct horse"); err != nil || !ok || !rehash {
+		t.Errorf("Expected a bcrypt hash to verify and need rehashing but got: %v, %v, %v", ok, rehash, err)
+	}
+	if ok, rehash, _ := verifyPassword(argon2Hash, "correct horse"); !ok || rehash {
+		t.Errorf("Expected an argon2id hash to verify without rehashing but got: %v, %v", ok, rehash)
+	}
+
+	// And the other way around
+	passwordHasher = bcryptHasher{cost: bcrypt.MinCost}
+	if ok, rehash, err := verifyPassword(argon2Hash, "correct horse"); err != nil || !ok || !rehash {
+		t.Errorf("Expected an argon2id hash to verify and need rehashing but got: %v, %v, %v", ok, rehash, err)
+	}
+
+	// A weaker bcrypt cost is rehashed too
+	passwordHasher = bcryptHasher{cost: bcrypt.MinCost + 1}
+	if _, rehash, _ := verifyPassword(bcryptHash, "correct horse"); !rehash {
+		t.Error("Expected a bcrypt hash with a lower cost to need rehashing")
+	}
+
+	// A wrong password never asks for a rehash
+	if ok, rehash, _ := verifyPassword(bcryptHash, "battery staple"); ok || rehash {
+		t.Errorf("Expected a wrong password to fail without rehashing but got: %v, %v", ok, rehash)
+	}
+}
+
+func TestConfiguredBcryptCost(t *testing.T) {
+	defer func(cost int) { bcryptCost = cost }(bcryptCost)
+	bcryptCost = bcrypt.MinCost + 1
+
+	hasher, err := newPasswordHasher(hashBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, _ := bcrypt.Cost([]byte(hash)); cost != bcryptCost {
+		t.Errorf("Expected the hash to be made with the configured cost %d but got: %d", bcryptCost, cost)
+	}
+
+	if isValidBcryptCost(bcrypt.MinCost-1) || isValidBcryptCost(bcrypt.MaxCost+1) {
+		t.Error("Expected costs bcrypt can't use to be refused")
+	}
+}
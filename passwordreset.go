@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	// passwordResetTTL is how long a password reset token can be used for
+	passwordResetTTL = time.Hour
+
+	// passwordResetSender delivers password reset tokens to users. Resets
+	// can't be requested when it's nil.
+	passwordResetSender PasswordResetSender
+)
+
+var (
+	errNoPasswordResetSender = errors.New("no way of delivering password reset tokens is configured")
+	errInvalidResetToken     = errors.New("invalid, expired or already used password reset token")
+)
+
+// PasswordResetSender is an interface for delivering password reset tokens to
+// users, e.g. as a link in an email
+type PasswordResetSender interface {
+	SendPasswordReset(user *model.User, token string) error
+}
+
+// logPasswordResetSender writes tokens to the service log, for development only
+type logPasswordResetSender struct{}
+
+func (logPasswordResetSender) SendPasswordReset(user *model.User, token string) error {
+	log.Printf("password reset token for user %s: %s", user.ID, token)
+	return nil
+}
+
+// passwordResetCollection returns the collection of password resets, making
+// sure the database drops expired ones. Resets are random like refresh
+// tokens, so they are generated and stored hashed the same way.
+func passwordResetCollection(session *mgo.Session) (*mgo.Collection, error) {
+	collection := session.DB("buzz-test-user").C("password_resets")
+
+	index := mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second,
+	}
+	if err := collection.EnsureIndex(index); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
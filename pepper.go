@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	// PasswordPepper is a secret mixed into passwords before they are hashed,
+	// set by the PASSWORD_PEPPER secret, so hashes leaked from the database
+	// alone can't be cracked. Passwords aren't peppered when it's empty.
+	PasswordPepper = ""
+
+	// PreviousPasswordPepper is the pepper in use before the current one, set
+	// by the PASSWORD_PREVIOUS_PEPPER secret. Its hashes still verify, and
+	// are moved to the current pepper as users log in.
+	PreviousPasswordPepper = ""
+)
+
+// pepperedHashPrefix starts peppered hashes, which are the hash made with the
+// pepper prefixed by $pepper${pepper id}
+const pepperedHashPrefix = "$pepper$"
+
+var errUnknownPepper = errors.New("password hash uses an unknown pepper")
+
+// pepperPassword mixes pepper into password. The HMAC keeps the result within
+// bcrypt's 72 byte limit however long the password is.
+func pepperPassword(password, pepper string) string {
+	mac := hmac.New(sha256.New, []byte(pepper))
+	io.WriteString(mac, password)
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// currentPepperID identifies the pepper new hashes are made with, which is
+// empty when passwords aren't peppered
+func currentPepperID() string {
+	if PasswordPepper == "" {
+		return ""
+	}
+	return keyID(PasswordPepper)
+}
+
+// pepperByID returns the pepper with the given id, current or previous
+func pepperByID(id string) (string, bool) {
+	if PasswordPepper != "" && id == keyID(PasswordPepper) {
+		return PasswordPepper, true
+	}
+	if PreviousPasswordPepper != "" && id == keyID(PreviousPasswordPepper) {
+		return PreviousPasswordPepper, true
+	}
+	return "", false
+}
+
+// hashPassword hashes a new password with passwordHasher, peppered with
+// PasswordPepper when there is one
+func hashPassword(password string) (string, error) {
+	if PasswordPepper == "" {
+		return passwordHasher.Hash(password)
+	}
+
+	hash, err := passwordHasher.Hash(pepperPassword(password, PasswordPepper))
+	if err != nil {
+		return "", err
+	}
+	return pepperedHashPrefix + currentPepperID() + hash, nil
+}
+
+// splitPepperedHash returns the id of the pepper of hash and the hash made
+// with it. Hashes made without a pepper have no id.
+func splitPepperedHash(hash string) (string, string) {
+	if !strings.HasPrefix(hash, pepperedHashPrefix) {
+		return "", hash
+	}
+	parts := strings.SplitN(strings.TrimPrefix(hash, pepperedHashPrefix), "$", 2)
+	if len(parts) != 2 {
+		return "", hash
+	}
+	return parts[0], "$" + parts[1]
+}
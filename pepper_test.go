@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPepperedPasswords(t *testing.T) {
+	defer func(hasher PasswordHasher, pepper, previous string) {
+		passwordHasher, PasswordPepper, PreviousPasswordPepper = hasher, pepper, previous
+	}(passwordHasher, PasswordPepper, PreviousPasswordPepper)
+	passwordHasher = bcryptHasher{cost: bcrypt.MinCost}
+
+	plainHash, _ := hashPassword("correct horse")
+
+	PasswordPepper = "first pepper"
+	firstHash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(firstHash, pepperedHashPrefix+keyID("first pepper")+"$2") {
+		t.Errorf("Expected the hash to name its pepper but got: %s", firstHash)
+	}
+	if ok, rehash, err := verifyPassword(firstHash, "correct horse"); err != nil || !ok || rehash {
+		t.Errorf("Expected a peppered hash to verify without rehashing but got: %v, %v, %v", ok, rehash, err)
+	}
+	if ok, _, _ := verifyPassword(firstHash, "battery staple"); ok {
+		t.Error("Expected another password not to match")
+	}
+
+	// The hash alone isn't enough to check passwords against
+	if ok, _ := passwordHasher.Verify(strings.TrimPrefix(firstHash, pepperedHashPrefix+keyID("first pepper")), "correct horse"); ok {
+		t.Error("Expected the password not to match the hash without the pepper")
+	}
+
+	// Hashes made before peppering was turned on get peppered on login
+	if ok, rehash, err := verifyPassword(plainHash, "correct horse"); err != nil || !ok || !rehash {
+		t.Errorf("Expected an unpeppered hash to verify and need rehashing but got: %v, %v, %v", ok, rehash, err)
+	}
+
+	// Rotating the pepper moves hashes to the new one
+	PasswordPepper, PreviousPasswordPepper = "second pepper", "first pepper"
+	if ok, rehash, err := verifyPassword(firstHash, "correct horse"); err != nil || !ok || !rehash {
+		t.Errorf("Expected a hash with the previous pepper to verify and need rehashing but got: %v, %v, %v", ok, rehash, err)
+	}
+	secondHash, _ := hashPassword("correct horse")
+	if ok, rehash, _ := verifyPassword(secondHash, "correct horse"); !ok || rehash {
+		t.Errorf("Expected a hash with the current pepper to verify without rehashing but got: %v, %v", ok, rehash)
+	}
+
+	// Hashes with a pepper that's gone can't be verified
+	PreviousPasswordPepper = ""
+	if _, _, err := verifyPassword(firstHash, "correct horse"); err != errUnknownPepper {
+		t.Errorf("Expected an unknown pepper error but got: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/buzzapp/user/model"
+)
+
+// Fields that can be encrypted at rest
+const (
+	piiFieldEmail = "email"
+	piiFieldPhone = "phone"
+)
+
+// encryptedValuePrefix marks encrypted values, so values stored before
+// encryption was turned on are still read as they are
+const encryptedValuePrefix = "enc:v1:"
+
+var (
+	// PIIEncryptionKey is the key sensitive fields are encrypted and blind
+	// indexed with, set by the PII_ENCRYPTION_KEY secret
+	PIIEncryptionKey = ""
+
+	// encryptedFields are the fields encrypted at rest. Nothing is encrypted
+	// by default.
+	encryptedFields = map[string]bool{}
+)
+
+var errMissingPIIKey = errors.New("a PII encryption key is required to encrypt fields")
+
+// parseEncryptedFields parses comma separated fields to encrypt at rest
+func parseEncryptedFields(spec string) (map[string]bool, error) {
+	fields := map[string]bool{}
+	if strings.TrimSpace(spec) == "" {
+		return fields, nil
+	}
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field != piiFieldEmail && field != piiFieldPhone {
+			return nil, errors.New("unknown field to encrypt: " + field)
+		}
+		fields[field] = true
+	}
+	return fields, nil
+}
+
+// piiKey derives a key for one purpose from PIIEncryptionKey, so the
+// encryption and blind index keys are never the same
+func piiKey(purpose string) []byte {
+	key := sha256.Sum256([]byte(purpose + ":" + PIIEncryptionKey))
+	return key[:]
+}
+
+// encryptField encrypts a value with AES-256-GCM under a random nonce
+func encryptField(value string) (string, error) {
+	block, err := aes.NewCipher(piiKey("encryption"))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedValuePrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptField reverses encryptField. Values without the encrypted prefix are
+// returned as they are.
+func decryptField(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(piiKey("encryption"))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// blindIndex is a keyed hash of a value, so encrypted values can still be
+// looked up and kept unique without decrypting them
+func blindIndex(value string) string {
+	mac := hmac.New(sha256.New, piiKey("blind-index"))
+	io.WriteString(mac, value)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptUser returns a copy of user with the encrypted fields encrypted and
+// indexed, ready to be stored. The email key is only stored in the clear when
+// the email is.
+func encryptUser(user *model.User) (*model.User, error) {
+	stored := *user
+	stored.EmailKey = ""
+	if stored.Email != "" {
+		stored.EmailKey = emailKey(stored.Email)
+	}
+	if encryptedFields[piiFieldEmail] && stored.Email != "" {
+		email, err := encryptField(stored.Email)
+		if err != nil {
+			return nil, err
+		}
+		stored.Email = email
+		stored.EmailIndex = blindIndex(stored.EmailKey)
+		stored.EmailKey = ""
+	}
+	phone, err := encryptPhone(stored.Phone)
+	if err != nil {
+		return nil, err
+	}
+	stored.Phone = phone
+	return &stored, nil
+}
+
+// encryptPhone returns phone as stored, encrypted when phones are. Phones
+// aren't looked up, so they have no blind index.
+func encryptPhone(phone string) (string, error) {
+	if !encryptedFields[piiFieldPhone] || phone == "" {
+		return phone, nil
+	}
+	return encryptField(phone)
+}
+
+// decryptUsers decrypts the fields of users read from the database in place
+func decryptUsers(users ...*model.User) error {
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		email, err := decryptField(user.Email)
+		if err != nil {
+			return err
+		}
+		user.Email = email
+		phone, err := decryptField(user.Phone)
+		if err != nil {
+			return err
+		}
+		user.Phone = phone
+	}
+	return nil
+}
+
+func decryptUserSlice(users []model.User) error {
+	for i := range users {
+		if err := decryptUsers(&users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emailQuery matches the user with email in any case, through its key or its
+// blind index when emails are encrypted. Emails stored in lower case before
+// they had a key, or before encryption was turned on, still match.
+func emailQuery(email string) bson.M {
+	key := emailKey(email)
+	query := []bson.M{{"email_key": key}, {"email": key}}
+	if encryptedFields[piiFieldEmail] {
+		query = append(query, bson.M{"email_index": blindIndex(key)})
+	}
+	return bson.M{"$or": query}
+}
+
+// checkEmailAvailable makes sure no other user has email. The unique indexes
+// can't tell a plaintext email from its encrypted twin while both kinds are
+// stored.
+func checkEmailAvailable(collection *mgo.Collection, id, email string) error {
+	count, err := collection.Find(mongoUserQuery(emailClash(id, email))).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errDuplicateEmail
+	}
+	return nil
+}
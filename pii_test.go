@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buzzapp/user/model"
+)
+
+func TestEncryptFieldRoundTrip(t *testing.T) {
+	defer func(key string) { PIIEncryptionKey = key }(PIIEncryptionKey)
+	PIIEncryptionKey = "test-pii-key"
+
+	first, err := encryptField("jane@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encryptField("jane@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(first, "jane") || first == second {
+		t.Errorf("Expected opaque values under fresh nonces but got: %s and %s", first, second)
+	}
+
+	for _, encrypted := range []string{first, second} {
+		if plain, err := decryptField(encrypted); err != nil || plain != "jane@test.com" {
+			t.Errorf("Expected the email back but got: %q, %v", plain, err)
+		}
+	}
+
+	// Values stored before encryption was turned on are read as they are
+	if plain, err := decryptField("legacy@test.com"); err != nil || plain != "legacy@test.com" {
+		t.Errorf("Expected a plaintext value to pass through but got: %q, %v", plain, err)
+	}
+
+	// Another key can't decrypt
+	PIIEncryptionKey = "other-pii-key"
+	if _, err := decryptField(first); err == nil {
+		t.Error("Expected decrypting with another key to fail")
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	defer func(key string) { PIIEncryptionKey = key }(PIIEncryptionKey)
+	PIIEncryptionKey = "test-pii-key"
+
+	index := blindIndex("jane@test.com")
+	if index != blindIndex("jane@test.com") {
+		t.Error("Expected the blind index to be deterministic")
+	}
+	if index == blindIndex("john@test.com") {
+		t.Error("Expected different values to have different blind indexes")
+	}
+
+	PIIEncryptionKey = "other-pii-key"
+	if index == blindIndex("jane@test.com") {
+		t.Error("Expected the blind index to depend on the key")
+	}
+}
+
+func TestEncryptUserEmailKey(t *testing.T) {
+	defer func(fields map[string]bool, key string) { encryptedFields, PIIEncryptionKey = fields, key }(encryptedFields, PIIEncryptionKey)
+	encryptedFields = map[string]bool{}
+	PIIEncryptionKey = "test-pii-key"
+
+	// Emails keep their case, and are keyed in lower case
+	stored, err := encryptUser(&model.User{Email: "Jane.Doe@Test.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != "Jane.Doe@Test.com" || stored.EmailKey != "jane.doe@test.com" || stored.EmailIndex != "" {
+		t.Errorf("Expected the email to be kept with a lower case key but got: %+v", stored)
+	}
+
+	// Encrypted emails only have the blind index of their key
+	encryptedFields = map[string]bool{piiFieldEmail: true}
+	stored, err = encryptUser(&model.User{Email: "Jane.Doe@Test.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.EmailKey != "" || stored.EmailIndex != blindIndex("jane.doe@test.com") {
+		t.Errorf("Expected only the blind index of the key but got: %+v", stored)
+	}
+}
+
+func TestEncryptUserPhone(t *testing.T) {
+	defer func(fields map[string]bool, key string) { encryptedFields, PIIEncryptionKey = fields, key }(encryptedFields, PIIEncryptionKey)
+	PIIEncryptionKey = "test-pii-key"
+
+	encryptedFields = map[string]bool{piiFieldEmail: true}
+	stored, err := encryptUser(&model.User{Phone: "+14155550100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Phone != "+14155550100" {
+		t.Errorf("Expected the phone to be kept as it is but got: %s", stored.Phone)
+	}
+
+	encryptedFields = map[string]bool{piiFieldPhone: true}
+	stored, err = encryptUser(&model.User{Email: "jane@test.com", Phone: "+14155550100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != "jane@test.com" || !strings.HasPrefix(stored.Phone, encryptedValuePrefix) {
+		t.Errorf("Expected only the phone to be encrypted but got: %+v", stored)
+	}
+	if err := decryptUsers(stored); err != nil || stored.Phone != "+14155550100" {
+		t.Errorf("Expected the phone back but got: %q, %v", stored.Phone, err)
+	}
+}
+
+func TestParseEncryptedFields(t *testing.T) {
+	fields, err := parseEncryptedFields("email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fields[piiFieldEmail] {
+		t.Errorf("Expected email to be encrypted but got: %v", fields)
+	}
+
+	if fields, err := parseEncryptedFields(""); err != nil || len(fields) != 0 {
+		t.Errorf("Expected nothing to be encrypted but got: %v, %v", fields, err)
+	}
+	if fields, err := parseEncryptedFields("email, phone"); err != nil || !fields[piiFieldPhone] {
+		t.Errorf("Expected phone to be encrypted too but got: %v, %v", fields, err)
+	}
+	if _, err := parseEncryptedFields("email,address"); err == nil {
+		t.Error("Expected an unknown field to be refused")
+	}
+}
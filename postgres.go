@@ -0,0 +1,772 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/lib/pq"
+)
+
+// PostgresURL is the connection string of the PostgreSQL database users are
+// stored in with -user-store postgres, set by the POSTGRES_URL secret
+var PostgresURL = ""
+
+// postgresUserRepository keeps users in the users table of a PostgreSQL
+// database, with their sensitive fields encrypted like in MongoDB. Their
+// identities are kept in the user_identities table. The tables are created
+// by the SQL of the migrations.
+type postgresUserRepository struct {
+	db *sql.DB
+}
+
+// newPostgresUserRepository connects to the PostgreSQL database at url
+func newPostgresUserRepository(url string) (*postgresUserRepository, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresUserRepository{db: db}, nil
+}
+
+// postgresUserField is a column of the users table, named after the field of
+// model.User it holds as stored in MongoDB, but for id
+type postgresUserField struct {
+	column string
+	// text columns hold NULL for empty strings, so unique indexes leave
+	// users without one alone, and are read back as empty strings
+	text bool
+	// value is what the field of a user is stored as, and dest where it is
+	// read to
+	value func(user *model.User) interface{}
+	dest  func(user *model.User) interface{}
+}
+
+func postgresTextField(column string, field func(user *model.User) *string) postgresUserField {
+	return postgresUserField{
+		column: column,
+		text:   true,
+		value:  func(user *model.User) interface{} { return postgresValue(*field(user)) },
+		dest:   func(user *model.User) interface{} { return field(user) },
+	}
+}
+
+func postgresTimeField(column string, field func(user *model.User) **time.Time) postgresUserField {
+	return postgresUserField{
+		column: column,
+		value:  func(user *model.User) interface{} { return *field(user) },
+		dest:   func(user *model.User) interface{} { return field(user) },
+	}
+}
+
+// postgresUserFields are the columns of the users table, in order
+var postgresUserFields = []postgresUserField{
+	postgresTextField("id", func(u *model.User) *string { return &u.ID }),
+	postgresTextField("email", func(u *model.User) *string { return &u.Email }),
+	postgresTextField("email_index", func(u *model.User) *string { return &u.EmailIndex }),
+	postgresTextField("email_key", func(u *model.User) *string { return &u.EmailKey }),
+	postgresTextField("first_name", func(u *model.User) *string { return &u.FirstName }),
+	postgresTextField("last_name", func(u *model.User) *string { return &u.LastName }),
+	postgresTextField("password", func(u *model.User) *string { return &u.Password }),
+	postgresTextField("role", func(u *model.User) *string { return &u.Role }),
+	postgresTextField("username", func(u *model.User) *string { return &u.Username }),
+	postgresTextField("username_key", func(u *model.User) *string { return &u.UsernameKey }),
+	postgresTextField("username_skeleton", func(u *model.User) *string { return &u.UsernameSkeleton }),
+	postgresTextField("date_of_birth", func(u *model.User) *string { return &u.DateOfBirth }),
+	postgresTextField("accepted_tos_version", func(u *model.User) *string { return &u.AcceptedTOSVersion }),
+	postgresTextField("status", func(u *model.User) *string { return &u.Status }),
+	{
+		column: "timestamp",
+		value:  func(u *model.User) interface{} { return u.Timestamp },
+		dest:   func(u *model.User) interface{} { return &u.Timestamp },
+	},
+	{
+		column: "updated_at",
+		value:  func(u *model.User) interface{} { return postgresValue(u.UpdatedAt) },
+		dest:   func(u *model.User) interface{} { return nullTime{&u.UpdatedAt} },
+	},
+	postgresTimeField("deleted_at", func(u *model.User) **time.Time { return &u.DeletedAt }),
+	postgresTimeField("purge_at", func(u *model.User) **time.Time { return &u.PurgeAt }),
+	postgresTimeField("erased_at", func(u *model.User) **time.Time { return &u.ErasedAt }),
+	postgresTimeField("last_login_at", func(u *model.User) **time.Time { return &u.LastLoginAt }),
+	postgresTimeField("password_changed_at", func(u *model.User) **time.Time { return &u.PasswordChangedAt }),
+	postgresTimeField("username_changed_at", func(u *model.User) **time.Time { return &u.UsernameChangedAt }),
+	postgresTextField("display_name", func(u *model.User) *string { return &u.DisplayName }),
+	postgresTextField("avatar_url", func(u *model.User) *string { return &u.AvatarURL }),
+	postgresTextField("timezone", func(u *model.User) *string { return &u.Timezone }),
+	postgresTextField("locale", func(u *model.User) *string { return &u.Locale }),
+	postgresTextField("phone", func(u *model.User) *string { return &u.Phone }),
+}
+
+// postgresColumn returns the column of the users table holding field, as
+// named in filters, sorts and changes
+func postgresColumn(field string) (postgresUserField, bool) {
+	if field == "_id" {
+		field = "id"
+	}
+	for _, f := range postgresUserFields {
+		if f.column == field {
+			return f, true
+		}
+	}
+	return postgresUserField{}, false
+}
+
+// postgresValue is how value is stored: empty strings and zero times as NULL
+func postgresValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+	case time.Time:
+		if v.IsZero() {
+			return nil
+		}
+	}
+	return value
+}
+
+// nullTime reads a timestamp that can be NULL into a time, zero for NULL
+type nullTime struct {
+	t *time.Time
+}
+
+func (n nullTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*n.t = time.Time{}
+	case time.Time:
+		*n.t = v
+	default:
+		return fmt.Errorf("unable to read %T as a time", value)
+	}
+	return nil
+}
+
+// postgresUserSelect selects every column of the users table
+func postgresUserSelect() string {
+	columns := make([]string, len(postgresUserFields))
+	for i, field := range postgresUserFields {
+		columns[i] = pq.QuoteIdentifier(field.column)
+		if field.text {
+			columns[i] = "COALESCE(" + columns[i] + ", '')"
+		}
+	}
+	return "SELECT " + strings.Join(columns, ", ") + " FROM users"
+}
+
+// postgresQueryer is what users are read through, the database or a
+// transaction
+type postgresQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// readUsers runs query, reading the users it selects with their identities
+func readUsers(ctx context.Context, db postgresQueryer, query string, args ...interface{}) ([]model.User, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return []model.User{}, err
+	}
+	defer rows.Close()
+
+	users := []model.User{}
+	for rows.Next() {
+		var user model.User
+		dests := make([]interface{}, len(postgresUserFields))
+		for i, field := range postgresUserFields {
+			dests[i] = field.dest(&user)
+		}
+		if err := rows.Scan(dests...); err != nil {
+			return []model.User{}, err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return []model.User{}, err
+	}
+	if len(users) == 0 {
+		return users, nil
+	}
+
+	ids := make([]string, len(users))
+	byID := make(map[string]*model.User, len(users))
+	for i := range users {
+		ids[i] = users[i].ID
+		byID[users[i].ID] = &users[i]
+	}
+	identities, err := db.QueryContext(ctx, "SELECT user_id, provider, subject, linked_at FROM user_identities WHERE user_id = ANY($1) ORDER BY linked_at", pq.Array(ids))
+	if err != nil {
+		return []model.User{}, err
+	}
+	defer identities.Close()
+	for identities.Next() {
+		var userID string
+		var identity model.Identity
+		if err := identities.Scan(&userID, &identity.Provider, &identity.Subject, &identity.LinkedAt); err != nil {
+			return []model.User{}, err
+		}
+		byID[userID].Identities = append(byID[userID].Identities, identity)
+	}
+	if err := identities.Err(); err != nil {
+		return []model.User{}, err
+	}
+
+	return users, decryptUserSlice(users)
+}
+
+// postgresQuery builds a statement, numbering its arguments
+type postgresQuery struct {
+	args []interface{}
+}
+
+// arg adds value to the arguments, returning its placeholder
+func (q *postgresQuery) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// where is the condition picking the users filter does, the way
+// mongoUserQuery does
+func (q *postgresQuery) where(filter UserFilter) string {
+	conditions := []string{}
+	if len(filter.IDs) > 0 {
+		conditions = append(conditions, "id = ANY("+q.arg(pq.Array(filter.IDs))+")")
+	}
+	if filter.ExcludeID != "" {
+		conditions = append(conditions, "id <> "+q.arg(filter.ExcludeID))
+	}
+	if filter.AfterID != "" {
+		conditions = append(conditions, `id COLLATE "C" > `+q.arg(filter.AfterID))
+	}
+	if len(filter.Statuses) > 0 {
+		statuses, none := []string{}, false
+		for _, status := range filter.Statuses {
+			if status == "" {
+				none = true
+			} else {
+				statuses = append(statuses, status)
+			}
+		}
+		condition := "status = ANY(" + q.arg(pq.Array(statuses)) + ")"
+		if none {
+			condition = "(" + condition + " OR status IS NULL)"
+		}
+		conditions = append(conditions, condition)
+	}
+	if filter.NotDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+	if filter.OnlyDeleted {
+		conditions = append(conditions, "deleted_at IS NOT NULL")
+	}
+	if filter.NotErased {
+		conditions = append(conditions, "erased_at IS NULL")
+	}
+	if filter.Password != "" {
+		conditions = append(conditions, "password = "+q.arg(filter.Password))
+	}
+	if filter.PurgePending {
+		conditions = append(conditions, "purge_at IS NOT NULL")
+	}
+	if !filter.PurgeBy.IsZero() {
+		conditions = append(conditions, "purge_at <= "+q.arg(filter.PurgeBy))
+	}
+	if filter.Role != "" {
+		conditions = append(conditions, "role = "+q.arg(filter.Role))
+	}
+	if len(filter.Roles) > 0 {
+		roles := make([]string, len(filter.Roles))
+		for i, role := range filter.Roles {
+			roles[i] = strings.ToLower(role)
+		}
+		conditions = append(conditions, "lower(role) = ANY("+q.arg(pq.Array(roles))+")")
+	}
+	if filter.Email != "" {
+		conditions = append(conditions, q.email(filter.Email))
+	}
+	if len(filter.Usernames) > 0 {
+		normalized := make([]string, len(filter.Usernames))
+		keys := make([]string, len(filter.Usernames))
+		for i, username := range filter.Usernames {
+			normalized[i] = normalizeUsername(username)
+			keys[i] = usernameKey(username)
+		}
+		condition := "username = ANY(" + q.arg(pq.Array(normalized)) + ")"
+		if usernameCase == usernameCaseInsensitive {
+			condition = "(" + condition + " OR username_key = ANY(" + q.arg(pq.Array(keys)) + "))"
+		}
+		conditions = append(conditions, condition)
+	}
+	if filter.UsernameSkeleton != "" {
+		conditions = append(conditions, "username_skeleton = "+q.arg(filter.UsernameSkeleton))
+	}
+	if filter.Identity != nil {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM user_identities i WHERE i.user_id = users.id AND i.provider = "+q.arg(filter.Identity.Provider)+" AND i.subject = "+q.arg(filter.Identity.Subject)+")")
+	}
+	if !filter.InactiveSince.IsZero() {
+		conditions = append(conditions, "(last_login_at < "+q.arg(filter.InactiveSince)+" OR (last_login_at IS NULL AND \"timestamp\" < "+q.arg(filter.InactiveSince.Unix())+"))")
+	}
+	if !filter.SignedUpSince.IsZero() {
+		conditions = append(conditions, "\"timestamp\" >= "+q.arg(filter.SignedUpSince.Unix()))
+	}
+	if filter.UpdatedAfter != nil {
+		after := q.arg(*filter.UpdatedAfter)
+		condition := "updated_at > " + after
+		if filter.UpdatedAfterID != "" {
+			condition = "(" + condition + " OR (updated_at = " + after + " AND id > " + q.arg(filter.UpdatedAfterID) + " COLLATE \"C\"))"
+		}
+		conditions = append(conditions, condition)
+	}
+	if filter.Search != "" {
+		conditions = append(conditions, q.search(filter.Search, filter.SearchMatch))
+	}
+
+	if len(conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// email is the condition picking the users with email, the way emailQuery
+// does
+func (q *postgresQuery) email(email string) string {
+	key := q.arg(emailKey(email))
+	condition := "email_key = " + key + " OR email = " + key
+	if encryptedFields[piiFieldEmail] {
+		condition += " OR email_index = " + q.arg(blindIndex(emailKey(email)))
+	}
+	return "COALESCE(" + condition + ", FALSE)"
+}
+
+// search is the condition picking the users matching text the way match
+// says, like searchMatchQuery does
+func (q *postgresQuery) search(text string, match searchMatch) string {
+	names := []string{"lower(COALESCE(username, ''))", "lower(COALESCE(first_name, ''))", "lower(COALESCE(last_name, ''))"}
+	fields := append(names, "lower(COALESCE(email, ''))")
+	anyField := func(fields []string, operator, value string) string {
+		arg := q.arg(value)
+		conditions := make([]string, len(fields))
+		for i, field := range fields {
+			conditions[i] = field + " " + operator + " " + arg
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")"
+	}
+
+	lower := strings.ToLower(text)
+	escaped := escapeLike(lower)
+	exact := "(" + anyField(fields, "=", lower) + " OR " + q.email(text) + ")"
+	prefix := anyField(fields, "LIKE", escaped+"%")
+	contains := "(" + anyField(fields, "LIKE", "%"+escaped+"%") + " OR " + q.email(text) + ")"
+	switch match {
+	case searchExact:
+		return exact
+	case searchPrefix:
+		return "(" + prefix + " AND NOT " + exact + ")"
+	case searchCandidates:
+		candidates := contains
+		if runes := []rune(lower); len(runes) > fuzzyPrefixLength && maxEdits(text) > 0 {
+			candidates = "(" + contains + " OR " + anyField(names, "LIKE", escapeLike(string(runes[:fuzzyPrefixLength]))+"%") + ")"
+		}
+		return "(" + candidates + " AND NOT " + exact + " AND NOT " + prefix + ")"
+	}
+	return contains
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// postgresOrder is the ORDER BY clause of sort, strings compared byte by
+// byte and missing values first like MongoDB does
+func postgresOrder(sort []string) (string, error) {
+	if len(sort) == 0 {
+		return "", nil
+	}
+	orders := make([]string, len(sort))
+	for i, field := range sort {
+		descending := strings.HasPrefix(field, "-")
+		column, ok := postgresColumn(strings.TrimPrefix(field, "-"))
+		if !ok {
+			return "", fmt.Errorf("unable to sort users by %s", field)
+		}
+		orders[i] = pq.QuoteIdentifier(column.column)
+		if column.text {
+			orders[i] += ` COLLATE "C"`
+		}
+		if descending {
+			orders[i] += " DESC NULLS LAST"
+		} else {
+			orders[i] += " ASC NULLS FIRST"
+		}
+	}
+	return " ORDER BY " + strings.Join(orders, ", "), nil
+}
+
+// postgresUserError turns a unique violation into the error for the field
+// that clashed, leaving other errors untouched
+func postgresUserError(err error) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok || pqErr.Code != "23505" {
+		return err
+	}
+	switch {
+	case pqErr.Constraint == "user_identities_pkey":
+		return errIdentityTaken
+	case pqErr.Constraint == "user_identities_user_id_provider_key":
+		return errProviderLinked
+	case strings.Contains(pqErr.Constraint, "email"):
+		return errDuplicateEmail
+	}
+	return errDuplicateUsername
+}
+
+// checkAvailable makes sure no other user has the username or email of user
+func (r *postgresUserRepository) checkAvailable(ctx context.Context, user *model.User) error {
+	for _, filter := range usernameClashes(user) {
+		if count, err := r.Count(ctx, filter); err != nil {
+			return err
+		} else if count > 0 {
+			return errDuplicateUsername
+		}
+	}
+	if user.Email != "" {
+		if count, err := r.Count(ctx, emailClash(user.ID, user.Email)); err != nil {
+			return err
+		} else if count > 0 {
+			return errDuplicateEmail
+		}
+	}
+	return nil
+}
+
+func (r *postgresUserRepository) Create(ctx context.Context, user *model.User) error {
+	if err := r.checkAvailable(ctx, user); err != nil {
+		return err
+	}
+
+	stored, err := encryptUser(user)
+	if err != nil {
+		return err
+	}
+	columns := make([]string, len(postgresUserFields))
+	placeholders := make([]string, len(postgresUserFields))
+	q := &postgresQuery{}
+	for i, field := range postgresUserFields {
+		columns[i] = pq.QuoteIdentifier(field.column)
+		placeholders[i] = q.arg(field.value(stored))
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO users ("+strings.Join(columns, ", ")+") VALUES ("+strings.Join(placeholders, ", ")+")", q.args...)
+	if err != nil {
+		return postgresUserError(err)
+	}
+	for _, identity := range user.Identities {
+		_, err := tx.ExecContext(ctx, "INSERT INTO user_identities (provider, subject, user_id, linked_at) VALUES ($1, $2, $3, $4)", identity.Provider, identity.Subject, user.ID, identity.LinkedAt)
+		if err != nil {
+			return postgresUserError(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *postgresUserRepository) GetByID(ctx context.Context, id string, includeDeleted bool) (*model.User, error) {
+	return r.findOne(ctx, UserFilter{IDs: []string{id}, NotDeleted: !includeDeleted})
+}
+
+func (r *postgresUserRepository) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	return r.findOne(ctx, UserFilter{Usernames: []string{username}, NotDeleted: true})
+}
+
+// findOne returns the first user filter picks, errUserNotFound when there is
+// none
+func (r *postgresUserRepository) findOne(ctx context.Context, filter UserFilter) (*model.User, error) {
+	users, err := r.Find(ctx, filter, nil, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, errUserNotFound
+	}
+	return &users[0], nil
+}
+
+func (r *postgresUserRepository) Update(ctx context.Context, id string, update *model.UpdateUser) error {
+	change := UserChange{Set: map[string]interface{}{}}
+	if update.Email != nil {
+		if err := r.checkAvailable(ctx, &model.User{ID: id, Email: *update.Email}); err != nil {
+			return err
+		}
+		encrypted, err := encryptUser(&model.User{Email: *update.Email})
+		if err != nil {
+			return err
+		}
+		change.Set["email"] = encrypted.Email
+		change.Set["email_index"] = encrypted.EmailIndex
+		change.Set["email_key"] = encrypted.EmailKey
+	}
+	if update.Username != nil {
+		renamed := &model.User{
+			ID:               id,
+			Username:         normalizeUsername(*update.Username),
+			UsernameKey:      usernameKey(*update.Username),
+			UsernameSkeleton: usernameSkeleton(*update.Username),
+		}
+		if err := r.checkAvailable(ctx, renamed); err != nil {
+			return err
+		}
+		change.Set["username"] = renamed.Username
+		change.Set["username_key"] = renamed.UsernameKey
+		change.Set["username_skeleton"] = renamed.UsernameSkeleton
+		change.Set["username_changed_at"] = time.Now()
+	}
+	for field, value := range map[string]*string{
+		"first_name":   update.FirstName,
+		"last_name":    update.LastName,
+		"role":         update.Role,
+		"password":     update.Password,
+		"display_name": update.DisplayName,
+		"avatar_url":   update.AvatarURL,
+		"timezone":     update.Timezone,
+		"locale":       update.Locale,
+		"phone":        update.Phone,
+	} {
+		if value != nil {
+			change.Set[field] = *value
+		}
+	}
+	if phone, ok := change.Set["phone"].(string); ok {
+		encrypted, err := encryptPhone(phone)
+		if err != nil {
+			return err
+		}
+		change.Set["phone"] = encrypted
+	}
+	if update.Password != nil {
+		change.Set["password_changed_at"] = time.Now()
+	}
+	if len(change.Set) == 0 {
+		return nil
+	}
+
+	//Update the given fields, leaving the rest such as the status alone
+	change.Set["updated_at"] = time.Now()
+	changed, err := r.Modify(ctx, UserFilter{IDs: []string{id}, NotDeleted: true}, change)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (r *postgresUserRepository) Delete(ctx context.Context, id string) error {
+	//Soft delete the user, keeping it around as a tombstone for the changes feed
+	now := time.Now()
+	change := UserChange{Set: map[string]interface{}{"status": statusDeleted, "deleted_at": now, "updated_at": now}}
+	changed, err := r.Modify(ctx, UserFilter{IDs: []string{id}, NotDeleted: true}, change)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (r *postgresUserRepository) List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	filter := UserFilter{Role: opts.Role, Roles: opts.Roles, NotDeleted: true}
+	total, countErr := r.Count(ctx, filter)
+
+	//Oldest users first by default, so pages stay stable as users sign up
+	users, pageErr := r.Find(ctx, filter, listSort(opts), opts.Offset, opts.Limit)
+	return partialList(users, total, countErr, pageErr)
+}
+
+func (r *postgresUserRepository) Find(ctx context.Context, filter UserFilter, sort []string, offset, limit int) ([]model.User, error) {
+	order, err := postgresOrder(sort)
+	if err != nil {
+		return []model.User{}, err
+	}
+	q := &postgresQuery{}
+	query := postgresUserSelect() + " WHERE " + q.where(filter) + order
+	if limit > 0 {
+		query += " LIMIT " + q.arg(limit)
+	}
+	if offset > 0 {
+		query += " OFFSET " + q.arg(offset)
+	}
+	return readUsers(ctx, r.db, query, q.args...)
+}
+
+func (r *postgresUserRepository) Count(ctx context.Context, filter UserFilter) (int, error) {
+	q := &postgresQuery{}
+	var count int
+	err := r.db.QueryRowContext(ctx, "SELECT count(*) FROM users WHERE "+q.where(filter), q.args...).Scan(&count)
+	return count, err
+}
+
+func (r *postgresUserRepository) Modify(ctx context.Context, filter UserFilter, change UserChange) ([]string, error) {
+	q := &postgresQuery{}
+	assignments := []string{}
+	for field, value := range change.Set {
+		column, ok := postgresColumn(field)
+		if !ok {
+			return nil, fmt.Errorf("unable to set %s of users", field)
+		}
+		assignments = append(assignments, pq.QuoteIdentifier(column.column)+" = "+q.arg(postgresValue(value)))
+	}
+	unlink := false
+	for _, field := range change.Unset {
+		if field == "identities" {
+			unlink = true
+			continue
+		}
+		column, ok := postgresColumn(field)
+		if !ok {
+			return nil, fmt.Errorf("unable to unset %s of users", field)
+		}
+		assignments = append(assignments, pq.QuoteIdentifier(column.column)+" = NULL")
+	}
+	if len(assignments) == 0 {
+		return []string{}, nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	//A single statement, so each user is only changed if still picked
+	rows, err := tx.QueryContext(ctx, "UPDATE users SET "+strings.Join(assignments, ", ")+" WHERE "+q.where(filter)+" RETURNING id", q.args...)
+	if err != nil {
+		return nil, postgresUserError(err)
+	}
+	changed := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changed = append(changed, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, postgresUserError(err)
+	}
+
+	if unlink && len(changed) > 0 {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM user_identities WHERE user_id = ANY($1)", pq.Array(changed)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+func (r *postgresUserRepository) Remove(ctx context.Context, filter UserFilter) (int, error) {
+	//Their identities go with them
+	q := &postgresQuery{}
+	result, err := r.db.ExecContext(ctx, "DELETE FROM users WHERE "+q.where(filter), q.args...)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+func (r *postgresUserRepository) Reissue(ctx context.Context, id, newID string) (*model.User, error) {
+	//Identities follow the new id
+	result, err := r.db.ExecContext(ctx, "UPDATE users SET id = $1, updated_at = $2 WHERE id = $3 AND deleted_at IS NULL", newID, time.Now(), id)
+	if err != nil {
+		return nil, postgresUserError(err)
+	}
+	if moved, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if moved == 0 {
+		return nil, errUserNotFound
+	}
+	return r.GetByID(ctx, newID, false)
+}
+
+func (r *postgresUserRepository) LinkIdentity(ctx context.Context, id string, identity model.Identity) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//The keys of the identities keep them linked to a single account, and
+	//to one identity per provider
+	result, err := tx.ExecContext(ctx, "INSERT INTO user_identities (provider, subject, user_id, linked_at) SELECT $1, $2, id, $3 FROM users WHERE id = $4 AND deleted_at IS NULL", identity.Provider, identity.Subject, identity.LinkedAt, id)
+	if err != nil {
+		return postgresUserError(err)
+	}
+	if linked, err := result.RowsAffected(); err != nil {
+		return err
+	} else if linked == 0 {
+		return errUserNotFound
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET updated_at = $1 WHERE id = $2", time.Now(), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *postgresUserRepository) UnlinkIdentity(ctx context.Context, id, provider string, keepOne bool) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//Locking the user keeps concurrent unlinks from taking both of the last
+	//two identities
+	var linked []string
+	rows, err := tx.QueryContext(ctx, "SELECT i.provider FROM users u JOIN user_identities i ON i.user_id = u.id WHERE u.id = $1 FOR UPDATE OF u", id)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return err
+		}
+		linked = append(linked, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case !containsString(linked, provider):
+		return errProviderNotLinked
+	case keepOne && len(linked) == 1:
+		return errLastAuthMethod
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_identities WHERE user_id = $1 AND provider = $2", id, provider); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET updated_at = $1 WHERE id = $2", time.Now(), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
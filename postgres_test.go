@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPostgresUserRepository(t *testing.T) {
+	url := os.Getenv("POSTGRES_URL")
+	if url == "" {
+		t.Skip("POSTGRES_URL not set")
+	}
+	repo, err := newPostgresUserRepository(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.db.Close()
+
+	// Start from the tables of the migrations, dropping them when done
+	migrations, err := builtinMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.sqlUp == "" {
+			continue
+		}
+		if _, err := repo.db.Exec(m.sqlUp); err != nil {
+			t.Fatal(err)
+		}
+		defer func(down string) { repo.db.Exec(down) }(m.sqlDown)
+	}
+
+	testUserRepository(t, repo)
+}
+
+func TestPostgresQuery(t *testing.T) {
+	q := &postgresQuery{}
+	where := q.where(UserFilter{Statuses: []string{"", statusActive}, NotDeleted: true, Role: "admin"})
+	if where != "(status = ANY($1) OR status IS NULL) AND deleted_at IS NULL AND role = $2" || len(q.args) != 2 {
+		t.Errorf("Expected the conditions in order with numbered arguments but got: %s %v", where, q.args)
+	}
+	if where := (&postgresQuery{}).where(UserFilter{}); where != "TRUE" {
+		t.Errorf("Expected an empty filter to pick every user but got: %s", where)
+	}
+
+	order, err := postgresOrder([]string{"-username", "_id", "timestamp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order != ` ORDER BY "username" COLLATE "C" DESC NULLS LAST, "id" COLLATE "C" ASC NULLS FIRST, "timestamp" ASC NULLS FIRST` {
+		t.Errorf("Expected the order of MongoDB but got: %s", order)
+	}
+	if _, err := postgresOrder([]string{"password; DROP TABLE users"}); err == nil {
+		t.Error("Expected an unknown field to be refused")
+	}
+
+	if escaped := escapeLike(`50%_off\`); escaped != `50\%\_off\\` {
+		t.Errorf("Expected the wildcards escaped but got: %s", escaped)
+	}
+	if value := postgresValue(""); value != nil {
+		t.Errorf("Expected an empty string stored as NULL but got: %v", value)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/buzzapp/user/reqres"
+)
+
+// problemContentType is the media type of RFC 7807 problem details, which
+// clients can ask errors to be described in
+const problemContentType = "application/problem+json"
+
+// requestIDHeader carries the id of a request, which error responses give and
+// problem details give as their instance
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps the length of request ids clients may give us
+const maxRequestIDLength = 128
+
+// problemTypeBase prefixes the error code of a problem to make its type URI
+var problemTypeBase = "urn:buzzapp:users:error:"
+
+// problemMiddleware describes errors as problem details to clients that
+// accept them, errors are described as usual otherwise
+func problemMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsProblem(r.Header.Get("Accept")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := assignRequestID(w, r)
+		next.ServeHTTP(&problemResponseWriter{ResponseWriter: w, requestID: id}, r)
+	})
+}
+
+// problemResponseWriter marks responses to clients that accept problem details
+type problemResponseWriter struct {
+	http.ResponseWriter
+	requestID string
+}
+
+// Flush sends what was written so far, so streamed responses aren't held back
+func (w *problemResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// acceptsProblem reports whether an Accept header asks for problem details
+func acceptsProblem(accept string) bool {
+	for _, accepted := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || mediaType != problemContentType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// newRequestID returns a random id for requests that came without one
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// problemFor describes an error response as problem details. The code and
+// fields and field errors of the error are kept as extension members.
+func problemFor(errMsg reqres.ErrorResponse, status int, requestID string) reqres.ProblemResponse {
+	return reqres.ProblemResponse{
+		Type:     problemTypeBase + strings.ToLower(errMsg.Code),
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   errMsg.Message,
+		Instance: requestID,
+		Code:     errMsg.Code,
+		Fields:   errMsg.Fields,
+		Errors:   errMsg.Errors,
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buzzapp/user/reqres"
+)
+
+func TestAcceptsProblem(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"*/*", false},
+		{"application/problem+json", true},
+		{"application/json, application/problem+json;q=0.9", true},
+		{"application/problem+json; q=0", false},
+	}
+
+	for _, test := range tests {
+		if got := acceptsProblem(test.accept); got != test.want {
+			t.Errorf("Expected %q to accept problem details %v but got: %v", test.accept, test.want, got)
+		}
+	}
+}
+
+func TestProblemMiddleware(t *testing.T) {
+	handler := problemMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError("Validation error", fieldError("email", "Please provide a valid email"), w, http.StatusBadRequest)
+	}))
+
+	request := func(accept, requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/users", nil)
+		req.Header.Set("Accept", accept)
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Errors are described as usual by default
+	rec := request("application/json", "")
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a json response but got: %s", rec.Header().Get("Content-Type"))
+	}
+	var payload = &reqres.ErrorResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Code != validationErrorCode || payload.Fields["email"] == "" {
+		t.Errorf("Expected the usual error response but got: %+v", payload)
+	}
+
+	// Clients asking for problem details get them
+	rec = request("application/problem+json", "req-123")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 status code response but got: %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != problemContentType {
+		t.Errorf("Expected a problem details response but got: %s", rec.Header().Get("Content-Type"))
+	}
+	var problem = &reqres.ProblemResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Type != problemTypeBase+"validation_error" || problem.Title != "Bad Request" || problem.Status != http.StatusBadRequest {
+		t.Errorf("Expected the problem to be described by its code and status but got: %+v", problem)
+	}
+	if problem.Detail == "" || problem.Instance != "req-123" || problem.Code != validationErrorCode || problem.Fields["email"] == "" {
+		t.Errorf("Expected the problem details of the error but got: %+v", problem)
+	}
+
+	// Requests without an id get one
+	rec = request("application/problem+json", "")
+	problem = &reqres.ProblemResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Instance == "" || rec.Header().Get(requestIDHeader) != problem.Instance {
+		t.Errorf("Expected a generated request id but got: %q", problem.Instance)
+	}
+}
+
+func TestProblemServerErrorDetails(t *testing.T) {
+	handler := problemMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError("unable to get user", errors.New("connection refused"), w, http.StatusInternalServerError)
+	}))
+
+	req := httptest.NewRequest("GET", "/users/id", nil)
+	req.Header.Set("Accept", problemContentType)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	var problem = &reqres.ProblemResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Detail != "unable to get user" || problem.Code != internalErrorCode {
+		t.Errorf("Expected server error details to be left out but got: %+v", problem)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitStore is an interface for counting hits per key within fixed time
+// windows. Stores backed by a shared database let every instance of the
+// service enforce the same limits.
+type RateLimitStore interface {
+	// Hit records a hit for key and returns the number of hits within the
+	// current window, including this one, and how long until it resets
+	Hit(key string, window time.Duration) (int, time.Duration, error)
+
+	// Count returns the number of hits within the current window of key and
+	// how long until it resets, without recording a hit
+	Count(key string) (int, time.Duration, error)
+
+	// Reset forgets the hits of key
+	Reset(key string) error
+}
+
+// memoryRateLimitStore keeps the counters in memory, which is only suitable
+// when running a single instance
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	entries map[string]*limiterEntry
+	now     func() time.Time
+}
+
+type limiterEntry struct {
+	count     int
+	expiresAt time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		entries: make(map[string]*limiterEntry),
+		now:     time.Now,
+	}
+}
+
+func (s *memoryRateLimitStore) Hit(key string, window time.Duration) (int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// Drop expired entries so the map doesn't grow forever
+	for k, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, k)
+		}
+	}
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &limiterEntry{expiresAt: now.Add(window)}
+		s.entries[key] = entry
+	}
+
+	entry.count++
+	return entry.count, entry.expiresAt.Sub(now), nil
+}
+
+func (s *memoryRateLimitStore) Count(key string) (int, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	entry, ok := s.entries[key]
+	if !ok || !now.Before(entry.expiresAt) {
+		return 0, 0, nil
+	}
+	return entry.count, entry.expiresAt.Sub(now), nil
+}
+
+func (s *memoryRateLimitStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// rateLimiter allows a number of requests per key within a fixed time window
+type rateLimiter struct {
+	store  RateLimitStore
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+func newRateLimiter(store RateLimitStore, prefix string, limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{store: store, prefix: prefix, limit: limit, window: window}
+}
+
+// Allow records a request for key and reports whether it is within the limit.
+// When it isn't, it also returns how long until the window resets.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration, error) {
+	count, resetIn, err := l.store.Hit(l.prefix+":"+key, l.window)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if count > l.limit {
+		return false, resetIn, nil
+	}
+	return true, 0, nil
+}
+
+// Exhausted reports whether key has already used up its limit, without
+// recording a request. When it has, it also returns how long until the window
+// resets.
+func (l *rateLimiter) Exhausted(key string) (bool, time.Duration, error) {
+	count, resetIn, err := l.store.Count(l.prefix + ":" + key)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if count >= l.limit {
+		return true, resetIn, nil
+	}
+	return false, 0, nil
+}
+
+// Block records a request for key in a window lasting d rather than the
+// limiter's, e.g. to lock it out for longer than usual
+func (l *rateLimiter) Block(key string, d time.Duration) error {
+	_, _, err := l.store.Hit(l.prefix+":"+key, d)
+	return err
+}
+
+// Reset forgets the requests recorded for key
+func (l *rateLimiter) Reset(key string) error {
+	return l.store.Reset(l.prefix + ":" + key)
+}
+
+// loginThrottle slows down bursts of failed logins from the same IP or for
+// the same username, regardless of whether the password is eventually right.
+// It is disabled when nil.
+var loginThrottle *loginThrottler
+
+type loginThrottler struct {
+	byIP       *rateLimiter
+	byUsername *rateLimiter
+
+	// lockIP and lockUsername lock an IP or username out for the lockout
+	// duration once it reaches the limit. Without them, logins are throttled
+	// until the window resets.
+	lockIP       *rateLimiter
+	lockUsername *rateLimiter
+
+	// lockouts counts the lockouts of a username within the decay window.
+	// Each one lasts multiplier times as long as the one before, up to
+	// maxLockout. Without it, every lockout lasts as long.
+	lockouts   *rateLimiter
+	multiplier float64
+	maxLockout time.Duration
+
+	// exemptUsernames and exemptRoles are accounts, e.g. for monitoring, that
+	// are never throttled. Their passwords can be guessed at any rate, so
+	// they should be long and random.
+	exemptUsernames map[string]bool
+	exemptRoles     map[string]bool
+}
+
+// newLoginThrottler throttles IPs and usernames with limit failed logins
+// within window, locking them out for lockout when it's positive
+func newLoginThrottler(store RateLimitStore, limit int, window, lockout time.Duration) *loginThrottler {
+	t := &loginThrottler{
+		byIP:       newRateLimiter(store, "login-failures-ip", limit, window),
+		byUsername: newRateLimiter(store, "login-failures-username", limit, window),
+	}
+	if lockout > 0 {
+		t.lockIP = newRateLimiter(store, "login-lockout-ip", 1, lockout)
+		t.lockUsername = newRateLimiter(store, "login-lockout-username", 1, lockout)
+	}
+	return t
+}
+
+// Escalate makes every lockout of a username within decay of its first one
+// last multiplier times as long as the one before, up to max. It does nothing
+// without a lockout, or when max isn't longer than it.
+func (t *loginThrottler) Escalate(multiplier float64, max, decay time.Duration) {
+	if t.lockUsername == nil || multiplier <= 1 || max <= t.lockUsername.window {
+		return
+	}
+	t.lockouts = newRateLimiter(t.lockUsername.store, "login-lockouts-username", 0, decay)
+	t.multiplier = multiplier
+	t.maxLockout = max
+}
+
+// Exempt never throttles logins for usernames, or for users with one of roles
+func (t *loginThrottler) Exempt(usernames, roles []string) {
+	t.exemptUsernames = make(map[string]bool)
+	for _, username := range usernames {
+		t.exemptUsernames[usernameKey(username)] = true
+	}
+	t.exemptRoles = make(map[string]bool)
+	for _, role := range roles {
+		t.exemptRoles[strings.ToLower(role)] = true
+	}
+}
+
+// IsExempt reports whether logins for username are never throttled. roleOf is
+// only called when roles are exempt.
+func (t *loginThrottler) IsExempt(username string, roleOf func(username string) string) bool {
+	if t.exemptUsernames[usernameKey(username)] {
+		return true
+	}
+	if len(t.exemptRoles) == 0 {
+		return false
+	}
+	return t.exemptRoles[strings.ToLower(roleOf(username))]
+}
+
+// Throttled reports whether a login from ip for username has to wait, and for
+// how long. Logins are refused while throttled even if the password is right.
+func (t *loginThrottler) Throttled(ip, username string) (bool, time.Duration, error) {
+	throttled, retryAfter, err := checkLoginLimit(t.byIP, t.lockIP, ip)
+	if err != nil || throttled {
+		return throttled, retryAfter, err
+	}
+	return checkLoginLimit(t.byUsername, t.lockUsername, usernameKey(username))
+}
+
+// Failed records a failed login from ip for username. When it locks username
+// out, it returns for how long.
+func (t *loginThrottler) Failed(ip, username string) (time.Duration, error) {
+	locked, err := countFailedLogin(t.byIP, t.lockIP, ip)
+	if err != nil {
+		return 0, err
+	}
+	if locked {
+		if err := t.lockIP.Block(ip, t.lockIP.window); err != nil {
+			return 0, err
+		}
+	}
+
+	key := usernameKey(username)
+	locked, err = countFailedLogin(t.byUsername, t.lockUsername, key)
+	if err != nil || !locked {
+		return 0, err
+	}
+	lockout, err := t.usernameLockout(key)
+	if err != nil {
+		return 0, err
+	}
+	return lockout, t.lockUsername.Block(key, lockout)
+}
+
+// usernameLockout counts a lockout of the username with key, returning how
+// long it lasts
+func (t *loginThrottler) usernameLockout(key string) (time.Duration, error) {
+	lockout := t.lockUsername.window
+	if t.lockouts == nil {
+		return lockout, nil
+	}
+
+	count, _, err := t.lockouts.store.Hit(t.lockouts.prefix+":"+key, t.lockouts.window)
+	if err != nil {
+		return 0, err
+	}
+	return escalatedLockout(lockout, t.multiplier, t.maxLockout, count), nil
+}
+
+// escalatedLockout returns how long the count-th lockout lasts, starting at
+// base and growing by multiplier each time, up to max
+func escalatedLockout(base time.Duration, multiplier float64, max time.Duration, count int) time.Duration {
+	lockout := base
+	for i := 1; i < count && lockout < max; i++ {
+		lockout = time.Duration(float64(lockout) * multiplier)
+	}
+	if lockout > max {
+		return max
+	}
+	return lockout
+}
+
+// Succeeded starts counting the failed logins for username over. The count
+// for the IP is kept, or a client could keep guessing other passwords by
+// logging into an account of its own in between.
+func (t *loginThrottler) Succeeded(username string) error {
+	return t.byUsername.Reset(usernameKey(username))
+}
+
+// Unlock lets logins for usernames through again, forgetting their failed
+// logins and lifting their lockout. IPs stay throttled.
+func (t *loginThrottler) Unlock(usernames ...string) error {
+	for _, username := range usernames {
+		if err := t.byUsername.Reset(usernameKey(username)); err != nil {
+			return err
+		}
+		if t.lockUsername == nil {
+			continue
+		}
+		if err := t.lockUsername.Reset(usernameKey(username)); err != nil {
+			return err
+		}
+		if t.lockouts == nil {
+			continue
+		}
+		if err := t.lockouts.Reset(usernameKey(username)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkLoginLimit(counter, lock *rateLimiter, key string) (bool, time.Duration, error) {
+	if lock != nil {
+		locked, retryAfter, err := lock.Exhausted(key)
+		if err != nil || locked {
+			return locked, retryAfter, err
+		}
+	}
+	return counter.Exhausted(key)
+}
+
+// countFailedLogin counts a failed login for key, reporting whether it has to
+// be locked out, in which case counting starts over
+func countFailedLogin(counter, lock *rateLimiter, key string) (bool, error) {
+	if _, _, err := counter.Allow(key); err != nil || lock == nil {
+		return false, err
+	}
+
+	// Lock the key out once it reaches the limit, counting over afterwards
+	exhausted, _, err := counter.Exhausted(key)
+	if err != nil || !exhausted {
+		return false, err
+	}
+	return true, counter.Reset(key)
+}
+
+// signupRateLimitMiddleware caps the number of accounts created per client IP.
+// Requests made with an admin token are not counted.
+func signupRateLimitMiddleware(limiter *rateLimiter, next http.Handler) http.Handler {
+	limited := rateLimitMiddleware(limiter, "too many accounts created from this address, try again later", next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitMiddleware caps the number of requests per client IP, responding
+// with reason once the limit is reached
+func rateLimitMiddleware(limiter *rateLimiter, reason string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter, err := limiter.Allow(clientIP(r))
+		if err != nil {
+			// Don't turn a rate limit store outage into an outage of the route
+			log.Println("unable to check rate limit:", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+			respondWithError("Too many requests", errors.New(reason), w, http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client connected to us
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
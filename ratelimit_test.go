@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+)
+
+func TestSignupRateLimit(t *testing.T) {
+	const limit = 5
+
+	created := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	handler := signupRateLimitMiddleware(newRateLimiter(newMemoryRateLimitStore(), "signup", limit, time.Hour), created)
+
+	signup := func(remoteAddr, authHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/users", nil)
+		req.RemoteAddr = remoteAddr
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < limit; i++ {
+		if rec := signup("10.0.0.1:1234", ""); rec.Code != http.StatusCreated {
+			t.Fatalf("Expected signup %d to succeed but got: %d", i+1, rec.Code)
+		}
+	}
+
+	rec := signup("10.0.0.1:5678", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 status code response but got: %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+
+	// Other addresses have their own budget
+	if rec := signup("10.0.0.2:1234", ""); rec.Code != http.StatusCreated {
+		t.Errorf("Expected a 201 status code response but got: %d", rec.Code)
+	}
+
+	// Admins aren't limited
+	adminToken, err := generateToken("adminID", "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := signup("10.0.0.1:1234", "Bearer "+adminToken); rec.Code != http.StatusCreated {
+		t.Errorf("Expected admin signup to be exempt but got: %d", rec.Code)
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	testRateLimitStore(t, store, func(d time.Duration) { now = now.Add(d) })
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL not set")
+	}
+
+	testRateLimitStore(t, redisRateLimitStore{newRedisPool(url)}, time.Sleep)
+}
+
+func TestLoginThrottle(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	throttle := newLoginThrottler(store, 3, time.Minute, 0)
+
+	// Rapid failures from one IP against different usernames
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if throttled, _, _ := throttle.Throttled("10.0.0.1", username); throttled {
+			t.Fatalf("Expected the login for %s not to be throttled yet", username)
+		}
+		throttle.Failed("10.0.0.1", username)
+	}
+
+	throttled, retryAfter, err := throttle.Throttled("10.0.0.1", "dave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !throttled {
+		t.Error("Expected the IP to be throttled after rapid failures")
+	}
+	if retryAfter <= 0 || retryAfter > time.Minute {
+		t.Errorf("Expected retry after to be within the window but got: %v", retryAfter)
+	}
+
+	// Rapid failures for one username from different IPs
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		throttle.Failed(ip, "erin")
+	}
+	if throttled, _, _ := throttle.Throttled("10.0.0.5", "erin"); !throttled {
+		t.Error("Expected the username to be throttled after rapid failures")
+	}
+
+	// Others aren't affected
+	if throttled, _, _ := throttle.Throttled("10.0.0.6", "frank"); throttled {
+		t.Error("Expected an unrelated login not to be throttled")
+	}
+
+	// The throttle lifts after the window
+	now = now.Add(time.Minute)
+	if throttled, _, _ := throttle.Throttled("10.0.0.1", "erin"); throttled {
+		t.Error("Expected the throttle to lift after the window")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	throttle := newLoginThrottler(store, 3, time.Minute, 10*time.Minute)
+
+	// A success starts the count over
+	throttle.Failed("10.0.0.1", "alice")
+	throttle.Failed("10.0.0.2", "alice")
+	throttle.Succeeded("alice")
+	throttle.Failed("10.0.0.3", "alice")
+	if throttled, _, _ := throttle.Throttled("10.0.0.4", "alice"); throttled {
+		t.Error("Expected a successful login to reset the failure count")
+	}
+
+	// Reaching the limit locks the username out
+	throttle.Failed("10.0.0.5", "alice")
+	throttle.Failed("10.0.0.6", "alice")
+	throttled, retryAfter, err := throttle.Throttled("10.0.0.7", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !throttled {
+		t.Fatal("Expected the username to be locked out after reaching the limit")
+	}
+	if retryAfter <= time.Minute || retryAfter > 10*time.Minute {
+		t.Errorf("Expected retry after to be within the lockout but got: %v", retryAfter)
+	}
+
+	// The lockout outlasts the window and can't be reset by succeeding
+	throttle.Succeeded("alice")
+	now = now.Add(5 * time.Minute)
+	if throttled, _, _ := throttle.Throttled("10.0.0.8", "alice"); !throttled {
+		t.Error("Expected the lockout to outlast the failure window")
+	}
+
+	now = now.Add(5 * time.Minute)
+	if throttled, _, _ := throttle.Throttled("10.0.0.8", "alice"); throttled {
+		t.Error("Expected the lockout to lift after the lockout duration")
+	}
+}
+
+func TestLoginLockoutEscalation(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	throttle := newLoginThrottler(store, 2, time.Minute, 10*time.Minute)
+	throttle.Escalate(2, time.Hour, 24*time.Hour)
+
+	// Each lockout lasts twice as long as the one before, up to the max
+	ip := 0
+	lockOut := func() time.Duration {
+		var lockout time.Duration
+		for i := 0; i < 2; i++ {
+			ip++
+			var err error
+			if lockout, err = throttle.Failed("10.0.0."+strconv.Itoa(ip), "bob"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, retryAfter, _ := throttle.Throttled("10.0.1.1", "bob"); retryAfter != lockout {
+			t.Errorf("Expected to retry after the %v lockout but got: %v", lockout, retryAfter)
+		}
+		now = now.Add(lockout)
+		return lockout
+	}
+	for i, expected := range []time.Duration{10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour} {
+		if lockout := lockOut(); lockout != expected {
+			t.Errorf("Expected lockout %d to last %v but got: %v", i+1, expected, lockout)
+		}
+	}
+
+	// The lockouts are forgotten once the decay window is over
+	now = now.Add(24 * time.Hour)
+	if lockout := lockOut(); lockout != 10*time.Minute {
+		t.Errorf("Expected the lockouts to decay but got a lockout of: %v", lockout)
+	}
+	if lockout := lockOut(); lockout != 20*time.Minute {
+		t.Errorf("Expected the lockouts to escalate again but got a lockout of: %v", lockout)
+	}
+
+	// Unlocking forgets them too
+	throttle.Unlock("bob")
+	if lockout := lockOut(); lockout != 10*time.Minute {
+		t.Errorf("Expected an unlock to forget the lockouts but got a lockout of: %v", lockout)
+	}
+}
+
+func TestEscalatedLockout(t *testing.T) {
+	for _, test := range []struct {
+		multiplier float64
+		count      int
+		expected   time.Duration
+	}{
+		{2, 1, 15 * time.Minute},
+		{2, 2, 30 * time.Minute},
+		{2, 3, time.Hour},
+		{2, 4, 90 * time.Minute},
+		{1.5, 2, 22*time.Minute + 30*time.Second},
+		{3, 1000, 90 * time.Minute},
+	} {
+		if lockout := escalatedLockout(15*time.Minute, test.multiplier, 90*time.Minute, test.count); lockout != test.expected {
+			t.Errorf("Expected lockout %d with a multiplier of %v to last %v but got: %v", test.count, test.multiplier, test.expected, lockout)
+		}
+	}
+}
+
+func TestUnlockLoginHTTPEndpoint(t *testing.T) {
+	defer func(throttle *loginThrottler) { loginThrottle = throttle }(loginThrottle)
+	loginThrottle = newLoginThrottler(newMemoryRateLimitStore(), 2, time.Minute, 10*time.Minute)
+
+	user := &model.User{ID: "lockedID", Username: "lockedUser", Email: "locked@test.com"}
+	router := mux.NewRouter()
+	router.Handle(UnlockLoginPath, handleUnlockLogin(storedUserService{user: user})).Methods("POST")
+
+	for _, name := range []string{user.Username, user.Email} {
+		loginThrottle.Failed("10.0.0.1", name)
+		loginThrottle.Failed("10.0.0.2", name)
+		if throttled, _, _ := loginThrottle.Throttled("10.0.0.3", name); !throttled {
+			t.Fatalf("Expected %s to be locked out", name)
+		}
+	}
+
+	unlock := func(id string) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/users/"+id+"/unlock", nil))
+		return rec.Code
+	}
+	if code := unlock("unknownID"); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown user to get a 404 but got: %d", code)
+	}
+	if code := unlock(user.ID); code != http.StatusNoContent {
+		t.Fatalf("Expected a 204 status code response but got: %d", code)
+	}
+
+	for _, name := range []string{user.Username, user.Email} {
+		if throttled, _, _ := loginThrottle.Throttled("10.0.0.3", name); throttled {
+			t.Errorf("Expected %s to be unlocked", name)
+		}
+	}
+
+	// The IPs that failed stay throttled
+	if throttled, _, _ := loginThrottle.Throttled("10.0.0.1", "someoneElse"); !throttled {
+		t.Error("Expected the IP to stay throttled")
+	}
+}
+
+func TestLoginThrottleExemptions(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	throttle := newLoginThrottler(store, 3, time.Minute, 0)
+	throttle.Exempt([]string{"Monitor"}, []string{"service"})
+
+	roles := map[string]string{"probe": "Service", "alice": "student"}
+	roleOf := func(username string) string { return roles[username] }
+
+	if !throttle.IsExempt("Monitor", roleOf) {
+		t.Error("Expected the exempt username to be exempt")
+	}
+	if !throttle.IsExempt("probe", roleOf) {
+		t.Error("Expected a user with an exempt role to be exempt")
+	}
+	if throttle.IsExempt("alice", roleOf) || throttle.IsExempt("unknown", roleOf) {
+		t.Error("Expected other users not to be exempt")
+	}
+
+	// Exempt logins aren't throttled past the limit
+	loginThrottle = throttle
+	defer func() { loginThrottle = nil }()
+
+	svc := fakeRoleService{roles: roles}
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("POST", "/auth/authenticate", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if throttleLogin(httptest.NewRecorder(), req, svc, "Monitor") {
+			t.Fatalf("Expected exempt login %d not to be throttled", i+1)
+		}
+		recordFailedLogin(req, svc, "Monitor")
+	}
+	if count, _, _ := store.Count("login-failures-username:" + usernameKey("Monitor")); count != 0 {
+		t.Errorf("Expected exempt failures not to be counted but got: %d", count)
+	}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/auth/authenticate", nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		recordFailedLogin(req, svc, "alice")
+	}
+	req := httptest.NewRequest("POST", "/auth/authenticate", nil)
+	req.RemoteAddr = "10.0.0.3:1234"
+	if !throttleLogin(httptest.NewRecorder(), req, svc, "alice") {
+		t.Error("Expected a non exempt login to be throttled")
+	}
+}
+
+// fakeRoleService only knows the roles of usernames
+type fakeRoleService struct {
+	UserService
+	roles map[string]string
+}
+
+func (s fakeRoleService) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	role, ok := s.roles[username]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	return &model.User{Username: username, Role: role}, nil
+}
+
+// testRateLimitStore checks the behaviour every RateLimitStore must share.
+// advance moves the store's clock forward.
+func testRateLimitStore(t *testing.T, store RateLimitStore, advance func(time.Duration)) {
+	const window = 200 * time.Millisecond
+	limiter := newRateLimiter(store, "test-"+strconv.FormatInt(time.Now().UnixNano(), 10), 2, window)
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := limiter.Allow("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allowed {
+			t.Fatalf("Expected hit %d to be allowed", i+1)
+		}
+	}
+
+	allowed, retryAfter, err := limiter.Allow("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed {
+		t.Error("Expected the hit over the limit to be blocked")
+	}
+	if retryAfter <= 0 || retryAfter > window {
+		t.Errorf("Expected retry after to be within the window but got: %v", retryAfter)
+	}
+
+	// Keys are counted separately
+	if allowed, _, _ := limiter.Allow("other"); !allowed {
+		t.Error("Expected another key to have its own budget")
+	}
+
+	// Counting doesn't record a hit
+	count, _, err := store.Count(limiter.prefix + ":key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("Expected a count of 3 but got: %d", count)
+	}
+	if count, _, _ := store.Count(limiter.prefix + ":unknown"); count != 0 {
+		t.Errorf("Expected an unknown key to have no hits but got: %d", count)
+	}
+
+	// Resetting forgets the hits
+	if err := store.Reset(limiter.prefix + ":other"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _, _ := store.Count(limiter.prefix + ":other"); count != 0 {
+		t.Errorf("Expected a reset key to have no hits but got: %d", count)
+	}
+
+	// The window resets
+	advance(window + 50*time.Millisecond)
+	if allowed, _, _ := limiter.Allow("key"); !allowed {
+		t.Error("Expected the limit to reset after the window")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/reqres"
+	"github.com/gomodule/redigo/redis"
+	"github.com/nats-io/nats.go"
+)
+
+// Statuses of the dependencies readiness checks report on
+const (
+	dependencyOK          = "ok"
+	dependencyUnavailable = "unavailable"
+)
+
+var errNATSDisconnected = errors.New("not connected to the NATS server")
+
+// HealthChecker is implemented by what the instance depends on that can be
+// checked, e.g. a sender of emails reaching its mail server
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// dependencyCheck is how readiness checks probe a dependency. The instance
+// isn't ready without the ones required, and only degraded without others.
+type dependencyCheck struct {
+	name     string
+	required bool
+	check    func(ctx context.Context) error
+}
+
+// dependencyChecks are the dependencies checked on top of the database, set
+// up by main for the ones configured
+var dependencyChecks []dependencyCheck
+
+// redisHealth checks the Redis server of pool answers
+func redisHealth(pool *redis.Pool) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn, err := pool.GetContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = redis.DoContext(conn, ctx, "PING")
+		return err
+	}
+}
+
+// CheckHealth reports whether events get to the NATS server. The connection
+// reconnects in the background, so this doesn't wait for it.
+func (p *natsPublisher) CheckHealth(ctx context.Context) error {
+	if p.conn.Status() != nats.CONNECTED {
+		return errNATSDisconnected
+	}
+	return nil
+}
+
+// checkDependencies runs checks at once until ctx is done, returning how each
+// went in order and whether the required ones are all ok
+func checkDependencies(ctx context.Context, checks []dependencyCheck) ([]reqres.DependencyHealth, bool) {
+	results := make([]reqres.DependencyHealth, len(checks))
+	var wg sync.WaitGroup
+	for i, dependency := range checks {
+		wg.Add(1)
+		go func(i int, dependency dependencyCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := runCheck(ctx, dependency.check)
+			results[i] = reqres.DependencyHealth{
+				Name:      dependency.name,
+				Status:    dependencyOK,
+				Required:  dependency.required,
+				LatencyMS: int64(time.Since(start) / time.Millisecond),
+			}
+			if err != nil {
+				results[i].Status, results[i].Error = dependencyUnavailable, err.Error()
+			}
+		}(i, dependency)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, result := range results {
+		if result.Required && result.Status != dependencyOK {
+			ready = false
+		}
+	}
+	return results, ready
+}
+
+// runCheck runs check, giving up on it once ctx is done
+func runCheck(ctx context.Context, check func(ctx context.Context) error) error {
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
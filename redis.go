@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RedisURL is the address of the Redis server shared by all instances, set by
+// the REDIS_URL secret. In-memory stores are used when it's empty.
+var RedisURL = ""
+
+func newRedisPool(url string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// hitScript increments the counter of a window and starts the window on the
+// first hit, atomically so concurrent instances can't lose a hit or leave a
+// counter without an expiry
+var hitScript = redis.NewScript(1, `
+local count = redis.call("INCR", KEYS[1])
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl < 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+// redisRateLimitStore keeps the counters in Redis so limits are shared
+// across instances
+type redisRateLimitStore struct {
+	pool *redis.Pool
+}
+
+func (s redisRateLimitStore) Hit(key string, window time.Duration) (int, time.Duration, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.Int64s(hitScript.Do(conn, "ratelimit:"+key, int64(window/time.Millisecond)))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(values[0]), time.Duration(values[1]) * time.Millisecond, nil
+}
+
+func (s redisRateLimitStore) Count(key string) (int, time.Duration, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("GET", "ratelimit:"+key)
+	conn.Send("PTTL", "ratelimit:"+key)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count, err := redis.Int(values[0], nil)
+	if err == redis.ErrNil {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ttl, err := redis.Int64(values[1], nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, time.Duration(ttl) * time.Millisecond, nil
+}
+
+func (s redisRateLimitStore) Reset(key string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", "ratelimit:"+key)
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// refreshTokenTTL is how long a refresh token can be swapped for a new access
+// token. Every refresh hands out a new refresh token with a fresh TTL.
+var refreshTokenTTL = 30 * 24 * time.Hour
+
+// rememberMeTTL is how long the refresh tokens of logins asking to be
+// remembered last instead of refreshTokenTTL
+var rememberMeTTL = 90 * 24 * time.Hour
+
+// rememberMeContextKey is the request context key of whether a login asked to
+// be remembered
+const rememberMeContextKey contextKey = "remember-me"
+
+// withRememberMe returns ctx, making the sessions logged in with it last
+// rememberMeTTL between refreshes when remember is set
+func withRememberMe(ctx context.Context, remember bool) context.Context {
+	return context.WithValue(ctx, rememberMeContextKey, remember)
+}
+
+// rememberMeFrom returns whether the login of ctx asked to be remembered
+func rememberMeFrom(ctx context.Context) bool {
+	remember, _ := ctx.Value(rememberMeContextKey).(bool)
+	return remember
+}
+
+// refreshTokenLifetime returns how long a refresh token lasts, depending on
+// whether its login asked to be remembered
+func refreshTokenLifetime(rememberMe bool) time.Duration {
+	if rememberMe {
+		return rememberMeTTL
+	}
+	return refreshTokenTTL
+}
+
+// maxFamilyRefreshes is how many times a family of refresh tokens can be
+// refreshed before its user has to log in again, bounding how long a stolen
+// refresh token keeps working. 0 leaves families unbounded.
+var maxFamilyRefreshes = 0
+
+var (
+	errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token was already used, the session has been revoked")
+	errOriginMismatch      = errors.New("token was issued to a different origin")
+	errAccountInactive     = errors.New("account is not active")
+	errReauthRequired      = errors.New("the session was refreshed too many times, log in again")
+)
+
+// refreshTokenBytes is how many random bytes refresh tokens are made of
+const refreshTokenBytes = 32
+
+// newRefreshToken returns a random opaque refresh token
+func newRefreshToken() (string, error) {
+	b := make([]byte, refreshTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isWellFormedRefreshToken reports whether token looks like one we issued, so
+// junk can be refused without looking it up. Refresh tokens are opaque, not
+// JWTs, so this checks they are hex encoded random bytes.
+func isWellFormedRefreshToken(token string) bool {
+	if len(token) != hex.EncodedLen(refreshTokenBytes) {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+// hashRefreshToken returns what refresh tokens are stored and looked up by.
+// They are random enough that a plain hash can't be reversed.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// refreshTokenCollection returns the collection of refresh tokens, making sure
+// the database drops expired ones
+func refreshTokenCollection(session *mgo.Session) (*mgo.Collection, error) {
+	collection := session.DB("buzz-test-user").C("refresh_tokens")
+
+	index := mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second,
+	}
+	if err := collection.EnsureIndex(index); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+// issueRefreshToken stores a new refresh token for userID in familyID, the
+// chain of tokens descending from the same login, and returns it. It lasts
+// longer when the login asked to be remembered.
+func issueRefreshToken(collection *mgo.Collection, userID, familyID, origin string, rememberMe bool) (string, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	stored := &model.RefreshToken{
+		ID:         hashRefreshToken(token),
+		UserID:     userID,
+		FamilyID:   familyID,
+		Origin:     origin,
+		RememberMe: rememberMe,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(refreshTokenLifetime(rememberMe)),
+	}
+	if err := collection.Insert(stored); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// revokeUserRefreshTokens revokes every refresh token of userID, ending all
+// of their sessions once their access tokens expire
+func revokeUserRefreshTokens(collection *mgo.Collection, userID string) error {
+	_, err := collection.RemoveAll(bson.M{"user_id": userID})
+	return err
+}
+
+// revokeRefreshTokenFamily revokes every refresh token descending from the
+// same login. Access tokens already handed out stay valid until they expire.
+func revokeRefreshTokenFamily(collection *mgo.Collection, familyID string) error {
+	_, err := collection.RemoveAll(bson.M{"family_id": familyID})
+	return err
+}
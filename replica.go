@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+var (
+	// MongoReplicaURL is the address of a read replica, set by the
+	// MONGO_REPLICA_URL secret. Reads go to the primary when it's empty.
+	MongoReplicaURL = ""
+
+	// recentWrites makes reads of a just-written user go to the primary for
+	// a short while so clients see their own writes despite replica lag
+	recentWrites = newWriteTracker(5 * time.Second)
+
+	replicaSession *mgo.Session
+)
+
+// getReadSession returns a session for read-only queries about key (a user
+// id or username). It uses the replica unless key was written recently.
+func getReadSession(key string) (*mgo.Session, error) {
+	if MongoReplicaURL == "" || recentWrites.Recent(key) {
+		return getSession()
+	}
+
+	//Establish our replica connection
+	if replicaSession == nil {
+		var err error
+		replicaSession, err = mgo.Dial(MongoReplicaURL)
+		if err != nil {
+			return nil, err
+		}
+
+		// Reads may be served by secondaries, falling back to the primary
+		replicaSession.SetMode(mgo.SecondaryPreferred, true)
+	}
+
+	return replicaSession.Copy(), nil
+}
+
+// getReadSessionContext is getReadSession, with queries giving up at the
+// deadline of ctx
+func getReadSessionContext(ctx context.Context, key string) (*mgo.Session, error) {
+	session, err := getReadSession(key)
+	if err != nil {
+		return nil, err
+	}
+	return boundSession(ctx, session)
+}
+
+// writeTracker remembers which users were written within a time window
+type writeTracker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	written map[string]time.Time
+	now     func() time.Time
+	onMark  []func(keys ...string)
+}
+
+func newWriteTracker(window time.Duration) *writeTracker {
+	return &writeTracker{window: window, written: make(map[string]time.Time), now: time.Now}
+}
+
+// Mark records a write for each of the given keys
+func (t *writeTracker) Mark(keys ...string) {
+	for _, f := range t.mark(keys) {
+		f(keys...)
+	}
+}
+
+// OnMark calls f with the keys of every write marked from now on, e.g. to
+// invalidate what's cached about them
+func (t *writeTracker) OnMark(f func(keys ...string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.onMark = append(t.onMark, f)
+}
+
+// mark records the writes, returning who to tell about them once the lock
+// is released
+func (t *writeTracker) mark(keys []string) []func(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	// Forget writes that are outside the window
+	for key, writtenAt := range t.written {
+		if now.Sub(writtenAt) >= t.window {
+			delete(t.written, key)
+		}
+	}
+
+	for _, key := range keys {
+		t.written[key] = now
+	}
+	return t.onMark
+}
+
+// Recent reports whether key was written within the window
+func (t *writeTracker) Recent(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	writtenAt, ok := t.written[key]
+	return ok && t.now().Sub(writtenAt) < t.window
+}
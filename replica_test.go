@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriteTrackerRoutesRecentWritesToPrimary(t *testing.T) {
+	now := time.Now()
+	tracker := newWriteTracker(5 * time.Second)
+	tracker.now = func() time.Time { return now }
+
+	if tracker.Recent("userID") {
+		t.Error("Expected an unwritten user to be read from the replica")
+	}
+
+	tracker.Mark("userID", "testUser")
+	if !tracker.Recent("userID") || !tracker.Recent("testUser") {
+		t.Error("Expected a just-written user to be read from the primary")
+	}
+
+	now = now.Add(5 * time.Second)
+	if tracker.Recent("userID") {
+		t.Error("Expected reads to go back to the replica after the lag window")
+	}
+
+	// Marking prunes stale entries
+	tracker.Mark("otherID")
+	if _, ok := tracker.written["userID"]; ok {
+		t.Error("Expected stale writes to be forgotten")
+	}
+}
@@ -1,19 +1,77 @@
 package reqres
 
-import "github.com/buzzapp/user/model"
+import (
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
 
 // CreateUserRequest desribes the request for creating a new user
 type CreateUserRequest struct {
-	Email     string `json:"email"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Password  string `json:"password"`
-	Role      string `json:"role"`
-	Username  string `json:"username"`
+	Email              string `json:"email"`
+	FirstName          string `json:"first_name"`
+	LastName           string `json:"last_name"`
+	Password           string `json:"password"`
+	Role               string `json:"role"`
+	Username           string `json:"username"`
+	DateOfBirth        string `json:"date_of_birth"`
+	AcceptedTOSVersion string `json:"accepted_tos_version"`
+	ReservationToken   string `json:"reservation_token,omitempty"`
+}
+
+// CreateUserRequestV1 describes version 1 of the request for creating a new
+// user, which takes the full name in one field
+type CreateUserRequestV1 struct {
+	Email              string `json:"email"`
+	Name               string `json:"name"`
+	Password           string `json:"password"`
+	Role               string `json:"role"`
+	Username           string `json:"username"`
+	DateOfBirth        string `json:"date_of_birth"`
+	AcceptedTOSVersion string `json:"accepted_tos_version"`
 }
 
 // CreateUserResponse desribes the response for creating a new user
 type CreateUserResponse struct {
+	User     *model.User `json:"user"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+// UpdateUserRequest describes the request for updating a user. Omitted
+// fields are left as they are.
+type UpdateUserRequest struct {
+	Email     *string `json:"email"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Password  *string `json:"password"`
+	Role      *string `json:"role"`
+	Username  *string `json:"username"`
+
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+	Timezone    *string `json:"timezone"`
+	Locale      *string `json:"locale"`
+	Phone       *string `json:"phone"`
+}
+
+// UpdateMeRequest describes the request for updating your own account. It
+// has no role or password, those are changed through their own endpoints.
+// Omitted fields are left as they are, and empty profile fields are cleared.
+type UpdateMeRequest struct {
+	Email     *string `json:"email"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Username  *string `json:"username"`
+
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+	Timezone    *string `json:"timezone"`
+	Locale      *string `json:"locale"`
+	Phone       *string `json:"phone"`
+}
+
+// UpdateUserResponse describes the response for updating a user
+type UpdateUserResponse struct {
 	User *model.User `json:"user"`
 }
 
@@ -22,20 +80,343 @@ type GetUserResponse struct {
 	User *model.User `json:"user"`
 }
 
+// ResolveUsersRequest describes the request for resolving usernames to IDs
+type ResolveUsersRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+// ResolveUsersResponse describes the response for resolving usernames to IDs
+type ResolveUsersResponse struct {
+	Users []model.ResolvedUser `json:"users"`
+}
+
 // LoginRequest describes the request for a user to login
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// Code is the one-time code sent when a login needs confirming
+	Code string `json:"code,omitempty"`
+	// RememberMe keeps the session logged in for longer between uses
+	RememberMe bool `json:"remember_me,omitempty"`
 }
 
 // LoginResponse describes the response for a user to login
 type LoginResponse struct {
-	Token model.JWTToken `json:"token"`
+	Token                 model.JWTToken `json:"token"`
+	RefreshToken          string         `json:"refresh_token"`
+	TOSAcceptanceRequired bool           `json:"tos_acceptance_required,omitempty"`
+	EvictedSessions       []string       `json:"evicted_sessions,omitempty"`
+}
+
+// ImpersonateResponse describes the response for an admin impersonating a
+// user. The token can't be refreshed.
+type ImpersonateResponse struct {
+	Token     model.JWTToken `json:"token"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+// AcceptTOSRequest describes the request for accepting the terms of service
+type AcceptTOSRequest struct {
+	Version string `json:"version"`
+}
+
+// SetStatusRequest describes the request for changing the status of an account
+type SetStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// GetChangesResponse describes the response of getting the users changed
+// since a time. NextCursor fetches the next page when there is one.
+type GetChangesResponse struct {
+	Changes    []model.UserChange `json:"changes"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// GetDuplicatesResponse describes the response of the duplicate accounts
+// report. Total is the number of groups across all pages.
+type GetDuplicatesResponse struct {
+	Groups []model.DuplicateGroup `json:"groups"`
+	Total  int                    `json:"total"`
+	Offset int                    `json:"offset"`
+	Limit  int                    `json:"limit"`
+}
+
+// ListUsersResponse describes the response of listing users. Total is the
+// number of users across all pages, and Next and Prev link to the pages
+// around this one when there are any. Warnings say what part of the list
+// couldn't be got, when the rest still could.
+type ListUsersResponse struct {
+	Users    []model.User `json:"users"`
+	Total    int          `json:"total"`
+	Offset   int          `json:"offset"`
+	Limit    int          `json:"limit"`
+	Next     string       `json:"next,omitempty"`
+	Prev     string       `json:"prev,omitempty"`
+	Warnings []string     `json:"warnings,omitempty"`
+}
+
+// SecurityEventsResponse describes the response for listing the caller's
+// recent security events, newest first
+type SecurityEventsResponse struct {
+	Events []model.SecurityEvent `json:"events"`
+	Total  int                   `json:"total"`
+	Offset int                   `json:"offset"`
+	Limit  int                   `json:"limit"`
+}
+
+// AuditEventsResponse describes the response for listing the audit log,
+// newest first
+type AuditEventsResponse struct {
+	Events []model.AuditEvent `json:"events"`
+	Total  int                `json:"total"`
+	Offset int                `json:"offset"`
+	Limit  int                `json:"limit"`
+}
+
+// AuditExportEvent describes a line of the audit log exported as JSON. Target
+// is the id of the user the event is about.
+type AuditExportEvent struct {
+	Actor     string    `json:"actor"`
+	Target    string    `json:"target"`
+	Event     string    `json:"event"`
+	Outcome   string    `json:"outcome"`
+	IP        string    `json:"ip"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// BulkUpdateResult describes the outcome of a row of a bulk update, by its
+// line in the CSV
+type BulkUpdateResult struct {
+	Line   int    `json:"line"`
+	Key    string `json:"key"`
+	UserID string `json:"user_id,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkUpdateResponse describes the response for updating users from a CSV.
+// On a dry run nothing is written, and Updated is how many users would be.
+type BulkUpdateResponse struct {
+	Updated int                `json:"updated"`
+	Failed  int                `json:"failed"`
+	Results []BulkUpdateResult `json:"results"`
+	DryRun  bool               `json:"dry_run,omitempty"`
+}
+
+// ResendVerificationsResponse describes the response for resending the
+// verifications of every pending user, which are sent in the background
+type ResendVerificationsResponse struct {
+	Queued int `json:"queued"`
+}
+
+// TestWebhookRequest describes the request for sending a sample event to the
+// webhook, or to URL when there is one
+type TestWebhookRequest struct {
+	URL string `json:"url,omitempty"`
+}
+
+// TestWebhookResponse describes the response for sending a sample event to a
+// webhook. Status is 0 when the webhook couldn't be reached.
+type TestWebhookResponse struct {
+	URL       string `json:"url"`
+	Status    int    `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ListDeadLettersResponse describes the response for listing the webhook
+// deliveries given up on
+type ListDeadLettersResponse struct {
+	DeadLetters []model.WebhookDeadLetter `json:"dead_letters"`
+}
+
+// ReplayDeadLetterResponse describes the response for replaying a webhook
+// delivery given up on, which is dropped once it's accepted
+type ReplayDeadLetterResponse struct {
+	ID        string `json:"id"`
+	Status    int    `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// BulkVerifyRequest describes the request for marking users verified, by
+// their IDs or emails
+type BulkVerifyRequest struct {
+	Users []string `json:"users"`
+}
+
+// BulkVerifyResult describes the outcome of verifying a user of a bulk verify
+type BulkVerifyResult struct {
+	Key    string `json:"key"`
+	UserID string `json:"user_id,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkVerifyResponse describes the response for marking users verified
+type BulkVerifyResponse struct {
+	Verified int                `json:"verified"`
+	Skipped  int                `json:"skipped"`
+	Failed   int                `json:"failed"`
+	Results  []BulkVerifyResult `json:"results"`
+}
+
+// CreateChallengeResponse describes the response of sending a one-time code
+type CreateChallengeResponse struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ChangePasswordRequest describes the request for a user changing their own
+// password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// RequestPasswordResetRequest describes the request for a password reset
+// token to be sent to a user
+type RequestPasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// ConfirmPasswordResetRequest describes the request for resetting a password
+// with a password reset token
+type ConfirmPasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// InviteUserRequest describes the request for inviting someone to join. They
+// pick their password when they accept.
+type InviteUserRequest struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Role      string `json:"role"`
+	Username  string `json:"username"`
+}
+
+// InviteUserResponse describes the response of inviting someone to join
+type InviteUserResponse struct {
+	Invitation *model.Invitation `json:"invitation"`
+}
+
+// AcceptInvitationRequest describes the request for accepting an invite
+type AcceptInvitationRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// CheckInvitationResponse describes the response of checking an invite
+// token, with what the signup form can be filled in with
+type CheckInvitationResponse struct {
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ListInvitationsResponse describes the response of listing the pending
+// invites, newest first
+type ListInvitationsResponse struct {
+	Invitations []model.Invitation `json:"invitations"`
+	Total       int                `json:"total"`
+	Offset      int                `json:"offset"`
+	Limit       int                `json:"limit"`
+}
+
+// CreateGroupRequest describes the request for creating a group
+type CreateGroupRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// UpdateGroupRequest describes the request for updating a group. Omitted
+// fields are left as they are.
+type UpdateGroupRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+// GroupResponse describes the response of creating, getting or updating a
+// group
+type GroupResponse struct {
+	Group *model.Group `json:"group"`
+}
+
+// ListGroupsResponse describes the response of listing groups, by name
+type ListGroupsResponse struct {
+	Groups []model.Group `json:"groups"`
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+}
+
+// UserGroupsResponse describes the response of listing the groups a user
+// belongs to, by name
+type UserGroupsResponse struct {
+	Groups []model.Group `json:"groups"`
+}
+
+// VerifyChallengeRequest describes the request for confirming a one-time code
+type VerifyChallengeRequest struct {
+	Code string `json:"code"`
+}
+
+// VerifyChallengeResponse describes the response of confirming a one-time
+// code. The proof token can be presented for sensitive changes until it
+// expires.
+type VerifyChallengeResponse struct {
+	ProofToken string    `json:"proof_token"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ListSessionsResponse describes the response of listing a user's sessions,
+// most recently seen first
+type ListSessionsResponse struct {
+	Sessions []model.Session `json:"sessions"`
+}
+
+// GetLoginAttemptsResponse describes the response of getting a user's login attempts
+type GetLoginAttemptsResponse struct {
+	LoginAttempts []model.LoginAttempt `json:"login_attempts"`
+}
+
+// GetSecurityReportResponse describes the response of getting a user's security report
+type GetSecurityReportResponse struct {
+	Report *model.SecurityReport `json:"report"`
+}
+
+// GetStatsResponse describes the response of getting user statistics
+type GetStatsResponse struct {
+	Stats *model.UserStats `json:"stats"`
 }
 
 // RefreshTokenRequest describes the request for refreshing a token
 type RefreshTokenRequest struct {
-	Token string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// LogoutRequest describes the request for logging out. The refresh token of
+// the session to end is optional.
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// InvalidateResetTokensResponse describes the response for invalidating the
+// outstanding reset and verification tokens of a user
+type InvalidateResetTokensResponse struct {
+	Invalidated int `json:"invalidated"`
+}
+
+// TokenRevokedRequest describes the request for checking whether a token was
+// revoked
+type TokenRevokedRequest struct {
+	JTI string `json:"jti"`
+}
+
+// TokenRevokedResponse describes the response for checking whether a token
+// was revoked
+type TokenRevokedResponse struct {
+	Revoked bool `json:"revoked"`
 }
 
 // RefreshTokenResponse describes the response for refreshing a token
@@ -43,6 +424,138 @@ type RefreshTokenResponse struct {
 	Token model.JWTToken `json:"token"`
 }
 
+// PasswordPolicyResponse describes the response for getting the password policy
+type PasswordPolicyResponse struct {
+	Policy model.PasswordPolicy `json:"policy"`
+}
+
+// CheckPasswordRequest describes the request for checking a candidate
+// password against the policy
+type CheckPasswordRequest struct {
+	Password  string `json:"password"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// CheckPasswordResponse describes the response for checking a candidate
+// password against the policy
+type CheckPasswordResponse struct {
+	Valid    bool     `json:"valid"`
+	Message  string   `json:"message,omitempty"`
+	Code     string   `json:"code,omitempty"`
+	Warnings []string `json:"warnings"`
+}
+
+// RolesResponse describes the response for listing the roles
+type RolesResponse struct {
+	Roles []model.Role `json:"roles"`
+}
+
+// PermissionsResponse describes the response for getting the caller's
+// permissions
+type PermissionsResponse struct {
+	Role   string   `json:"role"`
+	Scopes []string `json:"scopes"`
+}
+
+// AuthMethodsResponse describes the response for getting the ways the caller
+// can authenticate, without any of their secrets
+type AuthMethodsResponse struct {
+	PasswordSet     bool     `json:"password_set"`
+	TOTPEnabled     bool     `json:"totp_enabled"`
+	LinkedProviders []string `json:"linked_providers"`
+	APIKeys         int      `json:"api_keys"`
+	PhoneVerified   bool     `json:"phone_verified"`
+}
+
+// LinkIdentityResponse describes the response for starting to link an
+// identity, which is linked once the user logs in at AuthorizeURL
+type LinkIdentityResponse struct {
+	AuthorizeURL string `json:"authorize_url"`
+}
+
+// PasswordStatusResponse describes the response for getting how old the
+// caller's password is. MaxAge is in seconds, 0 when passwords don't expire.
+type PasswordStatusResponse struct {
+	ChangedAt      *time.Time `json:"changed_at,omitempty"`
+	MaxAge         int64      `json:"max_age"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Expired        bool       `json:"expired"`
+	ExpiringSoon   bool       `json:"expiring_soon"`
+	ChangeRequired bool       `json:"change_required"`
+}
+
+// RoleDiffResponse describes the response for previewing a role change, with
+// the scopes the user would gain and lose
+type RoleDiffResponse struct {
+	UserID       string   `json:"user_id"`
+	CurrentRole  string   `json:"current_role"`
+	ProposedRole string   `json:"proposed_role"`
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+}
+
+// AuditVerifyResponse describes the response for verifying the audit trail.
+// BrokenAt is the sequence number of the first entry that doesn't check out.
+type AuditVerifyResponse struct {
+	Valid    bool  `json:"valid"`
+	Entries  int   `json:"entries"`
+	BrokenAt int64 `json:"broken_at,omitempty"`
+}
+
+// HealthResponse describes the response of the health and readiness checks.
+// Only readiness checks report on dependencies.
+type HealthResponse struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyHealth `json:"dependencies,omitempty"`
+}
+
+// DependencyHealth describes how checking a dependency went. The instance
+// isn't ready when a required one is unavailable.
+type DependencyHealth struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Required  bool   `json:"required"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// DrainResponse describes the response for draining the instance
+type DrainResponse struct {
+	ShutdownAt time.Time `json:"shutdown_at"`
+}
+
+// DiscoveryResponse describes the discovery document of the service
+type DiscoveryResponse struct {
+	Issuer                    string   `json:"issuer"`
+	TokenEndpoint             string   `json:"token_endpoint"`
+	RefreshEndpoint           string   `json:"refresh_endpoint"`
+	SigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	JWKSURI                   string   `json:"jwks_uri"`
+	PasswordPolicyEndpoint    string   `json:"password_policy_endpoint"`
+}
+
+// JWKSResponse describes the JSON Web Key Set tokens are verified with
+type JWKSResponse struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey describes a public key tokens are verified with. N and E are set
+// for RSA keys, Curve, X and Y for EC keys.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
 /*****************************/
 /* GENERIC RESPONSES */
 /*****************************/
@@ -50,9 +563,149 @@ type RefreshTokenResponse struct {
 // ErrorResponse describes a response for when there is an error
 type ErrorResponse struct {
 	Message string `json:"message"`
+	Code    string `json:"code"`
+	// Fields holds the validation message of each offending request field
+	Fields map[string]string `json:"fields,omitempty"`
+	// Errors lists every validation error of the request, by field
+	Errors []FieldError `json:"errors,omitempty"`
+	// RequestID identifies the request in our logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// FieldError describes a validation error about a request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// DeactivateInactiveResponse describes the response of deactivating inactive
+// users. Count is how many were, or would be on a dry run, deactivated.
+type DeactivateInactiveResponse struct {
+	Count  int  `json:"count"`
+	DryRun bool `json:"dry_run"`
+}
+
+// DryRunResponse describes the response of previewing a destructive
+// operation, with the users it would affect
+type DryRunResponse struct {
+	Action  string   `json:"action"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"user_ids"`
+	DryRun  bool     `json:"dry_run"`
+}
+
+// GCTokensResponse describes the response of garbage collecting tokens.
+// Removed is how many entries were removed in all, the refresh tokens of
+// stale families included; TokenFamilies counts the families themselves.
+type GCTokensResponse struct {
+	Removed        int `json:"removed"`
+	RefreshTokens  int `json:"refresh_tokens"`
+	TokenFamilies  int `json:"token_families"`
+	PasswordResets int `json:"password_resets"`
+	Challenges     int `json:"challenges"`
+	Revocations    int `json:"revocations"`
+}
+
+// ProblemResponse describes an error as RFC 7807 problem details, for clients
+// that ask for them. Instance is the id of the request.
+type ProblemResponse struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail"`
+	Instance string            `json:"instance,omitempty"`
+	Code     string            `json:"code"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Errors   []FieldError      `json:"errors,omitempty"`
+}
+
+// ReserveUsernameRequest describes the request for holding a username during
+// a signup
+type ReserveUsernameRequest struct {
+	Username string `json:"username"`
+}
+
+// ReserveUsernameResponse describes the response for holding a username, with
+// the token the signup takes it with
+type ReserveUsernameResponse struct {
+	Username         string    `json:"username"`
+	ReservationToken string    `json:"reservation_token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+// ResendVerificationRequest describes the request for sending a new email
+// verification token
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// ValidateEmailRequest describes the request for checking an email ahead of
+// signing up with it
+type ValidateEmailRequest struct {
+	Email string `json:"email"`
+}
+
+// ValidateEmailResponse describes the response of checking an email.
+// Normalized is what the email is compared by for uniqueness and logging in,
+// and Message says why an invalid email is refused.
+type ValidateEmailResponse struct {
+	Email      string `json:"email"`
+	Normalized string `json:"normalized"`
+	Valid      bool   `json:"valid"`
+	Message    string `json:"message,omitempty"`
+}
+
+// ReleaseUsernameRequest describes the request for letting go of a reserved
+// username
+type ReleaseUsernameRequest struct {
+	Username         string `json:"username"`
+	ReservationToken string `json:"reservation_token"`
 }
 
 // MessageResponse describes a message JSON response
 type MessageResponse struct {
 	Message string `json:"message"`
 }
+
+// CreateAPIKeyRequest describes the request for creating an API key. Keys
+// without an expiry last until they are revoked.
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateAPIKeyResponse describes the response for creating an API key. Key is
+// only ever handed out here.
+type CreateAPIKeyResponse struct {
+	Key    string        `json:"key"`
+	APIKey *model.APIKey `json:"api_key"`
+}
+
+// ListAPIKeysResponse describes the response for listing a user's API keys
+type ListAPIKeysResponse struct {
+	APIKeys []model.APIKey `json:"api_keys"`
+}
+
+// ImportResult describes the outcome of a row of an import, by its line in
+// the CSV or its position in the JSON array
+type ImportResult struct {
+	Row      int    `json:"row"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	UserID   string `json:"user_id,omitempty"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ImportResponse describes the report of an import. Imports run in the
+// background are reported with their job id, and are running until they are
+// done, or cancelled when the service shuts down.
+type ImportResponse struct {
+	JobID   string         `json:"job_id,omitempty"`
+	Status  string         `json:"status"`
+	Created int            `json:"created"`
+	Skipped int            `json:"skipped"`
+	Failed  int            `json:"failed"`
+	Results []ImportResult `json:"results"`
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// requestLog logs every request as a line of JSON, nothing is logged when it's
+// off
+var requestLog = true
+
+// requestLogEntry is the line logged for a request
+type requestLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	UserID    string    `json:"user_id,omitempty"`
+}
+
+// requestIDMiddleware gives every request an id, the one the client sent in
+// the X-Request-ID header or a random one, and hands it back in the same
+// header. Error responses carry it so errors users report can be found in the
+// logs.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assignRequestID(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// assignRequestID returns the id of the request, setting it on the response
+// unless that's done already
+func assignRequestID(w http.ResponseWriter, r *http.Request) string {
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		return id
+	}
+
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// requestLogMiddleware writes a requestLogEntry to out for every request once
+// it's been responded to
+func requestLogMiddleware(out io.Writer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requestLog {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		id := assignRequestID(w, r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		entry := requestLogEntry{
+			Time:      start.UTC(),
+			RequestID: id,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    rec.status,
+			LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+			UserID:    auditActor(r),
+		}
+		if err := json.NewEncoder(out).Encode(entry); err != nil {
+			log.Println("unable to log request:", err)
+		}
+	})
+}
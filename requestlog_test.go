@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buzzapp/user/reqres"
+)
+
+func TestRequestLogMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	handler := requestIDMiddleware(requestLogMiddleware(&out, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithError("unable to get user", errUserNotFound, w, http.StatusNotFound)
+	})))
+
+	token, err := generateToken("loggedID", "logged", "user", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/users/missingID?fields=email", nil)
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	req.Header.Set(requestIDHeader, "req-456")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Header().Get(requestIDHeader) != "req-456" {
+		t.Errorf("Expected the request id to be handed back but got: %q", rec.Header().Get(requestIDHeader))
+	}
+	var payload reqres.ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.RequestID != "req-456" {
+		t.Errorf("Expected the error response to carry the request id but got: %q", payload.RequestID)
+	}
+
+	var entry requestLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a line of JSON but got: %q", out.String())
+	}
+	if entry.RequestID != "req-456" || entry.Method != "GET" || entry.Path != "/users/missingID" || entry.Status != http.StatusNotFound {
+		t.Errorf("Expected the request to be logged but got: %+v", entry)
+	}
+	if entry.UserID != "loggedID" {
+		t.Errorf("Expected the caller to be logged but got: %q", entry.UserID)
+	}
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("Expected one line per request but got: %q", out.String())
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	var out bytes.Buffer
+	handler := requestIDMiddleware(requestLogMiddleware(&out, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	for _, id := range []string{"", strings.Repeat("x", maxRequestIDLength+1)} {
+		out.Reset()
+		req := httptest.NewRequest("POST", "/users/logout", nil)
+		req.Header.Set(requestIDHeader, id)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		var entry requestLogEntry
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get(requestIDHeader); got == "" || got == id || entry.RequestID != got {
+			t.Errorf("Expected a generated request id to be handed back and logged but got: %q and %q", got, entry.RequestID)
+		}
+		if entry.Status != http.StatusNoContent || entry.UserID != "" {
+			t.Errorf("Expected an anonymous 204 to be logged but got: %+v", entry)
+		}
+	}
+}
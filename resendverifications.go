@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+var (
+	// resendBatchSize is how many verifications a bulk resend sends at once
+	resendBatchSize = 100
+
+	// resendBatchInterval is how long a bulk resend waits between batches, so
+	// a large one doesn't flood the mail server
+	resendBatchInterval = 10 * time.Second
+)
+
+var errResendRunning = errors.New("verifications are already being resent")
+
+// verificationResender resends email verifications to every pending user in
+// the background. Only one resend runs at a time per instance.
+type verificationResender struct {
+	mu      sync.Mutex
+	running bool
+
+	// ctx is what resends run under, cancelled on shutdown. Until it's set
+	// they run until done.
+	ctx  context.Context
+	done sync.WaitGroup
+}
+
+var verificationResends = &verificationResender{}
+
+// pendingVerificationUsers returns the users whose email is left to verify
+func pendingVerificationUsers(ctx context.Context) ([]model.User, error) {
+	return userRepository.Find(ctx, UserFilter{Statuses: []string{statusPending}, NotDeleted: true}, []string{"_id"}, 0, 0)
+}
+
+// start resends the verifications of users in the background, in batches of
+// resendBatchSize every resendBatchInterval, failing with errResendRunning
+// while another resend is still going
+func (s *verificationResender) start(svc UserService, users []model.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return errResendRunning
+	}
+	s.running = true
+
+	// The resend outlives the request that started it, but not the service
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		sent, failed := resendVerifications(ctx, svc, users)
+		log.Printf("verifications resent: %d sent, %d failed of %d pending users", sent, failed, len(users))
+
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// wait waits for the resend running to finish, which it does quickly once
+// its context is cancelled
+func (s *verificationResender) wait() {
+	s.done.Wait()
+}
+
+// resendVerifications sends each of users a new verification, returning how
+// many were sent and how many failed. Users verified in the meantime are
+// neither.
+func resendVerifications(ctx context.Context, svc UserService, users []model.User) (int, int) {
+	sent, failed := 0, 0
+	for start := 0; start < len(users); start += resendBatchSize {
+		if start > 0 {
+			select {
+			case <-ctx.Done():
+				return sent, failed
+			case <-time.After(resendBatchInterval):
+			}
+		}
+
+		end := start + resendBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		for _, user := range users[start:end] {
+			err := svc.ResendVerification(ctx, user.Email)
+			switch {
+			case err == nil:
+				sent++
+			case err != errUserNotFound:
+				log.Printf("unable to resend verification to user %s: %v", user.ID, err)
+				failed++
+			}
+		}
+	}
+	return sent, failed
+}
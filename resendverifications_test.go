@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// resendingUserService records the emails verifications are resent to
+type resendingUserService struct {
+	UserService
+	mu     sync.Mutex
+	emails []string
+}
+
+func (svc *resendingUserService) ResendVerification(ctx context.Context, email string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.emails = append(svc.emails, email)
+	return nil
+}
+
+func TestResendVerificationsHTTPEndpoint(t *testing.T) {
+	defer func(repo UserRepository, sender VerificationSender, size int, interval time.Duration) {
+		userRepository, verificationSender, resendBatchSize, resendBatchInterval = repo, sender, size, interval
+	}(userRepository, verificationSender, resendBatchSize, resendBatchInterval)
+	userRepository = newMemoryUserRepository()
+	verificationSender = logVerificationSender{}
+	resendBatchSize, resendBatchInterval = 2, time.Millisecond
+
+	ctx := context.Background()
+	for _, user := range []model.User{
+		{ID: "1", Email: "one@test.com", Username: "one", Status: statusPending},
+		{ID: "2", Email: "two@test.com", Username: "two", Status: statusActive},
+		{ID: "3", Email: "three@test.com", Username: "three", Status: statusPending},
+		{ID: "4", Email: "four@test.com", Username: "four"},
+		{ID: "5", Email: "five@test.com", Username: "five", Status: statusPending},
+	} {
+		user := user
+		user.UsernameKey = usernameKey(user.Username)
+		if err := userRepository.Create(ctx, &user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	svc := &resendingUserService{}
+	rec := httptest.NewRecorder()
+	handleResendVerifications(svc).ServeHTTP(rec, httptest.NewRequest("POST", ResendVerifiesPath, nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected a 202 status code response but got: %d", rec.Code)
+	}
+	var payload reqres.ResendVerificationsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Queued != 3 {
+		t.Errorf("Expected the 3 pending users to be queued but got: %d", payload.Queued)
+	}
+
+	// Only the unverified users get a verification, over two batches
+	verificationResends.wait()
+	sort.Strings(svc.emails)
+	if len(svc.emails) != 3 || svc.emails[0] != "five@test.com" || svc.emails[1] != "one@test.com" || svc.emails[2] != "three@test.com" {
+		t.Errorf("Expected verifications resent to the pending users only but got: %v", svc.emails)
+	}
+}
+
+func TestResendVerificationsOneAtATime(t *testing.T) {
+	defer func(interval time.Duration) { resendBatchInterval = interval }(resendBatchInterval)
+	resendBatchInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resends := &verificationResender{ctx: ctx}
+	users := make([]model.User, resendBatchSize+1)
+	if err := resends.start(&resendingUserService{}, users); err != nil {
+		t.Fatal(err)
+	}
+	if err := resends.start(&resendingUserService{}, users); err != errResendRunning {
+		t.Errorf("Expected a second resend to be refused while the first runs but got: %v", err)
+	}
+
+	// Shutting down stops waiting for the next batch
+	cancel()
+	resends.wait()
+	if err := resends.start(&resendingUserService{}, nil); err != nil {
+		t.Errorf("Expected a resend to start once the last one stopped but got: %v", err)
+	}
+	resends.wait()
+}
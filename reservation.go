@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// usernameReservationTTL is how long a username is held for a signup in
+// progress before anyone can take it again
+var usernameReservationTTL = 10 * time.Minute
+
+// reservationTokenBytes is how many random bytes reservation tokens are made of
+const reservationTokenBytes = 16
+
+// UsernameReservationStore is an interface for holding usernames, by their
+// key, for the signup holding the reservation token. Stores backed by a shared
+// database hold usernames across every instance of the service.
+type UsernameReservationStore interface {
+	// Reserve holds key for token until the ttl is over, unless it is
+	// already held. It reports whether token got the reservation.
+	Reserve(key, token string, ttl time.Duration) (bool, error)
+
+	// Holder returns the token holding key, empty when it isn't held
+	Holder(key string) (string, error)
+
+	// Release lets go of key when token holds it
+	Release(key, token string) error
+}
+
+// usernameReservations is where reserved usernames are held. It's replaced by
+// a Redis store when we have one.
+var usernameReservations UsernameReservationStore = newMemoryReservationStore()
+
+// newReservationToken returns a random opaque reservation token
+func newReservationToken() (string, error) {
+	b := make([]byte, reservationTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkUsernameReservation makes sure a signup holding token can take the
+// username with key, i.e. nobody else holds it
+func checkUsernameReservation(key, token string) error {
+	holder, err := usernameReservations.Holder(key)
+	if err != nil {
+		return err
+	}
+	if holder != "" && holder != token {
+		return errDuplicateUsername
+	}
+	return nil
+}
+
+// consumeUsernameReservation lets go of the username with key once the signup
+// holding token has taken it. It is best effort, since the hold expires anyway.
+func consumeUsernameReservation(key, token string) {
+	if token == "" {
+		return
+	}
+	if err := usernameReservations.Release(key, token); err != nil {
+		log.Println("unable to release username reservation:", err)
+	}
+}
+
+// memoryReservationStore keeps the reserved usernames in memory, which is
+// only suitable when running a single instance
+type memoryReservationStore struct {
+	mu           sync.Mutex
+	reservations map[string]reservation
+	now          func() time.Time
+}
+
+type reservation struct {
+	token string
+	until time.Time
+}
+
+func newMemoryReservationStore() *memoryReservationStore {
+	return &memoryReservationStore{
+		reservations: make(map[string]reservation),
+		now:          time.Now,
+	}
+}
+
+func (s *memoryReservationStore) Reserve(key, token string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// Drop reservations that have expired so the map doesn't grow forever
+	for k, held := range s.reservations {
+		if !now.Before(held.until) {
+			delete(s.reservations, k)
+		}
+	}
+
+	if _, ok := s.reservations[key]; ok {
+		return false, nil
+	}
+	s.reservations[key] = reservation{token: token, until: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryReservationStore) Holder(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, ok := s.reservations[key]
+	if !ok || !s.now().Before(held.until) {
+		return "", nil
+	}
+	return held.token, nil
+}
+
+func (s *memoryReservationStore) Release(key, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reservations[key].token == token {
+		delete(s.reservations, key)
+	}
+	return nil
+}
+
+// releaseScript deletes a reservation only when the token still holds it, so
+// a late release can't drop someone else's reservation
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisReservationStore keeps the reserved usernames in Redis, which expires
+// them by itself
+type redisReservationStore struct {
+	pool *redis.Pool
+}
+
+func (s redisReservationStore) Reserve(key, token string, ttl time.Duration) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	// NX makes concurrent reservations of the same username race in Redis,
+	// where only the first one gets it
+	_, err := redis.String(conn.Do("SET", "reservation:"+key, token, "PX", int64(ttl/time.Millisecond), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s redisReservationStore) Holder(key string) (string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	token, err := redis.String(conn.Do("GET", "reservation:"+key))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return token, err
+}
+
+func (s redisReservationStore) Release(key, token string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := releaseScript.Do(conn, "reservation:"+key, token)
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryReservationStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryReservationStore()
+	store.now = func() time.Time { return now }
+
+	// Reserve
+	if ok, err := store.Reserve("jdoe", "first", 10*time.Minute); err != nil || !ok {
+		t.Fatalf("Expected to reserve the username but got: %v, %v", ok, err)
+	}
+	if ok, _ := store.Reserve("jdoe", "second", 10*time.Minute); ok {
+		t.Error("Expected a reserved username not to be reserved again")
+	}
+	if holder, _ := store.Holder("jdoe"); holder != "first" {
+		t.Errorf("Expected the first reservation to hold the username but got: %q", holder)
+	}
+
+	// Only the holder can release it
+	store.Release("jdoe", "second")
+	if holder, _ := store.Holder("jdoe"); holder != "first" {
+		t.Errorf("Expected another token not to release the username but got: %q", holder)
+	}
+	store.Release("jdoe", "first")
+	if holder, _ := store.Holder("jdoe"); holder != "" {
+		t.Errorf("Expected the username to be released but got: %q", holder)
+	}
+
+	// Expiry
+	store.Reserve("jdoe", "third", 10*time.Minute)
+	now = now.Add(11 * time.Minute)
+	if holder, _ := store.Holder("jdoe"); holder != "" {
+		t.Errorf("Expected the reservation to expire but got: %q", holder)
+	}
+	if ok, _ := store.Reserve("jdoe", "fourth", 10*time.Minute); !ok {
+		t.Error("Expected an expired reservation to be reserved again")
+	}
+}
+
+func TestMemoryReservationStoreRace(t *testing.T) {
+	store := newMemoryReservationStore()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			if ok, _ := store.Reserve("jdoe", token, time.Minute); ok {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	if winners != 1 {
+		t.Errorf("Expected exactly one of the concurrent reservations to win but got: %d", winners)
+	}
+}
+
+func TestCheckUsernameReservation(t *testing.T) {
+	defer func(store UsernameReservationStore) { usernameReservations = store }(usernameReservations)
+	usernameReservations = newMemoryReservationStore()
+
+	if err := checkUsernameReservation("jdoe", ""); err != nil {
+		t.Errorf("Expected an unreserved username to be available but got: %v", err)
+	}
+
+	usernameReservations.Reserve("jdoe", "token", time.Minute)
+	if err := checkUsernameReservation("jdoe", "token"); err != nil {
+		t.Errorf("Expected the holder to take the username but got: %v", err)
+	}
+	if err := checkUsernameReservation("jdoe", ""); err != errDuplicateUsername {
+		t.Errorf("Expected signups without the token to be refused but got: %v", err)
+	}
+	if err := checkUsernameReservation("jdoe", "other"); err != errDuplicateUsername {
+		t.Errorf("Expected signups with another token to be refused but got: %v", err)
+	}
+
+	// Taking the username consumes the reservation
+	consumeUsernameReservation("jdoe", "token")
+	if holder, _ := usernameReservations.Holder("jdoe"); holder != "" {
+		t.Errorf("Expected the reservation to be consumed but got: %q", holder)
+	}
+}
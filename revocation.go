@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// TokenRevocationStore is an interface for remembering revoked tokens by
+// their jti until they would have expired anyway. Stores backed by a shared
+// database let every instance of the service reject the same tokens.
+type TokenRevocationStore interface {
+	// Revoke records tokenID as revoked until expiry
+	Revoke(tokenID string, expiry time.Time) error
+
+	// IsRevoked reports whether tokenID has been revoked
+	IsRevoked(tokenID string) (bool, error)
+
+	// Prune forgets the tokens that have expired, returning how many were.
+	// Stores that expire tokens by themselves have nothing to prune.
+	Prune() (int, error)
+}
+
+// revokedTokens is where logged out tokens are remembered. It's replaced by a
+// Redis store when we have one.
+var revokedTokens TokenRevocationStore = newMemoryRevocationStore()
+
+// subjectRevocationID is what revokes every token issued to sub at once, e.g.
+// when the user's ID is reissued
+func subjectRevocationID(sub string) string {
+	return "sub:" + sub
+}
+
+// revokeSubject revokes every token issued to sub so far
+func revokeSubject(sub string) error {
+	return revokedTokens.Revoke(subjectRevocationID(sub), time.Now().Add(maxTokenTTL()+tokenLeeway))
+}
+
+// sessionRevocationID is what revokes every access token of a session at
+// once, when the user logs out of it from elsewhere
+func sessionRevocationID(sessionID string) string {
+	return "sid:" + sessionID
+}
+
+// revokeSessionTokens revokes every access token of the session with
+// sessionID so far
+func revokeSessionTokens(sessionID string) error {
+	return revokedTokens.Revoke(sessionRevocationID(sessionID), time.Now().Add(maxTokenTTL()+tokenLeeway))
+}
+
+// isTokenRevoked reports whether the token with claims was revoked, by its
+// jti or along with every token of its subject or session
+func isTokenRevoked(claims map[string]interface{}) (bool, error) {
+	tokenID, _ := claims["jti"].(string)
+	revoked, err := revokedTokens.IsRevoked(tokenID)
+	if err != nil || revoked {
+		return revoked, err
+	}
+
+	if sessionID := sessionOf(claims); sessionID != "" {
+		revoked, err := revokedTokens.IsRevoked(sessionRevocationID(sessionID))
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+
+	sub, _ := claims["sub"].(string)
+	return revokedTokens.IsRevoked(subjectRevocationID(sub))
+}
+
+// memoryRevocationStore keeps the revoked tokens in memory, which is only
+// suitable when running a single instance
+type memoryRevocationStore struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+	now     func() time.Time
+}
+
+func newMemoryRevocationStore() *memoryRevocationStore {
+	return &memoryRevocationStore{
+		revoked: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+func (s *memoryRevocationStore) Revoke(tokenID string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// Drop tokens that have expired so the map doesn't grow forever
+	s.prune(now)
+
+	if now.Before(expiry) {
+		s.revoked[tokenID] = expiry
+	}
+	return nil
+}
+
+func (s *memoryRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.revoked[tokenID]
+	return ok && s.now().Before(until), nil
+}
+
+func (s *memoryRevocationStore) Prune() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.prune(s.now()), nil
+}
+
+// prune drops the tokens that have expired by now. The lock must be held.
+func (s *memoryRevocationStore) prune(now time.Time) int {
+	pruned := 0
+	for id, until := range s.revoked {
+		if !now.Before(until) {
+			delete(s.revoked, id)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// redisRevocationStore keeps the revoked tokens in Redis, which expires them
+// by itself
+type redisRevocationStore struct {
+	pool *redis.Pool
+}
+
+func (s redisRevocationStore) Revoke(tokenID string, expiry time.Time) error {
+	ttl := expiry.Sub(time.Now())
+	if ttl <= 0 {
+		return nil
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", "revoked:"+tokenID, 1, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (s redisRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", "revoked:"+tokenID))
+}
+
+func (redisRevocationStore) Prune() (int, error) {
+	return 0, nil
+}
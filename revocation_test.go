@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/reqres"
+)
+
+func TestMemoryRevocationStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRevocationStore()
+	store.now = func() time.Time { return now }
+
+	if err := store.Revoke("short", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	store.Revoke("long", now.Add(time.Hour))
+
+	if revoked, _ := store.IsRevoked("short"); !revoked {
+		t.Error("Expected the token to be revoked")
+	}
+	if revoked, _ := store.IsRevoked("other"); revoked {
+		t.Error("Expected an unknown token not to be revoked")
+	}
+
+	// Expired tokens are forgotten
+	now = now.Add(2 * time.Minute)
+	if revoked, _ := store.IsRevoked("short"); revoked {
+		t.Error("Expected an expired token to be forgotten")
+	}
+	store.Revoke("another", now.Add(time.Minute))
+	if _, ok := store.revoked["short"]; ok {
+		t.Error("Expected expired tokens to be pruned")
+	}
+	if revoked, _ := store.IsRevoked("long"); !revoked {
+		t.Error("Expected a token that hasn't expired to stay revoked")
+	}
+}
+
+func TestRevokeSubject(t *testing.T) {
+	defer func(store TokenRevocationStore) { revokedTokens = store }(revokedTokens)
+	revokedTokens = newMemoryRevocationStore()
+
+	if err := revokeSubject("oldID"); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked, _ := isTokenRevoked(map[string]interface{}{"sub": "oldID", "jti": "any"}); !revoked {
+		t.Error("Expected every token of a revoked subject to be revoked")
+	}
+	if revoked, _ := isTokenRevoked(map[string]interface{}{"sub": "otherID", "jti": "any"}); revoked {
+		t.Error("Expected tokens of other subjects not to be revoked")
+	}
+}
+
+func TestTokenRevokedEndpoint(t *testing.T) {
+	defer func(store TokenRevocationStore, key string) {
+		revokedTokens, ServiceSigningKey = store, key
+	}(revokedTokens, ServiceSigningKey)
+	revokedTokens = newMemoryRevocationStore()
+	ServiceSigningKey = "shared-key"
+
+	if err := revokedTokens.Revoke("revokedJTI", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	handler := serviceAuthMiddleware(handleTokenRevoked())
+
+	check := func(body string, sign bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", TokenRevokedPath, strings.NewReader(body))
+		if sign {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(signatureTimestampHeader, timestamp)
+			req.Header.Set(signatureHeader, hex.EncodeToString(signRequest(ServiceSigningKey, "POST", TokenRevokedPath, timestamp, []byte(body))))
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for jti, expected := range map[string]bool{"revokedJTI": true, "activeJTI": false} {
+		rec := check(`{"jti": "`+jti+`"}`, true)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected a 200 status code response but got: %d", rec.Code)
+		}
+		var payload reqres.TokenRevokedResponse
+		if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Revoked != expected {
+			t.Errorf("Expected %s to be revoked %v but got: %v", jti, expected, payload.Revoked)
+		}
+	}
+
+	if rec := check(`{"jti": ""}`, true); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing jti to get a 400 but got: %d", rec.Code)
+	}
+	if rec := check(`{"jti": "revokedJTI"}`, false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unauthenticated check to get a 401 but got: %d", rec.Code)
+	}
+}
+
+func TestRedisRevocationStore(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL not set")
+	}
+
+	store := redisRevocationStore{newRedisPool(url)}
+	tokenID := "test-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	if err := store.Revoke(tokenID, time.Now().Add(200*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := store.IsRevoked(tokenID); err != nil || !revoked {
+		t.Errorf("Expected the token to be revoked but got: %v, %v", revoked, err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if revoked, _ := store.IsRevoked(tokenID); revoked {
+		t.Error("Expected Redis to expire the token")
+	}
+}
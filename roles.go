@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Scopes roles can grant
+const (
+	scopeUsersRead         = "users:read"
+	scopeUsersWrite        = "users:write"
+	scopeLoginAttemptsRead = "login-attempts:read"
+)
+
+var errUnknownScope = errors.New("no role grants this scope")
+
+// roles are the roles users can be given. Signups are validated against them
+// and GET /roles lists them for the admin UI.
+var roles = []model.Role{
+	{Name: "admin", Scopes: []string{scopeUsersRead, scopeUsersWrite, scopeLoginAttemptsRead}},
+	{Name: "student", Scopes: []string{scopeUsersRead}},
+}
+
+// defaultRole is the role of accounts users sign up for themselves
+var defaultRole = "student"
+
+// Who is creating an account, which decides the role it can get
+const (
+	creatorSignup = "signup"
+	creatorAdmin  = "admin"
+)
+
+// creatorContextKey is the request context key of who is creating an account
+const creatorContextKey contextKey = "creator"
+
+// withCreator returns a copy of ctx that creates accounts as creator
+func withCreator(ctx context.Context, creator string) context.Context {
+	return context.WithValue(ctx, creatorContextKey, creator)
+}
+
+// resolveRole returns the role of an account created in ctx that asked for
+// requested. Admins get the role they ask for, or the default one when they
+// don't. Anyone else signing up gets the default role whatever they ask for.
+func resolveRole(ctx context.Context, requested string) (string, error) {
+	creator, _ := ctx.Value(creatorContextKey).(string)
+	if creator != creatorAdmin || requested == "" {
+		return defaultRole, nil
+	}
+	if !isValidRole(requested) {
+		return "", fieldError("role", "Unknown role: "+requested)
+	}
+	return requested, nil
+}
+
+func isValidRole(name string) bool {
+	for _, role := range roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// scopesFor returns the scopes role grants, matching role names like hasRole
+// does. Unknown roles grant nothing.
+func scopesFor(role string) []string {
+	for _, r := range roles {
+		if strings.EqualFold(r.Name, role) {
+			return r.Scopes
+		}
+	}
+	return []string{}
+}
+
+// rolesWithScope returns the roles that grant scope, which are how users
+// have scopes
+func rolesWithScope(scope string) []string {
+	granting := []string{}
+	for _, role := range roles {
+		for _, granted := range role.Scopes {
+			if granted == scope {
+				granting = append(granting, role.Name)
+				break
+			}
+		}
+	}
+	return granting
+}
+
+// roleMatchers returns what matches the stored role of users with any of
+// names, ignoring case like hasRole does
+func roleMatchers(names []string) []bson.RegEx {
+	matchers := make([]bson.RegEx, 0, len(names))
+	for _, name := range names {
+		matchers = append(matchers, bson.RegEx{Pattern: "^" + regexp.QuoteMeta(name) + "$", Options: "i"})
+	}
+	return matchers
+}
+
+// scopeDiff returns the scopes moving a user from one role to another would
+// add and remove
+func scopeDiff(from, to string) ([]string, []string) {
+	fromScopes, toScopes := scopesFor(from), scopesFor(to)
+	return missingScopes(toScopes, fromScopes), missingScopes(fromScopes, toScopes)
+}
+
+// missingScopes returns the scopes of scopes that aren't in others
+func missingScopes(scopes, others []string) []string {
+	missing := []string{}
+	for _, scope := range scopes {
+		found := false
+		for _, other := range others {
+			if scope == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
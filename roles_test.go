@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+	"github.com/gorilla/mux"
+)
+
+func TestScopesFor(t *testing.T) {
+	if scopes := scopesFor("Admin"); len(scopes) != 3 {
+		t.Errorf("Expected role names to match regardless of case but got: %v", scopes)
+	}
+
+	if scopes := scopesFor("student"); len(scopes) != 1 || scopes[0] != scopeUsersRead {
+		t.Errorf("Expected the student scopes but got: %v", scopes)
+	}
+
+	if scopes := scopesFor("unknown"); scopes == nil || len(scopes) != 0 {
+		t.Errorf("Expected an unknown role to grant no scopes but got: %v", scopes)
+	}
+}
+
+func TestScopeDiff(t *testing.T) {
+	added, removed := scopeDiff("student", "admin")
+	if len(added) != 2 || added[0] != scopeUsersWrite || added[1] != scopeLoginAttemptsRead || len(removed) != 0 {
+		t.Errorf("Expected promoting a student to add the admin scopes but got: %v %v", added, removed)
+	}
+
+	added, removed = scopeDiff("admin", "student")
+	if len(added) != 0 || len(removed) != 2 {
+		t.Errorf("Expected demoting an admin to remove the admin scopes but got: %v %v", added, removed)
+	}
+
+	if added, removed = scopeDiff("student", "Student"); len(added) != 0 || len(removed) != 0 {
+		t.Errorf("Expected the same role to change nothing but got: %v %v", added, removed)
+	}
+}
+
+func TestResolveRole(t *testing.T) {
+	signup := withCreator(context.Background(), creatorSignup)
+	admin := withCreator(context.Background(), creatorAdmin)
+
+	tests := []struct {
+		ctx       context.Context
+		requested string
+		want      string
+		wantErr   bool
+	}{
+		// Signups always get the default role
+		{signup, "", defaultRole, false},
+		{signup, "admin", defaultRole, false},
+		{context.Background(), "admin", defaultRole, false},
+
+		// Admins get the role they ask for, if it exists
+		{admin, "", defaultRole, false},
+		{admin, "admin", "admin", false},
+		{admin, "teacher", "", true},
+	}
+
+	for _, test := range tests {
+		role, err := resolveRole(test.ctx, test.requested)
+		if role != test.want || (err != nil) != test.wantErr {
+			t.Errorf("Expected %q to resolve to %q (error %v) but got: %q, %v", test.requested, test.want, test.wantErr, role, err)
+		}
+	}
+}
+
+// roleResolvingService creates users with the role resolved for them,
+// without a database
+type roleResolvingService struct {
+	UserService
+}
+
+func (roleResolvingService) Create(ctx context.Context, newUser *model.CreateUser) (*model.User, error) {
+	role, err := resolveRole(ctx, newUser.Role)
+	if err != nil {
+		return nil, err
+	}
+	return &model.User{Username: newUser.Username, Role: role}, nil
+}
+
+func TestCreateUserRoleByCreator(t *testing.T) {
+	adminToken, err := generateToken("adminID", "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	studentToken, err := generateToken("studentID", "student", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		role  string
+		want  string
+	}{
+		{"", "admin", defaultRole},
+		{"", "", defaultRole},
+		{studentToken, "admin", defaultRole},
+		{adminToken, "admin", "admin"},
+		{adminToken, "", defaultRole},
+	}
+
+	handler := handleCreateUser(roleResolvingService{})
+	for _, test := range tests {
+		body := `{"email":"jane@test.com","first_name":"Jane","last_name":"Doe","username":"janeDoe","password":"correct horse battery","role":"` + test.role + `"}`
+		req := httptest.NewRequest("POST", "/users", strings.NewReader(body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected a 201 status code response but got: %d %s", rec.Code, rec.Body.String())
+		}
+		var payload = &reqres.CreateUserResponse{}
+		if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.User.Role != test.want {
+			t.Errorf("Expected asking for %q to create a %q but got: %q", test.role, test.want, payload.User.Role)
+		}
+	}
+}
+
+// roleListingService lists its users by role, without a database
+type roleListingService struct {
+	UserService
+	users []model.User
+}
+
+func (svc roleListingService) List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	listed := []model.User{}
+	for _, user := range svc.users {
+		for _, role := range opts.Roles {
+			if strings.EqualFold(user.Role, role) {
+				listed = append(listed, user)
+				break
+			}
+		}
+	}
+	return listed, len(listed), nil
+}
+
+func TestListUsersByScope(t *testing.T) {
+	svc := roleListingService{users: []model.User{
+		{ID: "adminID", Role: "Admin"},
+		{ID: "studentID", Role: "student"},
+	}}
+
+	router := mux.NewRouter()
+	router.Handle("/admin/users/by-scope/{scope}", adminMiddleware(handleListUsersByScope(svc)))
+	token, err := generateToken("adminID", "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := func(scope string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/users/by-scope/"+scope, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Admins have users:write through their role, students don't
+	rec := list(scopeUsersWrite)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d %s", rec.Code, rec.Body.String())
+	}
+	var payload = &reqres.ListUsersResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Total != 1 || len(payload.Users) != 1 || payload.Users[0].ID != "adminID" {
+		t.Errorf("Expected only the admin to have the scope but got: %+v", payload.Users)
+	}
+
+	if rec := list(scopeUsersRead); !strings.Contains(rec.Body.String(), "studentID") || !strings.Contains(rec.Body.String(), "adminID") {
+		t.Errorf("Expected every role granting the scope to be listed but got: %s", rec.Body.String())
+	}
+
+	if rec := list("users:delete"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code response for a scope no role grants but got: %d", rec.Code)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/buzzapp/user/reqres"
+)
+
+// schemaVersionHeader lets clients pick the version of the request body
+// schema they send, so older clients keep working as the schema evolves
+const schemaVersionHeader = "X-Schema-Version"
+
+// latestCreateUserSchema is the create user schema of requests that don't pick
+// a version
+const latestCreateUserSchema = "2"
+
+var errUnknownSchemaVersion = errors.New("unknown schema version")
+
+// createUserDecoders decode each version of the create user request body into
+// the current request
+var createUserDecoders = map[string]func(io.Reader) (*reqres.CreateUserRequest, error){
+	"1": decodeCreateUserRequestV1,
+	"2": decodeCreateUserRequestV2,
+}
+
+// decodeCreateUserRequest decodes the body of r according to the schema
+// version it asks for
+func decodeCreateUserRequest(r *http.Request) (*reqres.CreateUserRequest, error) {
+	version := strings.TrimSpace(r.Header.Get(schemaVersionHeader))
+	if version == "" {
+		version = latestCreateUserSchema
+	}
+
+	decode, ok := createUserDecoders[version]
+	if !ok {
+		return nil, errUnknownSchemaVersion
+	}
+	return decode(r.Body)
+}
+
+func decodeCreateUserRequestV2(body io.Reader) (*reqres.CreateUserRequest, error) {
+	var payload = &reqres.CreateUserRequest{}
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// decodeCreateUserRequestV1 maps the single name field of version 1 onto the
+// first and last names, splitting at the first space
+func decodeCreateUserRequestV1(body io.Reader) (*reqres.CreateUserRequest, error) {
+	var payload = &reqres.CreateUserRequestV1{}
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		return nil, err
+	}
+
+	names := strings.Fields(payload.Name)
+	firstName, lastName := "", ""
+	if len(names) > 0 {
+		firstName, lastName = names[0], strings.Join(names[1:], " ")
+	}
+
+	return &reqres.CreateUserRequest{
+		Email:              payload.Email,
+		FirstName:          firstName,
+		LastName:           lastName,
+		Password:           payload.Password,
+		Role:               payload.Role,
+		Username:           payload.Username,
+		DateOfBirth:        payload.DateOfBirth,
+		AcceptedTOSVersion: payload.AcceptedTOSVersion,
+	}, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCreateUserRequestVersions(t *testing.T) {
+	decode := func(version, body string) interface{} {
+		req := httptest.NewRequest("POST", "/users", strings.NewReader(body))
+		if version != "" {
+			req.Header.Set(schemaVersionHeader, version)
+		}
+		payload, err := decodeCreateUserRequest(req)
+		if err != nil {
+			t.Fatalf("Expected version %q to decode but got: %v", version, err)
+		}
+		return payload
+	}
+
+	v1 := decode("1", `{"email": "jane@test.com", "name": "Jane van Doe", "password": "secret", "role": "student", "username": "jane"}`)
+	v2 := decode("2", `{"email": "jane@test.com", "first_name": "Jane", "last_name": "van Doe", "password": "secret", "role": "student", "username": "jane"}`)
+	if !reflect.DeepEqual(v1, v2) {
+		t.Errorf("Expected both versions to decode the same but got: %+v and %+v", v1, v2)
+	}
+
+	// Requests without a version get the latest
+	latest := decode("", `{"email": "jane@test.com", "first_name": "Jane", "last_name": "van Doe", "password": "secret", "role": "student", "username": "jane"}`)
+	if !reflect.DeepEqual(latest, v2) {
+		t.Errorf("Expected the latest version by default but got: %+v", latest)
+	}
+
+	req := httptest.NewRequest("POST", "/users", strings.NewReader(`{}`))
+	req.Header.Set(schemaVersionHeader, "3")
+	if _, err := decodeCreateUserRequest(req); err != errUnknownSchemaVersion {
+		t.Errorf("Expected an unknown version to be refused but got: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxSearchCandidates is how many of the users merely containing a search, or
+// close to it, are ranked by relevance. Searches matching more users than
+// that only rank the oldest of them, after all the users equal to or starting
+// like the search.
+const maxSearchCandidates = 1000
+
+// fuzzyPrefixLength is how much of a search has to be typed right for fuzzy
+// matches. Only users starting like the search are considered for typos after
+// that.
+const fuzzyPrefixLength = 2
+
+// Relevance of the ways a field can match a search
+const (
+	scoreExact      = 100
+	scorePrefix     = 80
+	scoreWordPrefix = 60
+	scoreContains   = 40
+	scoreFuzzy      = 20
+)
+
+// searchTiers are the queries for the users matching text best, best first:
+// the ones with a field equal to it, then the ones with a field starting with
+// it. Users in a tier are all as relevant as each other, so tiers can be
+// counted and paged by the database. Being anchored, they can be answered
+// from the indexes.
+func searchTiers(text string) [][]bson.M {
+	quoted := regexp.QuoteMeta(text)
+	exact := bson.RegEx{Pattern: "^" + quoted + "$", Options: "i"}
+	prefix := bson.RegEx{Pattern: "^" + quoted, Options: "i"}
+	return [][]bson.M{
+		{{"username": exact}, {"first_name": exact}, {"last_name": exact}, emailQuery(text), {"email": exact}},
+		{{"username": prefix}, {"first_name": prefix}, {"last_name": prefix}, {"email": prefix}},
+	}
+}
+
+// searchCandidatesQuery matches the users that could be relevant to text: the
+// ones containing it, and for typos the ones with a name starting like it.
+// Anchored patterns can be answered from the name indexes.
+func searchCandidatesQuery(text string) []bson.M {
+	clauses := searchQuery(text)
+	runes := []rune(text)
+	if len(runes) <= fuzzyPrefixLength || maxEdits(text) == 0 {
+		return clauses
+	}
+
+	pattern := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(string(runes[:fuzzyPrefixLength])), Options: "i"}
+	return append(clauses, bson.M{"username": pattern}, bson.M{"first_name": pattern}, bson.M{"last_name": pattern})
+}
+
+// searchQuery matches users whose username, names or email contain text,
+// ignoring case. Encrypted emails only match as a whole.
+func searchQuery(text string) []bson.M {
+	pattern := bson.RegEx{Pattern: regexp.QuoteMeta(text), Options: "i"}
+	return []bson.M{
+		{"username": pattern},
+		{"first_name": pattern},
+		{"last_name": pattern},
+		emailQuery(text),
+		{"email": pattern},
+	}
+}
+
+// searchMatchQuery matches the users matching text the way match says
+func searchMatchQuery(text string, match searchMatch) bson.M {
+	tiers := searchTiers(text)
+	switch match {
+	case searchExact:
+		return bson.M{"$or": tiers[0]}
+	case searchPrefix:
+		return bson.M{"$or": tiers[1], "$nor": []bson.M{{"$or": tiers[0]}}}
+	case searchCandidates:
+		return bson.M{"$or": searchCandidatesQuery(text), "$nor": []bson.M{{"$or": tiers[0]}, {"$or": tiers[1]}}}
+	}
+	return bson.M{"$or": searchQuery(text)}
+}
+
+// matchesSearch reports whether user matches text the way match says, like
+// searchMatchQuery does in the database
+func matchesSearch(user *model.User, text string, match searchMatch) bool {
+	text = strings.ToLower(text)
+	names := []string{strings.ToLower(user.Username), strings.ToLower(user.FirstName), strings.ToLower(user.LastName)}
+	fields := append(names, strings.ToLower(user.Email))
+	anyField := func(fields []string, matches func(field string) bool) bool {
+		for _, field := range fields {
+			if matches(field) {
+				return true
+			}
+		}
+		return false
+	}
+
+	exact := anyField(fields, func(field string) bool { return field == text }) || emailKey(user.Email) == emailKey(text)
+	prefix := anyField(fields, func(field string) bool { return strings.HasPrefix(field, text) })
+	contains := anyField(fields, func(field string) bool { return strings.Contains(field, text) })
+	switch match {
+	case searchExact:
+		return exact
+	case searchPrefix:
+		return prefix && !exact
+	case searchCandidates:
+		if exact || prefix {
+			return false
+		}
+		runes := []rune(text)
+		if contains || len(runes) <= fuzzyPrefixLength || maxEdits(text) == 0 {
+			return contains
+		}
+		start := string(runes[:fuzzyPrefixLength])
+		return anyField(names, func(field string) bool { return strings.HasPrefix(field, start) })
+	}
+	return contains || exact
+}
+
+// rankSearchResults returns the page of users opts asks for, most relevant to
+// opts.Query first, and how many users are relevant at all. Users as relevant
+// as each other keep their order.
+func rankSearchResults(users []model.User, opts model.ListOptions) ([]model.User, int) {
+	scores := make(map[string]int, len(users))
+	relevant := []model.User{}
+	for _, user := range users {
+		if score := searchScore(&user, opts.Query); score > 0 {
+			scores[user.ID] = score
+			relevant = append(relevant, user)
+		}
+	}
+	sort.SliceStable(relevant, func(i, j int) bool {
+		return scores[relevant[i].ID] > scores[relevant[j].ID]
+	})
+
+	total := len(relevant)
+	start := opts.Offset
+	if start > total {
+		start = total
+	}
+	end := total
+	if opts.Limit > 0 && start+opts.Limit < total {
+		end = start + opts.Limit
+	}
+	return relevant[start:end], total
+}
+
+// searchScore is how relevant user is to text, going by the field matching it
+// best. Users that don't match at all score 0.
+func searchScore(user *model.User, text string) int {
+	text = strings.ToLower(text)
+	best := 0
+	for _, field := range []string{user.Username, user.FirstName, user.LastName, user.FirstName + " " + user.LastName, user.Email} {
+		if score := fieldScore(strings.ToLower(field), text); score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// fieldScore is how well field matches text, both in lower case
+func fieldScore(field, text string) int {
+	switch {
+	case field == "":
+		return 0
+	case field == text:
+		return scoreExact
+	case strings.HasPrefix(field, text):
+		return scorePrefix
+	}
+
+	for _, word := range strings.FieldsFunc(field, isWordSeparator) {
+		if strings.HasPrefix(word, text) {
+			return scoreWordPrefix
+		}
+	}
+	if strings.Contains(field, text) {
+		return scoreContains
+	}
+
+	// Typos: the start of the field, as long as the search, is a few edits
+	// away from it
+	limit := maxEdits(text)
+	if limit == 0 {
+		return 0
+	}
+	length := len([]rune(text))
+	for _, word := range append([]string{field}, strings.FieldsFunc(field, isWordSeparator)...) {
+		start := []rune(word)
+		if len(start) > length {
+			start = start[:length]
+		}
+		if editDistance([]rune(text), start) <= limit {
+			return scoreFuzzy
+		}
+	}
+	return 0
+}
+
+// maxEdits is how many typos a search can have, more for longer searches.
+// Short searches have to match exactly.
+func maxEdits(text string) int {
+	switch length := len([]rune(text)); {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	}
+	return 2
+}
+
+func isWordSeparator(r rune) bool {
+	return r == ' ' || r == '.' || r == '_' || r == '-' || r == '@' || r == '+'
+}
+
+// editDistance is the Levenshtein distance between a and b: how many runes
+// have to be inserted, removed or replaced to turn one into the other
+func editDistance(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
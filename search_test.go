@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSearchScore(t *testing.T) {
+	user := &model.User{Username: "jsmith", FirstName: "Johnathan", LastName: "Smith", Email: "john.smith@example.com"}
+	for _, test := range []struct {
+		text  string
+		score int
+	}{
+		{"JSMITH", scoreExact},
+		{"john", scorePrefix},
+		{"smi", scorePrefix},
+		{"example", scoreWordPrefix},
+		{"athan", scoreContains},
+		{"jonhathan", scoreFuzzy},
+		{"smoth", scoreFuzzy},
+		{"jx", 0},
+		{"xyzzy", 0},
+	} {
+		if got := searchScore(user, test.text); got != test.score {
+			t.Errorf("Expected %q to score %d but got: %d", test.text, test.score, got)
+		}
+	}
+}
+
+func TestRankSearchResults(t *testing.T) {
+	users := []model.User{
+		{ID: "containsID", Username: "mariaanne"},
+		{ID: "unrelatedID", Username: "bob"},
+		{ID: "exactID", Username: "anne"},
+		{ID: "prefixID", Username: "annette"},
+		{ID: "typoID", Username: "amne"},
+	}
+
+	ranked, total := rankSearchResults(users, model.ListOptions{Query: "anne", Limit: 10})
+	if total != 4 {
+		t.Fatalf("Expected 4 relevant users but got: %d", total)
+	}
+	for i, id := range []string{"exactID", "prefixID", "containsID", "typoID"} {
+		if ranked[i].ID != id {
+			t.Errorf("Expected %s at %d but got: %s", id, i, ranked[i].ID)
+		}
+	}
+
+	page, total := rankSearchResults(users, model.ListOptions{Query: "anne", Offset: 1, Limit: 2})
+	if total != 4 || len(page) != 2 || page[0].ID != "prefixID" || page[1].ID != "containsID" {
+		t.Errorf("Expected the second and third best matches but got: %v", page)
+	}
+}
+
+func TestSearchTiers(t *testing.T) {
+	tiers := searchTiers("a.b")
+	if len(tiers) != 2 {
+		t.Fatalf("Expected an exact and a prefix tier but got: %d", len(tiers))
+	}
+	for i, pattern := range []string{`^a\.b$`, `^a\.b`} {
+		for _, clause := range tiers[i] {
+			if regex, ok := clause["username"].(bson.RegEx); ok && (regex.Pattern != pattern || regex.Options != "i") {
+				t.Errorf("Expected tier %d to match usernames with %s but got: %s", i, pattern, regex.Pattern)
+			}
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"kitten", "sitting", 3},
+		{"anne", "amne", 1},
+		{"", "abc", 3},
+		{"héllo", "hello", 1},
+	} {
+		if got := editDistance([]rune(test.a), []rune(test.b)); got != test.distance {
+			t.Errorf("Expected %q and %q to be %d edits apart but got: %d", test.a, test.b, test.distance, got)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// SecretProvider is an interface for looking up secrets by name, e.g. a
+// Vault client or the process environment
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// fileSecretProvider reads secrets from the file named by NAME_FILE, the
+// convention used by Docker secrets
+type fileSecretProvider struct{}
+
+func (fileSecretProvider) Secret(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Secret files usually end with a newline that isn't part of the secret
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// envSecretProvider reads secrets straight from the environment
+type envSecretProvider struct{}
+
+func (envSecretProvider) Secret(name string) (string, error) {
+	return os.Getenv(name), nil
+}
+
+// chainSecretProvider asks each provider in turn and returns the first
+// non-empty secret, so earlier providers take precedence
+type chainSecretProvider []SecretProvider
+
+func (c chainSecretProvider) Secret(name string) (string, error) {
+	for _, provider := range c {
+		secret, err := provider.Secret(name)
+		if err != nil {
+			return "", err
+		}
+		if secret != "" {
+			return secret, nil
+		}
+	}
+	return "", nil
+}
+
+// defaultSecretProvider prefers secret files over plain environment variables
+var defaultSecretProvider SecretProvider = chainSecretProvider{fileSecretProvider{}, envSecretProvider{}}
+
+// loadSecrets overrides the built-in secrets with the ones found by provider
+func loadSecrets(provider SecretProvider) error {
+	secretKey, err := provider.Secret("JWT_SECRET")
+	if err != nil {
+		return err
+	}
+	if secretKey != "" {
+		SecretKey = secretKey
+	}
+
+	previousSecretKey, err := provider.Secret("JWT_PREVIOUS_SECRET")
+	if err != nil {
+		return err
+	}
+	if previousSecretKey != "" {
+		PreviousSecretKey = previousSecretKey
+	}
+
+	mongoURL, err := provider.Secret("MONGO_URL")
+	if err != nil {
+		return err
+	}
+	if mongoURL != "" {
+		MongoURL = mongoURL
+	}
+
+	mongoReplicaURL, err := provider.Secret("MONGO_REPLICA_URL")
+	if err != nil {
+		return err
+	}
+	if mongoReplicaURL != "" {
+		MongoReplicaURL = mongoReplicaURL
+	}
+
+	redisURL, err := provider.Secret("REDIS_URL")
+	if err != nil {
+		return err
+	}
+	if redisURL != "" {
+		RedisURL = redisURL
+	}
+
+	postgresURL, err := provider.Secret("POSTGRES_URL")
+	if err != nil {
+		return err
+	}
+	if postgresURL != "" {
+		PostgresURL = postgresURL
+	}
+
+	signingKey, err := provider.Secret("SERVICE_SIGNING_KEY")
+	if err != nil {
+		return err
+	}
+	if signingKey != "" {
+		ServiceSigningKey = signingKey
+	}
+
+	piiKey, err := provider.Secret("PII_ENCRYPTION_KEY")
+	if err != nil {
+		return err
+	}
+	if piiKey != "" {
+		PIIEncryptionKey = piiKey
+	}
+
+	pepper, err := provider.Secret("PASSWORD_PEPPER")
+	if err != nil {
+		return err
+	}
+	if pepper != "" {
+		PasswordPepper = pepper
+	}
+
+	previousPepper, err := provider.Secret("PASSWORD_PREVIOUS_PEPPER")
+	if err != nil {
+		return err
+	}
+	if previousPepper != "" {
+		PreviousPasswordPepper = previousPepper
+	}
+
+	googleSecret, err := provider.Secret("OAUTH_GOOGLE_CLIENT_SECRET")
+	if err != nil {
+		return err
+	}
+	if googleSecret != "" {
+		OAuthGoogleClientSecret = googleSecret
+	}
+
+	githubSecret, err := provider.Secret("OAUTH_GITHUB_CLIENT_SECRET")
+	if err != nil {
+		return err
+	}
+	if githubSecret != "" {
+		OAuthGitHubClientSecret = githubSecret
+	}
+
+	ldapBindPassword, err := provider.Secret("LDAP_BIND_PASSWORD")
+	if err != nil {
+		return err
+	}
+	if ldapBindPassword != "" {
+		LDAPBindPassword = ldapBindPassword
+	}
+
+	webhookSecret, err := provider.Secret("WEBHOOK_SECRET")
+	if err != nil {
+		return err
+	}
+	if webhookSecret != "" {
+		WebhookSecret = webhookSecret
+	}
+
+	return nil
+}
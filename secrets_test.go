@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSecretFileConvention(t *testing.T) {
+	file, err := ioutil.TempFile("", "jwt-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString("file-secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	os.Setenv("TEST_SECRET", "env-secret")
+	defer os.Unsetenv("TEST_SECRET")
+
+	// Plain environment variables are used when there is no file
+	secret, err := defaultSecretProvider.Secret("TEST_SECRET")
+	if err != nil {
+		t.Error(err)
+	}
+	if secret != "env-secret" {
+		t.Errorf("Expected the env secret but got: %q", secret)
+	}
+
+	// The file wins when both are set
+	os.Setenv("TEST_SECRET_FILE", file.Name())
+	defer os.Unsetenv("TEST_SECRET_FILE")
+
+	secret, err = defaultSecretProvider.Secret("TEST_SECRET")
+	if err != nil {
+		t.Error(err)
+	}
+	if secret != "file-secret" {
+		t.Errorf("Expected the file secret but got: %q", secret)
+	}
+
+	// A missing file is an error rather than a silent fallback
+	os.Setenv("TEST_SECRET_FILE", file.Name()+".missing")
+	if _, err := defaultSecretProvider.Secret("TEST_SECRET"); err == nil {
+		t.Error("Expected an error for a missing secret file")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	handler := securityHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(overTLS bool) http.Header {
+		req := httptest.NewRequest("GET", "/users", nil)
+		if overTLS {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Header()
+	}
+
+	header := serve(true)
+	for key, want := range map[string]string{
+		"Strict-Transport-Security": securityHSTS,
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           securityFrameOptions,
+		"Content-Security-Policy":   securityCSP,
+	} {
+		if got := header.Get(key); got != want {
+			t.Errorf("Expected %s to be %q but got: %q", key, want, got)
+		}
+	}
+
+	// HSTS is only sent over TLS
+	if got := serve(false).Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Expected no HSTS header without TLS but got: %q", got)
+	}
+
+	// Each header can be turned off
+	defer func(frameOptions string) { securityFrameOptions = frameOptions }(securityFrameOptions)
+	securityFrameOptions = ""
+	header = serve(true)
+	if _, ok := header["X-Frame-Options"]; ok {
+		t.Errorf("Expected no X-Frame-Options header once disabled")
+	}
+	if header.Get("X-Content-Type-Options") == "" {
+		t.Errorf("Expected the other headers to still be sent")
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	if v, err := parseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3 but got: %v %v", v, err)
+	}
+	for _, version := range []string{"", "1.0", "1.1", "tls1.2"} {
+		if _, err := parseTLSVersion(version); err == nil {
+			t.Errorf("Expected %q to be refused", version)
+		}
+	}
+}
@@ -1,283 +1,2787 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 
 	"github.com/buzzapp/user/model"
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+var (
+	// SecretKey is the key to hash the JWT token, set by the JWT_SECRET secret.
+	// It also keys the hashes of one-time codes, so it's required with RS256 too.
+	SecretKey = ""
+
+	// MongoURL is the address of the database, overridden by the MONGO_URL
+	// secret since it may carry credentials
+	MongoURL = ":27017"
+)
+
+var (
+	errUserNotFound      = errors.New("user not found")
+	errDuplicateEmail    = errors.New("email address already in use")
+	errDuplicateUsername = errors.New("username already in use")
+
+	// errInvalidCredentials is returned for every failed login, so callers
+	// can't tell whether the username exists
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Reasons recorded for failed login attempts
 const (
-	// SecretKey is the key to hash the JWT token
-	SecretKey = "33266AB738F764C2A3DD5D8F38336"
+	loginReasonUnknownUser = "unknown_user"
+	loginReasonBadPassword = "bad_password"
+	loginReasonInactive    = "inactive_account"
+)
+
+var (
+	// currentTOSVersion is the terms of service version users have to accept
+	currentTOSVersion = ""
+
+	// requireTOSAcceptance makes signups accept currentTOSVersion and flags
+	// logins of users who haven't accepted it, e.g. after a version bump
+	requireTOSAcceptance = false
 )
 
+// loginAttemptRetention is how long login attempts are kept before the
+// database expires them
+var loginAttemptRetention = 30 * 24 * time.Hour
+
 // UserService is an interface for controlling users
 type UserService interface {
-	Create(newUser *model.CreateUser) (*model.User, error)
-	GetAll() ([]model.User, error)
-	GetByID(id string) (*model.User, error)
-	Login(username, password, referer string) (model.JWTToken, error)
-	RefreshToken(userID, username, role, referer string) (model.JWTToken, error)
-	Remove(id string) error
-	Update(updatedUser *model.UpdateUser) (*model.User, error)
+	Create(ctx context.Context, newUser *model.CreateUser) (*model.User, error)
+	GetAll(ctx context.Context) ([]model.User, error)
+	AcceptInvitation(ctx context.Context, token, password string) (*model.User, error)
+	AcceptTOS(ctx context.Context, userID, version string) error
+	AddGroupMember(ctx context.Context, groupID, userID string) error
+	CheckInvitation(ctx context.Context, token string) (*model.Invitation, *model.User, error)
+	CollectTokenGarbage(ctx context.Context, now time.Time) (*model.TokenGarbage, error)
+	CancelClose(ctx context.Context, username, password string) (*model.User, error)
+	ChangePassword(ctx context.Context, id, currentPassword, newPassword string) error
+	CloseAccount(ctx context.Context, id string) (*model.User, error)
+	CreateAPIKey(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (*model.APIKey, string, error)
+	CreateChallenge(ctx context.Context, userID string) (time.Time, error)
+	CreateGroup(ctx context.Context, name, description string) (*model.Group, error)
+	CreatePasswordReset(ctx context.Context, email string) error
+	Delete(ctx context.Context, id string) error
+	DeleteGroup(ctx context.Context, id string) error
+	GetByID(ctx context.Context, id string) (*model.User, error)
+	GetByIDIncludingDeleted(ctx context.Context, id string) (*model.User, error)
+	GetByEmail(ctx context.Context, email string) (*model.User, error)
+	GetByUsername(ctx context.Context, username string) (*model.User, error)
+	GetChanges(ctx context.Context, since time.Time, cursor string, limit int) ([]model.UserChange, string, error)
+	GetDuplicates(ctx context.Context, criteria []string, offset, limit int) ([]model.DuplicateGroup, int, error)
+	GetGroup(ctx context.Context, id string) (*model.Group, error)
+	GetLoginAttempts(ctx context.Context, userID string) ([]model.LoginAttempt, error)
+	GetSecurityEvents(ctx context.Context, userID string, opts model.ListOptions) ([]model.SecurityEvent, int, error)
+	GetSecurityReport(ctx context.Context, userID string, from, to time.Time) (*model.SecurityReport, error)
+	InvalidateResetTokens(ctx context.Context, userID string) (int, error)
+	InviteUser(ctx context.Context, invitee *model.CreateUser, invitedBy string) (*model.Invitation, error)
+	LinkIdentity(ctx context.Context, userID string, profile *model.ExternalProfile) (*model.User, error)
+	List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error)
+	ListAPIKeys(ctx context.Context, userID string) ([]model.APIKey, error)
+	ListGroups(ctx context.Context, opts model.ListOptions) ([]model.Group, int, error)
+	ListInvitations(ctx context.Context, opts model.ListOptions) ([]model.Invitation, int, error)
+	Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error)
+	LoginWithProvider(ctx context.Context, profile *model.ExternalProfile, referer string) (*model.LoginResult, error)
+	Ping(ctx context.Context) error
+	PurgeClosedAccounts(ctx context.Context, now time.Time) ([]string, error)
+	RefreshToken(ctx context.Context, refreshToken, origin string) (*model.LoginResult, error)
+	Reactivate(ctx context.Context, id string) (*model.User, error)
+	Revoke(ctx context.Context, tokenID string, expiry time.Time) error
+	RevokeAPIKey(ctx context.Context, userID, keyID string) error
+	RevokeInvitation(ctx context.Context, id string) error
+	RevokeSession(ctx context.Context, userID, sessionID string) error
+	RevokeSessions(ctx context.Context, userID string) error
+	Remove(ctx context.Context, id string) error
+	RemoveGroupMember(ctx context.Context, groupID, userID string) error
+	ReissueID(ctx context.Context, id string) (*model.User, error)
+	ReleaseUsername(ctx context.Context, username, token string) error
+	ReserveUsername(ctx context.Context, username string) (string, time.Time, error)
+	ResetPassword(ctx context.Context, token, newPassword string) (*model.User, error)
+	ResolveUsernames(ctx context.Context, usernames []string) ([]model.ResolvedUser, error)
+	Search(ctx context.Context, opts model.ListOptions) ([]model.User, int, error)
+	UnlinkIdentity(ctx context.Context, userID, provider string) (*model.User, error)
+	DeactivateInactive(ctx context.Context, cutoff time.Time, dryRun bool) ([]string, error)
+	EndSession(ctx context.Context, userID, refreshToken string) error
+	EraseUser(ctx context.Context, id string) error
+	ExportUser(ctx context.Context, id string) (*model.UserExport, error)
+	ExportUsers(ctx context.Context, after string, fn func(user *model.User) error) error
+	GetStats(ctx context.Context) (*model.UserStats, error)
+	ListSessions(ctx context.Context, userID string) ([]model.Session, error)
+	ListUserGroups(ctx context.Context, userID string) ([]model.Group, error)
+	ResendVerification(ctx context.Context, email string) error
+	SetStatus(ctx context.Context, id, status string) (*model.User, error)
+	Update(ctx context.Context, id string, updatedUser *model.UpdateUser) (*model.User, error)
+	UpdateGroup(ctx context.Context, id string, update *model.UpdateGroup) (*model.Group, error)
+	UpdateAttributes(ctx context.Context, id string, update *model.AttributeUpdate) (*model.User, error)
+	VerifyChallenge(ctx context.Context, userID, code string) (string, time.Time, error)
+	VerifyEmail(ctx context.Context, token string) (*model.User, error)
 }
 
 type userService struct{}
 
-func (userService) Create(newUser *model.CreateUser) (*model.User, error) {
+func (userService) Create(ctx context.Context, newUser *model.CreateUser) (*model.User, error) {
+	// Signups can't pick their own role
+	role, err := resolveRole(ctx, newUser.Role)
+	if err != nil {
+		return nil, err
+	}
+
 	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(newUser.Password)
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now()
 	user := &model.User{
-		ID:        bson.NewObjectId().Hex(),
-		Email:     newUser.Email,
-		FirstName: newUser.FirstName,
-		LastName:  newUser.LastName,
-		Password:  string(hashedPassword),
-		Role:      newUser.Role,
-		Username:  newUser.Username,
-		Timestamp: time.Now().Unix(),
+		ID:                 bson.NewObjectId().Hex(),
+		Email:              newUser.Email,
+		FirstName:          newUser.FirstName,
+		LastName:           newUser.LastName,
+		Password:           hashedPassword,
+		Role:               role,
+		Username:           normalizeUsername(newUser.Username),
+		UsernameKey:        usernameKey(newUser.Username),
+		UsernameSkeleton:   usernameSkeleton(newUser.Username),
+		DateOfBirth:        newUser.DateOfBirth,
+		AcceptedTOSVersion: newUser.AcceptedTOSVersion,
+		Status:             signupStatus(),
+		Timestamp:          now.Unix(),
+		UpdatedAt:          now,
+		PasswordChangedAt:  &now,
 	}
 
-	//Grab a copy of our session
-	session, err := getSession()
+	if err := insertUser(ctx, user, newUser.ReservationToken); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// insertUser stores a new user, making sure its username and email are free
+// and that nobody else holds a reservation of the username
+func insertUser(ctx context.Context, user *model.User, reservationToken string) error {
+	if err := checkUsernameReservation(user.UsernameKey, reservationToken); err != nil {
+		return err
+	}
+	if err := userRepository.Create(ctx, user); err != nil {
+		return err
+	}
+	recentWrites.Mark(user.ID, user.Username)
+	consumeUsernameReservation(user.UsernameKey, reservationToken)
+
+	//A token that didn't make it can be resent, so it doesn't fail the signup
+	if user.Status == statusPending {
+		if err := sendEmailVerification(ctx, user); err != nil {
+			log.Println("unable to send email verification:", err)
+		}
+	}
+	welcomeOnSignup(user)
+
+	return nil
+}
+
+// findUser returns the first user filter picks, errUserNotFound when there
+// is none
+func findUser(ctx context.Context, filter UserFilter) (*model.User, error) {
+	users, err := userRepository.Find(ctx, filter, nil, 0, 1)
 	if err != nil {
 		return nil, err
 	}
-	defer session.Close()
+	if len(users) == 0 {
+		return nil, errUserNotFound
+	}
+	return &users[0], nil
+}
 
-	//Get our collection of applications
-	db := session.DB("buzz-test-user")
-	collection := db.C("users")
+// modifyUser makes change to the user selector picks, failing with notFound
+// when it picks none, and marks the user written along with keys such as
+// its username
+func modifyUser(ctx context.Context, selector UserFilter, change UserChange, notFound error, keys ...string) error {
+	changed, err := userRepository.Modify(ctx, selector, change)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return notFound
+	}
+	recentWrites.Mark(append(changed, keys...)...)
+	return nil
+}
 
-	// Create a unique index for email and username
-	index := mgo.Index{
-		Key:    []string{"username", "email"},
-		Unique: true,
+// sendEmailVerification issues an email verification to user
+func sendEmailVerification(ctx context.Context, user *model.User) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
 	}
-	err = collection.EnsureIndex(index)
+	defer session.Close()
+
+	return issueEmailVerification(session, user)
+}
+
+func (userService) AcceptTOS(ctx context.Context, userID, version string) error {
+	//Record the accepted version
+	return modifyUser(ctx, UserFilter{IDs: []string{userID}}, UserChange{Set: map[string]interface{}{"accepted_tos_version": version, "updated_at": time.Now()}}, errUserNotFound)
+}
+
+func (u userService) CancelClose(ctx context.Context, username, password string) (*model.User, error) {
+	// Closed accounts can't log in, so the password proves who is asking
+	user, err := u.GetByUsername(ctx, username)
 	if err != nil {
+		hashPassword(password)
+		return nil, errInvalidCredentials
+	}
+	if ok, _, err := verifyPassword(user.Password, password); err != nil || !ok {
+		return nil, errInvalidCredentials
+	}
+	if user.PurgeAt == nil || user.Status != statusDeactivated {
+		return nil, errNoPendingClose
+	}
+
+	//Only reopen the account if it hasn't been purged in the meantime
+	now := time.Now()
+	selector := UserFilter{IDs: []string{user.ID}, Statuses: []string{statusDeactivated}, PurgePending: true, NotDeleted: true}
+	change := UserChange{Set: map[string]interface{}{"status": statusActive, "updated_at": now}, Unset: []string{"purge_at"}}
+	if err := modifyUser(ctx, selector, change, errNoPendingClose, user.Username); err != nil {
 		return nil, err
 	}
 
-	//Insert our application
-	err = collection.Insert(user)
+	user.Status = statusActive
+	user.UpdatedAt = now
+	user.PurgeAt = nil
+	return user, nil
+}
+
+func (u userService) CloseAccount(ctx context.Context, id string) (*model.User, error) {
+	user, err := u.GetByID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
+	if accountStatus(user.Status) != statusActive {
+		return nil, statusTransitionError{from: accountStatus(user.Status), to: statusDeactivated}
+	}
+
+	//Deactivate the account now and purge it once the grace period is over
+	now := time.Now()
+	purgeAt := now.Add(accountCloseGrace)
+	selector := UserFilter{IDs: []string{id}, Statuses: []string{user.Status}, NotDeleted: true}
+	change := UserChange{Set: map[string]interface{}{"status": statusDeactivated, "purge_at": purgeAt, "updated_at": now}}
+	if err := modifyUser(ctx, selector, change, statusTransitionError{from: accountStatus(user.Status), to: statusDeactivated}, user.Username); err != nil {
+		return nil, err
+	}
+
+	user.Status = statusDeactivated
+	user.UpdatedAt = now
+	user.PurgeAt = &purgeAt
 	return user, nil
 }
 
-func (userService) GetAll() ([]model.User, error) {
+func (u userService) ChangePassword(ctx context.Context, id, currentPassword, newPassword string) error {
+	user, err := u.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// make sure it's the user asking, not just someone with their token
+	ok, _, err := verifyPassword(user.Password, currentPassword)
+	if err != nil || !ok {
+		return errInvalidCredentials
+	}
+
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	//Only replace the password that was checked
+	now := time.Now()
+	selector := UserFilter{IDs: []string{id}, Password: user.Password}
+	change := UserChange{Set: map[string]interface{}{"password": hashedPassword, "updated_at": now, "password_changed_at": now}}
+	if err := modifyUser(ctx, selector, change, errInvalidCredentials, user.Username); err != nil {
+		return err
+	}
+
 	//Grab a copy of our session
-	session, err := getSession()
+	session, err := getSessionContext(ctx)
 	if err != nil {
-		return []model.User{}, err
+		return err
 	}
 	defer session.Close()
 
-	//Get our collection of applications
-	db := session.DB("buzz-test-user")
-	collection := db.C("users")
+	//Log out the user's other sessions
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return err
+	}
+	return revokeUserRefreshTokens(refreshTokens, id)
+}
 
-	//Get our applications from the collection
-	var retrievedUsers []model.User
-	err = collection.Find(bson.M{}).All(&retrievedUsers)
+func (u userService) CreateChallenge(ctx context.Context, userID string) (time.Time, error) {
+	if challengeSender == nil {
+		return time.Time{}, errNoChallengeSender
+	}
+
+	user, err := u.GetByID(ctx, userID)
 	if err != nil {
-		return []model.User{}, err
+		return time.Time{}, err
 	}
 
-	return retrievedUsers, nil
-}
+	code, err := newChallengeCode()
+	if err != nil {
+		return time.Time{}, err
+	}
 
-func (userService) GetByID(id string) (*model.User, error) {
 	//Grab a copy of our session
-	session, err := getSession()
+	session, err := getSessionContext(ctx)
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
 	defer session.Close()
 
-	//Get our collection of applications
+	//Get our collection of challenges
 	db := session.DB("buzz-test-user")
-	collection := db.C("users")
+	collection := db.C("challenges")
 
-	//Get our applications from the collection
-	var retrievedUser *model.User
-	err = collection.Find(bson.M{"_id": id}).One(&retrievedUser)
-	if err != nil {
-		return nil, err
+	// Let the database drop expired challenges
+	index := mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second,
+	}
+	if err := collection.EnsureIndex(index); err != nil {
+		return time.Time{}, err
+	}
+
+	//A new challenge replaces the pending one, along with its attempts
+	challenge := &model.Challenge{
+		UserID:    user.ID,
+		CodeHash:  hashChallengeCode(user.ID, code),
+		ExpiresAt: time.Now().Add(challengeTTL),
+	}
+	if _, err := collection.UpsertId(user.ID, challenge); err != nil {
+		return time.Time{}, err
 	}
 
-	return retrievedUser, nil
+	if err := challengeSender.SendChallenge(user, code); err != nil {
+		collection.RemoveId(user.ID)
+		return time.Time{}, err
+	}
+
+	return challenge.ExpiresAt, nil
 }
 
-func (userService) GetByUsername(username string) (*model.User, error) {
+func (u userService) CreatePasswordReset(ctx context.Context, email string) error {
+	if passwordResetSender == nil {
+		return errNoPasswordResetSender
+	}
+
+	user, err := u.GetByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	//Locked, deactivated and deleted accounts can't be taken back this way
+	if accountStatus(user.Status) != statusActive {
+		return errUserNotFound
+	}
+
+	token, err := newRefreshToken()
+	if err != nil {
+		return err
+	}
+
 	//Grab a copy of our session
-	session, err := getSession()
+	session, err := getSessionContext(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer session.Close()
 
-	//Get our collection of applications
-	db := session.DB("buzz-test-user")
-	collection := db.C("users")
+	//Get our collection of password resets
+	collection, err := passwordResetCollection(session)
+	if err != nil {
+		return err
+	}
+
+	//A new reset replaces the pending ones
+	if _, err := collection.RemoveAll(bson.M{"user_id": user.ID}); err != nil {
+		return err
+	}
+	now := time.Now()
+	reset := &model.PasswordReset{
+		ID:        hashRefreshToken(token),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	}
+	if err := collection.Insert(reset); err != nil {
+		return err
+	}
+
+	if err := passwordResetSender.SendPasswordReset(user, token); err != nil {
+		collection.RemoveId(reset.ID)
+		return err
+	}
+
+	return nil
+}
+
+func (userService) Delete(ctx context.Context, id string) error {
+	if err := userRepository.Delete(ctx, id); err != nil {
+		return err
+	}
+	recentWrites.Mark(id)
 
-	//Get our applications from the collection
-	var retrievedUser *model.User
-	err = collection.Find(bson.M{"username": username}).One(&retrievedUser)
+	return nil
+}
+
+// Reactivate brings a soft-deleted user back as an active user. Their email
+// and username stayed taken while they were deleted, so nobody else can have
+// them.
+func (userService) Reactivate(ctx context.Context, id string) (*model.User, error) {
+	user, err := userRepository.GetByID(ctx, id, true)
 	if err != nil {
 		return nil, err
 	}
+	if user.DeletedAt == nil {
+		return nil, errNotDeleted
+	}
+	if user.ErasedAt != nil {
+		return nil, errUserErased
+	}
+
+	// Their names may have been taken while they weren't reserved
+	if !reserveDeletedNames {
+		if err := checkNamesAvailable(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+
+	//Only bring the user back if they are still deleted, and weren't erased
+	now := time.Now()
+	selector := UserFilter{IDs: []string{id}, OnlyDeleted: true, NotErased: true}
+	change := UserChange{Set: map[string]interface{}{"status": statusActive, "updated_at": now}, Unset: []string{"deleted_at"}}
+	if err := modifyUser(ctx, selector, change, errNotDeleted, user.Username); err != nil {
+		return nil, err
+	}
+
+	user.Status = statusActive
+	user.UpdatedAt = now
+	user.DeletedAt = nil
+	return user, nil
+}
+
+func (userService) GetAll(ctx context.Context) ([]model.User, error) {
+	users, _, err := userRepository.List(ctx, model.ListOptions{})
+	if partial, ok := err.(partialListError); ok && partial.warning == warnTotalUnavailable {
+		//Only the total is missing, which isn't asked for
+		return users, nil
+	}
+	return users, err
+}
+
+func (userService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	return userRepository.GetByID(ctx, id, false)
+}
+
+func (userService) GetByIDIncludingDeleted(ctx context.Context, id string) (*model.User, error) {
+	return userRepository.GetByID(ctx, id, true)
+}
+
+func (userService) GetByEmail(ctx context.Context, email string) (*model.User, error) {
+	return findUser(ctx, UserFilter{Email: email, NotDeleted: true})
+}
 
-	return retrievedUser, nil
+func (userService) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	return userRepository.GetByUsername(ctx, username)
 }
 
-func (u userService) Login(username, password, referer string) (model.JWTToken, error) {
-	// try to retrive the user by the username
-	user, err := u.GetByUsername(username)
+func (userService) GetChanges(ctx context.Context, since time.Time, cursor string, limit int) ([]model.UserChange, string, error) {
+	//Pick up after the last change of the previous page
+	filter := UserFilter{UpdatedAfter: &since}
+	if cursor != "" {
+		after, afterID, err := decodeChangesCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		filter = UserFilter{UpdatedAfter: &after, UpdatedAfterID: afterID}
+	}
+
+	//Oldest changes first, one more than the page to know if there is another
+	retrievedUsers, err := userRepository.Find(ctx, filter, []string{"updated_at", "_id"}, 0, limit+1)
 	if err != nil {
-		return "", errors.New("invalid username or password")
+		return nil, "", err
 	}
 
-	// compare the passwords
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return "", errors.New("invalid username or password")
+	next := ""
+	if len(retrievedUsers) > limit {
+		retrievedUsers = retrievedUsers[:limit]
+		last := retrievedUsers[limit-1]
+		next = encodeChangesCursor(last.UpdatedAt, last.ID)
 	}
 
-	tokenString, err := generateToken(user.ID, user.Username, user.Role, referer)
+	changes := make([]model.UserChange, 0, len(retrievedUsers))
+	for i := range retrievedUsers {
+		changes = append(changes, userChange(&retrievedUsers[i], since))
+	}
+
+	return changes, next, nil
+}
+
+func (userService) GetDuplicates(ctx context.Context, criteria []string, offset, limit int) ([]model.DuplicateGroup, int, error) {
+	//Normalized keys can't be matched by the database, so group the users here
+	retrievedUsers, err := userRepository.Find(ctx, UserFilter{NotDeleted: true}, nil, 0, 0)
 	if err != nil {
-		return "", err
+		return nil, 0, err
+	}
+
+	groups := findDuplicates(retrievedUsers, criteria)
+	total := len(groups)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		groups = groups[offset : offset+limit]
+	} else {
+		groups = groups[offset:]
 	}
 
-	return model.JWTToken(tokenString), nil
+	return groups, total, nil
 }
 
-func (userService) RefreshToken(userID, username, role, referer string) (model.JWTToken, error) {
-	tokenString, err := generateToken(userID, username, role, referer)
+func (userService) GetLoginAttempts(ctx context.Context, userID string) ([]model.LoginAttempt, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, userID)
 	if err != nil {
-		return "", err
+		return []model.LoginAttempt{}, err
+	}
+	defer session.Close()
+
+	//Get our collection of login attempts
+	db := session.DB("buzz-test-user")
+	collection := db.C("login_attempts")
+
+	//Get the user's attempts, newest first
+	retrievedAttempts := []model.LoginAttempt{}
+	err = collection.Find(bson.M{"user_id": userID}).Sort("-created_at").All(&retrievedAttempts)
+	if err != nil {
+		return []model.LoginAttempt{}, err
 	}
 
-	return model.JWTToken(tokenString), nil
+	return retrievedAttempts, nil
 }
 
-func (userService) Remove(id string) error {
-	//Grab a copy of our session
-	session, err := getSession()
+// Types of security events
+const (
+	securityEventLogin       = "login"
+	securityEventLoginFailed = "login_failed"
+)
+
+// GetSecurityEvents returns a page of the recent security events of userID,
+// newest first, and how many there are. Only what the user did to their own
+// account is returned: failed logins don't say why they failed.
+func (userService) GetSecurityEvents(ctx context.Context, userID string, opts model.ListOptions) ([]model.SecurityEvent, int, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, userID)
 	if err != nil {
-		return err
+		return []model.SecurityEvent{}, 0, err
 	}
 	defer session.Close()
 
-	//Get our collection of applications
+	//Get our collection of login attempts
 	db := session.DB("buzz-test-user")
-	collection := db.C("users")
+	collection := db.C("login_attempts")
 
-	//remove our applications from the collection
-	err = collection.Remove(bson.M{"_id": id})
+	//The database only drops attempts past the retention every minute or so
+	query := collection.Find(bson.M{"user_id": userID, "created_at": bson.M{"$gte": time.Now().Add(-loginAttemptRetention)}})
+	total, err := query.Count()
 	if err != nil {
-		return err
+		return []model.SecurityEvent{}, 0, err
 	}
 
-	return nil
+	attempts := []model.LoginAttempt{}
+	err = query.Sort("-created_at").Skip(opts.Offset).Limit(opts.Limit).All(&attempts)
+	if err != nil {
+		return []model.SecurityEvent{}, 0, err
+	}
+
+	return securityEventsOf(attempts), total, nil
 }
 
-func (userService) Update(updatedUser *model.UpdateUser) (*model.User, error) {
-	user := &model.User{
-		ID:        updatedUser.ID,
-		Email:     updatedUser.Email,
-		FirstName: updatedUser.FirstName,
-		LastName:  updatedUser.LastName,
-		Password:  updatedUser.Password,
-		Role:      updatedUser.Role,
-		Username:  updatedUser.Username,
+// securityEventsOf summarizes login attempts as security events
+func securityEventsOf(attempts []model.LoginAttempt) []model.SecurityEvent {
+	events := make([]model.SecurityEvent, 0, len(attempts))
+	for _, attempt := range attempts {
+		event := model.SecurityEvent{Type: securityEventLogin, CreatedAt: attempt.CreatedAt}
+		if !attempt.Success {
+			event.Type = securityEventLoginFailed
+		}
+		events = append(events, event)
 	}
+	return events
+}
 
-	//Grab a copy of our session
-	session, err := getSession()
+func (u userService) GetSecurityReport(ctx context.Context, userID string, from, to time.Time) (*model.SecurityReport, error) {
+	user, err := u.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer session.Close()
 
-	//Get our collection of applications
+	//Get our collection of login attempts
 	db := session.DB("buzz-test-user")
-	collection := db.C("users")
+	collection := db.C("login_attempts")
 
-	// Create a unique index for email and username
-	index := mgo.Index{
-		Key:    []string{"username", "email"},
-		Unique: true,
+	//Limit the attempts to the range, zero times leave it open
+	query := bson.M{"user_id": userID}
+	createdAt := bson.M{}
+	if !from.IsZero() {
+		createdAt["$gte"] = from
 	}
-	err = collection.EnsureIndex(index)
-	if err != nil {
-		return nil, err
+	if !to.IsZero() {
+		createdAt["$lt"] = to
+	}
+	if len(createdAt) > 0 {
+		query["created_at"] = createdAt
 	}
 
-	//Insert our application
-	err = collection.Update(bson.M{"_id": updatedUser.ID}, user)
+	//Get the user's attempts, newest first
+	retrievedAttempts := []model.LoginAttempt{}
+	err = collection.Find(query).Sort("-created_at").All(&retrievedAttempts)
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	report := &model.SecurityReport{
+		UserID:        user.ID,
+		Status:        accountStatus(user.Status),
+		LoginAttempts: retrievedAttempts,
+	}
+
+	return report, nil
 }
 
-func generateToken(userID, username, role, referer string) (string, error) {
-	// Generate the JWT token
-	token := jwt.New(jwt.SigningMethodHS256)
-	token.Claims["sub"] = userID
-	token.Claims["iat"] = time.Now().Unix()
-	token.Claims["exp"] = time.Now().Add(time.Minute * 5).Unix() // Expire in 5 mins
-	token.Claims["nbf"] = time.Now().Unix()
-	token.Claims["iss"] = referer
-	token.Claims["jti"] = makeJTI(token.Claims["sub"], token.Claims["iat"])
-	token.Claims["username"] = username
-	token.Claims["role"] = role
-	tokenString, err := token.SignedString([]byte(SecretKey))
+func (userService) List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	return userRepository.List(ctx, opts)
+}
+
+func (userService) PurgeClosedAccounts(ctx context.Context, now time.Time) ([]string, error) {
+	//Soft delete the closed accounts past their grace period, like deleting
+	//them would, leaving the ones cancelled meanwhile
+	selector := UserFilter{Statuses: []string{statusDeactivated}, PurgeBy: now, NotDeleted: true}
+	change := UserChange{Set: map[string]interface{}{"status": statusDeleted, "deleted_at": now, "updated_at": now}, Unset: []string{"purge_at"}}
+	purged, err := userRepository.Modify(ctx, selector, change)
+	recentWrites.Mark(purged...)
 	if err != nil {
-		return "", err
+		return purged, err
 	}
 
-	return tokenString, nil
+	return purged, nil
 }
 
-func makeJTI(subject, issuedAt interface{}) []byte {
-	h := md5.New()
-	io.WriteString(h, subject.(string))
-	io.WriteString(h, strconv.Itoa(int(issuedAt.(int64))))
-	return h.Sum(nil)
-}
+func (userService) CollectTokenGarbage(ctx context.Context, now time.Time) (*model.TokenGarbage, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
 
-var globalSession *mgo.Session
+	// The database expires these by itself, but only every so often
+	garbage := &model.TokenGarbage{}
+	expired := bson.M{"expires_at": bson.M{"$lte": now}}
 
-func getSession() (*mgo.Session, error) {
-	//Establish our database connection
-	if globalSession == nil {
-		var err error
-		globalSession, err = mgo.Dial(":27017")
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	info, err := refreshTokens.RemoveAll(expired)
+	if err != nil {
+		return nil, err
+	}
+	garbage.RefreshTokens = info.Removed
+
+	//Families without a token left to use are what's left of sessions that
+	//ended, only kept around for spotting reuse. Tokens used just now may be
+	//waiting on their successor.
+	var families, live []string
+	if err := refreshTokens.Find(nil).Distinct("family_id", &families); err != nil {
+		return nil, err
+	}
+	liveSelector := bson.M{"$or": []bson.M{
+		{"used_at": bson.M{"$exists": false}},
+		{"used_at": bson.M{"$gt": now.Add(-staleFamilyGrace)}},
+	}}
+	if err := refreshTokens.Find(liveSelector).Distinct("family_id", &live); err != nil {
+		return nil, err
+	}
+	stale := staleTokenFamilies(families, live)
+	if len(stale) > 0 {
+		info, err := refreshTokens.RemoveAll(bson.M{"family_id": bson.M{"$in": stale}})
 		if err != nil {
 			return nil, err
 		}
+		garbage.TokenFamilies = len(stale)
+		garbage.RefreshTokens += info.Removed
+	}
 
-		//Optional. Switch the session to a monotonic behavior.
-		globalSession.SetMode(mgo.Monotonic, true)
+	//Used resets can't be used again either
+	resets, err := passwordResetCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	info, err = resets.RemoveAll(bson.M{"$or": []bson.M{expired, {"used_at": bson.M{"$exists": true}}}})
+	if err != nil {
+		return nil, err
 	}
+	garbage.PasswordResets = info.Removed
 
-	return globalSession.Copy(), nil
+	info, err = session.DB("buzz-test-user").C("challenges").RemoveAll(expired)
+	if err != nil {
+		return nil, err
+	}
+	garbage.Challenges = info.Removed
+
+	return garbage, nil
+}
+
+func (u userService) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	// check the credentials, against the directory if there's one
+	user, err := authenticator.Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// only active accounts can log in, and maybe pending ones
+	if !canLogIn(user.Status) {
+		recordLoginAttempt(user.ID, false, loginReasonInactive)
+		return nil, errInvalidCredentials
+	}
+
+	return startSession(ctx, user, referer)
+}
+
+// startSession logs in user, who has proven who they are, handing out an
+// access token and the first refresh token of a new family
+func startSession(ctx context.Context, user *model.User, referer string) (*model.LoginResult, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Every login starts a new family of refresh tokens, its session
+	sessionID := bson.NewObjectId().Hex()
+	groups, err := groupIDsOf(session, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	tokenString, err := generateSessionToken(user.ID, user.Username, user.Role, referer, sessionID, groups, isVerified(user))
+	if err != nil {
+		return nil, err
+	}
+
+	//Get our collection of refresh tokens
+	collection, err := refreshTokenCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	rememberMe := rememberMeFrom(ctx)
+	refreshToken, err := issueRefreshToken(collection, user.ID, sessionID, referer, rememberMe)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordSession(session, sessionID, user.ID, clientFrom(ctx), refreshTokenLifetime(rememberMe)); err != nil {
+		return nil, err
+	}
+
+	//Logging in once too many ends the oldest sessions
+	evicted, err := evictSessions(session, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range evicted {
+		recordServiceAuditEvent(ctx, user.ID, user.ID, auditActionSessionsRevoke, fmt.Sprintf("session %s evicted by a login over the limit of %d", id, maxSessionsPerUser), nil)
+	}
+	recordLoginAttempt(user.ID, true, "")
+	recordLastLogin(user.ID)
+
+	result := &model.LoginResult{
+		UserID:                user.ID,
+		Token:                 model.JWTToken(tokenString),
+		RefreshToken:          refreshToken,
+		TOSAcceptanceRequired: requireTOSAcceptance && user.AcceptedTOSVersion != currentTOSVersion,
+		EvictedSessions:       evicted,
+	}
+
+	return result, nil
+}
+
+func (u userService) LoginWithProvider(ctx context.Context, profile *model.ExternalProfile, referer string) (*model.LoginResult, error) {
+	//Find the user the identity is linked to, or else sign them up
+	user, err := userByIdentity(ctx, profile.Provider, profile.Subject)
+	if err == errUserNotFound {
+		user, err = provisionUser(ctx, profile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//The provider vouches for who they are, but not for their account
+	if !canLogIn(user.Status) {
+		recordLoginAttempt(user.ID, false, loginReasonInactive)
+		return nil, errAccountInactive
+	}
+
+	return startSession(ctx, user, referer)
+}
+
+func (u userService) RefreshToken(ctx context.Context, refreshToken, origin string) (*model.LoginResult, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of refresh tokens
+	collection, err := refreshTokenCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored model.RefreshToken
+	err = collection.FindId(hashRefreshToken(refreshToken)).One(&stored)
+	if err == mgo.ErrNotFound {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//The database only drops expired tokens every minute or so
+	if !time.Now().Before(stored.ExpiresAt) {
+		return nil, errInvalidRefreshToken
+	}
+
+	//A used token coming back means it leaked, so end the whole session
+	if stored.UsedAt != nil {
+		if err := revokeRefreshTokenFamily(collection, stored.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, errRefreshTokenReused
+	}
+
+	//Only refresh from the front-end the token was issued to
+	if !matchesBoundOrigin(stored.Origin, origin) {
+		return nil, errOriginMismatch
+	}
+
+	//Families only go through so many refreshes before a full login
+	if maxFamilyRefreshes > 0 {
+		refreshes, err := sessionRefreshes(session, stored.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+		if refreshes >= maxFamilyRefreshes {
+			if err := endSession(session, stored.FamilyID); err != nil {
+				return nil, err
+			}
+			return nil, errReauthRequired
+		}
+	}
+
+	//Mint the new tokens from the user as they are now
+	user, err := u.GetByID(ctx, stored.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	//Locked, deactivated and deleted accounts lose their sessions
+	if !canLogIn(user.Status) {
+		return nil, errAccountInactive
+	}
+
+	//Tokens are single use, even when refreshed twice at once
+	err = collection.Update(bson.M{"_id": stored.ID, "used_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"used_at": time.Now()}})
+	if err == mgo.ErrNotFound {
+		if err := revokeRefreshTokenFamily(collection, stored.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, errRefreshTokenReused
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := groupIDsOf(session, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	tokenString, err := generateSessionToken(user.ID, user.Username, user.Role, stored.Origin, stored.FamilyID, groups, isVerified(user))
+	if err != nil {
+		return nil, err
+	}
+
+	nextRefreshToken, err := issueRefreshToken(collection, user.ID, stored.FamilyID, stored.Origin, stored.RememberMe)
+	if err != nil {
+		return nil, err
+	}
+	if err := extendSession(session, stored.FamilyID, clientFrom(ctx), refreshTokenLifetime(stored.RememberMe)); err != nil {
+		return nil, err
+	}
+
+	result := &model.LoginResult{
+		UserID:                user.ID,
+		Token:                 model.JWTToken(tokenString),
+		RefreshToken:          nextRefreshToken,
+		TOSAcceptanceRequired: requireTOSAcceptance && user.AcceptedTOSVersion != currentTOSVersion,
+	}
+
+	return result, nil
+}
+
+func (userService) ResetPassword(ctx context.Context, token, newPassword string) (*model.User, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of password resets
+	collection, err := passwordResetCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var reset model.PasswordReset
+	err = collection.FindId(hashRefreshToken(token)).One(&reset)
+	if err == mgo.ErrNotFound {
+		return nil, errInvalidResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//The database only drops expired resets every minute or so
+	if reset.UsedAt != nil || !time.Now().Before(reset.ExpiresAt) {
+		return nil, errInvalidResetToken
+	}
+
+	//Locked, deactivated and deleted accounts can't be taken back this way
+	user, err := userRepository.GetByID(ctx, reset.UserID, false)
+	if err == errUserNotFound {
+		return nil, errInvalidResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if accountStatus(user.Status) != statusActive {
+		return nil, errInvalidResetToken
+	}
+
+	//A refused password leaves the token usable for another try
+	if err := validatePassword(newPassword, user.Username, user.Email, user.FirstName, user.LastName); err != nil {
+		return nil, withField(err, "new_password")
+	}
+
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	//Tokens are single use, even when confirmed twice at once
+	err = collection.Update(bson.M{"_id": reset.ID, "used_at": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"used_at": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return nil, errInvalidResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	change := UserChange{Set: map[string]interface{}{"password": hashedPassword, "updated_at": now, "password_changed_at": now}}
+	if err := modifyUser(ctx, UserFilter{IDs: []string{user.ID}, NotDeleted: true}, change, errInvalidResetToken, user.Username); err != nil {
+		return nil, err
+	}
+
+	//Log out every session, whoever knew the old password included
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	if err := revokeUserRefreshTokens(refreshTokens, user.ID); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (userService) Revoke(ctx context.Context, tokenID string, expiry time.Time) error {
+	// Tokens are accepted for up to tokenLeeway after they expire
+	return revokedTokens.Revoke(tokenID, expiry.Add(tokenLeeway))
+}
+
+func (userService) EndSession(ctx context.Context, userID, refreshToken string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of refresh tokens
+	collection, err := refreshTokenCollection(session)
+	if err != nil {
+		return err
+	}
+
+	//Tokens that are gone or belong to someone else have no session to end
+	var stored model.RefreshToken
+	err = collection.Find(bson.M{"_id": hashRefreshToken(refreshToken), "user_id": userID}).One(&stored)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return revokeRefreshTokenFamily(collection, stored.FamilyID)
+}
+
+func (u userService) LinkIdentity(ctx context.Context, userID string, profile *model.ExternalProfile) (*model.User, error) {
+	identity := model.Identity{Provider: profile.Provider, Subject: profile.Subject, LinkedAt: time.Now()}
+	if err := userRepository.LinkIdentity(ctx, userID, identity); err != nil {
+		return nil, err
+	}
+	recentWrites.Mark(userID)
+
+	return u.GetByID(ctx, userID)
+}
+
+func (u userService) UnlinkIdentity(ctx context.Context, userID, provider string) (*model.User, error) {
+	user, err := u.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	linked := false
+	for _, identity := range user.Identities {
+		linked = linked || identity.Provider == provider
+	}
+	if !linked {
+		return nil, errProviderNotLinked
+	}
+
+	//Don't lock users out of their account, even when unlinking concurrently
+	if err := userRepository.UnlinkIdentity(ctx, userID, provider, user.Password == ""); err != nil {
+		return nil, err
+	}
+	recentWrites.Mark(userID, user.Username)
+
+	return u.GetByID(ctx, userID)
+}
+
+func (userService) RevokeSessions(ctx context.Context, userID string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of refresh tokens
+	collection, err := refreshTokenCollection(session)
+	if err != nil {
+		return err
+	}
+
+	if err := revokeUserRefreshTokens(collection, userID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InvalidateResetTokens drops the password reset and email verification
+// tokens of userID that haven't been used yet, returning how many it dropped
+func (u userService) InvalidateResetTokens(ctx context.Context, userID string) (int, error) {
+	if _, err := u.GetByID(ctx, userID); err != nil {
+		return 0, err
+	}
+
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	resets, err := passwordResetCollection(session)
+	if err != nil {
+		return 0, err
+	}
+	verifications, err := emailVerificationCollection(session)
+	if err != nil {
+		return 0, err
+	}
+
+	//Used verifications stay, so a second click still finds the email
+	//verified
+	invalidated := 0
+	for _, collection := range []*mgo.Collection{resets, verifications} {
+		info, err := collection.RemoveAll(bson.M{"user_id": userID, "used_at": bson.M{"$exists": false}})
+		if err != nil {
+			return invalidated, err
+		}
+		invalidated += info.Removed
+	}
+	return invalidated, nil
+}
+
+func (userService) ReissueID(ctx context.Context, id string) (*model.User, error) {
+	user, err := userRepository.Reissue(ctx, id, bson.NewObjectId().Hex())
+	if err != nil {
+		return nil, err
+	}
+	recentWrites.Mark(id, user.ID, user.Username)
+
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	db := session.DB("buzz-test-user")
+
+	//Repoint the login history, and everything else kept by user id. The
+	//audit log stays as it happened, the reissue recorded in it links the ids.
+	for _, name := range []string{"login_attempts", "api_keys", "sessions", "email_verifications", "password_resets", "invitations"} {
+		if _, err := db.C(name).UpdateAll(bson.M{"user_id": id}, bson.M{"$set": bson.M{"user_id": user.ID}}); err != nil {
+			return nil, err
+		}
+	}
+
+	//Memberships are named after the user, so they are replaced
+	members, err := groupMemberCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	var memberships []model.GroupMembership
+	if err := members.Find(bson.M{"user_id": id}).All(&memberships); err != nil {
+		return nil, err
+	}
+	for _, membership := range memberships {
+		membership.ID, membership.UserID = groupMembershipID(membership.GroupID, user.ID), user.ID
+		if _, err := members.UpsertId(membership.ID, &membership); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := members.RemoveAll(bson.M{"user_id": id}); err != nil {
+		return nil, err
+	}
+
+	//Pending challenges were sent for the old id
+	if err := db.C("challenges").RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	//Tokens name the old id, so end every session
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	if err := revokeUserRefreshTokens(refreshTokens, id); err != nil {
+		return nil, err
+	}
+	if err := revokeSubject(id); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (userService) Remove(ctx context.Context, id string) error {
+	removed, err := userRepository.Remove(ctx, UserFilter{IDs: []string{id}})
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return errUserNotFound
+	}
+	recentWrites.Mark(id)
+
+	return nil
+}
+
+// checkNamesAvailable makes sure no user other than user has its username or
+// email
+func checkNamesAvailable(ctx context.Context, user *model.User) error {
+	for _, filter := range usernameClashes(user) {
+		count, err := userRepository.Count(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errDuplicateUsername
+		}
+	}
+	if user.Email == "" {
+		return nil
+	}
+	count, err := userRepository.Count(ctx, emailClash(user.ID, user.Email))
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errDuplicateEmail
+	}
+	return nil
+}
+
+// ReserveUsername holds username for a signup in progress, returning the token
+// the signup takes it with and when the hold expires
+func (userService) ReserveUsername(ctx context.Context, username string) (string, time.Time, error) {
+	// Only usernames nobody has can be held
+	user := &model.User{Username: normalizeUsername(username), UsernameSkeleton: usernameSkeleton(username)}
+	for _, filter := range usernameClashes(user) {
+		count, err := userRepository.Count(ctx, filter)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if count > 0 {
+			return "", time.Time{}, errDuplicateUsername
+		}
+	}
+
+	token, err := newReservationToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(usernameReservationTTL)
+	ok, err := usernameReservations.Reserve(usernameKey(username), token, usernameReservationTTL)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !ok {
+		return "", time.Time{}, errDuplicateUsername
+	}
+
+	return token, expiresAt, nil
+}
+
+// ReleaseUsername lets go of username when token holds it, e.g. when a signup
+// is abandoned
+func (userService) ReleaseUsername(ctx context.Context, username, token string) error {
+	return usernameReservations.Release(usernameKey(username), token)
+}
+
+func (userService) ResolveUsernames(ctx context.Context, usernames []string) ([]model.ResolvedUser, error) {
+	// Normalize the usernames and drop empty or repeated ones
+	seen := make(map[string]bool, len(usernames))
+	normalized := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		username = normalizeUsername(username)
+		if username == "" || seen[username] {
+			continue
+		}
+		seen[username] = true
+		normalized = append(normalized, username)
+	}
+	if len(normalized) == 0 {
+		return []model.ResolvedUser{}, nil
+	}
+
+	//Look all of the usernames up at once, unknown ones simply don't match
+	users, err := userRepository.Find(ctx, UserFilter{Usernames: normalized, NotDeleted: true}, nil, 0, 0)
+	if err != nil {
+		return []model.ResolvedUser{}, err
+	}
+	resolvedUsers := make([]model.ResolvedUser, len(users))
+	for i, user := range users {
+		resolvedUsers[i] = model.ResolvedUser{ID: user.ID, Username: user.Username}
+	}
+
+	return resolvedUsers, nil
+}
+
+func (userService) Search(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	var retrievedUsers []model.User
+	var total int
+	var err error
+	if len(opts.Sort) == 0 {
+		//Without a sort asked for, the best matches come first, typos included
+		retrievedUsers, total, err = searchRanked(ctx, opts)
+		if err != nil {
+			return []model.User{}, 0, err
+		}
+	} else {
+		//Soft-deleted users are searched too
+		filter := UserFilter{Role: opts.Role, Search: opts.Query, SearchMatch: searchContains}
+		total, err = userRepository.Count(ctx, filter)
+		if err != nil {
+			return []model.User{}, 0, err
+		}
+
+		retrievedUsers, err = userRepository.Find(ctx, filter, listSort(opts), opts.Offset, opts.Limit)
+		if err != nil {
+			return []model.User{}, 0, err
+		}
+	}
+
+	//Every result says what state the account is in
+	for i := range retrievedUsers {
+		if retrievedUsers[i].DeletedAt != nil {
+			retrievedUsers[i].Status = statusDeleted
+		}
+		retrievedUsers[i].Status = accountStatus(retrievedUsers[i].Status)
+	}
+
+	return retrievedUsers, total, nil
+}
+
+// searchRanked returns the page of users matching opts.Query that opts asks
+// for, most relevant first, and how many match. The users equal to or starting
+// like the search are counted and paged by the repository a tier at a time,
+// and only the users left are ranked here.
+func searchRanked(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	full := func(page []model.User) bool {
+		return opts.Limit > 0 && len(page) >= opts.Limit
+	}
+
+	page := []model.User{}
+	total, offset := 0, opts.Offset
+	for _, match := range []searchMatch{searchExact, searchPrefix} {
+		filter := UserFilter{Role: opts.Role, Search: opts.Query, SearchMatch: match}
+		count, err := userRepository.Count(ctx, filter)
+		if err != nil {
+			return []model.User{}, 0, err
+		}
+		total += count
+		if full(page) || offset >= count {
+			offset -= count
+			if offset < 0 {
+				offset = 0
+			}
+			continue
+		}
+
+		limit := 0
+		if opts.Limit > 0 {
+			limit = opts.Limit - len(page)
+		}
+		users, err := userRepository.Find(ctx, filter, listSort(opts), offset, limit)
+		if err != nil {
+			return []model.User{}, 0, err
+		}
+		page = append(page, users...)
+		offset = 0
+	}
+
+	//The rest are ranked here, which is why there can only be so many
+	filter := UserFilter{Role: opts.Role, Search: opts.Query, SearchMatch: searchCandidates}
+	candidates, err := userRepository.Find(ctx, filter, listSort(opts), 0, maxSearchCandidates)
+	if err != nil {
+		return []model.User{}, 0, err
+	}
+	limit := 0
+	if opts.Limit > 0 {
+		limit = opts.Limit - len(page)
+	}
+	rest, relevant := rankSearchResults(candidates, model.ListOptions{Query: opts.Query, Offset: offset, Limit: limit})
+	if !full(page) {
+		page = append(page, rest...)
+	}
+
+	return page, total + relevant, nil
+}
+
+// Ping checks that the database can be reached
+func (userService) Ping(ctx context.Context) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.Ping()
+}
+
+func (userService) GetStats(ctx context.Context) (*model.UserStats, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of login attempts
+	db := session.DB("buzz-test-user")
+	attempts := db.C("login_attempts")
+
+	now := time.Now()
+	stats := &model.UserStats{GeneratedAt: now}
+
+	//Every figure is a count the database answers from its indexes
+	userCounts := []struct {
+		filter UserFilter
+		count  *int
+	}{
+		{UserFilter{NotDeleted: true}, &stats.TotalUsers},
+		{UserFilter{Statuses: []string{statusActive, ""}}, &stats.ActiveUsers},
+		{UserFilter{Statuses: []string{statusDeactivated}}, &stats.DeactivatedUsers},
+		{UserFilter{Statuses: []string{statusLocked}}, &stats.LockedUsers},
+		{UserFilter{Statuses: []string{statusPending}}, &stats.UnverifiedUsers},
+		{UserFilter{SignedUpSince: now.AddDate(0, 0, -1)}, &stats.SignupsLastDay},
+		{UserFilter{SignedUpSince: now.AddDate(0, 0, -7)}, &stats.SignupsLastWeek},
+		{UserFilter{SignedUpSince: now.AddDate(0, 0, -30)}, &stats.SignupsLastMonth},
+	}
+	for _, c := range userCounts {
+		if *c.count, err = userRepository.Count(ctx, c.filter); err != nil {
+			return nil, err
+		}
+	}
+	attemptCounts := []struct {
+		query bson.M
+		count *int
+	}{
+		{bson.M{"success": true, "created_at": bson.M{"$gte": now.AddDate(0, 0, -1)}}, &stats.LoginSuccesses},
+		{bson.M{"success": false, "created_at": bson.M{"$gte": now.AddDate(0, 0, -1)}}, &stats.LoginFailures},
+	}
+	for _, c := range attemptCounts {
+		if *c.count, err = attempts.Find(c.query).Count(); err != nil {
+			return nil, err
+		}
+	}
+
+	if logins := stats.LoginSuccesses + stats.LoginFailures; logins > 0 {
+		stats.LoginSuccessRate = float64(stats.LoginSuccesses) / float64(logins)
+		stats.LoginFailureRate = float64(stats.LoginFailures) / float64(logins)
+	}
+
+	return stats, nil
+}
+
+// deactivateBatchSize is how many inactive users are deactivated at a time
+const deactivateBatchSize = 500
+
+func (userService) DeactivateInactive(ctx context.Context, cutoff time.Time, dryRun bool) ([]string, error) {
+	//Users who haven't logged in since we started recording logins count
+	//from when they signed up
+	selector := UserFilter{Statuses: []string{statusActive, ""}, InactiveSince: cutoff}
+
+	if dryRun {
+		users, err := userRepository.Find(ctx, selector, nil, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		inactive := make([]string, len(users))
+		for i, user := range users {
+			inactive[i] = user.ID
+		}
+		return inactive, nil
+	}
+
+	deactivated := []string{}
+	for {
+		batch, err := userRepository.Find(ctx, selector, nil, 0, deactivateBatchSize)
+		if err != nil {
+			return deactivated, err
+		}
+		if len(batch) == 0 {
+			return deactivated, nil
+		}
+
+		ids := make([]string, len(batch))
+		usernames := make(map[string]string, len(batch))
+		for i, user := range batch {
+			ids[i] = user.ID
+			usernames[user.ID] = user.Username
+		}
+
+		//Users who logged in meanwhile are no longer picked, and stay active
+		batchSelector := selector
+		batchSelector.IDs = ids
+		change := UserChange{Set: map[string]interface{}{"status": statusDeactivated, "updated_at": time.Now()}, Unset: []string{"purge_at"}}
+		batchDeactivated, err := userRepository.Modify(ctx, batchSelector, change)
+		deactivated = append(deactivated, batchDeactivated...)
+		for _, id := range batchDeactivated {
+			recentWrites.Mark(id, usernames[id])
+		}
+		if err != nil {
+			return deactivated, err
+		}
+
+		if len(batch) < deactivateBatchSize {
+			return deactivated, nil
+		}
+	}
+}
+
+func (userService) SetStatus(ctx context.Context, id, status string) (*model.User, error) {
+	//Deleted users are looked up too, so changing their status is a conflict
+	user, err := userRepository.GetByID(ctx, id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkStatusTransition(user.Status, status); err != nil {
+		return nil, err
+	}
+
+	//Only change the status if nobody changed it since we checked
+	selector := UserFilter{IDs: []string{id}, Statuses: []string{user.Status}}
+	now := time.Now()
+	changes := map[string]interface{}{"status": status, "updated_at": now}
+	if status == statusDeleted {
+		changes["deleted_at"] = now
+	}
+	//Setting a status overrides a pending close of the account
+	change := UserChange{Set: changes, Unset: []string{"purge_at"}}
+	if err := modifyUser(ctx, selector, change, statusTransitionError{from: accountStatus(user.Status), to: status}, user.Username); err != nil {
+		return nil, err
+	}
+
+	user.Status = status
+	user.UpdatedAt = now
+	user.PurgeAt = nil
+	if status == statusDeleted {
+		user.DeletedAt = &now
+	}
+	return user, nil
+}
+
+// UpdateAttributes changes the role and status of a user in a single write,
+// so either both change or neither does
+func (userService) UpdateAttributes(ctx context.Context, id string, update *model.AttributeUpdate) (*model.User, error) {
+	user, err := userRepository.GetByID(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	current := accountStatus(user.Status)
+	status := current
+	if update.Verify && status == statusPending {
+		status = statusActive
+	}
+	if update.Active != nil {
+		status = statusDeactivated
+		if *update.Active {
+			status = statusActive
+		}
+	}
+	if status != current {
+		if err := checkStatusTransition(current, status); err != nil {
+			return nil, err
+		}
+	}
+
+	//Only change the user if nobody changed its status since we checked
+	selector := UserFilter{IDs: []string{id}, Statuses: []string{user.Status}}
+	now := time.Now()
+	changes := map[string]interface{}{"updated_at": now}
+	if update.Role != nil {
+		changes["role"] = *update.Role
+	}
+	if status != current {
+		changes["status"] = status
+	}
+	if err := modifyUser(ctx, selector, UserChange{Set: changes}, statusTransitionError{from: current, to: status}, user.Username); err != nil {
+		return nil, err
+	}
+
+	if update.Role != nil {
+		user.Role = *update.Role
+	}
+	user.Status = status
+	user.UpdatedAt = now
+	return user, nil
+}
+
+func (u userService) Update(ctx context.Context, id string, updatedUser *model.UpdateUser) (*model.User, error) {
+	//Store the hash of a new password
+	stored := *updatedUser
+
+	//Usernames only change once per cooldown, and keeping the current one
+	//isn't a change
+	if updatedUser.Username != nil {
+		user, err := userRepository.GetByID(ctx, id, false)
+		if err != nil {
+			return nil, err
+		}
+		if normalizeUsername(*updatedUser.Username) == user.Username {
+			stored.Username = nil
+		} else if err := checkUsernameCooldown(user, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if updatedUser.Password != nil {
+		hashedPassword, err := hashPassword(*updatedUser.Password)
+		if err != nil {
+			return nil, err
+		}
+		stored.Password = &hashedPassword
+	}
+	if err := userRepository.Update(ctx, id, &stored); err != nil {
+		return nil, err
+	}
+	recentWrites.Mark(id)
+
+	//Whoever knew the old password is logged out
+	if updatedUser.Password != nil {
+		//Grab a copy of our session
+		session, err := getSessionContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer session.Close()
+
+		if err := endUserSessions(session, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return u.GetByID(ctx, id)
+}
+
+// listSort returns the order to list users in, oldest first unless asked
+// otherwise
+func listSort(opts model.ListOptions) []string {
+	if len(opts.Sort) == 0 {
+		return []string{"timestamp", "_id"}
+	}
+	return opts.Sort
+}
+
+// skipDeleted makes a query leave out soft-deleted users
+func skipDeleted(query bson.M) bson.M {
+	query["deleted_at"] = bson.M{"$exists": false}
+	return query
+}
+
+func (userService) VerifyChallenge(ctx context.Context, userID, code string) (string, time.Time, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer session.Close()
+
+	//Get our collection of challenges
+	db := session.DB("buzz-test-user")
+	collection := db.C("challenges")
+
+	var challenge model.Challenge
+	err = collection.FindId(userID).One(&challenge)
+	if err == mgo.ErrNotFound {
+		return "", time.Time{}, errChallengeExpired
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	//The database only drops expired challenges every minute or so
+	if !time.Now().Before(challenge.ExpiresAt) {
+		collection.RemoveId(userID)
+		return "", time.Time{}, errChallengeExpired
+	}
+	if challenge.Attempts >= challengeMaxAttempts {
+		collection.RemoveId(userID)
+		return "", time.Time{}, errTooManyAttempts
+	}
+
+	if !hmac.Equal([]byte(hashChallengeCode(userID, code)), []byte(challenge.CodeHash)) {
+		err := collection.Update(bson.M{"_id": userID, "code_hash": challenge.CodeHash}, bson.M{"$inc": bson.M{"attempts": 1}})
+		if err != nil && err != mgo.ErrNotFound {
+			return "", time.Time{}, err
+		}
+		return "", time.Time{}, errInvalidCode
+	}
+
+	//Codes are single use, even when confirmed twice at once
+	err = collection.Remove(bson.M{"_id": userID, "code_hash": challenge.CodeHash})
+	if err == mgo.ErrNotFound {
+		return "", time.Time{}, errChallengeExpired
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return generateProofToken(userID)
+}
+
+// duplicateUserError turns a duplicate key error into the error for the
+// field that clashed, leaving other errors untouched
+func duplicateUserError(err error) error {
+	if !mgo.IsDup(err) {
+		return err
+	}
+	if strings.Contains(err.Error(), "email") {
+		return errDuplicateEmail
+	}
+	return errDuplicateUsername
+}
+
+// rehashPassword replaces the stored hash of a user's password with one by
+// hashPassword. It is best effort, the old hash keeps working if it fails.
+func rehashPassword(userID, password string) {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		log.Println("unable to rehash password:", err)
+		return
+	}
+
+	change := UserChange{Set: map[string]interface{}{"password": hashedPassword}}
+	if err := modifyUser(context.Background(), UserFilter{IDs: []string{userID}}, change, errUserNotFound); err != nil {
+		log.Println("unable to rehash password:", err)
+	}
+}
+
+// recordLastLogin stores when a user last logged in. Like recording login
+// attempts it is best effort.
+func recordLastLogin(userID string) {
+	change := UserChange{Set: map[string]interface{}{"last_login_at": time.Now()}}
+	if err := modifyUser(context.Background(), UserFilter{IDs: []string{userID}}, change, errUserNotFound); err != nil {
+		log.Println("unable to record last login:", err)
+	}
+}
+
+// recordLoginAttempt stores the outcome of a login attempt. It is best effort,
+// failing to record an attempt never fails the login itself.
+func recordLoginAttempt(userID string, success bool, reason string) {
+	attempt := &model.LoginAttempt{
+		ID:        bson.NewObjectId().Hex(),
+		UserID:    userID,
+		Success:   success,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+
+	//Grab a copy of our session
+	session, err := getSession()
+	if err != nil {
+		log.Println("unable to record login attempt:", err)
+		return
+	}
+	defer session.Close()
+
+	//Get our collection of login attempts
+	db := session.DB("buzz-test-user")
+	collection := db.C("login_attempts")
+
+	// Let the database drop attempts older than our retention
+	index := mgo.Index{
+		Key:         []string{"created_at"},
+		ExpireAfter: loginAttemptRetention,
+	}
+	if err := collection.EnsureIndex(index); err != nil {
+		log.Println("unable to record login attempt:", err)
+		return
+	}
+
+	if err := collection.Insert(attempt); err != nil {
+		log.Println("unable to record login attempt:", err)
+	}
+}
+
+func generateToken(userID, username, role, referer string) (string, error) {
+	return generateSessionToken(userID, username, role, referer, "", nil, true)
+}
+
+// generateSessionToken is generateToken for an access token of the session
+// with sessionID, which stops working when the session is revoked, of a user
+// belonging to groups. Tokens of users who haven't verified their email yet
+// say so, and only carry unverifiedScopes.
+func generateSessionToken(userID, username, role, referer, sessionID string, groups []string, verified bool) (string, error) {
+	tokenString, err := signToken(newSessionToken(userID, username, role, referer, sessionID, groups, verified))
+	if err != nil {
+		return "", err
+	}
+
+	return tokenString, nil
+}
+
+// newSessionToken returns the unsigned token generateSessionToken signs
+func newSessionToken(userID, username, role, referer, sessionID string, groups []string, verified bool) *jwt.Token {
+	// Generate the JWT token
+	token := jwt.New(signingMethod)
+	token.Claims["sub"] = userID
+	token.Claims["iat"] = time.Now().Unix()
+	token.Claims["exp"] = time.Now().Add(tokenTTLFor(role)).Unix()
+	token.Claims["nbf"] = time.Now().Unix()
+	token.Claims["iss"] = referer
+	token.Claims["jti"] = makeJTI(token.Claims["sub"], token.Claims["iat"])
+	token.Claims["username"] = username
+	token.Claims["role"] = role
+	token.Claims["verified"] = verified
+	token.Claims["scopes"] = tokenScopes(role, verified)
+	if sessionID != "" {
+		token.Claims["sid"] = sessionID
+	}
+	if len(groups) > 0 {
+		token.Claims["groups"] = groups
+	}
+	return token
+}
+
+// makeJTI returns a unique token id. The random part tells apart tokens
+// issued to the same subject within the same second.
+func makeJTI(subject, issuedAt interface{}) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	h := md5.New()
+	io.WriteString(h, subject.(string))
+	io.WriteString(h, strconv.Itoa(int(issuedAt.(int64))))
+	h.Write(nonce)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+var globalSession *mgo.Session
+
+func getSession() (*mgo.Session, error) {
+	//Establish our database connection
+	if globalSession == nil {
+		var err error
+		globalSession, err = mgo.Dial(MongoURL)
+		if err != nil {
+			return nil, err
+		}
+
+		//Optional. Switch the session to a monotonic behavior.
+		globalSession.SetMode(mgo.Monotonic, true)
+	}
+
+	return globalSession.Copy(), nil
+}
+
+// closeSessions closes our database connections on shutdown
+func closeSessions() {
+	if globalSession != nil {
+		globalSession.Close()
+	}
+	if replicaSession != nil {
+		replicaSession.Close()
+	}
+}
+
+// getSessionContext is getSession, with queries giving up at the deadline of ctx
+func getSessionContext(ctx context.Context) (*mgo.Session, error) {
+	session, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	return boundSession(ctx, session)
+}
+
+func (u userService) ResendVerification(ctx context.Context, email string) error {
+	if verificationSender == nil {
+		return errNoVerificationSender
+	}
+
+	user, err := u.GetByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	//Only pending accounts have an email left to verify
+	if accountStatus(user.Status) != statusPending {
+		return errUserNotFound
+	}
+
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return issueEmailVerification(session, user)
+}
+
+func (userService) VerifyEmail(ctx context.Context, token string) (*model.User, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of email verifications
+	collection, err := emailVerificationCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var verification model.EmailVerification
+	err = collection.FindId(hashRefreshToken(token)).One(&verification)
+	if err == mgo.ErrNotFound {
+		return nil, errInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//The database only drops expired verifications every minute or so
+	if !time.Now().Before(verification.ExpiresAt) {
+		return nil, errInvalidVerificationToken
+	}
+
+	user, err := userRepository.GetByID(ctx, verification.UserID, false)
+	if err == errUserNotFound {
+		return nil, errInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//Following the link again, e.g. from another device, finds the email
+	//already verified
+	if verification.UsedAt != nil {
+		if accountStatus(user.Status) != statusActive {
+			return nil, errInvalidVerificationToken
+		}
+		return user, nil
+	}
+
+	//Only pending accounts are activated, so a locked or deactivated account
+	//stays that way
+	now := time.Now()
+	selector := UserFilter{IDs: []string{user.ID}, Statuses: []string{statusPending}, NotDeleted: true}
+	change := UserChange{Set: map[string]interface{}{"status": statusActive, "updated_at": now}}
+	if err := modifyUser(ctx, selector, change, errInvalidVerificationToken, user.Username); err != nil {
+		return nil, err
+	}
+
+	//The token is kept as used until it expires, the others can't be used
+	if err := collection.UpdateId(verification.ID, bson.M{"$set": bson.M{"used_at": now}}); err != nil {
+		return nil, err
+	}
+	if _, err := collection.RemoveAll(bson.M{"user_id": user.ID, "_id": bson.M{"$ne": verification.ID}}); err != nil {
+		return nil, err
+	}
+
+	user.Status = statusActive
+	user.UpdatedAt = now
+	welcomeOnVerification(user)
+	return user, nil
+}
+
+func (u userService) CreateAPIKey(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (*model.APIKey, string, error) {
+	//Keys can't do more than their user
+	user, err := u.GetByID(ctx, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(missingScopes(scopes, scopesFor(user.Role))) != 0 {
+		return nil, "", errScopeNotGranted
+	}
+
+	id, key, err := newAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer session.Close()
+
+	//Get our collection of API keys
+	collection, err := apiKeyCollection(session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	apiKey := &model.APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		Prefix:    apiKeyDisplayPrefix(id),
+		Hash:      hashRefreshToken(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	if err := collection.Insert(apiKey); err != nil {
+		return nil, "", err
+	}
+
+	//Count after adding the key, so keys created at once can't all fit
+	if maxAPIKeysPerUser > 0 {
+		active, err := countActiveAPIKeys(collection, userID, apiKey.CreatedAt)
+		if err == nil && active > maxAPIKeysPerUser {
+			err = errTooManyAPIKeys
+		}
+		if err != nil {
+			collection.RemoveId(id)
+			return nil, "", err
+		}
+	}
+
+	return apiKey, key, nil
+}
+
+func (userService) ListAPIKeys(ctx context.Context, userID string) ([]model.APIKey, error) {
+	//Grab a copy of our session
+	session, err := getReadSessionContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of API keys
+	collection, err := apiKeyCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return apiKeysOf(collection, userID)
+}
+
+func (userService) RevokeAPIKey(ctx context.Context, userID, keyID string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of API keys
+	collection, err := apiKeyCollection(session)
+	if err != nil {
+		return err
+	}
+
+	//Only the user's own keys, so ids of other users' keys aren't revealed
+	err = collection.Remove(bson.M{"_id": keyID, "user_id": userID})
+	if err == mgo.ErrNotFound {
+		return errAPIKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ExportUser gathers everything kept about a user: their profile, sessions,
+// refresh tokens, login attempts and API keys. Erased and deleted users can be exported too.
+func (userService) ExportUser(ctx context.Context, id string) (*model.UserExport, error) {
+	user, err := userRepository.GetByID(ctx, id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	export := &model.UserExport{User: user, AuditEvents: []model.AuditEvent{}, ExportedAt: time.Now().UTC()}
+
+	sessions, err := sessionCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	export.Sessions = []model.Session{}
+	if err := sessions.Find(bson.M{"user_id": id}).Sort("-last_seen_at").All(&export.Sessions); err != nil {
+		return nil, err
+	}
+
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	export.RefreshTokens = []model.RefreshToken{}
+	if err := refreshTokens.Find(bson.M{"user_id": id}).Sort("-created_at").All(&export.RefreshTokens); err != nil {
+		return nil, err
+	}
+
+	export.LoginAttempts = []model.LoginAttempt{}
+	if err := session.DB("buzz-test-user").C("login_attempts").Find(bson.M{"user_id": id}).Sort("-created_at").All(&export.LoginAttempts); err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := apiKeyCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	if export.APIKeys, err = apiKeysOf(apiKeys, id); err != nil {
+		return nil, err
+	}
+
+	if export.Groups, err = groupsOf(session, id); err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// erasedUsername is what the username of an erased user becomes. It is made
+// of their id so it stays unique without saying anything about them.
+func erasedUsername(id string) string {
+	return "erased-" + id
+}
+
+// erasedEmail is what the email of an erased user becomes, an address that
+// can't be delivered to
+func erasedEmail(id string) string {
+	return erasedUsername(id) + "@erased.invalid"
+}
+
+// EraseUser anonymizes the personal fields of a user and purges everything
+// they could log in with. The user stays behind as a deleted tombstone under
+// the same id, so login attempts and audit events still point at something.
+func (userService) EraseUser(ctx context.Context, id string) error {
+	//Deleted users can be erased too, they still hold personal data
+	now := time.Now()
+	email, username := erasedEmail(id), erasedUsername(id)
+	change := UserChange{
+		Set: map[string]interface{}{
+			"email":        email,
+			"email_key":    emailKey(email),
+			"username":     username,
+			"username_key": usernameKey(username),
+			"first_name":   "",
+			"last_name":    "",
+			"password":     "",
+			"status":       statusDeleted,
+			"deleted_at":   now,
+			"erased_at":    now,
+			"updated_at":   now,
+		},
+		Unset: []string{
+			"email_index",
+			"username_skeleton",
+			"date_of_birth",
+			"identities",
+			"purge_at",
+			"last_login_at",
+			"password_changed_at",
+			"username_changed_at",
+			"display_name",
+			"avatar_url",
+			"timezone",
+			"locale",
+			"phone",
+		},
+	}
+	if err := modifyUser(ctx, UserFilter{IDs: []string{id}}, change, errUserNotFound); err != nil {
+		return err
+	}
+
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Purge every token of the user, and the sessions saying where they were
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return err
+	}
+	if err := revokeUserRefreshTokens(refreshTokens, id); err != nil {
+		return err
+	}
+	sessions, err := sessionCollection(session)
+	if err != nil {
+		return err
+	}
+	if _, err := sessions.RemoveAll(bson.M{"user_id": id}); err != nil {
+		return err
+	}
+	apiKeys, err := apiKeyCollection(session)
+	if err != nil {
+		return err
+	}
+	if _, err := apiKeys.RemoveAll(bson.M{"user_id": id}); err != nil {
+		return err
+	}
+	resets, err := passwordResetCollection(session)
+	if err != nil {
+		return err
+	}
+	if _, err := resets.RemoveAll(bson.M{"user_id": id}); err != nil {
+		return err
+	}
+	verifications, err := emailVerificationCollection(session)
+	if err != nil {
+		return err
+	}
+	if _, err := verifications.RemoveAll(bson.M{"user_id": id}); err != nil {
+		return err
+	}
+	invitations, err := invitationCollection(session)
+	if err != nil {
+		return err
+	}
+	if _, err := invitations.RemoveAll(bson.M{"user_id": id}); err != nil {
+		return err
+	}
+	members, err := groupMemberCollection(session)
+	if err != nil {
+		return err
+	}
+	if _, err := members.RemoveAll(bson.M{"user_id": id}); err != nil {
+		return err
+	}
+	if err := session.DB("buzz-test-user").C("challenges").RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if err := revokeSubject(id); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListSessions returns the sessions of userID that can still be refreshed,
+// most recently seen first
+func (userService) ListSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return liveSessions(session, userID)
+}
+
+// RevokeSession logs userID out of the session with sessionID. Its refresh
+// tokens are purged and its access tokens stop working right away.
+func (userService) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of sessions
+	collection, err := sessionCollection(session)
+	if err != nil {
+		return err
+	}
+
+	//Only the user's own sessions can be revoked through them
+	err = collection.Remove(bson.M{"_id": sessionID, "user_id": userID})
+	if err == mgo.ErrNotFound {
+		return errSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return endSession(session, sessionID)
+}
+
+// InviteUser creates an invited account for someone to join, without a
+// password, and sends them the token they accept the invite with. Inviting
+// someone still invited sends them a new invite in place of the old one.
+func (userService) InviteUser(ctx context.Context, invitee *model.CreateUser, invitedBy string) (*model.Invitation, error) {
+	if invitationSender == nil {
+		return nil, errNoInvitationSender
+	}
+
+	//Admins invite people with the role they ask for
+	role, err := resolveRole(ctx, invitee.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := findUser(ctx, UserFilter{Email: invitee.Email, NotDeleted: true})
+	switch {
+	case err == errUserNotFound:
+		now := time.Now()
+		user = &model.User{
+			ID:               bson.NewObjectId().Hex(),
+			Email:            invitee.Email,
+			FirstName:        invitee.FirstName,
+			LastName:         invitee.LastName,
+			Role:             role,
+			Username:         normalizeUsername(invitee.Username),
+			UsernameKey:      usernameKey(invitee.Username),
+			UsernameSkeleton: usernameSkeleton(invitee.Username),
+			Status:           statusInvited,
+			Timestamp:        now.Unix(),
+			UpdatedAt:        now,
+		}
+		if err := insertUser(ctx, user, ""); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case user.Status != statusInvited:
+		return nil, errDuplicateEmail
+	}
+
+	token, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of invitations
+	invitations, err := invitationCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := invitations.RemoveAll(bson.M{"user_id": user.ID}); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	invitation := &model.Invitation{
+		ID:        bson.NewObjectId().Hex(),
+		UserID:    user.ID,
+		Email:     user.Email,
+		InvitedBy: invitedBy,
+		TokenHash: hashRefreshToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(invitationTTL),
+	}
+	if err := invitations.Insert(invitation); err != nil {
+		return nil, err
+	}
+
+	if err := invitationSender.SendInvitation(user, token); err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// AcceptInvitation activates the invited account token is for, with the
+// password the invitee picked. Getting the invite proves they own the email.
+func (userService) AcceptInvitation(ctx context.Context, token, password string) (*model.User, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of invitations
+	invitations, err := invitationCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation, user, err := findInvitation(ctx, invitations, token)
+	if err == errInvitationExpired {
+		return nil, errInvalidInviteToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//A refused password leaves the invite usable for another try
+	if err := validatePassword(password, user.Username, user.Email, user.FirstName, user.LastName); err != nil {
+		return nil, err
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	//Invites are single use, even when accepted twice at once
+	err = invitations.Remove(bson.M{"_id": invitation.ID})
+	if err == mgo.ErrNotFound {
+		return nil, errInvalidInviteToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	selector := UserFilter{IDs: []string{user.ID}, Statuses: []string{statusInvited}, NotDeleted: true}
+	change := UserChange{Set: map[string]interface{}{"password": hashedPassword, "status": statusActive, "updated_at": now, "password_changed_at": now}}
+	if err := modifyUser(ctx, selector, change, errInvalidInviteToken, user.Username); err != nil {
+		return nil, err
+	}
+
+	user.Status, user.UpdatedAt, user.PasswordChangedAt = statusActive, now, &now
+	welcomeOnAcceptance(user)
+	return user, nil
+}
+
+// CheckInvitation returns the pending invitation token is for and the
+// account waiting on it, without using the invite up
+func (userService) CheckInvitation(ctx context.Context, token string) (*model.Invitation, *model.User, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of invitations
+	invitations, err := invitationCollection(session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return findInvitation(ctx, invitations, token)
+}
+
+// ListInvitations returns a page of the pending invitations, newest first,
+// and how many there are
+func (userService) ListInvitations(ctx context.Context, opts model.ListOptions) ([]model.Invitation, int, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer session.Close()
+
+	//Get our collection of invitations
+	collection, err := invitationCollection(session)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	//The database only drops expired invitations every minute or so
+	query := collection.Find(bson.M{"expires_at": bson.M{"$gt": time.Now()}})
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	invitations := []model.Invitation{}
+	err = query.Sort("-created_at").Skip(opts.Offset).Limit(opts.Limit).All(&invitations)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return invitations, total, nil
+}
+
+// RevokeInvitation withdraws the invitation with id. The invited account
+// goes with it, so the email and username are free to invite again.
+func (userService) RevokeInvitation(ctx context.Context, id string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of invitations
+	invitations, err := invitationCollection(session)
+	if err != nil {
+		return err
+	}
+
+	var invitation model.Invitation
+	err = invitations.FindId(id).One(&invitation)
+	if err == mgo.ErrNotFound {
+		return errInvitationNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := invitations.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	//Accounts that joined in the meantime stay
+	if _, err := userRepository.Remove(ctx, UserFilter{IDs: []string{invitation.UserID}, Statuses: []string{statusInvited}}); err != nil {
+		return err
+	}
+	recentWrites.Mark(invitation.UserID)
+
+	return nil
+}
+
+// CreateGroup stores a new group named name
+func (userService) CreateGroup(ctx context.Context, name, description string) (*model.Group, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of groups
+	collection, err := groupCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	group := newGroup(name, description)
+	err = collection.Insert(group)
+	if mgo.IsDup(err) {
+		return nil, errDuplicateGroup
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// GetGroup returns the group with id
+func (userService) GetGroup(ctx context.Context, id string) (*model.Group, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of groups
+	collection, err := groupCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	var group model.Group
+	err = collection.FindId(id).One(&group)
+	if err == mgo.ErrNotFound {
+		return nil, errGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// ListGroups returns a page of the groups, by name, and how many there are
+func (userService) ListGroups(ctx context.Context, opts model.ListOptions) ([]model.Group, int, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer session.Close()
+
+	//Get our collection of groups
+	collection, err := groupCollection(session)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := collection.Find(nil)
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	groups := []model.Group{}
+	err = query.Sort("name_key").Skip(opts.Offset).Limit(opts.Limit).All(&groups)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return groups, total, nil
+}
+
+// UpdateGroup renames or redescribes the group with id
+func (userService) UpdateGroup(ctx context.Context, id string, update *model.UpdateGroup) (*model.Group, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of groups
+	collection, err := groupCollection(session)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := bson.M{"updated_at": time.Now()}
+	if update.Name != nil {
+		changes["name"], changes["name_key"] = strings.TrimSpace(*update.Name), groupNameKey(*update.Name)
+	}
+	if update.Description != nil {
+		changes["description"] = *update.Description
+	}
+
+	var group model.Group
+	_, err = collection.FindId(id).Apply(mgo.Change{Update: bson.M{"$set": changes}, ReturnNew: true}, &group)
+	if err == mgo.ErrNotFound {
+		return nil, errGroupNotFound
+	}
+	if mgo.IsDup(err) {
+		return nil, errDuplicateGroup
+	}
+	if err != nil {
+		return nil, err
+	}
+	recentWrites.Mark(id)
+
+	return &group, nil
+}
+
+// DeleteGroup removes the group with id along with its memberships. Tokens
+// already issued keep claiming it until they are refreshed.
+func (userService) DeleteGroup(ctx context.Context, id string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of groups
+	groups, err := groupCollection(session)
+	if err != nil {
+		return err
+	}
+	members, err := groupMemberCollection(session)
+	if err != nil {
+		return err
+	}
+
+	err = groups.RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return errGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := members.RemoveAll(bson.M{"group_id": id}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddGroupMember adds userID to the group with groupID. Adding a member
+// again changes nothing.
+func (u userService) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of groups
+	groups, err := groupCollection(session)
+	if err != nil {
+		return err
+	}
+	members, err := groupMemberCollection(session)
+	if err != nil {
+		return err
+	}
+
+	count, err := groups.FindId(groupID).Count()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errGroupNotFound
+	}
+	if _, err := u.GetByID(ctx, userID); err != nil {
+		return err
+	}
+
+	err = members.Insert(&model.GroupMembership{
+		ID:      groupMembershipID(groupID, userID),
+		GroupID: groupID,
+		UserID:  userID,
+		AddedAt: time.Now(),
+	})
+	if err != nil && !mgo.IsDup(err) {
+		return err
+	}
+	recentWrites.Mark(userID)
+
+	return nil
+}
+
+// RemoveGroupMember takes userID out of the group with groupID
+func (userService) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of group memberships
+	members, err := groupMemberCollection(session)
+	if err != nil {
+		return err
+	}
+
+	err = members.RemoveId(groupMembershipID(groupID, userID))
+	if err == mgo.ErrNotFound {
+		//Tell a missing group apart from a missing member
+		groups, err := groupCollection(session)
+		if err != nil {
+			return err
+		}
+		if count, err := groups.FindId(groupID).Count(); err != nil {
+			return err
+		} else if count == 0 {
+			return errGroupNotFound
+		}
+		return errNotGroupMember
+	}
+	if err != nil {
+		return err
+	}
+	recentWrites.Mark(userID)
+
+	return nil
+}
+
+// ListUserGroups returns the groups userID belongs to, by name
+func (userService) ListUserGroups(ctx context.Context, userID string) ([]model.Group, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return groupsOf(session, userID)
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sessionTouchInterval is how often the last-seen time of a session is
+// written while its access tokens are used. Requests in between only touch
+// memory.
+var sessionTouchInterval = time.Minute
+
+// maxSessionsPerUser is how many sessions a user can have at once, no limit
+// when it's 0. A login over the limit ends the oldest sessions.
+var maxSessionsPerUser = 0
+
+var errSessionNotFound = errors.New("session not found")
+
+// clientContextKey is the request context key of where a login comes from
+const clientContextKey contextKey = "client"
+
+// clientInfo is where a request came from, recorded on the sessions it starts
+type clientInfo struct {
+	ip        string
+	userAgent string
+}
+
+// withClient returns the context of r, knowing where r came from for the
+// sessions logged in with it
+func withClient(r *http.Request) context.Context {
+	return context.WithValue(r.Context(), clientContextKey, clientInfo{ip: clientIP(r), userAgent: r.UserAgent()})
+}
+
+// clientFrom returns where the request of ctx came from, empty when nobody
+// said
+func clientFrom(ctx context.Context) clientInfo {
+	client, _ := ctx.Value(clientContextKey).(clientInfo)
+	return client
+}
+
+// sessionCollection returns the collection of sessions. Migration 0003 has
+// the database drop them along with their last refresh token.
+func sessionCollection(session *mgo.Session) (*mgo.Collection, error) {
+	return session.DB("buzz-test-user").C("sessions"), nil
+}
+
+// endUserSessions logs userID out everywhere, e.g. when an admin sets their
+// password. Their refresh tokens are purged and the access tokens of their
+// sessions stop working right away.
+func endUserSessions(session *mgo.Session, userID string) error {
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return err
+	}
+	var families []string
+	if err := refreshTokens.Find(bson.M{"user_id": userID}).Distinct("family_id", &families); err != nil {
+		return err
+	}
+
+	collection, err := sessionCollection(session)
+	if err != nil {
+		return err
+	}
+	var sessionIDs []string
+	if err := collection.Find(bson.M{"user_id": userID}).Distinct("_id", &sessionIDs); err != nil {
+		return err
+	}
+
+	for _, sessionID := range append(families, sessionIDs...) {
+		if err := revokeSessionTokens(sessionID); err != nil {
+			return err
+		}
+	}
+	if _, err := collection.RemoveAll(bson.M{"user_id": userID}); err != nil {
+		return err
+	}
+	return revokeUserRefreshTokens(refreshTokens, userID)
+}
+
+// liveSessions returns the sessions of userID that can still be refreshed,
+// most recently seen first. Sessions last while their family has a token left
+// to use.
+func liveSessions(session *mgo.Session, userID string) ([]model.Session, error) {
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	var live []string
+	liveSelector := bson.M{"user_id": userID, "used_at": bson.M{"$exists": false}, "expires_at": bson.M{"$gt": time.Now()}}
+	if err := refreshTokens.Find(liveSelector).Distinct("family_id", &live); err != nil {
+		return nil, err
+	}
+
+	collection, err := sessionCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []model.Session{}
+	err = collection.Find(bson.M{"_id": bson.M{"$in": live}, "user_id": userID}).Sort("-last_seen_at").All(&sessions)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// endSession logs out of the session with sessionID. Its refresh tokens are
+// purged and its access tokens stop working right away.
+func endSession(session *mgo.Session, sessionID string) error {
+	refreshTokens, err := refreshTokenCollection(session)
+	if err != nil {
+		return err
+	}
+	if err := revokeRefreshTokenFamily(refreshTokens, sessionID); err != nil {
+		return err
+	}
+	return revokeSessionTokens(sessionID)
+}
+
+// evictSessions ends the oldest sessions of userID while they have more than
+// maxSessionsPerUser, returning the ids of the sessions ended
+func evictSessions(session *mgo.Session, userID string) ([]string, error) {
+	if maxSessionsPerUser <= 0 {
+		return nil, nil
+	}
+	sessions, err := liveSessions(session, userID)
+	if err != nil || len(sessions) <= maxSessionsPerUser {
+		return nil, err
+	}
+
+	collection, err := sessionCollection(session)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	evicted := []string{}
+	for _, oldest := range sessions[:len(sessions)-maxSessionsPerUser] {
+		if err := collection.RemoveId(oldest.ID); err != nil && err != mgo.ErrNotFound {
+			return evicted, err
+		}
+		if err := endSession(session, oldest.ID); err != nil {
+			return evicted, err
+		}
+		evicted = append(evicted, oldest.ID)
+	}
+	return evicted, nil
+}
+
+// recordSession stores the session started by a login of userID, named
+// after its family of refresh tokens, lasting as long as its first one
+func recordSession(session *mgo.Session, sessionID, userID string, client clientInfo, ttl time.Duration) error {
+	collection, err := sessionCollection(session)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return collection.Insert(&model.Session{
+		ID:         sessionID,
+		UserID:     userID,
+		IP:         client.ip,
+		UserAgent:  client.userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	})
+}
+
+// sessionRefreshes returns how many times the session with sessionID was
+// refreshed. Sessions from before they were recorded count as never refreshed.
+func sessionRefreshes(session *mgo.Session, sessionID string) (int, error) {
+	collection, err := sessionCollection(session)
+	if err != nil {
+		return 0, err
+	}
+
+	var stored model.Session
+	err = collection.FindId(sessionID).Select(bson.M{"refreshes": 1}).One(&stored)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return stored.Refreshes, err
+}
+
+// extendSession marks the session seen now, as long as the refresh token it
+// was just handed, lasting ttl, and counts the refresh. Sessions from before
+// they were recorded have nothing to extend.
+func extendSession(session *mgo.Session, sessionID string, client clientInfo, ttl time.Duration) error {
+	collection, err := sessionCollection(session)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	update := bson.M{"last_seen_at": now, "expires_at": now.Add(ttl)}
+	if client.ip != "" {
+		update["ip"], update["user_agent"] = client.ip, client.userAgent
+	}
+	err = collection.UpdateId(sessionID, bson.M{"$set": update, "$inc": bson.M{"refreshes": 1}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// sessionTouches remembers when the sessions in use were last written as
+// seen, so busy sessions are written every sessionTouchInterval at most
+var sessionTouches = struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}{seen: map[string]time.Time{}}
+
+// touchSession marks the session with sessionID seen now, in the background.
+// It is best effort, a session that isn't marked only looks idle for longer.
+func touchSession(sessionID string) {
+	now := time.Now()
+
+	sessionTouches.mu.Lock()
+	if now.Sub(sessionTouches.seen[sessionID]) < sessionTouchInterval {
+		sessionTouches.mu.Unlock()
+		return
+	}
+	sessionTouches.seen[sessionID] = now
+	for id, seen := range sessionTouches.seen {
+		if now.Sub(seen) >= sessionTouchInterval {
+			delete(sessionTouches.seen, id)
+		}
+	}
+	sessionTouches.mu.Unlock()
+
+	go func() {
+		//Grab a copy of our session
+		session, err := getSession()
+		if err != nil {
+			log.Println("unable to mark session seen:", err)
+			return
+		}
+		defer session.Close()
+
+		collection, err := sessionCollection(session)
+		if err != nil {
+			log.Println("unable to mark session seen:", err)
+			return
+		}
+		if err := collection.UpdateId(sessionID, bson.M{"$set": bson.M{"last_seen_at": now}}); err != nil && err != mgo.ErrNotFound {
+			log.Println("unable to mark session seen:", err)
+		}
+	}()
+}
+
+// sessionOf returns the session the access token with claims belongs to,
+// empty for tokens that don't belong to one
+func sessionOf(claims map[string]interface{}) string {
+	sessionID, _ := claims["sid"].(string)
+	return sessionID
+}
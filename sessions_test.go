@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+)
+
+// sessionsService knows two sessions of userID, laptopID and phoneID
+type sessionsService struct {
+	UserService
+}
+
+func (sessionsService) ListSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	return []model.Session{{ID: "laptopID", UserID: userID}, {ID: "phoneID", UserID: userID}}, nil
+}
+
+func (sessionsService) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	if sessionID != "laptopID" && sessionID != "phoneID" {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+func TestRevokedSessionTokensAreRefused(t *testing.T) {
+	defer func(store TokenRevocationStore) { revokedTokens = store }(revokedTokens)
+	revokedTokens = newMemoryRevocationStore()
+
+	// Seen just now, so checking the tokens doesn't write to the database
+	for _, sessionID := range []string{"laptopID", "phoneID"} {
+		sessionTouches.mu.Lock()
+		sessionTouches.seen[sessionID] = time.Now()
+		sessionTouches.mu.Unlock()
+	}
+
+	laptopToken, err := generateSessionToken("userID", "testUser", "student", "", "laptopID", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phoneToken, err := generateSessionToken("userID", "testUser", "student", "", "phoneID", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(token string) int {
+		req := httptest.NewRequest("GET", "/users/userID", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get(laptopToken); code != http.StatusOK {
+		t.Fatalf("Expected the token of a live session to be let through but got: %d", code)
+	}
+	if err := revokeSessionTokens("laptopID"); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(laptopToken); code != http.StatusUnauthorized {
+		t.Errorf("Expected the token of a revoked session to be refused but got: %d", code)
+	}
+	if code := get(phoneToken); code != http.StatusOK {
+		t.Errorf("Expected the tokens of other sessions to keep working but got: %d", code)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle(SessionsPath, handleListSessions(sessionsService{})).Methods("GET")
+	router.Handle(SessionPath, handleRevokeSession(sessionsService{})).Methods("DELETE")
+
+	req := httptest.NewRequest("GET", "/users/userID/sessions", nil)
+	req = req.WithContext(context.WithValue(req.Context(), claimsContextKey, map[string]interface{}{"sub": "userID", "sid": "phoneID"}))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 but got: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var resp reqres.ListSessionsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 2 || resp.Sessions[0].Current || !resp.Sessions[1].Current {
+		t.Errorf("Expected only the session of the caller to be current but got: %+v", resp.Sessions)
+	}
+
+	for sessionID, code := range map[string]int{"laptopID": http.StatusNoContent, "unknownID": http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("DELETE", "/users/userID/sessions/"+sessionID, nil))
+		if rec.Code != code {
+			t.Errorf("Expected revoking %s to be a %d but got: %d", sessionID, code, rec.Code)
+		}
+	}
+}
+
+func TestClientFrom(t *testing.T) {
+	req := httptest.NewRequest("POST", LoginUserPath, nil)
+	req.Header.Set("User-Agent", "sessions-test/1.0")
+
+	if client := clientFrom(withClient(req)); client.ip != "192.0.2.1" || client.userAgent != "sessions-test/1.0" {
+		t.Errorf("Expected where the request came from but got: %+v", client)
+	}
+	if client := clientFrom(context.Background()); client != (clientInfo{}) {
+		t.Errorf("Expected nothing for a context without a request but got: %+v", client)
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	defer func(store TokenRevocationStore) { revokedTokens = store }(revokedTokens)
+	revokedTokens = newMemoryRevocationStore()
+	defer func(limit int) { maxSessionsPerUser = limit }(maxSessionsPerUser)
+	maxSessionsPerUser = 5
+
+	svc := userService{}
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "sessionlimit@test.com", FirstName: "session", LastName: "limit", Password: password, Role: "student", Username: "sessionLimitUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.EraseUser(context.Background(), user.ID)
+
+	var logins []*model.LoginResult
+	for i := 0; i < maxSessionsPerUser+1; i++ {
+		result, err := svc.Login(context.Background(), "sessionLimitUser", password, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		logins = append(logins, result)
+	}
+
+	// The sixth login evicts the first
+	token, err := parseToken(string(logins[0].Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest := sessionOf(token.Claims)
+	for i, result := range logins[:maxSessionsPerUser] {
+		if len(result.EvictedSessions) != 0 {
+			t.Errorf("Expected login %d not to evict a session but got: %v", i+1, result.EvictedSessions)
+		}
+	}
+	if evicted := logins[maxSessionsPerUser].EvictedSessions; len(evicted) != 1 || evicted[0] != oldest {
+		t.Errorf("Expected the oldest session %s to be evicted but got: %v", oldest, evicted)
+	}
+
+	sessions, err := svc.ListSessions(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != maxSessionsPerUser {
+		t.Errorf("Expected %d sessions left but got: %d", maxSessionsPerUser, len(sessions))
+	}
+	for _, session := range sessions {
+		if session.ID == oldest {
+			t.Errorf("Expected the oldest session to be gone but it's listed")
+		}
+	}
+	if _, err := svc.RefreshToken(context.Background(), logins[0].RefreshToken, ""); err != errInvalidRefreshToken {
+		t.Errorf("Expected the refresh token of the evicted session to be revoked but got: %v", err)
+	}
+}
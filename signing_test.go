@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceAuthMiddleware(t *testing.T) {
+	defer func(key string) { ServiceSigningKey = key }(ServiceSigningKey)
+	ServiceSigningKey = "shared-key"
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := serviceAuthMiddleware(ok)
+
+	const body = `{"usernames": ["testUser"]}`
+	signed := func(signedAt time.Time, key, sentBody string) *http.Request {
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+		req := httptest.NewRequest("POST", "/users/resolve", strings.NewReader(sentBody))
+		req.Header.Set(signatureTimestampHeader, timestamp)
+		req.Header.Set(signatureHeader, hex.EncodeToString(signRequest(key, "POST", "/users/resolve", timestamp, []byte(body))))
+		return req
+	}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"valid", signed(time.Now(), "shared-key", body), http.StatusOK},
+		{"tampered body", signed(time.Now(), "shared-key", `{"usernames": ["admin"]}`), http.StatusForbidden},
+		{"wrong key", signed(time.Now(), "other-key", body), http.StatusForbidden},
+		{"replayed", signed(time.Now().Add(-signatureWindow-time.Minute), "shared-key", body), http.StatusForbidden},
+		{"unsigned", httptest.NewRequest("POST", "/users/resolve", strings.NewReader(body)), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, test.req)
+		if rec.Code != test.code {
+			t.Errorf("%s: expected a %d status code response but got: %d", test.name, test.code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+var (
+	// slowQueryLog turns on logging the service calls that take longer than
+	// slowQueryThreshold
+	slowQueryLog = false
+
+	// slowQueryThreshold is how long a service call can take before it is
+	// logged as slow
+	slowQueryThreshold = 500 * time.Millisecond
+)
+
+// userServiceSlowQueryMiddleware times every service call and reports the
+// ones slower than the threshold. Only the name of the call and how long it
+// took are reported, never its arguments, which can be passwords and tokens.
+type userServiceSlowQueryMiddleware struct {
+	UserService
+	threshold time.Duration
+	report    func(operation string, elapsed time.Duration)
+}
+
+func newUserServiceSlowQueryMiddleware(svc UserService, threshold time.Duration, report func(operation string, elapsed time.Duration)) userServiceSlowQueryMiddleware {
+	return userServiceSlowQueryMiddleware{UserService: svc, threshold: threshold, report: report}
+}
+
+// observe reports operation when it has been running since start for longer
+// than the threshold
+func (mw userServiceSlowQueryMiddleware) observe(operation string, start time.Time) {
+	if elapsed := time.Since(start); elapsed > mw.threshold {
+		mw.report(operation, elapsed)
+	}
+}
+
+func (mw userServiceSlowQueryMiddleware) AcceptInvitation(ctx context.Context, token, password string) (*model.User, error) {
+	defer mw.observe("AcceptInvitation", time.Now())
+	return mw.UserService.AcceptInvitation(ctx, token, password)
+}
+
+func (mw userServiceSlowQueryMiddleware) CheckInvitation(ctx context.Context, token string) (*model.Invitation, *model.User, error) {
+	defer mw.observe("CheckInvitation", time.Now())
+	return mw.UserService.CheckInvitation(ctx, token)
+}
+
+func (mw userServiceSlowQueryMiddleware) AcceptTOS(ctx context.Context, userID, version string) error {
+	defer mw.observe("AcceptTOS", time.Now())
+	return mw.UserService.AcceptTOS(ctx, userID, version)
+}
+
+func (mw userServiceSlowQueryMiddleware) AddGroupMember(ctx context.Context, groupID, userID string) error {
+	defer mw.observe("AddGroupMember", time.Now())
+	return mw.UserService.AddGroupMember(ctx, groupID, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) CancelClose(ctx context.Context, username, password string) (*model.User, error) {
+	defer mw.observe("CancelClose", time.Now())
+	return mw.UserService.CancelClose(ctx, username, password)
+}
+
+func (mw userServiceSlowQueryMiddleware) ChangePassword(ctx context.Context, id, currentPassword, newPassword string) error {
+	defer mw.observe("ChangePassword", time.Now())
+	return mw.UserService.ChangePassword(ctx, id, currentPassword, newPassword)
+}
+
+func (mw userServiceSlowQueryMiddleware) CloseAccount(ctx context.Context, id string) (*model.User, error) {
+	defer mw.observe("CloseAccount", time.Now())
+	return mw.UserService.CloseAccount(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) CollectTokenGarbage(ctx context.Context, now time.Time) (*model.TokenGarbage, error) {
+	defer mw.observe("CollectTokenGarbage", time.Now())
+	return mw.UserService.CollectTokenGarbage(ctx, now)
+}
+
+func (mw userServiceSlowQueryMiddleware) Create(ctx context.Context, newUser *model.CreateUser) (*model.User, error) {
+	defer mw.observe("Create", time.Now())
+	return mw.UserService.Create(ctx, newUser)
+}
+
+func (mw userServiceSlowQueryMiddleware) CreateAPIKey(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (*model.APIKey, string, error) {
+	defer mw.observe("CreateAPIKey", time.Now())
+	return mw.UserService.CreateAPIKey(ctx, userID, name, scopes, expiresAt)
+}
+
+func (mw userServiceSlowQueryMiddleware) CreateChallenge(ctx context.Context, userID string) (time.Time, error) {
+	defer mw.observe("CreateChallenge", time.Now())
+	return mw.UserService.CreateChallenge(ctx, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) CreateGroup(ctx context.Context, name, description string) (*model.Group, error) {
+	defer mw.observe("CreateGroup", time.Now())
+	return mw.UserService.CreateGroup(ctx, name, description)
+}
+
+func (mw userServiceSlowQueryMiddleware) CreatePasswordReset(ctx context.Context, email string) error {
+	defer mw.observe("CreatePasswordReset", time.Now())
+	return mw.UserService.CreatePasswordReset(ctx, email)
+}
+
+func (mw userServiceSlowQueryMiddleware) DeactivateInactive(ctx context.Context, cutoff time.Time, dryRun bool) ([]string, error) {
+	defer mw.observe("DeactivateInactive", time.Now())
+	return mw.UserService.DeactivateInactive(ctx, cutoff, dryRun)
+}
+
+func (mw userServiceSlowQueryMiddleware) Delete(ctx context.Context, id string) error {
+	defer mw.observe("Delete", time.Now())
+	return mw.UserService.Delete(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) DeleteGroup(ctx context.Context, id string) error {
+	defer mw.observe("DeleteGroup", time.Now())
+	return mw.UserService.DeleteGroup(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) EndSession(ctx context.Context, userID, refreshToken string) error {
+	defer mw.observe("EndSession", time.Now())
+	return mw.UserService.EndSession(ctx, userID, refreshToken)
+}
+
+func (mw userServiceSlowQueryMiddleware) EraseUser(ctx context.Context, id string) error {
+	defer mw.observe("EraseUser", time.Now())
+	return mw.UserService.EraseUser(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) ExportUser(ctx context.Context, id string) (*model.UserExport, error) {
+	defer mw.observe("ExportUser", time.Now())
+	return mw.UserService.ExportUser(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetAll(ctx context.Context) ([]model.User, error) {
+	defer mw.observe("GetAll", time.Now())
+	return mw.UserService.GetAll(ctx)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetByEmail(ctx context.Context, email string) (*model.User, error) {
+	defer mw.observe("GetByEmail", time.Now())
+	return mw.UserService.GetByEmail(ctx, email)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetByID(ctx context.Context, id string) (*model.User, error) {
+	defer mw.observe("GetByID", time.Now())
+	return mw.UserService.GetByID(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetByIDIncludingDeleted(ctx context.Context, id string) (*model.User, error) {
+	defer mw.observe("GetByIDIncludingDeleted", time.Now())
+	return mw.UserService.GetByIDIncludingDeleted(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	defer mw.observe("GetByUsername", time.Now())
+	return mw.UserService.GetByUsername(ctx, username)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetChanges(ctx context.Context, since time.Time, cursor string, limit int) ([]model.UserChange, string, error) {
+	defer mw.observe("GetChanges", time.Now())
+	return mw.UserService.GetChanges(ctx, since, cursor, limit)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetDuplicates(ctx context.Context, criteria []string, offset, limit int) ([]model.DuplicateGroup, int, error) {
+	defer mw.observe("GetDuplicates", time.Now())
+	return mw.UserService.GetDuplicates(ctx, criteria, offset, limit)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetGroup(ctx context.Context, id string) (*model.Group, error) {
+	defer mw.observe("GetGroup", time.Now())
+	return mw.UserService.GetGroup(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetLoginAttempts(ctx context.Context, userID string) ([]model.LoginAttempt, error) {
+	defer mw.observe("GetLoginAttempts", time.Now())
+	return mw.UserService.GetLoginAttempts(ctx, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetSecurityEvents(ctx context.Context, userID string, opts model.ListOptions) ([]model.SecurityEvent, int, error) {
+	defer mw.observe("GetSecurityEvents", time.Now())
+	return mw.UserService.GetSecurityEvents(ctx, userID, opts)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetSecurityReport(ctx context.Context, userID string, from, to time.Time) (*model.SecurityReport, error) {
+	defer mw.observe("GetSecurityReport", time.Now())
+	return mw.UserService.GetSecurityReport(ctx, userID, from, to)
+}
+
+func (mw userServiceSlowQueryMiddleware) GetStats(ctx context.Context) (*model.UserStats, error) {
+	defer mw.observe("GetStats", time.Now())
+	return mw.UserService.GetStats(ctx)
+}
+
+func (mw userServiceSlowQueryMiddleware) InviteUser(ctx context.Context, invitee *model.CreateUser, invitedBy string) (*model.Invitation, error) {
+	defer mw.observe("InviteUser", time.Now())
+	return mw.UserService.InviteUser(ctx, invitee, invitedBy)
+}
+
+func (mw userServiceSlowQueryMiddleware) LinkIdentity(ctx context.Context, userID string, profile *model.ExternalProfile) (*model.User, error) {
+	defer mw.observe("LinkIdentity", time.Now())
+	return mw.UserService.LinkIdentity(ctx, userID, profile)
+}
+
+func (mw userServiceSlowQueryMiddleware) List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	defer mw.observe("List", time.Now())
+	return mw.UserService.List(ctx, opts)
+}
+
+func (mw userServiceSlowQueryMiddleware) ListAPIKeys(ctx context.Context, userID string) ([]model.APIKey, error) {
+	defer mw.observe("ListAPIKeys", time.Now())
+	return mw.UserService.ListAPIKeys(ctx, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) ListGroups(ctx context.Context, opts model.ListOptions) ([]model.Group, int, error) {
+	defer mw.observe("ListGroups", time.Now())
+	return mw.UserService.ListGroups(ctx, opts)
+}
+
+func (mw userServiceSlowQueryMiddleware) ListInvitations(ctx context.Context, opts model.ListOptions) ([]model.Invitation, int, error) {
+	defer mw.observe("ListInvitations", time.Now())
+	return mw.UserService.ListInvitations(ctx, opts)
+}
+
+func (mw userServiceSlowQueryMiddleware) ListSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	defer mw.observe("ListSessions", time.Now())
+	return mw.UserService.ListSessions(ctx, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) ListUserGroups(ctx context.Context, userID string) ([]model.Group, error) {
+	defer mw.observe("ListUserGroups", time.Now())
+	return mw.UserService.ListUserGroups(ctx, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	defer mw.observe("Login", time.Now())
+	return mw.UserService.Login(ctx, username, password, referer)
+}
+
+func (mw userServiceSlowQueryMiddleware) LoginWithProvider(ctx context.Context, profile *model.ExternalProfile, referer string) (*model.LoginResult, error) {
+	defer mw.observe("LoginWithProvider", time.Now())
+	return mw.UserService.LoginWithProvider(ctx, profile, referer)
+}
+
+func (mw userServiceSlowQueryMiddleware) Ping(ctx context.Context) error {
+	defer mw.observe("Ping", time.Now())
+	return mw.UserService.Ping(ctx)
+}
+
+func (mw userServiceSlowQueryMiddleware) PurgeClosedAccounts(ctx context.Context, now time.Time) ([]string, error) {
+	defer mw.observe("PurgeClosedAccounts", time.Now())
+	return mw.UserService.PurgeClosedAccounts(ctx, now)
+}
+
+func (mw userServiceSlowQueryMiddleware) Reactivate(ctx context.Context, id string) (*model.User, error) {
+	defer mw.observe("Reactivate", time.Now())
+	return mw.UserService.Reactivate(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) RefreshToken(ctx context.Context, refreshToken, origin string) (*model.LoginResult, error) {
+	defer mw.observe("RefreshToken", time.Now())
+	return mw.UserService.RefreshToken(ctx, refreshToken, origin)
+}
+
+func (mw userServiceSlowQueryMiddleware) ReissueID(ctx context.Context, id string) (*model.User, error) {
+	defer mw.observe("ReissueID", time.Now())
+	return mw.UserService.ReissueID(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) ReleaseUsername(ctx context.Context, username, token string) error {
+	defer mw.observe("ReleaseUsername", time.Now())
+	return mw.UserService.ReleaseUsername(ctx, username, token)
+}
+
+func (mw userServiceSlowQueryMiddleware) Remove(ctx context.Context, id string) error {
+	defer mw.observe("Remove", time.Now())
+	return mw.UserService.Remove(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) RemoveGroupMember(ctx context.Context, groupID, userID string) error {
+	defer mw.observe("RemoveGroupMember", time.Now())
+	return mw.UserService.RemoveGroupMember(ctx, groupID, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) ReserveUsername(ctx context.Context, username string) (string, time.Time, error) {
+	defer mw.observe("ReserveUsername", time.Now())
+	return mw.UserService.ReserveUsername(ctx, username)
+}
+
+func (mw userServiceSlowQueryMiddleware) ResendVerification(ctx context.Context, email string) error {
+	defer mw.observe("ResendVerification", time.Now())
+	return mw.UserService.ResendVerification(ctx, email)
+}
+
+func (mw userServiceSlowQueryMiddleware) ResetPassword(ctx context.Context, token, newPassword string) (*model.User, error) {
+	defer mw.observe("ResetPassword", time.Now())
+	return mw.UserService.ResetPassword(ctx, token, newPassword)
+}
+
+func (mw userServiceSlowQueryMiddleware) ResolveUsernames(ctx context.Context, usernames []string) ([]model.ResolvedUser, error) {
+	defer mw.observe("ResolveUsernames", time.Now())
+	return mw.UserService.ResolveUsernames(ctx, usernames)
+}
+
+func (mw userServiceSlowQueryMiddleware) Revoke(ctx context.Context, tokenID string, expiry time.Time) error {
+	defer mw.observe("Revoke", time.Now())
+	return mw.UserService.Revoke(ctx, tokenID, expiry)
+}
+
+func (mw userServiceSlowQueryMiddleware) RevokeAPIKey(ctx context.Context, userID, keyID string) error {
+	defer mw.observe("RevokeAPIKey", time.Now())
+	return mw.UserService.RevokeAPIKey(ctx, userID, keyID)
+}
+
+func (mw userServiceSlowQueryMiddleware) RevokeInvitation(ctx context.Context, id string) error {
+	defer mw.observe("RevokeInvitation", time.Now())
+	return mw.UserService.RevokeInvitation(ctx, id)
+}
+
+func (mw userServiceSlowQueryMiddleware) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	defer mw.observe("RevokeSession", time.Now())
+	return mw.UserService.RevokeSession(ctx, userID, sessionID)
+}
+
+func (mw userServiceSlowQueryMiddleware) InvalidateResetTokens(ctx context.Context, userID string) (int, error) {
+	defer mw.observe("InvalidateResetTokens", time.Now())
+	return mw.UserService.InvalidateResetTokens(ctx, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) RevokeSessions(ctx context.Context, userID string) error {
+	defer mw.observe("RevokeSessions", time.Now())
+	return mw.UserService.RevokeSessions(ctx, userID)
+}
+
+func (mw userServiceSlowQueryMiddleware) Search(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	defer mw.observe("Search", time.Now())
+	return mw.UserService.Search(ctx, opts)
+}
+
+func (mw userServiceSlowQueryMiddleware) SetStatus(ctx context.Context, id, status string) (*model.User, error) {
+	defer mw.observe("SetStatus", time.Now())
+	return mw.UserService.SetStatus(ctx, id, status)
+}
+
+func (mw userServiceSlowQueryMiddleware) UnlinkIdentity(ctx context.Context, userID, provider string) (*model.User, error) {
+	defer mw.observe("UnlinkIdentity", time.Now())
+	return mw.UserService.UnlinkIdentity(ctx, userID, provider)
+}
+
+func (mw userServiceSlowQueryMiddleware) Update(ctx context.Context, id string, updatedUser *model.UpdateUser) (*model.User, error) {
+	defer mw.observe("Update", time.Now())
+	return mw.UserService.Update(ctx, id, updatedUser)
+}
+
+func (mw userServiceSlowQueryMiddleware) UpdateAttributes(ctx context.Context, id string, update *model.AttributeUpdate) (*model.User, error) {
+	defer mw.observe("UpdateAttributes", time.Now())
+	return mw.UserService.UpdateAttributes(ctx, id, update)
+}
+
+func (mw userServiceSlowQueryMiddleware) UpdateGroup(ctx context.Context, id string, update *model.UpdateGroup) (*model.Group, error) {
+	defer mw.observe("UpdateGroup", time.Now())
+	return mw.UserService.UpdateGroup(ctx, id, update)
+}
+
+func (mw userServiceSlowQueryMiddleware) VerifyChallenge(ctx context.Context, userID, code string) (string, time.Time, error) {
+	defer mw.observe("VerifyChallenge", time.Now())
+	return mw.UserService.VerifyChallenge(ctx, userID, code)
+}
+
+func (mw userServiceSlowQueryMiddleware) VerifyEmail(ctx context.Context, token string) (*model.User, error) {
+	defer mw.observe("VerifyEmail", time.Now())
+	return mw.UserService.VerifyEmail(ctx, token)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// slowUserService takes its time looking users up, without a database
+type slowUserService struct {
+	UserService
+	delay time.Duration
+}
+
+func (svc slowUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	time.Sleep(svc.delay)
+	return &model.User{ID: id}, nil
+}
+
+func TestSlowQueryMiddleware(t *testing.T) {
+	reported := map[string]time.Duration{}
+	report := func(operation string, elapsed time.Duration) { reported[operation] = elapsed }
+
+	svc := newUserServiceSlowQueryMiddleware(slowUserService{delay: 20 * time.Millisecond}, 10*time.Millisecond, report)
+	user, err := svc.GetByID(context.Background(), "slowID")
+	if err != nil || user.ID != "slowID" {
+		t.Fatalf("Expected the call to go through but got: %v %v", user, err)
+	}
+	if elapsed, ok := reported["GetByID"]; !ok || elapsed < 20*time.Millisecond {
+		t.Errorf("Expected the slow call to be reported with how long it took but got: %v", reported)
+	}
+
+	reported = map[string]time.Duration{}
+	svc = newUserServiceSlowQueryMiddleware(slowUserService{}, time.Second, report)
+	svc.GetByID(context.Background(), "fastID")
+	if len(reported) != 0 {
+		t.Errorf("Expected fast calls not to be reported but got: %v", reported)
+	}
+}
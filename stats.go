@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// statsCacheTTL is how long user statistics are reused before being counted
+// again, 0 counts them on every request
+var statsCacheTTL = 30 * time.Second
+
+// userServiceStatsCacheMiddleware reuses the user statistics for a while, so a
+// dashboard refreshing often doesn't count the whole store every time. Errors
+// aren't cached.
+type userServiceStatsCacheMiddleware struct {
+	UserService
+	ttl   time.Duration
+	mu    *sync.Mutex
+	cache *cachedStats
+}
+
+type cachedStats struct {
+	stats     *model.UserStats
+	expiresAt time.Time
+}
+
+func newUserServiceStatsCacheMiddleware(svc UserService, ttl time.Duration) userServiceStatsCacheMiddleware {
+	return userServiceStatsCacheMiddleware{UserService: svc, ttl: ttl, mu: &sync.Mutex{}, cache: &cachedStats{}}
+}
+
+func (mw userServiceStatsCacheMiddleware) GetStats(ctx context.Context) (*model.UserStats, error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	if mw.cache.stats == nil || !time.Now().Before(mw.cache.expiresAt) {
+		stats, err := mw.UserService.GetStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		mw.cache.stats = stats
+		mw.cache.expiresAt = time.Now().Add(mw.ttl)
+	}
+
+	// Every caller gets its own copy to change as it likes
+	stats := *mw.cache.stats
+	return &stats, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+// countingStatsService counts the statistics it is asked for
+type countingStatsService struct {
+	UserService
+	calls int
+	err   error
+}
+
+func (s *countingStatsService) GetStats(ctx context.Context) (*model.UserStats, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &model.UserStats{TotalUsers: s.calls}, nil
+}
+
+func TestStatsCache(t *testing.T) {
+	store := &countingStatsService{}
+	svc := newUserServiceStatsCacheMiddleware(store, 20*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		stats, err := svc.GetStats(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.TotalUsers != 1 {
+			t.Errorf("Expected the cached statistics but got: %+v", stats)
+		}
+	}
+	if store.calls != 1 {
+		t.Errorf("Expected the statistics to be counted once but got: %d", store.calls)
+	}
+
+	// Stale statistics are counted again, and errors aren't cached
+	time.Sleep(30 * time.Millisecond)
+	store.err = errors.New("unreachable")
+	if _, err := svc.GetStats(context.Background()); err == nil {
+		t.Error("Expected the error of counting the statistics")
+	}
+	store.err = nil
+	if stats, err := svc.GetStats(context.Background()); err != nil || stats.TotalUsers != 3 {
+		t.Errorf("Expected fresh statistics but got: %+v %v", stats, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Account statuses
+const (
+	statusPending     = "pending"
+	statusInvited     = "invited"
+	statusActive      = "active"
+	statusDeactivated = "deactivated"
+	statusLocked      = "locked"
+	statusDeleted     = "deleted"
+)
+
+// statusTransitions lists the statuses an account can move to from each
+// status. Deleted accounts only come back by being reactivated, invited ones
+// only become active by accepting their invite.
+var statusTransitions = map[string][]string{
+	statusPending:     {statusActive, statusDeleted},
+	statusInvited:     {statusDeleted},
+	statusActive:      {statusDeactivated, statusLocked, statusDeleted},
+	statusDeactivated: {statusActive, statusDeleted},
+	statusLocked:      {statusActive, statusDeleted},
+	statusDeleted:     {},
+}
+
+var (
+	errNotDeleted = errors.New("account isn't deleted")
+	errUserErased = errors.New("account was erased, there's nothing left to reactivate")
+)
+
+// statusTransitionError is returned when an account can't move from one
+// status to another
+type statusTransitionError struct {
+	from string
+	to   string
+}
+
+func (e statusTransitionError) Error() string {
+	return fmt.Sprintf("an account can't go from %s to %s", e.from, e.to)
+}
+
+func isValidStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// accountStatus returns the status of an account. Accounts created before
+// statuses existed are active.
+func accountStatus(status string) string {
+	if status == "" {
+		return statusActive
+	}
+	return status
+}
+
+// checkStatusTransition makes sure an account can move from one status to
+// another
+func checkStatusTransition(from, to string) error {
+	from = accountStatus(from)
+	for _, allowed := range statusTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return statusTransitionError{from: from, to: to}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestCheckStatusTransition(t *testing.T) {
+	tests := []struct {
+		from  string
+		to    string
+		valid bool
+	}{
+		{statusPending, statusActive, true},
+		{statusActive, statusLocked, true},
+		{statusLocked, statusActive, true},
+		{statusActive, statusDeactivated, true},
+		{statusDeactivated, statusDeleted, true},
+		{"", statusLocked, true}, // accounts from before statuses are active
+		{statusDeleted, statusActive, false},
+		{statusPending, statusLocked, false},
+		{statusActive, statusActive, false},
+		{statusActive, statusPending, false},
+	}
+
+	for _, test := range tests {
+		err := checkStatusTransition(test.from, test.to)
+		if test.valid && err != nil {
+			t.Errorf("Expected %q to %q to be allowed but got: %v", test.from, test.to, err)
+		}
+		if !test.valid {
+			if _, ok := err.(statusTransitionError); !ok {
+				t.Errorf("Expected %q to %q to be refused but got: %v", test.from, test.to, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+)
+
+// serviceTimeout is how long a service call may take before the request gets
+// a 503, so a hung database doesn't hold connections forever. Zero disables it.
+var serviceTimeout = 10 * time.Second
+
+var errServiceTimeout = errors.New("the service took too long to respond, try again later")
+
+// userServiceTimeoutMiddleware bounds the service calls users wait on the most
+// by a timeout, and gives up on them as soon as their context is cancelled.
+// The other calls only give up once their context is done between queries.
+type userServiceTimeoutMiddleware struct {
+	UserService
+	timeout time.Duration
+}
+
+func newUserServiceTimeoutMiddleware(svc UserService, timeout time.Duration) userServiceTimeoutMiddleware {
+	return userServiceTimeoutMiddleware{UserService: svc, timeout: timeout}
+}
+
+func (mw userServiceTimeoutMiddleware) Create(ctx context.Context, newUser *model.CreateUser) (*model.User, error) {
+	var user *model.User
+	err := withTimeout(ctx, mw.timeout, func(ctx context.Context) (err error) {
+		user, err = mw.UserService.Create(ctx, newUser)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (mw userServiceTimeoutMiddleware) GetByID(ctx context.Context, id string) (*model.User, error) {
+	var user *model.User
+	err := withTimeout(ctx, mw.timeout, func(ctx context.Context) (err error) {
+		user, err = mw.UserService.GetByID(ctx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (mw userServiceTimeoutMiddleware) GetByIDIncludingDeleted(ctx context.Context, id string) (*model.User, error) {
+	var user *model.User
+	err := withTimeout(ctx, mw.timeout, func(ctx context.Context) (err error) {
+		user, err = mw.UserService.GetByIDIncludingDeleted(ctx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (mw userServiceTimeoutMiddleware) Login(ctx context.Context, username, password, referer string) (*model.LoginResult, error) {
+	var result *model.LoginResult
+	err := withTimeout(ctx, mw.timeout, func(ctx context.Context) (err error) {
+		result, err = mw.UserService.Login(ctx, username, password, referer)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (mw userServiceTimeoutMiddleware) LoginWithProvider(ctx context.Context, profile *model.ExternalProfile, referer string) (*model.LoginResult, error) {
+	var result *model.LoginResult
+	err := withTimeout(ctx, mw.timeout, func(ctx context.Context) (err error) {
+		result, err = mw.UserService.LoginWithProvider(ctx, profile, referer)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (mw userServiceTimeoutMiddleware) RefreshToken(ctx context.Context, refreshToken, origin string) (*model.LoginResult, error) {
+	var result *model.LoginResult
+	err := withTimeout(ctx, mw.timeout, func(ctx context.Context) (err error) {
+		result, err = mw.UserService.RefreshToken(ctx, refreshToken, origin)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (mw userServiceTimeoutMiddleware) Ping(ctx context.Context) error {
+	return withTimeout(ctx, mw.timeout, mw.UserService.Ping)
+}
+
+// withTimeout runs call with ctx bounded by timeout, returning as soon as ctx
+// is done. Running out of time gives errServiceTimeout. mgo queries can't be
+// interrupted, so an abandoned call carries on until its socket times out.
+func withTimeout(ctx context.Context, timeout time.Duration, call func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		// Queries failing at the deadline fail because of it
+		if err != nil && ctx.Err() != nil {
+			return contextError(ctx.Err())
+		}
+		return err
+	case <-ctx.Done():
+		return contextError(ctx.Err())
+	}
+}
+
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return errServiceTimeout
+	}
+	return err
+}
+
+// boundSession makes the queries of session give up at the deadline of ctx,
+// closing it if ctx is already done
+func boundSession(ctx context.Context, session *mgo.Session) (*mgo.Session, error) {
+	if err := ctx.Err(); err != nil {
+		session.Close()
+		return nil, contextError(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		session.SetSocketTimeout(deadline.Sub(time.Now()))
+	}
+	return session, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"github.com/buzzapp/user/reqres"
+	"github.com/gorilla/mux"
+)
+
+// hungUserService never answers a GetByID before its context is done
+type hungUserService struct {
+	UserService
+}
+
+func (hungUserService) GetByID(ctx context.Context, id string) (*model.User, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestServiceTimeout(t *testing.T) {
+	svc := newUserServiceTimeoutMiddleware(hungUserService{}, 20*time.Millisecond)
+
+	start := time.Now()
+	if _, err := svc.GetByID(context.Background(), "id"); err != errServiceTimeout {
+		t.Errorf("Expected a hung call to time out but got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the call to give up at the timeout but it took: %v", elapsed)
+	}
+
+	// Clients going away isn't a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := svc.GetByID(ctx, "id"); err != context.Canceled {
+		t.Errorf("Expected a cancelled call to fail with context.Canceled but got: %v", err)
+	}
+}
+
+func TestServiceTimeoutHTTPEndpoint(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle("/users/{id}", handleGetUserByID(newUserServiceTimeoutMiddleware(hungUserService{}, 20*time.Millisecond)))
+
+	req := httptest.NewRequest("GET", "/users/hungID", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 status code response but got: %d", rec.Code)
+	}
+	var payload = &reqres.ErrorResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Code != serviceUnavailableCode {
+		t.Errorf("Expected the %s code but got: %s", serviceUnavailableCode, payload.Code)
+	}
+
+	// Clients that went away get a response nobody reads, not a panic
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code != statusClientClosedRequest {
+		t.Errorf("Expected a %d status code response but got: %d", statusClientClosedRequest, rec.Code)
+	}
+}
+
+func TestCoalescedGetByIDCallerGivesUp(t *testing.T) {
+	store := &countingUserService{delay: 50 * time.Millisecond}
+	svc := newUserServiceCoalescingMiddleware(store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	gaveUp := make(chan struct{})
+	go func() {
+		defer close(gaveUp)
+		if _, err := svc.GetByID(ctx, "hotID"); err != errServiceTimeout {
+			t.Errorf("Expected the impatient caller to time out but got: %v", err)
+		}
+	}()
+
+	// Others sharing the query still get the user
+	time.Sleep(time.Millisecond)
+	if user, err := svc.GetByID(context.Background(), "hotID"); err != nil || user.ID != "hotID" {
+		t.Errorf("Expected the patient caller to get the user but got: %v", err)
+	}
+	<-gaveUp
+}
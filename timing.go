@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases of a request reported in the Server-Timing header. Validation
+// includes reading the request, and db covers the calls to the service.
+const (
+	phaseValidation    = "validation"
+	phaseDB            = "db"
+	phaseSerialization = "serialization"
+)
+
+// serverTiming adds a Server-Timing header breaking down the time spent on
+// each request. Nothing is recorded when it's off.
+var serverTiming = false
+
+// timingsContextKey is the request context key of the request's timings
+const timingsContextKey contextKey = "timings"
+
+// requestTimings records how long each phase of a request took
+type requestTimings struct {
+	mu        sync.Mutex
+	start     time.Time
+	lastMark  time.Time
+	names     []string
+	durations map[string]time.Duration
+}
+
+// markPhase records that a phase of the request ended now. It started when the
+// previous phase ended, or with the request. Repeated phases add up.
+func markPhase(r *http.Request, name string) {
+	timings, ok := r.Context().Value(timingsContextKey).(*requestTimings)
+	if !ok {
+		return
+	}
+
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := timings.durations[name]; !ok {
+		timings.names = append(timings.names, name)
+	}
+	timings.durations[name] += now.Sub(timings.lastMark)
+	timings.lastMark = now
+}
+
+// header formats the timings as a Server-Timing header value
+func (t *requestTimings) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	metrics := make([]string, 0, len(t.names)+1)
+	for _, name := range t.names {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", name, milliseconds(t.durations[name])))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", milliseconds(time.Since(t.start))))
+	return strings.Join(metrics, ", ")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// serverTimingMiddleware records the timings of each request and adds them to
+// the response headers when serverTiming is on
+func serverTimingMiddleware(next http.Handler) http.Handler {
+	if !serverTiming {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		timings := &requestTimings{start: now, lastMark: now, durations: make(map[string]time.Duration)}
+
+		ctx := context.WithValue(r.Context(), timingsContextKey, timings)
+		next.ServeHTTP(&timingResponseWriter{ResponseWriter: w, timings: timings}, r.WithContext(ctx))
+	})
+}
+
+// timingResponseWriter adds the Server-Timing header just before the
+// response headers are sent
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timings     *requestTimings
+	wroteHeader bool
+}
+
+func (w *timingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.timings.header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what was written so far, so streamed responses aren't held back
+func (w *timingResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
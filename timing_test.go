@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerTimingHeader(t *testing.T) {
+	defer func(enabled bool) { serverTiming = enabled }(serverTiming)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		markPhase(r, phaseValidation)
+		markPhase(r, phaseDB)
+		markPhase(r, phaseDB)
+		markPhase(r, phaseSerialization)
+		w.Write([]byte("{}"))
+	})
+
+	serverTiming = true
+	rec := httptest.NewRecorder()
+	serverTimingMiddleware(handler).ServeHTTP(rec, httptest.NewRequest("GET", "/users/id", nil))
+
+	header := rec.Header().Get("Server-Timing")
+	for _, metric := range []string{"validation;dur=", "db;dur=", "serialization;dur=", "total;dur="} {
+		if !strings.Contains(header, metric) {
+			t.Errorf("Expected %q in the Server-Timing header but got: %q", metric, header)
+		}
+	}
+	if strings.Count(header, "db;dur=") != 1 {
+		t.Errorf("Expected repeated phases to be reported once but got: %q", header)
+	}
+
+	serverTiming = false
+	rec = httptest.NewRecorder()
+	serverTimingMiddleware(handler).ServeHTTP(rec, httptest.NewRequest("GET", "/users/id", nil))
+	if rec.Header().Get("Server-Timing") != "" {
+		t.Error("Expected no Server-Timing header when disabled")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// TokenBucketStore is an interface for token buckets kept per key. Stores
+// backed by a shared database let every instance draw from the same buckets.
+type TokenBucketStore interface {
+	// Take takes a token from the bucket of key, which holds up to capacity
+	// tokens and refills completely over period
+	Take(key string, capacity int, period time.Duration) (bucketState, error)
+}
+
+// bucketState is what's left of a bucket after taking a token from it
+type bucketState struct {
+	// allowed reports whether there was a token to take
+	allowed bool
+
+	// remaining is how many tokens are left
+	remaining int
+
+	// retryAfter is how long until there is a token again, when there was
+	// none
+	retryAfter time.Duration
+
+	// resetIn is how long until the bucket is full again
+	resetIn time.Duration
+}
+
+// takeToken refills a bucket holding tokens, last refilled elapsed ago, and
+// takes a token from it, returning what's left. Buckets refill steadily, one
+// token every period/capacity.
+func takeToken(tokens float64, elapsed time.Duration, capacity int, period time.Duration) (float64, bucketState) {
+	perToken := period / time.Duration(capacity)
+	tokens = math.Min(float64(capacity), tokens+float64(elapsed)/float64(perToken))
+
+	state := bucketState{allowed: tokens >= 1}
+	if state.allowed {
+		tokens--
+	} else {
+		state.retryAfter = time.Duration((1 - tokens) * float64(perToken))
+	}
+	state.remaining = int(tokens)
+	state.resetIn = time.Duration((float64(capacity) - tokens) * float64(perToken))
+	return tokens, state
+}
+
+// memoryTokenBucketStore keeps the buckets in memory, which is only suitable
+// when running a single instance
+type memoryTokenBucketStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucketEntry
+	now       func() time.Time
+	nextSweep time.Time
+}
+
+// tokenBucketSweepInterval is how often the memory store drops the buckets
+// that are full again. Between sweeps they are kept, which is harmless as a
+// bucket left alone refills all the same.
+var tokenBucketSweepInterval = time.Minute
+
+type tokenBucketEntry struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+func newMemoryTokenBucketStore() *memoryTokenBucketStore {
+	return &memoryTokenBucketStore{
+		buckets: make(map[string]*tokenBucketEntry),
+		now:     time.Now,
+	}
+}
+
+func (s *memoryTokenBucketStore) Take(key string, capacity int, period time.Duration) (bucketState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	// Full buckets are the same as missing ones, so they can be dropped. Going
+	// through all of them on every request would cost as much as there are
+	// clients, so that's only done once in a while.
+	if !now.Before(s.nextSweep) {
+		for k, bucket := range s.buckets {
+			if !now.Before(bucket.fullAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.nextSweep = now.Add(tokenBucketSweepInterval)
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucketEntry{tokens: float64(capacity), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens, state := takeToken(bucket.tokens, now.Sub(bucket.updatedAt), capacity, period)
+	bucket.tokens, bucket.updatedAt, bucket.fullAt = tokens, now, now.Add(state.resetIn)
+	return state, nil
+}
+
+// takeTokenScript is takeToken in Redis, atomically so concurrent instances
+// can't take the same token. Buckets expire once they would be full again.
+var takeTokenScript = redis.NewScript(1, `
+local capacity = tonumber(ARGV[1])
+local per_token = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated_at")
+local tokens = tonumber(bucket[1]) or capacity
+local updated_at = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated_at) / per_token)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+local reset_in = math.ceil((capacity - tokens) * per_token)
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated_at", now)
+redis.call("PEXPIRE", KEYS[1], math.max(1, reset_in))
+return {allowed, math.floor(tokens), math.ceil((1 - tokens) * per_token), reset_in}
+`)
+
+// redisTokenBucketStore keeps the buckets in Redis so limits are shared
+// across instances
+type redisTokenBucketStore struct {
+	pool *redis.Pool
+}
+
+func (s redisTokenBucketStore) Take(key string, capacity int, period time.Duration) (bucketState, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	perToken := float64(period/time.Millisecond) / float64(capacity)
+	values, err := redis.Int64s(takeTokenScript.Do(conn, "tokenbucket:"+key, capacity, strconv.FormatFloat(perToken, 'f', -1, 64), time.Now().UnixNano()/int64(time.Millisecond)))
+	if err != nil {
+		return bucketState{}, err
+	}
+
+	state := bucketState{
+		allowed:   values[0] == 1,
+		remaining: int(values[1]),
+		resetIn:   time.Duration(values[3]) * time.Millisecond,
+	}
+	if !state.allowed {
+		state.retryAfter = time.Duration(values[2]) * time.Millisecond
+	}
+	return state, nil
+}
+
+// tokenBucket allows bursts of up to capacity requests per key, refilling
+// completely over period
+type tokenBucket struct {
+	store    TokenBucketStore
+	prefix   string
+	capacity int
+	period   time.Duration
+}
+
+func newTokenBucket(store TokenBucketStore, prefix string, capacity int, period time.Duration) *tokenBucket {
+	return &tokenBucket{store: store, prefix: prefix, capacity: capacity, period: period}
+}
+
+// Take takes a token from the bucket of key
+func (b *tokenBucket) Take(key string) (bucketState, error) {
+	return b.store.Take(b.prefix+":"+key, b.capacity, b.period)
+}
+
+// bucketRateLimitMiddleware limits requests by client IP and, for callers
+// with a valid token, by user as well, each with a bucket of its own. The
+// RateLimit-* headers describe whichever bucket is closest to running out.
+// Requests are let through when the buckets can't be checked.
+func bucketRateLimitMiddleware(byIP, byUser *tokenBucket, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := byIP.capacity
+		state, err := byIP.Take(clientIP(r))
+		if err == nil && state.allowed && byUser != nil {
+			if sub := rateLimitSubject(r); sub != "" {
+				var userState bucketState
+				userState, err = byUser.Take(sub)
+				if err == nil && (!userState.allowed || userState.remaining < state.remaining) {
+					limit, state = byUser.capacity, userState
+				}
+			}
+		}
+		if err != nil {
+			// Don't turn a rate limit store outage into an outage of the service
+			log.Println("unable to check rate limit:", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(state.resetIn)))
+		if !state.allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(state.retryAfter)))
+			respondWithError("Too many requests", errors.New("too many requests, try again later"), w, http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitSubject returns the user the bearer token of r was issued to,
+// empty when it has none that's valid. Revocation isn't checked, a revoked
+// token is refused further in anyway.
+func rateLimitSubject(r *http.Request) string {
+	jwtToken, err := bearerToken(r)
+	if err != nil {
+		return ""
+	}
+	token, err := parseToken(jwtToken)
+	if err != nil {
+		return ""
+	}
+	sub, _ := token.Claims["sub"].(string)
+	return sub
+}
+
+// exceptPaths lets requests for paths skip limited, going straight to next
+func exceptPaths(limited, next http.Handler, paths ...string) http.Handler {
+	skip := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		skip[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if skip[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// ceilSeconds is d in whole seconds, rounded up
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
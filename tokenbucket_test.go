@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenBucketStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryTokenBucketStore()
+	store.now = func() time.Time { return now }
+
+	testTokenBucketStore(t, store, func(d time.Duration) { now = now.Add(d) })
+
+	// Buckets full again are kept until the next sweep
+	now = now.Add(time.Second)
+	store.Take("prune", 2, time.Second)
+	if len(store.buckets) < 2 {
+		t.Errorf("Expected the full buckets to be kept until the next sweep but got: %d", len(store.buckets))
+	}
+
+	// And forgotten then
+	now = now.Add(tokenBucketSweepInterval)
+	store.Take("prune", 2, time.Second)
+	if _, ok := store.buckets["prune"]; !ok || len(store.buckets) != 1 {
+		t.Errorf("Expected only the bucket just used to be kept but got: %d", len(store.buckets))
+	}
+}
+
+func TestRedisTokenBucketStore(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL not set")
+	}
+
+	testTokenBucketStore(t, redisTokenBucketStore{newRedisPool(url)}, time.Sleep)
+}
+
+func TestBucketRateLimitMiddleware(t *testing.T) {
+	store := newMemoryTokenBucketStore()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := bucketRateLimitMiddleware(newTokenBucket(store, "ip", 3, time.Minute), newTokenBucket(store, "user", 2, time.Minute), ok)
+
+	get := func(remoteAddr, authHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/users", nil)
+		req.RemoteAddr = remoteAddr
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("10.0.0.1:1234", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", rec.Code)
+	}
+	if limit, remaining := rec.Header().Get("RateLimit-Limit"), rec.Header().Get("RateLimit-Remaining"); limit != "3" || remaining != "2" {
+		t.Errorf("Expected a limit of 3 with 2 remaining but got: %s %s", limit, remaining)
+	}
+	if reset := rec.Header().Get("RateLimit-Reset"); reset != "20" {
+		t.Errorf("Expected the bucket to be full again in 20 seconds but got: %s", reset)
+	}
+
+	get("10.0.0.1:1234", "")
+	get("10.0.0.1:1234", "")
+	rec = get("10.0.0.1:1234", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 status code response but got: %d", rec.Code)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "20" {
+		t.Errorf("Expected to retry after 20 seconds but got: %s", retryAfter)
+	}
+
+	// Users are limited on their own bucket, whichever address they use
+	token, err := generateToken("userID", "testUser", "student", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, remoteAddr := range []string{"10.0.0.2:1234", "10.0.0.3:1234"} {
+		rec := get(remoteAddr, "Bearer "+token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected request %d of the user to succeed but got: %d", i+1, rec.Code)
+		}
+		if limit := rec.Header().Get("RateLimit-Limit"); limit != "2" {
+			t.Errorf("Expected the headers to describe the user bucket but got a limit of: %s", limit)
+		}
+	}
+	if rec := get("10.0.0.4:1234", "Bearer "+token); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the user to be limited but got: %d", rec.Code)
+	}
+
+	// Others aren't affected
+	if rec := get("10.0.0.5:1234", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected another address to have its own bucket but got: %d", rec.Code)
+	}
+}
+
+func TestExceptPaths(t *testing.T) {
+	limited := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTooManyRequests) })
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := exceptPaths(limited, next, HealthzPath)
+
+	for path, code := range map[string]int{HealthzPath: http.StatusOK, "/users": http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != code {
+			t.Errorf("Expected %s to be a %d but got: %d", path, code, rec.Code)
+		}
+	}
+}
+
+// testTokenBucketStore checks the behaviour every TokenBucketStore must share.
+// advance moves the store's clock forward.
+func testTokenBucketStore(t *testing.T, store TokenBucketStore, advance func(time.Duration)) {
+	const period = 200 * time.Millisecond
+	bucket := newTokenBucket(store, "test-"+strconv.FormatInt(time.Now().UnixNano(), 10), 2, period)
+
+	for i := 0; i < 2; i++ {
+		state, err := bucket.Take("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !state.allowed || state.remaining != 1-i {
+			t.Fatalf("Expected take %d to leave %d tokens but got: %+v", i+1, 1-i, state)
+		}
+	}
+
+	state, err := bucket.Take("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.allowed {
+		t.Error("Expected an empty bucket to be blocked")
+	}
+	if state.retryAfter <= 0 || state.retryAfter > period/2 {
+		t.Errorf("Expected retry after to be within a token's refill but got: %v", state.retryAfter)
+	}
+	if state.resetIn <= period/2 || state.resetIn > period {
+		t.Errorf("Expected the bucket to be full again within the period but got: %v", state.resetIn)
+	}
+
+	// Keys have buckets of their own
+	if state, _ := bucket.Take("other"); !state.allowed {
+		t.Error("Expected another key to have its own bucket")
+	}
+
+	// Tokens come back steadily
+	advance(period/2 + 20*time.Millisecond)
+	if state, _ := bucket.Take("key"); !state.allowed || state.remaining != 0 {
+		t.Errorf("Expected a token to be refilled but got: %+v", state)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/buzzapp/user/reqres"
+)
+
+// tokenGCInterval is how often expired and stale tokens are garbage
+// collected. Collecting is disabled when it's 0.
+var tokenGCInterval = time.Hour
+
+// staleFamilyGrace is how long after its last token was used a refresh token
+// family is left alone, since refreshing marks the token used before issuing
+// its successor
+const staleFamilyGrace = time.Minute
+
+// staleTokenFamilies returns the families that have no live token
+func staleTokenFamilies(families, live []string) []string {
+	isLive := make(map[string]bool, len(live))
+	for _, family := range live {
+		isLive[family] = true
+	}
+
+	stale := []string{}
+	for _, family := range families {
+		if !isLive[family] {
+			stale = append(stale, family)
+		}
+	}
+	return stale
+}
+
+// collectTokenGarbage removes the expired tokens from the database and the
+// expired entries from the revocation store, returning what was removed
+func collectTokenGarbage(ctx context.Context, svc UserService, now time.Time) (reqres.GCTokensResponse, error) {
+	garbage, err := svc.CollectTokenGarbage(ctx, now)
+	if err != nil {
+		return reqres.GCTokensResponse{}, err
+	}
+
+	revoked, err := revokedTokens.Prune()
+	if err != nil {
+		return reqres.GCTokensResponse{}, err
+	}
+
+	resp := reqres.GCTokensResponse{
+		RefreshTokens:  garbage.RefreshTokens,
+		TokenFamilies:  garbage.TokenFamilies,
+		PasswordResets: garbage.PasswordResets,
+		Challenges:     garbage.Challenges,
+		Revocations:    revoked,
+	}
+	resp.Removed = resp.RefreshTokens + resp.PasswordResets + resp.Challenges + resp.Revocations
+	return resp, nil
+}
+
+// runTokenGC garbage collects tokens every tokenGCInterval, until ctx is done
+func runTokenGC(ctx context.Context, svc UserService) {
+	ticker := time.NewTicker(tokenGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if _, err := collectTokenGarbage(ctx, svc, now); err != nil {
+				log.Println("unable to garbage collect tokens:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
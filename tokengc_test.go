@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMemoryRevocationStorePrune(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRevocationStore()
+	store.now = func() time.Time { return now }
+
+	store.Revoke("short", now.Add(time.Minute))
+	store.Revoke("long", now.Add(time.Hour))
+
+	now = now.Add(2 * time.Minute)
+	pruned, err := store.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Errorf("Expected 1 expired token to be pruned but got: %d", pruned)
+	}
+	if _, ok := store.revoked["short"]; ok {
+		t.Error("Expected the expired token to be pruned")
+	}
+	if revoked, _ := store.IsRevoked("long"); !revoked {
+		t.Error("Expected a token that hasn't expired to stay revoked")
+	}
+}
+
+func TestStaleTokenFamilies(t *testing.T) {
+	stale := staleTokenFamilies([]string{"a", "b", "c"}, []string{"b"})
+	if !reflect.DeepEqual(stale, []string{"a", "c"}) {
+		t.Errorf("Expected the families without a live token but got: %v", stale)
+	}
+}
+
+func TestCollectTokenGarbage(t *testing.T) {
+	session, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	collection, err := refreshTokenCollection(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	used := now.Add(-time.Hour)
+	tokens := []*model.RefreshToken{
+		// Expired
+		{ID: "gc-expired", UserID: "gcUser", FamilyID: "gc-live", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour), UsedAt: &used},
+		// Live
+		{ID: "gc-live", UserID: "gcUser", FamilyID: "gc-live", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		// A family with nothing left to use
+		{ID: "gc-stale", UserID: "gcUser", FamilyID: "gc-stale", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour), UsedAt: &used},
+	}
+	for _, token := range tokens {
+		if err := collection.Insert(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer collection.RemoveAll(bson.M{"user_id": "gcUser"})
+
+	garbage, err := userService{}.CollectTokenGarbage(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if garbage.RefreshTokens < 2 || garbage.TokenFamilies < 1 {
+		t.Errorf("Expected the expired and stale tokens to be counted but got: %+v", garbage)
+	}
+
+	for _, id := range []string{"gc-expired", "gc-stale"} {
+		if n, _ := collection.FindId(id).Count(); n != 0 {
+			t.Errorf("Expected refresh token %s to be removed", id)
+		}
+	}
+	if n, _ := collection.FindId("gc-live").Count(); n != 1 {
+		t.Error("Expected the live refresh token to be kept")
+	}
+}
+
+// collectingUserService counts the token garbage collections
+type collectingUserService struct {
+	UserService
+	collections chan struct{}
+}
+
+func (s collectingUserService) CollectTokenGarbage(ctx context.Context, now time.Time) (*model.TokenGarbage, error) {
+	s.collections <- struct{}{}
+	return &model.TokenGarbage{}, nil
+}
+
+func TestRunTokenGCStopsOnShutdown(t *testing.T) {
+	defer func(interval time.Duration) { tokenGCInterval = interval }(tokenGCInterval)
+	tokenGCInterval = time.Millisecond
+
+	svc := collectingUserService{collections: make(chan struct{}, 100)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runTokenGC(ctx, svc)
+		close(done)
+	}()
+
+	select {
+	case <-svc.collections:
+	case <-time.After(time.Second):
+		t.Fatal("Expected tokens to be garbage collected")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected the garbage collection to stop once the context is done")
+	}
+}
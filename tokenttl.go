@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// tokenTTL is how long tokens are valid for, unless their role has its own
+// lifetime in roleTokenTTLs
+var tokenTTL = 5 * time.Minute
+
+// roleTokenTTLs are the token lifetimes of roles that don't use tokenTTL, e.g.
+// shorter-lived admin tokens. They apply to refreshed tokens too.
+var roleTokenTTLs = map[string]time.Duration{}
+
+// tokenTTLFor returns how long a token issued to role is valid for. A role's
+// own lifetime takes precedence over the global one.
+func tokenTTLFor(role string) time.Duration {
+	if ttl, ok := roleTokenTTLs[role]; ok {
+		return ttl
+	}
+	return tokenTTL
+}
+
+// maxTokenTTL returns the longest any token is issued for
+func maxTokenTTL() time.Duration {
+	longest := tokenTTL
+	for _, ttl := range roleTokenTTLs {
+		if ttl > longest {
+			longest = ttl
+		}
+	}
+	return longest
+}
+
+// parseRoleTokenTTLs parses comma separated role=duration pairs such as
+// "admin=2m,student=15m", making sure every role exists, is only given once
+// and gets a positive lifetime
+func parseRoleTokenTTLs(spec string) (map[string]time.Duration, error) {
+	ttls := map[string]time.Duration{}
+	if strings.TrimSpace(spec) == "" {
+		return ttls, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("role token TTLs must be role=duration pairs, got: " + pair)
+		}
+
+		role := strings.TrimSpace(parts[0])
+		if !isValidRole(role) {
+			return nil, errors.New("unknown role in role token TTLs: " + role)
+		}
+		if _, ok := ttls[role]; ok {
+			return nil, errors.New("role given twice in role token TTLs: " + role)
+		}
+
+		ttl, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.New("invalid token TTL for role " + role + ": " + err.Error())
+		}
+		if ttl <= 0 {
+			return nil, errors.New("token TTL for role " + role + " must be positive")
+		}
+
+		ttls[role] = ttl
+	}
+
+	return ttls, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRoleTokenTTLs(t *testing.T) {
+	ttls, err := parseRoleTokenTTLs("admin=2m, student=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttls["admin"] != 2*time.Minute || ttls["student"] != time.Hour {
+		t.Errorf("Expected the TTLs of both roles but got: %v", ttls)
+	}
+
+	if ttls, err := parseRoleTokenTTLs(""); err != nil || len(ttls) != 0 {
+		t.Errorf("Expected no TTLs but got: %v, %v", ttls, err)
+	}
+
+	for _, spec := range []string{"admin", "admin=soon", "admin=-1m", "admin=0s", "teacher=1m", "admin=1m,admin=2m"} {
+		if _, err := parseRoleTokenTTLs(spec); err == nil {
+			t.Errorf("Expected %q to be refused", spec)
+		}
+	}
+}
+
+func TestTokenTTLPerRole(t *testing.T) {
+	defer func(ttl time.Duration, ttls map[string]time.Duration) {
+		tokenTTL, roleTokenTTLs = ttl, ttls
+	}(tokenTTL, roleTokenTTLs)
+	tokenTTL = 30 * time.Minute
+	roleTokenTTLs = map[string]time.Duration{"admin": 2 * time.Minute}
+
+	tests := []struct {
+		role string
+		ttl  time.Duration
+	}{
+		{"admin", 2 * time.Minute},
+		{"student", 30 * time.Minute},
+	}
+
+	for _, test := range tests {
+		tokenString, err := generateToken("userID", "testUser", test.role, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := parseToken(tokenString)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		iat := token.Claims["iat"].(float64)
+		exp := token.Claims["exp"].(float64)
+		if got := time.Duration(exp-iat) * time.Second; got != test.ttl {
+			t.Errorf("Expected a %s token to live %v but got: %v", test.role, test.ttl, got)
+		}
+	}
+}
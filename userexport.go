@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+
+	"github.com/buzzapp/user/model"
+)
+
+// exportBatchSize is how many users an export reads at once from
+// repositories that can't stream them
+var exportBatchSize = 500
+
+// UserStreamer is implemented by repositories that can go through users with
+// a database cursor, without holding them all
+type UserStreamer interface {
+	// Stream calls fn with every user filter picks in order of id, stopping
+	// at the first error
+	Stream(ctx context.Context, filter UserFilter, fn func(user *model.User) error) error
+}
+
+// ExportUsers calls fn with every user that isn't deleted in order of id,
+// starting after the user with the id after when it's set, so an export cut
+// short can pick up where it left off. Users are read from a cursor, or a
+// batch at a time, never all at once.
+func (userService) ExportUsers(ctx context.Context, after string, fn func(user *model.User) error) error {
+	filter := UserFilter{AfterID: after, NotDeleted: true}
+	if streamer, ok := userRepository.(UserStreamer); ok {
+		return streamer.Stream(ctx, filter, fn)
+	}
+
+	for {
+		users, err := userRepository.Find(ctx, filter, []string{"_id"}, 0, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		for i := range users {
+			if err := fn(&users[i]); err != nil {
+				return err
+			}
+		}
+		if len(users) < exportBatchSize {
+			return nil
+		}
+		filter.AfterID = users[len(users)-1].ID
+	}
+}
+
+func (mongoUserRepository) Stream(ctx context.Context, filter UserFilter, fn func(user *model.User) error) error {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, filter.readKey())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	//Users are read a batch at a time, however many there are
+	iter := collection.Find(mongoUserQuery(filter)).Sort("_id").Batch(exportBatchSize).Iter()
+	var user model.User
+	for iter.Next(&user) {
+		if err := decryptUsers(&user); err != nil {
+			iter.Close()
+			return err
+		}
+		if err := fn(&user); err != nil {
+			iter.Close()
+			return err
+		}
+		user = model.User{}
+	}
+	return iter.Close()
+}
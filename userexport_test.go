@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buzzapp/user/model"
+)
+
+// countingUserRepository counts the users read from the repository it wraps,
+// and the most read at once
+type countingUserRepository struct {
+	UserRepository
+	read, largestRead int
+}
+
+func (r *countingUserRepository) Find(ctx context.Context, filter UserFilter, sort []string, offset, limit int) ([]model.User, error) {
+	users, err := r.UserRepository.Find(ctx, filter, sort, offset, limit)
+	r.read += len(users)
+	if len(users) > r.largestRead {
+		r.largestRead = len(users)
+	}
+	return users, err
+}
+
+// countingResponseWriter counts the bytes written to it between flushes, and
+// how many users had been read at each flush
+type countingResponseWriter struct {
+	*httptest.ResponseRecorder
+	repo               *countingUserRepository
+	unflushed, largest int
+	readAtFlush        []int
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	w.unflushed += len(p)
+	if w.unflushed > w.largest {
+		w.largest = w.unflushed
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *countingResponseWriter) Flush() {
+	w.unflushed = 0
+	w.readAtFlush = append(w.readAtFlush, w.repo.read)
+}
+
+func TestExportUsersHTTPEndpoint(t *testing.T) {
+	defer func(repo UserRepository, size int) { userRepository, exportBatchSize = repo, size }(userRepository, exportBatchSize)
+	memory := newMemoryUserRepository()
+	repo := &countingUserRepository{UserRepository: memory}
+	userRepository, exportBatchSize = repo, 50
+
+	ctx := context.Background()
+	for i := 0; i < 1000; i++ {
+		username := fmt.Sprintf("export%04d", i)
+		user := model.User{ID: fmt.Sprintf("%04d", i), Email: username + "@test.com", Username: username, UsernameKey: usernameKey(username)}
+		if err := memory.Create(ctx, &user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := memory.Delete(ctx, "0500"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &countingResponseWriter{ResponseRecorder: httptest.NewRecorder(), repo: repo}
+	handleExportUsers(userService{}).ServeHTTP(w, httptest.NewRequest("GET", ExportUsersPath, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" || w.Header().Get("Transfer-Encoding") != "chunked" {
+		t.Fatalf("Expected a 200 chunked JSON lines response but got: %d %v", w.Code, w.Header())
+	}
+
+	// Every user but the deleted one is exported, in order of id
+	ids := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+	for scanner.Scan() {
+		var user model.User
+		if err := json.Unmarshal(scanner.Bytes(), &user); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, user.ID)
+	}
+	if len(ids) != 999 || ids[0] != "0000" || ids[499] != "0499" || ids[500] != "0501" || ids[998] != "0999" {
+		t.Errorf("Expected the 999 users left in order of id but got %d from %v to %v", len(ids), ids[:1], ids[len(ids)-1:])
+	}
+
+	// Users are read a batch at a time and flushed as they go
+	if repo.largestRead > exportBatchSize {
+		t.Errorf("Expected at most %d users read at once but got: %d", exportBatchSize, repo.largestRead)
+	}
+	if len(w.readAtFlush) < 9 || w.readAtFlush[0] >= len(ids) {
+		t.Errorf("Expected flushes before every user was read but got: %v", w.readAtFlush)
+	}
+	if w.largest >= w.Body.Len()/5 {
+		t.Errorf("Expected at most a few hundred users written between flushes but got %d of %d bytes", w.largest, w.Body.Len())
+	}
+
+	// An export picks up after a user
+	rec := httptest.NewRecorder()
+	handleExportUsers(userService{}).ServeHTTP(rec, httptest.NewRequest("GET", ExportUsersPath+"?after=0997", nil))
+	if lines := bytes.Count(rec.Body.Bytes(), []byte("\n")); lines != 2 {
+		t.Errorf("Expected the 2 users after 0997 but got: %s", rec.Body)
+	}
+}
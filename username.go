@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/buzzapp/user/model"
+)
+
+// Ways of comparing usernames
+const (
+	usernameCaseSensitive   = "sensitive"
+	usernameCaseInsensitive = "insensitive"
+)
+
+var (
+	// usernameCase is whether usernames differing only in case are the same
+	// username, both for uniqueness and for logging in
+	usernameCase = usernameCaseSensitive
+
+	// usernameConfusableCheck refuses new usernames that look like an
+	// existing one, e.g. with a Cyrillic "а" in place of a Latin "a"
+	usernameConfusableCheck = false
+
+	// usernameChangeCooldown is how long users wait between username
+	// changes, so handles can't be churned through or squatted in turn. 0
+	// lets usernames change any time.
+	usernameChangeCooldown time.Duration
+)
+
+// usernameCooldownError refuses a username change until next
+type usernameCooldownError struct {
+	next time.Time
+}
+
+func (e usernameCooldownError) Error() string {
+	return fmt.Sprintf("the username was changed recently and can be changed again at %s", e.next.UTC().Format(time.RFC3339))
+}
+
+// checkUsernameCooldown fails with a usernameCooldownError when user changed
+// their username less than usernameChangeCooldown before now
+func checkUsernameCooldown(user *model.User, now time.Time) error {
+	if usernameChangeCooldown <= 0 || user.UsernameChangedAt == nil {
+		return nil
+	}
+	next := user.UsernameChangedAt.Add(usernameChangeCooldown)
+	if now.Before(next) {
+		return usernameCooldownError{next: next}
+	}
+	return nil
+}
+
+func isValidUsernameCase(mode string) bool {
+	return mode == usernameCaseSensitive || mode == usernameCaseInsensitive
+}
+
+// normalizeUsername puts a username in NFKC form so differently encoded but
+// identical usernames are stored and looked up the same way
+func normalizeUsername(username string) string {
+	return norm.NFKC.String(strings.TrimSpace(username))
+}
+
+// usernameKey is what usernames are compared by, according to usernameCase
+func usernameKey(username string) string {
+	username = normalizeUsername(username)
+	if usernameCase == usernameCaseInsensitive {
+		return strings.ToLower(username)
+	}
+	return username
+}
+
+// confusables maps characters to the Latin ones they are commonly mistaken
+// for. It covers the usual Cyrillic and Greek lookalikes and digits rather
+// than the full Unicode confusables table. It is applied once, so every
+// character maps straight to where it ends up: "i" looks like "l", and so
+// does everything that looks like "i".
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'l',
+	'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ӏ': 'l', 'ո': 'n',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	'0': 'o', '1': 'l', 'i': 'l',
+}
+
+// usernameSkeleton reduces a username to what it looks like, so usernames that
+// can be mistaken for each other share a skeleton
+func usernameSkeleton(username string) string {
+	decomposed := norm.NFKD.String(strings.ToLower(normalizeUsername(username)))
+
+	skeleton := make([]rune, 0, len(decomposed))
+	for _, r := range decomposed {
+		// Accents don't tell usernames apart at a glance
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if latin, ok := confusables[r]; ok {
+			r = latin
+		}
+		skeleton = append(skeleton, r)
+	}
+
+	// "rn" passes for "m" in most fonts
+	return strings.Replace(string(skeleton), "rn", "m", -1)
+}
+
+// recomputeUsernameSkeletons stores the skeleton usernameSkeleton gives now
+// for every user whose stored one differs, as it does after confusables
+// changes. Migration 4 runs it for the lookalikes of "i", which used to stop
+// at "i".
+func recomputeUsernameSkeletons(db *mgo.Database) error {
+	collection := db.C("users")
+	iter := collection.Find(nil).Select(bson.M{"username": 1, "username_skeleton": 1}).Iter()
+	for {
+		var user model.User
+		if !iter.Next(&user) {
+			break
+		}
+		skeleton := usernameSkeleton(user.Username)
+		if skeleton == user.UsernameSkeleton {
+			continue
+		}
+		err := collection.UpdateId(user.ID, bson.M{"$set": bson.M{"username_skeleton": skeleton}})
+		// Users deleted meanwhile have nothing left to update
+		if err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// usernamesQuery matches the users with any of usernames, according to
+// usernameCase
+func usernamesQuery(usernames []string) bson.M {
+	normalized := make([]string, len(usernames))
+	keys := make([]string, len(usernames))
+	for i, username := range usernames {
+		normalized[i] = normalizeUsername(username)
+		keys[i] = usernameKey(username)
+	}
+
+	query := bson.M{"username": bson.M{"$in": normalized}}
+	if usernameCase == usernameCaseInsensitive {
+		// Users stored before keys existed only match exactly
+		return bson.M{"$or": []bson.M{{"username_key": bson.M{"$in": keys}}, query}}
+	}
+	return query
+}
+
+// checkUsernameAvailable makes sure no other user has a username that
+// compares equal to or, when usernameConfusableCheck is set, looks like the
+// user's
+func checkUsernameAvailable(collection *mgo.Collection, user *model.User) error {
+	for _, filter := range usernameClashes(user) {
+		count, err := collection.Find(mongoUserQuery(filter)).Count()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errDuplicateUsername
+		}
+	}
+	return nil
+}
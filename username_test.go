@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	// "é" precomposed (NFC) and as "e" plus a combining accent (NFD)
+	nfc, nfd := "jos\u00e9", "jose\u0301"
+	if normalizeUsername(nfc) != normalizeUsername(nfd) {
+		t.Error("Expected NFC and NFD forms of a username to normalize the same")
+	}
+
+	// Compatibility characters like fullwidth letters fold too
+	if normalizeUsername("\uff41dmin") != "admin" {
+		t.Errorf("Expected a fullwidth letter to normalize to ASCII but got: %q", normalizeUsername("\uff41dmin"))
+	}
+}
+
+func TestUsernameKeyCase(t *testing.T) {
+	defer func(mode string) { usernameCase = mode }(usernameCase)
+
+	usernameCase = usernameCaseSensitive
+	if usernameKey("Alice") == usernameKey("alice") {
+		t.Error("Expected usernames differing in case to differ when case sensitive")
+	}
+
+	usernameCase = usernameCaseInsensitive
+	if usernameKey("Alice") != usernameKey("alice") {
+		t.Error("Expected usernames differing in case to match when case insensitive")
+	}
+}
+
+func TestUsernameSkeleton(t *testing.T) {
+	tests := []struct {
+		a, b      string
+		confusing bool
+	}{
+		{"paypal", "p\u0430yp\u0430l", true}, // Cyrillic "а"
+		{"alice", "\u0430lice", true},
+		{"bob", "b0b", true},
+		{"modern", "rnodern", true},
+		{"Admin", "admin", true},
+		{"josé", "jose", true},
+		{"bill", "b\u0456ll", true}, // Cyrillic "і"
+		{"bill", "b\u03b9ll", true}, // Greek "ι"
+		{"bill", "b1ll", true},
+		{"alice", "bob", false},
+	}
+
+	for _, test := range tests {
+		if confusing := usernameSkeleton(test.a) == usernameSkeleton(test.b); confusing != test.confusing {
+			t.Errorf("Expected %q and %q confusable to be %v", test.a, test.b, test.confusing)
+		}
+	}
+
+	// Skeletons are where lookalikes end up, so they don't map any further
+	for r, latin := range confusables {
+		if next, ok := confusables[latin]; ok {
+			t.Errorf("Expected %q to map straight to %q rather than %q", r, next, latin)
+		}
+	}
+}
+
+func TestUsernameCooldownBoundary(t *testing.T) {
+	defer func(cooldown time.Duration) { usernameChangeCooldown = cooldown }(usernameChangeCooldown)
+	usernameChangeCooldown = 30 * 24 * time.Hour
+
+	changedAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	user := &model.User{UsernameChangedAt: &changedAt}
+	next := changedAt.Add(usernameChangeCooldown)
+
+	err := checkUsernameCooldown(user, next.Add(-time.Nanosecond))
+	cooldown, ok := err.(usernameCooldownError)
+	if !ok {
+		t.Fatalf("Expected a change just before the cooldown ends to be refused but got: %v", err)
+	}
+	if !cooldown.next.Equal(next) || !strings.Contains(err.Error(), "2026-01-31T12:00:00Z") {
+		t.Errorf("Expected the error to tell the next change is allowed at %v but got: %v", next, err)
+	}
+	if err := checkUsernameCooldown(user, next); err != nil {
+		t.Errorf("Expected a change once the cooldown ends to be allowed but got: %v", err)
+	}
+
+	// Usernames never changed can be changed right away, and so can any
+	// without a cooldown
+	if err := checkUsernameCooldown(&model.User{}, changedAt); err != nil {
+		t.Errorf("Expected a first change to be allowed but got: %v", err)
+	}
+	usernameChangeCooldown = 0
+	if err := checkUsernameCooldown(user, changedAt); err != nil {
+		t.Errorf("Expected changes to be allowed without a cooldown but got: %v", err)
+	}
+}
+
+func TestUpdateUsernameCooldown(t *testing.T) {
+	defer func(repo UserRepository, cooldown time.Duration) {
+		userRepository, usernameChangeCooldown = repo, cooldown
+	}(userRepository, usernameChangeCooldown)
+	repo := newMemoryUserRepository()
+	userRepository = repo
+	usernameChangeCooldown = time.Hour
+
+	svc := userService{}
+	ctx := context.Background()
+	user, err := svc.Create(ctx, &model.CreateUser{Email: "cooldown@test.com", FirstName: "cool", LastName: "down", Password: password, Role: "student", Username: "cooldown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rename := func(username string) (*model.User, error) {
+		return svc.Update(ctx, user.ID, &model.UpdateUser{Username: &username})
+	}
+	renamed, err := rename("cooldown2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.UsernameChangedAt == nil {
+		t.Fatal("Expected the time of the change to be tracked")
+	}
+
+	// Keeping the same username isn't a change, another one has to wait
+	if _, err := rename("cooldown2"); err != nil {
+		t.Errorf("Expected keeping the username to be allowed but got: %v", err)
+	}
+	if _, err := rename("cooldown3"); err == nil {
+		t.Error("Expected a second change within the cooldown to be refused")
+	} else if _, ok := err.(usernameCooldownError); !ok {
+		t.Errorf("Expected a cooldown error but got: %v", err)
+	}
+
+	stored := repo.users[user.ID]
+	changedAt := stored.UsernameChangedAt.Add(-time.Hour)
+	stored.UsernameChangedAt = &changedAt
+	repo.users[user.ID] = stored
+	if renamed, err := rename("cooldown3"); err != nil || renamed.Username != "cooldown3" {
+		t.Errorf("Expected a change after the cooldown to be allowed but got: %+v %v", renamed, err)
+	}
+}
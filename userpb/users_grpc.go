@@ -0,0 +1,199 @@
+package userpb
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The full names of the Users methods, which interceptors see
+const (
+	UsersCreateMethod        = "/buzz.users.v1.Users/Create"
+	UsersGetByIDMethod       = "/buzz.users.v1.Users/GetByID"
+	UsersLoginMethod         = "/buzz.users.v1.Users/Login"
+	UsersRefreshTokenMethod  = "/buzz.users.v1.Users/RefreshToken"
+	UsersValidateTokenMethod = "/buzz.users.v1.Users/ValidateToken"
+)
+
+// UsersServer is the server side of the Users service
+type UsersServer interface {
+	Create(context.Context, *CreateRequest) (*User, error)
+	GetByID(context.Context, *GetByIDRequest) (*User, error)
+	Login(context.Context, *LoginRequest) (*LoginResponse, error)
+	RefreshToken(context.Context, *RefreshTokenRequest) (*LoginResponse, error)
+	ValidateToken(context.Context, *ValidateTokenRequest) (*ValidateTokenResponse, error)
+}
+
+// UnimplementedUsersServer answers every method with codes.Unimplemented.
+// Servers can embed it to only implement some of them.
+type UnimplementedUsersServer struct{}
+
+func (UnimplementedUsersServer) Create(context.Context, *CreateRequest) (*User, error) {
+	return nil, status.Error(codes.Unimplemented, "method Create not implemented")
+}
+
+func (UnimplementedUsersServer) GetByID(context.Context, *GetByIDRequest) (*User, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetByID not implemented")
+}
+
+func (UnimplementedUsersServer) Login(context.Context, *LoginRequest) (*LoginResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Login not implemented")
+}
+
+func (UnimplementedUsersServer) RefreshToken(context.Context, *RefreshTokenRequest) (*LoginResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method RefreshToken not implemented")
+}
+
+func (UnimplementedUsersServer) ValidateToken(context.Context, *ValidateTokenRequest) (*ValidateTokenResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ValidateToken not implemented")
+}
+
+// RegisterUsersServer serves srv as the Users service of s
+func RegisterUsersServer(s grpc.ServiceRegistrar, srv UsersServer) {
+	s.RegisterService(&UsersServiceDesc, srv)
+}
+
+// UsersServiceDesc describes the Users service to grpc
+var UsersServiceDesc = grpc.ServiceDesc{
+	ServiceName: "buzz.users.v1.Users",
+	HandlerType: (*UsersServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Create", Handler: usersCreateHandler},
+		{MethodName: "GetByID", Handler: usersGetByIDHandler},
+		{MethodName: "Login", Handler: usersLoginHandler},
+		{MethodName: "RefreshToken", Handler: usersRefreshTokenHandler},
+		{MethodName: "ValidateToken", Handler: usersValidateTokenHandler},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "userpb/users.proto",
+}
+
+func usersCreateHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsersServer).Create(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: UsersCreateMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsersServer).Create(ctx, req.(*CreateRequest))
+	})
+}
+
+func usersGetByIDHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetByIDRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsersServer).GetByID(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: UsersGetByIDMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsersServer).GetByID(ctx, req.(*GetByIDRequest))
+	})
+}
+
+func usersLoginHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsersServer).Login(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: UsersLoginMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsersServer).Login(ctx, req.(*LoginRequest))
+	})
+}
+
+func usersRefreshTokenHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsersServer).RefreshToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: UsersRefreshTokenMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsersServer).RefreshToken(ctx, req.(*RefreshTokenRequest))
+	})
+}
+
+func usersValidateTokenHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValidateTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsersServer).ValidateToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: UsersValidateTokenMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsersServer).ValidateToken(ctx, req.(*ValidateTokenRequest))
+	})
+}
+
+// UsersClient is the client side of the Users service
+type UsersClient interface {
+	Create(ctx context.Context, in *CreateRequest, opts ...grpc.CallOption) (*User, error)
+	GetByID(ctx context.Context, in *GetByIDRequest, opts ...grpc.CallOption) (*User, error)
+	Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	RefreshToken(ctx context.Context, in *RefreshTokenRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	ValidateToken(ctx context.Context, in *ValidateTokenRequest, opts ...grpc.CallOption) (*ValidateTokenResponse, error)
+}
+
+type usersClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewUsersClient returns a client of the Users service served on cc
+func NewUsersClient(cc grpc.ClientConnInterface) UsersClient {
+	return &usersClient{cc: cc}
+}
+
+func (c *usersClient) Create(ctx context.Context, in *CreateRequest, opts ...grpc.CallOption) (*User, error) {
+	out := new(User)
+	if err := c.cc.Invoke(ctx, UsersCreateMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *usersClient) GetByID(ctx context.Context, in *GetByIDRequest, opts ...grpc.CallOption) (*User, error) {
+	out := new(User)
+	if err := c.cc.Invoke(ctx, UsersGetByIDMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *usersClient) Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	out := new(LoginResponse)
+	if err := c.cc.Invoke(ctx, UsersLoginMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *usersClient) RefreshToken(ctx context.Context, in *RefreshTokenRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	out := new(LoginResponse)
+	if err := c.cc.Invoke(ctx, UsersRefreshTokenMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *usersClient) ValidateToken(ctx context.Context, in *ValidateTokenRequest, opts ...grpc.CallOption) (*ValidateTokenResponse, error) {
+	out := new(ValidateTokenResponse)
+	if err := c.cc.Invoke(ctx, UsersValidateTokenMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
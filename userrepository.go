@@ -0,0 +1,1265 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Backends users can be stored in, picked with -user-store
+const (
+	userStoreMongo    = "mongo"
+	userStorePostgres = "postgres"
+	userStoreMemory   = "memory"
+)
+
+// userRepository is where users are stored, MongoDB unless -user-store picks
+// another backend. Everything else, sessions and tokens included, stays in
+// MongoDB whichever it is.
+var userRepository UserRepository = mongoUserRepository{}
+
+// UserRepository is an interface for storing users. Users are stored as the
+// service hands them over, with their password already hashed. Repositories
+// keep usernames and emails unique and leave soft-deleted users out unless
+// asked otherwise. Fields are named as they're stored in filters, sorts and
+// changes, e.g. _id and updated_at.
+type UserRepository interface {
+	// Create stores user, failing with errDuplicateUsername or
+	// errDuplicateEmail when another user has its username or email
+	Create(ctx context.Context, user *model.User) error
+
+	// GetByID returns the user with id, errUserNotFound when there is none
+	GetByID(ctx context.Context, id string, includeDeleted bool) (*model.User, error)
+
+	// GetByUsername returns the user with username, compared according to
+	// usernameCase, errUserNotFound when there is none
+	GetByUsername(ctx context.Context, username string) (*model.User, error)
+
+	// Update changes the fields of update that are set on the user with id.
+	// Its password, when set, is already hashed.
+	Update(ctx context.Context, id string, update *model.UpdateUser) error
+
+	// Delete soft-deletes the user with id, errUserNotFound when there is
+	// none left to delete
+	Delete(ctx context.Context, id string) error
+
+	// List returns a page of the users opts asks for, along with how many
+	// there are. When only one of the two can be got, it fails with a
+	// partialListError along with the other.
+	List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error)
+
+	// Find returns the users filter picks in the order of the fields of
+	// sort, prefixed with - for descending order, skipping offset of them
+	// and returning at most limit, or all of them for 0
+	Find(ctx context.Context, filter UserFilter, sort []string, offset, limit int) ([]model.User, error)
+
+	// Count returns how many users filter picks
+	Count(ctx context.Context, filter UserFilter) (int, error)
+
+	// Modify makes change to the users filter picks, returning the ids of
+	// the ones it changed. Each user is only changed if filter still picks
+	// it, so filters can make sure nobody changed a user since it was read.
+	Modify(ctx context.Context, filter UserFilter, change UserChange) ([]string, error)
+
+	// Remove deletes the users filter picks for good, returning how many
+	Remove(ctx context.Context, filter UserFilter) (int, error)
+
+	// Reissue moves the user with id, unless soft-deleted, to newID,
+	// returning it as moved. errUserNotFound when there is none.
+	Reissue(ctx context.Context, id, newID string) (*model.User, error)
+
+	// LinkIdentity links identity to the user with id, failing with
+	// errIdentityTaken when another user has it, errProviderLinked when the
+	// user already has one of its provider, and errUserNotFound when there
+	// is no such user left
+	LinkIdentity(ctx context.Context, id string, identity model.Identity) error
+
+	// UnlinkIdentity unlinks the identity of provider from the user with id,
+	// failing with errProviderNotLinked when there is none. When keepOne is
+	// set, it fails with errLastAuthMethod instead of unlinking the last
+	// identity of the user.
+	UnlinkIdentity(ctx context.Context, id, provider string, keepOne bool) error
+}
+
+// Warnings of a list that could only be got in part
+const (
+	warnTotalUnavailable = "The total number of users is unavailable"
+	warnPageUnavailable  = "The page of users is unavailable"
+)
+
+// partialListError is what List fails with when it only got part of the
+// list, the page of users without their total or the other way around.
+// Callers that can make do with the part warn instead of failing.
+type partialListError struct {
+	warning string
+	err     error
+}
+
+func (e partialListError) Error() string {
+	return e.warning + ": " + e.err.Error()
+}
+
+// partialList returns what List should, given how getting the total and the
+// page of users went. It fails outright only when both did.
+func partialList(users []model.User, total int, countErr, pageErr error) ([]model.User, int, error) {
+	switch {
+	case countErr != nil && pageErr != nil:
+		return []model.User{}, 0, pageErr
+	case countErr != nil:
+		return users, 0, partialListError{warning: warnTotalUnavailable, err: countErr}
+	case pageErr != nil:
+		return []model.User{}, total, partialListError{warning: warnPageUnavailable, err: pageErr}
+	}
+	return users, total, nil
+}
+
+// UserFilter picks the users a repository finds, counts or writes. Its zero
+// value picks every user, soft-deleted ones included, and each field set
+// narrows it down.
+type UserFilter struct {
+	// IDs picks the users with any of them, and ExcludeID leaves one out.
+	// AfterID picks the users with a greater id, for going through users in
+	// order of id a page at a time.
+	IDs       []string
+	ExcludeID string
+	AfterID   string
+
+	// Statuses picks the users with any of them, "" standing for the users
+	// stored without a status, who are active
+	Statuses []string
+
+	// NotDeleted picks the users that aren't soft-deleted, OnlyDeleted the
+	// ones that are, and NotErased leaves erased users out
+	NotDeleted  bool
+	OnlyDeleted bool
+	NotErased   bool
+
+	// Password picks the users with this hash, so a password is only
+	// replaced while it's still the one that was checked
+	Password string
+
+	// PurgePending picks the users with a pending close of their account,
+	// due by PurgeBy when it's set
+	PurgePending bool
+	PurgeBy      time.Time
+
+	// Role picks the users with it, and Roles the users with any of them
+	// ignoring case
+	Role  string
+	Roles []string
+
+	// Email picks the users with it in any case, the way emailQuery does
+	Email string
+
+	// Usernames picks the users with any of them, compared according to
+	// usernameCase, and UsernameSkeleton the users whose username looks
+	// like one with this skeleton
+	Usernames        []string
+	UsernameSkeleton string
+
+	// Identity picks the user it is linked to
+	Identity *model.Identity
+
+	// InactiveSince picks the users who haven't logged in since, counting
+	// from when they signed up for those who never logged in, and
+	// SignedUpSince the users who signed up at or after it
+	InactiveSince time.Time
+	SignedUpSince time.Time
+
+	// UpdatedAfter picks the users updated after it. When UpdatedAfterID is
+	// set, the users updated at it with a greater id are picked too, so
+	// pages of changes pick up where the last one left off.
+	UpdatedAfter   *time.Time
+	UpdatedAfterID string
+
+	// Search picks the users matching it the way SearchMatch says
+	Search      string
+	SearchMatch searchMatch
+}
+
+// searchMatch is how users match a search, through their username, names or
+// email ignoring case
+type searchMatch int
+
+const (
+	// searchContains matches users with a field containing the search
+	searchContains searchMatch = iota
+	// searchExact matches users with a field equal to it, their encrypted
+	// email included
+	searchExact
+	// searchPrefix matches users with a field starting with it, but none
+	// equal to it
+	searchPrefix
+	// searchCandidates matches the users left that could be relevant: the
+	// ones containing it, and for typos the ones with a name starting like it
+	searchCandidates
+)
+
+// readKey is the key reads of the users filter picks go by, so users just
+// written are read from the primary
+func (filter UserFilter) readKey() string {
+	switch {
+	case len(filter.IDs) > 0:
+		return filter.IDs[0]
+	case filter.Email != "":
+		return filter.Email
+	case len(filter.Usernames) > 0:
+		return filter.Usernames[0]
+	}
+	return ""
+}
+
+// UserChange is a write to users, naming their fields as stored: the fields
+// of Set are set to their value, a string or a time, and the fields of Unset
+// are cleared
+type UserChange struct {
+	Set   map[string]interface{}
+	Unset []string
+}
+
+// reserveDeletedNames is whether soft-deleted users keep their username and
+// email to themselves until they're purged or erased. It's on by default, and
+// turning it off has security implications: whoever signs up with a deleted
+// user's username next is who mentions, links and other services keyed by it
+// reach, and is who a recipient who knew the old user takes them for. A
+// freed email is one the old account can no longer be recovered with, and a
+// deleted user whose name has been taken can't be reactivated.
+//
+// The database only keeps the names of users that aren't deleted unique,
+// with indexes of migration 0007 over the names and deleted_at. Reserving
+// them is up to the checks picking clashes, which go through deleted users
+// too. Soft-deleted users never take a name, so checking before writing
+// doesn't race with them.
+var reserveDeletedNames = true
+
+// usernameClashes are the filters picking the users other than user whose
+// username compares equal to or, when usernameConfusableCheck is set, looks
+// like the user's
+func usernameClashes(user *model.User) []UserFilter {
+	filters := []UserFilter{{Usernames: []string{user.Username}, ExcludeID: user.ID, NotDeleted: !reserveDeletedNames}}
+	if usernameConfusableCheck && user.UsernameSkeleton != "" {
+		filters = append(filters, UserFilter{UsernameSkeleton: user.UsernameSkeleton, ExcludeID: user.ID, NotDeleted: !reserveDeletedNames})
+	}
+	return filters
+}
+
+// emailClash is the filter picking the users other than id with email
+func emailClash(id, email string) UserFilter {
+	return UserFilter{Email: email, ExcludeID: id, NotDeleted: !reserveDeletedNames}
+}
+
+// mongoUserRepository keeps users in the database, with their sensitive
+// fields encrypted
+type mongoUserRepository struct{}
+
+func (mongoUserRepository) Create(ctx context.Context, user *model.User) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	// Emails and usernames are unique by the indexes of migration 0006
+	if err := checkUsernameAvailable(collection, user); err != nil {
+		return err
+	}
+	if err := checkEmailAvailable(collection, user.ID, user.Email); err != nil {
+		return err
+	}
+
+	//Insert our application, with the sensitive fields encrypted
+	stored, err := encryptUser(user)
+	if err != nil {
+		return err
+	}
+	err = collection.Insert(stored)
+	if err != nil {
+		return duplicateUserError(err)
+	}
+
+	return nil
+}
+
+func (mongoUserRepository) GetByID(ctx context.Context, id string, includeDeleted bool) (*model.User, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	//Get our applications from the collection
+	query := bson.M{"_id": id}
+	if !includeDeleted {
+		query = skipDeleted(query)
+	}
+	var retrievedUser *model.User
+	err = collection.Find(query).One(&retrievedUser)
+	if err == mgo.ErrNotFound {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return retrievedUser, decryptUsers(retrievedUser)
+}
+
+func (mongoUserRepository) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	//Get our applications from the collection
+	var retrievedUser *model.User
+	err = collection.Find(mongoUserQuery(UserFilter{Usernames: []string{username}, NotDeleted: true})).One(&retrievedUser)
+	if err == mgo.ErrNotFound {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return retrievedUser, decryptUsers(retrievedUser)
+}
+
+func (mongoUserRepository) Update(ctx context.Context, id string, updatedUser *model.UpdateUser) error {
+	//Only set the fields that were given
+	changes := bson.M{}
+	unset := bson.M{}
+	if updatedUser.Email != nil {
+		encrypted, err := encryptUser(&model.User{Email: *updatedUser.Email})
+		if err != nil {
+			return err
+		}
+		changes["email"] = encrypted.Email
+		if encrypted.EmailIndex != "" {
+			changes["email_index"] = encrypted.EmailIndex
+			unset["email_key"] = ""
+		} else {
+			changes["email_key"] = encrypted.EmailKey
+			unset["email_index"] = ""
+		}
+	}
+	if updatedUser.FirstName != nil {
+		changes["first_name"] = *updatedUser.FirstName
+	}
+	if updatedUser.LastName != nil {
+		changes["last_name"] = *updatedUser.LastName
+	}
+	if updatedUser.Role != nil {
+		changes["role"] = *updatedUser.Role
+	}
+	if updatedUser.Password != nil {
+		changes["password"] = *updatedUser.Password
+		changes["password_changed_at"] = time.Now()
+	}
+	for field, value := range map[string]*string{
+		"display_name": updatedUser.DisplayName,
+		"avatar_url":   updatedUser.AvatarURL,
+		"timezone":     updatedUser.Timezone,
+		"locale":       updatedUser.Locale,
+		"phone":        updatedUser.Phone,
+	} {
+		if value == nil {
+			continue
+		}
+		if *value == "" {
+			unset[field] = ""
+		} else {
+			changes[field] = *value
+		}
+	}
+	if phone, ok := changes["phone"].(string); ok {
+		encrypted, err := encryptPhone(phone)
+		if err != nil {
+			return err
+		}
+		changes["phone"] = encrypted
+	}
+
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	// Emails and usernames are unique by the indexes of migration 0006
+	if updatedUser.Email != nil {
+		if err := checkEmailAvailable(collection, id, *updatedUser.Email); err != nil {
+			return err
+		}
+	}
+	if updatedUser.Username != nil {
+		renamed := &model.User{
+			ID:               id,
+			Username:         normalizeUsername(*updatedUser.Username),
+			UsernameKey:      usernameKey(*updatedUser.Username),
+			UsernameSkeleton: usernameSkeleton(*updatedUser.Username),
+		}
+		if err := checkUsernameAvailable(collection, renamed); err != nil {
+			return err
+		}
+		changes["username"] = renamed.Username
+		changes["username_key"] = renamed.UsernameKey
+		changes["username_skeleton"] = renamed.UsernameSkeleton
+		changes["username_changed_at"] = time.Now()
+	}
+
+	if len(changes) == 0 && len(unset) == 0 {
+		return nil
+	}
+
+	//Update the given fields, leaving the rest such as the status alone
+	changes["updated_at"] = time.Now()
+	update := bson.M{"$set": changes}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	err = collection.Update(skipDeleted(bson.M{"_id": id}), update)
+	if err == mgo.ErrNotFound {
+		return errUserNotFound
+	}
+	if err != nil {
+		return duplicateUserError(err)
+	}
+
+	return nil
+}
+
+func (mongoUserRepository) Delete(ctx context.Context, id string) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	//Soft delete the user, keeping it around as a tombstone for the changes feed
+	now := time.Now()
+	selector := skipDeleted(bson.M{"_id": id, "status": bson.M{"$ne": statusDeleted}})
+	err = collection.Update(selector, bson.M{"$set": bson.M{"status": statusDeleted, "deleted_at": now, "updated_at": now}})
+	if err == mgo.ErrNotFound {
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mongoUserRepository) List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, "")
+	if err != nil {
+		return []model.User{}, 0, err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	query := mongoUserQuery(UserFilter{Role: opts.Role, Roles: opts.Roles, NotDeleted: true})
+
+	//A slow count shouldn't cost the page, nor the other way around
+	total, countErr := collection.Find(query).Count()
+
+	//Oldest users first by default, so pages stay stable as users sign up
+	retrievedUsers := []model.User{}
+	pageErr := collection.Find(query).Sort(listSort(opts)...).Skip(opts.Offset).Limit(opts.Limit).All(&retrievedUsers)
+	if pageErr == nil {
+		pageErr = decryptUserSlice(retrievedUsers)
+	}
+
+	return partialList(retrievedUsers, total, countErr, pageErr)
+}
+
+func (mongoUserRepository) Find(ctx context.Context, filter UserFilter, sort []string, offset, limit int) ([]model.User, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, filter.readKey())
+	if err != nil {
+		return []model.User{}, err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	query := collection.Find(mongoUserQuery(filter))
+	if len(sort) > 0 {
+		query = query.Sort(sort...)
+	}
+	retrievedUsers := []model.User{}
+	if err := query.Skip(offset).Limit(limit).All(&retrievedUsers); err != nil {
+		return []model.User{}, err
+	}
+	if err := decryptUserSlice(retrievedUsers); err != nil {
+		return []model.User{}, err
+	}
+
+	return retrievedUsers, nil
+}
+
+func (mongoUserRepository) Count(ctx context.Context, filter UserFilter) (int, error) {
+	//Grab a copy of our read session
+	session, err := getReadSessionContext(ctx, filter.readKey())
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	return session.DB("buzz-test-user").C("users").Find(mongoUserQuery(filter)).Count()
+}
+
+func (mongoUserRepository) Modify(ctx context.Context, filter UserFilter, change UserChange) ([]string, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	update := bson.M{}
+	if len(change.Set) > 0 {
+		update["$set"] = bson.M(change.Set)
+	}
+	if len(change.Unset) > 0 {
+		unset := bson.M{}
+		for _, field := range change.Unset {
+			unset[field] = ""
+		}
+		update["$unset"] = unset
+	}
+
+	//Users are changed one at a time so the ones changed are known, those
+	//no longer picked by the time they're written are left alone
+	query := mongoUserQuery(filter)
+	ids := filter.IDs
+	if len(ids) != 1 {
+		if err := collection.Find(query).Distinct("_id", &ids); err != nil {
+			return nil, err
+		}
+	}
+	changed := []string{}
+	for _, id := range ids {
+		err := collection.Update(bson.M{"$and": []bson.M{query, {"_id": id}}}, update)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return changed, duplicateUserError(err)
+		}
+		changed = append(changed, id)
+	}
+
+	return changed, nil
+}
+
+func (mongoUserRepository) Remove(ctx context.Context, filter UserFilter) (int, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	info, err := session.DB("buzz-test-user").C("users").RemoveAll(mongoUserQuery(filter))
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (mongoUserRepository) Reissue(ctx context.Context, id, newID string) (*model.User, error) {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	db := session.DB("buzz-test-user")
+	collection := db.C("users")
+
+	//Move the document as stored, encrypted fields and all
+	var user model.User
+	err = collection.Find(skipDeleted(bson.M{"_id": id})).One(&user)
+	if err == mgo.ErrNotFound {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//Documents can't change their _id, and the unique indexes don't allow a
+	//copy next to the original, so replace it, putting it back on failure
+	if err := collection.RemoveId(id); err != nil {
+		return nil, err
+	}
+	user.ID = newID
+	user.UpdatedAt = time.Now()
+	if err := collection.Insert(&user); err != nil {
+		user.ID = id
+		if restoreErr := collection.Insert(&user); restoreErr != nil {
+			log.Printf("unable to restore user %s after failing to reissue its id: %v", id, restoreErr)
+		}
+		return nil, err
+	}
+
+	return &user, decryptUsers(&user)
+}
+
+func (mongoUserRepository) LinkIdentity(ctx context.Context, id string, identity model.Identity) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	collection := session.DB("buzz-test-user").C("users")
+
+	//Identities log in to a single account, by an index of migration 0006
+	count, err := collection.Find(mongoUserQuery(UserFilter{Identity: &identity, ExcludeID: id})).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errIdentityTaken
+	}
+
+	//Only link one identity per provider
+	selector := skipDeleted(bson.M{"_id": id, "identities.provider": bson.M{"$ne": identity.Provider}})
+	err = collection.Update(selector, bson.M{"$push": bson.M{"identities": identity}, "$set": bson.M{"updated_at": time.Now()}})
+	if err == mgo.ErrNotFound {
+		if count, err := collection.Find(skipDeleted(bson.M{"_id": id})).Count(); err != nil {
+			return err
+		} else if count == 0 {
+			return errUserNotFound
+		}
+		return errProviderLinked
+	}
+	if mgo.IsDup(err) {
+		return errIdentityTaken
+	}
+	return err
+}
+
+func (mongoUserRepository) UnlinkIdentity(ctx context.Context, id, provider string, keepOne bool) error {
+	//Grab a copy of our session
+	session, err := getSessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	//Get our collection of applications
+	collection := session.DB("buzz-test-user").C("users")
+
+	//Don't lock users out of their account, even when unlinking concurrently
+	selector := bson.M{"_id": id, "identities.provider": provider}
+	if keepOne {
+		selector["identities.1"] = bson.M{"$exists": true}
+	}
+	err = collection.Update(selector, bson.M{"$pull": bson.M{"identities": bson.M{"provider": provider}}, "$set": bson.M{"updated_at": time.Now()}})
+	if err == mgo.ErrNotFound {
+		if count, err := collection.Find(bson.M{"_id": id, "identities.provider": provider}).Count(); err != nil {
+			return err
+		} else if count > 0 {
+			return errLastAuthMethod
+		}
+		return errProviderNotLinked
+	}
+	return err
+}
+
+// mongoUserQuery is the query of the users collection picking the users
+// filter does
+func mongoUserQuery(filter UserFilter) bson.M {
+	clauses := []bson.M{}
+	if len(filter.IDs) > 0 {
+		clauses = append(clauses, bson.M{"_id": bson.M{"$in": filter.IDs}})
+	}
+	if filter.ExcludeID != "" {
+		clauses = append(clauses, bson.M{"_id": bson.M{"$ne": filter.ExcludeID}})
+	}
+	if filter.AfterID != "" {
+		clauses = append(clauses, bson.M{"_id": bson.M{"$gt": filter.AfterID}})
+	}
+	if len(filter.Statuses) > 0 {
+		//Missing statuses match null
+		statuses := make([]interface{}, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			if status != "" {
+				statuses[i] = status
+			}
+		}
+		clauses = append(clauses, bson.M{"status": bson.M{"$in": statuses}})
+	}
+	if filter.NotDeleted {
+		clauses = append(clauses, bson.M{"deleted_at": bson.M{"$exists": false}})
+	}
+	if filter.OnlyDeleted {
+		clauses = append(clauses, bson.M{"deleted_at": bson.M{"$exists": true}})
+	}
+	if filter.NotErased {
+		clauses = append(clauses, bson.M{"erased_at": bson.M{"$exists": false}})
+	}
+	if filter.Password != "" {
+		clauses = append(clauses, bson.M{"password": filter.Password})
+	}
+	if filter.PurgePending {
+		clauses = append(clauses, bson.M{"purge_at": bson.M{"$exists": true}})
+	}
+	if !filter.PurgeBy.IsZero() {
+		clauses = append(clauses, bson.M{"purge_at": bson.M{"$lte": filter.PurgeBy}})
+	}
+	if filter.Role != "" {
+		clauses = append(clauses, bson.M{"role": filter.Role})
+	}
+	if len(filter.Roles) > 0 {
+		clauses = append(clauses, bson.M{"role": bson.M{"$in": roleMatchers(filter.Roles)}})
+	}
+	if filter.Email != "" {
+		clauses = append(clauses, emailQuery(filter.Email))
+	}
+	if len(filter.Usernames) > 0 {
+		clauses = append(clauses, usernamesQuery(filter.Usernames))
+	}
+	if filter.UsernameSkeleton != "" {
+		clauses = append(clauses, bson.M{"username_skeleton": filter.UsernameSkeleton})
+	}
+	if filter.Identity != nil {
+		clauses = append(clauses, identityQuery(filter.Identity.Provider, filter.Identity.Subject))
+	}
+	if !filter.InactiveSince.IsZero() {
+		clauses = append(clauses, bson.M{"$or": []bson.M{
+			{"last_login_at": bson.M{"$lt": filter.InactiveSince}},
+			{"last_login_at": bson.M{"$exists": false}, "timestamp": bson.M{"$lt": filter.InactiveSince.Unix()}},
+		}})
+	}
+	if !filter.SignedUpSince.IsZero() {
+		clauses = append(clauses, bson.M{"timestamp": bson.M{"$gte": filter.SignedUpSince.Unix()}})
+	}
+	if filter.UpdatedAfter != nil {
+		after := bson.M{"updated_at": bson.M{"$gt": *filter.UpdatedAfter}}
+		if filter.UpdatedAfterID != "" {
+			after = bson.M{"$or": []bson.M{after, {"updated_at": *filter.UpdatedAfter, "_id": bson.M{"$gt": filter.UpdatedAfterID}}}}
+		}
+		clauses = append(clauses, after)
+	}
+	if filter.Search != "" {
+		clauses = append(clauses, searchMatchQuery(filter.Search, filter.SearchMatch))
+	}
+
+	switch len(clauses) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return clauses[0]
+	}
+	return bson.M{"$and": clauses}
+}
+
+// memoryUserRepository keeps users in memory, safe for concurrent use, like
+// the MongoDB repository does in the database. With -user-store memory it
+// stores the users of small deployments and development instances running a
+// single instance, which lose them on restart.
+type memoryUserRepository struct {
+	mu    sync.Mutex
+	users map[string]model.User
+}
+
+func newMemoryUserRepository() *memoryUserRepository {
+	return &memoryUserRepository{users: map[string]model.User{}}
+}
+
+// checkAvailable makes sure no user other than user has its username or
+// email, the way the database compares them
+func (r *memoryUserRepository) checkAvailable(user *model.User) error {
+	for id, other := range r.users {
+		if id == user.ID {
+			continue
+		}
+		if !reserveDeletedNames && (other.DeletedAt != nil || user.DeletedAt != nil) {
+			continue
+		}
+		if other.UsernameKey == user.UsernameKey || (usernameConfusableCheck && other.UsernameSkeleton == user.UsernameSkeleton) {
+			return errDuplicateUsername
+		}
+		if user.Email != "" && emailKey(other.Email) == emailKey(user.Email) {
+			return errDuplicateEmail
+		}
+	}
+	return nil
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, user *model.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[user.ID]; ok {
+		return errDuplicateUsername
+	}
+	if err := r.checkAvailable(user); err != nil {
+		return err
+	}
+	r.users[user.ID] = *copyUser(*user)
+	return nil
+}
+
+func (r *memoryUserRepository) GetByID(ctx context.Context, id string, includeDeleted bool) (*model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || (user.DeletedAt != nil && !includeDeleted) {
+		return nil, errUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (r *memoryUserRepository) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := usernameKey(username)
+	for _, user := range r.users {
+		if user.UsernameKey == key && user.DeletedAt == nil {
+			return copyUser(user), nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+func (r *memoryUserRepository) Update(ctx context.Context, id string, update *model.UpdateUser) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt != nil {
+		return errUserNotFound
+	}
+
+	now := time.Now()
+	for field, value := range map[*string]*string{
+		&user.Email:       update.Email,
+		&user.FirstName:   update.FirstName,
+		&user.LastName:    update.LastName,
+		&user.Password:    update.Password,
+		&user.Role:        update.Role,
+		&user.DisplayName: update.DisplayName,
+		&user.AvatarURL:   update.AvatarURL,
+		&user.Timezone:    update.Timezone,
+		&user.Locale:      update.Locale,
+		&user.Phone:       update.Phone,
+	} {
+		if value != nil {
+			*field = *value
+		}
+	}
+	if update.Password != nil {
+		user.PasswordChangedAt = &now
+	}
+	if update.Username != nil {
+		user.Username = normalizeUsername(*update.Username)
+		user.UsernameKey = usernameKey(*update.Username)
+		user.UsernameSkeleton = usernameSkeleton(*update.Username)
+		user.UsernameChangedAt = &now
+	}
+	if err := r.checkAvailable(&user); err != nil {
+		return err
+	}
+
+	user.UpdatedAt = now
+	r.users[id] = user
+	return nil
+}
+
+func (r *memoryUserRepository) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt != nil {
+		return errUserNotFound
+	}
+	now := time.Now()
+	user.Status, user.DeletedAt, user.UpdatedAt = statusDeleted, &now, now
+	r.users[id] = user
+	return nil
+}
+
+func (r *memoryUserRepository) List(ctx context.Context, opts model.ListOptions) ([]model.User, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	matching := r.find(UserFilter{Role: opts.Role, Roles: opts.Roles, NotDeleted: true}, listSort(opts))
+	return pageUsers(matching, opts.Offset, opts.Limit), len(matching), nil
+}
+
+func (r *memoryUserRepository) Find(ctx context.Context, filter UserFilter, sort []string, offset, limit int) ([]model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return pageUsers(r.find(filter, sort), offset, limit), nil
+}
+
+func (r *memoryUserRepository) Count(ctx context.Context, filter UserFilter) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, user := range r.users {
+		if filter.matches(&user) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *memoryUserRepository) Modify(ctx context.Context, filter UserFilter, change UserChange) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, renamed := change.Set["username"]
+	_, readdressed := change.Set["email"]
+	restored := false
+	for _, field := range change.Unset {
+		restored = restored || field == "deleted_at"
+	}
+	changed := []string{}
+	for id, user := range r.users {
+		if !filter.matches(&user) {
+			continue
+		}
+		modified, err := applyUserChange(user, change)
+		if err != nil {
+			return changed, err
+		}
+		if renamed || readdressed || restored {
+			if err := r.checkAvailable(modified); err != nil {
+				return changed, err
+			}
+		}
+		r.users[id] = *modified
+		changed = append(changed, id)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func (r *memoryUserRepository) Remove(ctx context.Context, filter UserFilter) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed := 0
+	for id, user := range r.users {
+		if filter.matches(&user) {
+			delete(r.users, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (r *memoryUserRepository) Reissue(ctx context.Context, id, newID string) (*model.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt != nil {
+		return nil, errUserNotFound
+	}
+	if _, ok := r.users[newID]; ok {
+		return nil, errDuplicateUsername
+	}
+	delete(r.users, id)
+	user.ID, user.UpdatedAt = newID, time.Now()
+	r.users[newID] = user
+	return copyUser(user), nil
+}
+
+func (r *memoryUserRepository) LinkIdentity(ctx context.Context, id string, identity model.Identity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	taken := UserFilter{Identity: &identity, ExcludeID: id}
+	for _, other := range r.users {
+		if taken.matches(&other) {
+			return errIdentityTaken
+		}
+	}
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt != nil {
+		return errUserNotFound
+	}
+	for _, linked := range user.Identities {
+		if linked.Provider == identity.Provider {
+			return errProviderLinked
+		}
+	}
+
+	user.Identities = append(append([]model.Identity{}, user.Identities...), identity)
+	user.UpdatedAt = time.Now()
+	r.users[id] = user
+	return nil
+}
+
+func (r *memoryUserRepository) UnlinkIdentity(ctx context.Context, id, provider string, keepOne bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user := r.users[id]
+	kept := []model.Identity{}
+	for _, identity := range user.Identities {
+		if identity.Provider != provider {
+			kept = append(kept, identity)
+		}
+	}
+	switch {
+	case len(kept) == len(user.Identities):
+		return errProviderNotLinked
+	case keepOne && len(kept) == 0:
+		return errLastAuthMethod
+	}
+
+	user.Identities = kept
+	user.UpdatedAt = time.Now()
+	r.users[id] = user
+	return nil
+}
+
+// find returns copies of the users filter picks, ordered like the database
+// would by each field of fields in turn
+func (r *memoryUserRepository) find(filter UserFilter, fields []string) []model.User {
+	matching := []model.User{}
+	for _, user := range r.users {
+		if filter.matches(&user) {
+			matching = append(matching, *copyUser(user))
+		}
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		for _, field := range fields {
+			descending := strings.HasPrefix(field, "-")
+			if c := compareUserField(&matching[i], &matching[j], strings.TrimPrefix(field, "-")); c != 0 {
+				return (c < 0) != descending
+			}
+		}
+		return false
+	})
+	return matching
+}
+
+// pageUsers returns the users of users after offset, at most limit of them
+// or all of them for 0
+func pageUsers(users []model.User, offset, limit int) []model.User {
+	if offset > len(users) {
+		offset = len(users)
+	}
+	end := len(users)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return users[offset:end]
+}
+
+// applyUserChange returns a copy of user with change made to it, through
+// the fields as stored like the database does
+func applyUserChange(user model.User, change UserChange) (*model.User, error) {
+	data, err := bson.Marshal(&user)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for field, value := range change.Set {
+		doc[field] = value
+	}
+	for _, field := range change.Unset {
+		delete(doc, field)
+	}
+
+	if data, err = bson.Marshal(doc); err != nil {
+		return nil, err
+	}
+	var changed model.User
+	if err := bson.Unmarshal(data, &changed); err != nil {
+		return nil, err
+	}
+	return &changed, nil
+}
+
+// matches reports whether filter picks user, the way mongoUserQuery does
+func (filter UserFilter) matches(user *model.User) bool {
+	switch {
+	case len(filter.IDs) > 0 && !containsString(filter.IDs, user.ID),
+		filter.ExcludeID != "" && user.ID == filter.ExcludeID,
+		filter.AfterID != "" && user.ID <= filter.AfterID,
+		len(filter.Statuses) > 0 && !containsString(filter.Statuses, user.Status),
+		filter.NotDeleted && user.DeletedAt != nil,
+		filter.OnlyDeleted && user.DeletedAt == nil,
+		filter.NotErased && user.ErasedAt != nil,
+		filter.Password != "" && user.Password != filter.Password,
+		filter.PurgePending && user.PurgeAt == nil,
+		!filter.PurgeBy.IsZero() && (user.PurgeAt == nil || user.PurgeAt.After(filter.PurgeBy)),
+		filter.Role != "" && user.Role != filter.Role,
+		len(filter.Roles) > 0 && !hasRoleIgnoringCase(filter.Roles, user.Role),
+		filter.Email != "" && emailKey(user.Email) != emailKey(filter.Email),
+		len(filter.Usernames) > 0 && !hasAnyUsername(user, filter.Usernames),
+		filter.UsernameSkeleton != "" && user.UsernameSkeleton != filter.UsernameSkeleton,
+		filter.Identity != nil && !hasIdentity(user, *filter.Identity),
+		!filter.SignedUpSince.IsZero() && user.Timestamp < filter.SignedUpSince.Unix(),
+		filter.Search != "" && !matchesSearch(user, filter.Search, filter.SearchMatch):
+		return false
+	}
+
+	if !filter.InactiveSince.IsZero() {
+		if user.LastLoginAt != nil && !user.LastLoginAt.Before(filter.InactiveSince) {
+			return false
+		}
+		if user.LastLoginAt == nil && user.Timestamp >= filter.InactiveSince.Unix() {
+			return false
+		}
+	}
+	if after := filter.UpdatedAfter; after != nil {
+		tied := filter.UpdatedAfterID != "" && user.UpdatedAt.Equal(*after) && user.ID > filter.UpdatedAfterID
+		if !user.UpdatedAt.After(*after) && !tied {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAnyUsername reports whether user has one of usernames, compared
+// according to usernameCase
+func hasAnyUsername(user *model.User, usernames []string) bool {
+	for _, username := range usernames {
+		username = normalizeUsername(username)
+		if user.Username == username || (usernameCase == usernameCaseInsensitive && user.UsernameKey == usernameKey(username)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIdentity reports whether identity, by its provider and subject, is
+// linked to user
+func hasIdentity(user *model.User, identity model.Identity) bool {
+	for _, linked := range user.Identities {
+		if linked.Provider == identity.Provider && linked.Subject == identity.Subject {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// compareUserField compares a and b by field, one of the fields users are
+// listed in order of, returning -1, 0 or 1 like strings.Compare. Strings
+// compare byte by byte like the database does.
+func compareUserField(a, b *model.User, field string) int {
+	switch field {
+	case "timestamp":
+		return compareInt64(a.Timestamp, b.Timestamp)
+	case "updated_at":
+		return compareInt64(a.UpdatedAt.UnixNano(), b.UpdatedAt.UnixNano())
+	case "username":
+		return strings.Compare(a.Username, b.Username)
+	case "first_name":
+		return strings.Compare(a.FirstName, b.FirstName)
+	case "last_name":
+		return strings.Compare(a.LastName, b.LastName)
+	case "_id":
+		return strings.Compare(a.ID, b.ID)
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// copyUser returns a copy of user sharing nothing with it, so users handed
+// out can't change the stored ones behind the lock
+func copyUser(user model.User) *model.User {
+	for _, field := range []**time.Time{&user.DeletedAt, &user.PurgeAt, &user.ErasedAt, &user.LastLoginAt, &user.PasswordChangedAt, &user.UsernameChangedAt} {
+		if *field != nil {
+			t := **field
+			*field = &t
+		}
+	}
+	if user.Identities != nil {
+		user.Identities = append([]model.Identity{}, user.Identities...)
+	}
+	return &user
+}
+
+// hasRoleIgnoringCase reports whether role is one of roles, ignoring case
+// like roleMatchers does
+func hasRoleIgnoringCase(roles []string, role string) bool {
+	for _, r := range roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
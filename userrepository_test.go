@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testUserRepository checks that repo stores users the way the service
+// expects of every repository
+func testUserRepository(t *testing.T, repo UserRepository) {
+	ctx := context.Background()
+	newUser := func(username, email, role string) *model.User {
+		return &model.User{
+			ID:               bson.NewObjectId().Hex(),
+			Email:            email,
+			Username:         username,
+			UsernameKey:      usernameKey(username),
+			UsernameSkeleton: usernameSkeleton(username),
+			Role:             role,
+			Status:           statusActive,
+		}
+	}
+
+	first, second := newUser("repoFirst", "repo-first@test.com", "student"), newUser("repoSecond", "repo-second@test.com", "admin")
+	first.Timestamp, second.Timestamp = 1, 2
+	for _, user := range []*model.User{first, second} {
+		if err := repo.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := repo.Create(ctx, newUser("repoFirst", "repo-other@test.com", "student")); err != errDuplicateUsername {
+		t.Errorf("Expected a taken username to be refused but got: %v", err)
+	}
+	if err := repo.Create(ctx, newUser("repoOther", "repo-first@test.com", "student")); err != errDuplicateEmail {
+		t.Errorf("Expected a taken email to be refused but got: %v", err)
+	}
+
+	if user, err := repo.GetByID(ctx, first.ID, false); err != nil || user.Username != "repoFirst" || user.Email != "repo-first@test.com" {
+		t.Errorf("Expected the first user but got: %+v %v", user, err)
+	}
+	if user, err := repo.GetByUsername(ctx, "repoSecond"); err != nil || user.ID != second.ID {
+		t.Errorf("Expected the second user but got: %+v %v", user, err)
+	}
+	if _, err := repo.GetByUsername(ctx, "repoNobody"); err != errUserNotFound {
+		t.Errorf("Expected an unknown username not to be found but got: %v", err)
+	}
+
+	firstName, taken := "Renamed", "repoSecond"
+	if err := repo.Update(ctx, first.ID, &model.UpdateUser{FirstName: &firstName}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := repo.GetByID(ctx, first.ID, false); err != nil || user.FirstName != "Renamed" || user.Role != "student" {
+		t.Errorf("Expected only the first name to change but got: %+v %v", user, err)
+	}
+	if err := repo.Update(ctx, first.ID, &model.UpdateUser{Username: &taken}); err != errDuplicateUsername {
+		t.Errorf("Expected renaming to a taken username to be refused but got: %v", err)
+	}
+
+	if users, total, err := repo.List(ctx, model.ListOptions{Roles: []string{"Admin"}}); err != nil || total != 1 || users[0].ID != second.ID {
+		t.Errorf("Expected only the admin but got: %+v %d %v", users, total, err)
+	}
+	if users, total, err := repo.List(ctx, model.ListOptions{Sort: []string{"-timestamp", "-_id"}, Offset: 1, Limit: 1}); err != nil || total != 2 || len(users) != 1 || users[0].ID != first.ID {
+		t.Errorf("Expected the first user on the second page newest first but got: %+v %d %v", users, total, err)
+	}
+	if users, _, err := repo.List(ctx, model.ListOptions{Sort: []string{"username", "_id"}}); err != nil || len(users) != 2 || users[0].ID != first.ID {
+		t.Errorf("Expected the users by username but got: %+v %v", users, err)
+	}
+
+	if users, err := repo.Find(ctx, UserFilter{Search: "REPO", Statuses: []string{statusActive}}, []string{"-username", "-_id"}, 0, 0); err != nil || len(users) != 2 || users[0].ID != second.ID {
+		t.Errorf("Expected both users found newest username first but got: %+v %v", users, err)
+	}
+	if users, err := repo.Find(ctx, UserFilter{Search: "repofirst", SearchMatch: searchExact}, nil, 0, 0); err != nil || len(users) != 1 || users[0].ID != first.ID {
+		t.Errorf("Expected the first user to match exactly but got: %+v %v", users, err)
+	}
+	if count, err := repo.Count(ctx, UserFilter{Email: "REPO-SECOND@test.com"}); err != nil || count != 1 {
+		t.Errorf("Expected the second user counted by email but got: %d %v", count, err)
+	}
+
+	// Changes only apply to the users still picked
+	stale := UserChange{Set: map[string]interface{}{"status": statusLocked}}
+	if changed, err := repo.Modify(ctx, UserFilter{IDs: []string{first.ID}, Password: "stale"}, stale); err != nil || len(changed) != 0 {
+		t.Errorf("Expected a stale change to be skipped but got: %v %v", changed, err)
+	}
+	change := UserChange{Set: map[string]interface{}{"last_name": "Modified"}, Unset: []string{"first_name"}}
+	if changed, err := repo.Modify(ctx, UserFilter{IDs: []string{first.ID}}, change); err != nil || len(changed) != 1 || changed[0] != first.ID {
+		t.Errorf("Expected the first user to change but got: %v %v", changed, err)
+	}
+	if user, err := repo.GetByID(ctx, first.ID, false); err != nil || user.FirstName != "" || user.LastName != "Modified" || user.Status != statusActive {
+		t.Errorf("Expected the first user changed but got: %+v %v", user, err)
+	}
+	clash := UserChange{Set: map[string]interface{}{"username": "repoSecond", "username_key": usernameKey("repoSecond")}}
+	if _, err := repo.Modify(ctx, UserFilter{IDs: []string{first.ID}}, clash); err != errDuplicateUsername {
+		t.Errorf("Expected changing to a taken username to be refused but got: %v", err)
+	}
+
+	// Identities belong to a single user, one per provider
+	google := model.Identity{Provider: "google", Subject: "repo-subject", LinkedAt: time.Now()}
+	if err := repo.LinkIdentity(ctx, first.ID, google); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.LinkIdentity(ctx, second.ID, google); err != errIdentityTaken {
+		t.Errorf("Expected a taken identity to be refused but got: %v", err)
+	}
+	if err := repo.LinkIdentity(ctx, first.ID, model.Identity{Provider: "google", Subject: "repo-other", LinkedAt: time.Now()}); err != errProviderLinked {
+		t.Errorf("Expected a second identity of a provider to be refused but got: %v", err)
+	}
+	if users, err := repo.Find(ctx, UserFilter{Identity: &google}, nil, 0, 0); err != nil || len(users) != 1 || users[0].ID != first.ID || len(users[0].Identities) != 1 {
+		t.Errorf("Expected the first user found by identity but got: %+v %v", users, err)
+	}
+	if err := repo.UnlinkIdentity(ctx, first.ID, "github", false); err != errProviderNotLinked {
+		t.Errorf("Expected an identity not linked not to be unlinked but got: %v", err)
+	}
+	if err := repo.UnlinkIdentity(ctx, first.ID, "google", true); err != errLastAuthMethod {
+		t.Errorf("Expected the last identity to be kept but got: %v", err)
+	}
+	if err := repo.UnlinkIdentity(ctx, first.ID, "google", false); err != nil {
+		t.Fatal(err)
+	}
+
+	reissued, err := repo.Reissue(ctx, second.ID, bson.NewObjectId().Hex())
+	if err != nil || reissued.Username != "repoSecond" {
+		t.Fatalf("Expected the second user moved but got: %+v %v", reissued, err)
+	}
+	if _, err := repo.GetByID(ctx, second.ID, true); err != errUserNotFound {
+		t.Errorf("Expected the old id to be gone but got: %v", err)
+	}
+	second = reissued
+
+	// Deleted users are only found when asked for
+	if err := repo.Delete(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(ctx, first.ID); err != errUserNotFound {
+		t.Errorf("Expected a deleted user not to be deleted again but got: %v", err)
+	}
+	if _, err := repo.GetByID(ctx, first.ID, false); err != errUserNotFound {
+		t.Errorf("Expected the deleted user to be left out but got: %v", err)
+	}
+	if user, err := repo.GetByID(ctx, first.ID, true); err != nil || user.Status != statusDeleted || user.DeletedAt == nil {
+		t.Errorf("Expected the deleted user when asked for but got: %+v %v", user, err)
+	}
+	if err := repo.Update(ctx, first.ID, &model.UpdateUser{FirstName: &firstName}); err != errUserNotFound {
+		t.Errorf("Expected a deleted user not to be updated but got: %v", err)
+	}
+	if users, total, err := repo.List(ctx, model.ListOptions{}); err != nil || total != 1 || users[0].ID != second.ID {
+		t.Errorf("Expected only the second user to be listed but got: %+v %d %v", users, total, err)
+	}
+
+	if removed, err := repo.Remove(ctx, UserFilter{IDs: []string{first.ID, second.ID}, OnlyDeleted: true}); err != nil || removed != 1 {
+		t.Errorf("Expected the deleted user removed but got: %d %v", removed, err)
+	}
+	if _, err := repo.GetByID(ctx, first.ID, true); err != errUserNotFound {
+		t.Errorf("Expected the removed user to be gone but got: %v", err)
+	}
+}
+
+func TestMemoryUserRepository(t *testing.T) {
+	testUserRepository(t, newMemoryUserRepository())
+}
+
+// TestMemoryUserRepositoryConcurrently is for the race detector, creating,
+// reading, listing and deleting users at once
+func TestMemoryUserRepositoryConcurrently(t *testing.T) {
+	repo := newMemoryUserRepository()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			username := fmt.Sprintf("concurrent%c%c", 'a'+i/26, 'a'+i%26)
+			user := &model.User{ID: bson.NewObjectId().Hex(), Email: username + "@test.com", Username: username, UsernameKey: usernameKey(username), UsernameSkeleton: usernameSkeleton(username), Timestamp: int64(i)}
+			if err := repo.Create(ctx, user); err != nil {
+				t.Errorf("Expected %s to be created but got: %v", username, err)
+				return
+			}
+			if found, err := repo.GetByUsername(ctx, username); err != nil || found.ID != user.ID {
+				t.Errorf("Expected %s to be found but got: %+v %v", username, found, err)
+			}
+			if _, _, err := repo.List(ctx, model.ListOptions{Sort: []string{"-username", "-_id"}, Limit: 10}); err != nil {
+				t.Error(err)
+			}
+			if i%2 == 0 {
+				if err := repo.Delete(ctx, user.ID); err != nil {
+					t.Errorf("Expected %s to be deleted but got: %v", username, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, total, err := repo.List(ctx, model.ListOptions{}); err != nil || total != 25 {
+		t.Errorf("Expected the 25 users not deleted but got: %d %v", total, err)
+	}
+}
+
+func TestMongoUserRepository(t *testing.T) {
+	session, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	defer session.DB("buzz-test-user").C("users").RemoveAll(bson.M{"username": bson.M{"$in": []string{"repoFirst", "repoSecond"}}})
+
+	testUserRepository(t, mongoUserRepository{})
+}
+
+func TestUserServiceWithMemoryRepository(t *testing.T) {
+	defer func(repo UserRepository) { userRepository = repo }(userRepository)
+	userRepository = newMemoryUserRepository()
+
+	svc := userService{}
+	ctx := context.Background()
+
+	user, err := svc.Create(ctx, &model.CreateUser{Email: "memory@test.com", FirstName: "memory", LastName: "user", Password: password, Role: "student", Username: "memoryUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := svc.GetByUsername(ctx, "memoryUser"); err != nil || found.ID != user.ID || found.Password == password {
+		t.Errorf("Expected the user with a hashed password but got: %+v %v", found, err)
+	}
+
+	// Lookups that used to query MongoDB directly go through the repository
+	if found, err := svc.GetByEmail(ctx, "MEMORY@test.com"); err != nil || found.ID != user.ID {
+		t.Errorf("Expected the user by email but got: %+v %v", found, err)
+	}
+	if resolved, err := svc.ResolveUsernames(ctx, []string{"memoryUser", "nobody"}); err != nil || len(resolved) != 1 || resolved[0].ID != user.ID {
+		t.Errorf("Expected the username resolved but got: %+v %v", resolved, err)
+	}
+	if found, total, err := svc.Search(ctx, model.ListOptions{Query: "memo"}); err != nil || total != 1 || found[0].ID != user.ID {
+		t.Errorf("Expected the user found but got: %+v %d %v", found, total, err)
+	}
+
+	lastName := "renamed"
+	if updated, err := svc.Update(ctx, user.ID, &model.UpdateUser{LastName: &lastName}); err != nil || updated.LastName != "renamed" {
+		t.Errorf("Expected the last name to change but got: %+v %v", updated, err)
+	}
+	if err := svc.Delete(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := svc.GetAll(ctx); err != nil || len(users) != 0 {
+		t.Errorf("Expected no users left but got: %+v %v", users, err)
+	}
+}
+
+func TestReserveDeletedNames(t *testing.T) {
+	defer func(repo UserRepository, reserve bool) { userRepository, reserveDeletedNames = repo, reserve }(userRepository, reserveDeletedNames)
+
+	svc := userService{}
+	ctx := context.Background()
+	signup := func() (*model.User, error) {
+		return svc.Create(ctx, &model.CreateUser{Email: "reserved@test.com", FirstName: "reserved", LastName: "user", Password: password, Role: "student", Username: "reservedUser"})
+	}
+
+	for _, reserve := range []bool{true, false} {
+		userRepository, reserveDeletedNames = newMemoryUserRepository(), reserve
+		deleted, err := signup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.Delete(ctx, deleted.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reserved, the deleted user's names can't be signed up with
+		again, err := signup()
+		if reserve {
+			if err != errDuplicateUsername {
+				t.Errorf("Expected the deleted user's username to be reserved but got: %+v %v", again, err)
+			}
+			if _, err := svc.Reactivate(ctx, deleted.ID); err != nil {
+				t.Errorf("Expected the deleted user to be reactivated but got: %v", err)
+			}
+			continue
+		}
+
+		// Released, they can, and the deleted user can't come back with them
+		if err != nil {
+			t.Fatalf("Expected the deleted user's names to be released but got: %v", err)
+		}
+		if _, err := svc.Reactivate(ctx, deleted.ID); err != errDuplicateUsername {
+			t.Errorf("Expected the deleted user not to be reactivated with a taken username but got: %v", err)
+		}
+		if err := svc.Delete(ctx, again.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := svc.Reactivate(ctx, deleted.ID); err != nil {
+			t.Errorf("Expected the deleted user to be reactivated once their names are free but got: %v", err)
+		}
+	}
+}
+
+func TestPartialList(t *testing.T) {
+	users := []model.User{{ID: "1"}}
+	countErr, pageErr := errors.New("count failed"), errors.New("page failed")
+	if got, total, err := partialList(users, 3, nil, nil); err != nil || len(got) != 1 || total != 3 {
+		t.Errorf("Expected the whole list but got: %v %d %v", got, total, err)
+	}
+	if got, _, err := partialList(users, 0, countErr, nil); len(got) != 1 || err != (partialListError{warning: warnTotalUnavailable, err: countErr}) {
+		t.Errorf("Expected the page without its total but got: %v %v", got, err)
+	}
+	if _, total, err := partialList(nil, 3, nil, pageErr); total != 3 || err != (partialListError{warning: warnPageUnavailable, err: pageErr}) {
+		t.Errorf("Expected the total without its page but got: %d %v", total, err)
+	}
+	if _, _, err := partialList(nil, 0, countErr, pageErr); err != pageErr {
+		t.Errorf("Expected the list to fail but got: %v", err)
+	}
+}
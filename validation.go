@@ -2,68 +2,1079 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // so timezones can be checked on hosts without a zoneinfo database
+	"unicode"
 
+	"github.com/buzzapp/user/model"
 	"github.com/buzzapp/user/reqres"
 )
 
-func validateCreateUser(user *reqres.CreateUserRequest) error {
-	if user.Email == "" || !isValidEmail(user.Email) {
-		return errors.New("Invalid email address or email address not provided")
+// Character classes a password policy can require
+const (
+	lowercaseClass = "lowercase"
+	uppercaseClass = "uppercase"
+	digitClass     = "digit"
+	symbolClass    = "symbol"
+)
+
+// Codes for validation errors clients may want to branch on
+const (
+	passwordPersonalInfoCode = "PASSWORD_CONTAINS_PERSONAL_INFO"
+	passwordBannedCode       = "PASSWORD_TOO_COMMON"
+	underMinimumAgeCode      = "UNDER_MINIMUM_AGE"
+	tosNotAcceptedCode       = "TOS_NOT_ACCEPTED"
+)
+
+// dateOfBirthLayout is the format dates of birth are given in
+const dateOfBirthLayout = "2006-01-02"
+
+// minimumAge is the age users must have reached to sign up, e.g. 13 for
+// COPPA. A date of birth is only required when it is set.
+var minimumAge = 0
+
+// codedError is a validation error carrying a machine readable code and the
+// request field it is about, either of which may be empty
+type codedError struct {
+	code    string
+	field   string
+	message string
+}
+
+func (e codedError) Error() string {
+	return e.message
+}
+
+// fieldError is a validation error about a single request field
+func fieldError(field, message string) error {
+	return codedError{field: field, message: message}
+}
+
+// withField moves a validation error to another request field, e.g. when a
+// password is validated as the new_password of a change
+func withField(err error, field string) error {
+	switch e := err.(type) {
+	case codedError:
+		e.field = field
+		return e
+	case validationErrors:
+		moved := make(validationErrors, len(e))
+		for i, coded := range e {
+			coded.field = field
+			moved[i] = coded
+		}
+		return moved
+	}
+	return fieldError(field, err.Error())
+}
+
+// validationErrors are all the validation errors of a request, so clients can
+// point out every offending field at once
+type validationErrors []codedError
+
+func (errs validationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// fieldErrors accumulates the validation errors of a request, field by field
+type fieldErrors struct {
+	errs validationErrors
+}
+
+// add records err, when there is one
+func (f *fieldErrors) add(err error) {
+	switch e := err.(type) {
+	case nil:
+	case codedError:
+		f.errs = append(f.errs, e)
+	case validationErrors:
+		f.errs = append(f.errs, e...)
+	default:
+		f.errs = append(f.errs, codedError{message: err.Error()})
+	}
+}
+
+// has reports whether field already failed, for checks that only make sense
+// of a field that's otherwise valid
+func (f *fieldErrors) has(field string) bool {
+	for _, err := range f.errs {
+		if err.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns what was recorded, nil when nothing was. A single error is
+// returned as it is.
+func (f *fieldErrors) err() error {
+	switch len(f.errs) {
+	case 0:
+		return nil
+	case 1:
+		return f.errs[0]
+	}
+	return f.errs
+}
+
+// isValidationError reports whether err is a validation error, of one field
+// or of several
+func isValidationError(err error) bool {
+	switch err.(type) {
+	case codedError, validationErrors:
+		return true
+	}
+	return false
+}
+
+// fieldErrorsOf returns the validation errors err is made of, none when it
+// isn't a validation error
+func fieldErrorsOf(err error) []codedError {
+	switch e := err.(type) {
+	case codedError:
+		return []codedError{e}
+	case validationErrors:
+		return e
+	}
+	return nil
+}
+
+// passwordPolicy is the policy new passwords are validated against
+var passwordPolicy = model.PasswordPolicy{
+	MinLength:       8,
+	RequiredClasses: []string{},
+}
+
+// Validation modes. Lenient validation turns non-critical issues into warnings
+// so clients can migrate at their own pace.
+const (
+	validationStrict  = "strict"
+	validationLenient = "lenient"
+)
+
+// validationModeHeader lets a request pick its own validation mode
+const validationModeHeader = "X-Validation-Mode"
+
+// validationMode is the validation mode of requests that don't pick one
+var validationMode = validationStrict
+
+func isValidValidationMode(mode string) bool {
+	return mode == validationStrict || mode == validationLenient
+}
+
+// validationModeOf returns the validation mode of a request
+func validationModeOf(r *http.Request) string {
+	if mode := strings.ToLower(r.Header.Get(validationModeHeader)); isValidValidationMode(mode) {
+		return mode
+	}
+	return validationMode
+}
+
+// validation collects the warnings of a lenient validation
+type validation struct {
+	mode     string
+	warnings []string
+}
+
+// soft reports a non-critical issue with field, which only fails strict
+// validation
+func (v *validation) soft(field, message string) error {
+	if v.mode == validationLenient {
+		v.warnings = append(v.warnings, message)
+		return nil
+	}
+	return fieldError(field, message)
+}
+
+// validateSignupEmail checks the email of a signup, the same way whether the
+// signup is made or only checked ahead of time
+func validateSignupEmail(email string) error {
+	if email == "" || !isValidEmail(email) {
+		return fieldError("email", "Invalid email address or email address not provided")
 	}
+	return nil
+}
+
+func validateCreateUser(user *reqres.CreateUserRequest, v *validation) error {
+	var errs fieldErrors
+	errs.add(validateSignupEmail(user.Email))
 
 	if user.FirstName == "" {
-		return errors.New("Please provide a first name")
+		errs.add(v.soft("first_name", "Please provide a first name"))
 	}
 
 	if user.LastName == "" {
-		return errors.New("Please provide a last name")
+		errs.add(v.soft("last_name", "Please provide a last name"))
 	}
 
 	if user.Username == "" {
-		return errors.New("Please provide an username")
+		errs.add(fieldError("username", "Please provide an username"))
+	}
+
+	errs.add(validatePassword(user.Password, user.Username, user.Email, user.FirstName, user.LastName))
+
+	if user.Role != "" && !isValidRole(user.Role) {
+		errs.add(fieldError("role", "Unknown role: "+user.Role))
 	}
 
-	if user.Password == "" {
-		return errors.New("Please provide a password")
+	errs.add(validateDateOfBirth(user.DateOfBirth, time.Now()))
+
+	if requireTOSAcceptance && user.AcceptedTOSVersion != currentTOSVersion {
+		errs.add(codedError{code: tosNotAcceptedCode, field: "accepted_tos_version", message: "Please accept terms of service version " + currentTOSVersion})
+	}
+
+	return errs.err()
+}
+
+func validateDateOfBirth(dateOfBirth string, now time.Time) error {
+	if dateOfBirth == "" {
+		if minimumAge > 0 {
+			return fieldError("date_of_birth", "Please provide a date of birth")
+		}
+		return nil
+	}
+
+	dob, err := time.Parse(dateOfBirthLayout, dateOfBirth)
+	if err != nil {
+		return fieldError("date_of_birth", "Please provide the date of birth as YYYY-MM-DD")
+	}
+
+	// It is already a later date in most of the world, so go by the earliest
+	// date anywhere (UTC-12) to never count a birthday before it has happened
+	today := now.In(time.FixedZone("UTC-12", -12*60*60))
+	if dob.After(today) {
+		return fieldError("date_of_birth", "The date of birth can't be in the future")
 	}
 
-	if user.Role == "" {
-		return errors.New("Please provide a role")
+	if ageOn(dob, today) < minimumAge {
+		return codedError{code: underMinimumAgeCode, field: "date_of_birth", message: fmt.Sprintf("You must be at least %d years old to sign up", minimumAge)}
 	}
 
 	return nil
 }
 
+// ageOn returns how many full years old someone born on dob is on day
+func ageOn(dob, day time.Time) int {
+	age := day.Year() - dob.Year()
+	if day.Month() < dob.Month() || (day.Month() == dob.Month() && day.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
 func validateGetUserByID(id string) error {
 	if id == "" {
-		return errors.New("Please provide an id")
+		return fieldError("id", "Please provide an id")
 	}
 
 	return nil
 }
 
-func validateLoginUser(payload *reqres.LoginRequest) error {
+func validateRoleDiff(id, to string) error {
+	if id == "" {
+		return fieldError("id", "Please provide an id")
+	}
+
+	if to == "" || !isValidRole(to) {
+		return fieldError("to", "Please provide a valid role to compare with")
+	}
+
+	return nil
+}
+
+// maxResolveUsernames caps how many usernames can be resolved in one request
+const maxResolveUsernames = 100
+
+func validateResolveUsers(payload *reqres.ResolveUsersRequest) error {
+	if len(payload.Usernames) == 0 {
+		return fieldError("usernames", "Please provide at least one username")
+	}
+
+	if len(payload.Usernames) > maxResolveUsernames {
+		return fieldError("usernames", fmt.Sprintf("Please provide at most %d usernames", maxResolveUsernames))
+	}
+
+	return nil
+}
+
+func validateBulkVerify(payload *reqres.BulkVerifyRequest) error {
+	if len(payload.Users) == 0 {
+		return fieldError("users", "Please provide at least one id or email")
+	}
+
+	if len(payload.Users) > maxBulkUpdateRows {
+		return fieldError("users", fmt.Sprintf("Please provide at most %d users", maxBulkUpdateRows))
+	}
+
+	return nil
+}
+
+func validateAcceptTOS(payload *reqres.AcceptTOSRequest) error {
+	if payload.Version == "" {
+		return fieldError("version", "Please provide a version")
+	}
+
+	// Only the current terms can be accepted
+	if payload.Version != currentTOSVersion {
+		return fieldError("version", "Please accept the current terms of service version "+currentTOSVersion)
+	}
+
+	return nil
+}
+
+func validateUpdateUser(id string, user *reqres.UpdateUserRequest) error {
+	if err := validateGetUserByID(id); err != nil {
+		return err
+	}
+
+	var errs fieldErrors
+	if user.Email != nil && !isValidEmail(*user.Email) {
+		errs.add(fieldError("email", "Invalid email address"))
+	}
+
+	if user.FirstName != nil && *user.FirstName == "" {
+		errs.add(fieldError("first_name", "Please provide a first name"))
+	}
+
+	if user.LastName != nil && *user.LastName == "" {
+		errs.add(fieldError("last_name", "Please provide a last name"))
+	}
+
+	if user.Username != nil && *user.Username == "" {
+		errs.add(fieldError("username", "Please provide an username"))
+	}
+
+	if user.Role != nil && !isValidRole(*user.Role) {
+		errs.add(fieldError("role", "Unknown role: "+*user.Role))
+	}
+
+	errs.add(validateProfile(user.DisplayName, user.AvatarURL, user.Timezone, user.Locale, user.Phone))
+
+	if user.Password != nil {
+		var userContext []string
+		for _, value := range []*string{user.Username, user.Email, user.FirstName, user.LastName} {
+			if value != nil {
+				userContext = append(userContext, *value)
+			}
+		}
+		errs.add(validatePassword(*user.Password, userContext...))
+	}
+
+	return errs.err()
+}
+
+// validateUpdateMe checks an update of your own account, like any other
+// update of the account
+func validateUpdateMe(id string, payload *reqres.UpdateMeRequest) error {
+	return validateUpdateUser(id, &reqres.UpdateUserRequest{
+		Email:       payload.Email,
+		FirstName:   payload.FirstName,
+		LastName:    payload.LastName,
+		Username:    payload.Username,
+		DisplayName: payload.DisplayName,
+		AvatarURL:   payload.AvatarURL,
+		Timezone:    payload.Timezone,
+		Locale:      payload.Locale,
+		Phone:       payload.Phone,
+	})
+}
+
+// Limits of the profile fields
+const (
+	maxDisplayNameLength = 64
+	maxAvatarURLLength   = 2048
+)
+
+var (
+	// localePattern matches BCP 47 language tags such as en or pt-BR
+	localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+	// phonePattern matches phone numbers in the E.164 international format
+	phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// validateProfile checks the profile fields of an update. Empty fields clear
+// the field so they're always valid.
+func validateProfile(displayName, avatarURL, timezone, locale, phone *string) error {
+	var errs fieldErrors
+	if displayName != nil && len([]rune(*displayName)) > maxDisplayNameLength {
+		errs.add(fieldError("display_name", fmt.Sprintf("Display names can't be longer than %d characters", maxDisplayNameLength)))
+	}
+
+	if avatarURL != nil && *avatarURL != "" && !isValidAvatarURL(*avatarURL) {
+		errs.add(fieldError("avatar_url", "Please provide an http or https URL"))
+	}
+
+	if timezone != nil && *timezone != "" && !isValidTimezone(*timezone) {
+		errs.add(fieldError("timezone", "Unknown timezone: "+*timezone))
+	}
+
+	if locale != nil && *locale != "" && !localePattern.MatchString(*locale) {
+		errs.add(fieldError("locale", "Please provide a locale such as en-US"))
+	}
+
+	if phone != nil && *phone != "" && !phonePattern.MatchString(*phone) {
+		errs.add(fieldError("phone", "Please provide a phone number in international format such as +14155550100"))
+	}
+
+	return errs.err()
+}
+
+// isValidAvatarURL reports whether avatar is an absolute http or https URL
+func isValidAvatarURL(avatar string) bool {
+	if len(avatar) > maxAvatarURLLength {
+		return false
+	}
+	u, err := url.Parse(avatar)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// isValidTimezone reports whether timezone is an IANA timezone such as
+// Europe/Paris. Local is refused, it means whatever the server runs in.
+func isValidTimezone(timezone string) bool {
+	if timezone == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(timezone)
+	return err == nil
+}
+
+// parseAuditExportQuery parses and checks the format and since time of an
+// audit log export. It's JSON of every event unless asked otherwise.
+func parseAuditExportQuery(query url.Values) (string, time.Time, error) {
+	format := query.Get("format")
+	if format == "" {
+		format = auditExportJSON
+	}
+	if !isValidAuditExportFormat(format) {
+		return "", time.Time{}, fieldError("format", "Please provide a format of json or cef")
+	}
+
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			return "", time.Time{}, fieldError("since", "Please provide since as an RFC 3339 time")
+		}
+	}
+	return format, since, nil
+}
+
+// parseChangesQuery parses and checks the since time and page size of a
+// changes feed request
+func parseChangesQuery(since, limit string) (time.Time, int, error) {
+	if since == "" {
+		return time.Time{}, 0, fieldError("since", "Please provide since as an RFC 3339 time")
+	}
+	sinceTime, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, 0, fieldError("since", "Please provide since as an RFC 3339 time")
+	}
+
+	if limit == "" {
+		return sinceTime, defaultChangesLimit, nil
+	}
+	limitValue, err := strconv.Atoi(limit)
+	if err != nil || limitValue < 1 || limitValue > maxChangesLimit {
+		return time.Time{}, 0, fieldError("limit", fmt.Sprintf("Please provide a limit between 1 and %d", maxChangesLimit))
+	}
+
+	return sinceTime, limitValue, nil
+}
+
+// Page sizes of listing users
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// parsePagingQuery reads the page of a list that is paged like users, e.g.
+// security events, but has no role to filter by
+func parsePagingQuery(query url.Values) (model.ListOptions, error) {
+	paging := url.Values{}
+	for _, key := range []string{"offset", "limit", "page", "per_page"} {
+		if values, ok := query[key]; ok {
+			paging[key] = values
+		}
+	}
+	return parseListUsersQuery(paging)
+}
+
+// parseListUsersQuery parses and checks the page and role filter of a list
+// users request. Pages are given either as offset and limit or as page and
+// per_page, counting pages from 1.
+func parseListUsersQuery(query url.Values) (model.ListOptions, error) {
+	opts := model.ListOptions{Limit: defaultListLimit, Role: query.Get("role")}
+
+	if opts.Role != "" && !isValidRole(opts.Role) {
+		return opts, fieldError("role", "Please provide a known role")
+	}
+
+	paged := query.Get("page") != "" || query.Get("per_page") != ""
+	if paged && (query.Get("offset") != "" || query.Get("limit") != "") {
+		return opts, errors.New("Please provide either offset and limit or page and per_page")
+	}
+
+	limit, perPage := query.Get("limit"), query.Get("per_page")
+	if paged {
+		limit = perPage
+	}
+	if limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxListLimit {
+			field := "limit"
+			if paged {
+				field = "per_page"
+			}
+			return opts, fieldError(field, fmt.Sprintf("Please provide a page size between 1 and %d", maxListLimit))
+		}
+		opts.Limit = value
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return opts, fieldError("offset", "Please provide an offset of 0 or more")
+		}
+		opts.Offset = value
+	}
+
+	if page := query.Get("page"); page != "" {
+		value, err := strconv.Atoi(page)
+		if err != nil || value < 1 {
+			return opts, fieldError("page", "Please provide a page of 1 or more")
+		}
+		opts.Offset = (value - 1) * opts.Limit
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		fields, err := parseListSort(sort)
+		if err != nil {
+			return opts, err
+		}
+		opts.Sort = fields
+	}
+
+	return opts, nil
+}
+
+// listSortFields are the fields users can be listed in order of, by what
+// they are called in the sort parameter. Emails can be encrypted, so users
+// can't be sorted by them.
+var listSortFields = map[string]string{
+	"created":    "timestamp",
+	"updated":    "updated_at",
+	"username":   "username",
+	"first_name": "first_name",
+	"last_name":  "last_name",
+}
+
+// parseListSort reads the sort parameter of a list, one of listSortFields
+// prefixed with - for descending order. Users sorting the same are kept in a
+// stable order by their id, so pages don't overlap.
+func parseListSort(sort string) ([]string, error) {
+	direction, name := "", sort
+	if strings.HasPrefix(sort, "-") {
+		direction, name = "-", sort[1:]
+	}
+
+	field, ok := listSortFields[name]
+	if !ok {
+		return nil, fieldError("sort", "Please sort by created, updated, username, first_name or last_name, prefixed with - for descending order")
+	}
+	return []string{direction + field, direction + "_id"}, nil
+}
+
+// maxSearchQueryLength caps the length of user search queries
+const maxSearchQueryLength = 100
+
+// parseSearchUsersQuery parses and checks a user search request, which pages
+// and filters like listing users
+func parseSearchUsersQuery(query url.Values) (model.ListOptions, error) {
+	opts, err := parseListUsersQuery(query)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Query = strings.TrimSpace(query.Get("q"))
+	if opts.Query == "" {
+		return opts, fieldError("q", "Please provide something to search for")
+	}
+	if len([]rune(opts.Query)) > maxSearchQueryLength {
+		return opts, fieldError("q", fmt.Sprintf("Please provide at most %d characters to search for", maxSearchQueryLength))
+	}
+
+	return opts, nil
+}
+
+// isUserLookup reports whether a users query looks a single user up by
+// username or email rather than listing users
+func isUserLookup(query url.Values) bool {
+	_, byUsername := query["username"]
+	_, byEmail := query["email"]
+	return byUsername || byEmail
+}
+
+// parseUserLookupQuery returns the field and value to look a single user up by
+func parseUserLookupQuery(query url.Values) (string, string, error) {
+	_, byUsername := query["username"]
+	_, byEmail := query["email"]
+	if byUsername && byEmail {
+		return "", "", errors.New("Please look a user up by either username or email")
+	}
+
+	if byUsername {
+		username := query.Get("username")
+		if strings.TrimSpace(username) == "" {
+			return "", "", fieldError("username", "Please provide an username")
+		}
+		return "username", username, nil
+	}
+
+	// Emails are only valid in lower case, but match in any case
+	email := strings.ToLower(query.Get("email"))
+	if email == "" || !isValidEmail(email) {
+		return "", "", fieldError("email", "Please provide a valid email")
+	}
+	return "email", email, nil
+}
+
+// parseDuplicatesQuery parses and checks the criteria and page of a duplicate
+// accounts report request, defaulting to duplicateCriteria and the first page
+func parseDuplicatesQuery(criteria, offset, limit string) ([]string, int, int, error) {
+	criteriaValue := duplicateCriteria
+	if criteria != "" {
+		var err error
+		if criteriaValue, err = parseDuplicateCriteria(criteria); err != nil {
+			return nil, 0, 0, withField(err, "criteria")
+		}
+	}
+
+	offsetValue := 0
+	if offset != "" {
+		var err error
+		if offsetValue, err = strconv.Atoi(offset); err != nil || offsetValue < 0 {
+			return nil, 0, 0, fieldError("offset", "Please provide an offset of 0 or more")
+		}
+	}
+
+	limitValue := defaultDuplicatesLimit
+	if limit != "" {
+		var err error
+		if limitValue, err = strconv.Atoi(limit); err != nil || limitValue < 1 || limitValue > maxDuplicatesLimit {
+			return nil, 0, 0, fieldError("limit", fmt.Sprintf("Please provide a limit between 1 and %d", maxDuplicatesLimit))
+		}
+	}
+
+	return criteriaValue, offsetValue, limitValue, nil
+}
+
+// parseDeactivateInactiveQuery parses the cutoff users must have logged in
+// since to stay active, and whether only to preview the deactivation
+func parseDeactivateInactiveQuery(inactiveSince, dryRun string) (time.Time, bool, error) {
+	cutoff, err := time.Parse(time.RFC3339, inactiveSince)
+	if err != nil {
+		return time.Time{}, false, fieldError("inactive_since", "Please provide an RFC 3339 time users must have logged in since")
+	}
+	if !cutoff.Before(time.Now()) {
+		return time.Time{}, false, fieldError("inactive_since", "Please provide a time in the past")
+	}
+
+	dryRunValue, err := parseDryRun(dryRun)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return cutoff, dryRunValue, nil
+}
+
+// parseEmailPreviewQuery parses which email to preview and in which locale,
+// the default one unless asked
+func parseEmailPreviewQuery(name, locale string) (string, string, error) {
+	var errs fieldErrors
+	if name == "" {
+		errs.add(fieldError("template", "Please provide the template to preview"))
+	}
+	if locale == "" {
+		locale = defaultWelcomeLocale
+	} else if !localePattern.MatchString(locale) {
+		errs.add(fieldError("locale", "Please provide a locale such as en-US"))
+	}
+	return name, locale, errs.err()
+}
+
+// parseDryRun parses whether only to preview a destructive operation, which
+// it isn't unless asked
+func parseDryRun(dryRun string) (bool, error) {
+	if dryRun == "" {
+		return false, nil
+	}
+	value, err := strconv.ParseBool(dryRun)
+	if err != nil {
+		return false, fieldError("dry_run", "Please provide true or false")
+	}
+	return value, nil
+}
+
+// validateChangePassword checks a password change for user, whose details the
+// new password may not contain
+func validateChangePassword(payload *reqres.ChangePasswordRequest, user *model.User) error {
+	var errs fieldErrors
+	if payload.CurrentPassword == "" {
+		errs.add(fieldError("current_password", "Please provide your current password"))
+	}
+
+	if payload.NewPassword == "" {
+		errs.add(fieldError("new_password", "Please provide a new password"))
+	} else if err := validatePassword(payload.NewPassword, user.Username, user.Email, user.FirstName, user.LastName); err != nil {
+		errs.add(withField(err, "new_password"))
+	}
+
+	return errs.err()
+}
+
+func validateReserveUsername(payload *reqres.ReserveUsernameRequest) error {
+	if normalizeUsername(payload.Username) == "" {
+		return fieldError("username", "Please provide an username")
+	}
+
+	return nil
+}
+
+func validateReleaseUsername(payload *reqres.ReleaseUsernameRequest) error {
+	if payload.Username == "" {
+		return fieldError("username", "Please provide an username")
+	}
+
+	if payload.ReservationToken == "" {
+		return fieldError("reservation_token", "Please provide the reservation token")
+	}
+
+	return nil
+}
+
+func validateCreateAPIKey(payload *reqres.CreateAPIKeyRequest, now time.Time) error {
+	if strings.TrimSpace(payload.Name) == "" {
+		return fieldError("name", "Please provide a name")
+	}
+
+	if len(payload.Scopes) == 0 {
+		return fieldError("scopes", "Please provide the scopes of the key")
+	}
+	for _, scope := range payload.Scopes {
+		if len(rolesWithScope(scope)) == 0 {
+			return fieldError("scopes", "Unknown scope: "+scope)
+		}
+	}
+
+	if payload.ExpiresAt != nil && !payload.ExpiresAt.After(now) {
+		return fieldError("expires_at", "Please provide an expiry in the future")
+	}
+
+	return nil
+}
+
+func validateRequestPasswordReset(payload *reqres.RequestPasswordResetRequest) error {
+	// Emails are only valid in lower case, but match in any case
+	if payload.Email == "" || !isValidEmail(strings.ToLower(payload.Email)) {
+		return fieldError("email", "Please provide a valid email")
+	}
+
+	return nil
+}
+
+func validateResendVerification(payload *reqres.ResendVerificationRequest) error {
+	// Emails are only valid in lower case, but match in any case
+	if payload.Email == "" || !isValidEmail(strings.ToLower(payload.Email)) {
+		return fieldError("email", "Please provide a valid email")
+	}
+
+	return nil
+}
+
+// validateConfirmPasswordReset only checks the request is complete. The new
+// password is checked against the details of the user the token belongs to.
+func validateConfirmPasswordReset(payload *reqres.ConfirmPasswordResetRequest) error {
+	var errs fieldErrors
+	if payload.Token == "" {
+		errs.add(fieldError("token", "Please provide the password reset token"))
+	}
+
+	if payload.NewPassword == "" {
+		errs.add(fieldError("new_password", "Please provide a new password"))
+	}
+
+	return errs.err()
+}
+
+func validateInviteUser(payload *reqres.InviteUserRequest) error {
+	var errs fieldErrors
+	errs.add(validateSignupEmail(payload.Email))
+
 	if payload.Username == "" {
-		return errors.New("Please provide an username")
+		errs.add(fieldError("username", "Please provide an username"))
+	}
+
+	if payload.Role != "" && !isValidRole(payload.Role) {
+		errs.add(fieldError("role", "Unknown role: "+payload.Role))
+	}
+
+	return errs.err()
+}
+
+func validateAcceptInvitation(payload *reqres.AcceptInvitationRequest) error {
+	var errs fieldErrors
+	if payload.Token == "" {
+		errs.add(fieldError("token", "Please provide the invite token"))
 	}
 
 	if payload.Password == "" {
-		return errors.New("Please provide a password")
+		errs.add(fieldError("password", "Please provide a password"))
+	}
+
+	return errs.err()
+}
+
+// validateGroupName checks the name of a group
+func validateGroupName(name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fieldError("name", "Please provide a name")
+	}
+	if len([]rune(name)) > maxGroupNameLength {
+		return fieldError("name", fmt.Sprintf("Group names can't be longer than %d characters", maxGroupNameLength))
+	}
+
+	return nil
+}
+
+func validateCreateGroup(payload *reqres.CreateGroupRequest) error {
+	return validateGroupName(payload.Name)
+}
+
+func validateUpdateGroup(id string, payload *reqres.UpdateGroupRequest) error {
+	var errs fieldErrors
+	errs.add(validateGetUserByID(id))
+
+	if payload.Name != nil {
+		errs.add(validateGroupName(*payload.Name))
+	}
+
+	return errs.err()
+}
+
+func validateVerifyChallenge(id string, payload *reqres.VerifyChallengeRequest) error {
+	if err := validateGetUserByID(id); err != nil {
+		return err
+	}
+
+	if payload.Code == "" {
+		return fieldError("code", "Please provide the code")
 	}
 
 	return nil
 }
 
+func validateSetStatus(id string, payload *reqres.SetStatusRequest) error {
+	if err := validateGetUserByID(id); err != nil {
+		return err
+	}
+
+	if !isValidStatus(payload.Status) {
+		return fieldError("status", "Please provide a status: pending, active, deactivated, locked or deleted")
+	}
+
+	return nil
+}
+
+// parseTimeRange parses an optional RFC 3339 time range, leaving missing ends
+// as zero times
+func parseTimeRange(from, to string) (time.Time, time.Time, error) {
+	var fromTime, toTime time.Time
+	var err error
+
+	if from != "" {
+		if fromTime, err = time.Parse(time.RFC3339, from); err != nil {
+			return fromTime, toTime, fieldError("from", "Please provide from as an RFC 3339 time")
+		}
+	}
+
+	if to != "" {
+		if toTime, err = time.Parse(time.RFC3339, to); err != nil {
+			return fromTime, toTime, fieldError("to", "Please provide to as an RFC 3339 time")
+		}
+	}
+
+	if !fromTime.IsZero() && !toTime.IsZero() && !fromTime.Before(toTime) {
+		return fromTime, toTime, fieldError("from", "Please provide a from time before the to time")
+	}
+
+	return fromTime, toTime, nil
+}
+
+func validateLoginUser(payload *reqres.LoginRequest) error {
+	var errs fieldErrors
+	if payload.Username == "" {
+		errs.add(fieldError("username", "Please provide an username"))
+	}
+
+	if payload.Password == "" {
+		errs.add(fieldError("password", "Please provide a password"))
+	}
+
+	return errs.err()
+}
+
 func validateRefreshToken(payload *reqres.RefreshTokenRequest) error {
-	if payload.Token == "" {
-		return errors.New("Please provide a token")
+	if payload.RefreshToken == "" {
+		return fieldError("refresh_token", "Please provide a refresh token")
+	}
+
+	if !isWellFormedRefreshToken(payload.RefreshToken) {
+		return fieldError("refresh_token", "Please provide a refresh token as issued at login")
 	}
 
 	return nil
 }
 
+// validateLogout checks the refresh token to end along with the access token,
+// when there is one
+func validateLogout(payload *reqres.LogoutRequest) error {
+	if payload.RefreshToken != "" && !isWellFormedRefreshToken(payload.RefreshToken) {
+		return fieldError("refresh_token", "Please provide a refresh token as issued at login")
+	}
+
+	return nil
+}
+
+func validateTokenRevoked(payload *reqres.TokenRevokedRequest) error {
+	if payload.JTI == "" {
+		return fieldError("jti", "Please provide the jti of a token")
+	}
+
+	return nil
+}
+
+func validateTestWebhook(payload *reqres.TestWebhookRequest) error {
+	if payload.URL == "" {
+		return nil
+	}
+	if u, err := url.Parse(payload.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fieldError("url", "Please provide an absolute http or https URL")
+	}
+
+	return nil
+}
+
+// validatePassword checks a password against the policy. userContext holds
+// the user's username, email and names, which the password may not contain.
+func validatePassword(password string, userContext ...string) error {
+	if password == "" {
+		return fieldError("password", "Please provide a password")
+	}
+
+	// Every rule the password breaks is reported, so it can be fixed in one go
+	var errs fieldErrors
+	if len([]rune(password)) < passwordPolicy.MinLength {
+		errs.add(fieldError("password", fmt.Sprintf("Password must be at least %d characters long", passwordPolicy.MinLength)))
+	}
+
+	for _, class := range passwordPolicy.RequiredClasses {
+		if strings.IndexFunc(password, classMatcher(class)) < 0 {
+			errs.add(fieldError("password", fmt.Sprintf("Password must contain at least one %s character", class)))
+		}
+	}
+
+	if isBannedPassword(password) {
+		errs.add(codedError{code: passwordBannedCode, field: "password", message: "Password is too common, please choose another one"})
+	}
+
+	lowerPassword := strings.ToLower(password)
+	for _, value := range userContext {
+		// Only the local part of an email is worth guessing
+		if at := strings.LastIndex(value, "@"); at >= 0 {
+			value = value[:at]
+		}
+
+		// Very short values would reject too many reasonable passwords
+		value = strings.ToLower(strings.TrimSpace(value))
+		if len([]rune(value)) < 3 {
+			continue
+		}
+
+		if strings.Contains(lowerPassword, value) {
+			errs.add(codedError{code: passwordPersonalInfoCode, field: "password", message: "Password must not contain your username, email or name"})
+			break
+		}
+	}
+
+	return errs.err()
+}
+
+// strongPasswordLength is the length past which a password is considered long
+// enough not to warn about
+const strongPasswordLength = 12
+
+// passwordWarnings returns advice for a password that meets the policy but
+// could still be stronger
+func passwordWarnings(password string) []string {
+	warnings := []string{}
+
+	if len([]rune(password)) < strongPasswordLength {
+		warnings = append(warnings, fmt.Sprintf("Passwords of at least %d characters are harder to guess", strongPasswordLength))
+	}
+
+	classes := 0
+	for _, class := range []string{lowercaseClass, uppercaseClass, digitClass, symbolClass} {
+		if strings.IndexFunc(password, classMatcher(class)) >= 0 {
+			classes++
+		}
+	}
+	if classes < 2 {
+		warnings = append(warnings, "Mixing letters, digits and symbols makes passwords harder to guess")
+	}
+
+	return warnings
+}
+
+// classMatcher returns a function matching the runes of a character class
+func classMatcher(class string) func(rune) bool {
+	switch class {
+	case lowercaseClass:
+		return unicode.IsLower
+	case uppercaseClass:
+		return unicode.IsUpper
+	case digitClass:
+		return unicode.IsDigit
+	default:
+		return func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }
+	}
+}
+
+func isValidPasswordClass(class string) bool {
+	switch class {
+	case lowercaseClass, uppercaseClass, digitClass, symbolClass:
+		return true
+	}
+	return false
+}
+
+// isValidEmail reports whether email is a valid email, which has to be in lower
+// case unless the case of emails is preserved
 func isValidEmail(email string) bool {
+	if preserveEmailCase {
+		email = strings.ToLower(email)
+	}
 	Re := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
 	return Re.MatchString(email)
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/buzzapp/user/model"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	// emailVerification creates accounts people sign up for as pending, until
+	// they confirm their email with the token sent to it
+	emailVerification = false
+
+	// emailVerificationTTL is how long an email verification token can be
+	// used for
+	emailVerificationTTL = 24 * time.Hour
+
+	// allowUnverifiedLogin lets pending accounts log in before their email is
+	// verified
+	allowUnverifiedLogin = false
+
+	// verificationSender delivers email verification tokens to users. Tokens
+	// can't be resent when it's nil.
+	verificationSender VerificationSender
+)
+
+// unverifiedScopes are the most the tokens of users who haven't verified
+// their email yet can do, when they're allowed to log in
+var unverifiedScopes = []string{scopeUsersRead}
+
+var (
+	errNoVerificationSender     = errors.New("no way of delivering email verification tokens is configured")
+	errInvalidVerificationToken = errors.New("invalid, expired or already used email verification token")
+	errUnverifiedScopeDenied    = errors.New("the email of this account has to be verified first")
+)
+
+// VerificationSender is an interface for delivering email verification tokens
+// to users, e.g. as a link in an email
+type VerificationSender interface {
+	SendVerification(user *model.User, token string) error
+}
+
+// logVerificationSender writes tokens to the service log, for development only
+type logVerificationSender struct{}
+
+func (logVerificationSender) SendVerification(user *model.User, token string) error {
+	log.Printf("email verification token for user %s: %s", user.ID, token)
+	return nil
+}
+
+// signupStatus is the status accounts are created with
+func signupStatus() string {
+	if emailVerification {
+		return statusPending
+	}
+	return statusActive
+}
+
+// canLogIn reports whether accounts with status can log in. Only active
+// accounts can, and pending ones when unverified logins are allowed.
+func canLogIn(status string) bool {
+	status = accountStatus(status)
+	return status == statusActive || (status == statusPending && allowUnverifiedLogin)
+}
+
+// isVerified reports whether user verified their email, or never had to
+func isVerified(user *model.User) bool {
+	return accountStatus(user.Status) != statusPending
+}
+
+// tokenScopes returns the scopes of the tokens of a user with role: those of
+// the role, only the ones of unverifiedScopes while unverified
+func tokenScopes(role string, verified bool) []string {
+	if verified {
+		return scopesFor(role)
+	}
+	return missingScopes(scopesFor(role), missingScopes(scopesFor(role), unverifiedScopes))
+}
+
+// unverifiedTokenScopes returns the scopes of the token of an unverified user
+// claims were made for, and whether they were made for one at all
+func unverifiedTokenScopes(claims map[string]interface{}) ([]string, bool) {
+	if verified, ok := claims["verified"].(bool); !ok || verified {
+		return nil, false
+	}
+	return claimScopes(claims), true
+}
+
+// emailVerificationCollection returns the collection of email verifications,
+// making sure the database drops expired ones. Tokens are random like refresh
+// tokens, so they are generated and stored hashed the same way.
+func emailVerificationCollection(session *mgo.Session) (*mgo.Collection, error) {
+	collection := session.DB("buzz-test-user").C("email_verifications")
+
+	index := mgo.Index{
+		Key:         []string{"expires_at"},
+		ExpireAfter: time.Second,
+	}
+	if err := collection.EnsureIndex(index); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+// issueEmailVerification sends user a new email verification token, which
+// replaces the pending ones
+func issueEmailVerification(session *mgo.Session, user *model.User) error {
+	if verificationSender == nil {
+		return errNoVerificationSender
+	}
+
+	token, err := newRefreshToken()
+	if err != nil {
+		return err
+	}
+
+	collection, err := emailVerificationCollection(session)
+	if err != nil {
+		return err
+	}
+	if _, err := collection.RemoveAll(bson.M{"user_id": user.ID}); err != nil {
+		return err
+	}
+	now := time.Now()
+	verification := &model.EmailVerification{
+		ID:        hashRefreshToken(token),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(emailVerificationTTL),
+	}
+	if err := collection.Insert(verification); err != nil {
+		return err
+	}
+
+	if err := verificationSender.SendVerification(user, token); err != nil {
+		collection.RemoveId(verification.ID)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buzzapp/user/model"
+)
+
+func TestCanLogIn(t *testing.T) {
+	defer func(allow bool) { allowUnverifiedLogin = allow }(allowUnverifiedLogin)
+
+	allowUnverifiedLogin = false
+	if !canLogIn(statusActive) || !canLogIn("") {
+		t.Error("Expected active accounts to log in")
+	}
+	if canLogIn(statusPending) || canLogIn(statusLocked) {
+		t.Error("Expected pending and locked accounts not to log in")
+	}
+
+	allowUnverifiedLogin = true
+	if !canLogIn(statusPending) {
+		t.Error("Expected pending accounts to log in when unverified logins are allowed")
+	}
+	if canLogIn(statusDeactivated) {
+		t.Error("Expected deactivated accounts not to log in either way")
+	}
+}
+
+// capturingVerificationSender remembers the last email verification token it
+// was asked to deliver
+type capturingVerificationSender struct {
+	token string
+}
+
+func (s *capturingVerificationSender) SendVerification(user *model.User, token string) error {
+	s.token = token
+	return nil
+}
+
+func TestEmailVerification(t *testing.T) {
+	defer func(enabled bool, sender VerificationSender) {
+		emailVerification, verificationSender = enabled, sender
+	}(emailVerification, verificationSender)
+	sender := &capturingVerificationSender{}
+	emailVerification, verificationSender = true, sender
+
+	svc := userService{}
+	user, err := svc.Create(context.Background(), &model.CreateUser{Email: "verify@test.com", FirstName: "verify", LastName: "user", Password: password, Username: "verifyUser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Remove(context.Background(), user.ID)
+
+	if user.Status != statusPending || sender.token == "" {
+		t.Fatalf("Expected a pending account and a verification token but got: %q %q", user.Status, sender.token)
+	}
+	if _, err := svc.Login(context.Background(), "verifyUser", password, ""); err != errInvalidCredentials {
+		t.Errorf("Expected an unverified account not to log in but got: %v", err)
+	}
+
+	// Resending replaces the token
+	first := sender.token
+	resend := httptest.NewRecorder()
+	handleResendVerification(svc).ServeHTTP(resend, httptest.NewRequest("POST", "/users/verify/resend", strings.NewReader(`{"email": "verify@test.com"}`)))
+	if resend.Code != http.StatusOK || sender.token == first {
+		t.Fatalf("Expected a new token to be sent but got: %d", resend.Code)
+	}
+
+	verify := func(token string) int {
+		rec := httptest.NewRecorder()
+		handleVerifyEmail(svc).ServeHTTP(rec, httptest.NewRequest("GET", "/users/verify?token="+token, nil))
+		return rec.Code
+	}
+	if code := verify(first); code != http.StatusBadRequest {
+		t.Errorf("Expected a replaced token to be refused but got: %d", code)
+	}
+	if code := verify(sender.token); code != http.StatusOK {
+		t.Fatalf("Expected a 200 status code response but got: %d", code)
+	}
+	if _, err := svc.Login(context.Background(), "verifyUser", password, ""); err != nil {
+		t.Errorf("Expected a verified account to log in but got: %v", err)
+	}
+
+	// Following a used link again finds the email verified
+	if code := verify(sender.token); code != http.StatusOK {
+		t.Errorf("Expected a used token of a verified account to be accepted but got: %d", code)
+	}
+	if code := verify("unknownToken"); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown token to be refused but got: %d", code)
+	}
+
+	// Expired tokens are refused, used or not
+	session, err := getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	expired := time.Now().Add(-time.Minute)
+	err = session.DB("buzz-test-user").C("email_verifications").Insert(&model.EmailVerification{ID: hashRefreshToken("expiredToken"), UserID: user.ID, CreatedAt: expired, ExpiresAt: expired, UsedAt: &expired})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := verify("expiredToken"); code != http.StatusBadRequest {
+		t.Errorf("Expected an expired token to be refused but got: %d", code)
+	}
+
+	// Unless the account isn't active anymore
+	if _, err := svc.SetStatus(context.Background(), user.ID, statusLocked); err != nil {
+		t.Fatal(err)
+	}
+	if code := verify(sender.token); code != http.StatusBadRequest {
+		t.Errorf("Expected a used token of a locked account to be refused but got: %d", code)
+	}
+}
+
+func TestUnverifiedToken(t *testing.T) {
+	token, err := generateSessionToken("adminID", "unverifiedAdmin", "admin", "", "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := authMiddleware(requireRoles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "admin"))
+	reading := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if verified, ok := claimsFromContext(r)["verified"].(bool); !ok || verified {
+			t.Errorf("Expected the token to say it's unverified but got: %v", claimsFromContext(r)["verified"])
+		}
+	}))
+
+	// Unverified users can only read, whatever their role
+	for _, test := range []struct {
+		handler http.Handler
+		method  string
+		code    int
+	}{
+		{reading, "GET", http.StatusOK},
+		{reading, "PUT", http.StatusForbidden},
+		{handler, "GET", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(test.method, "/users/adminID", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		test.handler.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("Expected a %d status code response to %s but got: %d", test.code, test.method, rec.Code)
+		}
+	}
+
+	if scopes := tokenScopes("admin", false); len(scopes) != 1 || scopes[0] != scopeUsersRead {
+		t.Errorf("Expected only the unverified scopes but got: %v", scopes)
+	}
+	if scopes := tokenScopes("admin", true); len(scopes) != len(scopesFor("admin")) {
+		t.Errorf("Expected every scope of the role but got: %v", scopes)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/buzzapp/user/model"
+)
+
+// When users are welcomed, picked with -welcome-emails
+const (
+	welcomeOff      = "off"
+	welcomeSignup   = "signup"
+	welcomeVerified = "verified"
+)
+
+// defaultWelcomeLocale is the locale of the built-in welcome email, and what
+// users get when there is no template in theirs
+const defaultWelcomeLocale = "en"
+
+// defaultWelcomeEmail is the email users are welcomed with, unless templates
+// of our own are configured
+const defaultWelcomeEmail = `Hi {{.FirstName}},
+
+Welcome to Buzz! Your account {{.Username}} is ready to use.
+`
+
+var (
+	// welcomeEmails is when users are sent a welcome email: on signup, once
+	// their email is verified, or never
+	welcomeEmails = welcomeOff
+
+	// welcomeEmailTemplates render the welcome email by locale, given a
+	// welcomeEmail
+	welcomeEmailTemplates = map[string]*template.Template{
+		defaultWelcomeLocale: template.Must(template.New("welcome").Parse(defaultWelcomeEmail)),
+	}
+
+	// welcomeEmailSender delivers welcome emails to users. Welcome emails
+	// aren't sent when it's nil.
+	welcomeEmailSender WelcomeEmailSender
+)
+
+// WelcomeEmailSender is an interface for delivering welcome emails to users
+type WelcomeEmailSender interface {
+	SendWelcomeEmail(user *model.User, email string) error
+}
+
+// logWelcomeEmailSender writes welcome emails to the service log, for
+// development only
+type logWelcomeEmailSender struct{}
+
+func (logWelcomeEmailSender) SendWelcomeEmail(user *model.User, email string) error {
+	log.Printf("welcome email for user %s:\n%s", user.ID, email)
+	return nil
+}
+
+// welcomeEmail is what welcome email templates are rendered with
+type welcomeEmail struct {
+	Username  string
+	FirstName string
+	LastName  string
+}
+
+func isValidWelcomeEmails(when string) bool {
+	return when == welcomeOff || when == welcomeSignup || when == welcomeVerified
+}
+
+// parseWelcomeEmailTemplates reads the welcome email templates in dir, one per
+// locale named after it, e.g. pt-BR.tmpl. The built-in email stays the one of
+// the default locale unless dir has its own.
+func parseWelcomeEmailTemplates(dir string) (map[string]*template.Template, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]*template.Template{defaultWelcomeLocale: welcomeEmailTemplates[defaultWelcomeLocale]}
+	for _, path := range paths {
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		locale := strings.TrimSuffix(filepath.Base(path), ".tmpl")
+		if templates[locale], err = template.New("welcome").Parse(string(text)); err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
+
+// localizedTemplate returns the template of templates for locale, falling
+// back on its language and then on the default locale
+func localizedTemplate(templates map[string]*template.Template, locale string) *template.Template {
+	if tmpl, ok := templates[locale]; ok {
+		return tmpl
+	}
+	if i := strings.Index(locale, "-"); i > 0 {
+		if tmpl, ok := templates[locale[:i]]; ok {
+			return tmpl
+		}
+	}
+	return templates[defaultWelcomeLocale]
+}
+
+// welcomeOnSignup welcomes a user that just signed up, when they are welcomed
+// on signup or have nothing left to verify. Invited users are welcomed once
+// they accept.
+func welcomeOnSignup(user *model.User) {
+	switch {
+	case user.Status == statusInvited:
+	case welcomeEmails == welcomeSignup, welcomeEmails == welcomeVerified && user.Status != statusPending:
+		sendWelcomeEmail(user)
+	}
+}
+
+// welcomeOnVerification welcomes a user whose email was just verified, when
+// that is when they are welcomed
+func welcomeOnVerification(user *model.User) {
+	if welcomeEmails == welcomeVerified {
+		sendWelcomeEmail(user)
+	}
+}
+
+// welcomeOnAcceptance welcomes an invited user that just accepted, which
+// verified their email too
+func welcomeOnAcceptance(user *model.User) {
+	if welcomeEmails != welcomeOff {
+		sendWelcomeEmail(user)
+	}
+}
+
+// sendWelcomeEmail sends user the welcome email in their locale. It is best
+// effort: the signup is done either way.
+func sendWelcomeEmail(user *model.User) {
+	if welcomeEmailSender == nil {
+		return
+	}
+
+	var email bytes.Buffer
+	data := welcomeEmail{Username: user.Username, FirstName: user.FirstName, LastName: user.LastName}
+	if err := localizedTemplate(welcomeEmailTemplates, user.Locale).Execute(&email, data); err != nil {
+		log.Println("unable to send welcome email:", err)
+		return
+	}
+	if err := welcomeEmailSender.SendWelcomeEmail(user, email.String()); err != nil {
+		log.Println("unable to send welcome email:", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buzzapp/user/model"
+)
+
+// failingWelcomeEmailSender records the welcome emails it is asked to send,
+// failing to send any
+type failingWelcomeEmailSender struct {
+	emails []string
+}
+
+func (s *failingWelcomeEmailSender) SendWelcomeEmail(user *model.User, email string) error {
+	s.emails = append(s.emails, email)
+	return errors.New("mail server unreachable")
+}
+
+func TestSignupSucceedsWhenWelcomeEmailFails(t *testing.T) {
+	defer func(repo UserRepository, when string, sender WelcomeEmailSender) {
+		userRepository, welcomeEmails, welcomeEmailSender = repo, when, sender
+	}(userRepository, welcomeEmails, welcomeEmailSender)
+	userRepository = newMemoryUserRepository()
+	sender := &failingWelcomeEmailSender{}
+	welcomeEmails, welcomeEmailSender = welcomeSignup, sender
+
+	body := `{"email":"welcome@test.com","first_name":"Wendy","last_name":"user","password":"` + password + `","username":"welcomeUser"}`
+	rec := httptest.NewRecorder()
+	handleCreateUser(userService{}).ServeHTTP(rec, httptest.NewRequest("POST", CreateUserPath, strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected a 201 status code response but got: %d %s", rec.Code, rec.Body)
+	}
+	if len(sender.emails) != 1 || !strings.Contains(sender.emails[0], "Hi Wendy") {
+		t.Errorf("Expected a welcome email to be attempted but got: %v", sender.emails)
+	}
+}
+
+func TestWelcomeOnSignup(t *testing.T) {
+	defer func(when string, sender WelcomeEmailSender) {
+		welcomeEmails, welcomeEmailSender = when, sender
+	}(welcomeEmails, welcomeEmailSender)
+
+	for _, test := range []struct {
+		when    string
+		status  string
+		welcome bool
+	}{
+		{welcomeOff, statusActive, false},
+		{welcomeSignup, statusActive, true},
+		{welcomeSignup, statusPending, true},
+		{welcomeSignup, statusInvited, false},
+		{welcomeVerified, statusActive, true},
+		{welcomeVerified, statusPending, false},
+	} {
+		sender := &failingWelcomeEmailSender{}
+		welcomeEmails, welcomeEmailSender = test.when, sender
+		welcomeOnSignup(&model.User{ID: "1", Status: test.status})
+		if welcomed := len(sender.emails) == 1; welcomed != test.welcome {
+			t.Errorf("Expected a %s user to be welcomed on %s to be %t but got: %t", test.status, test.when, test.welcome, welcomed)
+		}
+	}
+}
+
+func TestLocalizedWelcomeEmailTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "welcome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "pt.tmpl"), []byte("Olá {{.FirstName}}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := parseWelcomeEmailTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(locale string) string {
+		var email strings.Builder
+		if err := localizedTemplate(templates, locale).Execute(&email, welcomeEmail{FirstName: "Ana"}); err != nil {
+			t.Fatal(err)
+		}
+		return email.String()
+	}
+
+	// Users get their language, else the default
+	if email := render("pt-BR"); email != "Olá Ana" {
+		t.Errorf("Expected the Portuguese welcome email but got: %s", email)
+	}
+	if email := render("fr"); !strings.HasPrefix(email, "Hi Ana") {
+		t.Errorf("Expected the built-in welcome email but got: %s", email)
+	}
+	if _, ok := templates[defaultWelcomeLocale]; !ok {
+		t.Errorf("Expected the built-in template to stay the default but got: %v", templates)
+	}
+}